@@ -0,0 +1,411 @@
+package guerrilla
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeRenewBefore is how long before they expire that the DNS-01 certificates are renewed
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmeRetryInterval is how long a failed DNS-01 request waits to be tried again
+var acmeRetryInterval = time.Hour
+
+// acmeTimeout limits the time to get a certificate
+const acmeTimeout = 10 * time.Minute
+
+// validateACME checks the acme_* options
+func (stc *ServerTLSConfig) validateACME() error {
+	if len(stc.ACMEHosts) == 0 {
+		return nil
+	}
+	if stc.ACMECacheDir == "" {
+		return errors.New("acme_cache_dir is required")
+	}
+	if (stc.ACMEHTTPListen == "") == (stc.ACMEDNSHook == "") {
+		return errors.New("either acme_http_listen or acme_dns_hook is required")
+	}
+	for _, host := range stc.ACMEHosts {
+		if strings.HasPrefix(host, "*.") && stc.ACMEDNSHook == "" {
+			return fmt.Errorf("the wildcard host %s needs acme_dns_hook", host)
+		}
+	}
+	return nil
+}
+
+// acmeManager gets the certificates of its hosts from an ACME CA, and renews them
+type acmeManager struct {
+	hosts []string
+	// get returns the certificate for the hello
+	get func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+var acmeManagers = struct {
+	sync.Mutex
+	// the managers by their config. They're kept for the life of the process, so that a
+	// reload doesn't ask for the certificates again
+	m map[string]*acmeManager
+}{m: make(map[string]*acmeManager)}
+
+// useACME returns the manager of the acme_* options, and starts getting the certificates
+func useACME(sConfig *ServerTLSConfig, l log.Logger) (*acmeManager, error) {
+	if err := sConfig.validateACME(); err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(sConfig.ACMEHosts))
+	for i, host := range sConfig.ACMEHosts {
+		hosts[i] = strings.ToLower(strings.TrimSpace(host))
+	}
+	directory := sConfig.ACMEDirectory
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+	key := fmt.Sprintf("%v %s %s %s %s %s",
+		hosts, sConfig.ACMEEmail, directory, sConfig.ACMECacheDir, sConfig.ACMEHTTPListen, sConfig.ACMEDNSHook)
+	acmeManagers.Lock()
+	defer acmeManagers.Unlock()
+	if m, ok := acmeManagers.m[key]; ok {
+		return m, nil
+	}
+	if err := os.MkdirAll(sConfig.ACMECacheDir, 0700); err != nil {
+		return nil, err
+	}
+	m := &acmeManager{hosts: hosts}
+	if sConfig.ACMEDNSHook != "" {
+		d := &acmeDNS{
+			client:   &acme.Client{DirectoryURL: directory},
+			hosts:    hosts,
+			email:    sConfig.ACMEEmail,
+			cacheDir: sConfig.ACMECacheDir,
+			hook:     sConfig.ACMEDNSHook,
+			log:      l,
+		}
+		d.loadCached()
+		go d.run()
+		m.get = d.getCertificate
+	} else {
+		am := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(sConfig.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      sConfig.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: directory},
+		}
+		if err := acmeHTTPHandle(sConfig.ACMEHTTPListen, hosts, am.HTTPHandler(nil), l); err != nil {
+			return nil, err
+		}
+		m.get = am.GetCertificate
+		// get them now, rather than with the first handshake
+		for _, host := range hosts {
+			go func(host string) {
+				if _, err := am.GetCertificate(&tls.ClientHelloInfo{ServerName: host}); err != nil {
+					l.WithError(err).Errorf("failed to get the certificate of %s with ACME", host)
+				}
+			}(host)
+		}
+	}
+	acmeManagers.m[key] = m
+	return m, nil
+}
+
+// covers returns true if the name is one of the hosts, or matches a wildcard host
+func (m *acmeManager) covers(name string) bool {
+	for _, host := range m.hosts {
+		if host == name || (strings.HasPrefix(host, "*.") && strings.HasSuffix(name, host[1:]) &&
+			!strings.Contains(strings.TrimSuffix(name, host[1:]), ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificate returns the certificate of the name the client asks for, or of the first host
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if !m.covers(name) {
+		h := *hello
+		h.ServerName = strings.TrimPrefix(m.hosts[0], "*.")
+		hello = &h
+	}
+	return m.get(hello)
+}
+
+// acmeHTTP answers the HTTP-01 challenges on an interface, for the hosts of the managers using it
+type acmeHTTP struct {
+	sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+var acmeHTTPServers = struct {
+	sync.Mutex
+	m map[string]*acmeHTTP
+}{m: make(map[string]*acmeHTTP)}
+
+// acmeHTTPHandle answers the challenges of the hosts with the handler, on the interface
+func acmeHTTPHandle(iface string, hosts []string, handler http.Handler, l log.Logger) error {
+	acmeHTTPServers.Lock()
+	defer acmeHTTPServers.Unlock()
+	a, ok := acmeHTTPServers.m[iface]
+	if !ok {
+		ln, err := net.Listen("tcp", iface)
+		if err != nil {
+			return fmt.Errorf("acme_http_listen: %s", err)
+		}
+		a = &acmeHTTP{handlers: make(map[string]http.Handler)}
+		acmeHTTPServers.m[iface] = a
+		go func() {
+			err := (&http.Server{Handler: a, ReadTimeout: 10 * time.Second}).Serve(ln)
+			l.WithError(err).Errorf("stopped answering the ACME challenges on %s", iface)
+		}()
+	}
+	a.Lock()
+	defer a.Unlock()
+	for _, host := range hosts {
+		a.handlers[host] = handler
+	}
+	return nil
+}
+
+func (a *acmeHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	a.RLock()
+	handler, ok := a.handlers[strings.ToLower(host)]
+	a.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// acmeDNS gets one certificate for all the hosts with DNS-01 challenges, answered by the hook
+type acmeDNS struct {
+	sync.RWMutex
+	client   *acme.Client
+	hosts    []string
+	email    string
+	cacheDir string
+	hook     string
+	cert     *tls.Certificate
+	log      log.Logger
+}
+
+// certFile is where the key and the certificate are kept
+func (d *acmeDNS) certFile() string {
+	return filepath.Join(d.cacheDir, "dns01_"+strings.Replace(d.hosts[0], "*", "_", 1)+".pem")
+}
+
+// loadCached uses the certificate of a previous run, when it has all the hosts
+func (d *acmeDNS) loadCached() {
+	data, err := ioutil.ReadFile(d.certFile())
+	if err != nil {
+		return
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		d.log.WithError(err).Errorf("failed to read %s", d.certFile())
+		return
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return
+	}
+	for _, host := range d.hosts {
+		if cert.Leaf.VerifyHostname(strings.Replace(host, "*", "x", 1)) != nil {
+			return
+		}
+	}
+	d.cert = &cert
+}
+
+// due returns true when there's no certificate, or it's time to renew it
+func (d *acmeDNS) due() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.cert == nil || time.Until(d.cert.Leaf.NotAfter) < acmeRenewBefore
+}
+
+// run gets the certificate when it's due, for the life of the process
+func (d *acmeDNS) run() {
+	for {
+		wait := 12 * time.Hour
+		if d.due() {
+			ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+			if err := d.obtain(ctx); err != nil {
+				d.log.WithError(err).Errorf("failed to get the certificate of %v with ACME", d.hosts)
+				wait = acmeRetryInterval
+			} else {
+				d.log.Infof("got the certificate of %v with ACME", d.hosts)
+			}
+			cancel()
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (d *acmeDNS) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.cert == nil {
+		return nil, fmt.Errorf("no certificate of %v yet", d.hosts)
+	}
+	return d.cert, nil
+}
+
+// accountKey reads the key of the ACME account, or creates it
+func (d *acmeDNS) accountKey() (crypto.Signer, error) {
+	file := filepath.Join(d.cacheDir, "dns01_account.key")
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+		return nil, fmt.Errorf("no key in %s", file)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// obtain orders the certificate, answers the challenges and keeps the certificate
+func (d *acmeDNS) obtain(ctx context.Context) error {
+	if d.client.Key == nil {
+		key, err := d.accountKey()
+		if err != nil {
+			return err
+		}
+		d.client.Key = key
+		account := &acme.Account{}
+		if d.email != "" {
+			account.Contact = []string{"mailto:" + d.email}
+		}
+		if _, err := d.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+			d.client.Key = nil
+			return err
+		}
+	}
+	order, err := d.client.AuthorizeOrder(ctx, acme.DomainIDs(d.hosts...))
+	if err != nil {
+		return err
+	}
+	for _, u := range order.AuthzURLs {
+		if err := d.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if order, err = d.client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: d.hosts[0]},
+		DNSNames: d.hosts,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := d.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+	return d.keep(chain, key)
+}
+
+// authorize answers the DNS-01 challenge of the authorization
+func (d *acmeDNS) authorize(ctx context.Context, u string) error {
+	z, err := d.client.GetAuthorization(ctx, u)
+	if err != nil || z.Status == acme.StatusValid {
+		return err
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + z.Identifier.Value + "."
+	if err := runACMEDNSHook(ctx, d.hook, "present", name, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := runACMEDNSHook(ctx, d.hook, "cleanup", name, value); err != nil {
+			d.log.WithError(err).Warnf("failed to clean up the challenge of %s", z.Identifier.Value)
+		}
+	}()
+	if _, err := d.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = d.client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// keep uses the certificate, and saves it with its key for the next run
+func (d *acmeDNS) keep(chain [][]byte, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	cert := &tls.Certificate{Certificate: chain, PrivateKey: key}
+	if cert.Leaf, err = x509.ParseCertificate(chain[0]); err != nil {
+		return err
+	}
+	d.Lock()
+	d.cert = cert
+	d.Unlock()
+	return ioutil.WriteFile(d.certFile(), buf.Bytes(), 0600)
+}
+
+// runACMEDNSHook runs the acme_dns_hook command with the action, the name of the TXT record and
+// its value
+func runACMEDNSHook(ctx context.Context, hook, action, name, value string) error {
+	out, err := exec.CommandContext(ctx, hook, action, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("acme_dns_hook %s %s: %s %s", action, name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
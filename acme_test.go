@@ -0,0 +1,141 @@
+package guerrilla
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestACMEConfig(t *testing.T) {
+	for _, stc := range []ServerTLSConfig{
+		{ACMEHosts: []string{"mail.example.com"}, ACMEHTTPListen: ":80"},
+		{ACMEHosts: []string{"mail.example.com"}, ACMECacheDir: "acme"},
+		{ACMEHosts: []string{"mail.example.com"}, ACMECacheDir: "acme", ACMEHTTPListen: ":80", ACMEDNSHook: "hook"},
+		{ACMEHosts: []string{"*.example.com"}, ACMECacheDir: "acme", ACMEHTTPListen: ":80"},
+	} {
+		if err := stc.validateACME(); err == nil {
+			t.Error("expected the config to be refused", stc)
+		}
+	}
+	stc := ServerTLSConfig{ACMEHosts: []string{"*.example.com"}, ACMECacheDir: "acme", ACMEDNSHook: "hook"}
+	if err := stc.validateACME(); err != nil {
+		t.Error(err)
+	}
+
+	m := &acmeManager{hosts: []string{"mail.example.com", "*.example.org"}}
+	for name, want := range map[string]bool{
+		"mail.example.com":  true,
+		"mx.example.org":    true,
+		"example.org":       false,
+		"a.mx.example.org":  false,
+		"other.example.com": false,
+		"mxexample.org":     false,
+	} {
+		if m.covers(name) != want {
+			t.Errorf("expected covers(%q) to be %v", name, want)
+		}
+	}
+}
+
+func TestACMEHTTP(t *testing.T) {
+	a := &acmeHTTP{handlers: map[string]http.Handler{
+		"mail.example.com": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("token"))
+		}),
+	}}
+	for host, want := range map[string]int{"mail.example.com": 200, "MAIL.example.com:80": 200, "other.example.com": 404} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", "http://"+host+"/.well-known/acme-challenge/x", nil))
+		if w.Code != want {
+			t.Errorf("expected %d for %s, got %d", want, host, w.Code)
+		}
+	}
+}
+
+func TestACMEDNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	hosts := []string{"mail.example.com", "*.example.org"}
+
+	// the hook gets the action, the name of the record and its value
+	calls := filepath.Join(dir, "calls")
+	hook := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runACMEDNSHook(context.Background(), hook, "present", "_acme-challenge.example.org.", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(calls); string(data) != "present _acme-challenge.example.org. value\n" {
+		t.Error("unexpected hook arguments", string(data))
+	}
+	if err := runACMEDNSHook(context.Background(), filepath.Join(dir, "missing"), "present", "x", "y"); err == nil {
+		t.Error("expected a missing hook to fail")
+	}
+
+	// a certificate of a previous run is used while it's renewed
+	ca := newTestCertCA(t, "test CA")
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: hosts[0]}, DNSNames: hosts})
+	d := &acmeDNS{hosts: hosts, cacheDir: dir, log: mainlog}
+	if err := d.keep(cert.Certificate, cert.PrivateKey.(*ecdsa.PrivateKey)); err != nil {
+		t.Fatal(err)
+	}
+	if !d.due() {
+		t.Error("expected a certificate expiring within a month to be due")
+	}
+	// the CA can't be reached
+	ca2 := httptest.NewServer(http.NotFoundHandler())
+	defer ca2.Close()
+	defer func(interval time.Duration) {
+		acmeRetryInterval = interval
+	}(acmeRetryInterval)
+	acmeRetryInterval = time.Hour
+	m, err := useACME(&ServerTLSConfig{
+		ACMEHosts:     hosts,
+		ACMECacheDir:  dir,
+		ACMEDirectory: ca2.URL,
+		ACMEDNSHook:   hook,
+	}, mainlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mail.example.com", "mx.example.org", ""} {
+		got, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil || got.Leaf == nil || got.Leaf.Subject.CommonName != "mail.example.com" {
+			t.Errorf("expected the cached certificate for %q, got %v", name, err)
+		}
+	}
+	if other, _ := useACME(&ServerTLSConfig{
+		ACMEHosts:     hosts,
+		ACMECacheDir:  dir,
+		ACMEDirectory: ca2.URL,
+		ACMEDNSHook:   hook,
+	}, mainlog); other != m {
+		t.Error("expected the manager to be shared")
+	}
+
+	// a cached certificate without all the hosts is requested again
+	d = &acmeDNS{hosts: append(hosts, "new.example.com"), cacheDir: dir, log: mainlog}
+	d.loadCached()
+	if _, err := d.getCertificate(nil); err == nil || !strings.Contains(err.Error(), "no certificate") {
+		t.Error("expected the cached certificate not to be used, got", err)
+	}
+}
@@ -0,0 +1,504 @@
+package guerrilla
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+// AdminConfig configures the admin HTTP API
+type AdminConfig struct {
+	// ListenInterface is where the API listens, eg. "127.0.0.1:8025". The API is off when empty.
+	// Changes take effect after a restart
+	ListenInterface string `json:"listen_interface,omitempty"`
+	// Token gives access to everything. Requests must send it in the
+	// Authorization header, as "Bearer <token>". See also TenantConfig.AdminToken
+	Token string `json:"token,omitempty"`
+}
+
+// AdminHandler handles a request to the admin API. tenant is the tenant that the request's
+// token belongs to, the handler must only return that tenant's data.
+// It's empty for the admin token, which gives access to everything
+type AdminHandler func(w http.ResponseWriter, r *http.Request, tenant string)
+
+// adminHandlers are the endpoints of the admin API, by path
+type adminHandlers struct {
+	sync.RWMutex
+	m map[string]AdminHandler
+}
+
+func newAdminHandlers() *adminHandlers {
+	return &adminHandlers{m: make(map[string]AdminHandler)}
+}
+
+// newAdminHandlers returns the built-in endpoints of the admin API
+func (g *guerrilla) newAdminHandlers() *adminHandlers {
+	hs := newAdminHandlers()
+	for path, h := range map[string]AdminHandler{
+		"/certificates": g.adminCertificates,
+		"/console":      g.adminConsole,
+		"/deliveries":   adminDeliveries,
+		"/import":       g.adminImport,
+		"/maintenance":  adminMaintenance,
+		"/metrics":      g.adminMetrics,
+		"/retention":    adminRetention,
+		"/search":       adminSearch,
+		"/servers":      g.adminServers,
+		"/stats":        g.adminStats,
+		"/suppressions": adminSuppressions,
+	} {
+		hs.m[path] = h
+	}
+	return hs
+}
+
+// add adds the handler for the path, replacing any handler with the same path
+func (hs *adminHandlers) add(path string, h AdminHandler) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.m[path] = h
+}
+
+// get returns the handler for the path
+func (hs *adminHandlers) get(path string) (AdminHandler, bool) {
+	hs.RLock()
+	defer hs.RUnlock()
+	h, ok := hs.m[path]
+	return h, ok
+}
+
+// addAll adds the handlers of other, replacing those with the same path
+func (hs *adminHandlers) addAll(other *adminHandlers) {
+	other.RLock()
+	defer other.RUnlock()
+	for path, h := range other.m {
+		hs.add(path, h)
+	}
+}
+
+// AddAdminHandler adds an endpoint to the admin API, eg. "/quarantine".
+// It replaces any handler with the same path, including the built-in ones.
+// The endpoints are the daemon's, they can be added before or after it's started
+func (d *Daemon) AddAdminHandler(path string, h AdminHandler) {
+	if d.adminHandlers == nil {
+		d.adminHandlers = newAdminHandlers()
+	}
+	d.adminHandlers.add(path, h)
+}
+
+// writeAdminJSON sends v as the JSON response
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError sends an error as the JSON response
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	writeAdminJSON(w, code, map[string]string{"error": msg})
+}
+
+// adminDeliveries looks up the delivery records by QueuedId or Message-ID, GET /deliveries?id=<id>
+func adminDeliveries(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	store := backends.Deliveries
+	if store == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "delivery tracking is off, see delivery_tracking_size")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeAdminError(w, http.StatusBadRequest, "the id parameter is required, a queued id or Message-ID")
+		return
+	}
+	records := make([]backends.DeliveryRecord, 0)
+	for _, rec := range store.Lookup(id) {
+		if tenant == "" || rec.Tenant == tenant {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		writeAdminError(w, http.StatusNotFound, "no deliveries found for "+id)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, records)
+}
+
+// adminMaintenance lists the maintenance jobs with GET /maintenance, and runs one now with
+// POST /maintenance?job=<name>. Only the admin token may use it
+func adminMaintenance(w http.ResponseWriter, r *http.Request, tenant string) {
+	if tenant != "" {
+		writeAdminError(w, http.StatusForbidden, "requires the admin token")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, backends.MaintenanceJobs())
+	case http.MethodPost:
+		job := r.URL.Query().Get("job")
+		if job == "" {
+			writeAdminError(w, http.StatusBadRequest, "the job parameter is required")
+			return
+		}
+		found := false
+		for _, name := range backends.MaintenanceJobs() {
+			found = found || strings.EqualFold(name, job)
+		}
+		if !found {
+			writeAdminError(w, http.StatusNotFound, "no maintenance job "+job)
+			return
+		}
+		if err := backends.RunMaintenanceJob(job); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"job": job, "status": "done"})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// adminRetention runs the retention job. GET /retention returns a dry run report,
+// POST /retention removes the expired mail now. Only the admin token may use it
+func adminRetention(w http.ResponseWriter, r *http.Request, tenant string) {
+	if tenant != "" {
+		writeAdminError(w, http.StatusForbidden, "requires the admin token")
+		return
+	}
+	job := backends.Retention
+	if job == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "retention is off, see retention_interval")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, job.Run(true))
+	case http.MethodPost:
+		writeAdminJSON(w, http.StatusOK, job.Run(false))
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// adminSearch searches the index kept by the searchindex processor,
+// GET /search?q=<query string>&from=&to=&subject=&body=&limit=. The admin token may also set tenant=
+func adminSearch(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	index := backends.SearchIndex
+	if index == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "there is no search index, see the searchindex processor")
+		return
+	}
+	params := r.URL.Query()
+	q := backends.MailQuery{
+		Text:    params.Get("q"),
+		From:    params.Get("from"),
+		To:      params.Get("to"),
+		Subject: params.Get("subject"),
+		Body:    params.Get("body"),
+		Tenant:  tenant,
+	}
+	if tenant == "" {
+		q.Tenant = params.Get("tenant")
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeAdminError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		q.Limit = n
+	}
+	hits, err := index.Search(q)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, hits)
+}
+
+// adminSuppressionRequest is the body of POST /suppressions
+type adminSuppressionRequest struct {
+	Address string                     `json:"address"`
+	Reason  backends.SuppressionReason `json:"reason,omitempty"`
+	Detail  string                     `json:"detail,omitempty"`
+	// TTL is how long to suppress the address, eg. "720h". Defaults to the TTL of the reason
+	TTL string `json:"ttl,omitempty"`
+	// Tenant can only be set with the admin token
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// adminSuppressions manages the suppression list. GET /suppressions lists the addresses,
+// or looks one up with ?address=, POST adds an address and DELETE /suppressions?address=
+// removes one. The admin token may also set tenant=
+func adminSuppressions(w http.ResponseWriter, r *http.Request, tenant string) {
+	list := backends.Suppressions
+	params := r.URL.Query()
+	forTenant := tenant
+	if tenant == "" {
+		forTenant = params.Get("tenant")
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if address := params.Get("address"); address != "" {
+			s, ok := list.Suppressed(forTenant, address)
+			if !ok {
+				writeAdminError(w, http.StatusNotFound, address+" is not suppressed")
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, s)
+			return
+		}
+		_, filtered := params["tenant"]
+		writeAdminJSON(w, http.StatusOK, list.List(forTenant, tenant == "" && !filtered))
+	case http.MethodPost:
+		var req adminSuppressionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		s := backends.Suppression{Address: req.Address, Reason: req.Reason, Detail: req.Detail, Tenant: tenant}
+		if tenant == "" {
+			s.Tenant = req.Tenant
+		}
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeAdminError(w, http.StatusBadRequest, "invalid ttl "+req.TTL)
+				return
+			}
+			expires := time.Now().Add(ttl)
+			s.Expires = &expires
+		}
+		if err := list.Add(s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s, _ = list.Suppressed(s.Tenant, s.Address)
+		writeAdminJSON(w, http.StatusCreated, s)
+	case http.MethodDelete:
+		address := params.Get("address")
+		if address == "" {
+			writeAdminError(w, http.StatusBadRequest, "the address parameter is required")
+			return
+		}
+		removed, err := list.Remove(forTenant, address)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !removed {
+			writeAdminError(w, http.StatusNotFound, address+" is not suppressed")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]bool{"removed": true})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
+
+// ServerStatus is the state of a server, as listed by GET /servers
+type ServerStatus struct {
+	Server        string `json:"server"`
+	State         string `json:"state"`
+	ActiveClients int    `json:"active_clients"`
+}
+
+// defaultDrainGrace is how long the clients of a drained server get to finish
+const defaultDrainGrace = time.Second * 30
+
+var serverStateNames = map[int]string{
+	ServerStateNew:        "new",
+	ServerStateStopped:    "stopped",
+	ServerStateRunning:    "running",
+	ServerStateStartError: "start_error",
+	ServerStateDraining:   "draining",
+}
+
+func serverStatus(s *server) ServerStatus {
+	return ServerStatus{Server: s.listenInterface, State: serverStateNames[s.getState()], ActiveClients: s.GetActiveClientsCount()}
+}
+
+// adminServers lists the servers with GET /servers. POST /servers?server=<listen_interface>&action=drain
+// stops accepting clients on the server and gives the connected ones up to grace= (default 30s) to
+// finish, while the other servers keep running. It replies straight away, the server is listed as
+// stopped once it's drained. action=start starts it again, eg. after changing its config or
+// certificate. Only the admin token may use it
+func (g *guerrilla) adminServers(w http.ResponseWriter, r *http.Request, tenant string) {
+	if tenant != "" {
+		writeAdminError(w, http.StatusForbidden, "requires the admin token")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		statuses := make([]ServerStatus, 0)
+		g.mapServers(func(s *server) {
+			statuses = append(statuses, serverStatus(s))
+		})
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Server < statuses[j].Server })
+		writeAdminJSON(w, http.StatusOK, statuses)
+	case http.MethodPost:
+		params := r.URL.Query()
+		s, err := g.findServer(params.Get("server"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, "no such server "+params.Get("server"))
+			return
+		}
+		switch params.Get("action") {
+		case "drain":
+			grace := defaultDrainGrace
+			if v := params.Get("grace"); v != "" {
+				if grace, err = time.ParseDuration(v); err != nil || grace <= 0 {
+					writeAdminError(w, http.StatusBadRequest, "invalid grace "+v)
+					return
+				}
+			}
+			if s.getState() != ServerStateRunning {
+				writeAdminError(w, http.StatusConflict, "server "+s.listenInterface+" is not running")
+				return
+			}
+			g.mainlog().Infof("draining server [%s]", s.listenInterface)
+			done := s.Drain(grace)
+			go func() {
+				if <-done {
+					g.mainlog().Infof("server [%s] drained", s.listenInterface)
+				} else {
+					g.mainlog().Warnf("server [%s] drained, the clients still connected after %s were shut down",
+						s.listenInterface, grace)
+				}
+			}()
+			writeAdminJSON(w, http.StatusAccepted, serverStatus(s))
+		case "start":
+			if err := g.startServer(s); err != nil {
+				writeAdminError(w, http.StatusConflict, err.Error())
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, serverStatus(s))
+		default:
+			writeAdminError(w, http.StatusBadRequest, "action must be drain or start")
+		}
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// adminMetrics returns the histograms and the counters of the tenants in the OpenMetrics text format, GET /metrics.
+// Only the admin token may use it
+func (g *guerrilla) adminMetrics(w http.ResponseWriter, r *http.Request, tenant string) {
+	if tenant != "" {
+		writeAdminError(w, http.StatusForbidden, "requires the admin token")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if writeHistograms(w, g.histograms.snapshots()) != nil {
+		return
+	}
+	if writeTenantMetrics(w, g.tenants.stats()) != nil {
+		return
+	}
+	_, _ = io.WriteString(w, "# EOF\n")
+}
+
+// AdminStats is the response of GET /stats
+type AdminStats struct {
+	Tenants map[string]TenantStats `json:"tenants"`
+	Daily   []DailyStats           `json:"daily"`
+}
+
+// adminStats returns the counters of the tenants and of each day, GET /stats. A tenant's
+// token only gets the tenant's counters
+func (g *guerrilla) adminStats(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	stats := AdminStats{Tenants: g.tenants.stats(), Daily: g.daily.list(tenant, tenant == "")}
+	if tenant != "" {
+		stats.Tenants = map[string]TenantStats{tenant: stats.Tenants[tenant]}
+	}
+	writeAdminJSON(w, http.StatusOK, stats)
+}
+
+// adminTenant returns the tenant that the request's token gives access to, and false if the
+// token is not valid. The tenant is empty for the admin token
+func (g *guerrilla) adminTenant(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	g.guard.Lock()
+	adminToken := g.Config.Admin.Token
+	g.guard.Unlock()
+	if adminToken != "" && subtle.ConstantTimeCompare(token, []byte(adminToken)) == 1 {
+		return "", true
+	}
+	return g.tenants.forAdminToken(token)
+}
+
+// ServeHTTP serves the admin API
+func (g *guerrilla) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, ok := g.adminHandlers.get(r.URL.Path)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+	tenant, ok := g.adminTenant(r)
+	if !ok {
+		writeAdminError(w, http.StatusUnauthorized, "a valid token is required")
+		return
+	}
+	h(w, r, tenant)
+}
+
+// startAdmin starts the admin API, if configured and not started already
+func (g *guerrilla) startAdmin() error {
+	if g.admin != nil || g.Config.Admin.ListenInterface == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", g.Config.Admin.ListenInterface)
+	if err != nil {
+		return err
+	}
+	g.admin = &http.Server{
+		Handler:      g,
+		ReadTimeout:  time.Second * 30,
+		WriteTimeout: time.Second * 30,
+	}
+	go func(srv *http.Server) {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			g.mainlog().WithError(err).Error("admin API stopped")
+		}
+	}(g.admin)
+	g.mainlog().Infof("admin API listening on %s", l.Addr())
+	return nil
+}
+
+// stopAdmin stops the admin API
+func (g *guerrilla) stopAdmin() {
+	if g.admin != nil {
+		_ = g.admin.Close()
+		g.admin = nil
+	}
+	// they were taken over from the admin API
+	g.console.closeAll()
+}
@@ -0,0 +1,357 @@
+package guerrilla
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestAdminDeliveries(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"acme.com", "globex.com"},
+		Tenants: []TenantConfig{
+			{Name: "acme", Domains: []string{"acme.com"}, AdminToken: "acme-secret"},
+			{Name: "globex", Domains: []string{"globex.com"}, AdminToken: "globex-secret"},
+		},
+		Admin: AdminConfig{ListenInterface: "127.0.0.1:2580", Token: "secret"},
+	}
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	cfg.BackendConfig = backends.BackendConfig{
+		"save_process":           "HeadersParser|SearchIndex|Debugger",
+		"delivery_tracking_size": 100,
+		"search_index_path":      filepath.Join(dir, "index"),
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	cmd := func(line, expect string) {
+		if line != "" {
+			if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+				t.Error(err)
+			}
+		}
+		str, err := in.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		} else if !strings.HasPrefix(str, expect) {
+			t.Error("sent", line, "expected", expect, "but got", str)
+		}
+	}
+	cmd("", "220")
+	cmd("HELO host", "250")
+	cmd("MAIL FROM:<test@example.com>", "250")
+	cmd("RCPT TO:<a@acme.com>", "250")
+	cmd("DATA", "354")
+	cmd("Message-ID: <track@example.com>\r\nSubject: Test\r\n\r\nHello\r\n.", "250")
+	cmd("QUIT", "221")
+
+	request := func(path, token string, v interface{}) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:2580"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Error(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	get := func(id, token string) (int, []backends.DeliveryRecord) {
+		var records []backends.DeliveryRecord
+		code := request("/deliveries?id="+id, token, &records)
+		return code, records
+	}
+
+	for _, token := range []string{"secret", "acme-secret"} {
+		code, records := get("track@example.com", token)
+		if code != http.StatusOK || len(records) != 1 {
+			t.Fatal("expected a record with the token", token, "got", code, records)
+		}
+		r := records[0]
+		if r.Tenant != "acme" || r.From != "test@example.com" || len(r.Events) != 2 ||
+			r.Events[0].State != backends.DeliveryReceived || r.Events[1].State != backends.DeliveryQueued {
+			t.Error("unexpected record", r)
+		}
+	}
+	// another tenant can't see acme's mail
+	if code, _ := get("track@example.com", "globex-secret"); code != http.StatusNotFound {
+		t.Error("expected 404 for another tenant, got", code)
+	}
+	if code, _ := get("track@example.com", "wrong"); code != http.StatusUnauthorized {
+		t.Error("expected 401 for a bad token, got", code)
+	}
+	if code, _ := get("unknown@example.com", "secret"); code != http.StatusNotFound {
+		t.Error("expected 404 for an unknown id, got", code)
+	}
+
+	// the search only finds the tenant's mail
+	var hits []backends.MailHit
+	if code := request("/search?subject=test", "acme-secret", &hits); code != http.StatusOK || len(hits) != 1 || hits[0].From != "test@example.com" {
+		t.Error("expected the message to be found, got", code, hits)
+	}
+	if code := request("/search?subject=test", "globex-secret", &hits); code != http.StatusOK || len(hits) != 0 {
+		t.Error("expected no messages for another tenant, got", code, hits)
+	}
+	if code := request("/search", "secret", &hits); code != http.StatusBadRequest {
+		t.Error("expected 400 for an empty search, got", code)
+	}
+}
+
+func TestAdminSuppressions(t *testing.T) {
+	defer func(l *backends.SuppressionList) { backends.Suppressions = l }(backends.Suppressions)
+	backends.Suppressions = backends.NewSuppressionList()
+	request := func(method, path, body, tenant string, v interface{}) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		adminSuppressions(w, r, tenant)
+		if v != nil {
+			_ = json.NewDecoder(w.Body).Decode(v)
+		}
+		return w.Code
+	}
+	var s backends.Suppression
+	code := request(http.MethodPost, "/suppressions", `{"address":"bob@example.com","ttl":"1h"}`, "acme", &s)
+	if code != http.StatusCreated || s.Tenant != "acme" || s.Reason != backends.SuppressionManual || s.Expires == nil {
+		t.Fatal("expected the address to be added for the tenant", code, s)
+	}
+	body := `{"address":"eve@example.com","tenant":"globex","reason":"complaint"}`
+	if code := request(http.MethodPost, "/suppressions", body, "", nil); code != http.StatusCreated {
+		t.Fatal("expected the admin token to add for any tenant, got", code)
+	}
+	if code := request(http.MethodPost, "/suppressions", `{"address":"x@example.com","ttl":"soon"}`, "", nil); code != http.StatusBadRequest {
+		t.Error("expected an invalid ttl, got", code)
+	}
+	var list []backends.Suppression
+	if request(http.MethodGet, "/suppressions", "", "acme", &list); len(list) != 1 || list[0].Address != "bob@example.com" {
+		t.Error("expected the tenant's list, got", list)
+	}
+	if request(http.MethodGet, "/suppressions", "", "", &list); len(list) != 2 {
+		t.Error("expected the admin token to list everything, got", list)
+	}
+	if request(http.MethodGet, "/suppressions?tenant=globex", "", "", &list); len(list) != 1 || list[0].Tenant != "globex" {
+		t.Error("expected the globex list, got", list)
+	}
+	if code := request(http.MethodGet, "/suppressions?address=eve@example.com", "", "acme", nil); code != http.StatusNotFound {
+		t.Error("expected the other tenant's address to be hidden, got", code)
+	}
+	if code := request(http.MethodDelete, "/suppressions?address=eve@example.com", "", "acme", nil); code != http.StatusNotFound {
+		t.Error("expected the other tenant's address to stay, got", code)
+	}
+	if code := request(http.MethodDelete, "/suppressions?address=eve@example.com&tenant=globex", "", "", nil); code != http.StatusOK {
+		t.Error("expected the address to be removed, got", code)
+	}
+	if _, ok := backends.Suppressions.Suppressed("globex", "eve@example.com"); ok {
+		t.Error("expected eve to be removed")
+	}
+}
+
+func TestAdminHandlers(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"example.com"},
+		Admin:        AdminConfig{Token: "secret"},
+	}
+	handler := func(body string) AdminHandler {
+		return func(w http.ResponseWriter, r *http.Request, tenant string) {
+			writeAdminJSON(w, http.StatusOK, body)
+		}
+	}
+	d := Daemon{Config: cfg}
+	d.AddAdminHandler("/before", handler("before"))
+	// another daemon's endpoints aren't served
+	var other Daemon
+	other.AddAdminHandler("/other", handler("other"))
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+	d.AddAdminHandler("/after", handler("after"))
+	d.AddAdminHandler("/stats", handler("replaced"))
+
+	g := d.g.(*guerrilla)
+	get := func(path string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		var body string
+		_ = json.NewDecoder(w.Body).Decode(&body)
+		return w.Code, body
+	}
+	for path, want := range map[string]string{"/before": "before", "/after": "after", "/stats": "replaced"} {
+		if code, body := get(path); code != http.StatusOK || body != want {
+			t.Errorf("expected %s from %s, got %d %q", want, path, code, body)
+		}
+	}
+	if code, _ := get("/other"); code != http.StatusNotFound {
+		t.Error("expected the other daemon's endpoint not to be found, got", code)
+	}
+	if code, _ := get("/servers"); code != http.StatusOK {
+		t.Error("expected the built-in endpoints, got", code)
+	}
+}
+
+func TestAdminDrainServer(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"example.com"},
+		Servers: []ServerConfig{
+			{ListenInterface: "127.0.0.1:2525", IsEnabled: true, MaxClients: 10},
+			{ListenInterface: "127.0.0.1:2526", IsEnabled: true, MaxClients: 10},
+		},
+		Admin: AdminConfig{ListenInterface: "127.0.0.1:2580", Token: "secret"},
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	request := func(method, path, token string, v interface{}) int {
+		req, _ := http.NewRequest(method, "http://127.0.0.1:2580"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if v != nil {
+			_ = json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+	state := func(iface string) string {
+		var statuses []ServerStatus
+		request(http.MethodGet, "/servers", "secret", &statuses)
+		for _, s := range statuses {
+			if s.Server == iface {
+				return s.State
+			}
+		}
+		return ""
+	}
+	greet := func(iface string) error {
+		conn, err := net.Dial("tcp", iface)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil && !strings.HasPrefix(line, "220") {
+			err = fmt.Errorf("unexpected greeting %q", line)
+		}
+		return err
+	}
+
+	// a client in the middle of a transaction
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	cmd := func(line, expect string) {
+		if line != "" {
+			if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+				t.Error(err)
+			}
+		}
+		str, err := in.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		} else if !strings.HasPrefix(str, expect) {
+			t.Error("sent", line, "expected", expect, "but got", str)
+		}
+	}
+	cmd("", "220")
+	cmd("HELO host", "250")
+	cmd("MAIL FROM:<test@example.com>", "250")
+
+	if code := request(http.MethodPost, "/servers?server=127.0.0.1:2525&action=drain", "other", nil); code != http.StatusUnauthorized {
+		t.Error("expected 401 without the admin token, got", code)
+	}
+	if code := request(http.MethodPost, "/servers?server=127.0.0.1:9999&action=drain", "secret", nil); code != http.StatusNotFound {
+		t.Error("expected 404 for an unknown server, got", code)
+	}
+	var status ServerStatus
+	code := request(http.MethodPost, "/servers?server=127.0.0.1:2525&action=drain&grace=10s", "secret", &status)
+	if code != http.StatusAccepted || status.State != "draining" || status.ActiveClients != 1 {
+		t.Fatal("expected the server to be draining, got", code, status)
+	}
+	if err := greet("127.0.0.1:2525"); err == nil {
+		t.Error("expected the drained server to refuse new clients")
+	}
+	if err := greet("127.0.0.1:2526"); err != nil {
+		t.Error("expected the other server to keep running, got", err)
+	}
+
+	// the transaction is finished, and the client is told to go away after it
+	cmd("RCPT TO:<a@example.com>", "250")
+	cmd("DATA", "354")
+	cmd("Subject: Test\r\n\r\nHello\r\n.", "250")
+	cmd("", "421")
+	for i := 0; state("127.0.0.1:2525") != "stopped"; i++ {
+		if i == 100 {
+			t.Fatal("expected the server to be stopped once drained, got", state("127.0.0.1:2525"))
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if state("127.0.0.1:2526") != "running" {
+		t.Error("expected the other server to be running")
+	}
+
+	if code := request(http.MethodPost, "/servers?server=127.0.0.1:2525&action=start", "secret", &status); code != http.StatusOK || status.State != "running" {
+		t.Error("expected the server to be started, got", code, status)
+	}
+	if err := greet("127.0.0.1:2525"); err != nil {
+		t.Error("expected the server to accept clients again, got", err)
+	}
+	if code := request(http.MethodPost, "/servers?server=127.0.0.1:2525&action=start", "secret", nil); code != http.StatusConflict {
+		t.Error("expected a running server not to be started again, got", code)
+	}
+}
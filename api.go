@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/artpar/go-guerrilla/authenticators"
@@ -26,6 +27,14 @@ type Daemon struct {
 
 	configLoadTime time.Time
 	subs           []deferredSub
+	// commands are the custom SMTP commands, see AddCommand
+	commands *commands
+	// adminHandlers are the endpoints of the admin API, see AddAdminHandler
+	adminHandlers *adminHandlers
+	// reloadMu serializes the config reloads, and guards stopWatch
+	reloadMu sync.Mutex
+	// closed on shutdown, to stop WatchConfig
+	stopWatch chan struct{}
 }
 
 type deferredSub struct {
@@ -74,20 +83,84 @@ func (d *Daemon) Start() (err error) {
 
 		}
 		d.subs = make([]deferredSub, 0)
+		if g, ok := d.g.(*guerrilla); ok {
+			// the servers use the commands added before, and the ones added later
+			if d.commands == nil {
+				d.commands = g.commands
+			} else {
+				g.setCommands(d.commands)
+			}
+			// and the admin API the endpoints added before, and the ones added later
+			if d.adminHandlers != nil {
+				g.adminHandlers.addAll(d.adminHandlers)
+			}
+			d.adminHandlers = g.adminHandlers
+		}
 	}
 	err = d.g.Start()
 	if err == nil {
 		if err := d.resetLogger(); err == nil {
 			d.Log().Infof("main log configured to %s", d.Config.LogFile)
 		}
-
+		d.notify(sdReady)
 	}
 	return err
 }
 
+// notify reports the state to systemd, when it started the daemon
+func (d *Daemon) notify(state string) {
+	if err := sdNotify(state); err != nil {
+		d.Log().WithError(err).Warnf("could not notify systemd of %s", state)
+	}
+}
+
+// TenantStats returns the counters for each tenant, keyed by tenant name.
+// Returns nil if the daemon has not been started
+func (d *Daemon) TenantStats() map[string]TenantStats {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.tenants.stats()
+	}
+	return nil
+}
+
+// DailyStats returns the counters of each day by tenant and recipient domain, sorted by day.
+// They're kept for the days of StatsConfig.Days. Returns nil if the daemon has not been started
+func (d *Daemon) DailyStats() []DailyStats {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.daily.list("", true)
+	}
+	return nil
+}
+
+// Histograms returns the distributions of the message sizes, recipients per message and
+// session durations of all the servers, keyed by name, eg. HistogramMessageSize.
+// Returns nil if the daemon has not been started
+func (d *Daemon) Histograms() map[string]HistogramSnapshot {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.histograms.snapshots()
+	}
+	return nil
+}
+
+// Certificates returns the expiry of the TLS certificates of the servers, as of the last check.
+// Returns nil if the daemon has not been started
+func (d *Daemon) Certificates() []CertStatus {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.certificates()
+	}
+	return nil
+}
+
 // Shuts down the daemon, including servers and backend.
 // Do not call Start on it again, use a new server.
 func (d *Daemon) Shutdown() {
+	d.notify(sdStopping)
+	d.reloadMu.Lock()
+	if d.stopWatch != nil {
+		close(d.stopWatch)
+		d.stopWatch = nil
+	}
+	d.reloadMu.Unlock()
 	if d.g != nil {
 		d.g.Shutdown()
 	}
@@ -120,16 +193,27 @@ func (d *Daemon) SetConfig(c AppConfig) error {
 	if err != nil {
 		return err
 	}
-	err = c.Load(data)
+	// loaded into a new config, c's slices and maps may be shared with the running config
+	var ac AppConfig
+	err = ac.Load(data)
 	if err != nil {
 		return err
 	}
-	d.Config = &c
+	d.Config = &ac
 	return nil
 }
 
 // Reload a config using the passed in AppConfig and emit config change events
 func (d *Daemon) ReloadConfig(c AppConfig) error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+	return d.reloadConfig(c)
+}
+
+// reloadConfig is ReloadConfig, called with reloadMu locked
+func (d *Daemon) reloadConfig(c AppConfig) error {
+	d.notify(sdReloading)
+	defer d.notify(sdReady)
 	oldConfig := *d.Config
 	err := d.SetConfig(c)
 	if err != nil {
@@ -144,6 +228,10 @@ func (d *Daemon) ReloadConfig(c AppConfig) error {
 
 // Reload a config from a file and emit config change events
 func (d *Daemon) ReloadConfigFile(path string) error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+	d.notify(sdReloading)
+	defer d.notify(sdReady)
 	ac, err := d.LoadConfig(path)
 	if err != nil {
 		d.Log().WithError(err).Error("Error while reloading config from file")
@@ -0,0 +1,92 @@
+package guerrilla
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// cleartextAuth returns true for the AUTH mechanisms that send the password in the clear
+func cleartextAuth(mechanism string) bool {
+	return mechanism == "PLAIN" || mechanism == "LOGIN"
+}
+
+// authTypes returns the AUTH mechanisms offered to the client. The ones that send the password in
+// the clear are only offered over TLS, unless auth_allow_insecure is set, and none are offered
+// before STARTTLS when the server requires it
+func (s *server) authTypes(sc *ServerConfig, client *client) []string {
+	if sc.TLS.StartTLSRequired && !client.TLS {
+		return nil
+	}
+	if client.TLS || sc.AuthAllowInsecure {
+		return sc.AuthTypes
+	}
+	var types []string
+	for _, t := range sc.AuthTypes {
+		if !cleartextAuth(t) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// refuseAuth returns the reply to an AUTH command with the mechanism when it can't be used,
+// or an empty string when it can
+func (s *server) refuseAuth(sc *ServerConfig, client *client, mechanism string) string {
+	switch {
+	case !sc.IsAuthTypeAllowed(mechanism):
+		return "500 5.5.1 Invalid command"
+	case client.authStore.IsAuthenticated:
+		return "503 5.5.1 Already authenticated"
+	case sc.TLS.StartTLSRequired && !client.TLS:
+		return response.Canned.FailStartTLSRequired.String()
+	case cleartextAuth(mechanism) && !client.TLS && !sc.AuthAllowInsecure:
+		// RFC 4954, section 6
+		return "538 5.7.11 Encryption required for requested authentication mechanism"
+	}
+	return ""
+}
+
+// authFailed replies to a failed AUTH, which counts as an error of the client, so that a client
+// guessing passwords is disconnected like one sending unknown commands
+func (s *server) authFailed(client *client, reply string) {
+	client.errors++
+	if client.errors >= MaxUnrecognizedCommands {
+		client.sendResponse(response.Canned.ErrorTooManyAuthFailures)
+		client.kill()
+		return
+	}
+	client.sendResponse(reply)
+}
+
+// authPlain verifies the response of AUTH PLAIN, the base64 encoding of
+// "authorization identity\0username\0password" (RFC 4616)
+func (s *server) authPlain(client *client, resp string) {
+	if resp == "*" {
+		client.sendResponse("501 5.7.0 Authentication cancelled")
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	parts := strings.Split(string(decoded), "\x00")
+	if err != nil || len(parts) != 3 || parts[1] == "" {
+		client.sendResponse("501 5.5.2 Cannot decode the response")
+		return
+	}
+	// acting on behalf of another user isn't supported
+	ok := false
+	if parts[0] == "" || parts[0] == parts[1] {
+		if ok, err = s.authenticator.VerifyPLAIN(parts[1], parts[2]); err != nil {
+			client.sendResponse(response.Canned.ErrorAuthUnavailable)
+			return
+		}
+	}
+	if !ok {
+		s.log().Infof("AUTH PLAIN failed for %s from %s", parts[1], client.RemoteIP)
+		s.authFailed(client, "535 5.7.8 Error: authentication failed")
+		return
+	}
+	client.authStore.IsAuthenticated = true
+	client.AuthorizedLogin = parts[1]
+	client.sendResponse("235 Authentication succeeded")
+}
@@ -0,0 +1,256 @@
+package guerrilla
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/authenticators"
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/mocks"
+)
+
+// authSession starts a session with a server that authenticates alice, and sends EHLO. The session
+// is taken as encrypted when encrypted is true. It returns the lines of the EHLO reply
+func authSession(t *testing.T, sc *ServerConfig, encrypted bool) (*textproto.Reader, *textproto.Writer, *client, func(), []string) {
+	return authSessionWith(t, sc, encrypted, authenticators.StaticCredentials{"alice": "secret"})
+}
+
+// authSessionWith is authSession with the credentials of the store
+func authSessionWith(t *testing.T, sc *ServerConfig, encrypted bool, store authenticators.CredentialStore) (*textproto.Reader, *textproto.Writer, *client, func(), []string) {
+	// the client doesn't use TLS, the certificate isn't needed
+	sc.TLS.StartTLSOn = false
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	backend, err := backends.New(backends.BackendConfig{"save_workers_size": 1}, mainlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authenticators.NewCredentialAuthenticator(store)
+	server, err := newServer(sc, backend, auth, mainlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	client.TLS = encrypted
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+	if err := w.PrintfLine("EHLO test.test.com"); err != nil {
+		t.Fatal(err)
+	}
+	var ehlo []string
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ehlo = append(ehlo, line)
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	quit := func() {
+		_ = w.PrintfLine("QUIT")
+		_, _ = r.ReadLine()
+		wg.Wait()
+	}
+	return r, w, client, quit, ehlo
+}
+
+func authCommand(t *testing.T, r *textproto.Reader, w *textproto.Writer, cmd string) string {
+	if err := w.PrintfLine("%s", cmd); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func plainResponse(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.AuthTypes = []string{"PLAIN", "LOGIN"}
+	r, w, client, quit, ehlo := authSession(t, sc, false)
+	defer quit()
+	for _, line := range ehlo {
+		if strings.Contains(line, "AUTH") {
+			t.Error("AUTH should not be advertised without TLS, got", line)
+		}
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "secret")); !strings.HasPrefix(line, "538 ") {
+		t.Error("expected 538, got", line)
+	}
+	if line := authCommand(t, r, w, "AUTH LOGIN"); !strings.HasPrefix(line, "538 ") {
+		t.Error("expected 538, got", line)
+	}
+	if line := authCommand(t, r, w, "AUTH CRAM-MD5"); !strings.HasPrefix(line, "500 ") {
+		t.Error("expected 500 for a mechanism that isn't allowed, got", line)
+	}
+	if client.AuthorizedLogin != "" {
+		t.Error("expected no authenticated user, got", client.AuthorizedLogin)
+	}
+}
+
+func TestAuthPlain(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.AuthTypes = []string{"PLAIN", "LOGIN"}
+	sc.AuthAllowInsecure = true
+	r, w, client, quit, ehlo := authSession(t, sc, false)
+	defer quit()
+	advertised := false
+	for _, line := range ehlo {
+		if line == "250-AUTH PLAIN LOGIN" {
+			advertised = true
+		}
+	}
+	if !advertised {
+		t.Error("expected AUTH PLAIN LOGIN to be advertised, got", ehlo)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "wrong")); !strings.HasPrefix(line, "535 ") {
+		t.Error("expected 535, got", line)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN !!!"); !strings.HasPrefix(line, "501 ") {
+		t.Error("expected 501, got", line)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN"); line != "334 " && line != "334" {
+		t.Errorf("expected a continuation, got %q", line)
+	}
+	if line := authCommand(t, r, w, plainResponse("alice", "secret")); !strings.HasPrefix(line, "235 ") {
+		t.Error("expected 235, got", line)
+	}
+	if client.AuthorizedLogin != "alice" {
+		t.Error("expected alice to be authenticated, got", client.AuthorizedLogin)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "secret")); !strings.HasPrefix(line, "503 ") {
+		t.Error("expected 503, got", line)
+	}
+	// the identity is kept for the next transaction
+	if line := authCommand(t, r, w, "RSET"); !strings.HasPrefix(line, "250 ") {
+		t.Error("expected 250, got", line)
+	}
+	if client.AuthorizedLogin != "alice" {
+		t.Error("expected alice to stay authenticated after RSET, got", client.AuthorizedLogin)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.AuthTypes = []string{"LOGIN"}
+	sc.AuthAllowInsecure = true
+	r, w, client, quit, _ := authSession(t, sc, false)
+	defer quit()
+	b64 := base64.StdEncoding.EncodeToString
+	if line := authCommand(t, r, w, "AUTH LOGIN"); !strings.HasPrefix(line, "334 ") {
+		t.Error("expected 334, got", line)
+	}
+	if line := authCommand(t, r, w, b64([]byte("alice"))); !strings.HasPrefix(line, "334 ") {
+		t.Error("expected 334, got", line)
+	}
+	if line := authCommand(t, r, w, b64([]byte("secret"))); !strings.HasPrefix(line, "235 ") {
+		t.Error("expected 235, got", line)
+	}
+	if client.AuthorizedLogin != "alice" {
+		t.Error("expected alice to be authenticated, got", client.AuthorizedLogin)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "secret")); !strings.HasPrefix(line, "500 ") {
+		t.Error("expected 500 for PLAIN when only LOGIN is allowed, got", line)
+	}
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.AuthTypes = []string{"PLAIN", "LOGIN"}
+	sc.AuthAllowInsecure = true
+	sc.TLS.StartTLSRequired = true
+	r, w, client, quit, ehlo := authSession(t, sc, false)
+	for _, line := range ehlo {
+		if strings.Contains(line, "AUTH") {
+			t.Error("AUTH should not be advertised before STARTTLS, got", line)
+		}
+	}
+	if line := authCommand(t, r, w, "MAIL FROM:<test@example.com>"); line != "530 5.7.0 Must issue a STARTTLS command first" {
+		t.Error("expected 530, got", line)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "secret")); !strings.HasPrefix(line, "530 5.7.0") {
+		t.Error("expected 530, got", line)
+	}
+	if client.AuthorizedLogin != "" {
+		t.Error("expected no authenticated user, got", client.AuthorizedLogin)
+	}
+	quit()
+
+	// once encrypted, the session goes on as usual
+	r, w, client, quit, ehlo = authSession(t, sc, true)
+	defer quit()
+	if !strings.Contains(strings.Join(ehlo, "\n"), "AUTH PLAIN LOGIN") {
+		t.Error("expected AUTH to be advertised over TLS, got", ehlo)
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "secret")); !strings.HasPrefix(line, "235 ") {
+		t.Error("expected 235, got", line)
+	}
+	if line := authCommand(t, r, w, "MAIL FROM:<test@example.com>"); !strings.HasPrefix(line, "250 ") {
+		t.Error("expected 250, got", line)
+	}
+}
+
+// brokenCredentials is a credential store that can't be reached
+type brokenCredentials struct{}
+
+func (brokenCredentials) Verify(username, password string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestAuthFailures(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.AuthTypes = []string{"PLAIN", "LOGIN"}
+	sc.AuthAllowInsecure = true
+	b64 := base64.StdEncoding.EncodeToString
+
+	// the client may try again when the credentials can't be checked
+	r, w, _, quit, _ := authSessionWith(t, sc, false, brokenCredentials{})
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "secret")); line != "454 4.7.0 Temporary authentication failure" {
+		t.Error("expected 454, got", line)
+	}
+	if line := authCommand(t, r, w, "AUTH LOGIN"); !strings.HasPrefix(line, "334 ") {
+		t.Error("expected 334, got", line)
+	}
+	_ = authCommand(t, r, w, b64([]byte("alice")))
+	if line := authCommand(t, r, w, b64([]byte("secret"))); !strings.HasPrefix(line, "454 4.7.0") {
+		t.Error("expected 454, got", line)
+	}
+	quit()
+
+	// a client guessing passwords is disconnected
+	r, w, _, quit, _ = authSession(t, sc, false)
+	defer quit()
+	for i := 1; i < MaxUnrecognizedCommands; i++ {
+		if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "wrong")); !strings.HasPrefix(line, "535 ") {
+			t.Error("expected 535, got", line)
+		}
+	}
+	if line := authCommand(t, r, w, "AUTH PLAIN "+plainResponse("alice", "wrong")); line != "421 4.7.0 Too many failed authentication attempts" {
+		t.Error("expected 421, got", line)
+	}
+	if _, err := r.ReadLine(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
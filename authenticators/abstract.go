@@ -14,6 +14,11 @@ func (aa AbstractAuthenticator) GetAdvertiseAuthentication(authType []string) st
 	return "250-AUTH " + strings.Join(authType, " ") + "\r\n"
 }
 
+// VerifyPLAIN rejects AUTH PLAIN, for the authenticators that don't support it
+func (aa AbstractAuthenticator) VerifyPLAIN(login, password string) (bool, error) {
+	return false, nil
+}
+
 func (aa AbstractAuthenticator) GetMailSize(login string, defaultSize int64) int64 {
 	return defaultSize
 }
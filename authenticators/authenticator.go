@@ -3,8 +3,11 @@ package authenticators
 import "github.com/artpar/go-guerrilla/backends"
 
 type Authenticator interface {
-	VerifyLOGIN(login, password string) bool
-	//VerifyPLAIN(login, password string) bool
+	// VerifyLOGIN verifies the base64 encoded username and password of AUTH LOGIN. An error means
+	// that the credentials couldn't be checked, eg. the store is down, and the client may try again
+	VerifyLOGIN(login, password string) (bool, error)
+	// VerifyPLAIN verifies the decoded username and password of AUTH PLAIN, see VerifyLOGIN
+	VerifyPLAIN(login, password string) (bool, error)
 	//VerifyGSSAPI(login, password string) bool
 	//VerifyDIGESTMD5(login, password string) bool
 	//VerifyMD5(login, password string) bool
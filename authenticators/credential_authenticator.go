@@ -0,0 +1,135 @@
+package authenticators
+
+import (
+	"encoding/base64"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+// CredentialConfig configures the built-in credential stores, it's read from the backend config
+type CredentialConfig struct {
+	// Users are "user:password" entries, where the password may be a bcrypt hash
+	Users []string `json:"auth_users,omitempty"`
+	// BcryptFile is a file of "user:bcrypt hash" lines, see BcryptFile
+	BcryptFile string `json:"auth_bcrypt_file,omitempty"`
+	// SQLDriver, SQLDSN and SQLQuery look up the users in a database, see SQLCredentials
+	SQLDriver string `json:"auth_sql_driver,omitempty"`
+	SQLDSN    string `json:"auth_sql_dsn,omitempty"`
+	SQLQuery  string `json:"auth_sql_query,omitempty"`
+}
+
+// stores returns the credential stores that are configured
+func (c *CredentialConfig) stores() (CredentialStores, error) {
+	var stores CredentialStores
+	if len(c.Users) > 0 {
+		s, err := ParseStaticCredentials(c.Users)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	if c.BcryptFile != "" {
+		f, err := NewBcryptFile(c.BcryptFile)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, f)
+	}
+	if c.SQLQuery != "" {
+		s, err := NewSQLCredentials(c.SQLDriver, c.SQLDSN, c.SQLQuery)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	return stores, nil
+}
+
+// CredentialAuthenticator verifies AUTH PLAIN and LOGIN with a CredentialStore.
+// CRAM-MD5 needs the passwords in the clear, so it's not offered
+type CredentialAuthenticator struct {
+	AbstractAuthenticator
+	store CredentialStore
+}
+
+// NewCredentialAuthenticator returns an authenticator that checks the passwords with the store
+func NewCredentialAuthenticator(store CredentialStore) *CredentialAuthenticator {
+	return &CredentialAuthenticator{store: store}
+}
+
+// NewAuthenticator is the AuthenticatorCreator used when none is given. It's a CredentialAuthenticator
+// with the stores of the auth_* options of the config, or the NoopAuthenticator when there are none
+func NewAuthenticator(config backends.BackendConfig) Authenticator {
+	bcfg, err := backends.Svc.ExtractConfig(config, &CredentialConfig{})
+	if err != nil {
+		backends.Log().WithError(err).Error("invalid auth config, AUTH is off")
+		return NoopAuthenticator{}
+	}
+	stores, err := bcfg.(*CredentialConfig).stores()
+	if err != nil {
+		backends.Log().WithError(err).Error("cannot load the credentials, AUTH is off")
+		return NoopAuthenticator{}
+	}
+	if len(stores) == 0 {
+		return NoopAuthenticator{}
+	}
+	return NewCredentialAuthenticator(stores)
+}
+
+// verify returns the error of the store only when no store knew the password
+func (ca *CredentialAuthenticator) verify(username, password string) (bool, error) {
+	ok, err := ca.store.Verify(username, password)
+	if ok {
+		return true, nil
+	}
+	if err != nil {
+		backends.Log().WithError(err).Errorf("cannot verify the credentials of %s", username)
+	}
+	return false, err
+}
+
+// VerifyLOGIN verifies the base64 encoded username and password of AUTH LOGIN
+func (ca *CredentialAuthenticator) VerifyLOGIN(login, password string) (bool, error) {
+	username, err := ca.DecodeLogin(login)
+	if err != nil {
+		return false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return false, nil
+	}
+	return ca.verify(username, string(decoded))
+}
+
+// VerifyPLAIN verifies the username and password of AUTH PLAIN
+func (ca *CredentialAuthenticator) VerifyPLAIN(login, password string) (bool, error) {
+	return ca.verify(login, password)
+}
+
+func (ca *CredentialAuthenticator) VerifyCRAMMD5(challenge, authString string) bool {
+	return false
+}
+
+func (ca *CredentialAuthenticator) GenerateCRAMMD5Challenge() (string, error) {
+	return "", nil
+}
+
+func (ca *CredentialAuthenticator) ExtractLoginFromAuthString(authString string) string {
+	return ""
+}
+
+func (ca *CredentialAuthenticator) DecodeLogin(login string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(login)
+	return string(decoded), err
+}
+
+// GetAdvertiseAuthentication advertises the PLAIN and LOGIN mechanisms of authType
+func (ca *CredentialAuthenticator) GetAdvertiseAuthentication(authType []string) string {
+	var supported []string
+	for _, t := range authType {
+		if t == "PLAIN" || t == "LOGIN" {
+			supported = append(supported, t)
+		}
+	}
+	return ca.AbstractAuthenticator.GetAdvertiseAuthentication(supported)
+}
@@ -0,0 +1,181 @@
+package authenticators
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialStore checks the username and password that a client gave with AUTH PLAIN or LOGIN
+type CredentialStore interface {
+	// Verify returns true when the password is the user's. An error means that the user
+	// couldn't be looked up
+	Verify(username, password string) (bool, error)
+}
+
+// isBcrypt returns true when the stored password is a bcrypt hash
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares the password with the stored one, a bcrypt hash or the password itself
+func checkPassword(stored, password string) bool {
+	if isBcrypt(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// StaticCredentials are the users and their passwords, or bcrypt hashes of them, eg. from the config
+type StaticCredentials map[string]string
+
+// ParseStaticCredentials parses "user:password" entries, where the password may be a bcrypt hash
+func ParseStaticCredentials(entries []string) (StaticCredentials, error) {
+	s := make(StaticCredentials, len(entries))
+	for _, entry := range entries {
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid credential %q, expected user:password", entry)
+		}
+		s[entry[:i]] = entry[i+1:]
+	}
+	return s, nil
+}
+
+func (s StaticCredentials) Verify(username, password string) (bool, error) {
+	stored, ok := s[username]
+	if !ok {
+		return false, nil
+	}
+	return checkPassword(stored, password), nil
+}
+
+// BcryptFile is a file of "user:hash" lines with bcrypt hashes, such as made by htpasswd -B.
+// Lines starting with # are comments. The file is read again when it changes
+type BcryptFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+// NewBcryptFile reads the file
+func NewBcryptFile(path string) (*BcryptFile, error) {
+	f := &BcryptFile{path: path}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load returns the users of the file, reading it if it changed since it was last read
+func (f *BcryptFile) load() (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.users != nil && info.ModTime().Equal(f.modTime) {
+		return f.users, nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 || !isBcrypt(text[i+1:]) {
+			return nil, fmt.Errorf("%s:%d: expected user:bcrypt hash", f.path, line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	f.users, f.modTime = users, info.ModTime()
+	return users, nil
+}
+
+func (f *BcryptFile) Verify(username, password string) (bool, error) {
+	users, err := f.load()
+	if err != nil {
+		return false, err
+	}
+	stored, ok := users[username]
+	if !ok {
+		return false, nil
+	}
+	return checkPassword(stored, password), nil
+}
+
+// SQLCredentials looks up the bcrypt hash of a user's password, or the password, with a query that
+// has a ? placeholder for the username, eg. "SELECT password FROM users WHERE email = ? AND active = 1"
+type SQLCredentials struct {
+	db    *sql.DB
+	query string
+}
+
+// NewSQLCredentials opens the database. The driver must be registered, the drivers of the
+// storage processors are
+func NewSQLCredentials(driver, dsn, query string) (*SQLCredentials, error) {
+	if strings.Count(query, "?") != 1 {
+		return nil, errors.New("the credentials query needs a single ? placeholder for the username")
+	}
+	if driver == "postgres" {
+		query = strings.Replace(query, "?", "$1", 1)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLCredentials{db: db, query: query}, nil
+}
+
+func (s *SQLCredentials) Verify(username, password string) (bool, error) {
+	var stored string
+	err := s.db.QueryRow(s.query, username).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return checkPassword(stored, password), nil
+}
+
+// CredentialStores checks the stores in turn, until one of them knows the password
+type CredentialStores []CredentialStore
+
+func (stores CredentialStores) Verify(username, password string) (bool, error) {
+	var lastErr error
+	for _, store := range stores {
+		ok, err := store.Verify(username, password)
+		if ok {
+			return true, nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return false, lastErr
+}
@@ -0,0 +1,129 @@
+package authenticators
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestCredentialStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	static, err := ParseStaticCredentials([]string{"alice:secret", "bob:" + bcryptHash(t, "hunter2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseStaticCredentials([]string{"nopassword"}); err == nil {
+		t.Error("expected an entry without a password to be refused")
+	}
+
+	path := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(path, []byte("# users\ncarol:"+bcryptHash(t, "pass1")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewBcryptFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsn := "file:" + filepath.Join(dir, "users.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if _, err := db.Exec("CREATE TABLE users (email TEXT, password TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users VALUES (?, ?)", "dave@example.com", bcryptHash(t, "pass2")); err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewSQLCredentials("sqlite3", dsn, "SELECT password FROM users WHERE email = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := CredentialStores{static, file, users}
+	for _, c := range []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"bob", "hunter2", true},
+		{"bob", "hunter3", false},
+		{"carol", "pass1", true},
+		{"dave@example.com", "pass2", true},
+		{"dave@example.com", "pass1", false},
+		{"eve", "secret", false},
+	} {
+		if ok, err := stores.Verify(c.username, c.password); ok != c.want || err != nil {
+			t.Error("expected", c.want, "for", c.username, c.password, "got", ok, err)
+		}
+	}
+
+	// the file is read again when it changes
+	if err := ioutil.WriteFile(path, []byte("carol:"+bcryptHash(t, "pass3")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(path, later, later)
+	if ok, _ := file.Verify("carol", "pass3"); !ok {
+		t.Error("expected the new password to be read")
+	}
+	if err := ioutil.WriteFile(path, []byte("carol:plain\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBcryptFile(path); err == nil {
+		t.Error("expected a password that isn't a bcrypt hash to be refused")
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	if _, ok := NewAuthenticator(backends.BackendConfig{}).(NoopAuthenticator); !ok {
+		t.Error("expected the noop authenticator without credentials")
+	}
+	if _, ok := NewAuthenticator(backends.BackendConfig{"auth_bcrypt_file": "/nonexistent"}).(NoopAuthenticator); !ok {
+		t.Error("expected the noop authenticator when the credentials can't be loaded")
+	}
+	a := NewAuthenticator(backends.BackendConfig{"auth_users": []interface{}{"alice:secret"}})
+	if ok, _ := a.VerifyPLAIN("alice", "secret"); !ok {
+		t.Error("expected AUTH PLAIN to be verified")
+	}
+	if ok, err := a.VerifyPLAIN("alice", "wrong"); ok || err != nil {
+		t.Error("expected a wrong password to be refused, got", ok, err)
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	if ok, _ := a.VerifyLOGIN(b64([]byte("alice")), b64([]byte("secret"))); !ok {
+		t.Error("expected AUTH LOGIN to be verified with base64")
+	}
+	if ok, _ := a.VerifyLOGIN("alice", "secret"); ok {
+		t.Error("expected AUTH LOGIN to need base64")
+	}
+	if adv := a.GetAdvertiseAuthentication([]string{"CRAM-MD5", "PLAIN", "LOGIN"}); adv != "250-AUTH PLAIN LOGIN\r\n" {
+		t.Errorf("unexpected advertisement %q", adv)
+	}
+}
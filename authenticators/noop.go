@@ -0,0 +1,38 @@
+package authenticators
+
+import "github.com/artpar/go-guerrilla/backends"
+
+// NoopAuthenticator is used when no authenticator was given. It does not
+// advertise AUTH, and rejects any credentials.
+type NoopAuthenticator struct {
+	AbstractAuthenticator
+}
+
+// NewNoopAuthenticator is an AuthenticatorCreator for the NoopAuthenticator
+func NewNoopAuthenticator(config backends.BackendConfig) Authenticator {
+	return NoopAuthenticator{}
+}
+
+func (na NoopAuthenticator) VerifyLOGIN(login, password string) (bool, error) {
+	return false, nil
+}
+
+func (na NoopAuthenticator) VerifyCRAMMD5(challenge, authString string) bool {
+	return false
+}
+
+func (na NoopAuthenticator) GenerateCRAMMD5Challenge() (string, error) {
+	return "", nil
+}
+
+func (na NoopAuthenticator) ExtractLoginFromAuthString(authString string) string {
+	return ""
+}
+
+func (na NoopAuthenticator) DecodeLogin(login string) (string, error) {
+	return "", nil
+}
+
+func (na NoopAuthenticator) GetAdvertiseAuthentication(authType []string) string {
+	return ""
+}
@@ -0,0 +1,223 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// AccountingRecord counts the mail accepted for a recipient domain of a tenant during a period
+type AccountingRecord struct {
+	Tenant string    `json:"tenant,omitempty"`
+	Domain string    `json:"domain"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Messages counts the messages with recipients in the domain
+	Messages int64 `json:"messages"`
+	// Recipients counts the recipients in the domain
+	Recipients int64 `json:"recipients"`
+	// Bytes is the size of the messages, with the delivery header
+	Bytes int64 `json:"bytes"`
+	// StorageBytes is the size of the messages as they were saved, after compression
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+type accountingKey struct {
+	tenant, domain string
+}
+
+// accountingMaxPending is how many records are kept while the sinks fail, the oldest are dropped after that
+const accountingMaxPending = 100000
+
+// accountant adds up the mail accepted by all the workers, and sends the records to the sinks
+// every interval
+type accountant struct {
+	config   *AccountingConfig
+	client   *http.Client
+	interval time.Duration
+	counts   map[accountingKey]*AccountingRecord
+	start    time.Time
+	// pending are the records that the sinks didn't take yet
+	pending []AccountingRecord
+	sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+	// how many processors use the accountant
+	users int
+}
+
+var (
+	accountantsGuard sync.Mutex
+	// the accountants of the processors, by their config, so that the workers share the counts
+	accountants = make(map[string]*accountant)
+)
+
+// useAccountant returns the accountant for the config, starting it if it's not used already
+func useAccountant(config *AccountingConfig, interval, timeout time.Duration) *accountant {
+	key := fmt.Sprintf("%+v", *config)
+	accountantsGuard.Lock()
+	defer accountantsGuard.Unlock()
+	if a, ok := accountants[key]; ok {
+		a.users++
+		return a
+	}
+	a := &accountant{
+		config:   config,
+		client:   &http.Client{Timeout: timeout},
+		interval: interval,
+		counts:   make(map[accountingKey]*AccountingRecord),
+		start:    Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		users:    1,
+	}
+	accountants[key] = a
+	go a.run()
+	return a
+}
+
+// release stops the accountant when the last processor that used it is shut down.
+// The counts since the last interval are sent first
+func (a *accountant) release() {
+	accountantsGuard.Lock()
+	a.users--
+	last := a.users == 0
+	if last {
+		for key, v := range accountants {
+			if v == a {
+				delete(accountants, key)
+			}
+		}
+	}
+	accountantsGuard.Unlock()
+	if last {
+		close(a.stop)
+		<-a.done
+	}
+}
+
+// add counts a message of size bytes, saved with storage bytes, for each domain of its recipients
+func (a *accountant) add(e *mail.Envelope, size, storage int64) {
+	a.Lock()
+	defer a.Unlock()
+	seen := make(map[string]bool, len(e.RcptTo))
+	for _, rcpt := range e.RcptTo {
+		key := accountingKey{tenant: e.Tenant, domain: strings.ToLower(rcpt.Host)}
+		r, ok := a.counts[key]
+		if !ok {
+			r = &AccountingRecord{Tenant: key.tenant, Domain: key.domain}
+			a.counts[key] = r
+		}
+		r.Recipients++
+		if !seen[key.domain] {
+			seen[key.domain] = true
+			r.Messages++
+			r.Bytes += size
+			r.StorageBytes += storage
+		}
+	}
+}
+
+func (a *accountant) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.stop:
+			a.flush()
+			return
+		}
+	}
+}
+
+// flush closes the period, and sends its records and the ones that the sinks didn't take before
+func (a *accountant) flush() {
+	a.Lock()
+	end := Now()
+	records := make([]AccountingRecord, 0, len(a.counts))
+	for _, r := range a.counts {
+		r.Start, r.End = a.start, end
+		records = append(records, *r)
+	}
+	a.counts = make(map[accountingKey]*AccountingRecord)
+	a.start = end
+	a.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Tenant != records[j].Tenant {
+			return records[i].Tenant < records[j].Tenant
+		}
+		return records[i].Domain < records[j].Domain
+	})
+	records = append(a.pending, records...)
+	if len(records) == 0 {
+		return
+	}
+	if err := a.send(records); err != nil {
+		if over := len(records) - accountingMaxPending; over > 0 {
+			Log().Errorf("accounting: dropped %d records that could not be sent", over)
+			records = records[over:]
+		}
+		Log().WithError(err).Warnf("accounting: could not send %d records, they're sent with the next ones", len(records))
+		a.pending = records
+		return
+	}
+	a.pending = nil
+}
+
+// send writes the records to the file and posts them to the URL
+func (a *accountant) send(records []AccountingRecord) error {
+	if a.config.File != "" {
+		if err := a.write(records); err != nil {
+			return err
+		}
+	}
+	if a.config.URL != "" {
+		body, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		post := &HTTPProcessorConfig{URL: a.config.URL, Secret: a.config.Secret, MaxRetries: defaultHTTPMaxRetries}
+		if err := httpPost(a.client, post, body, "application/json"); err != nil {
+			if a.config.File != "" {
+				// the records are in the file already
+				Log().WithError(err).Errorf("accounting: could not post %d records", len(records))
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// write appends the records to the file as json lines, {date} is replaced with the day of the period's end
+func (a *accountant) write(records []AccountingRecord) error {
+	name := strings.Replace(a.config.File, sampleDatePlaceholder, records[len(records)-1].End.Format("2006-01-02"), -1)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
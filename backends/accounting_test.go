@@ -0,0 +1,123 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestAccountingProcessor(t *testing.T) {
+	db, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	file := filepath.Join(filepath.Dir(db), "accounting-{date}.json")
+	restore := SetClock(NewManualClock(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)))
+	defer SetClock(restore)
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":        "Accounting|HeadersParser|Hasher|Compressor|sql",
+		"mail_table":          "mail",
+		"primary_mail_host":   "example.com",
+		"sql_driver":          "sqlite3",
+		"sql_dsn":             db,
+		"sql_values":          sqlBatchTestValues,
+		"accounting_interval": "1h",
+		"accounting_file":     file,
+	})
+	e := newBrokerTestEnvelope()
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "alice", Host: "acme.com"})
+	e.Data.WriteString(strings.Repeat("compressible ", 100))
+	size := int64(e.Data.Len())
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be saved, got", result)
+	}
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be saved, got", result)
+	}
+	// the records are sent when the backend is shut down
+	if err := backend.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(filepath.Dir(db), "accounting-2020-03-01.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var records []AccountingRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AccountingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 || records[0].Domain != "acme.com" || records[1].Domain != "other.com" {
+		t.Fatal("expected a record for each domain, got", records)
+	}
+	acme := records[0]
+	if acme.Tenant != "acme" || acme.Messages != 2 || acme.Recipients != 3 || !acme.End.Equal(Now()) {
+		t.Error("unexpected record", acme)
+	}
+	if acme.Bytes != size+48 || acme.StorageBytes <= 0 || acme.StorageBytes >= acme.Bytes {
+		t.Error("expected the storage bytes to be the compressed size, got", acme.Bytes, acme.StorageBytes)
+	}
+}
+
+func TestAccountingURL(t *testing.T) {
+	var mu sync.Mutex
+	var posted [][]AccountingRecord
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var records []AccountingRecord
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Guerrilla-Signature") != httpSignature("s3cret", r.Header.Get("X-Guerrilla-Timestamp"), body) {
+			t.Error("expected the request to be signed")
+		}
+		posted = append(posted, records)
+	}))
+	defer server.Close()
+
+	a := useAccountant(&AccountingConfig{URL: server.URL, Secret: "s3cret"}, time.Hour, time.Second)
+	defer a.release()
+	a.add(newBrokerTestEnvelope(), 100, 100)
+	// the records are kept while the webhook fails
+	a.flush()
+	if len(a.pending) != 2 {
+		t.Fatal("expected the records to be pending, got", a.pending)
+	}
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	e := newBrokerTestEnvelope()
+	e.Tenant = ""
+	a.add(e, 50, 50)
+	a.flush()
+	if len(posted) != 1 || len(posted[0]) != 4 || len(a.pending) != 0 {
+		t.Fatal("expected the pending records to be posted with the new ones, got", posted)
+	}
+	if r := posted[0][2]; r.Tenant != "" || r.Domain != "acme.com" || r.Bytes != 50 || r.Messages != 1 {
+		t.Error("unexpected record", r)
+	}
+}
@@ -0,0 +1,97 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// AnonymizeConfig is read from the backend config
+type AnonymizeConfig struct {
+	// Key is the site key the addresses are hashed with, anonymization is off when empty
+	Key string `json:"anonymize_key,omitempty"`
+	// KeepDomain keeps the domain of the hashed addresses, eg. for statistics by domain
+	KeepDomain bool `json:"anonymize_keep_domain,omitempty"`
+}
+
+// minAnonymizeKeyLen is the length of the shortest key, so that the hashes of common
+// addresses can't be guessed by trying keys
+const minAnonymizeKeyLen = 16
+
+// Anonymizer replaces email addresses with an HMAC-SHA256 of the address and a site key.
+// An address always gets the same hash, so the records can still be counted and joined by
+// address, but the address can't be recovered without the key
+type Anonymizer struct {
+	key        []byte
+	keepDomain bool
+}
+
+// NewAnonymizer returns an Anonymizer that hashes with the key. With keepDomain, the hashes
+// keep the @domain of the address
+func NewAnonymizer(key string, keepDomain bool) *Anonymizer {
+	return &Anonymizer{key: []byte(key), keepDomain: keepDomain}
+}
+
+// Address returns the hash of the lower case address, or "" for an empty address
+func (a *Anonymizer) Address(address string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if address == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, a.key)
+	_, _ = mac.Write([]byte(address))
+	hash := hex.EncodeToString(mac.Sum(nil)[:16])
+	if i := strings.LastIndexByte(address, '@'); a.keepDomain && i >= 0 {
+		return hash + address[i:]
+	}
+	return hash
+}
+
+// textAddress matches the email addresses in headers and subjects
+var textAddress = regexp.MustCompile(`[^\s<>"'(),;:\[\]]+@[a-zA-Z0-9][a-zA-Z0-9.-]*`)
+
+// Text returns s with its email addresses replaced with their hashes
+func (a *Anonymizer) Text(s string) string {
+	return textAddress.ReplaceAllStringFunc(s, a.Address)
+}
+
+// Header returns a copy of the header with the addresses in its values hashed
+func (a *Anonymizer) Header(header map[string][]string) map[string][]string {
+	anonymized := make(map[string][]string, len(header))
+	for k, values := range header {
+		hashed := make([]string, len(values))
+		for i := range values {
+			hashed[i] = a.Text(values[i])
+		}
+		anonymized[k] = hashed
+	}
+	return anonymized
+}
+
+// Anonymization hashes the addresses of the records that processors publish or index for
+// analytics, such as the json of the kafka, rabbitmq, nats and sample processors and the
+// documents of the elasticsearch processor, and leaves the message out of them. It's nil
+// unless the anonymize_key option is set when the backend is initialized
+var Anonymization *Anonymizer
+
+// configureAnonymization sets Anonymization from the anonymize_* options
+func configureAnonymization(backendConfig BackendConfig) error {
+	configType := BaseConfig(&AnonymizeConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return err
+	}
+	config := bcfg.(*AnonymizeConfig)
+	if config.Key == "" {
+		Anonymization = nil
+		return nil
+	}
+	if len(config.Key) < minAnonymizeKeyLen {
+		return errors.New("anonymize_key must be at least 16 characters")
+	}
+	Anonymization = NewAnonymizer(config.Key, config.KeepDomain)
+	return nil
+}
@@ -0,0 +1,74 @@
+package backends
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizer(t *testing.T) {
+	a := NewAnonymizer("0123456789abcdef", false)
+	hash := a.Address("Bob@Acme.com")
+	if len(hash) != 32 || hash != a.Address("bob@acme.com") || hash == NewAnonymizer("fedcba9876543210", false).Address("bob@acme.com") {
+		t.Error("expected the same hash for an address, and another with another key, got", hash)
+	}
+	if a.Address("") != "" {
+		t.Error("expected the null sender to stay empty")
+	}
+	if d := NewAnonymizer("0123456789abcdef", true).Address("bob@Acme.com"); d != hash+"@acme.com" {
+		t.Error("expected the domain to be kept, got", d)
+	}
+	if s := a.Text(`"Bob" <bob@acme.com>, eve@other.com`); s != `"Bob" <`+hash+`>, `+a.Address("eve@other.com") {
+		t.Error("unexpected header", s)
+	}
+}
+
+func TestAnonymizedEvents(t *testing.T) {
+	defer func() {
+		Anonymization = nil
+	}()
+	k, restore := useFakeKafka()
+	defer restore()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":  "HeadersParser|Hasher|Kafka|Debugger",
+		"kafka_brokers": "k1:9092",
+		"kafka_topic":   "mail",
+		"anonymize_key": "0123456789abcdef",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	e.Data.Reset()
+	e.Data.WriteString("Subject: for bob@acme.com\nFrom: Test <test@example.com>\n\nsecret\n")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be published, got", result)
+	}
+	msgs := k.messages["mail"]
+	if len(msgs) != 1 {
+		t.Fatal("expected a message, got", len(msgs))
+	}
+	raw := string(msgs[0].Value)
+	if strings.Contains(raw, "@") || strings.Contains(raw, "secret") {
+		t.Errorf("expected no addresses and no message, got %s", raw)
+	}
+	var doc mailEvent
+	if err := json.Unmarshal(msgs[0].Value, &doc); err != nil {
+		t.Fatal("expected json instead of the raw message,", err)
+	}
+	a := NewAnonymizer("0123456789abcdef", false)
+	if doc.From != a.Address("test@example.com") || doc.To[0] != a.Address("bob@acme.com") ||
+		doc.Subject != "for "+a.Address("bob@acme.com") || doc.Headers["From"][0] != "Test <"+doc.From+">" {
+		t.Errorf("unexpected document %+v", doc)
+	}
+	if es := esDocument(e, 100); es.From != doc.From || es.Body != "" {
+		t.Errorf("unexpected elasticsearch document %+v", es)
+	}
+
+	for _, key := range []string{"", "short"} {
+		err := configureAnonymization(BackendConfig{"anonymize_key": key})
+		if (key == "") != (err == nil) || (key == "" && Anonymization != nil) {
+			t.Error("unexpected result for the key", key, err)
+		}
+	}
+}
@@ -47,6 +47,26 @@ type Backend interface {
 	Start() error
 }
 
+// ChainProcessor is a Backend that can process an envelope with a named chain of processors,
+// see the process_chains option
+type ChainProcessor interface {
+	ProcessChain(e *mail.Envelope, chain string) Result
+}
+
+// ChainStepper is a Backend that can process an envelope with a named chain while calling step
+// before each processor, eg. to debug the chain one processor at a time
+type ChainStepper interface {
+	// StepChain is like ProcessChain, but it has no timeout, as step may wait for someone
+	StepChain(e *mail.Envelope, chain string, step StepFunc) Result
+}
+
+// RcptBatchValidator is a Backend that can validate several recipients with one task,
+// eg. the recipients that a server deferred until DATA, see its defer_rcpt_after option
+type RcptBatchValidator interface {
+	// ValidateRcpts validates the last n recipients pushed to the envelope
+	ValidateRcpts(e *mail.Envelope, n int) []RcptError
+}
+
 type BackendConfig map[string]interface{}
 
 // All config structs extend from this
@@ -56,6 +76,8 @@ type notifyMsg struct {
 	err      error
 	queuedID string
 	result   Result
+	// rcptErrs are the errors of a batch of recipients
+	rcptErrs []RcptError
 }
 
 // Result represents a response to an SMTP client after receiving DATA.
@@ -152,8 +174,15 @@ func convertError(name string) error {
 type service struct {
 	initializers []processorInitializer
 	shutdowners  []processorShutdowner
+	healthChecks []HealthCheckWith
 	sync.Mutex
-	mainlog atomic.Value
+	mainlog    atomic.Value
+	streamHash atomic.Value
+	// configKeys are the keys that ExtractConfig read, to warn about the unknown ones
+	configKeys sync.Map
+	// gateway is the *BackendGateway being initialized, for the processors that pass envelopes
+	// to its chains
+	gateway atomic.Value
 }
 
 // Get loads the log.logger in an atomic operation. Returns a stderr logger if not able to load
@@ -169,6 +198,21 @@ func (s *service) SetMainlog(l log.Logger) {
 	s.mainlog.Store(l)
 }
 
+// SetStreamHash asks the server to hash the message body with the named algorithm while
+// it is being received. The digest is stored in the envelope's BodyHash field.
+// Use an empty string to stop hashing
+func (s *service) SetStreamHash(algorithm string) {
+	s.streamHash.Store(algorithm)
+}
+
+// StreamHash returns the algorithm set with SetStreamHash, or an empty string if none
+func (s *service) StreamHash() string {
+	if v, ok := s.streamHash.Load().(string); ok {
+		return v
+	}
+	return ""
+}
+
 // AddInitializer adds a function that implements ProcessorShutdowner to be called when initializing
 func (s *service) AddInitializer(i processorInitializer) {
 	s.Lock()
@@ -187,6 +231,8 @@ func (s *service) AddShutdowner(sh processorShutdowner) {
 func (s *service) reset() {
 	s.shutdowners = make([]processorShutdowner, 0)
 	s.initializers = make([]processorInitializer, 0)
+	s.healthChecks = nil
+	s.streamHash.Store("")
 }
 
 // Initialize initializes all the processors one-by-one and returns any errors.
@@ -273,6 +319,7 @@ func (s *service) ExtractConfig(configData BackendConfig, configType BaseConfig)
 			// so use the reflected field name
 			fieldName = typeOfT.Field(i).Name
 		}
+		s.markConfigKey(fieldName)
 		if f.Type().Name() == "int" {
 			// in json, there is no int, only floats...
 			if intVal, converted := configData[fieldName].(float64); converted {
@@ -283,6 +330,15 @@ func (s *service) ExtractConfig(configData BackendConfig, configType BaseConfig)
 				return configType, convertError("property missing/invalid: '" + fieldName + "' of expected type: " + f.Type().Name())
 			}
 		}
+		if f.Type().Name() == "float64" {
+			if floatVal, converted := configData[fieldName].(float64); converted {
+				v.Field(i).SetFloat(floatVal)
+			} else if intVal, converted := configData[fieldName].(int); converted {
+				v.Field(i).SetFloat(float64(intVal))
+			} else if !omitempty {
+				return configType, convertError("property missing/invalid: '" + fieldName + "' of expected type: " + f.Type().Name())
+			}
+		}
 		if f.Type().Name() == "string" {
 			if stringVal, converted := configData[fieldName].(string); converted {
 				v.Field(i).SetString(stringVal)
@@ -297,6 +353,31 @@ func (s *service) ExtractConfig(configData BackendConfig, configType BaseConfig)
 				return configType, convertError("missing/invalid: '" + fieldName + "' of type: " + f.Type().Name())
 			}
 		}
+		if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String {
+			// a list of strings, json arrays are unmarshalled to []interface{}
+			var list []string
+			converted := true
+			switch val := configData[fieldName].(type) {
+			case []string:
+				list = val
+			case []interface{}:
+				for _, item := range val {
+					str, ok := item.(string)
+					if !ok {
+						converted = false
+						break
+					}
+					list = append(list, str)
+				}
+			default:
+				converted = false
+			}
+			if converted {
+				v.Field(i).Set(reflect.ValueOf(list))
+			} else if !omitempty {
+				return configType, convertError("missing/invalid: '" + fieldName + "' of type: []string")
+			}
+		}
 	}
 	return configType, nil
 }
@@ -0,0 +1,254 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// BouncedRcpt is a recipient that the message could not be delivered to
+type BouncedRcpt struct {
+	Rcpt mail.Address
+	// Reply is the reply of the server that refused the recipient, eg. "550 5.1.1 No such user",
+	// or the reason it was given up on
+	Reply string
+}
+
+// RetryFunc delivers the envelope again to its recipients, and returns the reply of each recipient
+// that failed, keyed by address. A reply that starts with 5 is permanent, the others are retried
+type RetryFunc func(e *mail.Envelope) map[string]string
+
+// DeliveryNotifier is a Backend that notifies the sender of the recipients that the processors
+// could not deliver to, see BounceRcpt and RetryRcpts
+type DeliveryNotifier interface {
+	// Notify sends a delivery status notification for the bounced recipients of e, and starts
+	// retrying the deferred ones. It's called once the message was accepted
+	Notify(e *mail.Envelope)
+}
+
+const (
+	// bouncedValue is the key of e.Values where BounceRcpt keeps the recipients
+	bouncedValue = "bounced"
+	// dsnOfValue is the key of e.Values where NewDSN keeps the QueuedId of the message it reports on
+	dsnOfValue = "dsn_of"
+	// retryValue is the key of e.Values where RetryRcpts keeps the retries
+	retryValue = "retry"
+)
+
+// retryInterval is the wait before the first retry. It doubles with each retry, up to retryMaxInterval
+var retryInterval = time.Minute
+
+const (
+	retryMaxInterval = time.Minute * 15
+	// defaultRetryFor is how long the recipients are retried, see GatewayConfig.RetryFor
+	defaultRetryFor = time.Hour
+)
+
+type retryRcpts struct {
+	rcpts []mail.Address
+	retry RetryFunc
+}
+
+// BounceRcpt is called when the email can't be delivered to rcpt although the client was told it
+// would be, eg. by processors when the other recipients got it. Once the email is accepted, the
+// recipient is recorded as bounced and the sender gets a delivery status notification
+func BounceRcpt(e *mail.Envelope, rcpt mail.Address, reply string) {
+	bounced, _ := e.Values[bouncedValue].([]BouncedRcpt)
+	e.Values[bouncedValue] = append(bounced, BouncedRcpt{Rcpt: rcpt, Reply: reply})
+}
+
+// RetryRcpts is called by processors that could not deliver the email to the rcpts for now, while
+// the others got it. Once the email is accepted, retry is called in the background with a copy of
+// the email for those recipients, until they are delivered or bounced, see GatewayConfig.RetryFor
+func RetryRcpts(e *mail.Envelope, rcpts []mail.Address, retry RetryFunc) {
+	retries, _ := e.Values[retryValue].([]retryRcpts)
+	e.Values[retryValue] = append(retries, retryRcpts{rcpts: rcpts, retry: retry})
+}
+
+// Notify sends a delivery status notification for the recipients passed to BounceRcpt, and starts
+// the retries of RetryRcpts
+func (gw *BackendGateway) Notify(e *mail.Envelope) {
+	if bounced, _ := e.Values[bouncedValue].([]BouncedRcpt); len(bounced) > 0 {
+		gw.bounce(e, bounced)
+	}
+	retries, _ := e.Values[retryValue].([]retryRcpts)
+	for _, r := range retries {
+		// the envelope is reset after this
+		c := e.Clone()
+		delete(c.Values, bouncedValue)
+		delete(c.Values, retryValue)
+		c.RcptTo = append([]mail.Address(nil), r.rcpts...)
+		gw.Lock()
+		stop := gw.retryStop
+		gw.retries.Add(1)
+		gw.Unlock()
+		go gw.retry(c, r.retry, stop)
+	}
+}
+
+// retry calls the retry function for the recipients of e until they are delivered, and bounces
+// those that fail permanently or for longer than the retry period. When the gateway shuts down,
+// they are tried once more and the rest is bounced, as the retries are not kept
+func (gw *BackendGateway) retry(e *mail.Envelope, retry RetryFunc, stop chan struct{}) {
+	defer gw.retries.Done()
+	expires := time.Now().Add(gw.retryFor())
+	wait := retryInterval
+	for {
+		if left := time.Until(expires); wait > left {
+			wait = left
+		}
+		last := false
+		select {
+		case <-time.After(wait):
+			last = !time.Now().Before(expires)
+		case <-stop:
+			last = true
+		}
+		failed := retry(e)
+		var bounced []BouncedRcpt
+		var pending []mail.Address
+		for _, rcpt := range e.RcptTo {
+			reply, ok := failed[rcpt.String()]
+			if !ok {
+				continue
+			}
+			if last || strings.HasPrefix(reply, "5") {
+				bounced = append(bounced, BouncedRcpt{Rcpt: rcpt, Reply: reply})
+			} else {
+				pending = append(pending, rcpt)
+			}
+		}
+		if len(bounced) > 0 {
+			gw.bounce(e, bounced)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		Log().Infof("%s is retried for %d recipients", e.QueuedId, len(pending))
+		e.RcptTo = pending
+		if wait *= 2; wait > retryMaxInterval {
+			wait = retryMaxInterval
+		}
+	}
+}
+
+// retryFor returns how long the recipients are retried, see GatewayConfig.RetryFor
+func (gw *BackendGateway) retryFor() time.Duration {
+	if gw.gwConfig.RetryFor == "" {
+		return defaultRetryFor
+	}
+	t, err := time.ParseDuration(gw.gwConfig.RetryFor)
+	if err != nil {
+		return defaultRetryFor
+	}
+	return t
+}
+
+// bounce records the recipients as bounced and sends the delivery status notification to the
+// sender, through the bounce_process chain as it has the null sender
+func (gw *BackendGateway) bounce(e *mail.Envelope, bounced []BouncedRcpt) {
+	for _, b := range bounced {
+		TrackRcptDelivery(e, b.Rcpt, DeliveryBounced, b.Reply)
+	}
+	host := gw.gwConfig.PrimaryHost
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	dsn := NewDSN(e, host, bounced)
+	if dsn == nil {
+		// bounces are not bounced
+		return
+	}
+	res := gw.Process(dsn)
+	if res.Code() >= 300 {
+		Log().Errorf("could not send the DSN of %s to %s: %s", e.QueuedId, e.MailFrom.String(), res)
+		TrackDelivery(dsn, DeliveryRejected, res.String())
+		return
+	}
+	TrackDelivery(dsn, DeliveryQueued, res.String())
+}
+
+// enhancedStatus finds the enhanced status code in a reply, eg. 5.1.1
+var enhancedStatus = regexp.MustCompile(`\b[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// dsnStatus returns the status of a bounced recipient for the DSN, from its reply
+func dsnStatus(reply string) string {
+	if status := enhancedStatus.FindString(reply); status != "" {
+		return status
+	}
+	if strings.HasPrefix(reply, "4") {
+		return "4.0.0"
+	}
+	return "5.0.0"
+}
+
+// NewDSN returns a delivery status notification (RFC 3464) that tells the sender of e that it could
+// not be delivered to the failed recipients, reported by the host. It's nil when e has the null
+// sender, so that bounces don't loop
+func NewDSN(e *mail.Envelope, host string, failed []BouncedRcpt) *mail.Envelope {
+	if e.MailFrom.NullPath || e.MailFrom.IsEmpty() || len(failed) == 0 {
+		return nil
+	}
+	dsn := mail.NewEnvelope("127.0.0.1", 0)
+	id := md5.Sum([]byte(e.QueuedId + strconv.FormatInt(Now().UnixNano(), 10) + failed[0].Rcpt.String()))
+	dsn.QueuedId = fmt.Sprintf("%x", id)
+	dsn.Helo = host
+	dsn.ESMTP = true
+	dsn.Tenant = e.Tenant
+	dsn.MailFrom = mail.Address{NullPath: true}
+	dsn.RcptTo = []mail.Address{e.MailFrom}
+	dsn.Subject = "Undelivered Mail Returned to Sender"
+	dsn.Values[dsnOfValue] = e.QueuedId
+
+	boundary := "=_" + dsn.QueuedId
+	w := &dsn.Data
+	fmt.Fprintf(w, "From: Mail Delivery System <MAILER-DAEMON@%s>\n", host)
+	fmt.Fprintf(w, "To: <%s>\n", e.MailFrom.String())
+	fmt.Fprintf(w, "Subject: %s\n", dsn.Subject)
+	fmt.Fprintf(w, "Date: %s\n", Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Message-Id: %s\n", composeMessageId("MAILER-DAEMON@"+host))
+	fmt.Fprintf(w, "Auto-Submitted: auto-replied\n")
+	fmt.Fprintf(w, "MIME-Version: 1.0\n")
+	fmt.Fprintf(w, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\n\n", boundary)
+
+	fmt.Fprintf(w, "--%s\nContent-Type: text/plain; charset=utf-8\n\n", boundary)
+	fmt.Fprintf(w, "Your message could not be delivered to these recipients:\n\n")
+	for _, f := range failed {
+		fmt.Fprintf(w, "<%s>: %s\n", f.Rcpt.String(), f.Reply)
+	}
+
+	fmt.Fprintf(w, "\n--%s\nContent-Type: message/delivery-status\n\n", boundary)
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\n", host)
+	for _, f := range failed {
+		fmt.Fprintf(w, "\nFinal-Recipient: rfc822; %s\nAction: failed\nStatus: %s\n",
+			f.Rcpt.String(), dsnStatus(f.Reply))
+		if len(f.Reply) > 3 && f.Reply[3] == ' ' {
+			if _, err := strconv.Atoi(f.Reply[:3]); err == nil {
+				fmt.Fprintf(w, "Diagnostic-Code: smtp; %s\n", f.Reply)
+			}
+		}
+	}
+
+	if headers := originalHeaders(e.Data.Bytes()); len(headers) > 0 {
+		fmt.Fprintf(w, "\n--%s\nContent-Type: text/rfc822-headers\n\n", boundary)
+		w.Write(headers)
+	}
+	fmt.Fprintf(w, "\n--%s--\n", boundary)
+	_ = dsn.ParseHeaders()
+	return dsn
+}
+
+// originalHeaders returns the header of a message, up to the blank line
+func originalHeaders(data []byte) []byte {
+	if i := bytes.Index(data, []byte("\n\n")); i > -1 {
+		return data[:i+1]
+	}
+	return nil
+}
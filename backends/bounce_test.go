@@ -0,0 +1,233 @@
+package backends
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestNewDSN(t *testing.T) {
+	e := newBrokerTestEnvelope()
+	dsn := NewDSN(e, "mx.example.com", []BouncedRcpt{
+		{Rcpt: e.RcptTo[1], Reply: "550 5.1.1 <eve@other.com> User doesn't exist"},
+		{Rcpt: e.RcptTo[0], Reply: "dial tcp: connection refused"},
+	})
+	if dsn == nil {
+		t.Fatal("expected a DSN")
+	}
+	if !dsn.MailFrom.NullPath || len(dsn.RcptTo) != 1 || dsn.RcptTo[0].String() != "test@example.com" {
+		t.Error("expected the DSN to go from the null sender to the sender, got", dsn.MailFrom, dsn.RcptTo)
+	}
+	data := dsn.Data.String()
+	for _, line := range []string{
+		"From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\n",
+		"Auto-Submitted: auto-replied\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Reporting-MTA: dns; mx.example.com\n",
+		"Final-Recipient: rfc822; eve@other.com\nAction: failed\nStatus: 5.1.1\n" +
+			"Diagnostic-Code: smtp; 550 5.1.1 <eve@other.com> User doesn't exist\n",
+		// without a reply, the reason is only in the text
+		"Final-Recipient: rfc822; bob@Acme.com\nAction: failed\nStatus: 5.0.0\n\n",
+		"<bob@Acme.com>: dial tcp: connection refused\n",
+		"Content-Type: text/rfc822-headers\n\nSubject: hello\nMessage-Id: <m1@example.com>\n\n--",
+	} {
+		if !strings.Contains(data, line) {
+			t.Errorf("expected %q in %s", line, data)
+		}
+	}
+	if dsn.Header == nil || dsn.Header.Get("Subject") != "Undelivered Mail Returned to Sender" {
+		t.Error("expected the headers of the DSN to be parsed")
+	}
+
+	// bounces are not bounced
+	e.MailFrom = mail.Address{NullPath: true}
+	if NewDSN(e, "mx.example.com", []BouncedRcpt{{Rcpt: e.RcptTo[0], Reply: "550 no"}}) != nil {
+		t.Error("expected no DSN for the null sender")
+	}
+}
+
+func TestGatewayBounce(t *testing.T) {
+	defer func() {
+		Deliveries = nil
+	}()
+	dsns := make(chan *mail.Envelope, 10)
+	processors["dsnsink"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					dsns <- e
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	defer delete(processors, "dsnsink")
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	Svc.SetMainlog(logger)
+	Svc.reset()
+	gw := &BackendGateway{}
+	if err := gw.Initialize(BackendConfig{
+		"save_process":           "Debugger",
+		"bounce_process":         "DSNSink",
+		"primary_mail_host":      "mx.example.com",
+		"log_received_mails":     true,
+		"delivery_tracking_size": 10,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		select {
+		case dsn := <-dsns:
+			return dsn.Data.String()
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected a DSN")
+		}
+		return ""
+	}
+
+	e := newBrokerTestEnvelope()
+	e.QueuedId = "notify1"
+	BounceRcpt(e, e.RcptTo[1], "550 5.1.1 no such user")
+	gw.Notify(e)
+	if dsn := next(); !strings.Contains(dsn, "Final-Recipient: rfc822; eve@other.com\nAction: failed\nStatus: 5.1.1") ||
+		strings.Contains(dsn, "bob@Acme.com") {
+		t.Error("expected only eve in the DSN, got", dsn)
+	}
+	var bounced []string
+	for _, r := range Deliveries.Lookup("notify1") {
+		for _, event := range r.Events {
+			if event.State == DeliveryBounced {
+				bounced = append(bounced, event.Recipient)
+			}
+		}
+	}
+	if strings.Join(bounced, " ") != "eve@other.com" {
+		t.Error("expected eve to be recorded as bounced, got", bounced)
+	}
+
+	// no DSN for a bounce
+	e = newBrokerTestEnvelope()
+	e.MailFrom = mail.Address{NullPath: true}
+	BounceRcpt(e, e.RcptTo[0], "550 5.1.1 no such user")
+	gw.Notify(e)
+	if err := gw.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dsn := <-dsns:
+		t.Error("expected no DSN for a bounce, got", dsn.Data.String())
+	default:
+	}
+}
+
+func TestGatewayRetry(t *testing.T) {
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = time.Millisecond * 10
+	defer func() {
+		Deliveries = nil
+	}()
+	dsns := make(chan *mail.Envelope, 10)
+	processors["dsnsink"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					dsns <- e
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	defer delete(processors, "dsnsink")
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	Svc.SetMainlog(logger)
+	Svc.reset()
+	gw := &BackendGateway{}
+	if err := gw.Initialize(BackendConfig{
+		"save_process":           "Debugger",
+		"bounce_process":         "DSNSink",
+		"gw_retry_for":           "300ms",
+		"primary_mail_host":      "mx.example.com",
+		"log_received_mails":     true,
+		"delivery_tracking_size": 10,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		select {
+		case dsn := <-dsns:
+			return dsn.Data.String()
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected a DSN")
+		}
+		return ""
+	}
+
+	var tries sync.Map
+	e := newBrokerTestEnvelope()
+	e.QueuedId = "notify1"
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "later", Host: "acme.com"}, mail.Address{User: "never", Host: "acme.com"})
+	BounceRcpt(e, e.RcptTo[1], "550 5.1.1 no such user")
+	RetryRcpts(e, e.RcptTo[2:], func(e *mail.Envelope) map[string]string {
+		failed := make(map[string]string)
+		for _, rcpt := range e.RcptTo {
+			n, _ := tries.LoadOrStore(rcpt.User, 0)
+			tries.Store(rcpt.User, n.(int)+1)
+			// later gets it on the second try
+			if rcpt.User == "never" || n.(int) == 0 {
+				failed[rcpt.String()] = "452 4.2.2 mailbox full"
+			}
+		}
+		return failed
+	})
+	gw.Notify(e)
+	// eve is bounced right away
+	if dsn := next(); !strings.Contains(dsn, "Final-Recipient: rfc822; eve@other.com") || strings.Contains(dsn, "acme.com") {
+		t.Error("expected only eve in the first DSN, got", dsn)
+	}
+	// never is bounced once the retries expired
+	if dsn := next(); !strings.Contains(dsn, "Final-Recipient: rfc822; never@acme.com\nAction: failed\nStatus: 4.2.2") ||
+		strings.Contains(dsn, "later@acme.com") {
+		t.Error("expected only never in the second DSN, got", dsn)
+	}
+	if n, _ := tries.Load("later"); n != 2 {
+		t.Error("expected later to be tried twice, got", n)
+	}
+	if n, _ := tries.Load("never"); n.(int) < 3 {
+		t.Error("expected never to be retried until it expired, got", n)
+	}
+	var bounced []string
+	for _, r := range Deliveries.Lookup("notify1") {
+		for _, event := range r.Events {
+			if event.State == DeliveryBounced {
+				bounced = append(bounced, event.Recipient)
+			}
+		}
+	}
+	if strings.Join(bounced, " ") != "eve@other.com never@acme.com" {
+		t.Error("expected eve and never to be recorded as bounced, got", bounced)
+	}
+
+	// the retries that are left are tried once more when the gateway shuts down
+	retryInterval = time.Hour
+	e = newBrokerTestEnvelope()
+	RetryRcpts(e, e.RcptTo[:1], func(e *mail.Envelope) map[string]string {
+		return map[string]string{e.RcptTo[0].String(): "451 4.3.0 try again"}
+	})
+	gw.Notify(e)
+	if err := gw.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if dsn := next(); !strings.Contains(dsn, "Final-Recipient: rfc822; bob@Acme.com\nAction: failed\nStatus: 4.3.0") {
+		t.Error("expected bob to be bounced at shutdown, got", dsn)
+	}
+}
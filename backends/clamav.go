@@ -0,0 +1,106 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks of INSTREAM
+const clamdChunkSize = 64 << 10
+
+var errClamdSizeLimit = errors.New("clamd: the email is bigger than its StreamMaxLength")
+
+// clamdScan streams r to clamd at addr, see socketAddress, with the INSTREAM command, and
+// returns the name of the signature that was found, or "" when it's clean
+func clamdScan(addr string, timeout time.Duration, r io.Reader) (string, error) {
+	network, address := socketAddress(addr)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	// each chunk is sent after its length, as 4 bytes in network order, and a 0 length ends it
+	buf := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			_, _ = w.Write(size[:])
+			if _, err := w.Write(buf[:n]); err != nil {
+				// clamd may have closed the connection when the size limit was reached
+				break
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return "", readErr
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	_, _ = w.Write(size[:])
+	_ = w.Flush()
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return parseClamdReply(reply)
+}
+
+// clamdPing checks that clamd at addr answers the PING command
+func clamdPing(addr string, timeout time.Duration) error {
+	network, address := socketAddress(addr)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return err
+	}
+	if reply = strings.TrimSpace(strings.TrimRight(reply, "\x00")); reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply to PING %q", reply)
+	}
+	return nil
+}
+
+// parseClamdReply parses eg. "stream: OK", "stream: Eicar-Signature FOUND" or
+// "INSTREAM size limit exceeded. ERROR"
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		reply = strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(reply, ": "); i >= 0 {
+			reply = reply[i+2:]
+		}
+		return reply, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return "", errClamdSizeLimit
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
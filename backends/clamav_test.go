@@ -0,0 +1,143 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestParseClamdReply(t *testing.T) {
+	for reply, want := range map[string]string{
+		"stream: OK\x00":                         "",
+		"stream: Win.Test.EICAR_HDB-1 FOUND\x00": "Win.Test.EICAR_HDB-1",
+	} {
+		if got, err := parseClamdReply(reply); err != nil || got != want {
+			t.Errorf("expected %q, got %q, %v", want, got, err)
+		}
+	}
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR\x00"); err != errClamdSizeLimit {
+		t.Error("expected the size limit error, got", err)
+	}
+	if _, err := parseClamdReply("stream: Can't allocate memory ERROR\x00"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// clamdTestServer finds a virus in the streams that contain EICAR
+func clamdTestServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			cmd, err := r.ReadString(0)
+			if err == nil && cmd == "zPING\x00" {
+				_, _ = conn.Write([]byte("PONG\x00"))
+			}
+			if err != nil || cmd != "zINSTREAM\x00" {
+				_ = conn.Close()
+				continue
+			}
+			var data bytes.Buffer
+			for {
+				var size uint32
+				if err := binary.Read(r, binary.BigEndian, &size); err != nil || size == 0 {
+					break
+				}
+				if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+					break
+				}
+			}
+			if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+				_, _ = conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+			} else {
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}
+			_ = conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestClamAV(t *testing.T) {
+	listener := clamdTestServer(t)
+	defer func() {
+		_ = listener.Close()
+	}()
+	dir, err := ioutil.TempDir("", "clamav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	infected := func() *mail.Envelope {
+		e := newBrokerTestEnvelope()
+		e.Data.WriteString(strings.Repeat("x", clamdChunkSize) + "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR\n")
+		return e
+	}
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":   "ClamAV|Debugger",
+		"clamav_address": listener.Addr().String(),
+	})
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the clean mail to be accepted, got", result)
+	}
+	if v := GetVerdicts(e); len(v) != 1 || v[0].Result != "clean" {
+		t.Errorf("unexpected verdicts %+v", v)
+	}
+	e = infected()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "550 5.7.1") ||
+		!strings.Contains(result.String(), "Eicar-Signature") {
+		t.Error("expected the infected mail to be rejected, got", result)
+	}
+	_ = backend.Shutdown()
+
+	backend = newBrokerTestBackend(t, BackendConfig{
+		"save_process":   "ClamAV|Debugger",
+		"clamav_address": listener.Addr().String(),
+		"clamav_action":  "tag",
+	})
+	e = infected()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the tagged mail to be accepted, got", result)
+	}
+	if e.Values["virus_signature"] != "Eicar-Signature" || strings.Join(e.Tags.Values("virus"), ",") != "infected" {
+		t.Error("expected the signature to be recorded, got", e.Values["virus_signature"], e.Tags)
+	}
+	_ = backend.Shutdown()
+
+	backend = newBrokerTestBackend(t, BackendConfig{
+		"save_process":          "ClamAV|Debugger",
+		"clamav_address":        listener.Addr().String(),
+		"clamav_action":         "quarantine",
+		"clamav_quarantine_dir": filepath.Join(dir, "{tenant}"),
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e = infected()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the quarantined mail to be accepted, got", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme", e.QueuedId+".eml")); err != nil {
+		t.Error("expected the mail to be quarantined,", err)
+	}
+}
@@ -0,0 +1,129 @@
+package backends
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the time-sensitive parts of the server and the processors, such as
+// expiries, time windows and the timestamps of signatures, so that tests can move the time
+// instead of sleeping. See SetClock
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockConfig is read from the backend config
+type ClockConfig struct {
+	// Skew is how far the clocks of other hosts may be from ours, eg. "2m". Times set by other
+	// hosts, such as the expiry of a signature or an OCSP response, are checked with this margin
+	Skew string `json:"clock_skew,omitempty"`
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock = struct {
+	sync.RWMutex
+	c    Clock
+	skew time.Duration
+}{c: systemClock{}}
+
+// SetClock replaces the clock, eg. with a ManualClock in tests, and returns the previous one.
+// A nil clock restores the system's
+func SetClock(c Clock) Clock {
+	if c == nil {
+		c = systemClock{}
+	}
+	clock.Lock()
+	defer clock.Unlock()
+	prev := clock.c
+	clock.c = c
+	return prev
+}
+
+// Now returns the time of the clock
+func Now() time.Time {
+	clock.RLock()
+	defer clock.RUnlock()
+	return clock.c.Now()
+}
+
+// ClockSkew returns how far the clocks of other hosts may be from ours, see SetClockSkew
+func ClockSkew() time.Duration {
+	clock.RLock()
+	defer clock.RUnlock()
+	return clock.skew
+}
+
+// SetClockSkew sets how far the clocks of other hosts may be from ours. It's set from the
+// clock_skew option when the backend is initialized
+func SetClockSkew(skew time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.skew = skew
+}
+
+// Expired returns true once the deadline, set by another host, has passed by more than the
+// clock skew, eg. the expiry of a signature
+func Expired(deadline time.Time) bool {
+	return Now().After(deadline.Add(ClockSkew()))
+}
+
+// Premature returns true when a time set by another host is ahead of the clock by more than
+// the clock skew, eg. a signature made in the future
+func Premature(t time.Time) bool {
+	return t.After(Now().Add(ClockSkew()))
+}
+
+// ManualClock is a Clock that only moves when it's set or advanced, for tests
+type ManualClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a clock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now
+func (c *ManualClock) Set(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// configureClock sets the clock skew from the clock_skew option
+func configureClock(backendConfig BackendConfig) error {
+	configType := BaseConfig(&ClockConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return err
+	}
+	config := bcfg.(*ClockConfig)
+	var skew time.Duration
+	if config.Skew != "" {
+		if skew, err = time.ParseDuration(config.Skew); err != nil || skew < 0 {
+			return fmt.Errorf("invalid clock_skew %q", config.Skew)
+		}
+	}
+	SetClockSkew(skew)
+	return nil
+}
@@ -0,0 +1,55 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := NewManualClock(start)
+	prev := SetClock(c)
+	defer SetClock(prev)
+	defer SetClockSkew(0)
+	if err := configureClock(BackendConfig{"clock_skew": "2m"}); err != nil {
+		t.Fatal(err)
+	}
+	if ClockSkew() != time.Minute*2 {
+		t.Error("expected a skew of 2m, got", ClockSkew())
+	}
+	if Expired(start.Add(-time.Minute)) || !Expired(start.Add(-time.Minute*3)) {
+		t.Error("expected a deadline to expire once it's past by more than the skew")
+	}
+	if Premature(start.Add(time.Minute)) || !Premature(start.Add(time.Minute*3)) {
+		t.Error("expected a time to be premature once it's ahead by more than the skew")
+	}
+	if err := configureClock(BackendConfig{"clock_skew": "-1m"}); err == nil {
+		t.Error("expected a negative clock_skew to be refused")
+	}
+
+	// the suppressions expire with the clock, without waiting
+	dir, err := ioutil.TempDir("", "clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	l, err := OpenSuppressionList(filepath.Join(dir, "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetTTL(SuppressionBounce, time.Hour)
+	_ = l.Add(Suppression{Address: "bob@example.com", Reason: SuppressionBounce})
+	c.Advance(time.Minute * 59)
+	if _, ok := l.Suppressed("", "bob@example.com"); !ok {
+		t.Error("expected bob to be suppressed for an hour")
+	}
+	c.Advance(time.Minute)
+	if _, ok := l.Suppressed("", "bob@example.com"); ok {
+		t.Error("expected the suppression to expire after an hour")
+	}
+}
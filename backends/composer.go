@@ -0,0 +1,388 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// MessageTemplate describes a message to compose, eg. an auto-reply, a bounce or a notification.
+// The header values, the text, the html and the content of the attachments are templates,
+// executed with the data given to Composer.Compose, eg. a *ComposeData
+type MessageTemplate struct {
+	// Headers are eg. "From", "To" and "Subject". Date, Message-Id and MIME-Version are
+	// added when they are not set
+	Headers map[string]string `json:"headers"`
+	// Text is the text/plain body
+	Text string `json:"text,omitempty"`
+	// HTML is the text/html body, it's an alternative to Text when both are set. Values are
+	// escaped by the html/template package
+	HTML        string               `json:"html,omitempty"`
+	Attachments []AttachmentTemplate `json:"attachments,omitempty"`
+}
+
+// AttachmentTemplate is a file attached to a composed message
+type AttachmentTemplate struct {
+	Filename string `json:"filename"`
+	// ContentType defaults to the type of the extension of Filename
+	ContentType string `json:"content_type,omitempty"`
+	// Content is a template of the content, used when Path is empty
+	Content string `json:"content,omitempty"`
+	// Path is a file that is attached as is
+	Path string `json:"path,omitempty"`
+}
+
+// ComposeData is the data of an envelope that templates can use, eg. {{.From}} or {{.Subject}}
+type ComposeData struct {
+	From      string
+	To        []string
+	Subject   string
+	MessageId string
+	QueuedId  string
+	Tenant    string
+	RemoteIP  string
+	Helo      string
+	Date      time.Time
+	// Header are the headers of the message, eg. {{.Header.Get "Reply-To"}}
+	Header *mail.Header
+	// Values are set by the caller, eg. the reason of a bounce
+	Values map[string]interface{}
+}
+
+// NewComposeData returns the data of the envelope
+func NewComposeData(e *mail.Envelope) *ComposeData {
+	d := &ComposeData{
+		From:     e.MailFrom.String(),
+		Subject:  e.Subject,
+		QueuedId: e.QueuedId,
+		Tenant:   e.Tenant,
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+		Date:     time.Now(),
+		Header:   e.HeaderIndex,
+		Values:   make(map[string]interface{}),
+	}
+	for i := range e.RcptTo {
+		d.To = append(d.To, e.RcptTo[i].String())
+	}
+	if d.Header == nil {
+		d.Header = mail.NewHeader()
+	}
+	d.MessageId = strings.Trim(d.Header.Get("Message-Id"), "<>")
+	return d
+}
+
+// Composer builds RFC 5322 messages from a MessageTemplate. It's safe for concurrent use
+type Composer struct {
+	headers     map[string]*template.Template
+	text        *template.Template
+	html        *htmltemplate.Template
+	attachments []composerAttachment
+}
+
+type composerAttachment struct {
+	filename    string
+	contentType string
+	content     *template.Template
+	data        []byte
+}
+
+// addressHeaders are parsed as address lists, so that only the display names are encoded
+var addressHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Sender": true,
+}
+
+// NewComposer parses the templates of t
+func NewComposer(t MessageTemplate) (*Composer, error) {
+	if t.Text == "" && t.HTML == "" {
+		return nil, fmt.Errorf("the message template has no text or html")
+	}
+	c := &Composer{headers: make(map[string]*template.Template)}
+	for name, value := range t.Headers {
+		tmpl, err := template.New(name).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of the %s header: %s", name, err)
+		}
+		c.headers[textproto.CanonicalMIMEHeaderKey(name)] = tmpl
+	}
+	var err error
+	if t.Text != "" {
+		if c.text, err = template.New("text").Parse(t.Text); err != nil {
+			return nil, fmt.Errorf("invalid text template: %s", err)
+		}
+	}
+	if t.HTML != "" {
+		if c.html, err = htmltemplate.New("html").Parse(t.HTML); err != nil {
+			return nil, fmt.Errorf("invalid html template: %s", err)
+		}
+	}
+	for _, at := range t.Attachments {
+		a := composerAttachment{filename: at.Filename, contentType: at.ContentType}
+		if a.filename == "" && at.Path != "" {
+			a.filename = filepath.Base(at.Path)
+		}
+		if a.filename == "" {
+			return nil, fmt.Errorf("an attachment has no filename")
+		}
+		if a.contentType == "" {
+			if a.contentType = mime.TypeByExtension(filepath.Ext(a.filename)); a.contentType == "" {
+				a.contentType = "application/octet-stream"
+			}
+		}
+		if at.Path != "" {
+			if a.data, err = ioutil.ReadFile(at.Path); err != nil {
+				return nil, err
+			}
+		} else if a.content, err = template.New(a.filename).Parse(at.Content); err != nil {
+			return nil, fmt.Errorf("invalid template of the attachment %s: %s", a.filename, err)
+		}
+		c.attachments = append(c.attachments, a)
+	}
+	return c, nil
+}
+
+// LoadComposer reads a MessageTemplate from a json file
+func LoadComposer(path string) (*Composer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t MessageTemplate
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("could not read the message template %s: %s", path, err)
+	}
+	return NewComposer(t)
+}
+
+// Compose executes the templates with data, and returns the message with CRLF line endings
+func (c *Composer) Compose(data interface{}) ([]byte, error) {
+	header := make(textproto.MIMEHeader)
+	for name, tmpl := range c.headers {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			return nil, fmt.Errorf("could not compose the %s header: %s", name, err)
+		}
+		value, err := encodeHeader(name, strings.TrimSpace(sb.String()))
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+	if header.Get("From") == "" {
+		return nil, fmt.Errorf("the composed message has no From header")
+	}
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().Format(time.RFC1123Z))
+	}
+	if header.Get("Message-Id") == "" {
+		header.Set("Message-Id", composeMessageId(header.Get("From")))
+	}
+	header.Set("Mime-Version", "1.0")
+
+	var body bytes.Buffer
+	contentType, err := c.writeBody(&body, data)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", contentType)
+	if !strings.HasPrefix(contentType, "multipart/") {
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+
+	var msg bytes.Buffer
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := name
+		if key == "Mime-Version" {
+			key = "MIME-Version"
+		}
+		_, _ = fmt.Fprintf(&msg, "%s: %s\r\n", key, header.Get(name))
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// writeBody writes the parts of the body and returns its content type
+func (c *Composer) writeBody(w io.Writer, data interface{}) (string, error) {
+	if len(c.attachments) == 0 {
+		return c.writeAlternatives(w, data)
+	}
+	mw := multipart.NewWriter(w)
+	var part bytes.Buffer
+	contentType, err := c.writeAlternatives(&part, data)
+	if err != nil {
+		return "", err
+	}
+	h := textproto.MIMEHeader{"Content-Type": {contentType}}
+	if !strings.HasPrefix(contentType, "multipart/") {
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return "", err
+	}
+	_, _ = pw.Write(part.Bytes())
+	for _, a := range c.attachments {
+		content := a.data
+		if a.content != nil {
+			var buf bytes.Buffer
+			if err := a.content.Execute(&buf, data); err != nil {
+				return "", fmt.Errorf("could not compose the attachment %s: %s", a.filename, err)
+			}
+			content = buf.Bytes()
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachmentType(a.contentType, a.filename)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return "", err
+		}
+		writeBase64Lines(pw, content)
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return "multipart/mixed; boundary=" + mw.Boundary(), nil
+}
+
+// writeAlternatives writes the text, the html, or both as a multipart/alternative
+func (c *Composer) writeAlternatives(w io.Writer, data interface{}) (string, error) {
+	var text, html bytes.Buffer
+	if c.text != nil {
+		if err := c.text.Execute(&text, data); err != nil {
+			return "", fmt.Errorf("could not compose the text: %s", err)
+		}
+	}
+	if c.html != nil {
+		if err := c.html.Execute(&html, data); err != nil {
+			return "", fmt.Errorf("could not compose the html: %s", err)
+		}
+	}
+	const textType, htmlType = "text/plain; charset=utf-8", "text/html; charset=utf-8"
+	if c.html == nil {
+		return textType, writeQuotedPrintable(w, text.Bytes())
+	} else if c.text == nil {
+		return htmlType, writeQuotedPrintable(w, html.Bytes())
+	}
+	mw := multipart.NewWriter(w)
+	// the last alternative is the preferred one
+	for _, alt := range []struct {
+		contentType string
+		body        []byte
+	}{{textType, text.Bytes()}, {htmlType, html.Bytes()}} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alt.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := writeQuotedPrintable(pw, alt.body); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return "multipart/alternative; boundary=" + mw.Boundary(), nil
+}
+
+// attachmentType returns the content type with the name parameter of the file
+func attachmentType(contentType, filename string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", make(map[string]string)
+	}
+	params["name"] = filename
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// writeQuotedPrintable writes the text with CRLF line endings
+func writeQuotedPrintable(w io.Writer, text []byte) error {
+	text = bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+	text = bytes.Replace(text, []byte("\n"), []byte("\r\n"), -1)
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write(text); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64Lines writes the data in lines of 76 characters
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		_, _ = io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	_, _ = io.WriteString(w, encoded+"\r\n")
+}
+
+// encodeHeader returns the value with its non-ASCII text encoded (RFC 2047). The display
+// names of address headers are encoded, and their addresses checked
+func encodeHeader(name, value string) (string, error) {
+	value = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "", nil
+	}
+	if addressHeaders[name] {
+		list, err := netmail.ParseAddressList(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s header %q: %s", name, value, err)
+		}
+		addresses := make([]string, len(list))
+		for i, a := range list {
+			addresses[i] = a.String()
+		}
+		return strings.Join(addresses, ", "), nil
+	}
+	return mime.QEncoding.Encode("utf-8", value), nil
+}
+
+// composeMessageId returns a new Message-Id in the domain of the from address
+func composeMessageId(from string) string {
+	domain := "localhost"
+	if a, err := netmail.ParseAddress(from); err == nil {
+		if i := strings.LastIndexByte(a.Address, '@'); i > -1 {
+			domain = a.Address[i+1:]
+		}
+	} else if host, err := os.Hostname(); err == nil {
+		domain = host
+	}
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">"
+}
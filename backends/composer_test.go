@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"strings"
+	"testing"
+)
+
+func TestComposer(t *testing.T) {
+	c, err := NewComposer(MessageTemplate{
+		Headers: map[string]string{
+			"From":    `"Café Support" <support@acme.com>`,
+			"To":      "{{.From}}",
+			"Subject": "Re: {{.Subject}}",
+		},
+		Text: "Hello,\nwe received {{.Subject}}\n",
+		HTML: "<p>we received {{.Subject}}</p>",
+		Attachments: []AttachmentTemplate{
+			{Filename: "ticket.txt", Content: "ticket for {{.From}}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &ComposeData{From: "bob@example.com", Subject: "crème <brûlée>"}
+	raw, err := c.Compose(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.Replace(raw, []byte("\r\n"), nil, -1), []byte("\n")) {
+		t.Error("expected CRLF line endings")
+	}
+	msg, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Re: crème <brûlée>" || msg.Header.Get("To") != "<bob@example.com>" ||
+		msg.Header.Get("Message-Id") == "" || msg.Header.Get("Date") == "" || msg.Header.Get("Mime-Version") != "1.0" {
+		t.Error("unexpected headers", msg.Header)
+	}
+	if from, err := netmail.ParseAddress(msg.Header.Get("From")); err != nil || from.Name != "Café Support" ||
+		!strings.HasSuffix(msg.Header.Get("Message-Id"), "@acme.com>") {
+		t.Error("expected an encoded display name, got", msg.Header.Get("From"), err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatal("expected a multipart/mixed message, got", mediaType)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	alternative, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	altType, altParams, _ := mime.ParseMediaType(alternative.Header.Get("Content-Type"))
+	if altType != "multipart/alternative" {
+		t.Fatal("expected the alternatives first, got", altType)
+	}
+	ar := multipart.NewReader(alternative, altParams["boundary"])
+	var bodies []string
+	for {
+		part, err := ar.NextPart()
+		if err != nil {
+			break
+		}
+		// the reader decodes quoted-printable
+		body, _ := ioutil.ReadAll(part)
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	if len(bodies) != 2 || bodies[0] != "text/plain; charset=utf-8: Hello,\r\nwe received crème <brûlée>\r\n" ||
+		bodies[1] != "text/html; charset=utf-8: <p>we received crème &lt;brûlée&gt;</p>" {
+		t.Errorf("unexpected alternatives %q", bodies)
+	}
+	attachment, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.FileName() != "ticket.txt" || !strings.HasPrefix(attachment.Header.Get("Content-Type"), "text/plain") {
+		t.Error("unexpected attachment", attachment.Header)
+	}
+}
+
+func TestComposerText(t *testing.T) {
+	c, err := NewComposer(MessageTemplate{
+		Headers: map[string]string{"From": "postmaster@acme.com", "Subject": "{{.Subject}}", "Cc": ""},
+		Text:    "{{.Values.reason}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := c.Compose(&ComposeData{Subject: "hi", Values: map[string]interface{}{"reason": "mailbox full"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := netmail.ReadMessage(bytes.NewReader(raw))
+	body, _ := ioutil.ReadAll(msg.Body)
+	if msg.Header.Get("Content-Type") != "text/plain; charset=utf-8" || string(body) != "mailbox full" ||
+		msg.Header.Get("Content-Transfer-Encoding") != "quoted-printable" || msg.Header.Get("Cc") != "" {
+		t.Errorf("unexpected message %q", raw)
+	}
+
+	for _, bad := range []MessageTemplate{
+		{Headers: map[string]string{"From": "a@acme.com"}},
+		{Headers: map[string]string{"From": "{{.From"}, Text: "hi"},
+		{Text: "hi", Attachments: []AttachmentTemplate{{Content: "no name"}}},
+	} {
+		if _, err := NewComposer(bad); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+	c, _ = NewComposer(MessageTemplate{Headers: map[string]string{"To": "a@acme.com"}, Text: "hi"})
+	if _, err := c.Compose(&ComposeData{}); err == nil {
+		t.Error("expected a message without From to be refused")
+	}
+}
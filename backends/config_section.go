@@ -0,0 +1,117 @@
+package backends
+
+import (
+	"sort"
+	"strings"
+)
+
+// Section returns the config seen by the processor name: the flat keys, with the keys of the
+// processor's section in their place, eg. with
+//
+//	"mail_table": "emails",
+//	"sql": {"mail_table": "inbox"}
+//
+// the sql processor gets "inbox", and the other processors "emails". The name is not case sensitive.
+// The flat keys are kept, so configs from before sections need no changes
+func (c BackendConfig) Section(name string) BackendConfig {
+	section := c.section(name)
+	if section == nil {
+		return c
+	}
+	merged := make(BackendConfig, len(c)+len(section))
+	for k, v := range c {
+		merged[k] = v
+	}
+	for k, v := range section {
+		merged[k] = v
+	}
+	return merged
+}
+
+// section returns the keys of the section name, nil when there is no such section
+func (c BackendConfig) section(name string) map[string]interface{} {
+	for k, v := range c {
+		if !strings.EqualFold(k, name) {
+			continue
+		}
+		switch section := v.(type) {
+		case map[string]interface{}:
+			return section
+		case BackendConfig:
+			return section
+		}
+	}
+	return nil
+}
+
+// sectionInitializer initializes a processor with its section of the config
+type sectionInitializer struct {
+	name string
+	processorInitializer
+}
+
+func (i sectionInitializer) Initialize(backendConfig BackendConfig) error {
+	return i.processorInitializer.Initialize(backendConfig.Section(i.name))
+}
+
+// scopeInitializers makes the initializers added since the first n see the section name of the config
+func (s *service) scopeInitializers(n int, name string) {
+	s.Lock()
+	defer s.Unlock()
+	for i := n; i < len(s.initializers); i++ {
+		s.initializers[i] = sectionInitializer{name: name, processorInitializer: s.initializers[i]}
+	}
+}
+
+// countInitializers returns how many initializers were added
+func (s *service) countInitializers() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.initializers)
+}
+
+// markConfigKey records that the key was read by ExtractConfig
+func (s *service) markConfigKey(key string) {
+	s.configKeys.Store(key, true)
+}
+
+// unknownConfigKeys returns the sections of the config that are not named after a processor,
+// and the keys of the processor sections that were not read by ExtractConfig, eg. "sql.mail_tabel"
+func (s *service) unknownConfigKeys(backendConfig BackendConfig) (sections, keys []string) {
+	for name, v := range backendConfig {
+		var section map[string]interface{}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			section = val
+		case BackendConfig:
+			section = val
+		default:
+			continue
+		}
+		if _, ok := processors[strings.ToLower(name)]; !ok {
+			if _, known := s.configKeys.Load(name); !known {
+				sections = append(sections, name)
+			}
+			continue
+		}
+		for key := range section {
+			if _, ok := s.configKeys.Load(key); !ok {
+				keys = append(keys, name+"."+key)
+			}
+		}
+	}
+	sort.Strings(sections)
+	sort.Strings(keys)
+	return sections, keys
+}
+
+// warnUnknownConfigKeys logs the sections and keys that no processor uses, which are probably misspelled
+func (s *service) warnUnknownConfigKeys(backendConfig BackendConfig) {
+	sections, keys := s.unknownConfigKeys(backendConfig)
+	for _, name := range sections {
+		Log().Warnf("backend_config has a section %q, but there is no processor by that name", name)
+	}
+	for _, key := range keys {
+		Log().Warnf("backend_config has %q, but the processor doesn't use it", key)
+	}
+}
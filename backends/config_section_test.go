@@ -0,0 +1,90 @@
+package backends
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestConfigSection(t *testing.T) {
+	config := BackendConfig{
+		"mail_table": "emails",
+		"SQL":        map[string]interface{}{"mail_table": "inbox"},
+	}
+	if table := config.Section("sql")["mail_table"]; table != "inbox" {
+		t.Error("expected the section's key, got", table)
+	}
+	if table := config.Section("redis")["mail_table"]; table != "emails" {
+		t.Error("expected the flat key, got", table)
+	}
+	if config["mail_table"] != "emails" {
+		t.Error("expected the config to be left as it was")
+	}
+}
+
+func TestConfigSectionProcessors(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	type greeterConfig struct {
+		Greeting string `json:"greeting"`
+	}
+	// each greeter tags the email with its greeting
+	greeter := func(name string) ProcessorConstructor {
+		return func() Decorator {
+			var config *greeterConfig
+			Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+				bcfg, err := Svc.ExtractConfig(backendConfig, &greeterConfig{})
+				if err != nil {
+					return err
+				}
+				config = bcfg.(*greeterConfig)
+				return nil
+			}))
+			return func(p Processor) Processor {
+				return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+					if task == TaskSaveMail {
+						e.Tags.Add(name, config.Greeting)
+					}
+					return p.Process(e, task)
+				})
+			}
+		}
+	}
+	processors["hello"] = greeter("hello")
+	processors["bonjour"] = greeter("bonjour")
+	defer delete(processors, "hello")
+	defer delete(processors, "bonjour")
+
+	Svc.reset()
+	config := BackendConfig{
+		"save_process": "Hello|Bonjour",
+		"greeting":     "hi",
+		"bonjour":      map[string]interface{}{"greeting": "salut", "greting": "typo"},
+		"hola":         map[string]interface{}{"greeting": "hola"},
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(config); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "test", Host: "example.com"}}
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Fatal("expected the email to be saved, got", result)
+	}
+	if fmt.Sprint(e.Tags.Values("hello"), e.Tags.Values("bonjour")) != "[hi] [salut]" {
+		t.Error("expected each processor to get its greeting, got", e.Tags.Strings())
+	}
+
+	sections, keys := Svc.unknownConfigKeys(config)
+	if fmt.Sprint(sections) != "[hola]" || fmt.Sprint(keys) != "[bonjour.greting]" {
+		t.Error("unexpected unknown sections", sections, "and keys", keys)
+	}
+}
@@ -1,5 +1,20 @@
 package backends
 
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ErrBudgetExceeded is returned when the envelope's Deadline passed before processing finished
+var ErrBudgetExceeded = errors.New("processing time budget exceeded")
+
+// ErrStepAborted is returned when a StepFunc stopped the processing of the envelope
+var ErrStepAborted = errors.New("processing stopped by the step function")
+
 // We define what a decorator to our processor will look like
 type Decorator func(Processor) Processor
 
@@ -11,3 +26,41 @@ func Decorate(c Processor, ds ...Decorator) Processor {
 	}
 	return decorated
 }
+
+// Budgeted wraps a decorator so that its processor is not called once the envelope's Deadline has passed.
+// If optional, the processor is skipped, otherwise processing stops with a temporary failure
+func Budgeted(d Decorator, optional bool) Decorator {
+	return func(next Processor) Processor {
+		p := d(next)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail && !e.Deadline.IsZero() && time.Now().After(e.Deadline) {
+				if optional {
+					return next.Process(e, task)
+				}
+				return NewResult(response.Canned.ErrorBudgetExceeded), ErrBudgetExceeded
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// StepFunc is called before each processor of a chain with the processor's name, see
+// ChainStepper. Returning false stops the processing
+type StepFunc func(name string, e *mail.Envelope) bool
+
+// steppers are the step functions of the envelopes being stepped through a chain
+var steppers sync.Map
+
+// stepped wraps a decorator so that its processor can be stepped through, see ChainStepper
+func stepped(name string, d Decorator) Decorator {
+	return func(next Processor) Processor {
+		p := d(next)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if step, ok := steppers.Load(e); ok && task == TaskSaveMail && !step.(StepFunc)(name, e) {
+				return NewResult(response.Canned.FailBackendTransaction, response.SP, "stopped before "+name),
+					ErrStepAborted
+			}
+			return p.Process(e, task)
+		})
+	}
+}
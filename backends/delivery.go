@@ -0,0 +1,251 @@
+package backends
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// DeliveryState is a step in the life of a message, for a recipient
+type DeliveryState string
+
+const (
+	// DeliveryReceived is recorded when the message data was received from the client
+	DeliveryReceived DeliveryState = "received"
+	// DeliveryQueued is recorded when the message was accepted with a 250 reply
+	DeliveryQueued DeliveryState = "queued"
+	// DeliveryRejected is recorded when the processors refused the message
+	DeliveryRejected DeliveryState = "rejected"
+	// DeliveryStored is recorded by processors that saved the message, eg. to MySQL or Redis
+	DeliveryStored DeliveryState = "stored"
+	// DeliveryRelayed is recorded by processors that passed the message on to another server
+	DeliveryRelayed DeliveryState = "relayed"
+	// DeliveryBounced is recorded when a message that was accepted could not be delivered: when the sender
+	// is sent a DSN for the recipient, see BounceRcpt, or the suppress processor gets a DSN from the next hop
+	DeliveryBounced DeliveryState = "bounced"
+	// DeliveryComplained is recorded when a recipient reported the message as spam, see the arf processor
+	DeliveryComplained DeliveryState = "complained"
+)
+
+// DeliveryEvent is a state that a message reached for a recipient
+type DeliveryEvent struct {
+	Recipient string        `json:"recipient"`
+	State     DeliveryState `json:"state"`
+	// Detail is eg. the reply that was sent, or the name of the storage
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// DeliveryRecord is the history of a message
+type DeliveryRecord struct {
+	QueuedId  string          `json:"queued_id"`
+	MessageId string          `json:"message_id,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	From      string          `json:"from"`
+	Events    []DeliveryEvent `json:"events"`
+}
+
+// DeliveryStore keeps the delivery records so that they can be looked up
+type DeliveryStore interface {
+	// Record adds the events of r to the record with the same QueuedId, creating it if needed.
+	// The MessageId is set if it was not known before. Events are kept in order of time
+	Record(r DeliveryRecord)
+	// Lookup returns the records with the QueuedId or MessageId, nil if none
+	Lookup(id string) []DeliveryRecord
+}
+
+// Deliveries is where delivery events are recorded, nil when tracking is disabled.
+// The delivery_tracking_size option sets it to a MemoryDeliveryStore when the backend is initialized.
+// To keep the records elsewhere, eg. in a database, set it to your own DeliveryStore instead
+var Deliveries DeliveryStore
+
+// DeliveryTrackingConfig is read from the backend config
+type DeliveryTrackingConfig struct {
+	// Size is how many messages to remember, 0 disables the tracking
+	Size int `json:"delivery_tracking_size,omitempty"`
+}
+
+// TrackDelivery records the state for all the recipients of the envelope
+func TrackDelivery(e *mail.Envelope, state DeliveryState, detail string) {
+	TrackDeliveryAt(e, state, detail, Now())
+}
+
+// TrackDeliveryAt records the state for all the recipients of the envelope, as reached at t.
+// Processors may change the e.QueuedId, so a state reached before processing should be recorded after it
+func TrackDeliveryAt(e *mail.Envelope, state DeliveryState, detail string, t time.Time) {
+	if Deliveries == nil {
+		return
+	}
+	r := newDeliveryRecord(e)
+	for i := range e.RcptTo {
+		r.Events = append(r.Events, DeliveryEvent{
+			Recipient: e.RcptTo[i].String(),
+			State:     state,
+			Detail:    detail,
+			Time:      t,
+		})
+	}
+	Deliveries.Record(r)
+}
+
+// TrackRcptDelivery records the state for one recipient of the envelope
+func TrackRcptDelivery(e *mail.Envelope, rcpt mail.Address, state DeliveryState, detail string) {
+	if Deliveries == nil {
+		return
+	}
+	r := newDeliveryRecord(e)
+	r.Events = []DeliveryEvent{{
+		Recipient: rcpt.String(),
+		State:     state,
+		Detail:    detail,
+		Time:      Now(),
+	}}
+	Deliveries.Record(r)
+}
+
+// trackReportedBounces records the recipients as bounced for the messages with the Message-Id,
+// that a DSN from another server reported as failed
+func trackReportedBounces(messageId string, failed []BouncedRcpt) {
+	if Deliveries == nil || messageId == "" {
+		return
+	}
+	for _, r := range Deliveries.Lookup(messageId) {
+		record := DeliveryRecord{QueuedId: r.QueuedId, MessageId: r.MessageId, Tenant: r.Tenant, From: r.From}
+		for _, f := range failed {
+			record.Events = append(record.Events, DeliveryEvent{
+				Recipient: f.Rcpt.String(),
+				State:     DeliveryBounced,
+				Detail:    f.Reply,
+				Time:      Now(),
+			})
+		}
+		Deliveries.Record(record)
+	}
+}
+
+func newDeliveryRecord(e *mail.Envelope) DeliveryRecord {
+	r := DeliveryRecord{
+		QueuedId: e.QueuedId,
+		Tenant:   e.Tenant,
+		From:     e.MailFrom.String(),
+	}
+	if e.Header != nil {
+		r.MessageId = strings.Trim(e.Header.Get("Message-Id"), "<> ")
+	}
+	return r
+}
+
+// MemoryDeliveryStore keeps the records of the most recent messages in memory
+type MemoryDeliveryStore struct {
+	size    int
+	records map[string]*DeliveryRecord
+	// QueuedIds by MessageId
+	messageIds map[string][]string
+	// QueuedIds in the order they were added, to forget the oldest
+	order []string
+	sync.RWMutex
+}
+
+// NewMemoryDeliveryStore returns a store that remembers up to size messages
+func NewMemoryDeliveryStore(size int) *MemoryDeliveryStore {
+	return &MemoryDeliveryStore{
+		size:       size,
+		records:    make(map[string]*DeliveryRecord),
+		messageIds: make(map[string][]string),
+	}
+}
+
+func (s *MemoryDeliveryStore) Record(r DeliveryRecord) {
+	s.Lock()
+	defer s.Unlock()
+	rec, ok := s.records[r.QueuedId]
+	if !ok {
+		if len(s.order) >= s.size {
+			s.forget(s.order[0])
+			s.order = s.order[1:]
+		}
+		rec = &DeliveryRecord{QueuedId: r.QueuedId, Tenant: r.Tenant, From: r.From}
+		s.records[r.QueuedId] = rec
+		s.order = append(s.order, r.QueuedId)
+	}
+	if rec.MessageId == "" && r.MessageId != "" {
+		rec.MessageId = r.MessageId
+		s.messageIds[r.MessageId] = append(s.messageIds[r.MessageId], r.QueuedId)
+	}
+	if rec.Tenant == "" {
+		rec.Tenant = r.Tenant
+	}
+	rec.Events = append(rec.Events, r.Events...)
+	sort.SliceStable(rec.Events, func(i, j int) bool {
+		return rec.Events[i].Time.Before(rec.Events[j].Time)
+	})
+}
+
+// forget removes a record. The lock must be held
+func (s *MemoryDeliveryStore) forget(queuedId string) {
+	rec, ok := s.records[queuedId]
+	if !ok {
+		return
+	}
+	delete(s.records, queuedId)
+	if rec.MessageId == "" {
+		return
+	}
+	ids := s.messageIds[rec.MessageId][:0]
+	for _, id := range s.messageIds[rec.MessageId] {
+		if id != queuedId {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		delete(s.messageIds, rec.MessageId)
+	} else {
+		s.messageIds[rec.MessageId] = ids
+	}
+}
+
+func (s *MemoryDeliveryStore) Lookup(id string) []DeliveryRecord {
+	s.RLock()
+	defer s.RUnlock()
+	var found []DeliveryRecord
+	if rec, ok := s.records[id]; ok {
+		found = append(found, copyDeliveryRecord(rec))
+	}
+	for _, queuedId := range s.messageIds[strings.Trim(id, "<> ")] {
+		if rec, ok := s.records[queuedId]; ok && queuedId != id {
+			found = append(found, copyDeliveryRecord(rec))
+		}
+	}
+	return found
+}
+
+func copyDeliveryRecord(rec *DeliveryRecord) DeliveryRecord {
+	r := *rec
+	r.Events = append([]DeliveryEvent(nil), rec.Events...)
+	return r
+}
+
+// configureDeliveryTracking sets Deliveries to a MemoryDeliveryStore if enabled by the config.
+// Records are kept when the backend is reinitialized with the same size, and a store
+// that is not a MemoryDeliveryStore is left alone
+func configureDeliveryTracking(backendConfig BackendConfig) error {
+	configType := BaseConfig(&DeliveryTrackingConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return err
+	}
+	config := bcfg.(*DeliveryTrackingConfig)
+	s, ok := Deliveries.(*MemoryDeliveryStore)
+	if Deliveries != nil && !ok {
+		return nil
+	}
+	if config.Size <= 0 {
+		Deliveries = nil
+	} else if !ok || s.size != config.Size {
+		Deliveries = NewMemoryDeliveryStore(config.Size)
+	}
+	return nil
+}
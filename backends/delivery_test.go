@@ -0,0 +1,82 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestMemoryDeliveryStore(t *testing.T) {
+	defer func() {
+		Deliveries = nil
+	}()
+	Deliveries = NewMemoryDeliveryStore(2)
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "q1"
+	e.Tenant = "acme"
+	e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "a", Host: "acme.com"})
+	e.PushRcpt(mail.Address{User: "b", Host: "acme.com"})
+	received := time.Now()
+	TrackRcptDelivery(e, e.RcptTo[1], DeliveryStored, "mysql")
+	// the Message-ID is known once the headers are parsed
+	e.Data.WriteString("Message-ID: <abc@example.com>\n\nhello\n")
+	_ = e.ParseHeaders()
+	TrackDelivery(e, DeliveryQueued, "250 OK")
+	TrackDeliveryAt(e, DeliveryReceived, "127.0.0.1:2525", received)
+
+	for _, id := range []string{"q1", "abc@example.com", "<abc@example.com>"} {
+		records := Deliveries.Lookup(id)
+		if len(records) != 1 {
+			t.Fatal("expected a record for", id, "got", records)
+		}
+		r := records[0]
+		if r.QueuedId != "q1" || r.MessageId != "abc@example.com" || r.Tenant != "acme" || r.From != "sender@example.com" {
+			t.Error("unexpected record", r)
+		}
+		states := ""
+		for _, ev := range r.Events {
+			states += string(ev.State) + ":" + ev.Recipient + " "
+		}
+		expect := "received:a@acme.com received:b@acme.com stored:b@acme.com queued:a@acme.com queued:b@acme.com "
+		if states != expect {
+			t.Error("expected the events", expect, "in order, got", states)
+		}
+	}
+
+	// the oldest record is forgotten
+	for _, id := range []string{"q2", "q3"} {
+		e.QueuedId = id
+		TrackDelivery(e, DeliveryQueued, "250 OK")
+	}
+	if records := Deliveries.Lookup("q1"); records != nil {
+		t.Error("expected q1 to be forgotten, got", records)
+	}
+	if records := Deliveries.Lookup("abc@example.com"); len(records) != 2 {
+		t.Error("expected the Message-ID to find q2 and q3, got", records)
+	}
+}
+
+func TestConfigureDeliveryTracking(t *testing.T) {
+	defer func() {
+		Deliveries = nil
+	}()
+	if err := configureDeliveryTracking(BackendConfig{"delivery_tracking_size": 10}); err != nil {
+		t.Fatal(err)
+	}
+	store, ok := Deliveries.(*MemoryDeliveryStore)
+	if !ok {
+		t.Fatal("expected a MemoryDeliveryStore, got", Deliveries)
+	}
+	// the records are kept when the size does not change
+	_ = configureDeliveryTracking(BackendConfig{"delivery_tracking_size": 10})
+	if Deliveries != store {
+		t.Error("expected the store to be kept")
+	}
+	_ = configureDeliveryTracking(BackendConfig{})
+	if Deliveries != nil {
+		t.Error("expected tracking to be off")
+	}
+}
@@ -0,0 +1,140 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dependencies are the processors that a processor needs before it in the chains that save the
+// mail, by the processor's name
+var dependencies = make(map[string][]string)
+
+// AddDependencies declares the processors that must come before the named processor in the chains
+// that save the mail, eg. the sql processor saves the hashes of the hasher and the subject parsed
+// by the headersparser. A chain without them is refused when the backend is initialized
+func (s *service) AddDependencies(name string, processors ...string) {
+	name = strings.ToLower(name)
+	for _, p := range processors {
+		dependencies[name] = append(dependencies[name], strings.ToLower(p))
+	}
+}
+
+// wholeMessage are the processors that need the whole message in e.Data, by the processor's name
+var wholeMessage = make(map[string]bool)
+
+// AddWholeMessage declares that the named processor needs the whole message in e.Data, eg. to deliver
+// or scan it. When stream_save_process is set, e.Data only has the header section, so a chain that
+// saves the mail with it is refused when the backend is initialized
+func (s *service) AddWholeMessage(name string) {
+	wholeMessage[strings.ToLower(name)] = true
+}
+
+// checkStreamed returns an error for the first processor of the chain that needs the whole message,
+// for the chains that get the streamed messages. option is the name of the chain's setting, for the error
+func checkStreamed(option, stackConfig string) error {
+	cfg := strings.ToLower(strings.TrimSpace(stackConfig))
+	if len(cfg) == 0 {
+		return nil
+	}
+	for _, name := range strings.Split(cfg, "|") {
+		if name = strings.TrimSuffix(name, "?"); wholeMessage[name] {
+			return fmt.Errorf("processor [%s] of %s needs the whole message, which stream_save_process "+
+				"doesn't keep, save it with a stream processor instead: %q", name, option, stackConfig)
+		}
+	}
+	return nil
+}
+
+// checkDependencies returns an error for the first processor of the chain that doesn't have the
+// processors it depends on before it. option is the name of the chain's setting, for the error
+func checkDependencies(option, stackConfig string) error {
+	cfg := strings.ToLower(strings.TrimSpace(stackConfig))
+	if len(cfg) == 0 {
+		return nil
+	}
+	items := strings.Split(cfg, "|")
+	position := make(map[string]int, len(items))
+	for i := range items {
+		items[i] = strings.TrimSuffix(items[i], "?")
+		if _, ok := position[items[i]]; !ok {
+			position[items[i]] = i
+		}
+	}
+	for i, name := range items {
+		for _, dep := range dependencies[name] {
+			at, ok := position[dep]
+			if !ok {
+				return fmt.Errorf("processor [%s] of %s depends on [%s], add it before [%s]: %q",
+					name, option, dep, name, stackConfig)
+			}
+			if at > i {
+				return fmt.Errorf("processor [%s] of %s depends on [%s], move [%s] before it: %q",
+					name, option, dep, dep, stackConfig)
+			}
+		}
+	}
+	return nil
+}
+
+// chainOrder is a processor that should come before the ones that use its work in a chain
+type chainOrder struct {
+	processor string
+	before    []string
+	// missed is what the processors after it do, for the warning
+	missed string
+}
+
+// chainOrders are the known bad orderings, that work but lose something
+var chainOrders = []chainOrder{
+	{"header", []string{"compressor", "sql", "postgresql", "sqlite", "mongodb", "s3", "mbox", "forward"},
+		"without the delivery header"},
+	{"compressor", []string{"sql", "postgresql", "sqlite", "mongodb", "redis", "s3"}, "uncompressed"},
+}
+
+// chainWarnings returns the misconfigurations of the chain that don't stop it from working, eg.
+// a compressor after the processor that saves the email. option is the name of the chain's setting
+func chainWarnings(option, stackConfig string, cfg BackendConfig) []string {
+	stack := strings.ToLower(strings.TrimSpace(stackConfig))
+	if len(stack) == 0 {
+		return nil
+	}
+	items := strings.Split(stack, "|")
+	position := make(map[string]int, len(items))
+	for i := range items {
+		items[i] = strings.TrimSuffix(items[i], "?")
+		if _, ok := position[items[i]]; !ok {
+			position[items[i]] = i
+		}
+	}
+	var warnings []string
+	for _, order := range chainOrders {
+		at, ok := position[order.processor]
+		if !ok {
+			continue
+		}
+		for _, name := range items[:at] {
+			for _, user := range order.before {
+				if name == user {
+					warnings = append(warnings, fmt.Sprintf("[%s] of %s gets the email %s, move [%s] before it: %q",
+						name, option, order.missed, order.processor, stackConfig))
+				}
+			}
+		}
+	}
+	if _, ok := position[strings.ToLower(defaultProcessor)]; ok {
+		cfg = cfg.Section(defaultProcessor)
+		if logged, _ := cfg["log_received_mails"].(bool); logged {
+			warnings = append(warnings, fmt.Sprintf("[debugger] of %s logs the addresses and headers of each "+
+				"email, set log_received_mails to false in production", option))
+		}
+		sleep, _ := cfg["sleep_seconds"].(float64)
+		if n, ok := cfg["sleep_seconds"].(int); ok {
+			sleep = float64(n)
+		}
+		if sleep > 0 {
+			warnings = append(warnings, fmt.Sprintf("[debugger] of %s sleeps for each email, remove "+
+				"sleep_seconds in production", option))
+		}
+	}
+	return warnings
+}
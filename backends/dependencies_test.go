@@ -0,0 +1,123 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	for _, c := range []struct {
+		chain string
+		want  string
+	}{
+		{"", ""},
+		{"HeadersParser|Hasher|Sql", ""},
+		{"Hasher?|HeadersParser|Compressor|SQL|Debugger", ""},
+		{"Hasher|Redis|Debugger", ""},
+		{"Hasher|Sql", "depends on [headersparser], add it before [sql]"},
+		{"HeadersParser|Sql|Hasher", "depends on [hasher], move [hasher] before it"},
+		{"Redis|Hasher", "depends on [hasher], move [hasher] before it"},
+	} {
+		err := checkDependencies("save_process", c.chain)
+		if c.want == "" && err != nil {
+			t.Error("expected", c.chain, "to be valid, got", err)
+		} else if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("expected %q for %s, got %v", c.want, c.chain, err)
+		}
+	}
+
+	// a chain of process_chains is checked too
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	_, err := New(BackendConfig{
+		"save_process":   "HeadersParser|Hasher|Debugger",
+		"process_chains": []interface{}{"reprocess=HeadersParser|Sql"},
+	}, logger)
+	if err == nil || !strings.Contains(err.Error(), "process_chains reprocess depends on [hasher]") {
+		t.Error("expected the chain to be refused, got", err)
+	}
+}
+
+func TestCheckStreamed(t *testing.T) {
+	for _, c := range []struct {
+		chain string
+		want  string
+	}{
+		{"", ""},
+		{"HeadersParser|Hasher|Sql|Debugger", ""},
+		{"HeadersParser|Hasher|Redis", ""},
+		{"HeadersParser|Mbox", "processor [mbox] of save_process needs the whole message"},
+		{"HeadersParser|SpamCheck?|Sql", "processor [spamcheck] of save_process needs the whole message"},
+		{"Hasher|Compressor|Sql", "processor [compressor] of save_process needs the whole message"},
+	} {
+		err := checkStreamed("save_process", c.chain)
+		if c.want == "" && err != nil {
+			t.Error("expected", c.chain, "to be valid, got", err)
+		} else if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("expected %q for %s, got %v", c.want, c.chain, err)
+		}
+	}
+
+	// only with stream_save_process
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	cfg := BackendConfig{
+		"save_process":       "HeadersParser|Debugger",
+		"bounce_process":     "HeadersParser|Forward",
+		"forward_hosts":      []interface{}{"127.0.0.1:2526"},
+		"primary_mail_host":  "mx.example.com",
+		"log_received_mails": false,
+	}
+	defer Svc.reset()
+	if _, err := New(cfg, logger); err != nil {
+		t.Fatal("expected the chains to be valid without streaming, got", err)
+	}
+	Svc.reset()
+	cfg["stream_save_process"] = "compressor"
+	_, err := New(cfg, logger)
+	if err == nil || !strings.Contains(err.Error(), "processor [forward] of bounce_process needs the whole message") {
+		t.Error("expected the bounce chain to be refused, got", err)
+	}
+}
+
+func TestChainWarnings(t *testing.T) {
+	for _, c := range []struct {
+		chain string
+		cfg   BackendConfig
+		want  []string
+	}{
+		{"HeadersParser|Header|Hasher|Compressor|Sql|Debugger", BackendConfig{}, nil},
+		{"HeadersParser|Hasher|Sql|Compressor", BackendConfig{},
+			[]string{"[sql] of save_process gets the email uncompressed, move [compressor] before it"}},
+		{"HeadersParser|Hasher|Compressor|Header|Sql", BackendConfig{},
+			[]string{"[compressor] of save_process gets the email without the delivery header"}},
+		{"HeadersParser|Debugger", BackendConfig{"log_received_mails": true, "sleep_seconds": 2},
+			[]string{"set log_received_mails to false", "remove sleep_seconds"}},
+		// the debugger's section turns it off
+		{"HeadersParser|Debugger", BackendConfig{
+			"log_received_mails": true,
+			"debugger":           map[string]interface{}{"log_received_mails": false},
+		}, nil},
+	} {
+		warnings := chainWarnings("save_process", c.chain, c.cfg)
+		if len(warnings) != len(c.want) {
+			t.Errorf("expected %d warnings for %s, got %q", len(c.want), c.chain, warnings)
+			continue
+		}
+		for i := range c.want {
+			if !strings.Contains(warnings[i], c.want[i]) {
+				t.Errorf("expected %q for %s, got %q", c.want[i], c.chain, warnings[i])
+			}
+		}
+	}
+
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	_, err := New(BackendConfig{
+		"save_process":       "HeadersParser|Debugger",
+		"log_received_mails": true,
+		"strict_chains":      true,
+	}, logger)
+	if err == nil || !strings.Contains(err.Error(), "strict_chains: [debugger] of save_process") {
+		t.Error("expected the chain to be refused, got", err)
+	}
+}
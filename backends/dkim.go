@@ -0,0 +1,266 @@
+package backends
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The DKIM canonicalizations, RFC 6376 section 3.4
+const (
+	DKIMSimple  = "simple"
+	DKIMRelaxed = "relaxed"
+)
+
+// defaultDKIMHeaders are the headers that are signed when they're in the email
+var defaultDKIMHeaders = []string{
+	"From", "Sender", "Reply-To", "Subject", "Date", "Message-ID", "To", "Cc", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "List-Id", "List-Unsubscribe",
+}
+
+// defaultDKIMOversign are the headers that are signed once more than they're in the email, so
+// that a copy of the email with one of them added, eg. a second From or Subject, doesn't verify
+var defaultDKIMOversign = []string{"From", "Sender", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID"}
+
+var errDKIMNoFrom = errors.New("dkim: the email has no From header")
+
+// dkimSigner signs the emails of a domain with one of its keys
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	// algorithm is the a= tag, rsa-sha256 or ed25519-sha256
+	algorithm   string
+	headerCanon string
+	bodyCanon   string
+	// headers are the names of the headers to sign
+	headers []string
+	// oversign are the names of the headers that are signed once more than they're in the email
+	oversign []string
+}
+
+// parseDKIMKey reads a PEM private key, PKCS#1 or PKCS#8, RSA or Ed25519
+func parseDKIMKey(data []byte) (crypto.Signer, string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", errors.New("no PEM private key found")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, "", fmt.Errorf("the RSA key has %d bits, at least 1024 are needed", k.N.BitLen())
+		}
+		return k, "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return k, "ed25519-sha256", nil
+	}
+	return nil, "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// parseDKIMCanonicalization parses a c= value, header/body, where the body defaults to simple
+func parseDKIMCanonicalization(c string) (header, body string, err error) {
+	parts := strings.SplitN(c, "/", 2)
+	header, body = parts[0], DKIMSimple
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+	for _, v := range []string{header, body} {
+		if v != DKIMSimple && v != DKIMRelaxed {
+			return "", "", fmt.Errorf("invalid dkim canonicalization %q", c)
+		}
+	}
+	return header, body, nil
+}
+
+// dkimHeaderField is a header field as it's in the email, with its folding, without the
+// line ending
+type dkimHeaderField struct {
+	name string
+	raw  string
+}
+
+// splitDKIMMessage returns the header fields and the body of a message, which may end its
+// lines with LF or CRLF. The folded lines of a field are joined with CRLF
+func splitDKIMMessage(msg []byte) ([]dkimHeaderField, []byte) {
+	var fields []dkimHeaderField
+	for len(msg) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			line, msg = msg, nil
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += "\r\n" + string(line)
+			continue
+		}
+		name := string(line)
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[:i]
+		}
+		fields = append(fields, dkimHeaderField{name: strings.TrimSpace(name), raw: string(line)})
+	}
+	return fields, msg
+}
+
+// dkimCompressWSP replaces each run of whitespace with a single space
+func dkimCompressWSP(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// dkimCanonicalHeader canonicalizes a header field, without its line ending
+func dkimCanonicalHeader(raw, canon string) string {
+	if canon == DKIMSimple {
+		return raw
+	}
+	i := strings.IndexByte(raw, ':')
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":"
+	}
+	value := strings.Replace(raw[i+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(dkimCompressWSP(value))
+	return strings.ToLower(strings.TrimSpace(raw[:i])) + ":" + value
+}
+
+// dkimCanonicalBody canonicalizes a body that may end its lines with LF or CRLF
+func dkimCanonicalBody(body []byte, canon string) []byte {
+	lines := strings.Split(string(body), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+		if canon == DKIMRelaxed {
+			lines[i] = strings.TrimRight(dkimCompressWSP(lines[i]), " ")
+		}
+	}
+	// the empty lines at the end are ignored
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canon == DKIMSimple {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// sign returns the DKIM-Signature header for the message, folded with CRLF and ending with it
+func (s *dkimSigner) sign(msg []byte, now time.Time) (string, error) {
+	fields, body := splitDKIMMessage(msg)
+	bodyHash := sha256.Sum256(dkimCanonicalBody(body, s.bodyCanon))
+
+	// each header is signed as many times as it's in the email, the last one first. The oversigned
+	// ones are named once more, which a verifier hashes as an empty header (RFC 6376 section 5.4.2)
+	var names []string
+	var signed []string
+	from := false
+	for _, name := range s.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				names = append(names, strings.ToLower(name))
+				signed = append(signed, dkimCanonicalHeader(fields[i].raw, s.headerCanon))
+				from = from || strings.EqualFold(name, "From")
+			}
+		}
+		for _, over := range s.oversign {
+			if strings.EqualFold(over, name) {
+				names = append(names, strings.ToLower(name))
+				break
+			}
+		}
+	}
+	if !from {
+		return "", errDKIMNoFrom
+	}
+
+	tags := []string{
+		"v=1", "a=" + s.algorithm, "c=" + s.headerCanon + "/" + s.bodyCanon, "d=" + s.domain, "s=" + s.selector,
+		fmt.Sprintf("t=%d", now.Unix()), "h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]), "b=",
+	}
+	// folded before the tags when the line would get too long
+	header := "DKIM-Signature:"
+	line := len(header)
+	for i, tag := range tags {
+		sep := " "
+		width := len(tag)
+		if i == len(tags)-1 {
+			// room for the start of the signature
+			width += 16
+		}
+		if line+width+2 > 78 {
+			sep = "\r\n "
+			line = 0
+		}
+		header += sep + tag
+		line += len(sep) + len(tag)
+		if i < len(tags)-1 {
+			header += ";"
+			line++
+		}
+	}
+
+	h := sha256.New()
+	for _, field := range signed {
+		h.Write([]byte(field + "\r\n"))
+	}
+	// the signature header is hashed with an empty b= and without its line ending
+	h.Write([]byte(dkimCanonicalHeader(header, s.headerCanon)))
+	opts := crypto.Hash(0)
+	if s.algorithm == "rsa-sha256" {
+		opts = crypto.SHA256
+	}
+	sig, err := s.key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	for n := 78 - line; len(b) > n; n = 77 {
+		header += b[:n] + "\r\n "
+		b = b[n:]
+	}
+	return header + b + "\r\n", nil
+}
@@ -0,0 +1,217 @@
+package backends
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// the examples of RFC 6376 section 3.4.6
+	fields, body := splitDKIMMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	var relaxed []string
+	for _, f := range fields {
+		relaxed = append(relaxed, dkimCanonicalHeader(f.raw, DKIMRelaxed))
+	}
+	if got := strings.Join(relaxed, "\r\n"); got != "a:X\r\nb:Y Z" {
+		t.Errorf("unexpected relaxed headers %q", got)
+	}
+	if got := dkimCanonicalHeader(fields[1].raw, DKIMSimple); got != "B : Y\t\r\n\tZ  " {
+		t.Errorf("unexpected simple header %q", got)
+	}
+	if got := string(dkimCanonicalBody(body, DKIMRelaxed)); got != " C\r\nD E\r\n" {
+		t.Errorf("unexpected relaxed body %q", got)
+	}
+	if got := string(dkimCanonicalBody(body, DKIMSimple)); got != " C \r\nD \t E\r\n" {
+		t.Errorf("unexpected simple body %q", got)
+	}
+	// LF line endings are read as CRLF
+	if got := string(dkimCanonicalBody([]byte("a\n\n"), DKIMSimple)); got != "a\r\n" {
+		t.Errorf("unexpected body %q", got)
+	}
+	if got := dkimCanonicalBody(nil, DKIMRelaxed); len(got) != 0 {
+		t.Errorf("expected the empty body to stay empty, got %q", got)
+	}
+	if _, _, err := parseDKIMCanonicalization("relaxed/loose"); err == nil {
+		t.Error("expected an invalid canonicalization to fail")
+	}
+}
+
+// verifyDKIMTest checks the signature on top of the message the way a receiver would
+func verifyDKIMTest(t *testing.T, msg string, pub crypto.PublicKey) {
+	t.Helper()
+	fields, body := splitDKIMMessage([]byte(strings.Replace(msg, "\r\n", "\n", -1)))
+	if len(fields) == 0 || fields[0].name != "DKIM-Signature" {
+		t.Fatal("expected a DKIM-Signature on top")
+	}
+	sigField := fields[0]
+	tags := make(map[string]string)
+	value := strings.Replace(sigField.raw[len("DKIM-Signature:"):], "\r\n", "", -1)
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[kv[0]] = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, kv[1])
+	}
+	canon := strings.Split(tags["c"], "/")
+	bh := sha256.Sum256(dkimCanonicalBody(body, canon[1]))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		t.Fatal("the body hash doesn't match")
+	}
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				h.Write([]byte(dkimCanonicalHeader(fields[i].raw, canon[0]) + "\r\n"))
+				break
+			}
+		}
+	}
+	// the signature is hashed with an empty b=
+	unsigned := sigField.raw[:strings.Index(sigField.raw, " b=")+3]
+	h.Write([]byte(dkimCanonicalHeader(unsigned, canon[0])))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, h.Sum(nil), sig) {
+			err = rsa.ErrVerification
+		}
+	}
+	if err != nil {
+		t.Fatal("the signature doesn't verify", err)
+	}
+}
+
+const dkimTestMessage = "From: Alice <alice@Example.com>\nTo: bob@example.org\nSubject: hello\n" +
+	"\tthere\nDate: Mon, 1 Mar 2021 12:00:00 +0000\n\nHi  Bob,\n\ncheers\n\n"
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		key   crypto.Signer
+		algo  string
+		canon string
+	}{
+		{rsaKey, "rsa-sha256", "relaxed/relaxed"},
+		{rsaKey, "rsa-sha256", "simple/simple"},
+		{edKey, "ed25519-sha256", "relaxed/simple"},
+	} {
+		s := &dkimSigner{domain: "example.com", selector: "sel", key: test.key, algorithm: test.algo,
+			headers: defaultDKIMHeaders}
+		s.headerCanon, s.bodyCanon, _ = parseDKIMCanonicalization(test.canon)
+		header, err := s.sign([]byte(dkimTestMessage), time.Unix(1600000000, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(header, "\r\n") {
+			if len(line) > 80 {
+				t.Errorf("expected the header to be folded, got %q", line)
+			}
+		}
+		if !strings.Contains(header, "a="+test.algo+";") || !strings.Contains(header, "t=1600000000;") ||
+			!strings.Contains(header, "h=from:subject:date:to;") {
+			t.Errorf("unexpected header %q", header)
+		}
+		verifyDKIMTest(t, header+dkimTestMessage, test.key.Public())
+	}
+
+	// the oversigned headers are named once more, also when they're not in the email
+	s := &dkimSigner{domain: "example.com", selector: "sel", key: edKey, algorithm: "ed25519-sha256",
+		headerCanon: DKIMRelaxed, bodyCanon: DKIMRelaxed, headers: defaultDKIMHeaders, oversign: defaultDKIMOversign}
+	header, err := s.sign([]byte(dkimTestMessage), time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Replace(header, "\r\n ", "", -1),
+		"h=from:from:sender:reply-to:subject:subject:date:date:message-id:to:to:cc;") {
+		t.Errorf("unexpected header %q", header)
+	}
+	verifyDKIMTest(t, header+dkimTestMessage, edKey.Public())
+
+	s = &dkimSigner{domain: "example.com", selector: "sel", key: edKey, algorithm: "ed25519-sha256",
+		headerCanon: DKIMRelaxed, bodyCanon: DKIMRelaxed, headers: []string{"From"}}
+	if _, err := s.sign([]byte("Subject: no from\n\nhi\n"), time.Now()); err != errDKIMNoFrom {
+		t.Error("expected an email without From to fail, got", err)
+	}
+}
+
+func TestDKIMSignProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "example.com.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseDKIMSigners(&DKIMSignProcessorConfig{Keys: []string{"example.com:sel:" + file}}); err == nil {
+		t.Error("expected the entry to be refused")
+	}
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "Header|DKIM_Sign|Debugger",
+		"primary_mail_host": "example.com",
+		"dkim_sign_keys":    []interface{}{"example.com=sel:" + file},
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	e.Data.Reset()
+	e.Data.WriteString(dkimTestMessage)
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	if e.Values["dkim_domain"] != "example.com" || !strings.HasPrefix(e.DeliveryHeader, "DKIM-Signature: v=1;") {
+		t.Fatal("expected the email to be signed, got", e.DeliveryHeader)
+	}
+	// the delivery headers that came before aren't signed
+	verifyDKIMTest(t, e.String(), pub)
+
+	other := newBrokerTestEnvelope()
+	if result := backend.Process(other); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	if strings.Contains(other.DeliveryHeader, "DKIM-Signature") {
+		t.Error("expected an email of another domain to be left unsigned")
+	}
+}
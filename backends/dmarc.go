@@ -0,0 +1,247 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"golang.org/x/net/publicsuffix"
+)
+
+// The dispositions of the DMARC policies, RFC 7489 section 6.3
+const (
+	DMARCNone       = "none"
+	DMARCQuarantine = "quarantine"
+	DMARCReject     = "reject"
+)
+
+// dmarcPolicy is a DMARC record published by a domain
+type dmarcPolicy struct {
+	// domain is where the record was found, the From domain or its organizational domain
+	domain string
+	p, sp  string
+	// adkim and aspf are the alignment modes, "r" (relaxed) or "s" (strict)
+	adkim, aspf string
+	pct         int
+}
+
+var errDMARCNoRecord = errors.New("dmarc: no record")
+
+// parseDMARCRecord parses a DMARC TXT record, eg. "v=DMARC1; p=reject; adkim=s"
+func parseDMARCRecord(txt string) (*dmarcPolicy, error) {
+	p := &dmarcPolicy{adkim: "r", aspf: "r", pct: 100}
+	for i, tag := range strings.Split(txt, ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		if len(kv) != 2 {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			return nil, errors.New("dmarc: invalid tag " + tag)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		if i == 0 {
+			if name != "v" || value != "DMARC1" {
+				return nil, errDMARCNoRecord
+			}
+			continue
+		}
+		switch name {
+		case "p", "sp":
+			value = strings.ToLower(value)
+			if value != DMARCNone && value != DMARCQuarantine && value != DMARCReject {
+				return nil, errors.New("dmarc: invalid policy " + value)
+			}
+			if name == "p" {
+				p.p = value
+			} else {
+				p.sp = value
+			}
+		case "adkim", "aspf":
+			value = strings.ToLower(value)
+			if value != "r" && value != "s" {
+				return nil, errors.New("dmarc: invalid alignment mode " + value)
+			}
+			if name == "adkim" {
+				p.adkim = value
+			} else {
+				p.aspf = value
+			}
+		case "pct":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 100 {
+				return nil, errors.New("dmarc: invalid pct " + value)
+			}
+			p.pct = n
+		}
+	}
+	if p.p == "" {
+		return nil, errors.New("dmarc: the record has no policy")
+	}
+	if p.sp == "" {
+		p.sp = p.p
+	}
+	return p, nil
+}
+
+// dmarcOrgDomain returns the organizational domain, the registered domain under a public suffix
+func dmarcOrgDomain(domain string) string {
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// lookupDMARC finds the policy for the From domain, at _dmarc.<domain>, or else at the
+// organizational domain. It returns errDMARCNoRecord when neither has a record
+func lookupDMARC(ctx context.Context, domain string) (*dmarcPolicy, error) {
+	names := []string{domain}
+	if org := dmarcOrgDomain(domain); org != domain {
+		names = append(names, org)
+	}
+	for _, name := range names {
+		txts, err := Resolver().LookupTXT(ctx, "_dmarc."+name)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var records []*dmarcPolicy
+		for _, txt := range txts {
+			if p, err := parseDMARCRecord(txt); err == nil {
+				records = append(records, p)
+			}
+		}
+		// more than one record is as good as none, RFC 7489 section 6.6.3
+		if len(records) == 1 {
+			records[0].domain = name
+			return records[0], nil
+		}
+	}
+	return nil, errDMARCNoRecord
+}
+
+// dmarcAligned returns true if the authenticated domain is aligned with the From domain
+func dmarcAligned(domain, from, mode string) bool {
+	domain, from = strings.ToLower(domain), strings.ToLower(from)
+	if mode == "s" {
+		return domain == from
+	}
+	return dmarcOrgDomain(domain) == dmarcOrgDomain(from)
+}
+
+// DMARCAuthResult is an SPF or DKIM result, as in the auth_results of an aggregate report
+type DMARCAuthResult struct {
+	Domain   string `json:"domain"`
+	Result   string `json:"result"`
+	Selector string `json:"selector,omitempty"`
+}
+
+// DMARCRecord is the evaluation of an email, with the fields of a record of a DMARC aggregate
+// report (RFC 7489 appendix C), so that the reports can be put together from them
+type DMARCRecord struct {
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	QueuedID string    `json:"queued_id"`
+	SourceIP string    `json:"source_ip"`
+	// identifiers
+	HeaderFrom   string `json:"header_from"`
+	EnvelopeFrom string `json:"envelope_from,omitempty"`
+	// policy_published, empty when the domain has no record
+	PolicyDomain    string `json:"policy_domain,omitempty"`
+	ADKIM           string `json:"adkim,omitempty"`
+	ASPF            string `json:"aspf,omitempty"`
+	Policy          string `json:"p,omitempty"`
+	SubdomainPolicy string `json:"sp,omitempty"`
+	Pct             int    `json:"pct,omitempty"`
+	// policy_evaluated
+	Disposition string `json:"disposition"`
+	DKIM        string `json:"dkim"`
+	SPF         string `json:"spf"`
+	// Reason is why the disposition isn't the policy: local_policy or sampled_out
+	Reason string `json:"reason,omitempty"`
+	// auth_results
+	DKIMResults []DMARCAuthResult `json:"dkim_results,omitempty"`
+	SPFResults  []DMARCAuthResult `json:"spf_results,omitempty"`
+}
+
+// DMARCSink is given the record of each email that the dmarc processor evaluated
+type DMARCSink func(r *DMARCRecord)
+
+var dmarcSinks = struct {
+	sync.RWMutex
+	m map[string]DMARCSink
+}{m: make(map[string]DMARCSink)}
+
+// RegisterDMARCSink adds a sink for the DMARC records, eg. to send aggregate reports. Names
+// are case-insensitive, a sink with the same name is replaced, and a nil sink removes it
+func RegisterDMARCSink(name string, s DMARCSink) {
+	dmarcSinks.Lock()
+	defer dmarcSinks.Unlock()
+	if s == nil {
+		delete(dmarcSinks.m, strings.ToLower(name))
+		return
+	}
+	dmarcSinks.m[strings.ToLower(name)] = s
+}
+
+// sinkDMARC gives the record to the sinks, in order of name
+func sinkDMARC(r *DMARCRecord) {
+	dmarcSinks.RLock()
+	names := make([]string, 0, len(dmarcSinks.m))
+	for name := range dmarcSinks.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sinks := make([]DMARCSink, len(names))
+	for i, name := range names {
+		sinks[i] = dmarcSinks.m[name]
+	}
+	dmarcSinks.RUnlock()
+	for _, s := range sinks {
+		s(r)
+	}
+}
+
+// verdictProperty returns the value of an RFC 8601 property of the verdict, eg. header.d
+func verdictProperty(v Verdict, name string) string {
+	for _, p := range v.Properties {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// dmarcAuthResults returns the SPF and DKIM results of the verdicts of the envelope. An SPF
+// result without a smtp.mailfrom property is for the envelope's MAIL FROM, or HELO for a bounce
+func dmarcAuthResults(e *mail.Envelope) (spf, dkim []DMARCAuthResult) {
+	for _, v := range GetVerdicts(e) {
+		switch v.Method {
+		case "spf":
+			domain := verdictProperty(v, "smtp.mailfrom")
+			if i := strings.LastIndexByte(domain, '@'); i >= 0 {
+				domain = domain[i+1:]
+			}
+			if domain == "" {
+				domain = e.MailFrom.Host
+				if e.MailFrom.NullPath {
+					domain = e.Helo
+				}
+			}
+			spf = append(spf, DMARCAuthResult{Domain: strings.ToLower(domain), Result: v.Result})
+		case "dkim":
+			dkim = append(dkim, DMARCAuthResult{
+				Domain:   strings.ToLower(verdictProperty(v, "header.d")),
+				Result:   v.Result,
+				Selector: verdictProperty(v, "header.s"),
+			})
+		}
+	}
+	return spf, dkim
+}
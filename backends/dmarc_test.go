@@ -0,0 +1,183 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// dmarcTestResolver answers the TXT lookups from a map
+type dmarcTestResolver struct {
+	mockResolver
+	txt map[string][]string
+}
+
+func (r *dmarcTestResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name == "_dmarc.broken.example" {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	p, err := parseDMARCRecord("v=DMARC1; p=Reject; sp=none; adkim=s; pct=50; rua=mailto:d@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.p != DMARCReject || p.sp != DMARCNone || p.adkim != "s" || p.aspf != "r" || p.pct != 50 {
+		t.Errorf("unexpected policy %+v", p)
+	}
+	if p, _ := parseDMARCRecord("v=DMARC1; p=quarantine;"); p == nil || p.sp != DMARCQuarantine || p.pct != 100 {
+		t.Errorf("expected sp to default to p, got %+v", p)
+	}
+	for _, txt := range []string{"v=spf1 -all", "p=reject; v=DMARC1", "v=DMARC1; p=maybe", "v=DMARC1; pct=50", "v=DMARC1; p=none; pct=200"} {
+		if _, err := parseDMARCRecord(txt); err == nil {
+			t.Errorf("expected %q to be refused", txt)
+		}
+	}
+}
+
+func TestDMARCAligned(t *testing.T) {
+	for _, test := range []struct {
+		domain, from, mode string
+		aligned            bool
+	}{
+		{"mail.example.com", "example.com", "r", true},
+		{"mail.example.com", "example.com", "s", false},
+		{"Example.com", "example.com", "s", true},
+		{"example.co.uk", "other.co.uk", "r", false},
+		{"a.example.co.uk", "b.example.co.uk", "r", true},
+	} {
+		if dmarcAligned(test.domain, test.from, test.mode) != test.aligned {
+			t.Errorf("expected %s and %s with %s to be aligned: %v", test.domain, test.from, test.mode, test.aligned)
+		}
+	}
+}
+
+func newDMARCTestEnvelope(from string, verdicts ...Verdict) *mail.Envelope {
+	e := newBrokerTestEnvelope()
+	e.Data.Reset()
+	e.Data.WriteString("From: <alice@" + from + ">\nSubject: hello\n\nhi\n")
+	for _, v := range verdicts {
+		AddVerdict(e, v)
+	}
+	return e
+}
+
+func TestDMARCProcessor(t *testing.T) {
+	// the backend resolves with the upstream when there's no cache
+	saved := DNSUpstream
+	DNSUpstream = &dmarcTestResolver{txt: map[string][]string{
+		"_dmarc.example.com":   {"v=DMARC1; p=reject; sp=quarantine; aspf=s"},
+		"_dmarc.monitor.test":  {"v=DMARC1; p=none"},
+		"_dmarc.twice.example": {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	}}
+	defer func() {
+		DNSUpstream = saved
+		SetResolver(saved)
+	}()
+	dir, err := ioutil.TempDir("", "dmarc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	var sunk []*DMARCRecord
+	RegisterDMARCSink("test", func(r *DMARCRecord) {
+		sunk = append(sunk, r)
+	})
+	defer RegisterDMARCSink("test", nil)
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":         "DMARC|Debugger",
+		"dmarc_quarantine_dir": filepath.Join(dir, "{tenant}"),
+		"dmarc_report_file":    filepath.Join(dir, "{date}.jsonl"),
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	dkimPass := Verdict{Method: "dkim", Result: "pass", Properties: []string{"header.d=mail.example.com", "header.s=sel"}}
+	spfPass := Verdict{Method: "spf", Result: "pass", Properties: []string{"smtp.mailfrom=bounces@mail.example.com"}}
+	tests := []struct {
+		name   string
+		e      *mail.Envelope
+		reply  string
+		result string
+	}{
+		{"relaxed dkim", newDMARCTestEnvelope("example.com", dkimPass), "250", "dmarc=pass"},
+		{"strict spf", newDMARCTestEnvelope("example.com", spfPass), "550 5.7.1", "dmarc=fail"},
+		{"no results", newDMARCTestEnvelope("example.com"), "550 5.7.1", "dmarc=fail"},
+		{"subdomain policy", newDMARCTestEnvelope("news.example.com"), "250", "dmarc=fail"},
+		{"monitor", newDMARCTestEnvelope("monitor.test"), "250", "dmarc=fail"},
+		{"no record", newDMARCTestEnvelope("other.test"), "250", "dmarc=none"},
+		{"two records", newDMARCTestEnvelope("twice.example"), "250", "dmarc=none"},
+		{"lookup failed", newDMARCTestEnvelope("broken.example"), "250", "dmarc=temperror"},
+	}
+	for _, test := range tests {
+		result := backend.Process(test.e)
+		if !strings.HasPrefix(result.String(), test.reply) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.reply, result)
+		}
+		if got := VerdictHeaders("mx", GetVerdicts(test.e)); !strings.Contains(got, test.result) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.result, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme", tests[3].e.QueuedId+".eml")); err != nil {
+		t.Error("expected the email of the subdomain to be quarantined", err)
+	}
+	if len(sunk) != 5 {
+		t.Fatal("expected 5 records, got", len(sunk))
+	}
+	if r := sunk[0]; r.Disposition != DMARCNone || r.DKIM != "pass" || r.SPF != "fail" || r.PolicyDomain != "example.com" ||
+		len(r.DKIMResults) != 1 || r.DKIMResults[0].Selector != "sel" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r := sunk[3]; r.Disposition != DMARCQuarantine || r.PolicyDomain != "example.com" || r.HeaderFrom != "news.example.com" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, Now().Format("2006-01-02")+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var r DMARCRecord
+	if len(lines) != 5 || json.Unmarshal([]byte(lines[1]), &r) != nil || r.Disposition != DMARCReject {
+		t.Error("unexpected report file", string(data))
+	}
+}
+
+func TestDMARCOverride(t *testing.T) {
+	// the backend resolves with the upstream when there's no cache
+	saved := DNSUpstream
+	DNSUpstream = &dmarcTestResolver{txt: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}}}
+	defer func() {
+		DNSUpstream = saved
+		SetResolver(saved)
+	}()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":   "DMARC|Debugger",
+		"dmarc_override": "quarantine",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newDMARCTestEnvelope("example.com")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be quarantined, got", result)
+	}
+	r := e.Values["dmarc"].(*DMARCRecord)
+	if r.Disposition != DMARCQuarantine || r.Reason != "local_policy" || !strings.Contains(e.Tags.String(), "quarantine:dmarc") {
+		t.Errorf("unexpected record %+v, tags %s", r, e.Tags)
+	}
+}
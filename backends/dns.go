@@ -0,0 +1,350 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNSResolver does the DNS lookups for processors, such as SPF, DKIM, DMARC or DNSBL checks.
+// It's implemented by *net.Resolver and by DNSCache
+type DNSResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// DNSUpstream is the resolver used when an answer is not cached.
+// Replace it to use a different resolver, eg. one that queries a specific DNS server
+var DNSUpstream DNSResolver = net.DefaultResolver
+
+// resolver holds the resolverValue returned by Resolver. It's replaced when the backend is
+// initialized, while the workers of the previous backend may still be doing lookups
+var resolver atomic.Value
+
+// resolverValue wraps the resolver, since an atomic.Value must always store the same type
+type resolverValue struct {
+	DNSResolver
+}
+
+// Resolver returns the resolver that processors should use for their lookups.
+// It's a DNSCache when the dns_cache_ttl option is set, otherwise it's DNSUpstream.
+// The returned slices may be shared, do not modify them
+func Resolver() DNSResolver {
+	if r, ok := resolver.Load().(resolverValue); ok {
+		return r.DNSResolver
+	}
+	return DNSUpstream
+}
+
+// SetResolver replaces the resolver returned by Resolver, eg. with a mock in tests.
+// It's set again when a backend is initialized
+func SetResolver(r DNSResolver) {
+	resolver.Store(resolverValue{r})
+}
+
+// DNSCacheConfig configures the DNS cache, it's read from the backend config
+type DNSCacheConfig struct {
+	// TTL enables the cache, it's how long to keep an answer, eg. "5m".
+	// Answers that were used are refreshed in the background before they expire
+	TTL string `json:"dns_cache_ttl,omitempty"`
+	// NegativeTTL is how long to keep a not found answer, defaults to TTL
+	NegativeTTL string `json:"dns_cache_negative_ttl,omitempty"`
+	// Size is the maximum number of answers to keep, defaults to 10000
+	Size int `json:"dns_cache_size,omitempty"`
+	// Warm lists lookups to make when starting, in the type:name form,
+	// eg. "TXT:example.com". Types are A (for IP addresses), MX, TXT and PTR
+	Warm []string `json:"dns_cache_warm,omitempty"`
+}
+
+const defaultDNSCacheSize = 10000
+
+// dnsTimeout limits lookups done in the background
+const dnsTimeout = time.Second * 10
+
+type dnsKey struct {
+	qtype string
+	name  string
+}
+
+type dnsEntry struct {
+	answer  interface{}
+	err     error
+	expires time.Time
+	// hits since the entry was last fetched, only entries with hits are refreshed
+	hits   int64
+	lookup func(ctx context.Context) (interface{}, error)
+}
+
+// DNSCacheStats are the counters kept by the DNSCache
+type DNSCacheStats struct {
+	Hits       int64
+	Misses     int64
+	Prefetches int64
+	Entries    int
+}
+
+// DNSCache is a DNSResolver that caches answers from an upstream resolver.
+// Answers that are used are refreshed before they expire, so that the lookups of
+// policy checks don't add latency during bursts
+type DNSCache struct {
+	upstream    DNSResolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+
+	entries    map[dnsKey]*dnsEntry
+	hits       int64
+	misses     int64
+	prefetches int64
+	sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDNSCache returns a cache for the upstream resolver. Call Start to refresh the answers in the background
+func NewDNSCache(upstream DNSResolver, ttl, negativeTTL time.Duration, size int) *DNSCache {
+	if negativeTTL <= 0 {
+		negativeTTL = ttl
+	}
+	if size <= 0 {
+		size = defaultDNSCacheSize
+	}
+	return &DNSCache{
+		upstream:    upstream,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		entries:     make(map[dnsKey]*dnsEntry),
+	}
+}
+
+func (c *DNSCache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	a, err := c.lookup(ctx, dnsKey{"TXT", name}, func(ctx context.Context) (interface{}, error) {
+		return c.upstream.LookupTXT(ctx, name)
+	})
+	txt, _ := a.([]string)
+	return txt, err
+}
+
+func (c *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	a, err := c.lookup(ctx, dnsKey{"A", host}, func(ctx context.Context) (interface{}, error) {
+		return c.upstream.LookupIPAddr(ctx, host)
+	})
+	ips, _ := a.([]net.IPAddr)
+	return ips, err
+}
+
+func (c *DNSCache) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	a, err := c.lookup(ctx, dnsKey{"MX", name}, func(ctx context.Context) (interface{}, error) {
+		return c.upstream.LookupMX(ctx, name)
+	})
+	mx, _ := a.([]*net.MX)
+	return mx, err
+}
+
+func (c *DNSCache) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	a, err := c.lookup(ctx, dnsKey{"PTR", addr}, func(ctx context.Context) (interface{}, error) {
+		return c.upstream.LookupAddr(ctx, addr)
+	})
+	names, _ := a.([]string)
+	return names, err
+}
+
+// Warm looks up each item of the list, in the type:name form, eg. "MX:example.com"
+// so that the answers are cached before they are needed
+func (c *DNSCache) Warm(list []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	for _, item := range list {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			Log().Warnf("dns cache: cannot warm [%s], expecting type:name", item)
+			continue
+		}
+		switch strings.ToUpper(parts[0]) {
+		case "A", "AAAA":
+			_, _ = c.LookupIPAddr(ctx, parts[1])
+		case "MX":
+			_, _ = c.LookupMX(ctx, parts[1])
+		case "TXT":
+			_, _ = c.LookupTXT(ctx, parts[1])
+		case "PTR":
+			_, _ = c.LookupAddr(ctx, parts[1])
+		default:
+			Log().Warnf("dns cache: cannot warm [%s], unknown type", item)
+		}
+	}
+}
+
+// Stats returns the cache's counters
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return DNSCacheStats{
+		Hits:       atomic.LoadInt64(&c.hits),
+		Misses:     atomic.LoadInt64(&c.misses),
+		Prefetches: atomic.LoadInt64(&c.prefetches),
+		Entries:    len(c.entries),
+	}
+}
+
+func (c *DNSCache) lookup(
+	ctx context.Context,
+	key dnsKey,
+	lookup func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.Lock()
+	if e, ok := c.entries[key]; ok && Now().Before(e.expires) {
+		e.hits++
+		c.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return e.answer, e.err
+	}
+	c.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+	answer, err := lookup(ctx)
+	c.store(key, answer, err, lookup, 1)
+	return answer, err
+}
+
+// store caches the answer, unless it was a temporary error such as a timeout
+func (c *DNSCache) store(
+	key dnsKey,
+	answer interface{},
+	err error,
+	lookup func(ctx context.Context) (interface{}, error),
+	hits int64) {
+	ttl := c.ttl
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[key] = &dnsEntry{
+		answer:  answer,
+		err:     err,
+		expires: Now().Add(ttl),
+		hits:    hits,
+		lookup:  lookup,
+	}
+}
+
+// evict makes room for a new entry by removing the expired entries,
+// or any entry if none expired. The lock must be held
+func (c *DNSCache) evict() {
+	now := Now()
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// Start looks up the warm list, then keeps refreshing the answers that were used before they expire.
+// Unused answers are removed
+func (c *DNSCache) Start(warm []string) {
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.Warm(warm)
+		ticker := time.NewTicker(c.ttl / 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing
+func (c *DNSCache) Stop() {
+	if c.stop != nil {
+		close(c.stop)
+		c.wg.Wait()
+		c.stop = nil
+	}
+}
+
+// refresh looks up the entries that were used and will expire within a fifth of the TTL
+func (c *DNSCache) refresh() {
+	now := Now()
+	soon := now.Add(c.ttl / 5)
+	refresh := make(map[dnsKey]*dnsEntry)
+	c.Lock()
+	for key, e := range c.entries {
+		if e.expires.Before(soon) {
+			if e.hits > 0 {
+				refresh[key] = e
+			} else if e.expires.Before(now) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.Unlock()
+	for key, e := range refresh {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		answer, err := e.lookup(ctx)
+		cancel()
+		atomic.AddInt64(&c.prefetches, 1)
+		// the hits are cleared, so that the entry is dropped unless it is used again
+		c.store(key, answer, err, e.lookup, 0)
+	}
+}
+
+// configureDNSCache sets the Resolver to a DNSCache if enabled by the config, or to DNSUpstream if not
+func configureDNSCache(backendConfig BackendConfig) error {
+	configType := BaseConfig(&DNSCacheConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return err
+	}
+	config := bcfg.(*DNSCacheConfig)
+	if config.TTL == "" {
+		SetResolver(DNSUpstream)
+		return nil
+	}
+	ttl, err := time.ParseDuration(config.TTL)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("dns_cache_ttl must be greater than 0")
+	}
+	var negativeTTL time.Duration
+	if config.NegativeTTL != "" {
+		if negativeTTL, err = time.ParseDuration(config.NegativeTTL); err != nil {
+			return err
+		}
+	}
+	cache := NewDNSCache(DNSUpstream, ttl, negativeTTL, config.Size)
+	cache.Start(config.Warm)
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		cache.Stop()
+		return nil
+	}))
+	SetResolver(cache)
+	return nil
+}
@@ -0,0 +1,124 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockResolver counts the lookups, and doesn't find anything in the .invalid domain
+type mockResolver struct {
+	lookups int64
+}
+
+func (m *mockResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	atomic.AddInt64(&m.lookups, 1)
+	if name == "nx.invalid" {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if name == "timeout.invalid" {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	return []string{"v=spf1 -all"}, nil
+}
+
+func (m *mockResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt64(&m.lookups, 1)
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+}
+
+func (m *mockResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	atomic.AddInt64(&m.lookups, 1)
+	return []*net.MX{{Host: "mx." + name, Pref: 10}}, nil
+}
+
+func (m *mockResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	atomic.AddInt64(&m.lookups, 1)
+	return []string{"host.example.com."}, nil
+}
+
+func TestDNSCache(t *testing.T) {
+	upstream := &mockResolver{}
+	c := NewDNSCache(upstream, time.Minute, 0, 2)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if txt, err := c.LookupTXT(ctx, "example.com"); err != nil || len(txt) != 1 {
+			t.Error("unexpected answer", txt, err)
+		}
+	}
+	if n := atomic.LoadInt64(&upstream.lookups); n != 1 {
+		t.Error("expected 1 upstream lookup, got", n)
+	}
+	// not found answers are cached, temporary errors are not
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupTXT(ctx, "nx.invalid"); err == nil {
+			t.Error("expected an error")
+		}
+		_, _ = c.LookupTXT(ctx, "timeout.invalid")
+	}
+	if n := atomic.LoadInt64(&upstream.lookups); n != 4 {
+		t.Error("expected 4 upstream lookups, got", n)
+	}
+	// the cache is full, so this replaces one of the entries
+	_, _ = c.LookupMX(ctx, "example.com")
+	if s := c.Stats(); s.Entries != 2 || s.Hits != 3 || s.Misses != 5 {
+		t.Error("unexpected stats", s)
+	}
+}
+
+func TestDNSCachePrefetch(t *testing.T) {
+	upstream := &mockResolver{}
+	c := NewDNSCache(upstream, time.Millisecond*200, 0, 0)
+	c.Warm([]string{"MX:example.com", "A:example.com", "bogus"})
+	c.Start(nil)
+	defer c.Stop()
+	ctx := context.Background()
+	deadline := time.Now().Add(time.Millisecond * 500)
+	// keep using the answer, it should be refreshed before it expires, so that there are no misses
+	for time.Now().Before(deadline) {
+		if _, err := c.LookupMX(ctx, "example.com"); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	s := c.Stats()
+	if s.Misses != 2 {
+		t.Error("expected only the 2 misses when warming, got", s.Misses)
+	}
+	if s.Prefetches == 0 {
+		t.Error("expected the answers to be prefetched")
+	}
+}
+
+func TestConfigureDNSCache(t *testing.T) {
+	upstream := &mockResolver{}
+	DNSUpstream = upstream
+	defer func() {
+		DNSUpstream = net.DefaultResolver
+		SetResolver(DNSUpstream)
+	}()
+	Svc.reset()
+	err := configureDNSCache(BackendConfig{
+		"dns_cache_ttl":  "1m",
+		"dns_cache_warm": []interface{}{"TXT:example.com", "MX:example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = Svc.shutdown()
+	}()
+	c, ok := Resolver().(*DNSCache)
+	if !ok {
+		t.Fatal("expected Resolver to be a *DNSCache")
+	}
+	// warming is done in the background
+	for i := 0; i < 100 && c.Stats().Entries < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if s := c.Stats(); s.Entries != 2 {
+		t.Error("expected the cache to be warmed with 2 entries, got", s)
+	}
+}
@@ -0,0 +1,379 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// esMail is the document that is indexed for a message
+type esMail struct {
+	QueuedId  string    `json:"queued_id"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject"`
+	Date      time.Time `json:"date"`
+	MessageId string    `json:"message_id,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Body      string    `json:"body,omitempty"`
+}
+
+// esAction is a document waiting for the next bulk request
+type esAction struct {
+	index string
+	id    string
+	doc   []byte
+}
+
+// esIndexer sends the documents to Elasticsearch in bulk requests, from a queue so that
+// the workers don't wait for the cluster. When the queue is full, documents are dropped
+type esIndexer struct {
+	config   *ElasticsearchConfig
+	client   *http.Client
+	interval time.Duration
+	queue    chan esAction
+	stop     chan struct{}
+	done     chan struct{}
+	// dropped counts the documents that didn't fit in the queue since the last report
+	dropped uint64
+	// how many processors use the indexer
+	users int
+}
+
+var (
+	esIndexersGuard sync.Mutex
+	// the indexers of the processors, by their config, so that the workers share a queue
+	esIndexers = make(map[string]*esIndexer)
+)
+
+// esRetryBackoff is how long to wait before the first retry, doubled for the next ones
+var esRetryBackoff = time.Millisecond * 500
+
+// useESIndexer returns the indexer for the config, starting it if it's not used already
+func useESIndexer(config *ElasticsearchConfig, interval, timeout time.Duration) *esIndexer {
+	key := fmt.Sprintf("%+v", *config)
+	esIndexersGuard.Lock()
+	defer esIndexersGuard.Unlock()
+	if ix, ok := esIndexers[key]; ok {
+		ix.users++
+		return ix
+	}
+	ix := &esIndexer{
+		config:   config,
+		client:   &http.Client{Timeout: timeout},
+		interval: interval,
+		queue:    make(chan esAction, config.QueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		users:    1,
+	}
+	esIndexers[key] = ix
+	go ix.run()
+	return ix
+}
+
+// release stops the indexer when the last processor that used it is shut down.
+// The documents in the queue are sent first
+func (ix *esIndexer) release() {
+	esIndexersGuard.Lock()
+	ix.users--
+	last := ix.users == 0
+	if last {
+		for key, v := range esIndexers {
+			if v == ix {
+				delete(esIndexers, key)
+			}
+		}
+	}
+	esIndexersGuard.Unlock()
+	if last {
+		close(ix.stop)
+		<-ix.done
+	}
+}
+
+// add queues the document without waiting, it returns false if the queue is full
+func (ix *esIndexer) add(a esAction) bool {
+	select {
+	case ix.queue <- a:
+		return true
+	default:
+		if atomic.AddUint64(&ix.dropped, 1) == 1 {
+			Log().Warn("elasticsearch: the queue is full, documents are not indexed")
+		}
+		return false
+	}
+}
+
+func (ix *esIndexer) run() {
+	defer close(ix.done)
+	ticker := time.NewTicker(ix.interval)
+	defer ticker.Stop()
+	batch := make([]esAction, 0, ix.config.BulkSize)
+	for {
+		select {
+		case a := <-ix.queue:
+			batch = append(batch, a)
+			if len(batch) >= ix.config.BulkSize {
+				ix.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				ix.flush(batch)
+				batch = batch[:0]
+			}
+			if n := atomic.SwapUint64(&ix.dropped, 0); n > 0 {
+				Log().Warnf("elasticsearch: %d documents were dropped because the queue was full", n)
+			}
+		case <-ix.stop:
+			for {
+				select {
+				case a := <-ix.queue:
+					batch = append(batch, a)
+					if len(batch) >= ix.config.BulkSize {
+						ix.flush(batch)
+						batch = batch[:0]
+					}
+				default:
+					if len(batch) > 0 {
+						ix.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush sends the batch, and sends the documents that were rejected because the cluster
+// was busy again, up to es_max_retries times
+func (ix *esIndexer) flush(batch []esAction) {
+	backoff := esRetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := ix.bulk(batch)
+		if err == nil && len(retry) == 0 {
+			return
+		}
+		if attempt >= ix.config.MaxRetries {
+			if err != nil {
+				Log().WithError(err).Errorf("elasticsearch: could not index %d documents", len(batch))
+			} else {
+				Log().Errorf("elasticsearch: could not index %d documents, the cluster is busy", len(retry))
+			}
+			return
+		}
+		if err != nil {
+			Log().WithError(err).Warn("elasticsearch: bulk request failed, retrying")
+		} else {
+			batch = retry
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ix.stop:
+			// shutting down, the documents get one more try
+			attempt = ix.config.MaxRetries - 1
+		}
+		backoff *= 2
+	}
+}
+
+// esBulkResponse is the part of the bulk API's response that's needed
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends one bulk request. An error means the whole batch can be tried again,
+// otherwise it returns the documents that should be tried again
+func (ix *esIndexer) bulk(batch []esAction) ([]esAction, error) {
+	var body bytes.Buffer
+	for _, a := range batch {
+		meta, _ := json.Marshal(map[string]map[string]string{"index": {"_index": a.index, "_id": a.id}})
+		body.Write(meta)
+		body.WriteByte('\n')
+		body.Write(a.doc)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(ix.config.URL, "/")+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if ix.config.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+ix.config.APIKey)
+	} else if ix.config.Username != "" {
+		req.SetBasicAuth(ix.config.Username, ix.config.Password)
+	}
+	resp, err := ix.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		Log().Errorf("elasticsearch: bulk request failed with %s: %s", resp.Status, msg)
+		return nil, nil
+	}
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	var retry []esAction
+	for i, item := range result.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, r := range item {
+			if r.Status == http.StatusTooManyRequests || r.Status >= 500 {
+				retry = append(retry, batch[i])
+			} else if r.Status >= 300 {
+				Log().Errorf("elasticsearch: could not index %s: %s", batch[i].id, r.Error)
+			}
+		}
+	}
+	return retry, nil
+}
+
+// esDocument returns the document for the envelope, with up to maxBody bytes of its text
+// when maxBody is more than 0. With Anonymization, the addresses are hashed and the text
+// is left out
+func esDocument(e *mail.Envelope, maxBody int) esMail {
+	doc := esMail{
+		QueuedId: e.QueuedId,
+		From:     e.MailFrom.String(),
+		Subject:  e.Subject,
+		Date:     time.Now(),
+		Tenant:   e.Tenant,
+		To:       make([]string, 0, len(e.RcptTo)),
+	}
+	for i := range e.RcptTo {
+		doc.To = append(doc.To, e.RcptTo[i].String())
+	}
+	doc.MessageId = strings.Trim(e.Header.Get("Message-Id"), "<>")
+	if len(e.Tags) > 0 {
+		doc.Tags = e.Tags.Strings()
+	}
+	if a := Anonymization; a != nil {
+		doc.From = a.Address(doc.From)
+		for i := range doc.To {
+			doc.To[i] = a.Address(doc.To[i])
+		}
+		doc.Subject = a.Text(doc.Subject)
+		doc.MessageId = a.Text(doc.MessageId)
+		return doc
+	}
+	if maxBody > 0 {
+		doc.Body = plainTextBody(e.Data.Bytes(), maxBody)
+	}
+	return doc
+}
+
+var htmlTags = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+// plainTextBody returns the text of the message, decoded to UTF-8. The first text/plain
+// part is used, otherwise the first text/html part without the tags
+func plainTextBody(data []byte, max int) string {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	text, html := textParts(textproto.MIMEHeader(msg.Header), msg.Body, max, 0)
+	if text == "" && html != "" {
+		text = htmlTags.ReplaceAllString(html, " ")
+	}
+	if len(text) > max {
+		text = text[:max]
+	}
+	return strings.ToValidUTF8(text, "")
+}
+
+const maxMIMEDepth = 5
+
+// textParts returns the first text/plain and text/html parts found in the part
+func textParts(header textproto.MIMEHeader, body io.Reader, max, depth int) (text, html string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// the default for a missing or invalid content type
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth || params["boundary"] == "" {
+			return "", ""
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return text, html
+			}
+			if part.Header.Get("Content-Disposition") != "" &&
+				strings.HasPrefix(strings.ToLower(part.Header.Get("Content-Disposition")), "attachment") {
+				continue
+			}
+			t, h := textParts(part.Header, part, max, depth+1)
+			if text == "" {
+				text = t
+			}
+			if html == "" {
+				html = h
+			}
+			if text != "" {
+				return text, html
+			}
+		}
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", ""
+	}
+	var r io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" &&
+		charset != "us-ascii" && mail.Dec.CharsetReader != nil {
+		if cr, err := mail.Dec.CharsetReader(charset, r); err == nil {
+			r = cr
+		}
+	}
+	// html has tags, so read more of it
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(max)*2))
+	if err != nil && len(b) == 0 {
+		return "", ""
+	}
+	if mediaType == "text/html" {
+		return "", string(b)
+	}
+	return string(b), ""
+}
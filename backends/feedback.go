@@ -0,0 +1,209 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FeedbackReport is an abuse report of the Abuse Reporting Format (RFC 5965), sent by the
+// feedback loop of a mailbox provider when a recipient marked a message as spam
+type FeedbackReport struct {
+	// FeedbackType is eg. "abuse", "fraud", "virus" or "not-spam"
+	FeedbackType string
+	UserAgent    string
+	Version      string
+	// OriginalMailFrom is the return path of the reported message
+	OriginalMailFrom string
+	// OriginalRcptTo are the recipients that complained. When the report doesn't say,
+	// it's the To address of the reported message
+	OriginalRcptTo []string
+	ArrivalDate    time.Time
+	ReportingMTA   string
+	SourceIP       string
+	ReportedDomain []string
+	Incidents      int
+	// MessageId is the Message-ID of the reported message
+	MessageId string
+	// QueuedIds are the ids in the Received headers of the reported message, that include
+	// the e.QueuedId added by the Header processor when it went through this server
+	QueuedIds []string
+}
+
+// ErrNotFeedbackReport is returned by ParseFeedbackReport for other messages
+var ErrNotFeedbackReport = errors.New("not a feedback report")
+
+// Complaint returns true if the recipients complained, ie. for all but not-spam reports
+func (r *FeedbackReport) Complaint() bool {
+	return !strings.EqualFold(r.FeedbackType, "not-spam")
+}
+
+// receivedId matches the id of a Received header, eg. "with SMTP id 1a2b3c@example.com;"
+var receivedId = regexp.MustCompile(`(?i)\bid\s+<?([^\s;<>@]+)`)
+
+// ParseFeedbackReport reads a multipart/report message with a report-type of feedback-report
+func ParseFeedbackReport(data []byte) (*FeedbackReport, error) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ErrNotFeedbackReport
+	}
+	var r *FeedbackReport
+	// the headers of the reported message
+	var original textproto.MIMEHeader
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/feedback-report":
+			fields, _ := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			r = &FeedbackReport{
+				FeedbackType:     strings.ToLower(strings.TrimSpace(fields.Get("Feedback-Type"))),
+				UserAgent:        fields.Get("User-Agent"),
+				Version:          fields.Get("Version"),
+				OriginalMailFrom: trimAddress(fields.Get("Original-Mail-From")),
+				ReportingMTA:     fields.Get("Reporting-MTA"),
+				SourceIP:         fields.Get("Source-IP"),
+				ReportedDomain:   fields["Reported-Domain"],
+				Incidents:        1,
+			}
+			for _, rcpt := range fields["Original-Rcpt-To"] {
+				if rcpt = trimAddress(rcpt); rcpt != "" {
+					r.OriginalRcptTo = append(r.OriginalRcptTo, rcpt)
+				}
+			}
+			if date, err := netmail.ParseDate(fields.Get("Arrival-Date")); err == nil {
+				r.ArrivalDate = date
+			}
+			if n, err := strconv.Atoi(fields.Get("Incidents")); err == nil && n > 0 {
+				r.Incidents = n
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			original, _ = textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+		}
+	}
+	if r == nil || r.FeedbackType == "" {
+		return nil, ErrNotFeedbackReport
+	}
+	if original != nil {
+		r.MessageId = strings.Trim(original.Get("Message-Id"), "<> ")
+		for _, received := range original["Received"] {
+			if m := receivedId.FindStringSubmatch(received); m != nil {
+				r.QueuedIds = append(r.QueuedIds, m[1])
+			}
+		}
+		if len(r.OriginalRcptTo) == 0 {
+			if to, err := netmail.ParseAddress(original.Get("To")); err == nil {
+				r.OriginalRcptTo = []string{to.Address}
+			}
+		}
+		if r.OriginalMailFrom == "" {
+			r.OriginalMailFrom = trimAddress(original.Get("Return-Path"))
+		}
+	}
+	return r, nil
+}
+
+// FeedbackHandler is given the reports received by the arf processor, with the tenant
+// that received them
+type FeedbackHandler func(tenant string, r *FeedbackReport)
+
+var feedbackHandlers = struct {
+	sync.RWMutex
+	m map[string]FeedbackHandler
+}{m: map[string]FeedbackHandler{
+	"suppressions": suppressComplaints,
+	"deliveries":   trackComplaints,
+}}
+
+// RegisterFeedbackHandler adds a handler for the feedback reports, eg. to keep the complaint
+// rate of the senders. Names are case-insensitive, a handler with the same name is replaced.
+// The reports are added to the Suppressions and recorded in the Deliveries by default
+func RegisterFeedbackHandler(name string, h FeedbackHandler) {
+	feedbackHandlers.Lock()
+	defer feedbackHandlers.Unlock()
+	if h == nil {
+		delete(feedbackHandlers.m, strings.ToLower(name))
+		return
+	}
+	feedbackHandlers.m[strings.ToLower(name)] = h
+}
+
+// handleFeedback calls the handlers, in order of name
+func handleFeedback(tenant string, r *FeedbackReport) {
+	feedbackHandlers.RLock()
+	names := make([]string, 0, len(feedbackHandlers.m))
+	for name := range feedbackHandlers.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	handlers := make([]FeedbackHandler, len(names))
+	for i, name := range names {
+		handlers[i] = feedbackHandlers.m[name]
+	}
+	feedbackHandlers.RUnlock()
+	for _, h := range handlers {
+		h(tenant, r)
+	}
+}
+
+// suppressComplaints adds the recipients that complained to the suppression list
+func suppressComplaints(tenant string, r *FeedbackReport) {
+	if !r.Complaint() {
+		return
+	}
+	for _, rcpt := range r.OriginalRcptTo {
+		s := Suppression{Address: rcpt, Tenant: tenant, Reason: SuppressionComplaint, Detail: r.FeedbackType}
+		if err := Suppressions.Add(s); err != nil {
+			Log().WithError(err).Error("could not add to the suppression list")
+			return
+		}
+	}
+}
+
+// trackComplaints records the complaint in the delivery records of the reported message
+func trackComplaints(tenant string, r *FeedbackReport) {
+	if Deliveries == nil || !r.Complaint() {
+		return
+	}
+	ids := append([]string{r.MessageId}, r.QueuedIds...)
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		for _, rec := range Deliveries.Lookup(id) {
+			if seen[rec.QueuedId] || rec.Tenant != tenant {
+				continue
+			}
+			seen[rec.QueuedId] = true
+			update := DeliveryRecord{QueuedId: rec.QueuedId, Tenant: rec.Tenant, From: rec.From}
+			for _, rcpt := range r.OriginalRcptTo {
+				update.Events = append(update.Events, DeliveryEvent{
+					Recipient: rcpt,
+					State:     DeliveryComplained,
+					Detail:    r.FeedbackType,
+					Time:      time.Now(),
+				})
+			}
+			Deliveries.Record(update)
+		}
+	}
+}
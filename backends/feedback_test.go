@@ -0,0 +1,95 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+const testFeedbackReport = "From: fbl@isp.example\r\n" +
+	"Content-Type: multipart/report; report-type=feedback-report; boundary=\"b3\"\r\n\r\n" +
+	"--b3\r\nContent-Type: text/plain\r\n\r\nThis is an email abuse report\r\n" +
+	"--b3\r\nContent-Type: message/feedback-report\r\n\r\n" +
+	"Feedback-Type: abuse\r\nUser-Agent: SomeGenerator/1.0\r\nVersion: 1\r\n" +
+	"Original-Mail-From: <news@acme.com>\r\nOriginal-Rcpt-To: <dave@isp.example>\r\n" +
+	"Arrival-Date: Thu, 8 Mar 2005 14:00:00 EDT\r\nReporting-MTA: dns; mail.isp.example\r\n" +
+	"Source-IP: 192.0.2.1\r\nReported-Domain: acme.com\r\nIncidents: 3\r\n" +
+	"--b3\r\nContent-Type: message/rfc822\r\n\r\n" +
+	"Received: from 192.0.2.1 ([192.0.2.1])\r\n\tby isp.example with ESMTP id 4f2a; Thu, 8 Mar 2005 14:00:00 -0400\r\n" +
+	"Received: from 127.0.0.1 ([127.0.0.1])\r\n\tby acme.com with SMTP id q1@acme.com; Thu, 8 Mar 2005 13:59:00 -0400\r\n" +
+	"From: <news@acme.com>\r\nTo: Dave <dave@isp.example>\r\nMessage-Id: <m1@acme.com>\r\nSubject: offer\r\n\r\nbody\r\n" +
+	"--b3--\r\n"
+
+func TestParseFeedbackReport(t *testing.T) {
+	r, err := ParseFeedbackReport([]byte(testFeedbackReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FeedbackType != "abuse" || r.UserAgent != "SomeGenerator/1.0" || r.OriginalMailFrom != "news@acme.com" ||
+		len(r.OriginalRcptTo) != 1 || r.OriginalRcptTo[0] != "dave@isp.example" || r.SourceIP != "192.0.2.1" ||
+		r.Incidents != 3 || len(r.ReportedDomain) != 1 || r.ArrivalDate.IsZero() || !r.Complaint() {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if r.MessageId != "m1@acme.com" || strings.Join(r.QueuedIds, ",") != "4f2a,q1" {
+		t.Error("unexpected ids of the original message", r.MessageId, r.QueuedIds)
+	}
+	notSpam := strings.Replace(testFeedbackReport, "Feedback-Type: abuse", "Feedback-Type: not-spam", 1)
+	if r, err := ParseFeedbackReport([]byte(notSpam)); err != nil || r.Complaint() {
+		t.Error("expected a report that is not a complaint", err)
+	}
+	if _, err := ParseFeedbackReport([]byte(testDSN)); err != ErrNotFeedbackReport {
+		t.Error("expected a DSN not to be a feedback report, got", err)
+	}
+}
+
+func TestARFProcessor(t *testing.T) {
+	defer func(l *SuppressionList) { Suppressions = l }(Suppressions)
+	Suppressions = NewSuppressionList()
+	defer func() {
+		Deliveries = nil
+	}()
+	var reports []*FeedbackReport
+	RegisterFeedbackHandler("test", func(tenant string, r *FeedbackReport) {
+		reports = append(reports, r)
+	})
+	defer RegisterFeedbackHandler("test", nil)
+
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	backend, err := New(BackendConfig{
+		"save_process":           "HeadersParser|ARF|Debugger",
+		"log_received_mails":     true,
+		"delivery_tracking_size": 10,
+	}, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	Deliveries.Record(DeliveryRecord{QueuedId: "q1", MessageId: "m1@acme.com", Tenant: "acme", From: "news@acme.com",
+		Events: []DeliveryEvent{{Recipient: "dave@isp.example", State: DeliveryRelayed, Time: time.Now()}}})
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "fbl", Host: "isp.example"}
+	e.RcptTo = []mail.Address{{User: "fbl", Host: "acme.com"}}
+	e.Tenant = "acme"
+	e.Data.WriteString(testFeedbackReport)
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the report to be accepted, got", result)
+	}
+	if _, ok := Suppressions.Suppressed("acme", "dave@isp.example"); !ok {
+		t.Error("expected the complainant to be suppressed")
+	}
+	if len(reports) != 1 || e.Values["arf"] != reports[0] || !e.Tags.Has("arf") {
+		t.Error("expected the report to be handled", reports)
+	}
+	records := Deliveries.Lookup("q1")
+	if len(records) != 1 || len(records[0].Events) != 2 || records[0].Events[1].State != DeliveryComplained {
+		t.Error("expected the complaint to be recorded", records)
+	}
+}
@@ -0,0 +1,235 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// The transports of a forward route
+const (
+	forwardSMTP = "smtp"
+	forwardMX   = "mx"
+	forwardLMTP = "lmtp"
+)
+
+// The TLS policies of a forward route
+const (
+	forwardTLSNone    = "none"
+	forwardTLSMay     = "may"
+	forwardTLSRequire = "require"
+)
+
+// forwardRoute is where the forward processor sends the mail of the recipient domains that
+// match its pattern
+type forwardRoute struct {
+	// pattern is a domain, *.domain for its subdomains, or * for the rest
+	pattern   string
+	transport string
+	// hosts are the host:port of the smtp relays in the order they are tried, or the lmtp address
+	hosts      []string
+	tls        string
+	skipVerify bool
+	username   string
+	password   string
+}
+
+// key identifies the sessions with host, which depend on the TLS policy and the credentials
+func (r *forwardRoute) key(host string) string {
+	return "forward " + r.tls + " " + r.username + "@" + host
+}
+
+// forwardRoutes is the transport map, the routes by their pattern
+type forwardRoutes map[string]*forwardRoute
+
+// parseForwardRoute parses an entry of forward_routes, "<pattern> <target> [option...]". The
+// target is smtp:host[:port][,host...], mx, or lmtp:<address>, and the options are
+// tls=none|may|require, tls_skip_verify and auth=user:password or auth=none. The route starts
+// as a copy of def, the settings of the forward_* options
+func parseForwardRoute(entry string, def forwardRoute) (*forwardRoute, error) {
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("forward route %q should be <domain> <target> [options]", entry)
+	}
+	r := def
+	r.pattern = strings.ToLower(fields[0])
+	if r.pattern != "*" && strings.Contains(strings.TrimPrefix(r.pattern, "*."), "*") {
+		return nil, fmt.Errorf("forward route %q: the domain may only start with *.", entry)
+	}
+	target := fields[1]
+	switch {
+	case target == forwardMX:
+		r.transport, r.hosts = forwardMX, nil
+	case strings.HasPrefix(target, forwardSMTP+":"):
+		r.transport, r.hosts = forwardSMTP, nil
+		for _, host := range strings.Split(strings.TrimPrefix(target, forwardSMTP+":"), ",") {
+			if host == "" {
+				return nil, fmt.Errorf("forward route %q has an empty host", entry)
+			}
+			r.hosts = append(r.hosts, forwardHostPort(host))
+		}
+	case strings.HasPrefix(target, forwardLMTP+":") && len(target) > len(forwardLMTP)+1:
+		r.transport, r.hosts = forwardLMTP, []string{strings.TrimPrefix(target, forwardLMTP+":")}
+	default:
+		return nil, fmt.Errorf("forward route %q: the target should be smtp:<hosts>, mx or lmtp:<address>", entry)
+	}
+	for _, option := range fields[2:] {
+		kv := strings.SplitN(option, "=", 2)
+		switch {
+		case kv[0] == "tls" && len(kv) == 2 &&
+			(kv[1] == forwardTLSNone || kv[1] == forwardTLSMay || kv[1] == forwardTLSRequire):
+			r.tls = kv[1]
+		case kv[0] == "tls_skip_verify" && len(kv) == 1:
+			r.skipVerify = true
+		case kv[0] == "auth" && len(kv) == 2 && kv[1] == "none":
+			r.username, r.password = "", ""
+		case kv[0] == "auth" && len(kv) == 2 && strings.Contains(kv[1], ":"):
+			credentials := strings.SplitN(kv[1], ":", 2)
+			r.username, r.password = credentials[0], credentials[1]
+		default:
+			return nil, fmt.Errorf("forward route %q: unknown option %q", entry, option)
+		}
+	}
+	return &r, nil
+}
+
+// forwardHostPort adds the smtp port to host when it has none
+func forwardHostPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(strings.Trim(host, "[]"), "25")
+	}
+	return host
+}
+
+// match returns the route of the domain: the route of the domain itself, else the route of
+// the closest parent domain with a *. pattern, else the * route. Nil when there is none
+func (routes forwardRoutes) match(domain string) *forwardRoute {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if r, ok := routes[domain]; ok {
+		return r
+	}
+	for parent := domain; strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if r, ok := routes["*."+parent]; ok {
+			return r
+		}
+	}
+	return routes["*"]
+}
+
+// forwardGroup are the recipients that are sent together, in one transaction
+type forwardGroup struct {
+	// route is nil for the recipients without a route
+	route *forwardRoute
+	// domain is the domain of the recipients when they are delivered to its MX hosts
+	domain string
+	rcpts  []mail.Address
+}
+
+// group splits the recipients by their route, and for the mx routes by their domain, in the
+// order the groups were first seen
+func (routes forwardRoutes) group(rcpts []mail.Address) []*forwardGroup {
+	var groups []*forwardGroup
+	for _, rcpt := range rcpts {
+		route := routes.match(rcpt.Host)
+		domain := ""
+		if route != nil && route.transport == forwardMX {
+			domain = strings.ToLower(rcpt.Host)
+		}
+		var g *forwardGroup
+		for _, other := range groups {
+			if other.route == route && other.domain == domain {
+				g = other
+				break
+			}
+		}
+		if g == nil {
+			g = &forwardGroup{route: route, domain: domain}
+			groups = append(groups, g)
+		}
+		g.rcpts = append(g.rcpts, rcpt)
+	}
+	return groups
+}
+
+// errForwardNoRoute is the reply for the recipients whose domain has no route
+var errForwardNoRoute = &textproto.Error{Code: 550, Msg: "5.4.4 No route to the recipient's domain"}
+
+// errForwardNullMX is the reply for a domain that publishes that it takes no mail, RFC 7505
+var errForwardNullMX = &textproto.Error{Code: 556, Msg: "5.1.10 The recipient's domain does not accept mail"}
+
+// forwardMXPort is the port of the MX hosts
+var forwardMXPort = "25"
+
+// forwardMXHosts returns the host:port of the MX hosts of the domain, by preference. A domain
+// without MX records is its own MX host, RFC 5321 section 5.1
+func forwardMXHosts(domain string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	mxs, err := Resolver().LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return []string{net.JoinHostPort(domain, forwardMXPort)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, errForwardNullMX
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), forwardMXPort))
+	}
+	if len(hosts) == 0 {
+		return []string{net.JoinHostPort(domain, forwardMXPort)}, nil
+	}
+	return hosts, nil
+}
+
+// forwardLMTPDeliver delivers the envelope to the local delivery agent at addr. It returns the
+// reply for each recipient that failed, when the others were delivered. When all of them
+// failed, the error is the reply of the first one that may succeed later, or else the first one
+func forwardLMTPDeliver(addr, helo string, e *mail.Envelope, timeout time.Duration) (map[string]string, error) {
+	c, err := dialLMTP(addr, helo, timeout)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := lmtpDeliver(c, e)
+	_ = c.Close()
+	if err != nil {
+		return nil, err
+	}
+	var failed map[string]string
+	var tempfail, permfail error
+	for i, reply := range replies {
+		if reply.Code/100 == 2 {
+			continue
+		}
+		if failed == nil {
+			failed = make(map[string]string)
+		}
+		failed[e.RcptTo[i].String()] = reply.String()
+		if reply.Code/100 == 4 && tempfail == nil {
+			tempfail = &textproto.Error{Code: reply.Code, Msg: reply.Message}
+		} else if permfail == nil {
+			permfail = &textproto.Error{Code: reply.Code, Msg: reply.Message}
+		}
+	}
+	if len(failed) == len(replies) && len(replies) > 0 {
+		if tempfail != nil {
+			return nil, tempfail
+		}
+		return nil, permfail
+	}
+	return failed, nil
+}
@@ -0,0 +1,202 @@
+package backends
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// mxResolver answers the MX lookups with its records, and doesn't find the other domains
+type mxResolver struct {
+	mockResolver
+	mx map[string][]*net.MX
+}
+
+func (m *mxResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := m.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestForwardRoutesMatch(t *testing.T) {
+	config := &ForwardProcessorConfig{
+		Hosts:    []string{"smarthost.example.net"},
+		Username: "relay",
+		Password: "secret",
+		Routes: []string{
+			"corp.example.com smtp:relay1.corp,relay2.corp:587 tls=require",
+			"*.corp.example.com smtp:[::1]:2525 tls=none auth=none",
+			"example.org lmtp:unix:/run/dovecot/lmtp",
+			"*.example.org mx tls_skip_verify auth=other:pass:word",
+		},
+	}
+	routes, err := config.routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]string{
+		"corp.example.com":        "corp.example.com",
+		"CORP.example.com.":       "corp.example.com",
+		"eu.corp.example.com":     "*.corp.example.com",
+		"a.b.corp.example.com":    "*.corp.example.com",
+		"example.org":             "example.org",
+		"mail.example.org":        "*.example.org",
+		"example.com":             "*",
+		"notcorp.example.com.net": "*",
+	} {
+		if r := routes.match(domain); r == nil || r.pattern != want {
+			t.Error("expected", domain, "to match", want, "got", r)
+		}
+	}
+	r := routes["corp.example.com"]
+	if strings.Join(r.hosts, " ") != "relay1.corp:25 relay2.corp:587" || r.tls != forwardTLSRequire ||
+		r.username != "relay" {
+		t.Error("unexpected route", r)
+	}
+	if r := routes["*.corp.example.com"]; r.hosts[0] != "[::1]:2525" || r.tls != forwardTLSNone || r.username != "" {
+		t.Error("unexpected route", r)
+	}
+	if r := routes["example.org"]; r.transport != forwardLMTP || r.hosts[0] != "unix:/run/dovecot/lmtp" {
+		t.Error("unexpected route", r)
+	}
+	if r := routes["*.example.org"]; r.transport != forwardMX || !r.skipVerify || r.password != "pass:word" {
+		t.Error("unexpected route", r)
+	}
+	if r := routes["*"]; r.hosts[0] != "smarthost.example.net:25" || r.tls != forwardTLSMay {
+		t.Error("unexpected default route", r)
+	}
+
+	groups := routes.group([]mail.Address{
+		{User: "a", Host: "corp.example.com"},
+		{User: "b", Host: "x.example.org"},
+		{User: "c", Host: "y.example.org"},
+		{User: "d", Host: "corp.example.com"},
+		{User: "e", Host: "x.example.org"},
+	})
+	if len(groups) != 3 || len(groups[0].rcpts) != 2 || groups[1].domain != "x.example.org" ||
+		len(groups[1].rcpts) != 2 || groups[2].domain != "y.example.org" {
+		t.Error("unexpected groups", groups)
+	}
+
+	for _, entry := range []string{
+		"example.com",
+		"example.com ftp:host",
+		"example.com smtp:",
+		"example.com lmtp:",
+		"ex*ample.com mx",
+		"example.com mx tls=maybe",
+		"example.com mx auth=nopassword",
+	} {
+		if _, err := parseForwardRoute(entry, forwardRoute{}); err == nil {
+			t.Error("expected", entry, "to be refused")
+		}
+	}
+	config = &ForwardProcessorConfig{Routes: []string{"example.com mx", "EXAMPLE.com mx"}}
+	if _, err := config.routes(); err == nil {
+		t.Error("expected a second route of a domain to be refused")
+	}
+	if _, err := (&ForwardProcessorConfig{}).routes(); err == nil {
+		t.Error("expected a route to be required")
+	}
+}
+
+func TestForwardMXHosts(t *testing.T) {
+	defer SetResolver(Resolver())
+	SetResolver(&mxResolver{mx: map[string][]*net.MX{
+		"example.com":  {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+		"null.example": {{Host: ".", Pref: 0}},
+	}})
+	if hosts, err := forwardMXHosts("example.com", time.Second); err != nil ||
+		strings.Join(hosts, " ") != "mx1.example.com:25 mx2.example.com:25" {
+		t.Error("expected the MX hosts by preference, got", hosts, err)
+	}
+	if hosts, err := forwardMXHosts("nomx.example", time.Second); err != nil || hosts[0] != "nomx.example:25" {
+		t.Error("expected the domain to be its own MX, got", hosts, err)
+	}
+	if _, err := forwardMXHosts("null.example", time.Second); err != errForwardNullMX {
+		t.Error("expected the null MX to be refused, got", err)
+	}
+}
+
+func TestForwardRoutes(t *testing.T) {
+	internal := newFakeUpstream(t, "")
+	internet := newFakeUpstream(t, "")
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "lmtp")
+	local := newFakeLMTP(t, "unix", socket)
+	defer func() {
+		_ = internal.ln.Close()
+		_ = internet.ln.Close()
+		_ = local.ln.Close()
+		_ = os.RemoveAll(dir)
+	}()
+	// the MX of the internet domains is the fake upstream
+	mxHost, mxPort, _ := net.SplitHostPort(internet.ln.Addr().String())
+	// the backend sets the Resolver to the upstream
+	defer func(r DNSResolver, port string) {
+		DNSUpstream, forwardMXPort = r, port
+		SetResolver(r)
+	}(DNSUpstream, forwardMXPort)
+	DNSUpstream = &mxResolver{mx: map[string][]*net.MX{"other.com": {{Host: mxHost, Pref: 10}}}}
+	forwardMXPort = mxPort
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Forward|Debugger",
+		"primary_mail_host": "mail.acme.com",
+		"forward_routes": []interface{}{
+			"acme.com smtp:" + internal.ln.Addr().String(),
+			"*.acme.com lmtp:unix:" + socket,
+			"other.com mx",
+		},
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	e.RcptTo = []mail.Address{
+		{User: "bob", Host: "acme.com"},
+		{User: "bob", Host: "eu.acme.com"},
+		{User: "bob", Host: "other.com"},
+		{User: "bob", Host: "unrouted.net"},
+	}
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be accepted, got", result)
+	}
+	if _, ok := internal.delivered["bob@acme.com"]; !ok || len(internal.delivered) != 1 {
+		t.Error("expected only bob@acme.com to be relayed internally, got", internal.delivered)
+	}
+	if _, ok := local.delivered["bob@eu.acme.com"]; !ok || len(local.delivered) != 1 {
+		t.Error("expected only bob@eu.acme.com to be delivered over lmtp, got", local.delivered)
+	}
+	if _, ok := internet.delivered["bob@other.com"]; !ok || len(internet.delivered) != 1 {
+		t.Error("expected only bob@other.com to be sent to its MX, got", internet.delivered)
+	}
+	if failed, _ := e.Values["forward_failed"].(map[string]string); len(failed) != 1 ||
+		!strings.HasPrefix(failed["bob@unrouted.net"], "550 5.4.4") {
+		t.Error("expected the unrouted recipient to be refused, got", e.Values["forward_failed"])
+	}
+	if hosts := strings.Split(e.Values["forward_host"].(string), ","); len(hosts) != 3 {
+		t.Error("expected the 3 hosts that took the email, got", e.Values["forward_host"])
+	}
+	if len(e.RcptTo) != 4 {
+		t.Error("expected the recipients to be restored, got", e.RcptTo)
+	}
+
+	// a recipient without a route only
+	e = newBrokerTestEnvelope()
+	e.RcptTo = []mail.Address{{User: "bob", Host: "unrouted.net"}}
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "550 5.4.4") {
+		t.Error("expected the unrouted recipient to be refused, got", result)
+	}
+}
@@ -3,6 +3,7 @@ package backends
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -30,12 +31,23 @@ type BackendGateway struct {
 	workStoppers []chan bool
 	processors   []Processor
 	validators   []Processor
+	bouncers     []Processor
+	// named chains of each worker, see GatewayConfig.Chains
+	chains []map[string]Processor
+	// stream processors, shared by all workers, see GatewayConfig.StreamProcess
+	streamers []StreamDecorator
 
 	// controls access to state
 	sync.Mutex
 	State    backendState
 	config   BackendConfig
 	gwConfig *GatewayConfig
+	// the criticality of the processors, and their health
+	criticality map[string]string
+	monitor     *healthMonitor
+	// the retries started by Notify, they are stopped when the gateway shuts down
+	retries   sync.WaitGroup
+	retryStop chan struct{}
 }
 
 type GatewayConfig struct {
@@ -45,10 +57,45 @@ type GatewayConfig struct {
 	SaveProcess string `json:"save_process,omitempty"`
 	// ValidateProcess is like ProcessorStack, but for recipient validation tasks
 	ValidateProcess string `json:"validate_process,omitempty"`
+	// BounceProcess is like SaveProcess, but for saving bounces, ie. email with a null sender (MAIL FROM:<>)
+	// Defaults to SaveProcess
+	BounceProcess string `json:"bounce_process,omitempty"`
 	// TimeoutSave is duration before timeout when saving an email, eg "29s"
 	TimeoutSave string `json:"gw_save_timeout,omitempty"`
 	// TimeoutValidateRcpt duration before timeout when validating a recipient, eg "1s"
 	TimeoutValidateRcpt string `json:"gw_val_rcpt_timeout,omitempty"`
+	// SaveBudget is the total time that processing an email may take, eg "25s", to stay under
+	// the client's DATA timeout. Once it's used up, processors marked as optional with a ? suffix,
+	// eg. "HeadersParser|SpamCheck?|Redis", are skipped, and others fail with a temporary error.
+	// It's checked before each processor, so it should be less than TimeoutSave
+	SaveBudget string `json:"gw_save_budget,omitempty"`
+	// Chains are named processor chains that envelopes can be sent through instead of SaveProcess,
+	// eg. to re-process stored mail. Each is "name=HeadersParser|Hasher|Sql". The names "save" and "bounce"
+	// are the SaveProcess and BounceProcess chains
+	Chains []string `json:"process_chains,omitempty"`
+	// StreamProcess chains stream processors, eg. "compressor|s3", that get the message while
+	// it's being received, instead of buffering it. The last one saves the message, s3 or sql.
+	// Then e.Data only has the header section when SaveProcess runs, and the processors that need
+	// the whole message, eg. mbox, are refused there and in BounceProcess
+	StreamProcess string `json:"stream_save_process,omitempty"`
+	// Plugins are paths to processor plugins (.so files) to load, see LoadPlugin
+	Plugins []string `json:"processor_plugins,omitempty"`
+	// Criticality sets what happens when the health check of a processor keeps failing, each is
+	// "processor=criticality", eg. "spamcheck=preferred". Processors are required, unless they
+	// are marked with a ? in a chain, which makes them optional
+	Criticality []string `json:"processor_criticality,omitempty"`
+	// HealthCheckInterval is how often the processors with a health check are checked, eg. "10s"
+	HealthCheckInterval string `json:"health_check_interval,omitempty"`
+	// HealthCheckFailures is how many checks in a row a processor fails before it's unhealthy
+	HealthCheckFailures int `json:"health_check_failures,omitempty"`
+	// StrictChains refuses to start with the misconfigured chains that are otherwise logged as warnings,
+	// eg. a compressor after the processor that saves the email
+	StrictChains bool `json:"strict_chains,omitempty"`
+	// RetryFor is how long the recipients that a processor deferred are retried before they are
+	// bounced, eg. "4h". Defaults to 1h
+	RetryFor string `json:"gw_retry_for,omitempty"`
+	// PrimaryHost is the host that reports the delivery status notifications
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
 }
 
 // workerMsg is what get placed on the BackendGateway.saveMailChan channel
@@ -59,6 +106,10 @@ type workerMsg struct {
 	notifyMe chan *notifyMsg
 	// select the task type
 	task SelectTask
+	// chain is the name of the chain to process with, empty for SaveProcess or BounceProcess
+	chain string
+	// batch is the number of recipients to validate, see ValidateRcpts
+	batch int
 }
 
 type backendState int
@@ -124,16 +175,33 @@ func (w *workerMsg) reset(e *mail.Envelope, task SelectTask) {
 	}
 	w.e = e
 	w.task = task
+	w.chain = ""
+	w.batch = 0
 }
 
 // Process distributes an envelope to one of the backend workers with a TaskSaveMail task
 func (gw *BackendGateway) Process(e *mail.Envelope) Result {
+	return gw.ProcessChain(e, "")
+}
+
+// ProcessChain is like Process, but the envelope goes through the named chain, see GatewayConfig.Chains.
+// An empty name selects the save or bounce chain, like Process does
+func (gw *BackendGateway) ProcessChain(e *mail.Envelope, chain string) Result {
 	if gw.State != BackendStateRunning {
 		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
 	}
+	chain = strings.ToLower(chain)
+	if !gw.hasChain(chain) {
+		return NewResult(response.Canned.FailBackendTransaction, response.SP, "no such processor chain: "+chain)
+	}
+	if budget := gw.saveBudget(); budget > 0 {
+		// processors check the deadline, gw_save_timeout remains the hard limit
+		e.Deadline = time.Now().Add(budget)
+	}
 	// borrow a workerMsg from the pool
 	workerMsg := workerMsgPool.Get().(*workerMsg)
 	workerMsg.reset(e, TaskSaveMail)
+	workerMsg.chain = chain
 	// place on the channel so that one of the save mail workers can pick it up
 	gw.conveyor <- workerMsg
 	// wait for the save to complete
@@ -141,30 +209,7 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 	select {
 	case status := <-workerMsg.notifyMe:
 		// email saving transaction completed
-		if status.result == BackendResultOK && status.queuedID != "" {
-			return NewResult(response.Canned.SuccessMessageQueued, response.SP, status.queuedID)
-		}
-
-		// A custom result, there was probably an error, if so, log it
-		if status.result != nil {
-			if status.err != nil {
-				Log().Error(status.err)
-			}
-			return status.result
-		}
-
-		// if there was no result, but there's an error, then make a new result from the error
-		if status.err != nil {
-			if _, err := strconv.Atoi(status.err.Error()[:3]); err != nil {
-				return NewResult(response.Canned.FailBackendTransaction, response.SP, status.err)
-			}
-			return NewResult(status.err)
-		}
-
-		// both result & error are nil (should not happen)
-		err := errors.New("no response from backend - processor did not return a result or an error")
-		Log().Error(err)
-		return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
+		return statusResult(status)
 
 	case <-time.After(gw.saveTimeout()):
 		Log().Error("Backend has timed out while saving email")
@@ -179,6 +224,61 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 	}
 }
 
+// hasChain returns true when there is a chain of that name in process_chains, or it's empty
+func (gw *BackendGateway) hasChain(chain string) bool {
+	_, ok := gw.chains[0][chain]
+	return chain == "" || ok
+}
+
+// StepChain processes the envelope with the named chain like ProcessChain, calling step before
+// each processor. It waits for the processing to finish, without a timeout, see ChainStepper
+func (gw *BackendGateway) StepChain(e *mail.Envelope, chain string, step StepFunc) Result {
+	if gw.State != BackendStateRunning {
+		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
+	}
+	chain = strings.ToLower(chain)
+	if !gw.hasChain(chain) {
+		return NewResult(response.Canned.FailBackendTransaction, response.SP, "no such processor chain: "+chain)
+	}
+	steppers.Store(e, step)
+	defer steppers.Delete(e)
+	workerMsg := workerMsgPool.Get().(*workerMsg)
+	workerMsg.reset(e, TaskSaveMail)
+	workerMsg.chain = chain
+	gw.conveyor <- workerMsg
+	status := <-workerMsg.notifyMe
+	workerMsgPool.Put(workerMsg)
+	return statusResult(status)
+}
+
+// statusResult is the result of an email saving transaction that a worker completed
+func statusResult(status *notifyMsg) Result {
+	if status.result == BackendResultOK && status.queuedID != "" {
+		return NewResult(response.Canned.SuccessMessageQueued, response.SP, status.queuedID)
+	}
+
+	// A custom result, there was probably an error, if so, log it
+	if status.result != nil {
+		if status.err != nil {
+			Log().Error(status.err)
+		}
+		return status.result
+	}
+
+	// if there was no result, but there's an error, then make a new result from the error
+	if status.err != nil {
+		if _, err := strconv.Atoi(status.err.Error()[:3]); err != nil {
+			return NewResult(response.Canned.FailBackendTransaction, response.SP, status.err)
+		}
+		return NewResult(status.err)
+	}
+
+	// both result & error are nil (should not happen)
+	err := errors.New("no response from backend - processor did not return a result or an error")
+	Log().Error(err)
+	return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
+}
+
 // ValidateRcpt asks one of the workers to validate the recipient
 // Only the last recipient appended to e.RcptTo will be validated.
 func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
@@ -215,15 +315,62 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 	}
 }
 
+// ValidateRcpts validates the last n recipients of the envelope with a single task, each
+// as if it was the last one pushed. The errors are in the order of the recipients
+func (gw *BackendGateway) ValidateRcpts(e *mail.Envelope, n int) []RcptError {
+	errs := make([]RcptError, n)
+	if gw.State != BackendStateRunning {
+		for i := range errs {
+			errs[i] = StorageNotAvailable
+		}
+		return errs
+	}
+	if _, ok := gw.validators[0].(NoopProcessor); ok || n == 0 {
+		return errs
+	}
+	workerMsg := workerMsgPool.Get().(*workerMsg)
+	workerMsg.reset(e, TaskValidateRcpt)
+	workerMsg.batch = n
+	gw.conveyor <- workerMsg
+	select {
+	case status := <-workerMsg.notifyMe:
+		workerMsgPool.Put(workerMsg)
+		copy(errs, status.rcptErrs)
+		return errs
+
+	case <-time.After(gw.validateRcptTimeout() * time.Duration(n)):
+		e.Lock()
+		go func() {
+			<-workerMsg.notifyMe
+			e.Unlock()
+			workerMsgPool.Put(workerMsg)
+			Log().Error("Backend has timed out while validating rcpts")
+		}()
+		for i := range errs {
+			errs[i] = StorageTimeout
+		}
+		return errs
+	}
+}
+
 // Shutdown shuts down the backend and leaves it in BackendStateShuttered state
 func (gw *BackendGateway) Shutdown() error {
 	gw.Lock()
 	defer gw.Unlock()
 	if gw.State != BackendStateShuttered {
+		if gw.retryStop != nil {
+			// the retries may still send their bounces through the workers
+			close(gw.retryStop)
+			gw.retryStop = nil
+			gw.retries.Wait()
+		}
 		// send a signal to all workers
 		gw.stopWorkers()
 		// wait for workers to stop
 		gw.wg.Wait()
+		if gw.monitor != nil {
+			gw.monitor.shutdown()
+		}
 		// call shutdown on all processor shutdowners
 		if err := Svc.shutdown(); err != nil {
 			return err
@@ -250,6 +397,23 @@ func (gw *BackendGateway) Reinitialize() error {
 	return err
 }
 
+// parseChains parses the "name=Processor|Processor" entries of GatewayConfig.Chains
+func parseChains(entries []string) (map[string]string, error) {
+	chains := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) != 2 || name == "" {
+			return nil, fmt.Errorf("processor chain %q should be name=Processor|Processor", entry)
+		}
+		if name == "save" || name == "bounce" {
+			return nil, fmt.Errorf("processor chain %q uses a reserved name", entry)
+		}
+		chains[name] = kv[1]
+	}
+	return chains, nil
+}
+
 // newStack creates a new Processor by chaining multiple Processors in a call stack
 // Decorators are functions of Decorator type, source files prefixed with p_*
 // Each decorator does a specific task during the processing stage.
@@ -264,8 +428,31 @@ func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
 	items := strings.Split(cfg, "|")
 	for i := range items {
 		name := items[len(items)-1-i] // reverse order, since decorators are stacked
+		// a ? suffix marks the processor as optional, it may be skipped when short on time
+		optional := strings.HasSuffix(name, "?")
+		name = strings.TrimSuffix(name, "?")
 		if makeFunc, ok := processors[name]; ok {
-			decorators = append(decorators, makeFunc())
+			n := Svc.countInitializers()
+			d := Budgeted(makeFunc(), optional)
+			checks := Svc.takeHealthChecks()
+			if gw.monitor != nil {
+				criticality, ok := gw.criticality[name]
+				if !ok && optional {
+					criticality = CriticalityOptional
+				} else if !ok {
+					criticality = CriticalityRequired
+				}
+				h := gw.monitor.processor(name, criticality)
+				if h.check == nil && len(checks) > 0 {
+					h.check = checks[0]
+				}
+				if criticality != CriticalityRequired {
+					d = degradable(h, d)
+				}
+			}
+			decorators = append(decorators, stepped(name, d))
+			// the processor reads its own section of the config, see BackendConfig.Section
+			Svc.scopeInitializers(n, name)
 		} else {
 			ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", name)
 			return nil, ErrProcessorNotFound
@@ -302,13 +489,116 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 		gw.State = BackendStateError
 		return err
 	}
+	if err = configureClock(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureDNSCache(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureSMTPPool(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureDeliveryTracking(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureSuppressions(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureRetention(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureMaintenance(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	if err = configureAnonymization(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	for _, path := range gw.gwConfig.Plugins {
+		if err = LoadPlugin(path); err != nil {
+			gw.State = BackendStateError
+			return err
+		}
+	}
 	workersSize := gw.workersSize()
 	if workersSize < 1 {
 		gw.State = BackendStateError
 		return errors.New("must have at least 1 worker")
 	}
+	if gw.criticality, err = parseCriticality(gw.gwConfig.Criticality); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	gw.monitor = &healthMonitor{
+		interval: defaultHealthCheckInterval,
+		failures: defaultHealthCheckFailures,
+		health:   make(map[string]*processorHealth),
+	}
+	if gw.gwConfig.HealthCheckInterval != "" {
+		d, err := time.ParseDuration(gw.gwConfig.HealthCheckInterval)
+		if err != nil || d <= 0 {
+			gw.State = BackendStateError
+			return fmt.Errorf("invalid health_check_interval %q", gw.gwConfig.HealthCheckInterval)
+		}
+		gw.monitor.interval = d
+	}
+	if gw.gwConfig.HealthCheckFailures > 0 {
+		gw.monitor.failures = gw.gwConfig.HealthCheckFailures
+	}
 	gw.processors = make([]Processor, 0)
 	gw.validators = make([]Processor, 0)
+	gw.bouncers = make([]Processor, 0)
+	gw.chains = make([]map[string]Processor, 0)
+	chains, err := parseChains(gw.gwConfig.Chains)
+	if err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	// the processors that save the mail need the ones they depend on before them
+	stacks := map[string]string{"save_process": gw.gwConfig.SaveProcess, "bounce_process": gw.gwConfig.BounceProcess}
+	for name, stack := range chains {
+		stacks["process_chains "+name] = stack
+	}
+	options := make([]string, 0, len(stacks))
+	for option := range stacks {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	var warnings []string
+	for _, option := range options {
+		if err := checkDependencies(option, stacks[option]); err != nil {
+			gw.State = BackendStateError
+			return err
+		}
+		warnings = append(warnings, chainWarnings(option, stacks[option], cfg)...)
+	}
+	if gw.gwConfig.StreamProcess != "" {
+		// e.Data only has the header section of the streamed messages
+		for _, option := range []string{"bounce_process", "save_process"} {
+			if err := checkStreamed(option, stacks[option]); err != nil {
+				gw.State = BackendStateError
+				return err
+			}
+		}
+		if err := checkStreamStores(gw.gwConfig.StreamProcess, stacks["save_process"]); err != nil {
+			gw.State = BackendStateError
+			return err
+		}
+	}
+	if len(warnings) > 0 && gw.gwConfig.StrictChains {
+		gw.State = BackendStateError
+		return fmt.Errorf("strict_chains: %s", strings.Join(warnings, "; "))
+	}
+	for _, warning := range warnings {
+		Log().Warn(warning)
+	}
 	for i := 0; i < workersSize; i++ {
 		p, err := gw.newStack(gw.gwConfig.SaveProcess)
 		if err != nil {
@@ -323,12 +613,36 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 			return err
 		}
 		gw.validators = append(gw.validators, v)
+
+		b := p
+		if gw.gwConfig.BounceProcess != "" {
+			if b, err = gw.newStack(gw.gwConfig.BounceProcess); err != nil {
+				gw.State = BackendStateError
+				return err
+			}
+		}
+		gw.bouncers = append(gw.bouncers, b)
+
+		named := map[string]Processor{"save": p, "bounce": b}
+		for name, stack := range chains {
+			if named[name], err = gw.newStack(stack); err != nil {
+				gw.State = BackendStateError
+				return err
+			}
+		}
+		gw.chains = append(gw.chains, named)
+	}
+	if gw.streamers, err = gw.newStreamStack(gw.gwConfig.StreamProcess); err != nil {
+		gw.State = BackendStateError
+		return err
 	}
 	// initialize processors
+	Svc.gateway.Store(gw)
 	if err := Svc.initialize(cfg); err != nil {
 		gw.State = BackendStateError
 		return err
 	}
+	Svc.warnUnknownConfigKeys(cfg)
 	if gw.conveyor == nil {
 		gw.conveyor = make(chan *workerMsg, workersSize)
 	}
@@ -358,6 +672,8 @@ func (gw *BackendGateway) Start() error {
 						gw.conveyor,
 						gw.processors[workerId],
 						gw.validators[workerId],
+						gw.bouncers[workerId],
+						gw.chains[workerId],
 						workerId+1,
 						stop)
 					// keep running after panic
@@ -369,6 +685,10 @@ func (gw *BackendGateway) Start() error {
 			}(i, stop)
 			gw.workStoppers = append(gw.workStoppers, stop)
 		}
+		if gw.monitor != nil {
+			gw.monitor.start()
+		}
+		gw.retryStop = make(chan struct{})
 		gw.State = BackendStateRunning
 		return nil
 	} else {
@@ -397,6 +717,18 @@ func (gw *BackendGateway) saveTimeout() time.Duration {
 	return t
 }
 
+// saveBudget returns the time that processing an email may take, 0 if there is no budget
+func (gw *BackendGateway) saveBudget() time.Duration {
+	if gw.gwConfig.SaveBudget == "" {
+		return 0
+	}
+	t, err := time.ParseDuration(gw.gwConfig.SaveBudget)
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
 // validateRcptTimeout returns the maximum amount of seconds to wait before timing out a recipient validation  task
 func (gw *BackendGateway) validateRcptTimeout() time.Duration {
 	if gw.gwConfig.TimeoutValidateRcpt == "" {
@@ -423,6 +755,8 @@ func (gw *BackendGateway) workDispatcher(
 	workIn chan *workerMsg,
 	save Processor,
 	validate Processor,
+	bounce Processor,
+	chains map[string]Processor,
 	workerId int,
 	stop chan bool) (state dispatcherState) {
 
@@ -456,9 +790,26 @@ func (gw *BackendGateway) workDispatcher(
 		case msg = <-workIn:
 			state = dispatcherStateWorking // recovers from panic if in this state
 			if msg.task == TaskSaveMail {
-				result, err := save.Process(msg.e, msg.task)
+				p := save
+				if msg.chain != "" {
+					p = chains[msg.chain]
+				} else if msg.e.MailFrom.NullPath {
+					p = bounce
+				}
+				result, err := p.Process(msg.e, msg.task)
 				state = dispatcherStateNotify
 				msg.notifyMe <- &notifyMsg{err: err, result: result, queuedID: msg.e.QueuedId}
+			} else if msg.batch > 0 {
+				// validate each recipient with the ones before it, as if it was just pushed
+				all := msg.e.RcptTo
+				errs := make([]RcptError, msg.batch)
+				for i := range errs {
+					msg.e.RcptTo = all[:len(all)-msg.batch+i+1]
+					_, errs[i] = validate.Process(msg.e, msg.task)
+				}
+				msg.e.RcptTo = all
+				state = dispatcherStateNotify
+				msg.notifyMe <- &notifyMsg{rcptErrs: errs}
 			} else {
 				result, err := validate.Process(msg.e, msg.task)
 				state = dispatcherStateNotify
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/artpar/go-guerrilla/log"
 	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
 	"strings"
 	"testing"
 	"time"
@@ -86,7 +87,7 @@ func TestStartProcessStop(t *testing.T) {
 	e.Data.WriteString("Subject:Test\n\nThis is a test.")
 	notify := make(chan *notifyMsg)
 
-	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail}
+	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail, "", 0}
 
 	// it should not produce any errors
 	// headers (subject) should be parsed.
@@ -97,7 +98,7 @@ func TestStartProcessStop(t *testing.T) {
 		if status.err != nil {
 			t.Error("envelope processing failed with:", status.err)
 		}
-		if e.Header["Subject"][0] != "Test" {
+		if e.Header.Get("Subject") != "Test" {
 			t.Error("envelope processing did not parse header")
 		}
 
@@ -111,3 +112,190 @@ func TestStartProcessStop(t *testing.T) {
 		t.Error("Gateway did not shutdown")
 	}
 }
+
+func TestBounceProcess(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	c := BackendConfig{
+		"save_process":       "Debugger",
+		"bounce_process":     "LoopCheck|Debugger",
+		"loopcheck_max_hops": 2,
+		"log_received_mails": true,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	data := "Received: from a\nReceived: from b\nReceived: from c\nSubject: loop\n\nhello\n"
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+	e.Data.WriteString(data)
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expected the save_process chain to accept, got", result)
+	}
+
+	e = mail.NewEnvelope("127.0.0.1", 2)
+	e.MailFrom = mail.Address{NullPath: true}
+	e.Data.WriteString(data)
+	if result := gateway.Process(e); result.Code() != 554 {
+		t.Error("expected the bounce_process chain to reject the loop, got", result)
+	}
+}
+
+func TestProcessChain(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	c := BackendConfig{
+		"save_process":       "Debugger",
+		"process_chains":     []interface{}{"loops=LoopCheck|Debugger"},
+		"loopcheck_max_hops": 2,
+		"log_received_mails": true,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	data := "Received: from a\nReceived: from b\nReceived: from c\nSubject: loop\n\nhello\n"
+
+	for chain, code := range map[string]int{"": 250, "save": 250, "bounce": 250, "Loops": 554, "unknown": 554} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{NullPath: true}
+		e.Data.WriteString(data)
+		if result := gateway.ProcessChain(e, chain); result.Code() != code {
+			t.Error("expected", code, "from the chain", chain, "got", result)
+		}
+	}
+
+	for _, chains := range [][]interface{}{{"save=Debugger"}, {"Debugger"}, {"=Debugger"}} {
+		gateway := &BackendGateway{}
+		err := gateway.Initialize(BackendConfig{"process_chains": chains, "log_received_mails": true})
+		if err == nil || !strings.Contains(err.Error(), "processor chain") {
+			t.Error("expected an error for the chains", chains, "got", err)
+		}
+	}
+}
+
+func TestSaveBudget(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	// slowpoke takes 60ms and counts how many times it was called
+	calls := 0
+	processors["slowpoke"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					calls++
+					time.Sleep(time.Millisecond * 60)
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	defer delete(processors, "slowpoke")
+
+	tests := []struct {
+		process string
+		code    int
+		calls   int
+	}{
+		// the third is skipped, as the budget ran out
+		{"Slowpoke|Slowpoke|Slowpoke?", 250, 2},
+		// the third is required
+		{"Slowpoke|Slowpoke|Slowpoke", 451, 2},
+		{"Slowpoke?", 250, 1},
+	}
+	for _, tt := range tests {
+		Svc.reset()
+		calls = 0
+		gateway := &BackendGateway{}
+		if err := gateway.Initialize(BackendConfig{
+			"save_process":   tt.process,
+			"gw_save_budget": "100ms",
+		}); err != nil {
+			t.Fatal("Gateway did not init because:", err)
+		}
+		if err := gateway.Start(); err != nil {
+			t.Fatal("Gateway did not start because:", err)
+		}
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.RcptTo = []mail.Address{{User: "test", Host: "example.com"}}
+		if result := gateway.Process(e); result.Code() != tt.code {
+			t.Error(tt.process, "expected", tt.code, "but got", result)
+		}
+		if calls != tt.calls {
+			t.Error(tt.process, "expected", tt.calls, "calls but got", calls)
+		}
+		_ = gateway.Shutdown()
+	}
+}
+
+func TestValidateRcpts(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	// picky only knows bob, and sees the recipients before the last one
+	var seen []int
+	processors["picky"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskValidateRcpt {
+					seen = append(seen, len(e.RcptTo))
+					if e.RcptTo[len(e.RcptTo)-1].User != "bob" {
+						return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+					}
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	defer delete(processors, "picky")
+
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if errs := gateway.ValidateRcpts(mail.NewEnvelope("127.0.0.1", 1), 1); errs[0] != StorageNotAvailable {
+		t.Error("expected the backend to be unavailable, got", errs)
+	}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":     "HeadersParser",
+		"validate_process": "Picky",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{
+		{User: "alice", Host: "example.com"},
+		{User: "bob", Host: "example.com"},
+		{User: "eve", Host: "example.com"},
+		{User: "bob", Host: "example.org"},
+	}
+	errs := gateway.ValidateRcpts(e, 3)
+	if len(errs) != 3 || errs[0] != nil || errs[1] != NoSuchUser || errs[2] != nil {
+		t.Error("unexpected errors", errs)
+	}
+	if fmt.Sprint(seen) != "[2 3 4]" {
+		t.Error("expected each recipient to be validated as the last one, got", seen)
+	}
+	if len(e.RcptTo) != 4 {
+		t.Error("expected the recipients to be restored, got", e.RcptTo)
+	}
+}
@@ -0,0 +1,206 @@
+package backends
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GreylistRecord is what the greylist processor keeps for a triplet, or for a client
+type GreylistRecord struct {
+	// First is when the triplet was first seen
+	First time.Time
+	// Passed is how many times the triplet, or the triplets of the client, were let through
+	Passed int
+}
+
+// GreylistStore keeps the records of the greylist processor. The stores of a cluster should be shared,
+// so that a client that retries on another node is let through
+type GreylistStore interface {
+	// Get returns the record of the key, ok is false when there's none or it expired
+	Get(key string) (r GreylistRecord, ok bool, err error)
+	// Set saves the record of the key, until ttl from now
+	Set(key string, r GreylistRecord, ttl time.Duration) error
+	Close() error
+}
+
+// GreylistStores are the stores that greylist_store can name. A store is created with the backend
+// config, eg. to read its own options
+var GreylistStores = map[string]func(backendConfig BackendConfig) (GreylistStore, error){
+	"memory": func(BackendConfig) (GreylistStore, error) {
+		return newMemoryGreylistStore(), nil
+	},
+	"redis": func(backendConfig BackendConfig) (GreylistStore, error) {
+		config, err := Svc.ExtractConfig(backendConfig, &RedisProcessorConfig{})
+		if err != nil {
+			return nil, err
+		}
+		return &redisGreylistStore{config: config.(*RedisProcessorConfig)}, nil
+	},
+}
+
+// GreylistCleaner is a GreylistStore that drops its expired records when asked, by the greylist_cleanup
+// maintenance job. Stores whose records expire on their own, like redis, don't need it
+type GreylistCleaner interface {
+	Cleanup() error
+}
+
+// greylistStores are the stores in use, that the greylist_cleanup job cleans
+var greylistStores = struct {
+	sync.Mutex
+	m map[GreylistStore]bool
+}{m: make(map[GreylistStore]bool)}
+
+func init() {
+	RegisterMaintenanceJob("greylist_cleanup", func() error {
+		greylistStores.Lock()
+		defer greylistStores.Unlock()
+		for store := range greylistStores.m {
+			if c, ok := store.(GreylistCleaner); ok {
+				if err := c.Cleanup(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// trackGreylistStore adds the store to the ones the greylist_cleanup job cleans, or removes it
+func trackGreylistStore(store GreylistStore, inUse bool) {
+	greylistStores.Lock()
+	defer greylistStores.Unlock()
+	if inUse {
+		greylistStores.m[store] = true
+	} else {
+		delete(greylistStores.m, store)
+	}
+}
+
+// greylistSweepInterval is how often the expired records are dropped from memory
+const greylistSweepInterval = time.Minute * 10
+
+type memoryGreylistEntry struct {
+	record  GreylistRecord
+	expires time.Time
+}
+
+// memoryGreylistStore keeps the records of a node
+type memoryGreylistStore struct {
+	mu      sync.Mutex
+	records map[string]memoryGreylistEntry
+	swept   time.Time
+}
+
+func newMemoryGreylistStore() *memoryGreylistStore {
+	return &memoryGreylistStore{records: make(map[string]memoryGreylistEntry)}
+}
+
+func (m *memoryGreylistStore) Get(key string) (GreylistRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.records[key]
+	if !ok || !Now().Before(entry.expires) {
+		return GreylistRecord{}, false, nil
+	}
+	return entry.record, true, nil
+}
+
+func (m *memoryGreylistStore) Set(key string, r GreylistRecord, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := Now()
+	if now.Sub(m.swept) >= greylistSweepInterval {
+		m.sweep(now)
+	}
+	m.records[key] = memoryGreylistEntry{record: r, expires: now.Add(ttl)}
+	return nil
+}
+
+// sweep drops the expired records. Called with the lock held
+func (m *memoryGreylistStore) sweep(now time.Time) {
+	m.swept = now
+	for k, entry := range m.records {
+		if !now.Before(entry.expires) {
+			delete(m.records, k)
+		}
+	}
+}
+
+// Cleanup drops the expired records, which are otherwise only dropped as new ones are added
+func (m *memoryGreylistStore) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(Now())
+	return nil
+}
+
+func (m *memoryGreylistStore) Close() error {
+	return nil
+}
+
+// redisGreylistStore keeps the records in redis, with the redis_* options of the redis processor. A record
+// is "<first, unix seconds>:<passed>", and expires with the key
+type redisGreylistStore struct {
+	config *RedisProcessorConfig
+	mu     sync.Mutex
+	conn   RedisConn
+}
+
+// do sends the command, connecting first when needed
+func (r *redisGreylistStore) do(command string, args ...interface{}) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		conn, err := dialRedis(r.config)
+		if err != nil {
+			return nil, err
+		}
+		r.conn = conn
+	}
+	reply, err := r.conn.Do(command, args...)
+	if err != nil && redisConnError(err) {
+		_ = r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+func (r *redisGreylistStore) Get(key string) (GreylistRecord, bool, error) {
+	reply, err := r.do("GET", key)
+	if err != nil || reply == nil {
+		return GreylistRecord{}, false, err
+	}
+	parts := strings.SplitN(redisString(reply), ":", 2)
+	if len(parts) != 2 {
+		return GreylistRecord{}, false, fmt.Errorf("greylist: invalid record %q of %s", redisString(reply), key)
+	}
+	first, err1 := strconv.ParseInt(parts[0], 10, 64)
+	passed, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return GreylistRecord{}, false, fmt.Errorf("greylist: invalid record %q of %s", redisString(reply), key)
+	}
+	return GreylistRecord{First: time.Unix(first, 0), Passed: passed}, true, nil
+}
+
+func (r *redisGreylistStore) Set(key string, record GreylistRecord, ttl time.Duration) error {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	_, err := r.do("SET", key, fmt.Sprintf("%d:%d", record.First.Unix(), record.Passed), "EX", seconds)
+	return err
+}
+
+func (r *redisGreylistStore) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
@@ -0,0 +1,161 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestGreylistValidate(t *testing.T) {
+	c := NewManualClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(c))
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":             "Debugger",
+		"validate_process":         "Greylist",
+		"greylist_whitelist_after": 2,
+		"greylist_exempt":          []interface{}{"192.0.2.0/24"},
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	envelope := func(ip, rcpt string) *mail.Envelope {
+		e := mail.NewEnvelope(ip, 1)
+		e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+		e.RcptTo = []mail.Address{{User: rcpt, Host: "acme.com"}}
+		return e
+	}
+	for _, step := range []struct {
+		advance time.Duration
+		ip      string
+		rcpt    string
+		want    error
+		verify  bool
+	}{
+		// the probes of VRFY pass, and don't start the delay
+		{0, "198.51.100.1", "bob", nil, true},
+		{time.Minute * 5, "198.51.100.1", "bob", nil, true},
+		{0, "198.51.100.1", "bob", Greylisted, false},
+		// too early
+		{time.Minute, "198.51.100.1", "bob", Greylisted, false},
+		// another server of the pool
+		{time.Minute * 5, "198.51.100.2", "bob", nil, false},
+		{0, "198.51.100.1", "Bob", nil, false},
+		// the client has passed twice, its next triplets aren't greylisted
+		{0, "198.51.100.1", "eve", nil, false},
+		{0, "203.0.113.1", "bob", Greylisted, false},
+		{0, "192.0.2.1", "bob", nil, false},
+		// an attempt after the retry window is a new one
+		{time.Hour * 49, "203.0.113.1", "bob", Greylisted, false},
+	} {
+		c.Advance(step.advance)
+		e := envelope(step.ip, step.rcpt)
+		if step.verify {
+			VerifyOnly(e)
+		}
+		if err := backend.ValidateRcpt(e); err != step.want {
+			t.Errorf("expected %v for %s from %s, got %v", step.want, step.rcpt, step.ip, err)
+		}
+	}
+}
+
+func TestGreylistSave(t *testing.T) {
+	c := NewManualClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(c))
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":   "Greylist|Debugger",
+		"greylist_delay": "1m",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "451 4.7.1") {
+		t.Fatal("expected the mail to be greylisted, got", result)
+	}
+	if strings.Join(e.Tags.Values("greylist"), ",") != "deferred" {
+		t.Error("expected the greylist tag, got", e.Tags)
+	}
+	// the client that logged in isn't greylisted
+	e = newBrokerTestEnvelope()
+	e.RcptTo[0].User = "alice"
+	e.AuthorizedLogin = "test"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the mail to be accepted, got", result)
+	}
+	c.Advance(time.Minute)
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the retry to be accepted, got", result)
+	}
+}
+
+// greylistTestConn is a redis with GET and SET
+type greylistTestConn struct {
+	values map[string]string
+	ttls   map[string]int64
+	fail   bool
+}
+
+func (c *greylistTestConn) Close() error {
+	return nil
+}
+
+func (c *greylistTestConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if c.fail {
+		return nil, errors.New("ERR unavailable")
+	}
+	switch commandName {
+	case "GET":
+		if v, ok := c.values[args[0].(string)]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "SET":
+		c.values[args[0].(string)] = args[1].(string)
+		c.ttls[args[0].(string)] = args[3].(int64)
+		return "OK", nil
+	}
+	return nil, errors.New("ERR unknown command")
+}
+
+func TestGreylistRedis(t *testing.T) {
+	c := NewManualClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(c))
+	conn := &greylistTestConn{values: make(map[string]string), ttls: make(map[string]int64)}
+	saved := RedisDialer
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		return conn, nil
+	}
+	defer func() {
+		RedisDialer = saved
+	}()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":    "Greylist|Debugger",
+		"greylist_store":  "redis",
+		"redis_interface": "127.0.0.1:6379",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "451") {
+		t.Fatal("expected the mail to be greylisted, got", result)
+	}
+	if v := conn.values["greylist:127.0.0.0/test@example.com/bob@acme.com"]; v != "1614600000:0" ||
+		conn.ttls["greylist:127.0.0.0/test@example.com/bob@acme.com"] != 48*3600 {
+		t.Error("unexpected record", conn.values)
+	}
+	c.Advance(time.Minute * 5)
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the retry to be accepted, got", result)
+	}
+	// the mail isn't held up when redis fails
+	conn.fail = true
+	e = newBrokerTestEnvelope()
+	e.RemoteIP = "198.51.100.1"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the mail to be accepted, got", result)
+	}
+}
@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends/processorpb"
+	"github.com/artpar/go-guerrilla/mail"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcMaxMessage is the largest reply accepted from the service
+const grpcMaxMessage = 4 << 20
+
+// grpcReply returns the reply of the service as an SMTP reply
+func grpcReply(r *processorpb.Reply) string {
+	return fmt.Sprintf("%d %s", r.GetCode(), r.GetMessage())
+}
+
+// grpcClient calls the Processor service of processor.proto over a connection that is kept open
+// between calls, and made again when it's lost
+type grpcClient struct {
+	conn    *grpc.ClientConn
+	client  processorpb.ProcessorClient
+	timeout time.Duration
+}
+
+// newGRPCClient returns a client of the service at address, a unix socket when it starts with
+// "unix:" or a "/", otherwise host:port. The connection is encrypted when tlsConfig is not nil.
+// Each call must end within the timeout
+func newGRPCClient(address string, tlsConfig *tls.Config, timeout time.Duration) (*grpcClient, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	if strings.HasPrefix(address, "/") {
+		address = "unix://" + address
+	}
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(grpcMaxMessage)))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{conn: conn, client: processorpb.NewProcessorClient(conn), timeout: timeout}, nil
+}
+
+// grpcEnvelope returns the Envelope message of the email
+func grpcEnvelope(e *mail.Envelope) *processorpb.Envelope {
+	env := &processorpb.Envelope{
+		QueuedId: e.QueuedId,
+		RemoteIp: e.RemoteIP,
+		Helo:     e.Helo,
+		Tls:      e.TLS,
+		Tenant:   e.Tenant,
+		Subject:  e.Subject,
+		Size:     uint64(len(e.DeliveryHeader) + e.Data.Len()),
+	}
+	if !e.MailFrom.IsEmpty() {
+		env.MailFrom = e.MailFrom.String()
+	}
+	for i := range e.RcptTo {
+		env.RcptTo = append(env.RcptTo, e.RcptTo[i].String())
+	}
+	return env
+}
+
+// validateRcpt calls ValidateRcpt for the last recipient of the envelope
+func (c *grpcClient) validateRcpt(e *mail.Envelope) (*processorpb.Reply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.client.ValidateRcpt(ctx, &processorpb.ValidateRcptRequest{
+		Envelope: grpcEnvelope(e),
+		Rcpt:     e.RcptTo[len(e.RcptTo)-1].String(),
+	})
+}
+
+// saveMail calls SaveMail with the envelope, then the message in chunks of chunkSize bytes.
+// The requests are sent by the caller, so the envelope isn't used once it returns
+func (c *grpcClient) saveMail(e *mail.Envelope, chunkSize int) (*processorpb.Reply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	stream, err := c.client.SaveMail(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&processorpb.SaveMailRequest{
+		Part: &processorpb.SaveMailRequest_Envelope{Envelope: grpcEnvelope(e)},
+	})
+	r := e.NewReader()
+	buf := make([]byte, chunkSize)
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			// the request is encoded by Send, so buf can be reused
+			chunk := &processorpb.SaveMailRequest{Part: &processorpb.SaveMailRequest_Chunk{Chunk: buf[:n]}}
+			if sendErr := stream.Send(chunk); sendErr != nil {
+				err = sendErr
+			}
+		}
+	}
+	// Send returns io.EOF when the service replied before it read all of the message
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+// close closes the connection
+func (c *grpcClient) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,205 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// The criticality of a processor decides what happens when its health check keeps failing,
+// see GatewayConfig.Criticality
+const (
+	// CriticalityRequired processors are always called, the mail fails while they do
+	CriticalityRequired = "required"
+	// CriticalityPreferred processors are bypassed while unhealthy, and the emails that skipped them
+	// are tagged "degraded:<processor>"
+	CriticalityPreferred = "preferred"
+	// CriticalityOptional processors are bypassed while unhealthy
+	CriticalityOptional = "optional"
+)
+
+const (
+	// defaultHealthCheckInterval is used when health_check_interval is not set
+	defaultHealthCheckInterval = time.Second * 30
+	// defaultHealthCheckFailures is used when health_check_failures is not set
+	defaultHealthCheckFailures = 3
+)
+
+// HealthCheckWith checks the service that a processor depends on, eg. by pinging it.
+// It's added with Svc.AddHealthCheck when the processor is constructed
+type HealthCheckWith func() error
+
+// HealthAlert is called when a processor becomes unhealthy, with the error of its last check, and
+// when it's healthy again, with a nil error. Set it to send the alerts somewhere, they are logged
+var HealthAlert func(processor, criticality string, bypassed bool, err error)
+
+// AddHealthCheck adds the health check of the processor being constructed
+func (s *service) AddHealthCheck(check HealthCheckWith) {
+	s.Lock()
+	defer s.Unlock()
+	s.healthChecks = append(s.healthChecks, check)
+}
+
+// takeHealthChecks returns the health checks added since it was last called, ie. the ones of the
+// processor that was constructed
+func (s *service) takeHealthChecks() []HealthCheckWith {
+	s.Lock()
+	defer s.Unlock()
+	checks := s.healthChecks
+	s.healthChecks = nil
+	return checks
+}
+
+// parseCriticality parses the "processor=criticality" entries of GatewayConfig.Criticality
+func parseCriticality(entries []string) (map[string]string, error) {
+	m := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) != 2 || name == "" {
+			return nil, fmt.Errorf("processor criticality %q should be processor=criticality", entry)
+		}
+		switch c := strings.ToLower(strings.TrimSpace(kv[1])); c {
+		case CriticalityRequired, CriticalityPreferred, CriticalityOptional:
+			m[name] = c
+		default:
+			return nil, fmt.Errorf("unknown criticality %q of %s, expected required, preferred or optional",
+				kv[1], name)
+		}
+	}
+	return m, nil
+}
+
+// processorHealth is the health of a processor, shared by the workers
+type processorHealth struct {
+	name        string
+	criticality string
+	// check is the health check of the first worker's processor, the others check the same service
+	check     HealthCheckWith
+	failures  int
+	unhealthy bool
+	// bypassed is 1 while the processor is skipped
+	bypassed int32
+}
+
+func (h *processorHealth) isBypassed() bool {
+	return atomic.LoadInt32(&h.bypassed) == 1
+}
+
+// degradable wraps a decorator so that its processor is skipped while it's bypassed
+func degradable(h *processorHealth, d Decorator) Decorator {
+	return func(next Processor) Processor {
+		p := d(next)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if !h.isBypassed() {
+				return p.Process(e, task)
+			}
+			if h.criticality == CriticalityPreferred && task == TaskSaveMail {
+				e.Tags.Add("degraded", h.name)
+			}
+			return next.Process(e, task)
+		})
+	}
+}
+
+// healthMonitor checks the processors that have a health check
+type healthMonitor struct {
+	interval time.Duration
+	failures int
+	mu       sync.Mutex
+	health   map[string]*processorHealth
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// processor returns the health of the named processor, creating it the first time
+func (m *healthMonitor) processor(name, criticality string) *processorHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.health[name]; ok {
+		return h
+	}
+	h := &processorHealth{name: name, criticality: criticality}
+	m.health[name] = h
+	return h
+}
+
+// check runs the health checks once. A processor is unhealthy after failing the given number of
+// checks in a row, and healthy again after passing one
+func (m *healthMonitor) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, h := range m.health {
+		if h.check == nil {
+			continue
+		}
+		err := h.check()
+		switch {
+		case err != nil:
+			h.failures++
+			if h.unhealthy || h.failures < m.failures {
+				continue
+			}
+			h.unhealthy = true
+			if h.criticality != CriticalityRequired {
+				atomic.StoreInt32(&h.bypassed, 1)
+			}
+			m.alert(h, err)
+		case h.unhealthy:
+			h.failures = 0
+			h.unhealthy = false
+			atomic.StoreInt32(&h.bypassed, 0)
+			m.alert(h, nil)
+		default:
+			h.failures = 0
+		}
+	}
+}
+
+func (m *healthMonitor) alert(h *processorHealth, err error) {
+	if err != nil {
+		l := Log().WithError(err)
+		if h.isBypassed() {
+			l.Errorf("processor %s failed %d health checks, it's bypassed until it's healthy", h.name, h.failures)
+		} else {
+			l.Errorf("processor %s failed %d health checks, the mail fails while it's %s", h.name, h.failures,
+				h.criticality)
+		}
+	} else {
+		Log().Infof("processor %s is healthy again", h.name)
+	}
+	if HealthAlert != nil {
+		HealthAlert(h.name, h.criticality, h.isBypassed(), err)
+	}
+}
+
+// start checks the processors every interval, until stopped
+func (m *healthMonitor) start() {
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.check()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *healthMonitor) shutdown() {
+	if m.stop != nil {
+		close(m.stop)
+		m.wg.Wait()
+		m.stop = nil
+	}
+}
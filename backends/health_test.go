@@ -0,0 +1,146 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// healthTestService is the service of the healthtest processor, down while err is set
+type healthTestService struct {
+	sync.Mutex
+	err error
+}
+
+func (s *healthTestService) set(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.err = err
+}
+
+func (s *healthTestService) get() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+type healthTestAlert struct {
+	processor, criticality string
+	bypassed               bool
+	err                    error
+}
+
+func TestProcessorHealth(t *testing.T) {
+	service := &healthTestService{}
+	processors["healthtest"] = func() Decorator {
+		Svc.AddHealthCheck(service.get)
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if err := service.get(); err != nil {
+					return NewResult("451 4.3.0 Error: the service is down"), StorageError
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	var alerts []healthTestAlert
+	HealthAlert = func(processor, criticality string, bypassed bool, err error) {
+		alerts = append(alerts, healthTestAlert{processor, criticality, bypassed, err})
+	}
+	defer func() {
+		delete(processors, "healthtest")
+		HealthAlert = nil
+	}()
+
+	for _, c := range []struct {
+		chain       string
+		criticality []interface{}
+		want        string
+		degraded    bool
+	}{
+		{"HealthTest|Debugger", nil, CriticalityRequired, false},
+		{"HealthTest|Debugger", []interface{}{"healthtest=preferred"}, CriticalityPreferred, true},
+		{"HealthTest?|Debugger", nil, CriticalityOptional, false},
+	} {
+		service.set(nil)
+		alerts = nil
+		backend := newBrokerTestBackend(t, BackendConfig{
+			"save_process":          c.chain,
+			"processor_criticality": c.criticality,
+			"health_check_failures": 2,
+			"health_check_interval": "1h",
+		})
+		monitor := backend.(*BackendGateway).monitor
+		process := func() (string, *mail.Envelope) {
+			e := newBrokerTestEnvelope()
+			return backend.Process(e).String(), e
+		}
+
+		service.set(errors.New("connection refused"))
+		monitor.check()
+		if result, _ := process(); !strings.HasPrefix(result, "451") || len(alerts) != 0 {
+			t.Error(c.want, "expected the mail to fail before the processor is unhealthy, got", result, alerts)
+		}
+		monitor.check()
+		monitor.check()
+		if len(alerts) != 1 || alerts[0].processor != "healthtest" || alerts[0].criticality != c.want ||
+			alerts[0].bypassed != (c.want != CriticalityRequired) || alerts[0].err == nil {
+			t.Error(c.want, "expected an alert, got", alerts)
+		}
+		result, e := process()
+		if c.want == CriticalityRequired && !strings.HasPrefix(result, "451") {
+			t.Error("expected the required processor to be called, got", result)
+		} else if c.want != CriticalityRequired && !strings.HasPrefix(result, "250") {
+			t.Error(c.want, "expected the processor to be bypassed, got", result)
+		}
+		if e.Tags.Has("degraded") != c.degraded {
+			t.Error(c.want, "unexpected tags", e.Tags)
+		}
+
+		service.set(nil)
+		monitor.check()
+		if len(alerts) != 2 || alerts[1].err != nil || alerts[1].bypassed {
+			t.Error(c.want, "expected the processor to be healthy again, got", alerts)
+		}
+		if result, e := process(); !strings.HasPrefix(result, "250") || e.Tags.Has("degraded") {
+			t.Error(c.want, "expected the processor to be called again, got", result, e.Tags)
+		}
+		_ = backend.Shutdown()
+	}
+
+	for _, bad := range [][]string{{"spamcheck"}, {"spamcheck=sometimes"}, {"=optional"}} {
+		if _, err := parseCriticality(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
+
+func TestScannerHealthChecks(t *testing.T) {
+	clamd := clamdTestServer(t)
+	spamd := spamdTestServer(t, 1)
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":          "ClamAV|SpamCheck|Debugger",
+		"clamav_address":        clamd.Addr().String(),
+		"spamcheck_url":         "spamd://" + spamd.Addr().String(),
+		"health_check_interval": "1h",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	monitor := backend.(*BackendGateway).monitor
+	for _, name := range []string{"clamav", "spamcheck"} {
+		if err := monitor.health[name].check(); err != nil {
+			t.Error("expected", name, "to be healthy, got", err)
+		}
+	}
+	_ = clamd.Close()
+	_ = spamd.Close()
+	for _, name := range []string{"clamav", "spamcheck"} {
+		if err := monitor.health[name].check(); err == nil {
+			t.Error("expected", name, "to be unhealthy")
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// kafkaWriter publishes to a topic, it's a *kafka.Writer
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newKafkaWriter returns the writer of a topic, it's replaced by the tests
+var newKafkaWriter = func(config kafka.WriterConfig) kafkaWriter {
+	return kafka.NewWriter(config)
+}
+
+// kafkaProducer has a writer for each topic, shared by the workers. The writers batch the
+// messages of the workers, and retry the messages that a broker did not take
+type kafkaProducer struct {
+	config  *KafkaProcessorConfig
+	dialer  *kafka.Dialer
+	writers map[string]kafkaWriter
+	// journal is opened by the first processor when kafka_journal is set
+	journal *kafkaJournal
+	// how many processors use the producer
+	users int
+	sync.Mutex
+}
+
+var (
+	kafkaProducersGuard sync.Mutex
+	// the producers of the processors, by their config
+	kafkaProducers = make(map[string]*kafkaProducer)
+)
+
+// useKafkaProducer returns the producer for the config, creating it if it's not used already
+func useKafkaProducer(config *KafkaProcessorConfig) *kafkaProducer {
+	key := fmt.Sprintf("%+v", *config)
+	kafkaProducersGuard.Lock()
+	defer kafkaProducersGuard.Unlock()
+	if kp, ok := kafkaProducers[key]; ok {
+		kp.users++
+		return kp
+	}
+	kp := &kafkaProducer{
+		config:  config,
+		dialer:  &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true},
+		writers: make(map[string]kafkaWriter),
+		users:   1,
+	}
+	if config.TLS {
+		kp.dialer.TLS = &tls.Config{}
+	}
+	if config.Username != "" {
+		kp.dialer.SASLMechanism = plain.Mechanism{Username: config.Username, Password: config.Password}
+	}
+	kafkaProducers[key] = kp
+	return kp
+}
+
+// release closes the writers when the last processor that used the producer is shut down.
+// Closing waits for the batches that are being sent
+func (kp *kafkaProducer) release() error {
+	kafkaProducersGuard.Lock()
+	kp.users--
+	last := kp.users == 0
+	if last {
+		for key, v := range kafkaProducers {
+			if v == kp {
+				delete(kafkaProducers, key)
+			}
+		}
+	}
+	kafkaProducersGuard.Unlock()
+	if !last {
+		return nil
+	}
+	kp.Lock()
+	defer kp.Unlock()
+	var err error
+	for topic, w := range kp.writers {
+		if closeErr := w.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(kp.writers, topic)
+	}
+	if kp.journal != nil {
+		if closeErr := kp.journal.close(); closeErr != nil {
+			err = closeErr
+		}
+		kp.journal = nil
+	}
+	return err
+}
+
+// openJournal opens the kafka_journal of the config, once for all the processors of the producer
+func (kp *kafkaProducer) openJournal() (*kafkaJournal, error) {
+	kp.Lock()
+	defer kp.Unlock()
+	if kp.journal != nil || kp.config.Journal == "" {
+		return kp.journal, nil
+	}
+	retention := defaultKafkaJournalRetention
+	if kp.config.JournalRetention != "" {
+		d, err := time.ParseDuration(kp.config.JournalRetention)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid kafka_journal_retention %q", kp.config.JournalRetention)
+		}
+		retention = d
+	}
+	j, err := openKafkaJournal(kp.config.Journal, retention)
+	if err != nil {
+		return nil, fmt.Errorf("could not open kafka_journal: %s", err)
+	}
+	kp.journal = j
+	return j, nil
+}
+
+// writer returns the writer of the topic, creating it the first time
+func (kp *kafkaProducer) writer(topic string) kafkaWriter {
+	kp.Lock()
+	defer kp.Unlock()
+	if w, ok := kp.writers[topic]; ok {
+		return w
+	}
+	w := newKafkaWriter(kafka.WriterConfig{
+		Brokers: kp.config.brokers(),
+		Topic:   topic,
+		Dialer:  kp.dialer,
+		// messages with the same key, the recipient domain, go to the same partition
+		Balancer:      &kafka.Hash{},
+		MaxAttempts:   kp.config.MaxAttempts,
+		QueueCapacity: kp.config.QueueSize,
+		BatchSize:     kp.config.BatchSize,
+		BatchBytes:    kp.config.MaxMessageBytes,
+		BatchTimeout:  time.Millisecond * 10,
+		RequiredAcks:  kp.config.acks(),
+	})
+	kp.writers[topic] = w
+	return w
+}
+
+// publish writes the message, and waits until the brokers acknowledged it, or the timeout
+func (kp *kafkaProducer) publish(topic string, msg kafka.Message, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return kp.writer(topic).WriteMessages(ctx, msg)
+}
+
+// kafkaKey is the lower case domain of the first recipient, so that the mail for a domain
+// is kept in order on a partition
+func kafkaKey(e *mail.Envelope) []byte {
+	if len(e.RcptTo) == 0 {
+		return nil
+	}
+	return []byte(rcptDomain(e))
+}
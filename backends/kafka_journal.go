@@ -0,0 +1,201 @@
+package backends
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// kafkaJournalCompactAfter is how many lines the journal may have before it's rewritten without the
+// expired ones, when most of them expired
+const kafkaJournalCompactAfter = 1000
+
+// kafkaJournal remembers the messages that the brokers acknowledged, by their content, so that a
+// message that the client sends again because it didn't get the reply isn't published twice. Each
+// line of the file is "<unix seconds> <id>", appended and synced before the client gets its reply
+type kafkaJournal struct {
+	path      string
+	retention time.Duration
+	mu        sync.Mutex
+	f         *os.File
+	lines     int
+	done      map[string]time.Time
+	// the messages being published, a message sent again meanwhile waits for the outcome
+	pending map[string]chan struct{}
+}
+
+// openKafkaJournal loads the journal, dropping the ids older than the retention
+func openKafkaJournal(path string, retention time.Duration) (*kafkaJournal, error) {
+	j := &kafkaJournal{
+		path:      filepath.Clean(path),
+		retention: retention,
+		done:      make(map[string]time.Time),
+		pending:   make(map[string]chan struct{}),
+	}
+	f, err := os.Open(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = j.load(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *kafkaJournal) load(r io.Reader) error {
+	now := Now()
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || len(fields) != 2 {
+			// a line that was cut short when the server stopped
+			Log().Warnf("kafka journal %s:%d: skipped an invalid line", j.path, line)
+			continue
+		}
+		if t := time.Unix(sec, 0); now.Sub(t) < j.retention {
+			j.done[fields[1]] = t
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with the ids that haven't expired, and opens it for appending
+func (j *kafkaJournal) compact() error {
+	now := Now()
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	lines := 0
+	for id, t := range j.done {
+		if now.Sub(t) >= j.retention {
+			delete(j.done, id)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%d %s\n", t.Unix(), id)
+		lines++
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if j.f != nil {
+		_ = j.f.Close()
+	}
+	if j.f, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return err
+	}
+	j.lines = lines
+	return nil
+}
+
+// begin returns true when the message was published already. Otherwise, the caller publishes it and
+// calls finish, and the same message waits for it meanwhile
+func (j *kafkaJournal) begin(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for {
+		if t, ok := j.done[id]; ok && Now().Sub(t) < j.retention {
+			return true
+		}
+		wait, ok := j.pending[id]
+		if !ok {
+			break
+		}
+		j.mu.Unlock()
+		<-wait
+		j.mu.Lock()
+	}
+	j.pending[id] = make(chan struct{})
+	return false
+}
+
+// finish records the message when it was published, before letting the same message through
+func (j *kafkaJournal) finish(id string, published bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer func() {
+		close(j.pending[id])
+		delete(j.pending, id)
+	}()
+	if !published {
+		return nil
+	}
+	now := Now()
+	j.done[id] = now
+	if j.lines >= kafkaJournalCompactAfter && j.lines > len(j.done)*2 {
+		return j.compact()
+	}
+	if _, err := fmt.Fprintf(j.f, "%d %s\n", now.Unix(), id); err != nil {
+		return err
+	}
+	j.lines++
+	return j.f.Sync()
+}
+
+func (j *kafkaJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// kafkaMessageID identifies the message by the tenant, the envelope, the Message-ID and the data, which
+// are the same when the client sends it again. A message without a Message-ID, or without the headers
+// parsed, is identified by its queued id instead, so that two copies that the sender meant to send
+// aren't taken for one. The hashes of the hasher can't be used, they differ each time
+func kafkaMessageID(e *mail.Envelope) string {
+	var messageID string
+	if e.Header != nil {
+		messageID = strings.TrimSpace(e.Header.Get("Message-Id"))
+	}
+	if messageID == "" {
+		messageID = "queued " + e.QueuedId
+	}
+	h := sha256.New()
+	_, _ = io.WriteString(h, e.Tenant+"\n"+e.MailFrom.String()+"\n")
+	for i := range e.RcptTo {
+		_, _ = io.WriteString(h, e.RcptTo[i].String()+"\n")
+	}
+	_, _ = io.WriteString(h, messageID+"\n")
+	_, _ = h.Write(e.Data.Bytes())
+	return hex.EncodeToString(h.Sum(nil))
+}
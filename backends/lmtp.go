@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// lmtpReply is the reply of the LMTP server for a recipient
+type lmtpReply struct {
+	Code    int
+	Message string
+}
+
+func (r lmtpReply) String() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
+}
+
+// lmtpClient is a session with a local delivery agent, RFC 2033
+type lmtpClient struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// socketAddress returns the network and address to dial for addr, a unix socket when it
+// starts with "unix:" or a "/", otherwise host:port
+func socketAddress(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	} else if strings.HasPrefix(addr, "/") {
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// dialLMTP connects to addr, see socketAddress, and says LHLO as helo. The deadline is for
+// the whole session
+var dialLMTP = func(addr, helo string, timeout time.Duration) (*lmtpClient, error) {
+	network, addr := socketAddress(addr)
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c := &lmtpClient{conn: conn, text: textproto.NewConn(conn)}
+	if _, err := c.expect(220); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if _, err := c.cmd(250, "LHLO %s", helo); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// reply reads a reply
+func (c *lmtpClient) reply() (lmtpReply, error) {
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		return lmtpReply{}, err
+	}
+	return lmtpReply{Code: code, Message: strings.Replace(msg, "\n", " ", -1)}, nil
+}
+
+// expect reads a reply, an error is returned unless it has the code
+func (c *lmtpClient) expect(code int) (lmtpReply, error) {
+	r, err := c.reply()
+	if err == nil && r.Code != code {
+		err = &textproto.Error{Code: r.Code, Msg: r.Message}
+	}
+	return r, err
+}
+
+func (c *lmtpClient) cmd(code int, format string, args ...interface{}) (lmtpReply, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return lmtpReply{}, err
+	}
+	return c.expect(code)
+}
+
+// mail starts the transaction
+func (c *lmtpClient) mail(from string) error {
+	_, err := c.cmd(250, "MAIL FROM:<%s>", from)
+	return err
+}
+
+// rcpt returns the reply to RCPT TO, the error is only for a broken session
+func (c *lmtpClient) rcpt(to string) (lmtpReply, error) {
+	if err := c.text.PrintfLine("RCPT TO:<%s>", to); err != nil {
+		return lmtpReply{}, err
+	}
+	return c.reply()
+}
+
+// data sends the message, and returns a reply for each of the n accepted recipients
+func (c *lmtpClient) data(r io.Reader, n int) ([]lmtpReply, error) {
+	if _, err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	w := c.text.DotWriter()
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	replies := make([]lmtpReply, 0, n)
+	for i := 0; i < n; i++ {
+		reply, err := c.reply()
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// Close says QUIT and closes the connection
+func (c *lmtpClient) Close() error {
+	_ = c.text.PrintfLine("QUIT")
+	return c.conn.Close()
+}
+
+// lmtpDeliver delivers the envelope, and returns the reply for each recipient, in the order
+// of e.RcptTo. The error is for a session that failed before the replies of all the recipients
+func lmtpDeliver(c *lmtpClient, e *mail.Envelope) ([]lmtpReply, error) {
+	if err := c.mail(e.MailFrom.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]lmtpReply, len(e.RcptTo))
+	var accepted []int
+	for i := range e.RcptTo {
+		reply, err := c.rcpt(e.RcptTo[i].String())
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+		if reply.Code/100 == 2 {
+			accepted = append(accepted, i)
+		}
+	}
+	if len(accepted) == 0 {
+		return replies, nil
+	}
+	dataReplies, err := c.data(e.NewReader(), len(accepted))
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range accepted {
+		replies[i] = dataReplies[j]
+	}
+	return replies, nil
+}
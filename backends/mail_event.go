@@ -0,0 +1,81 @@
+package backends
+
+import (
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// mailEvent is an email published to a message broker, eg. by the kafka and rabbitmq processors
+type mailEvent struct {
+	QueuedId   string              `json:"queued_id"`
+	Hash       string              `json:"hash,omitempty"`
+	Tenant     string              `json:"tenant,omitempty"`
+	From       string              `json:"from"`
+	To         []string            `json:"to"`
+	RemoteIP   string              `json:"remote_ip"`
+	Helo       string              `json:"helo"`
+	TLS        bool                `json:"tls"`
+	Subject    string              `json:"subject"`
+	MessageId  string              `json:"message_id,omitempty"`
+	Headers    map[string][]string `json:"headers"`
+	Tags       []string            `json:"tags,omitempty"`
+	Size       int                 `json:"size"`
+	ReceivedAt time.Time           `json:"received_at"`
+	// Data is the message, when the config of the processor asks for it
+	Data string `json:"data,omitempty"`
+}
+
+// newMailEvent returns the event of the envelope, with the message when withData is true.
+// With Anonymization, the addresses are hashed and the message is left out
+func newMailEvent(e *mail.Envelope, withData bool) mailEvent {
+	doc := mailEvent{
+		QueuedId:   e.QueuedId,
+		Tenant:     e.Tenant,
+		From:       e.MailFrom.String(),
+		To:         make([]string, 0, len(e.RcptTo)),
+		RemoteIP:   e.RemoteIP,
+		Helo:       e.Helo,
+		TLS:        e.TLS,
+		Subject:    e.Subject,
+		Headers:    map[string][]string(e.Header),
+		Size:       e.Data.Len(),
+		ReceivedAt: time.Now(),
+	}
+	if len(e.Hashes) > 0 {
+		doc.Hash = e.Hashes[0]
+	}
+	for i := range e.RcptTo {
+		doc.To = append(doc.To, e.RcptTo[i].String())
+	}
+	if doc.Headers == nil {
+		doc.Headers = make(map[string][]string)
+	}
+	doc.MessageId = strings.Trim(e.Header.Get("Message-Id"), "<>")
+	if len(e.Tags) > 0 {
+		doc.Tags = e.Tags.Strings()
+	}
+	if a := Anonymization; a != nil {
+		doc.From = a.Address(doc.From)
+		for i := range doc.To {
+			doc.To[i] = a.Address(doc.To[i])
+		}
+		doc.Subject = a.Text(doc.Subject)
+		doc.MessageId = a.Text(doc.MessageId)
+		doc.Headers = a.Header(doc.Headers)
+		return doc
+	}
+	if withData {
+		doc.Data = strings.ToValidUTF8(e.String(), "�")
+	}
+	return doc
+}
+
+// rcptDomain returns the lower case domain of the first recipient
+func rcptDomain(e *mail.Envelope) string {
+	if len(e.RcptTo) == 0 {
+		return ""
+	}
+	return strings.ToLower(e.RcptTo[0].Host)
+}
@@ -0,0 +1,253 @@
+package backends
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// MaildirQuota is the Maildir++ quota of a maildir, kept in its maildirsize file like Courier
+// and Dovecot do, so that they agree on the usage. The maildir processor checks the quota with
+// CheckMaildirQuota before saving a message, and records the message with Add after
+type MaildirQuota struct {
+	// Dir is the maildir, with the cur, new and tmp directories
+	Dir string
+	// Bytes and Count are the limits, 0 is no limit
+	Bytes, Count int64
+	// UsedBytes and UsedCount are the usage when the quota was read
+	UsedBytes, UsedCount int64
+	// the size of the maildirsize file and when it was modified
+	size    int64
+	modTime time.Time
+}
+
+const (
+	maildirSizeFile = "maildirsize"
+	// the usage is recalculated when the maildirsize file grows larger than this
+	maildirSizeMax = 5120
+	// an over quota maildir is recalculated if its maildirsize file is older than this,
+	// in case messages were deleted without updating it
+	maildirSizeMaxAge = time.Minute * 15
+)
+
+// parseMaildirQuota parses a quota definition, eg. "1000000S,1000C"
+func parseMaildirQuota(def string) (bytes, count int64, err error) {
+	for _, f := range strings.Split(strings.TrimSpace(def), ",") {
+		if f == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(f[:len(f)-1], 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid maildir quota %q", def)
+		}
+		switch f[len(f)-1] {
+		case 'S':
+			bytes = n
+		case 'C':
+			count = n
+		default:
+			return 0, 0, fmt.Errorf("invalid maildir quota %q", def)
+		}
+	}
+	return bytes, count, nil
+}
+
+// definition returns the first line of the maildirsize file
+func (q *MaildirQuota) definition() string {
+	var def []string
+	if q.Bytes > 0 {
+		def = append(def, strconv.FormatInt(q.Bytes, 10)+"S")
+	}
+	if q.Count > 0 {
+		def = append(def, strconv.FormatInt(q.Count, 10)+"C")
+	}
+	return strings.Join(def, ",")
+}
+
+// ReadMaildirQuota reads the quota of the maildir at dir. It returns nil when the maildir has
+// no maildirsize file, so no quota
+func ReadMaildirQuota(dir string) (*MaildirQuota, error) {
+	f, err := os.Open(filepath.Join(dir, maildirSizeFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	q := &MaildirQuota{Dir: dir}
+	if fi, err := f.Stat(); err == nil {
+		q.size, q.modTime = fi.Size(), fi.ModTime()
+	}
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return nil, errors.New("empty maildirsize file in " + dir)
+	}
+	if q.Bytes, q.Count, err = parseMaildirQuota(s.Text()); err != nil {
+		return nil, err
+	}
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			// a line being written by another process
+			continue
+		}
+		bytes, err1 := strconv.ParseInt(fields[0], 10, 64)
+		count, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		q.UsedBytes += bytes
+		q.UsedCount += count
+	}
+	if q.size > maildirSizeMax || q.UsedBytes < 0 || q.UsedCount < 0 {
+		if err := q.Recalculate(); err != nil {
+			return nil, err
+		}
+	}
+	return q, s.Err()
+}
+
+// SetMaildirQuota sets the quota of the maildir at dir, and calculates its usage
+func SetMaildirQuota(dir string, bytes, count int64) (*MaildirQuota, error) {
+	q := &MaildirQuota{Dir: dir, Bytes: bytes, Count: count}
+	return q, q.Recalculate()
+}
+
+// Fits returns false if a message of size bytes would go over the quota
+func (q *MaildirQuota) Fits(size int64) bool {
+	if q.Bytes > 0 && q.UsedBytes+size > q.Bytes {
+		return false
+	}
+	if q.Count > 0 && q.UsedCount+1 > q.Count {
+		return false
+	}
+	return true
+}
+
+// Add records that count messages of size bytes were saved in the maildir, or removed
+// when they are negative
+func (q *MaildirQuota) Add(size, count int64) error {
+	f, err := os.OpenFile(filepath.Join(q.Dir, maildirSizeFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	// a single write, so that the lines of other processes don't get mixed up with it
+	n, err := f.WriteString(fmt.Sprintf("%d %d\n", size, count))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	q.UsedBytes += size
+	q.UsedCount += count
+	q.size += int64(n)
+	return nil
+}
+
+// Recalculate counts the messages of the maildir and its folders, and replaces the
+// maildirsize file with the usage
+func (q *MaildirQuota) Recalculate() error {
+	var bytes, count int64
+	folders := []string{q.Dir}
+	entries, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		// Maildir++ folders are the directories starting with a dot
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), ".") && fi.Name() != "." && fi.Name() != ".." {
+			folders = append(folders, filepath.Join(q.Dir, fi.Name()))
+		}
+	}
+	for _, folder := range folders {
+		for _, sub := range []string{"new", "cur"} {
+			messages, err := ioutil.ReadDir(filepath.Join(folder, sub))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			for _, m := range messages {
+				if m.IsDir() {
+					continue
+				}
+				bytes += maildirMessageSize(m)
+				count++
+			}
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(q.Dir, "tmp"), maildirSizeFile)
+	if os.IsNotExist(err) {
+		tmp, err = ioutil.TempFile(q.Dir, "."+maildirSizeFile)
+	}
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%s\n%d %d\n", q.definition(), bytes, count)
+	if _, err = tmp.WriteString(content); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(q.Dir, maildirSizeFile))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	q.UsedBytes, q.UsedCount = bytes, count
+	q.size, q.modTime = int64(len(content)), time.Now()
+	return nil
+}
+
+// maildirMessageSize returns the size from the S= field of the file name, which
+// Maildir++ writers add so that the file doesn't need to be read, or the file's size
+func maildirMessageSize(fi os.FileInfo) int64 {
+	name := fi.Name()
+	if i := strings.IndexByte(name, ':'); i > -1 {
+		name = name[:i]
+	}
+	for _, field := range strings.Split(name, ",")[1:] {
+		if strings.HasPrefix(field, "S=") {
+			if n, err := strconv.ParseInt(field[2:], 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return fi.Size()
+}
+
+// CheckMaildirQuota returns the over quota tempfail and QuotaExceeded if a message of size
+// bytes doesn't fit in the quota of the maildir. The quota is returned to record the message
+// with Add once it's saved, nil if the maildir has no quota
+func CheckMaildirQuota(dir string, size int64) (*MaildirQuota, Result, error) {
+	q, err := ReadMaildirQuota(dir)
+	if err != nil {
+		Log().WithError(err).Error("could not read the maildir quota of ", dir)
+		return nil, NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+	}
+	if q == nil || q.Fits(size) {
+		return q, nil, nil
+	}
+	if time.Since(q.modTime) > maildirSizeMaxAge {
+		// messages may have been deleted without updating the file
+		if err := q.Recalculate(); err != nil {
+			Log().WithError(err).Error("could not recalculate the maildir quota of ", dir)
+		} else if q.Fits(size) {
+			return q, nil, nil
+		}
+	}
+	return q, NewResult(response.Canned.ErrorMailboxOverQuota), QuotaExceeded
+}
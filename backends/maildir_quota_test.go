@@ -0,0 +1,116 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestMaildirQuota(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for _, sub := range []string{"new", "cur", "tmp", ".Sent/cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{
+		"new/1.M1P1.host,S=100":     "",
+		"cur/2.M2P2.host,S=50:2,S":  "",
+		".Sent/cur/3.M3P3.host:2,S": "0123456789",
+		"tmp/4.M4P4.host,S=1000":    "",
+		".Sent/maildirfolder":       "",
+		"courierimapuiddb":          "",
+		"cur/5.M5P5.host,W=5,S=":    "12345",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if q, err := ReadMaildirQuota(dir); q != nil || err != nil {
+		t.Fatal("expected no quota without a maildirsize file", q, err)
+	}
+	if _, result, err := CheckMaildirQuota(dir, 1<<30); result != nil || err != nil {
+		t.Error("expected any message to fit without a quota", result, err)
+	}
+	q, err := SetMaildirQuota(dir, 200, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the messages in tmp are not counted, and the size comes from the name when it's there
+	if q.UsedBytes != 165 || q.UsedCount != 4 {
+		t.Fatal("unexpected usage", q.UsedBytes, q.UsedCount)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, maildirSizeFile)); string(data) != "200S,5C\n165 4\n" {
+		t.Errorf("unexpected maildirsize file %q", data)
+	}
+	if !q.Fits(35) || q.Fits(36) {
+		t.Error("expected the byte limit to be applied")
+	}
+	if err := q.Add(30, 1); err != nil {
+		t.Fatal(err)
+	}
+	// the count is now at the limit
+	q, result, err := CheckMaildirQuota(dir, 1)
+	if err != QuotaExceeded || !strings.HasPrefix(result.String(), "452 4.2.2") {
+		t.Fatal("expected a tempfail, got", result, err)
+	}
+	if q.UsedBytes != 195 || q.UsedCount != 5 {
+		t.Error("expected the usage to be read back, got", q.UsedBytes, q.UsedCount)
+	}
+	if err := q.Add(-30, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, result, err := CheckMaildirQuota(dir, 35); result != nil || err != nil {
+		t.Error("expected the message to fit after a delete", result, err)
+	}
+
+	// a stale file is recalculated before the message is refused
+	if err := os.Remove(filepath.Join(dir, "new/1.M1P1.host,S=100")); err != nil {
+		t.Fatal(err)
+	}
+	if _, result, _ := CheckMaildirQuota(dir, 100); result == nil {
+		t.Fatal("expected the message to be refused while the file is recent")
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, maildirSizeFile), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if q, result, err := CheckMaildirQuota(dir, 100); result != nil || err != nil || q.UsedBytes != 65 {
+		t.Error("expected the usage to be recalculated", result, err)
+	}
+
+	// a long file is recalculated when it's read
+	q, _ = ReadMaildirQuota(dir)
+	for q.size <= maildirSizeMax {
+		if err := q.Add(1000, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Add(-1000, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q, _ = ReadMaildirQuota(dir); q.size > maildirSizeMax || q.UsedBytes != 65 || q.UsedCount != 3 {
+		t.Error("expected the file to be rewritten", q.size, q.UsedBytes, q.UsedCount)
+	}
+
+	if _, _, err := parseMaildirQuota("100X"); err == nil {
+		t.Error("expected an invalid quota")
+	}
+	if b, c, err := parseMaildirQuota("1000C"); b != 0 || c != 1000 || err != nil {
+		t.Error("unexpected quota", b, c, err)
+	}
+}
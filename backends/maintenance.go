@@ -0,0 +1,289 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceConfig schedules the maintenance jobs of the subsystems, it's read from the backend config
+type MaintenanceConfig struct {
+	// Schedule is when to run the jobs, "<job>=<schedule>", eg. ["retention=0 3 * * *",
+	// "greylist_cleanup=@hourly"]. A schedule has the cron fields minute, hour, day of the month,
+	// month and day of the week, or is @hourly, @daily, @weekly, @monthly or "@every <duration>"
+	Schedule []string `json:"maintenance_schedule,omitempty"`
+}
+
+// MaintenanceJob is a task of a subsystem, eg. to purge expired records, that the scheduler runs
+// at the times of the maintenance_schedule
+type MaintenanceJob func() error
+
+var maintenanceJobs = struct {
+	sync.RWMutex
+	m map[string]MaintenanceJob
+}{m: make(map[string]MaintenanceJob)}
+
+// RegisterMaintenanceJob adds a job that maintenance_schedule can name. Names are case-insensitive,
+// a job with the same name is replaced, and a nil job removes it
+func RegisterMaintenanceJob(name string, job MaintenanceJob) {
+	maintenanceJobs.Lock()
+	defer maintenanceJobs.Unlock()
+	if job == nil {
+		delete(maintenanceJobs.m, strings.ToLower(name))
+		return
+	}
+	maintenanceJobs.m[strings.ToLower(name)] = job
+}
+
+// MaintenanceJobs returns the names of the registered jobs, sorted
+func MaintenanceJobs() []string {
+	maintenanceJobs.RLock()
+	defer maintenanceJobs.RUnlock()
+	names := make([]string, 0, len(maintenanceJobs.m))
+	for name := range maintenanceJobs.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunMaintenanceJob runs a registered job now
+func RunMaintenanceJob(name string) error {
+	maintenanceJobs.RLock()
+	job, ok := maintenanceJobs.m[strings.ToLower(name)]
+	maintenanceJobs.RUnlock()
+	if !ok {
+		return fmt.Errorf("no maintenance job %q", name)
+	}
+	return job()
+}
+
+// maintenanceEntry is a job of the schedule
+type maintenanceEntry struct {
+	job      string
+	schedule *cronSchedule
+}
+
+// parseMaintenanceSchedule parses the "<job>=<schedule>" entries
+func parseMaintenanceSchedule(entries []string) ([]maintenanceEntry, error) {
+	parsed := make([]maintenanceEntry, 0, len(entries))
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("maintenance_schedule entry %q should be <job>=<schedule>", entry)
+		}
+		s, err := parseCronSchedule(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("maintenance_schedule entry %q: %s", entry, err)
+		}
+		parsed = append(parsed, maintenanceEntry{job: strings.ToLower(strings.TrimSpace(kv[0])), schedule: s})
+	}
+	return parsed, nil
+}
+
+// maintenanceScheduled returns true if the job is in the maintenance_schedule of the backend config
+func maintenanceScheduled(backendConfig BackendConfig, job string) bool {
+	config, err := Svc.ExtractConfig(backendConfig, &MaintenanceConfig{})
+	if err != nil {
+		return false
+	}
+	for _, entry := range config.(*MaintenanceConfig).Schedule {
+		if kv := strings.SplitN(entry, "=", 2); strings.EqualFold(strings.TrimSpace(kv[0]), job) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceScheduler runs the jobs of the schedule, each entry in its own goroutine. The next run of an
+// entry is worked out once its last run finished, so that the runs don't overlap
+type maintenanceScheduler struct {
+	entries []maintenanceEntry
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (m *maintenanceScheduler) start() {
+	m.stop = make(chan struct{})
+	for _, entry := range m.entries {
+		m.wg.Add(1)
+		go func(entry maintenanceEntry) {
+			defer m.wg.Done()
+			for {
+				now := time.Now()
+				next := entry.schedule.next(now)
+				timer := time.NewTimer(next.Sub(now))
+				select {
+				case <-m.stop:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+				started := time.Now()
+				if err := RunMaintenanceJob(entry.job); err != nil {
+					Log().WithError(err).Errorf("maintenance job %s failed", entry.job)
+				} else {
+					Log().Infof("maintenance job %s finished in %s", entry.job, time.Since(started))
+				}
+			}
+		}(entry)
+	}
+}
+
+// shutdown stops the scheduler, waiting for the jobs that are running
+func (m *maintenanceScheduler) shutdown() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+func configureMaintenance(backendConfig BackendConfig) error {
+	config, err := Svc.ExtractConfig(backendConfig, &MaintenanceConfig{})
+	if err != nil {
+		return err
+	}
+	entries, err := parseMaintenanceSchedule(config.(*MaintenanceConfig).Schedule)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	m := &maintenanceScheduler{entries: entries}
+	m.start()
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		m.shutdown()
+		return nil
+	}))
+	return nil
+}
+
+// cronSchedule is when a job runs, either every interval, or at the minutes that match the fields
+type cronSchedule struct {
+	every time.Duration
+	// the bits of the values that match, eg. bit 5 of minute for the 5th minute
+	minute, hour, dom, month, dow uint64
+	// a restricted day of the month or of the week matches either, as cron does
+	domAny, dowAny bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cronSearchLimit is how far ahead a schedule must match, so that eg. February 30th is an error
+const cronSearchLimit = time.Hour * 24 * 366 * 5
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid duration in %q, it needs at least a second", spec)
+		}
+		return &cronSchedule{every: d}, nil
+	}
+	if fields, ok := cronShorthands[spec]; ok {
+		spec = fields
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q should have 5 fields, or be @hourly, @daily, @weekly, @monthly or @every", spec)
+	}
+	s := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		if *f.bits, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, err
+		}
+	}
+	// 7 is Sunday too
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	if now := time.Now(); s.next(now).Sub(now) > cronSearchLimit {
+		return nil, fmt.Errorf("%q never runs", spec)
+	}
+	return s, nil
+}
+
+// parseCronField parses a list of values, ranges and steps, eg. "*/15", "1-5" or "0,30"
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i > -1 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", field)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", field)
+				}
+			} else if step > 1 {
+				// "5/10" is from 5 to the end
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of the range %d-%d", field, min, max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	if bits == 0 {
+		return 0, errors.New("empty field")
+	}
+	return bits, nil
+}
+
+// next returns the first time after t that the schedule matches
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return t
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,122 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2020, 1, 15, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next string
+	}{
+		{"*/15 * * * *", "2020-01-15 10:45"},
+		{"0 3 * * *", "2020-01-16 03:00"},
+		{"@hourly", "2020-01-15 11:00"},
+		{"@daily", "2020-01-16 00:00"},
+		{"@weekly", "2020-01-19 00:00"},
+		{"@monthly", "2020-02-01 00:00"},
+		{"30 10 * * *", "2020-01-16 10:30"},
+		{"0 9-17/4 * * 1-5", "2020-01-15 13:00"},
+		{"0 0 * * 7", "2020-01-19 00:00"},
+		{"0 0 29 2 *", "2020-02-29 00:00"},
+		// either the day of the month or the day of the week
+		{"0 0 1 * 5", "2020-01-17 00:00"},
+		{"5,35 * * * *", "2020-01-15 10:35"},
+		{"5/20 * * * *", "2020-01-15 10:45"},
+	}
+	for _, test := range tests {
+		s, err := parseCronSchedule(test.spec)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.spec, err)
+			continue
+		}
+		if next := s.next(now).Format("2006-01-02 15:04"); next != test.next {
+			t.Errorf("expected %q to run at %s, got %s", test.spec, test.next, next)
+		}
+	}
+	if s, err := parseCronSchedule("@every 90s"); err != nil || s.next(now) != now.Add(time.Second*90) {
+		t.Error("expected @every to run after the duration, got", s, err)
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *",
+		"a * * * *", "0 0 30 2 *", "@every 1ms", "@yearly"} {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestMaintenanceJobs(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	runs := make(chan struct{}, 10)
+	RegisterMaintenanceJob("Test_Job", func() error {
+		runs <- struct{}{}
+		return nil
+	})
+	defer RegisterMaintenanceJob("test_job", nil)
+	names := MaintenanceJobs()
+	found := false
+	for _, name := range names {
+		found = found || name == "test_job"
+	}
+	if !found {
+		t.Fatal("expected the job to be registered, got", names)
+	}
+	if err := RunMaintenanceJob("unknown"); err == nil {
+		t.Error("expected an error for an unknown job")
+	}
+
+	if _, err := parseMaintenanceSchedule([]string{"test_job"}); err == nil {
+		t.Error("expected an error for an entry without a schedule")
+	}
+	entries, err := parseMaintenanceSchedule([]string{"test_job=@every 1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &maintenanceScheduler{entries: entries}
+	m.start()
+	select {
+	case <-runs:
+	case <-time.After(time.Second * 3):
+		t.Error("expected the job to run")
+	}
+	m.shutdown()
+
+	// the retention job only runs when it's scheduled
+	config := BackendConfig{"retention_days": 30, "retention_stores": []interface{}{"files"}}
+	if j, err := NewRetentionJob(config); j != nil || err != nil {
+		t.Error("expected retention to be off, got", j, err)
+	}
+	config["maintenance_schedule"] = []interface{}{"retention=0 3 * * *"}
+	j, err := NewRetentionJob(config)
+	if err != nil || j == nil || j.interval != 0 {
+		t.Fatal("expected a retention job without an interval, got", j, err)
+	}
+
+	// the expired greylist records are dropped
+	store := newMemoryGreylistStore()
+	trackGreylistStore(store, true)
+	defer trackGreylistStore(store, false)
+	_ = store.Set("old", GreylistRecord{}, time.Nanosecond)
+	_ = store.Set("new", GreylistRecord{}, time.Hour)
+	time.Sleep(time.Millisecond)
+	if err := RunMaintenanceJob("greylist_cleanup"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.records["old"]; ok || len(store.records) != 1 {
+		t.Error("expected the expired record to be dropped, got", store.records)
+	}
+
+	RegisterMaintenanceJob("test_job", func() error {
+		return errors.New("failed")
+	})
+	if err := RunMaintenanceJob("TEST_JOB"); err == nil {
+		t.Error("expected the error of the job")
+	}
+}
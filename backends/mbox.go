@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// mboxFromLine matches the lines that mboxrd quotes with a '>', so that they can't be
+// mistaken for the From_ line of the next message
+var mboxFromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+// WriteMbox writes a message in the mboxrd format: a From_ line with the sender and date,
+// the message with LF line endings and its "From " lines quoted, and a blank line
+func WriteMbox(w io.Writer, from string, date time.Time, data []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	var b bytes.Buffer
+	b.Grow(len(data) + 128)
+	_, _ = fmt.Fprintf(&b, "From %s %s\n", from, date.UTC().Format(time.ANSIC))
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	b.Write(mboxFromLine.ReplaceAll(data, []byte(">$1")))
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// appendMbox appends a message to the mbox file, holding an exclusive lock on it so that
+// mail readers and other processes don't see a partial message. When maxSize is set and the
+// message doesn't fit, the file is renamed to the next free name.N first
+func appendMbox(name string, maxSize int64, from string, date time.Time, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	for {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		if err := lockFile(f); err != nil {
+			_ = f.Close()
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		if maxSize > 0 && fi.Size() > 0 && fi.Size()+int64(len(data)) > maxSize {
+			// another process may have rotated it already, only rename the file that is locked
+			if cur, err := os.Stat(name); err == nil && os.SameFile(fi, cur) {
+				err = os.Rename(name, nextMboxName(name))
+				if err != nil {
+					_ = f.Close()
+					return err
+				}
+			}
+			_ = f.Close()
+			continue
+		}
+		err = WriteMbox(f, from, date, data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// nextMboxName returns the first name.N that doesn't exist
+func nextMboxName(name string) string {
+	for n := 1; ; n++ {
+		rotated := name + "." + strconv.Itoa(n)
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			return rotated
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// +build !darwin
+// +build !dragonfly
+// +build !freebsd
+// +build !linux
+// +build !netbsd
+// +build !openbsd
+
+package backends
+
+import "os"
+
+// lockFile doesn't lock on this platform, the mbox processor still serializes its own writes
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package backends
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file, it's released when the file is closed
+func lockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/nats-io/nats.go"
+)
+
+// natsStream publishes to JetStream, it's a nats.JetStreamContext of a connection
+type natsStream interface {
+	PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error)
+	Close()
+}
+
+type natsConn struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+}
+
+func (c natsConn) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	return c.js.PublishMsg(m, opts...)
+}
+
+func (c natsConn) Close() {
+	c.conn.Close()
+}
+
+// natsConnect connects to the servers, it's replaced by the tests
+var natsConnect = func(config *NATSProcessorConfig) (natsStream, error) {
+	opts := []nats.Option{
+		nats.Name("go-guerrilla"),
+		// the server starts when NATS is down, and publishes fail until it's back
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				Log().WithError(err).Warn("nats: disconnected, reconnecting")
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			Log().Infof("nats: reconnected to %s", nc.ConnectedUrl())
+		}),
+	}
+	if config.TLS {
+		opts = append(opts, nats.Secure())
+	}
+	if config.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(config.Credentials))
+	}
+	if config.Username != "" {
+		opts = append(opts, nats.UserInfo(config.Username, config.Password))
+	}
+	if config.Token != "" {
+		opts = append(opts, nats.Token(config.Token))
+	}
+	conn, err := nats.Connect(config.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return natsConn{conn: conn, js: js}, nil
+}
+
+// natsReconnectWait is how long to wait between two attempts to connect
+var natsReconnectWait = time.Second * 2
+
+// natsPublisher is the connection shared by the workers of the same config. The client
+// reconnects by itself, and buffers nothing: a publish fails when it's not acknowledged
+type natsPublisher struct {
+	stream natsStream
+	// how many processors use the publisher
+	users int
+}
+
+var (
+	natsPublishersGuard sync.Mutex
+	// the publishers of the processors, by their config
+	natsPublishers = make(map[string]*natsPublisher)
+)
+
+// useNATSPublisher returns the publisher for the config, connecting if it's not used already
+func useNATSPublisher(config *NATSProcessorConfig) (*natsPublisher, error) {
+	key := fmt.Sprintf("%+v", *config)
+	natsPublishersGuard.Lock()
+	defer natsPublishersGuard.Unlock()
+	if np, ok := natsPublishers[key]; ok {
+		np.users++
+		return np, nil
+	}
+	stream, err := natsConnect(config)
+	if err != nil {
+		return nil, err
+	}
+	np := &natsPublisher{stream: stream, users: 1}
+	natsPublishers[key] = np
+	return np, nil
+}
+
+// release closes the connection when the last processor that used it is shut down
+func (np *natsPublisher) release() {
+	natsPublishersGuard.Lock()
+	np.users--
+	last := np.users == 0
+	if last {
+		for key, v := range natsPublishers {
+			if v == np {
+				delete(natsPublishers, key)
+			}
+		}
+	}
+	natsPublishersGuard.Unlock()
+	if last {
+		np.stream.Close()
+	}
+}
+
+// publish sends the message and waits until the stream acknowledged it, or the timeout.
+// The id is the Nats-Msg-Id that the stream detects duplicates with, none if empty
+func (np *natsPublisher) publish(msg *nats.Msg, id, stream string, timeout time.Duration) (*nats.PubAck, error) {
+	if id != "" {
+		msg.Header.Set(nats.MsgIdHdr, id)
+	}
+	if stream != "" {
+		msg.Header.Set(nats.ExpectedStreamHdr, stream)
+	}
+	return np.stream.PublishMsg(msg, nats.AckWait(timeout))
+}
+
+// natsSubject returns the subject of the envelope. The domain of the first recipient
+// replaces {domain}, its dots make more tokens, eg. mail.example.com
+func natsSubject(subject string, e *mail.Envelope) string {
+	return ForTenant(strings.Replace(subject, "{domain}", rcptDomain(e), -1), e.Tenant)
+}
@@ -0,0 +1,108 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: accounting
+// ----------------------------------------------------------------------------------
+// Description   : Counts the accepted messages, recipients and bytes of each recipient
+//               : domain of each tenant, and sends the counts as records to a json
+//               : lines file or a webhook every interval, for billing. Place it first
+//               : in the chain, the envelope is counted once the rest of the chain
+//               : accepted it. The storage bytes are the size of the message after the
+//               : Compressor, when a processor saved the compressed message
+// ----------------------------------------------------------------------------------
+// Config Options: accounting_interval string - how often to send the records, default
+//               : "5m"
+//               : accounting_file string - a file the records are appended to as json
+//               : lines, {date} (2006-01-02) is replaced with the day
+//               : accounting_url string - a URL the records are POSTed to as a json
+//               : array. When the file is set too, failed requests are not retried
+//               : with the next records
+//               : accounting_secret string - the key to sign the requests with, like
+//               : the http processor
+//               : accounting_timeout string - timeout of each request, default "10s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, e.Tenant, e.Data, e.DeliveryHeader
+//               : e.Values["zlib-compressor"] - set by the Compressor processor
+// ----------------------------------------------------------------------------------
+// Output        : none
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["accounting"] = func() Decorator {
+		return Accounting()
+	}
+}
+
+type AccountingConfig struct {
+	Interval string `json:"accounting_interval,omitempty"`
+	File     string `json:"accounting_file,omitempty"`
+	URL      string `json:"accounting_url,omitempty"`
+	Secret   string `json:"accounting_secret,omitempty"`
+	Timeout  string `json:"accounting_timeout,omitempty"`
+}
+
+const defaultAccountingInterval = time.Minute * 5
+
+func Accounting() Decorator {
+	var a *accountant
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AccountingConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*AccountingConfig)
+		if config.File == "" && config.URL == "" {
+			return errors.New("accounting_file or accounting_url is required by the accounting processor")
+		}
+		interval := defaultAccountingInterval
+		if config.Interval != "" {
+			if interval, err = time.ParseDuration(config.Interval); err != nil || interval <= 0 {
+				return fmt.Errorf("invalid accounting_interval %q", config.Interval)
+			}
+		}
+		timeout := defaultHTTPTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid accounting_timeout %q", config.Timeout)
+			}
+		}
+		a = useAccountant(config, interval, timeout)
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if a != nil {
+			a.release()
+			a = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			// a processor that saves the compressed message drains e.Data
+			size := int64(e.Data.Len())
+			result, err := p.Process(e, task)
+			if err != nil {
+				return result, err
+			}
+			size += int64(len(e.DeliveryHeader))
+			storage := size
+			if c, ok := e.Values["zlib-compressor"].(*DataCompressor); ok && c.Size > 0 {
+				storage = int64(c.Size)
+			}
+			a.add(e, size, storage)
+			return result, err
+		})
+	}
+}
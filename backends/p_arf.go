@@ -0,0 +1,46 @@
+package backends
+
+import (
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: arf
+// ----------------------------------------------------------------------------------
+// Description   : Recognizes the abuse reports (RFC 5965) sent by the feedback loops of
+//               : mailbox providers, and passes them to the feedback handlers: the
+//               : recipients that complained are added to the Suppressions list of the
+//               : tenant, and the complaint is recorded in the delivery records of the
+//               : reported message. Other handlers can be added with
+//               : RegisterFeedbackHandler. Other mail is passed on as is
+// ----------------------------------------------------------------------------------
+// Config Options: none
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.Tenant
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["arf"] - the *FeedbackReport
+//               : e.Tags - "arf" with the feedback type, eg. arf:abuse
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["arf"] = func() Decorator {
+		return ARF()
+	}
+}
+
+func ARF() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if r, err := ParseFeedbackReport(e.Data.Bytes()); err == nil {
+					e.Values["arf"] = r
+					e.Tags.Add("arf", r.FeedbackType)
+					Log().Infof("feedback report %s from %s for %v, message %s", r.FeedbackType, r.UserAgent,
+						r.OriginalRcptTo, r.MessageId)
+					handleFeedback(e.Tenant, r)
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package backends
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: chaos
+// ----------------------------------------------------------------------------------
+// Description   : Injects latency and faults, for testing retry and alerting
+//               : behaviour in staging. Do not use in production chains.
+// ----------------------------------------------------------------------------------
+// Config Options: chaos_delay string - fixed delay before continuing, eg "2s"
+//               : chaos_delay_jitter string - random extra delay up to this, eg "500ms"
+//               : chaos_tempfail_probability float - 0.0 to 1.0, chance of a 451 result
+//               : chaos_permfail_probability float - 0.0 to 1.0, chance of a 554 result
+//               : chaos_panic_probability float - 0.0 to 1.0, chance of a panic
+//               : chaos_validate_rcpt bool - also inject faults when validating recipients
+//               : chaos_seed int - seed for the random source, 0 seeds from the clock
+// --------------:-------------------------------------------------------------------
+// Input         : envelope
+// ----------------------------------------------------------------------------------
+// Output        : none, the envelope is passed through untouched unless a fault fires
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["chaos"] = func() Decorator {
+		return Chaos()
+	}
+}
+
+type ChaosConfig struct {
+	Delay               string  `json:"chaos_delay,omitempty"`
+	DelayJitter         string  `json:"chaos_delay_jitter,omitempty"`
+	TempFailProbability float64 `json:"chaos_tempfail_probability,omitempty"`
+	PermFailProbability float64 `json:"chaos_permfail_probability,omitempty"`
+	PanicProbability    float64 `json:"chaos_panic_probability,omitempty"`
+	ValidateRcpt        bool    `json:"chaos_validate_rcpt,omitempty"`
+	Seed                int     `json:"chaos_seed,omitempty"`
+	delay, jitter       time.Duration
+}
+
+var (
+	errChaosTempFail = errors.New("chaos: injected temporary failure")
+	errChaosPermFail = errors.New("chaos: injected permanent failure")
+)
+
+// chaosMonkey holds the random source, shared between all workers
+type chaosMonkey struct {
+	config *ChaosConfig
+	rnd    *rand.Rand
+	sync.Mutex
+}
+
+// roll returns true with the given probability
+func (c *chaosMonkey) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.rnd.Float64() < probability
+}
+
+// sleep waits for the configured delay plus a random jitter
+func (c *chaosMonkey) sleep() {
+	d := c.config.delay
+	if c.config.jitter > 0 {
+		c.Lock()
+		d += time.Duration(c.rnd.Int63n(int64(c.config.jitter)))
+		c.Unlock()
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// inject sleeps, then possibly panics or returns a failure result.
+// Returns a nil result if no fault was injected
+func (c *chaosMonkey) inject() (Result, error) {
+	c.sleep()
+	if c.roll(c.config.PanicProbability) {
+		panic("chaos: injected panic")
+	}
+	if c.roll(c.config.PermFailProbability) {
+		return NewResult("554 5.3.0 Error: ", errChaosPermFail), errChaosPermFail
+	}
+	if c.roll(c.config.TempFailProbability) {
+		return NewResult("451 4.3.0 Error: ", errChaosTempFail), errChaosTempFail
+	}
+	return nil, nil
+}
+
+func Chaos() Decorator {
+	monkey := &chaosMonkey{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ChaosConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*ChaosConfig)
+		if config.Delay != "" {
+			if config.delay, err = time.ParseDuration(config.Delay); err != nil {
+				return err
+			}
+		}
+		if config.DelayJitter != "" {
+			if config.jitter, err = time.ParseDuration(config.DelayJitter); err != nil {
+				return err
+			}
+		}
+		seed := int64(config.Seed)
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		monkey.config = config
+		monkey.rnd = rand.New(rand.NewSource(seed))
+		Log().Warn("the chaos processor is enabled, faults will be injected on purpose")
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail || (task == TaskValidateRcpt && monkey.config.ValidateRcpt) {
+				if result, err := monkey.inject(); result != nil {
+					Log().WithError(err).Warn("chaos processor injected a fault")
+					return result, err
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
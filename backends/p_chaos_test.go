@@ -0,0 +1,54 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestChaos(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	tests := []struct {
+		name   string
+		config BackendConfig
+		code   int
+	}{
+		{"pass through", BackendConfig{}, 200},
+		{"temp fail", BackendConfig{"chaos_tempfail_probability": 1.0}, 451},
+		{"perm fail", BackendConfig{"chaos_permfail_probability": 1.0, "chaos_tempfail_probability": 1.0}, 554},
+		{"delayed", BackendConfig{"chaos_delay": "10ms", "chaos_delay_jitter": "5ms", "chaos_seed": 1}, 200},
+	}
+	for _, tt := range tests {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, Chaos())
+		if errs := Svc.initialize(tt.config); errs != nil {
+			t.Fatal(tt.name, "initialize:", errs)
+		}
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		result, _ := p.Process(e, TaskSaveMail)
+		if result.Code() != tt.code {
+			t.Error(tt.name, "expected code", tt.code, "got", result.Code(), result)
+		}
+		// recipient validation is left alone unless chaos_validate_rcpt is set
+		if result, err := p.Process(e, TaskValidateRcpt); err != nil || result.Code() != 200 {
+			t.Error(tt.name, "validate rcpt should pass through, got", result, err)
+		}
+	}
+}
+
+func TestChaosPanic(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Chaos())
+	if errs := Svc.initialize(BackendConfig{"chaos_panic_probability": 1.0}); errs != nil {
+		t.Fatal("initialize:", errs)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected the chaos processor to panic")
+		}
+	}()
+	_, _ = p.Process(mail.NewEnvelope("127.0.0.1", 1), TaskSaveMail)
+}
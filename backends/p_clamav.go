@@ -0,0 +1,144 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: clamav
+// ----------------------------------------------------------------------------------
+// Description   : Streams the email to clamd with INSTREAM, and rejects the infected
+//               : emails, quarantines them, or tags them and passes them on. The result
+//               : is recorded as a virus verdict
+// ----------------------------------------------------------------------------------
+// Config Options: clamav_address string - host:port, or a unix socket such as
+//               : unix:/var/run/clamav/clamd.ctl. Default 127.0.0.1:3310
+//               : clamav_timeout string - timeout of the scan, default "30s"
+//               : clamav_max_size int - bigger emails aren't scanned, default 26214400,
+//               : clamd's StreamMaxLength
+//               : clamav_action string - what to do with infected emails: "reject"
+//               : (default), "quarantine" or "tag", which passes them on with the
+//               : virus:infected tag, for the processors after it
+//               : clamav_quarantine_dir string - where infected emails are quarantined,
+//               : {tenant} is replaced. Required by the quarantine action
+//               : clamav_tempfail bool - defer the email with a 451 when clamd can't be
+//               : reached. By default it's passed on unscanned
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+// Output        : a "virus" verdict
+//               : e.Values["virus_signature"] string - the name of the signature found
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["clamav"] = func() Decorator {
+		return ClamAV()
+	}
+	Svc.AddWholeMessage("clamav")
+}
+
+type ClamAVProcessorConfig struct {
+	Address       string `json:"clamav_address,omitempty"`
+	Timeout       string `json:"clamav_timeout,omitempty"`
+	MaxSize       int    `json:"clamav_max_size,omitempty"`
+	Action        string `json:"clamav_action,omitempty"`
+	QuarantineDir string `json:"clamav_quarantine_dir,omitempty"`
+	TempFail      bool   `json:"clamav_tempfail,omitempty"`
+}
+
+const (
+	defaultClamAVAddress = "127.0.0.1:3310"
+	defaultClamAVTimeout = time.Second * 30
+	defaultClamAVMaxSize = 25 << 20
+)
+
+var errVirusFound = errors.New("clamav: the email has a virus")
+
+func ClamAV() Decorator {
+	var config *ClamAVProcessorConfig
+	var timeout time.Duration
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ClamAVProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ClamAVProcessorConfig)
+		if config.Address == "" {
+			config.Address = defaultClamAVAddress
+		}
+		timeout = defaultClamAVTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid clamav_timeout %q", config.Timeout)
+			}
+		}
+		if config.MaxSize <= 0 {
+			config.MaxSize = defaultClamAVMaxSize
+		}
+		switch config.Action {
+		case "":
+			config.Action = "reject"
+		case "reject", "tag":
+		case "quarantine":
+			if config.QuarantineDir == "" {
+				return errors.New("clamav_quarantine_dir is required by the quarantine clamav_action")
+			}
+		default:
+			return fmt.Errorf("invalid clamav_action %q, expecting reject, quarantine or tag", config.Action)
+		}
+		return nil
+	}))
+	Svc.AddHealthCheck(func() error {
+		return clamdPing(config.Address, timeout)
+	})
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			if e.Len() > config.MaxSize {
+				Log().Debugf("clamav: %s is too big to be scanned", e.QueuedId)
+				return p.Process(e, task)
+			}
+			signature, err := clamdScan(config.Address, timeout, e.NewReader())
+			if err == errClamdSizeLimit {
+				Log().Debugf("clamav: %s is too big for clamd", e.QueuedId)
+				return p.Process(e, task)
+			} else if err != nil {
+				Log().WithError(err).Warnf("clamav: could not scan %s", e.QueuedId)
+				if config.TempFail {
+					return NewResult("451 4.7.1 Error: the email could not be scanned, try again later"), StorageError
+				}
+				return p.Process(e, task)
+			}
+			if signature == "" {
+				AddVerdict(e, Verdict{Method: VerdictVirus, Result: "clean", Scanner: "ClamAV"})
+				return p.Process(e, task)
+			}
+
+			AddVerdict(e, Verdict{Method: VerdictVirus, Result: "infected", Reason: signature, Scanner: "ClamAV"})
+			e.Values["virus_signature"] = signature
+			switch config.Action {
+			case "tag":
+				Log().WithField("signature", signature).Infof("clamav: %s has a virus", e.QueuedId)
+				return p.Process(e, task)
+			case "reject":
+				Log().WithField("signature", signature).Infof("clamav: rejected %s", e.QueuedId)
+				return NewResult("550 5.7.1 Error: the email has a virus: " + signature), errVirusFound
+			}
+			e.Tags.Add("quarantine", "virus")
+			if err := quarantineEnvelope(config.QuarantineDir, e); err != nil {
+				Log().WithError(err).Error("clamav: could not quarantine an email")
+				return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+			}
+			Log().WithField("signature", signature).Infof("clamav: quarantined %s", e.QueuedId)
+			return BackendResultOK, nil
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package backends
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: compose
+// ----------------------------------------------------------------------------------
+// Description   : Composes a message from a template for each email, eg. a notification
+//               : or an auto-reply, and sends it through a smarthost. The recipients are
+//               : the To, Cc and Bcc headers of the composed message, eg. "{{.From}}" to
+//               : reply to the sender. No message is composed for bounces, or for mail
+//               : that is auto-submitted or bulk (RFC 3834), so that two servers don't
+//               : reply to each other in a loop. Sending failures are logged, the email is
+//               : accepted. The composed message has an Auto-Submitted: auto-generated
+//               : header, unless the template sets it, eg. to auto-replied. It's signed
+//               : with DKIM when the domain of its From has one of the dkim_sign_keys
+// ----------------------------------------------------------------------------------
+// Config Options: compose_template string - path of a json MessageTemplate. Required
+//               : compose_smarthost string - host:port of the server that relays the
+//               : composed messages, STARTTLS is used when offered. Required
+//               : compose_from string - the envelope sender. Default is the null
+//               : sender, as for automatic replies
+//               : dkim_sign_keys []string - see the dkim_sign processor, and its other
+//               : dkim_sign_* options
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.Subject
+//               : e.Header generated by ParseHeader() processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags - "composed" with the Message-Id of the composed message
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["compose"] = func() Decorator {
+		return Compose()
+	}
+}
+
+type ComposeProcessorConfig struct {
+	Template    string `json:"compose_template"`
+	Smarthost   string `json:"compose_smarthost"`
+	From        string `json:"compose_from,omitempty"`
+	PrimaryHost string `json:"primary_mail_host"`
+}
+
+// composeDialTimeout is how long to wait to connect to the smarthost
+const composeDialTimeout = time.Second * 10
+
+// sendComposed sends the message with a session of SMTPSessions, it's replaced by the tests
+var sendComposed = func(config *ComposeProcessorConfig, from string, to []string, msg []byte) error {
+	s, err := SMTPSessions.Get(config.Smarthost, func() (*smtp.Client, error) {
+		conn, err := net.DialTimeout("tcp", config.Smarthost, composeDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(config.Smarthost)
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if err = c.Hello(config.PrimaryHost); err == nil {
+			if ok, _ := c.Extension("STARTTLS"); ok {
+				err = c.StartTLS(&tls.Config{ServerName: host})
+			}
+		}
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if err := s.Mail(from); err != nil {
+			return err
+		}
+		for _, rcpt := range to {
+			if err := s.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+		w, err := s.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			_ = w.Close()
+			return err
+		}
+		return w.Close()
+	}()
+	SMTPSessions.Put(s, err)
+	return err
+}
+
+// autoSubmitted returns true for mail that should not get an automatic reply
+func autoSubmitted(e *mail.Envelope) bool {
+	if e.MailFrom.NullPath || e.MailFrom.IsEmpty() {
+		return true
+	}
+	if v := strings.TrimSpace(e.Header.Get("Auto-Submitted")); v != "" && !strings.EqualFold(v, "no") {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(e.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return e.Header.Get("List-Id") != ""
+}
+
+// composedRecipients returns the addresses of the To, Cc and Bcc headers, and the message
+// without its Bcc header
+func composedRecipients(msg []byte) ([]string, []byte, error) {
+	end := strings.Index(string(msg), "\r\n\r\n")
+	if end < 0 {
+		return nil, nil, fmt.Errorf("the composed message has no body")
+	}
+	var to []string
+	var header []string
+	for _, line := range strings.Split(string(msg[:end]), "\r\n") {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		switch name := strings.ToLower(line[:i]); name {
+		case "to", "cc", "bcc":
+			list, err := netmail.ParseAddressList(line[i+1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, a := range list {
+				to = append(to, a.Address)
+			}
+			if name == "bcc" {
+				continue
+			}
+		}
+		header = append(header, line)
+	}
+	if len(to) == 0 {
+		return nil, nil, fmt.Errorf("the composed message has no recipients")
+	}
+	return to, append([]byte(strings.Join(header, "\r\n")), msg[end:]...), nil
+}
+
+func Compose() Decorator {
+	var config *ComposeProcessorConfig
+	var composer *Composer
+	var signers map[string]*dkimSigner
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ComposeProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ComposeProcessorConfig)
+		if config.Template == "" || config.Smarthost == "" {
+			return fmt.Errorf("compose_template and compose_smarthost are required by the compose processor")
+		}
+		if _, _, err := net.SplitHostPort(config.Smarthost); err != nil {
+			return fmt.Errorf("invalid compose_smarthost %q: %s", config.Smarthost, err)
+		}
+		if composer, err = LoadComposer(config.Template); err != nil {
+			return err
+		}
+		signers = nil
+		if dkimConfig, err := Svc.ExtractConfig(backendConfig, BaseConfig(&DKIMSignProcessorConfig{})); err != nil {
+			return err
+		} else if len(dkimConfig.(*DKIMSignProcessorConfig).Keys) > 0 {
+			if signers, err = parseDKIMSigners(dkimConfig.(*DKIMSignProcessorConfig)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail && !autoSubmitted(e) {
+				msg, err := composer.Compose(NewComposeData(e))
+				var to []string
+				if err == nil {
+					to, msg, err = composedRecipients(msg)
+				}
+				if err == nil && composedHeader(msg, "Auto-Submitted") == "" {
+					msg = append([]byte("Auto-Submitted: auto-generated\r\n"), msg...)
+				}
+				if err == nil && signers != nil {
+					if msg, _, err = dkimSignMessage(signers, msg); err != nil {
+						err = fmt.Errorf("dkim: %s", err)
+					}
+				}
+				if err != nil {
+					Log().WithError(err).Error("could not compose a message for ", e.QueuedId)
+				} else if err := sendComposed(config, config.From, to, msg); err != nil {
+					Log().WithError(err).Warnf("could not send the message composed for %s to %s", e.QueuedId, config.Smarthost)
+				} else {
+					e.Tags.Add("composed", strings.Trim(composedHeader(msg, "Message-Id"), "<>"))
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// composedHeader returns the value of a header of a composed message
+func composedHeader(msg []byte, name string) string {
+	for _, line := range strings.Split(string(msg), "\r\n") {
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i > -1 && strings.EqualFold(line[:i], name) {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package backends
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComposeProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	template := filepath.Join(dir, "reply.json")
+	if err := ioutil.WriteFile(template, []byte(`{
+		"headers": {
+			"From": "support@acme.com",
+			"To": "{{.From}}",
+			"Bcc": "archive@acme.com",
+			"Subject": "Re: {{.Subject}}",
+			"Auto-Submitted": "auto-replied"
+		},
+		"text": "We received your email"
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	type sent struct {
+		from string
+		to   []string
+		msg  string
+	}
+	var messages []sent
+	saved := sendComposed
+	sendComposed = func(config *ComposeProcessorConfig, from string, to []string, msg []byte) error {
+		messages = append(messages, sent{from, to, string(msg)})
+		return nil
+	}
+	defer func() {
+		sendComposed = saved
+	}()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Compose|Debugger",
+		"primary_mail_host": "mail.acme.com",
+		"compose_template":  template,
+		"compose_smarthost": "relay.acme.com:25",
+		"dkim_sign_keys": []interface{}{
+			"acme.com=sel:" + string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		},
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	if len(messages) != 1 || messages[0].from != "" || strings.Join(messages[0].to, ",") != "archive@acme.com,test@example.com" {
+		t.Fatal("expected a reply to the sender, got", messages)
+	}
+	msg := messages[0].msg
+	if !strings.Contains(msg, "Subject: Re: hello\r\n") || strings.Contains(msg, "Bcc:") ||
+		!strings.Contains(msg, "Auto-Submitted: auto-replied\r\n") || !e.Tags.Has("composed") {
+		t.Errorf("unexpected message %q", msg)
+	}
+	// the reply is signed for the domain of its From
+	if !strings.HasPrefix(msg, "DKIM-Signature: v=1;") || !strings.Contains(msg, "d=acme.com;") {
+		t.Fatalf("expected the message to be signed, got %q", msg)
+	}
+	verifyDKIMTest(t, msg, pub)
+
+	// no replies to automatic mail
+	e = newBrokerTestEnvelope()
+	e.Data.Reset()
+	e.Data.WriteString("Subject: out of office\nAuto-Submitted: auto-replied\n\nhi\n")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") || len(messages) != 1 {
+		t.Error("expected no reply to an auto-reply, got", result, len(messages))
+	}
+}
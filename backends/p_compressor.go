@@ -24,10 +24,19 @@ import (
 //               : Note that it can only be outputted once. It destroys the buffer
 //               : after being printed
 // ----------------------------------------------------------------------------------
+// Stream        : in stream_save_process, it compresses the message while it's
+//               : received, for the stream processors after it, and sets
+//               : e.Values["stream-encoding"] to "deflate". e.DeliveryHeader is not
+//               : included, as it's made after the message was received
+// ----------------------------------------------------------------------------------
 func init() {
 	processors["compressor"] = func() Decorator {
 		return Compressor()
 	}
+	streamProcessors["compressor"] = func() StreamDecorator {
+		return StreamCompressor()
+	}
+	Svc.AddWholeMessage("compressor")
 }
 
 // compressedData struct will be compressed using zlib when printed via fmt
@@ -36,6 +45,8 @@ type DataCompressor struct {
 	Data         *bytes.Buffer
 	// the pool is used to recycle buffers to ease up on the garbage collector
 	Pool *sync.Pool
+	// Size is the length of the compressed data, once it was compressed by String
+	Size int
 }
 
 // newCompressedData returns a new CompressedData
@@ -80,6 +91,7 @@ func (c *DataCompressor) String() string {
 	_, _ = io.Copy(w, r)
 	_, _ = io.Copy(w, c.Data)
 	_ = w.Close()
+	c.Size = b.Len()
 	return b.String()
 }
 
@@ -105,3 +117,37 @@ func Compressor() Decorator {
 		})
 	}
 }
+
+// streamCompressor compresses the message for the next stream processor
+type streamCompressor struct {
+	w    *zlib.Writer
+	next StreamProcessor
+}
+
+func (c *streamCompressor) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *streamCompressor) Close(err error) error {
+	var flushErr error
+	if err == nil {
+		// flushes the rest of the compressed data
+		flushErr = c.w.Close()
+		err = flushErr
+	}
+	if closeErr := c.next.Close(err); flushErr == nil {
+		return closeErr
+	}
+	return flushErr
+}
+
+func StreamCompressor() StreamDecorator {
+	return func(e *mail.Envelope, next StreamProcessor) (StreamProcessor, error) {
+		w, err := zlib.NewWriterLevel(next, zlib.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		e.Values["stream-encoding"] = "deflate"
+		return &streamCompressor{w: w, next: next}, nil
+	}
+}
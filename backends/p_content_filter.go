@@ -0,0 +1,326 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: contentfilter
+// ----------------------------------------------------------------------------------
+// Description   : Checks the email against ordered rules loaded from a json file, a
+//               : lightweight alternative to SpamAssassin, eg.
+//               :   [{"name": "pills", "action": "reject",
+//               :     "if": [{"field": "subject", "match": "(?i)viagra"},
+//               :            {"field": "from", "match": "@example\\.com$", "not": true}]}]
+//               : A rule applies when all its conditions match. A condition matches when
+//               : the regular expression matches the field, or doesn't with "not". The
+//               : fields are subject, from, to (any recipient), tenant, remote_ip, helo,
+//               : body (the decoded text of the message) and header:<name> (any value).
+//               : The actions are:
+//               :   tag - adds "tag" (key:value, default filter:<name>) and goes on
+//               :   reject - rejects the email with "reply", default a 554 5.7.1
+//               :   quarantine - accepts the email, but saves it to
+//               :     content_filter_quarantine_dir instead of passing it on
+//               : The first reject or quarantine rule that applies stops the checks.
+//               : The file is loaded again when it changes, a file that can't be loaded
+//               : is logged and the previous rules are kept.
+// ----------------------------------------------------------------------------------
+// Config Options: content_filter_rules string - path of the json file with the rules
+//               : content_filter_reload_interval string - how often to check if the
+//               : file changed, default "10s"
+//               : content_filter_quarantine_dir string - where quarantined emails are
+//               : saved, {tenant} is replaced. Required by quarantine rules
+//               : content_filter_max_body int - how many bytes of the decoded body the
+//               : rules see, default 262144
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header and e.Subject, parsed by HeadersParser, e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["contentfilter"] = func() Decorator {
+		return ContentFilter()
+	}
+	Svc.AddWholeMessage("contentfilter")
+}
+
+type ContentFilterConfig struct {
+	Rules          string `json:"content_filter_rules"`
+	ReloadInterval string `json:"content_filter_reload_interval,omitempty"`
+	QuarantineDir  string `json:"content_filter_quarantine_dir,omitempty"`
+	MaxBody        int    `json:"content_filter_max_body,omitempty"`
+}
+
+const (
+	defaultContentFilterReload  = time.Second * 10
+	defaultContentFilterMaxBody = 256 * 1024
+)
+
+// The actions of the content filter rules
+const (
+	ContentFilterTag        = "tag"
+	ContentFilterReject     = "reject"
+	ContentFilterQuarantine = "quarantine"
+)
+
+// ContentFilterRule is a rule of the content filter, read from the rules file
+type ContentFilterRule struct {
+	Name       string                   `json:"name"`
+	Conditions []ContentFilterCondition `json:"if"`
+	Action     string                   `json:"action"`
+	// Tag is added by the tag action, key:value
+	Tag string `json:"tag,omitempty"`
+	// Reply is the reply of the reject action, eg. "550 5.7.1 Error: no thanks"
+	Reply string `json:"reply,omitempty"`
+}
+
+// ContentFilterCondition matches a field of the email with a regular expression
+type ContentFilterCondition struct {
+	Field string `json:"field"`
+	Match string `json:"match"`
+	Not   bool   `json:"not,omitempty"`
+	re    *regexp.Regexp
+}
+
+var errContentFilterRejected = errors.New("contentfilter: rejected by a rule")
+
+// parseContentFilterRules parses and checks the rules, compiling their expressions
+func parseContentFilterRules(b []byte) ([]ContentFilterRule, error) {
+	var rules []ContentFilterRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		switch r.Action {
+		case ContentFilterTag:
+			if r.Tag == "" {
+				r.Tag = "filter:" + r.Name
+			}
+		case ContentFilterReject:
+			if r.Reply == "" {
+				r.Reply = "554 5.7.1 Error: rejected by content filter"
+			} else if len(r.Reply) < 3 || (r.Reply[0] != '4' && r.Reply[0] != '5') {
+				return nil, fmt.Errorf("rule %s: the reply should start with a 4xx or 5xx code", r.Name)
+			}
+		case ContentFilterQuarantine:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", r.Name, r.Action)
+		}
+		if len(r.Conditions) == 0 {
+			return nil, fmt.Errorf("rule %s has no conditions", r.Name)
+		}
+		for j := range r.Conditions {
+			c := &r.Conditions[j]
+			switch c.Field {
+			case "subject", "from", "to", "tenant", "remote_ip", "helo", "body":
+			default:
+				if !strings.HasPrefix(c.Field, sqlHeaderField) || c.Field == sqlHeaderField {
+					return nil, fmt.Errorf("rule %s: unknown field %q", r.Name, c.Field)
+				}
+			}
+			var err error
+			if c.re, err = regexp.Compile(c.Match); err != nil {
+				return nil, fmt.Errorf("rule %s: %s", r.Name, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// contentFilter has the rules, and loads them again when the file changes
+type contentFilter struct {
+	config  *ContentFilterConfig
+	reload  time.Duration
+	rules   []ContentFilterRule
+	modTime time.Time
+	checked time.Time
+	sync.Mutex
+}
+
+// load reads the rules file, the rules are kept as they were if it fails
+func (f *contentFilter) load() error {
+	info, err := os.Stat(f.config.Rules)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(f.config.Rules)
+	if err != nil {
+		return err
+	}
+	rules, err := parseContentFilterRules(b)
+	if err != nil {
+		return fmt.Errorf("%s: %s", f.config.Rules, err)
+	}
+	for _, r := range rules {
+		if r.Action == ContentFilterQuarantine && f.config.QuarantineDir == "" {
+			return fmt.Errorf("%s: rule %s needs content_filter_quarantine_dir", f.config.Rules, r.Name)
+		}
+	}
+	f.rules, f.modTime = rules, info.ModTime()
+	return nil
+}
+
+// current returns the rules, loading them again if the file changed since the last check
+func (f *contentFilter) current() []ContentFilterRule {
+	f.Lock()
+	defer f.Unlock()
+	if now := Now(); now.Sub(f.checked) >= f.reload {
+		f.checked = now
+		if info, err := os.Stat(f.config.Rules); err == nil && !info.ModTime().Equal(f.modTime) {
+			if err := f.load(); err != nil {
+				// logged once for each change of the file
+				f.modTime = info.ModTime()
+				Log().WithError(err).Error("contentfilter: could not reload the rules, the previous rules are kept")
+			} else {
+				Log().Infof("contentfilter: reloaded %d rules from %s", len(f.rules), f.config.Rules)
+			}
+		}
+	}
+	return f.rules
+}
+
+// contentFilterFields gets the fields of an email for the conditions, the body is only
+// decoded if a condition needs it
+type contentFilterFields struct {
+	e       *mail.Envelope
+	maxBody int
+	body    *string
+}
+
+func (c *contentFilterFields) values(field string) []string {
+	e := c.e
+	switch field {
+	case "subject":
+		return []string{e.Subject}
+	case "from":
+		return []string{e.MailFrom.String()}
+	case "to":
+		to := make([]string, len(e.RcptTo))
+		for i := range e.RcptTo {
+			to[i] = e.RcptTo[i].String()
+		}
+		return to
+	case "tenant":
+		return []string{e.Tenant}
+	case "remote_ip":
+		return []string{e.RemoteIP}
+	case "helo":
+		return []string{e.Helo}
+	case "body":
+		if c.body == nil {
+			body := plainTextBody(e.Data.Bytes(), c.maxBody)
+			c.body = &body
+		}
+		return []string{*c.body}
+	}
+	return e.HeaderIndex.GetAll(strings.TrimPrefix(field, sqlHeaderField))
+}
+
+// applies returns true when all the conditions of the rule match
+func (r *ContentFilterRule) applies(fields *contentFilterFields) bool {
+	for i := range r.Conditions {
+		c := &r.Conditions[i]
+		matched := false
+		for _, v := range fields.values(c.Field) {
+			if c.re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if matched == c.Not {
+			return false
+		}
+	}
+	return true
+}
+
+// quarantineEnvelope saves the email to the quarantine directory, as <queued id>.eml.
+// {tenant} in the directory is replaced with the envelope's tenant
+func quarantineEnvelope(dir string, e *mail.Envelope) error {
+	dir = ForTenant(dir, e.Tenant)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, e.QueuedId+".eml"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(e.DeliveryHeader); err == nil {
+		_, err = file.Write(e.Data.Bytes())
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ContentFilter checks the emails against the rules of a file
+func ContentFilter() Decorator {
+	f := &contentFilter{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ContentFilterConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*ContentFilterConfig)
+		f.reload = defaultContentFilterReload
+		if config.ReloadInterval != "" {
+			if f.reload, err = time.ParseDuration(config.ReloadInterval); err != nil || f.reload <= 0 {
+				return fmt.Errorf("invalid content_filter_reload_interval %q", config.ReloadInterval)
+			}
+		}
+		if config.MaxBody <= 0 {
+			config.MaxBody = defaultContentFilterMaxBody
+		}
+		f.config = config
+		f.checked = Now()
+		return f.load()
+	}))
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			fields := &contentFilterFields{e: e, maxBody: f.config.MaxBody}
+			for _, r := range f.current() {
+				if !r.applies(fields) {
+					continue
+				}
+				switch r.Action {
+				case ContentFilterTag:
+					tag := mail.ParseTag(r.Tag)
+					e.Tags.Add(tag.Key, tag.Value)
+				case ContentFilterReject:
+					Log().WithField("rule", r.Name).Info("contentfilter: rejected an email")
+					return NewResult(r.Reply), errContentFilterRejected
+				case ContentFilterQuarantine:
+					e.Tags.Add("filter", r.Name)
+					if err := quarantineEnvelope(f.config.QuarantineDir, e); err != nil {
+						Log().WithError(err).Error("contentfilter: could not quarantine an email")
+						return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+					}
+					Log().WithField("rule", r.Name).Infof("contentfilter: quarantined %s", e.QueuedId)
+					return BackendResultOK, nil
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContentFilterRules(t *testing.T) {
+	rules, err := parseContentFilterRules([]byte(`[
+		{"name": "bulk", "action": "tag", "if": [{"field": "header:Precedence", "match": "bulk"}]},
+		{"name": "pills", "action": "reject", "reply": "550 5.7.1 no thanks", "if": [{"field": "body", "match": "pills"}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Tag != "filter:bulk" || rules[1].Reply != "550 5.7.1 no thanks" {
+		t.Error("unexpected rules", rules)
+	}
+	for _, bad := range []string{
+		`[{"name": "x", "action": "drop", "if": [{"field": "subject", "match": "x"}]}]`,
+		`[{"name": "x", "action": "tag", "if": [{"field": "size", "match": "x"}]}]`,
+		`[{"name": "x", "action": "tag", "if": [{"field": "subject", "match": "("}]}]`,
+		`[{"name": "x", "action": "reject", "reply": "250 ok", "if": [{"field": "subject", "match": "x"}]}]`,
+		`[{"name": "x", "action": "tag"}]`,
+		`[{"action": "tag", "if": [{"field": "subject", "match": "x"}]}]`,
+	} {
+		if _, err := parseContentFilterRules([]byte(bad)); err == nil {
+			t.Error("expected the rules to be refused:", bad)
+		}
+	}
+}
+
+func TestContentFilterProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contentfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	rulesFile := filepath.Join(dir, "rules.json")
+	writeRules := func(rules string, mod time.Time) {
+		if err := ioutil.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(rulesFile, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mod := time.Now().Add(-time.Hour)
+	writeRules(`[
+		{"name": "greeting", "action": "tag", "tag": "greeting:yes", "if": [{"field": "subject", "match": "(?i)^hello"}]},
+		{"name": "pills", "action": "reject", "if": [{"field": "body", "match": "pills"}]},
+		{"name": "outsider", "action": "quarantine",
+		 "if": [{"field": "to", "match": "@other\\.com$"}, {"field": "from", "match": "@example\\.com$", "not": true}]}
+	]`, mod)
+	clock := NewManualClock(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":                  "HeadersParser|ContentFilter",
+		"content_filter_rules":          rulesFile,
+		"content_filter_quarantine_dir": filepath.Join(dir, "quarantine", "{tenant}"),
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be accepted, got", result)
+	}
+	if !e.Tags.Has("greeting") {
+		t.Error("expected the email to be tagged, got", e.Tags)
+	}
+
+	e = newBrokerTestEnvelope()
+	e.Data.WriteString("cheap pills\n")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "554 5.7.1") {
+		t.Error("expected the email to be rejected, got", result)
+	}
+
+	e = newBrokerTestEnvelope()
+	e.MailFrom.Host = "elsewhere.com"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the quarantined email to be accepted, got", result)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "quarantine", "acme", e.QueuedId+".eml"))
+	if err != nil || !strings.Contains(string(b), "Subject: hello") {
+		t.Error("expected the email to be quarantined, got", string(b), err)
+	}
+
+	// the rules are loaded again once the interval passed
+	writeRules(`[{"name": "all", "action": "reject", "reply": "451 4.7.1 later", "if": [{"field": "helo", "match": "."}]}]`,
+		mod.Add(time.Minute))
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the previous rules before the interval, got", result)
+	}
+	clock.Advance(defaultContentFilterReload)
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451 4.7.1") {
+		t.Error("expected the new rules, got", result)
+	}
+	// a broken file keeps the rules
+	writeRules(`[{"name": "broken"`, mod.Add(time.Minute*2))
+	clock.Advance(defaultContentFilterReload)
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451 4.7.1") {
+		t.Error("expected the rules to be kept, got", result)
+	}
+}
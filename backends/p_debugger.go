@@ -46,6 +46,9 @@ func Debugger() Decorator {
 				if config.LogReceivedMails {
 					Log().Infof("Mail from: %s / to: %v", e.MailFrom.String(), e.RcptTo)
 					Log().Info("Headers are:", e.Header)
+					if len(e.Tags) > 0 {
+						Log().Info("Tags are:", e.Tags.String())
+					}
 				}
 
 				if config.SleepSec > 0 {
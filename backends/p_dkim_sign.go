@@ -0,0 +1,203 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dkim_sign
+// ----------------------------------------------------------------------------------
+// Description   : Signs the emails with the DKIM key of the domain of their From
+//               : header, for the emails that are relayed with the forward processor,
+//               : in the save process or in the bounce process. The DKIM-Signature header is added on top of e.DeliveryHeader, so
+//               : it goes after the Header processor and before forward. The emails
+//               : of the other domains are passed on unsigned
+// ----------------------------------------------------------------------------------
+// Config Options: dkim_sign_keys []string - domain=selector:key, where the key is the
+//               : path of a PEM private key file, or the PEM itself. RSA keys of at
+//               : least 1024 bits, or Ed25519 keys, eg.
+//               : "example.com=mail2024:/etc/dkim/example.com.pem". Required
+//               : dkim_sign_canonicalization string - header/body canonicalization,
+//               : simple or relaxed, default "relaxed/relaxed"
+//               : dkim_sign_headers []string - the headers to sign when they're in
+//               : the email, From is always signed. The default is From, Sender,
+//               : Reply-To, Subject, Date, Message-ID, To, Cc, In-Reply-To,
+//               : References, MIME-Version, Content-Type, Content-Transfer-Encoding,
+//               : List-Id and List-Unsubscribe
+//               : dkim_sign_oversign []string - the headers that are signed once more
+//               : than they're in the email, so that the signature breaks when one is
+//               : added, eg. to replay the email with another Subject. They're signed
+//               : even when they're not in dkim_sign_headers, From always is. The
+//               : default is From, Sender, Reply-To, Subject, Date, To, Cc and
+//               : Message-ID
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the Header() processor
+// ----------------------------------------------------------------------------------
+// Output        : e.DeliveryHeader with the DKIM-Signature header on top
+//               : e.Values["dkim_domain"] string - the domain that signed the email
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dkim_sign"] = func() Decorator {
+		return DKIMSign()
+	}
+	Svc.AddWholeMessage("dkim_sign")
+}
+
+type DKIMSignProcessorConfig struct {
+	Keys             []string `json:"dkim_sign_keys"`
+	Canonicalization string   `json:"dkim_sign_canonicalization,omitempty"`
+	Headers          []string `json:"dkim_sign_headers,omitempty"`
+	Oversign         []string `json:"dkim_sign_oversign,omitempty"`
+}
+
+const defaultDKIMCanonicalization = "relaxed/relaxed"
+
+// parseDKIMSigners reads the keys of the config, returning a signer for each domain
+func parseDKIMSigners(config *DKIMSignProcessorConfig) (map[string]*dkimSigner, error) {
+	if len(config.Keys) == 0 {
+		return nil, errors.New("dkim_sign_keys is required")
+	}
+	canon := config.Canonicalization
+	if canon == "" {
+		canon = defaultDKIMCanonicalization
+	}
+	headerCanon, bodyCanon, err := parseDKIMCanonicalization(canon)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Headers) == 0 {
+		config.Headers = defaultDKIMHeaders
+	}
+	if len(config.Oversign) == 0 {
+		config.Oversign = defaultDKIMOversign
+	}
+	headers := appendDKIMHeaders([]string{"From"}, config.Headers)
+	oversign := appendDKIMHeaders([]string{"From"}, config.Oversign)
+	headers = appendDKIMHeaders(headers, oversign)
+	signers := make(map[string]*dkimSigner)
+	for _, entry := range config.Keys {
+		kv := strings.SplitN(entry, "=", 2)
+		var selector []string
+		if len(kv) == 2 {
+			selector = strings.SplitN(kv[1], ":", 2)
+		}
+		if len(selector) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(selector[0]) == "" {
+			return nil, fmt.Errorf("dkim_sign_keys entry for %q should be domain=selector:key", kv[0])
+		}
+		// the key is a file, unless it's the PEM itself
+		key := selector[1]
+		pemData := []byte(key)
+		if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+			if pemData, err = ioutil.ReadFile(key); err != nil {
+				return nil, fmt.Errorf("dkim_sign_keys: %s", err)
+			}
+		}
+		domain := strings.ToLower(strings.TrimSpace(kv[0]))
+		s := &dkimSigner{
+			domain:      domain,
+			selector:    strings.TrimSpace(selector[0]),
+			headerCanon: headerCanon,
+			bodyCanon:   bodyCanon,
+			headers:     headers,
+			oversign:    oversign,
+		}
+		if s.key, s.algorithm, err = parseDKIMKey(pemData); err != nil {
+			return nil, fmt.Errorf("dkim_sign_keys: the key of %s: %s", domain, err)
+		}
+		signers[domain] = s
+	}
+	return signers, nil
+}
+
+// appendDKIMHeaders appends the names that aren't in headers yet, ignoring the case
+func appendDKIMHeaders(headers, names []string) []string {
+	for _, h := range names {
+		dup := false
+		for _, name := range headers {
+			dup = dup || strings.EqualFold(h, name)
+		}
+		if !dup {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// fromHeaderDomain returns the domain of the From header, the domain that DKIM signs for and
+// that DMARC checks. It comes from e.Header when the headers were parsed
+func fromHeaderDomain(e *mail.Envelope) string {
+	if e.Header != nil {
+		if addr, err := mail.NewAddress(e.Header.Get("From")); err == nil {
+			return strings.ToLower(addr.Host)
+		}
+		return ""
+	}
+	return messageFromDomain(e.Data.Bytes())
+}
+
+// messageFromDomain returns the domain of the From header of a message
+func messageFromDomain(msg []byte) string {
+	fields, _ := splitDKIMMessage(msg)
+	for _, field := range fields {
+		if strings.EqualFold(field.name, "From") {
+			value := strings.Replace(field.raw[strings.IndexByte(field.raw, ':')+1:], "\r\n", "", -1)
+			if addr, err := mail.NewAddress(strings.TrimSpace(value)); err == nil {
+				return strings.ToLower(addr.Host)
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// dkimSignMessage returns the message signed with the key of the domain of its From header,
+// with the DKIM-Signature on top, or the message when none of the signers is for that domain.
+// The signature header ends its lines with CRLF, like the messages that are composed
+func dkimSignMessage(signers map[string]*dkimSigner, msg []byte) ([]byte, string, error) {
+	s, ok := signers[messageFromDomain(msg)]
+	if !ok {
+		return msg, "", nil
+	}
+	header, err := s.sign(msg, Now())
+	if err != nil {
+		return msg, "", err
+	}
+	return append([]byte(header), msg...), s.domain, nil
+}
+
+func DKIMSign() Decorator {
+	var signers map[string]*dkimSigner
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DKIMSignProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		signers, err = parseDKIMSigners(bcfg.(*DKIMSignProcessorConfig))
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if s, ok := signers[fromHeaderDomain(e)]; ok {
+					header, err := s.sign(e.Data.Bytes(), Now())
+					if err != nil {
+						Log().WithError(err).Warnf("dkim_sign: %s was not signed", e.QueuedId)
+					} else {
+						// the header is written like the delivery headers, with LF line endings
+						e.DeliveryHeader = strings.Replace(header, "\r\n", "\n", -1) + e.DeliveryHeader
+						e.Values["dkim_domain"] = s.domain
+					}
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
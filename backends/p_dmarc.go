@@ -0,0 +1,219 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dmarc
+// ----------------------------------------------------------------------------------
+// Description   : Checks the emails against the DMARC policy of the domain of their
+//               : From header. The SPF and DKIM verdicts recorded by the processors
+//               : before it are aligned with the From domain, and when neither passes
+//               : aligned, the policy applies: p=reject refuses the email, and
+//               : p=quarantine saves it to dmarc_quarantine_dir, or tags it with
+//               : quarantine:dmarc. The pct of the policy is honoured. Each evaluation
+//               : is given to the sinks added with RegisterDMARCSink, with the fields
+//               : of a record of an aggregate report
+// ----------------------------------------------------------------------------------
+// Config Options: dmarc_override string - "none" only records the evaluations, and
+//               : "quarantine" quarantines the emails that the policy would reject.
+//               : Empty (default) applies the policies
+//               : dmarc_quarantine_dir string - where quarantined emails are saved,
+//               : {tenant} is replaced. Otherwise they're tagged and passed on
+//               : dmarc_report_file string - a file the records are appended to as
+//               : json lines, {date} (2006-01-02) is replaced with the day
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : the "spf" and "dkim" verdicts, with their smtp.mailfrom and header.d
+//               : properties, see AddVerdict
+// ----------------------------------------------------------------------------------
+// Output        : a "dmarc" verdict
+//               : e.Values["dmarc"] *DMARCRecord - the evaluation
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dmarc"] = func() Decorator {
+		return DMARC()
+	}
+}
+
+type DMARCProcessorConfig struct {
+	Override      string `json:"dmarc_override,omitempty"`
+	QuarantineDir string `json:"dmarc_quarantine_dir,omitempty"`
+	ReportFile    string `json:"dmarc_report_file,omitempty"`
+}
+
+// dmarcLookupTimeout limits the lookup of a policy
+const dmarcLookupTimeout = time.Second * 5
+
+var errDMARCRejected = errors.New("dmarc: rejected by the policy of the sender's domain")
+
+// dmarcReportFile appends the records to a json lines file
+type dmarcReportFile struct {
+	name string
+	sync.Mutex
+}
+
+func (f *dmarcReportFile) write(r *DMARCRecord) error {
+	f.Lock()
+	defer f.Unlock()
+	name := strings.Replace(f.name, sampleDatePlaceholder, r.Time.Format("2006-01-02"), -1)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// evaluateDMARC checks the SPF and DKIM results against the policy, and returns the record
+// with the disposition, before any override
+func evaluateDMARC(e *mail.Envelope, from string, policy *dmarcPolicy) *DMARCRecord {
+	r := &DMARCRecord{
+		Time:            Now(),
+		Tenant:          e.Tenant,
+		QueuedID:        e.QueuedId,
+		SourceIP:        e.RemoteIP,
+		HeaderFrom:      from,
+		EnvelopeFrom:    strings.ToLower(e.MailFrom.Host),
+		PolicyDomain:    policy.domain,
+		ADKIM:           policy.adkim,
+		ASPF:            policy.aspf,
+		Policy:          policy.p,
+		SubdomainPolicy: policy.sp,
+		Pct:             policy.pct,
+		Disposition:     DMARCNone,
+		DKIM:            "fail",
+		SPF:             "fail",
+	}
+	r.SPFResults, r.DKIMResults = dmarcAuthResults(e)
+	for _, a := range r.DKIMResults {
+		if a.Result == "pass" && dmarcAligned(a.Domain, from, policy.adkim) {
+			r.DKIM = "pass"
+		}
+	}
+	for _, a := range r.SPFResults {
+		if a.Result == "pass" && dmarcAligned(a.Domain, from, policy.aspf) {
+			r.SPF = "pass"
+		}
+	}
+	if r.DKIM == "pass" || r.SPF == "pass" {
+		return r
+	}
+	r.Disposition = policy.p
+	if policy.domain != from {
+		// the policy of the organizational domain for its subdomains
+		r.Disposition = policy.sp
+	}
+	if r.Disposition != DMARCNone && policy.pct < 100 && rand.Intn(100) >= policy.pct {
+		// the emails that aren't sampled get the next policy down
+		r.Reason = "sampled_out"
+		if r.Disposition == DMARCReject {
+			r.Disposition = DMARCQuarantine
+		} else {
+			r.Disposition = DMARCNone
+		}
+	}
+	return r
+}
+
+func DMARC() Decorator {
+	var config *DMARCProcessorConfig
+	var report *dmarcReportFile
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DMARCProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*DMARCProcessorConfig)
+		switch config.Override {
+		case "", DMARCNone, DMARCQuarantine:
+		default:
+			return fmt.Errorf("invalid dmarc_override %q, expecting none or quarantine", config.Override)
+		}
+		if config.ReportFile != "" {
+			report = &dmarcReportFile{name: config.ReportFile}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			from := fromHeaderDomain(e)
+			if from == "" {
+				return p.Process(e, task)
+			}
+			props := []string{"header.from=" + from}
+			ctx, cancel := context.WithTimeout(context.Background(), dmarcLookupTimeout)
+			policy, err := lookupDMARC(ctx, from)
+			cancel()
+			if err == errDMARCNoRecord {
+				AddVerdict(e, Verdict{Method: "dmarc", Result: "none", Properties: props})
+				return p.Process(e, task)
+			} else if err != nil {
+				Log().WithError(err).Warnf("dmarc: could not look up the policy of %s", from)
+				AddVerdict(e, Verdict{Method: "dmarc", Result: "temperror", Properties: props})
+				return p.Process(e, task)
+			}
+
+			r := evaluateDMARC(e, from, policy)
+			result := "pass"
+			if r.DKIM == "fail" && r.SPF == "fail" {
+				result = "fail"
+			}
+			if (config.Override == DMARCNone && r.Disposition != DMARCNone) ||
+				(config.Override == DMARCQuarantine && r.Disposition == DMARCReject) {
+				r.Disposition, r.Reason = config.Override, "local_policy"
+			}
+			AddVerdict(e, Verdict{Method: "dmarc", Result: result, Properties: props,
+				Reason: "p=" + policy.p + " dis=" + r.Disposition})
+			e.Values["dmarc"] = r
+			if report != nil {
+				if err := report.write(r); err != nil {
+					Log().WithError(err).Error("dmarc: could not write the record")
+				}
+			}
+			sinkDMARC(r)
+
+			switch r.Disposition {
+			case DMARCReject:
+				Log().Infof("dmarc: rejected %s from %s", e.QueuedId, from)
+				return NewResult("550 5.7.1 Error: rejected by the DMARC policy of " + from), errDMARCRejected
+			case DMARCQuarantine:
+				e.Tags.Add("quarantine", "dmarc")
+				if config.QuarantineDir == "" {
+					break
+				}
+				if err := quarantineEnvelope(config.QuarantineDir, e); err != nil {
+					Log().WithError(err).Error("dmarc: could not quarantine an email")
+					return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+				}
+				Log().Infof("dmarc: quarantined %s from %s", e.QueuedId, from)
+				return BackendResultOK, nil
+			}
+			return p.Process(e, task)
+		})
+	}
+}
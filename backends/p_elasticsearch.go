@@ -0,0 +1,158 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: elasticsearch
+// ----------------------------------------------------------------------------------
+// Description   : Indexes the subject, from, to, date and optionally the text of the
+//               : body in Elasticsearch, so that mail is searchable as soon as it's
+//               : received. Documents are sent in bulk requests from a queue, so a slow
+//               : cluster doesn't hold up the workers. When the queue is full, the
+//               : documents are dropped and a warning is logged
+// ----------------------------------------------------------------------------------
+// Config Options: es_url string - URL of the cluster, eg. "http://localhost:9200".
+//               : Required
+//               : es_index string - name of the index, {tenant} is replaced with the
+//               : envelope's tenant. Defaults to "mail"
+//               : es_username, es_password string - for basic authentication
+//               : es_api_key string - base64 encoded API key, instead of a password
+//               : es_index_body bool - index the text of the body
+//               : es_max_body int - how many bytes of text to index, default 65536
+//               : es_bulk_size int - most documents in a bulk request, default 500
+//               : es_flush_interval string - how often to send the documents that are
+//               : waiting, default "1s"
+//               : es_queue_size int - most documents waiting, default 10000
+//               : es_max_retries int - how many times to retry when the cluster is
+//               : busy or can't be reached, default 3
+//               : es_timeout string - timeout of a bulk request, default "30s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId - the id of the document, place it after the processor
+//               : that saves the email, eg. "HeadersParser|Hasher|Sql|Elasticsearch"
+//               : e.Subject - set by the headersparser processor
+//               : e.Header - set by the headersparser processor
+//               : e.Tags
+// ----------------------------------------------------------------------------------
+// Output        : none, a failure to index is logged and does not fail the transaction
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["elasticsearch"] = func() Decorator {
+		return Elasticsearch()
+	}
+}
+
+type ElasticsearchConfig struct {
+	URL           string `json:"es_url"`
+	Index         string `json:"es_index,omitempty"`
+	Username      string `json:"es_username,omitempty"`
+	Password      string `json:"es_password,omitempty"`
+	APIKey        string `json:"es_api_key,omitempty"`
+	IndexBody     bool   `json:"es_index_body,omitempty"`
+	MaxBody       int    `json:"es_max_body,omitempty"`
+	BulkSize      int    `json:"es_bulk_size,omitempty"`
+	FlushInterval string `json:"es_flush_interval,omitempty"`
+	QueueSize     int    `json:"es_queue_size,omitempty"`
+	MaxRetries    int    `json:"es_max_retries,omitempty"`
+	Timeout       string `json:"es_timeout,omitempty"`
+}
+
+const (
+	defaultESIndex         = "mail"
+	defaultESMaxBody       = 65536
+	defaultESBulkSize      = 500
+	defaultESFlushInterval = time.Second
+	defaultESQueueSize     = 10000
+	defaultESMaxRetries    = 3
+	defaultESTimeout       = time.Second * 30
+)
+
+// esDuration parses the duration of the option name, def when it's empty
+func esDuration(name, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return d, nil
+}
+
+func Elasticsearch() Decorator {
+	var config *ElasticsearchConfig
+	var indexer *esIndexer
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ElasticsearchConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ElasticsearchConfig)
+		if config.URL == "" {
+			return errors.New("es_url is required by the elasticsearch processor")
+		}
+		if config.Index == "" {
+			config.Index = defaultESIndex
+		}
+		if config.MaxBody <= 0 {
+			config.MaxBody = defaultESMaxBody
+		}
+		if config.BulkSize <= 0 {
+			config.BulkSize = defaultESBulkSize
+		}
+		if config.QueueSize <= 0 {
+			config.QueueSize = defaultESQueueSize
+		}
+		if config.MaxRetries <= 0 {
+			config.MaxRetries = defaultESMaxRetries
+		}
+		interval, err := esDuration("es_flush_interval", config.FlushInterval, defaultESFlushInterval)
+		if err != nil {
+			return err
+		}
+		timeout, err := esDuration("es_timeout", config.Timeout, defaultESTimeout)
+		if err != nil {
+			return err
+		}
+		indexer = useESIndexer(config, interval, timeout)
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if indexer != nil {
+			indexer.release()
+			indexer = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				maxBody := 0
+				if config.IndexBody {
+					maxBody = config.MaxBody
+				}
+				doc, err := json.Marshal(esDocument(e, maxBody))
+				if err != nil {
+					Log().WithError(err).Warn("could not make the elasticsearch document")
+					return p.Process(e, task)
+				}
+				indexer.add(esAction{
+					// index names are lower case
+					index: strings.ToLower(ForTenant(config.Index, e.Tenant)),
+					id:    e.QueuedId,
+					doc:   doc,
+				})
+			}
+			return p.Process(e, task)
+		})
+	}
+}
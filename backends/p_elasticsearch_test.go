@@ -0,0 +1,181 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// fakeES accepts bulk requests, busy is how many requests get a 429 first
+type fakeES struct {
+	sync.Mutex
+	busy     int
+	requests int
+	indexes  []string
+	docs     map[string]esMail
+	block    chan struct{}
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if f.busy > 0 {
+		f.busy--
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	s := bufio.NewScanner(r.Body)
+	s.Buffer(nil, 1<<20)
+	var items []string
+	for s.Scan() {
+		var meta map[string]map[string]string
+		_ = json.Unmarshal(s.Bytes(), &meta)
+		s.Scan()
+		var doc esMail
+		_ = json.Unmarshal(s.Bytes(), &doc)
+		f.docs[meta["index"]["_id"]] = doc
+		f.indexes = append(f.indexes, meta["index"]["_index"])
+		items = append(items, `{"index":{"status":201}}`)
+	}
+	_, _ = w.Write([]byte(`{"errors":false,"items":[` + strings.Join(items, ",") + `]}`))
+}
+
+func (f *fakeES) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.docs)
+}
+
+func TestPlainTextBody(t *testing.T) {
+	multi := "Subject: test\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/html\r\n\r\n<p>the <b>html</b></p>\r\n" +
+		"--inner\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		"aGVsbG8gd29ybGQ=\r\n--inner--\r\n" +
+		"--outer\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nattached\r\n" +
+		"--outer--\r\n"
+	for _, test := range []struct{ msg, expect string }{
+		{"Subject: test\r\n\r\nplain body\r\n", "plain body"},
+		{multi, "hello world"},
+		{"Content-Type: text/html\r\n\r\n<html><style>p {}</style><p>café</p></html>", "café"},
+		{"Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=C3=A9 ok", "café ok"},
+		{"Content-Type: image/png\r\n\r\nxxx", ""},
+	} {
+		if text := strings.TrimSpace(plainTextBody([]byte(test.msg), 1000)); text != test.expect {
+			t.Errorf("expected %q, got %q", test.expect, text)
+		}
+	}
+	if text := plainTextBody([]byte(multi), 5); text != "hello" {
+		t.Error("expected the text to be limited, got", text)
+	}
+	// a character that doesn't fit is left out
+	if text := plainTextBody([]byte("\r\ncafé"), 4); text != "caf" {
+		t.Error("expected valid UTF-8, got", text)
+	}
+}
+
+func TestElasticsearch(t *testing.T) {
+	es := &fakeES{busy: 1, docs: make(map[string]esMail)}
+	server := httptest.NewServer(es)
+	defer server.Close()
+	defer func(d time.Duration) { esRetryBackoff = d }(esRetryBackoff)
+	esRetryBackoff = time.Millisecond
+
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	cfg := BackendConfig{
+		"save_process":      "HeadersParser|Hasher|Elasticsearch",
+		"es_url":            server.URL,
+		"es_index":          "Mail-{tenant}",
+		"es_index_body":     true,
+		"es_flush_interval": "10ms",
+	}
+	backend, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			_ = backend.Shutdown()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		e := mail.NewEnvelope("127.0.0.1", uint64(i))
+		e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+		e.RcptTo = []mail.Address{{User: "user", Host: "example.com"}}
+		e.Tenant = "acme"
+		e.Data.WriteString("Subject: test\nMessage-Id: <" + string(rune('a'+i)) + "@example.org>\n\nhello\n")
+		backend.Process(e)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for es.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := backend.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	stopped = true
+	es.Lock()
+	defer es.Unlock()
+	if len(es.docs) != 3 || es.requests < 2 {
+		t.Fatal("expected the documents to be indexed after a retry, got", len(es.docs), es.requests)
+	}
+	for id, doc := range es.docs {
+		if id != doc.QueuedId || doc.Subject != "test" || doc.Body != "hello\n" || doc.From != "sender@example.org" ||
+			len(doc.To) != 1 || doc.Tenant != "acme" || !strings.HasSuffix(doc.MessageId, "@example.org") {
+			t.Errorf("unexpected document %s %+v", id, doc)
+		}
+	}
+	if es.indexes[0] != "mail-acme" {
+		t.Error("expected the tenant's index, got", es.indexes[0])
+	}
+}
+
+func TestElasticsearchBackpressure(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	es := &fakeES{docs: make(map[string]esMail), block: make(chan struct{})}
+	server := httptest.NewServer(es)
+	defer server.Close()
+	config := &ElasticsearchConfig{URL: server.URL, BulkSize: 1, QueueSize: 2, MaxRetries: 1}
+	ix := useESIndexer(config, time.Hour, time.Second*5)
+	// the first document is sent, and the cluster doesn't answer, so the next two fill the queue
+	added := 0
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if ix.add(esAction{index: "mail", id: string(rune('a' + i)), doc: []byte("{}")}) {
+			added++
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected the documents to be added without waiting for the cluster")
+	}
+	if added != 3 {
+		t.Error("expected the queue to be full after 3 documents, got", added)
+	}
+	close(es.block)
+	ix.release()
+	if n := es.count(); n != 3 {
+		t.Error("expected the queued documents to be sent on shutdown, got", n)
+	}
+}
@@ -0,0 +1,404 @@
+package backends
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: forward
+// ----------------------------------------------------------------------------------
+// Description   : Relays the email to an upstream SMTP server, eg. a smarthost or the
+//               : next hop of a filtering gateway. The hosts are tried in order: the
+//               : next one is tried when a host can't be reached or defers the email.
+//               : The sessions are kept open and reused, see the smtp_pool_* options.
+//               : When the upstream refuses the email, the client gets its reply. When
+//               : only some recipients were refused, the email is accepted: the ones
+//               : refused with a 5xx are bounced to the sender, and the others are
+//               : retried in the background, then bounced once gw_retry_for has passed.
+//               : With forward_routes, the
+//               : recipients are sent by the route of their domain, eg. to an internal
+//               : relay, to the domain's MX hosts or over LMTP, one transaction each
+// ----------------------------------------------------------------------------------
+// Config Options: forward_hosts []string - host:port of the upstream servers, in the
+//               : order they are tried, the port defaults to 25. The route of the
+//               : domains that forward_routes doesn't route. Required without routes
+//               : forward_routes []string - the transport map, "<domain> <target>
+//               : [options]" entries, eg. "*.corp.example.com smtp:relay.corp:25",
+//               : "example.org lmtp:unix:/run/dovecot/lmtp" or "* mx tls=may".
+//               : The domain may start with "*." for the subdomains, or be "*" for
+//               : the rest. The target is smtp:<host>[,<host>...], mx or
+//               : lmtp:<address>, and the options are tls=none|may|require,
+//               : tls_skip_verify and auth=<user>:<password> or auth=none, the
+//               : defaults are the forward_* options
+//               : forward_require_tls bool - refuse hosts that don't offer STARTTLS,
+//               : otherwise STARTTLS is used when offered
+//               : forward_tls_skip_verify bool - don't verify the upstream certificates
+//               : forward_username string - authenticate with AUTH PLAIN, over TLS
+//               : forward_password string
+//               : forward_timeout string - how long a command may take, default 30s
+//               : primary_mail_host string - the name sent with EHLO
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.Data
+//               : e.DeliveryHeader generated by the Header() processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["forward_host"] string - the host that took the email, the
+//               : hosts separated by commas when it was sent by several routes
+//               : e.Values["forward_failed"] map[string]string - the reply for each
+//               : recipient that was refused, when the others were accepted
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["forward"] = func() Decorator {
+		return Forward()
+	}
+	Svc.AddWholeMessage("forward")
+}
+
+type ForwardProcessorConfig struct {
+	Hosts         []string `json:"forward_hosts,omitempty"`
+	Routes        []string `json:"forward_routes,omitempty"`
+	RequireTLS    bool     `json:"forward_require_tls,omitempty"`
+	TLSSkipVerify bool     `json:"forward_tls_skip_verify,omitempty"`
+	Username      string   `json:"forward_username,omitempty"`
+	Password      string   `json:"forward_password,omitempty"`
+	Timeout       string   `json:"forward_timeout,omitempty"`
+	PrimaryHost   string   `json:"primary_mail_host"`
+}
+
+const defaultForwardTimeout = time.Second * 30
+
+var errForwardNoTLS = errors.New("forward: the upstream doesn't offer STARTTLS")
+
+// deadlineConn moves the deadline with each read and write, so that a pooled session
+// gets the timeout for each command rather than from when it was opened
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// routes returns the transport map of forward_routes, with the route of forward_hosts for *
+// unless a route has it
+func (config *ForwardProcessorConfig) routes() (forwardRoutes, error) {
+	def := forwardRoute{
+		transport:  forwardSMTP,
+		tls:        forwardTLSMay,
+		skipVerify: config.TLSSkipVerify,
+		username:   config.Username,
+		password:   config.Password,
+	}
+	if config.RequireTLS {
+		def.tls = forwardTLSRequire
+	}
+	routes := make(forwardRoutes, len(config.Routes)+1)
+	for _, entry := range config.Routes {
+		r, err := parseForwardRoute(entry, def)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := routes[r.pattern]; ok {
+			return nil, fmt.Errorf("forward route %q: %s has another route", entry, r.pattern)
+		}
+		routes[r.pattern] = r
+	}
+	if _, ok := routes["*"]; !ok && len(config.Hosts) > 0 {
+		def.pattern = "*"
+		for _, host := range config.Hosts {
+			def.hosts = append(def.hosts, forwardHostPort(host))
+		}
+		routes["*"] = &def
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("forward_hosts or forward_routes is required by the forward processor")
+	}
+	return routes, nil
+}
+
+// dialForward opens a session with host of the route, ready for the MAIL command
+var dialForward = func(route *forwardRoute, helo, host string, timeout time.Duration) (*smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := net.SplitHostPort(host)
+	c, err := smtp.NewClient(&deadlineConn{Conn: conn, timeout: timeout}, name)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	err = func() error {
+		if err := c.Hello(helo); err != nil {
+			return err
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok && route.tls != forwardTLSNone {
+			if err := c.StartTLS(&tls.Config{
+				ServerName:         name,
+				InsecureSkipVerify: route.skipVerify,
+			}); err != nil {
+				return err
+			}
+		} else if route.tls == forwardTLSRequire {
+			return errForwardNoTLS
+		}
+		if route.username != "" {
+			return c.Auth(smtp.PlainAuth("", route.username, route.password, name))
+		}
+		return nil
+	}()
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// forwardReply is the reply of the upstream as a string, or "" when it didn't reply
+func forwardReply(err error) string {
+	if tpErr, ok := err.(*textproto.Error); ok {
+		return fmt.Sprintf("%d %s", tpErr.Code, strings.Replace(tpErr.Msg, "\n", " ", -1))
+	}
+	return ""
+}
+
+// forwardPermanent returns true when the upstream refused with a 5xx reply, so there is
+// no point trying the next host
+func forwardPermanent(err error) bool {
+	tpErr, ok := err.(*textproto.Error)
+	return ok && tpErr.Code/100 == 5
+}
+
+// forwardSend sends the envelope in the session. It returns the reply for each recipient that was
+// refused, when the others were accepted. When all of them were refused, the error is the reply
+// of the first one that may succeed later, or else the first one
+func forwardSend(s *SMTPSession, e *mail.Envelope) (map[string]string, error) {
+	from := ""
+	if !e.MailFrom.NullPath {
+		from = e.MailFrom.String()
+	}
+	if err := s.Mail(from); err != nil {
+		return nil, err
+	}
+	var failed map[string]string
+	var tempfail, permfail error
+	for i := range e.RcptTo {
+		err := s.Rcpt(e.RcptTo[i].String())
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+		if failed == nil {
+			failed = make(map[string]string)
+		}
+		failed[e.RcptTo[i].String()] = forwardReply(err)
+		if !forwardPermanent(err) && tempfail == nil {
+			tempfail = err
+		} else if permfail == nil {
+			permfail = err
+		}
+	}
+	if len(failed) == len(e.RcptTo) {
+		if tempfail != nil {
+			return nil, tempfail
+		}
+		return nil, permfail
+	}
+	w, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, e.NewReader()); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return failed, w.Close()
+}
+
+// forwardHosts sends the envelope to the first of the hosts that takes it, see forwardSend.
+// It returns the host, and the error of the last host tried when none took it
+func forwardHosts(route *forwardRoute, helo string, hosts []string, e *mail.Envelope,
+	timeout time.Duration) (failed map[string]string, host string, err error) {
+	for _, host = range hosts {
+		var s *SMTPSession
+		// the credentials are a part of the session
+		s, err = SMTPSessions.Get(route.key(host), func() (*smtp.Client, error) {
+			return dialForward(route, helo, host, timeout)
+		})
+		if err != nil {
+			Log().WithError(err).Warn("could not connect to the upstream ", host)
+			// a reply such as 535 for the credentials is not for the client
+			err = fmt.Errorf("forward: could not connect to %s: %s", host, err)
+			continue
+		}
+		failed, err = forwardSend(s, e)
+		SMTPSessions.Put(s, err)
+		if err == nil || forwardPermanent(err) {
+			break
+		}
+		Log().WithError(err).Warnf("the upstream %s did not take %s", host, e.QueuedId)
+	}
+	return failed, host, err
+}
+
+// forwardGroupSend sends the envelope to the recipients of the group by its route. It returns
+// the host that took it, or an error when none of the recipients could be sent to
+func forwardGroupSend(g *forwardGroup, helo string, e *mail.Envelope, timeout time.Duration) (map[string]string, string, error) {
+	switch {
+	case g.route == nil:
+		return nil, "", errForwardNoRoute
+	case g.route.transport == forwardLMTP:
+		failed, err := forwardLMTPDeliver(g.route.hosts[0], helo, e, timeout)
+		return failed, g.route.hosts[0], err
+	case g.route.transport == forwardMX:
+		hosts, err := forwardMXHosts(g.domain, timeout)
+		if err != nil {
+			return nil, "", err
+		}
+		return forwardHosts(g.route, helo, hosts, e, timeout)
+	}
+	return forwardHosts(g.route, helo, g.route.hosts, e, timeout)
+}
+
+// forwardDeliver sends the envelope to each group of recipients that the routes make. It returns
+// the reply for each recipient that failed, the host that took each of the others, and the hosts
+// in the order they were used. The errors are the first temporary and permanent failures of a group
+func forwardDeliver(routes forwardRoutes, helo string, e *mail.Envelope, timeout time.Duration) (
+	failed, relayed map[string]string, hosts []string, tempfail, permfail error) {
+	rcptTo := e.RcptTo
+	failed = make(map[string]string)
+	relayed = make(map[string]string, len(rcptTo))
+	hostsSeen := make(map[string]bool)
+	for _, g := range routes.group(rcptTo) {
+		// each group is a transaction with only its recipients
+		e.RcptTo = g.rcpts
+		groupFailed, host, err := forwardGroupSend(g, helo, e, timeout)
+		e.RcptTo = rcptTo
+		if err != nil {
+			reply := forwardReply(err)
+			if reply == "" {
+				reply = err.Error()
+			}
+			for _, rcpt := range g.rcpts {
+				failed[rcpt.String()] = reply
+			}
+			if !forwardPermanent(err) && tempfail == nil {
+				tempfail = err
+			} else if forwardPermanent(err) && permfail == nil {
+				permfail = err
+			}
+			continue
+		}
+		for _, rcpt := range g.rcpts {
+			if reply, ok := groupFailed[rcpt.String()]; ok {
+				failed[rcpt.String()] = reply
+			} else {
+				relayed[rcpt.String()] = host
+			}
+		}
+		if !hostsSeen[host] {
+			hostsSeen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return failed, relayed, hosts, tempfail, permfail
+}
+
+// forwardRetry returns the RetryFunc that sends the email again with the routes
+func forwardRetry(routes forwardRoutes, helo string, timeout time.Duration) RetryFunc {
+	return func(e *mail.Envelope) map[string]string {
+		failed, relayed, _, _, _ := forwardDeliver(routes, helo, e, timeout)
+		for i := range e.RcptTo {
+			if host, ok := relayed[e.RcptTo[i].String()]; ok {
+				TrackRcptDelivery(e, e.RcptTo[i], DeliveryRelayed, host)
+			}
+		}
+		return failed
+	}
+}
+
+func Forward() Decorator {
+	var config *ForwardProcessorConfig
+	var routes forwardRoutes
+	timeout := defaultForwardTimeout
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ForwardProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ForwardProcessorConfig)
+		if routes, err = config.routes(); err != nil {
+			return err
+		}
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid forward_timeout %q", config.Timeout)
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			failed, relayed, hosts, tempfail, permfail := forwardDeliver(routes, config.PrimaryHost, e, timeout)
+			if len(hosts) == 0 {
+				// none of the recipients were sent to, the client may retry unless it's permanent
+				err := tempfail
+				if err == nil {
+					err = permfail
+				}
+				for i := range e.RcptTo {
+					TrackRcptDelivery(e, e.RcptTo[i], DeliveryRejected, err.Error())
+				}
+				if reply := forwardReply(err); reply != "" {
+					return NewResult(reply), err
+				}
+				return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+			}
+			var deferred []mail.Address
+			for i := range e.RcptTo {
+				rcpt := e.RcptTo[i]
+				if host, ok := relayed[rcpt.String()]; ok {
+					TrackRcptDelivery(e, rcpt, DeliveryRelayed, host)
+				} else if reply := failed[rcpt.String()]; strings.HasPrefix(reply, "5") {
+					BounceRcpt(e, rcpt, reply)
+				} else {
+					deferred = append(deferred, rcpt)
+				}
+			}
+			if len(deferred) > 0 {
+				RetryRcpts(e, deferred, forwardRetry(routes, config.PrimaryHost, timeout))
+			}
+			if len(failed) > 0 {
+				Log().Warnf("forwarded %s to %d of %d recipients, failed: %v",
+					e.QueuedId, len(e.RcptTo)-len(failed), len(e.RcptTo), failed)
+				e.Values["forward_failed"] = failed
+			}
+			e.Values["forward_host"] = strings.Join(hosts, ",")
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpstream is an SMTP server that knows bob and full, whose mailbox is full.
+// It answers MAIL with mailReply, when it's set
+type fakeUpstream struct {
+	ln        net.Listener
+	mailReply string
+	delivered map[string]string
+	sync.Mutex
+}
+
+func newFakeUpstream(t *testing.T, mailReply string) *fakeUpstream {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUpstream{ln: ln, mailReply: mailReply, delivered: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeUpstream) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, _ = fmt.Fprint(conn, s+"\r\n")
+	}
+	reply("220 upstream ready")
+	var rcpts []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "EHLO "):
+			reply("250-upstream\r\n250 8BITMIME")
+		case strings.HasPrefix(line, "MAIL FROM:"):
+			rcpts = nil
+			if f.mailReply != "" {
+				reply(f.mailReply)
+			} else {
+				reply("250 2.1.0 OK")
+			}
+		case strings.HasPrefix(line, "RCPT TO:"):
+			rcpt := strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			switch {
+			case strings.HasPrefix(rcpt, "bob@"):
+				rcpts = append(rcpts, rcpt)
+				reply("250 2.1.5 OK")
+			case strings.HasPrefix(rcpt, "full@"):
+				reply("452 4.2.2 Mailbox is full")
+			default:
+				reply("550 5.1.1 User unknown")
+			}
+		case line == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			f.Lock()
+			for _, rcpt := range rcpts {
+				f.delivered[rcpt] = data.String()
+			}
+			f.Unlock()
+			reply("250 2.0.0 queued")
+		case line == "RSET":
+			rcpts = nil
+			reply("250 2.0.0 OK")
+		case line == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("500 5.5.1 Unknown command")
+		}
+	}
+}
+
+func TestForwardProcessor(t *testing.T) {
+	// nothing listens on down
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	_ = ln.Close()
+	deferring := newFakeUpstream(t, "421 4.3.2 Try again later")
+	refusing := newFakeUpstream(t, "554 5.7.1 Relay denied")
+	good := newFakeUpstream(t, "")
+	for _, f := range []*fakeUpstream{deferring, refusing, good} {
+		defer func(f *fakeUpstream) {
+			_ = f.ln.Close()
+		}(f)
+	}
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Forward|Debugger",
+		"primary_mail_host": "mail.acme.com",
+		"forward_hosts":     []interface{}{down, deferring.ln.Addr().String(), good.ln.Addr().String()},
+		"forward_timeout":   "5s",
+	})
+	// the next hosts are tried, eve is refused and only bob is delivered
+	e := newBrokerTestEnvelope()
+	e.RcptTo[0].User = "bob"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected a partial delivery to be accepted, got", result)
+	}
+	if data := good.delivered["bob@Acme.com"]; !strings.HasSuffix(data, "Subject: hello\r\nMessage-Id: <m1@example.com>\r\n\r\nhi\r\n") {
+		t.Errorf("unexpected delivery %q", data)
+	}
+	if e.Values["forward_host"] != good.ln.Addr().String() {
+		t.Error("expected the good host to take it, got", e.Values["forward_host"])
+	}
+	if failed, _ := e.Values["forward_failed"].(map[string]string); len(failed) != 1 ||
+		failed["eve@other.com"] != "550 5.1.1 User unknown" {
+		t.Error("expected eve's refusal to be recorded, got", e.Values["forward_failed"])
+	}
+	if bounced, _ := e.Values[bouncedValue].([]BouncedRcpt); len(bounced) != 1 ||
+		bounced[0].Rcpt.String() != "eve@other.com" || bounced[0].Reply != "550 5.1.1 User unknown" {
+		t.Error("expected eve to be bounced, got", e.Values[bouncedValue])
+	}
+
+	// full is deferred, and retried once the email is accepted
+	e = newBrokerTestEnvelope()
+	e.RcptTo[1].User = "full"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected a partial delivery to be accepted, got", result)
+	}
+	if retries, _ := e.Values[retryValue].([]retryRcpts); len(retries) != 1 || len(retries[0].rcpts) != 1 {
+		t.Error("expected full to be retried, got", e.Values[retryValue])
+	} else {
+		c := e.Clone()
+		c.RcptTo = retries[0].rcpts
+		if failed := retries[0].retry(c); failed["full@other.com"] != "452 4.2.2 Mailbox is full" {
+			t.Error("expected the retry to be deferred again, got", failed)
+		}
+	}
+
+	// none accepted, the temporary failure is preferred
+	e = newBrokerTestEnvelope()
+	e.RcptTo[0].User = "full"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "452 4.2.2") {
+		t.Error("expected the mailbox full tempfail, got", result)
+	}
+	e = newBrokerTestEnvelope()
+	e.RcptTo = e.RcptTo[1:]
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "550 5.1.1") {
+		t.Error("expected the unknown user to be refused, got", result)
+	}
+	// the sessions with the good host were reused
+	if stats := SMTPSessions.Stats(); stats.Reuses == 0 {
+		t.Error("expected the sessions to be reused, got", stats)
+	}
+	_ = backend.Shutdown()
+
+	// a permanent refusal is not retried with the next host
+	backend = newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Forward|Debugger",
+		"primary_mail_host": "mail.acme.com",
+		"forward_hosts":     []interface{}{refusing.ln.Addr().String(), good.ln.Addr().String()},
+	})
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "554 5.7.1 Relay denied") {
+		t.Error("expected the upstream's refusal, got", result)
+	}
+	_ = backend.Shutdown()
+
+	// none of the hosts are up
+	backend = newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Forward|Debugger",
+		"primary_mail_host": "mail.acme.com",
+		"forward_hosts":     []interface{}{down},
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail, got", result)
+	}
+}
@@ -0,0 +1,287 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/ipaddr"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: greylist
+// ----------------------------------------------------------------------------------
+// Description   : Greylists the triplets of the client's network, the sender and the
+//               : recipient: the first attempt is deferred with a 451, and a retry
+//               : after greylist_delay is let through, as most spam is not retried.
+//               : In the validate_process, each recipient is checked when it's given,
+//               : in save_process all of them are checked at the end of DATA. Use one
+//               : of them. Clients that logged in are not greylisted, and the probes
+//               : of VRFY aren't checked, see VerifyOnly
+// ----------------------------------------------------------------------------------
+// Config Options: greylist_delay string - how long a client must wait before it retries,
+//               : default "5m"
+//               : greylist_retry_window string - a retry after this long is seen as a
+//               : new attempt, default "48h"
+//               : greylist_expire string - how long a triplet that was let through,
+//               : and a whitelisted client, are remembered since the last time they
+//               : were seen, default "840h" (35 days)
+//               : greylist_whitelist_after int - a client whose triplets were let
+//               : through this many times isn't greylisted any more, default 5, and
+//               : -1 doesn't whitelist clients
+//               : greylist_ipv4_prefix int - the network of an IPv4 client, so that a
+//               : retry from another server of the same pool counts, default 24
+//               : greylist_ipv6_prefix int - the network of an IPv6 client, default 64
+//               : greylist_exempt []string - networks that aren't greylisted, eg.
+//               : ["10.0.0.0/8", "2001:db8::/32"]
+//               : greylist_store string - "memory", the default, or "redis" to share
+//               : the triplets between the nodes, with the redis_* options of the
+//               : redis processor. The greylist_cleanup job of maintenance_schedule
+//               : drops the expired triplets of the memory store
+//               : greylist_key_prefix string - prepended to the keys, default
+//               : "greylist:"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP, e.MailFrom, e.RcptTo, e.AuthorizedLogin
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags - "greylist:deferred" or "greylist:passed"
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["greylist"] = func() Decorator {
+		return Greylist()
+	}
+}
+
+type GreylistProcessorConfig struct {
+	Delay          string   `json:"greylist_delay,omitempty"`
+	RetryWindow    string   `json:"greylist_retry_window,omitempty"`
+	Expire         string   `json:"greylist_expire,omitempty"`
+	WhitelistAfter int      `json:"greylist_whitelist_after,omitempty"`
+	IPv4Prefix     int      `json:"greylist_ipv4_prefix,omitempty"`
+	IPv6Prefix     int      `json:"greylist_ipv6_prefix,omitempty"`
+	Exempt         []string `json:"greylist_exempt,omitempty"`
+	Store          string   `json:"greylist_store,omitempty"`
+	KeyPrefix      string   `json:"greylist_key_prefix,omitempty"`
+}
+
+const (
+	defaultGreylistDelay          = time.Minute * 5
+	defaultGreylistRetryWindow    = time.Hour * 48
+	defaultGreylistExpire         = time.Hour * 24 * 35
+	defaultGreylistWhitelistAfter = 5
+	defaultGreylistKeyPrefix      = "greylist:"
+)
+
+// Greylisted is returned when a recipient was greylisted, so that the client gets a 451 and tries again
+var Greylisted = RcptError(errors.New("greylisted, try again later"))
+
+// greylist decides whether to let the triplets through
+type greylist struct {
+	delay          time.Duration
+	retryWindow    time.Duration
+	expire         time.Duration
+	whitelistAfter int
+	ipv4Mask       net.IPMask
+	ipv6Mask       net.IPMask
+	exempt         []*net.IPNet
+	prefix         string
+	store          GreylistStore
+}
+
+// greylistDuration parses the duration of an option, or returns the default when it's not set
+func greylistDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+func newGreylist(config *GreylistProcessorConfig, backendConfig BackendConfig) (*greylist, error) {
+	g := &greylist{whitelistAfter: config.WhitelistAfter, prefix: config.KeyPrefix}
+	var err error
+	if g.delay, err = greylistDuration("greylist_delay", config.Delay, defaultGreylistDelay); err != nil {
+		return nil, err
+	}
+	if g.retryWindow, err = greylistDuration("greylist_retry_window", config.RetryWindow, defaultGreylistRetryWindow); err != nil {
+		return nil, err
+	}
+	if g.expire, err = greylistDuration("greylist_expire", config.Expire, defaultGreylistExpire); err != nil {
+		return nil, err
+	}
+	if g.retryWindow <= g.delay {
+		return nil, errors.New("greylist_retry_window must be longer than greylist_delay")
+	}
+	if g.whitelistAfter == 0 {
+		g.whitelistAfter = defaultGreylistWhitelistAfter
+	}
+	ipv4, ipv6 := config.IPv4Prefix, config.IPv6Prefix
+	if ipv4 == 0 {
+		ipv4 = 24
+	}
+	if ipv6 == 0 {
+		ipv6 = 64
+	}
+	if ipv4 < 0 || ipv4 > 32 || ipv6 < 0 || ipv6 > 128 {
+		return nil, errors.New("greylist_ipv4_prefix must be up to 32, and greylist_ipv6_prefix up to 128")
+	}
+	g.ipv4Mask, g.ipv6Mask = net.CIDRMask(ipv4, 32), net.CIDRMask(ipv6, 128)
+	for _, network := range config.Exempt {
+		ipNet, err := ipaddr.Network(network)
+		if err != nil {
+			return nil, fmt.Errorf("greylist_exempt: %s", err)
+		}
+		g.exempt = append(g.exempt, ipNet)
+	}
+	if g.prefix == "" {
+		g.prefix = defaultGreylistKeyPrefix
+	}
+	store := config.Store
+	if store == "" {
+		store = "memory"
+	}
+	newStore, ok := GreylistStores[store]
+	if !ok {
+		return nil, fmt.Errorf("unknown greylist_store %q", config.Store)
+	}
+	if g.store, err = newStore(backendConfig); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// client returns the network of the client's address, "" when it's exempt or not an address
+func (g *greylist) client(remoteIP string) string {
+	ip := ipaddr.Parse(remoteIP)
+	if ip == nil {
+		return ""
+	}
+	for _, network := range g.exempt {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(g.ipv4Mask).String()
+	}
+	return ip.Mask(g.ipv6Mask).String()
+}
+
+// allow returns true when the triplet of the client, the sender and the recipient may pass
+func (g *greylist) allow(client, from, rcpt string) (bool, error) {
+	now := Now()
+	clientKey := g.prefix + "client:" + client
+	c, whitelisted, err := g.store.Get(clientKey)
+	if err != nil {
+		return false, err
+	}
+	if whitelisted && g.whitelistAfter > 0 && c.Passed >= g.whitelistAfter {
+		return true, g.store.Set(clientKey, c, g.expire)
+	}
+	key := g.prefix + client + "/" + strings.ToLower(from) + "/" + strings.ToLower(rcpt)
+	r, ok, err := g.store.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !ok || r.Passed == 0 && now.Sub(r.First) > g.retryWindow {
+		// the first attempt, or the last one was too long ago
+		return false, g.store.Set(key, GreylistRecord{First: now}, g.retryWindow)
+	}
+	if r.Passed == 0 && now.Sub(r.First) < g.delay {
+		// retried too early, the triplet's first attempt counts
+		return false, nil
+	}
+	r.Passed++
+	if err := g.store.Set(key, r, g.expire); err != nil {
+		return false, err
+	}
+	if g.whitelistAfter > 0 {
+		c.Passed++
+		if err := g.store.Set(clientKey, c, g.expire); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// check checks the triplets of the recipients, all of them even when one is deferred, so that they all
+// pass on the retry
+func (g *greylist) check(e *mail.Envelope, rcpts []mail.Address) (bool, error) {
+	if e.AuthorizedLogin != "" {
+		return true, nil
+	}
+	client := g.client(e.RemoteIP)
+	if client == "" {
+		return true, nil
+	}
+	from := "<>"
+	if !e.MailFrom.NullPath {
+		from = e.MailFrom.String()
+	}
+	pass := true
+	for i := range rcpts {
+		ok, err := g.allow(client, from, rcpts[i].String())
+		if err != nil {
+			return false, err
+		}
+		pass = pass && ok
+	}
+	return pass, nil
+}
+
+func Greylist() Decorator {
+	var g *greylist
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&GreylistProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		if g, err = newGreylist(bcfg.(*GreylistProcessorConfig), backendConfig); err != nil {
+			return err
+		}
+		trackGreylistStore(g.store, true)
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if g != nil {
+			trackGreylistStore(g.store, false)
+			return g.store.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			var rcpts []mail.Address
+			if task == TaskValidateRcpt && IsVerifyOnly(e) {
+				// a probe must not record a triplet
+				return p.Process(e, task)
+			} else if task == TaskValidateRcpt && len(e.RcptTo) > 0 {
+				rcpts = e.RcptTo[len(e.RcptTo)-1:]
+			} else if task == TaskSaveMail {
+				rcpts = e.RcptTo
+			} else {
+				return p.Process(e, task)
+			}
+			pass, err := g.check(e, rcpts)
+			if err != nil {
+				// the mail isn't held up when the store can't be reached
+				Log().WithError(err).Warn("greylist: could not check ", e.RemoteIP)
+				return p.Process(e, task)
+			}
+			if !pass {
+				e.Tags.Add("greylist", "deferred")
+				Log().WithField("ip", e.RemoteIP).Infof("greylist: deferred %s", e.MailFrom.String())
+				return NewResult("451 4.7.1 Greylisted, please try again later"), Greylisted
+			}
+			e.Tags.Add("greylist", "passed")
+			return p.Process(e, task)
+		})
+	}
+}
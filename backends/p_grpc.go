@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: grpc
+// ----------------------------------------------------------------------------------
+// Description   : Calls an external service that implements the Processor service of
+//               : processor.proto over gRPC, so that processors can be written in any
+//               : language. Go services can use the stubs in backends/processorpb.
+//               : SaveMail streams the envelope, then the message in chunks, and the
+//               : service replies with an SMTP code: 2xx passes the email on to the
+//               : next processor with the tags of the reply, 4xx or 5xx is returned
+//               : to the client. When the service can't be called, the client gets a
+//               : 451. The connection is kept open for the next emails
+// ----------------------------------------------------------------------------------
+// Config Options: grpc_address string - host:port of the service, or unix:/path of a
+//               : socket. Required
+//               : grpc_tls bool - connect with TLS
+//               : grpc_ca_file string - PEM file of the CAs to verify the service with,
+//               : instead of the system's
+//               : grpc_tls_skip_verify bool - don't verify the service's certificate
+//               : grpc_timeout string - deadline of each call, default "30s"
+//               : grpc_validate_rcpt bool - call ValidateRcpt for each recipient when
+//               : it's added, and refuse the ones that get a 5xx
+//               : grpc_chunk_size int - bytes of the message in each request, default
+//               : 65536
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader generated by the Header() processor
+//               : e.Subject - set by the headersparser processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags - the tags of the reply
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["grpc"] = func() Decorator {
+		return GRPC()
+	}
+	Svc.AddWholeMessage("grpc")
+}
+
+type GRPCProcessorConfig struct {
+	Address       string `json:"grpc_address"`
+	TLS           bool   `json:"grpc_tls,omitempty"`
+	CAFile        string `json:"grpc_ca_file,omitempty"`
+	TLSSkipVerify bool   `json:"grpc_tls_skip_verify,omitempty"`
+	Timeout       string `json:"grpc_timeout,omitempty"`
+	ValidateRcpt  bool   `json:"grpc_validate_rcpt,omitempty"`
+	ChunkSize     int    `json:"grpc_chunk_size,omitempty"`
+}
+
+const (
+	defaultGRPCTimeout   = time.Second * 30
+	defaultGRPCChunkSize = 64 * 1024
+)
+
+var errGRPCRefused = errors.New("grpc: the service did not accept the email")
+
+// grpcTLSConfig returns the TLS config to connect to the service with, or nil without grpc_tls
+func grpcTLSConfig(config *GRPCProcessorConfig) (*tls.Config, error) {
+	if !config.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.TLSSkipVerify}
+	if config.CAFile != "" {
+		pool, err := readCAFile("grpc_ca_file", config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func GRPC() Decorator {
+	var config *GRPCProcessorConfig
+	var client *grpcClient
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&GRPCProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*GRPCProcessorConfig)
+		if config.Address == "" {
+			return errors.New("grpc_address is required by the grpc processor")
+		}
+		timeout := defaultGRPCTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid grpc_timeout %q", config.Timeout)
+			}
+		}
+		if config.ChunkSize <= 0 {
+			config.ChunkSize = defaultGRPCChunkSize
+		}
+		tlsConfig, err := grpcTLSConfig(config)
+		if err != nil {
+			return err
+		}
+		client, err = newGRPCClient(config.Address, tlsConfig, timeout)
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if client != nil {
+			return client.close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && config.ValidateRcpt && len(e.RcptTo) > 0 {
+				reply, err := client.validateRcpt(e)
+				if err != nil {
+					// the email is refused or deferred with DATA instead
+					Log().WithError(err).Warn("could not call the grpc service to validate a recipient")
+					return p.Process(e, task)
+				}
+				switch reply.GetCode() / 100 {
+				case 5:
+					return NewResult(grpcReply(reply)), NoSuchUser
+				case 4:
+					return NewResult(grpcReply(reply)), StorageTooBusy
+				}
+				return p.Process(e, task)
+			}
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			reply, err := client.saveMail(e, config.ChunkSize)
+			if err != nil {
+				Log().WithError(err).Warn("grpc SaveMail failed for ", e.QueuedId)
+				return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+			}
+			if reply.GetCode() != 0 && reply.GetCode()/100 != 2 {
+				Log().Infof("the grpc service did not accept %s: %s", e.QueuedId, grpcReply(reply))
+				return NewResult(grpcReply(reply)), errGRPCRefused
+			}
+			tags := reply.GetTags()
+			keys := make([]string, 0, len(tags))
+			for key := range tags {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				e.Tags.Add(key, tags[key])
+			}
+			return p.Process(e, task)
+		})
+	}
+}
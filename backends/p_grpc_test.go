@@ -0,0 +1,201 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends/processorpb"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/tests/testcert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// fakeProcessorService implements the Processor service of processor.proto
+type fakeProcessorService struct {
+	processorpb.UnimplementedProcessorServer
+	sync.Mutex
+	code  int32
+	fail  codes.Code
+	delay time.Duration
+	// early replies after the envelope, without reading the message
+	early    bool
+	from     string
+	rcpts    []string
+	subject  string
+	message  bytes.Buffer
+	chunks   int
+	deadline bool
+}
+
+func (s *fakeProcessorService) ValidateRcpt(_ context.Context, req *processorpb.ValidateRcptRequest) (*processorpb.Reply, error) {
+	if strings.HasPrefix(req.GetRcpt(), "nobody@") {
+		return &processorpb.Reply{Code: 550, Message: "5.1.1 No such user"}, nil
+	}
+	return &processorpb.Reply{Code: 250, Message: "ok"}, nil
+}
+
+func (s *fakeProcessorService) SaveMail(stream processorpb.Processor_SaveMailServer) error {
+	s.Lock()
+	defer s.Unlock()
+	_, s.deadline = stream.Context().Deadline()
+	time.Sleep(s.delay)
+	s.message.Reset()
+	s.chunks = 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if env := req.GetEnvelope(); env != nil {
+			s.from, s.rcpts, s.subject = env.GetMailFrom(), env.GetRcptTo(), env.GetSubject()
+			if s.early {
+				break
+			}
+			continue
+		}
+		s.chunks++
+		s.message.Write(req.GetChunk())
+	}
+	if s.fail != codes.OK {
+		return status.Error(s.fail, "service unavailable")
+	}
+	return stream.SendAndClose(&processorpb.Reply{Code: s.code, Message: "ok", Tags: map[string]string{"spam": "no"}})
+}
+
+// startFakeProcessorService serves the service on a local port, and returns its address
+func startFakeProcessorService(t *testing.T, svc *fakeProcessorService, opts ...grpc.ServerOption) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(opts...)
+	processorpb.RegisterProcessorServer(server, svc)
+	go func() {
+		_ = server.Serve(l)
+	}()
+	return l.Addr().String(), server.Stop
+}
+
+func TestGRPCProcessor(t *testing.T) {
+	svc := &fakeProcessorService{}
+	address, stop := startFakeProcessorService(t, svc)
+	defer stop()
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":       "HeadersParser|GRPC|Debugger",
+		"validate_process":   "GRPC",
+		"grpc_address":       address,
+		"grpc_timeout":       "1s",
+		"grpc_validate_rcpt": true,
+		"grpc_chunk_size":    10,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be saved, got", result)
+	}
+	if svc.message.String() != e.String() || svc.chunks != 5 {
+		t.Errorf("expected the message in 5 chunks, got %d: %q", svc.chunks, svc.message.String())
+	}
+	if svc.from != "test@example.com" || strings.Join(svc.rcpts, ",") != "bob@Acme.com,eve@other.com" ||
+		svc.subject != "hello" || !svc.deadline {
+		t.Error("unexpected envelope", svc.from, svc.rcpts, svc.subject, svc.deadline)
+	}
+	if !e.Tags.Has("spam") || e.Tags.Values("spam")[0] != "no" {
+		t.Error("expected the tags of the reply, got", e.Tags.Strings())
+	}
+
+	if err := backend.ValidateRcpt(e); err != nil {
+		t.Error("expected eve to be valid, got", err)
+	}
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "nobody", Host: "other.com"})
+	if err := backend.ValidateRcpt(e); err != NoSuchUser {
+		t.Error("expected nobody to be refused, got", err)
+	}
+
+	svc.code = 452
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "452 ok") {
+		t.Error("expected the reply of the service, got", result)
+	}
+	// the service may reply before it read all of the message
+	svc.early = true
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "452 ok") {
+		t.Error("expected the early reply of the service, got", result)
+	}
+	svc.code, svc.early, svc.fail = 0, false, codes.Unavailable
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail when the call fails, got", result)
+	}
+	svc.fail, svc.delay = codes.OK, time.Millisecond*1500
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail past the deadline, got", result)
+	}
+	svc.Lock()
+	svc.delay = 0
+	svc.Unlock()
+}
+
+func TestGRPCProcessorTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	prefix := dir + string(filepath.Separator)
+	if err := testcert.GenerateCert("127.0.0.1", "", time.Hour, false, 2048, "P256", prefix); err != nil {
+		t.Fatal(err)
+	}
+	caFile := prefix + "127.0.0.1.cert.pem"
+	creds, err := credentials.NewServerTLSFromFile(caFile, prefix+"127.0.0.1.key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &fakeProcessorService{}
+	address, stop := startFakeProcessorService(t, svc, grpc.Creds(creds))
+	defer stop()
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process": "GRPC|Debugger",
+		"grpc_address": address,
+		"grpc_tls":     true,
+		"grpc_ca_file": caFile,
+	})
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the email to be saved over TLS, got", result)
+	}
+	if svc.message.String() != e.String() || svc.chunks != 1 {
+		t.Errorf("unexpected message in %d chunks: %q", svc.chunks, svc.message.String())
+	}
+	_ = backend.Shutdown()
+
+	if _, err := New(BackendConfig{
+		"save_process": "GRPC",
+		"grpc_address": "127.0.0.1:1",
+		"grpc_tls":     true,
+		"grpc_ca_file": filepath.Join(dir, "missing.pem"),
+	}, Log()); err == nil {
+		t.Error("expected a missing grpc_ca_file to be refused")
+	}
+	// the initializers of the backend that failed are left behind
+	Svc.reset()
+}
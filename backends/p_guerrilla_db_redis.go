@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/artpar/go-guerrilla/ipaddr"
 	"github.com/artpar/go-guerrilla/mail"
 )
 
@@ -31,6 +32,7 @@ func init() {
 	processors["guerrillaredisdb"] = func() Decorator {
 		return GuerrillaDbRedis()
 	}
+	Svc.AddWholeMessage("guerrillaredisdb")
 }
 
 var queryBatcherId = 0
@@ -478,11 +480,12 @@ func GuerrillaDbRedis() Decorator {
 					data.String(),
 					hash,
 					trimToLimit(to, 255),
-					e.RemoteIP,
+					ipaddr.Bytes(e.RemoteIP),
 					trimToLimit(e.MailFrom.String(), 255),
 					e.TLS)
 				// give the values to a random query batcher
 				feeders[rand.Intn(len(feeders))] <- vals
+				TrackDelivery(e, DeliveryStored, "guerrilladbredis")
 				return p.Process(e, task)
 
 			} else {
@@ -1,7 +1,6 @@
 package backends
 
 import (
-	"crypto/md5"
 	"fmt"
 	"io"
 	"strings"
@@ -13,14 +12,17 @@ import (
 // ----------------------------------------------------------------------------------
 // Processor Name: hasher
 // ----------------------------------------------------------------------------------
-// Description   : Generates a unique md5 checksum id for an email
+// Description   : Generates a unique checksum id for an email, for each recipient
 // ----------------------------------------------------------------------------------
-// Config Options: None
+// Config Options: hash_algorithm string - md5 (default), sha1, sha256, sha512, blake3
+//               : or any algorithm added with mail.RegisterHash
 // --------------:-------------------------------------------------------------------
-// Input         : e.MailFrom, e.Subject, e.RcptTo
+// Input         : e.MailFrom, e.Subject, e.RcptTo, e.BodyHash
 //               : assuming e.Subject was generated by "headersparser" processor
+//               : e.BodyHash is computed by the server while receiving the body,
+//               : if missing, it is computed from e.Data
 // ----------------------------------------------------------------------------------
-// Output        : Checksum stored in e.Hash
+// Output        : Checksums appended to e.Hashes, algorithm stored in e.HashAlgorithm
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["hasher"] = func() Decorator {
@@ -28,26 +30,65 @@ func init() {
 	}
 }
 
+type HasherConfig struct {
+	Algorithm string `json:"hash_algorithm,omitempty"`
+}
+
+const defaultHashAlgorithm = "md5"
+
 // The hasher decorator computes a hash of the email for each recipient
 // It appends the hashes to envelope's Hashes slice.
 func Hasher() Decorator {
+	config := &HasherConfig{Algorithm: defaultHashAlgorithm}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&HasherConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*HasherConfig)
+		if config.Algorithm == "" {
+			config.Algorithm = defaultHashAlgorithm
+		}
+		config.Algorithm = strings.ToLower(config.Algorithm)
+		if _, err := mail.NewHash(config.Algorithm); err != nil {
+			return err
+		}
+		// hash the body as it streams in, instead of going over e.Data again later
+		Svc.SetStreamHash(config.Algorithm)
+		return nil
+	}))
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 
 			if task == TaskSaveMail {
-				// base hash, use subject from and timestamp-nano
-				h := md5.New()
+				bodyHash := e.BodyHash
+				if bodyHash == nil || e.HashAlgorithm != config.Algorithm {
+					// the body was not hashed while it was received
+					h, err := mail.NewHash(config.Algorithm)
+					if err != nil {
+						return NewResult(fmt.Sprintf("554 Error: %s", err)), err
+					}
+					_, _ = h.Write(e.Data.Bytes())
+					bodyHash = h.Sum(nil)
+				}
+				// base hash, use body, subject, from and timestamp-nano
+				h, _ := mail.NewHash(config.Algorithm)
 				ts := fmt.Sprintf("%d", time.Now().UnixNano())
-				_, _ = io.Copy(h, strings.NewReader(e.MailFrom.String()))
-				_, _ = io.Copy(h, strings.NewReader(e.Subject))
-				_, _ = io.Copy(h, strings.NewReader(ts))
+				_, _ = h.Write(bodyHash)
+				_, _ = io.WriteString(h, e.MailFrom.String())
+				_, _ = io.WriteString(h, e.Subject)
+				_, _ = io.WriteString(h, ts)
+				base := h.Sum(nil)
 				// using the base hash, calculate a unique hash for each recipient
 				for i := range e.RcptTo {
-					h2 := h
-					_, _ = io.Copy(h2, strings.NewReader(e.RcptTo[i].String()))
-					sum := h2.Sum([]byte{})
-					e.Hashes = append(e.Hashes, fmt.Sprintf("%x", sum))
+					h.Reset()
+					_, _ = h.Write(base)
+					_, _ = io.WriteString(h, e.RcptTo[i].String())
+					e.Hashes = append(e.Hashes, fmt.Sprintf("%x", h.Sum(nil)))
 				}
+				e.HashAlgorithm = config.Algorithm
+				e.BodyHash = bodyHash
 				return p.Process(e, task)
 			} else {
 				return p.Process(e, task)
@@ -0,0 +1,49 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestHasher(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	tests := []struct {
+		algorithm string
+		length    int
+	}{
+		{"", 32},
+		{"sha256", 64},
+		{"BLAKE3", 64},
+	}
+	for _, tt := range tests {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, Hasher())
+		if errs := Svc.initialize(BackendConfig{"hash_algorithm": tt.algorithm}); errs != nil {
+			t.Fatal(tt.algorithm, "initialize:", errs)
+		}
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+		e.RcptTo = []mail.Address{{User: "a", Host: "example.com"}, {User: "b", Host: "example.com"}}
+		e.Data.WriteString("Subject: test\n\nhello\n")
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error(tt.algorithm, "process error:", err)
+			continue
+		}
+		if len(e.Hashes) != 2 || len(e.Hashes[0]) != tt.length || e.Hashes[0] == e.Hashes[1] {
+			t.Error(tt.algorithm, "expected 2 unique hashes of length", tt.length, "got", e.Hashes)
+		}
+		if Svc.StreamHash() != e.HashAlgorithm || e.BodyHash == nil {
+			t.Error(tt.algorithm, "expected the algorithm and body hash to be recorded, got", e.HashAlgorithm, e.BodyHash)
+		}
+	}
+
+	Svc.reset()
+	Decorate(DefaultProcessor{}, Hasher())
+	if errs := Svc.initialize(BackendConfig{"hash_algorithm": "nope"}); errs == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
@@ -61,6 +61,10 @@ func Header() Decorator {
 				if e.TLS {
 					protocol = protocol + "S"
 				}
+				if e.ESMTP && e.AuthorizedLogin != "" {
+					// the client authenticated, RFC 3848
+					protocol = protocol + "A"
+				}
 				var addHead string
 				addHead += "Delivered-To: " + to + "\n"
 				addHead += "Received: from " + e.RemoteIP + " ([" + e.RemoteIP + "])\n"
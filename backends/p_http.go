@@ -0,0 +1,217 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: http
+// ----------------------------------------------------------------------------------
+// Description   : POSTs the email to a webhook, as json with the envelope, the headers
+//               : and optionally the message. Requests that fail, or get a 429 or 5xx
+//               : response, are retried with a backoff. When the webhook doesn't take
+//               : the email, the client gets a 451 to try again later, so no mail is
+//               : lost while the endpoint is down. With http_secret, the requests are
+//               : signed: X-Guerrilla-Signature is "sha256=" and the hex HMAC-SHA256 of
+//               : the X-Guerrilla-Timestamp, a "." and the body
+// ----------------------------------------------------------------------------------
+// Config Options: http_url string - the URL of the webhook. Required
+//               : http_message string - how to send the message: "" leaves it out,
+//               : "base64" adds it to the json as message, and "multipart" sends a
+//               : multipart/form-data body with the json in a "metadata" part and the
+//               : message in a "message" part
+//               : http_secret string - the key to sign the requests with
+//               : http_timeout string - timeout of each request, default "10s"
+//               : http_max_retries int - how many times to retry, default 2
+// --------------:-------------------------------------------------------------------
+// Input         : e.Subject, e.Header - set by the headersparser processor
+//               : e.Hashes, e.Tags
+// ----------------------------------------------------------------------------------
+// Output        : none
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["http"] = func() Decorator {
+		return HTTP()
+	}
+	Svc.AddWholeMessage("http")
+}
+
+type HTTPProcessorConfig struct {
+	URL        string `json:"http_url"`
+	Message    string `json:"http_message,omitempty"`
+	Secret     string `json:"http_secret,omitempty"`
+	Timeout    string `json:"http_timeout,omitempty"`
+	MaxRetries int    `json:"http_max_retries,omitempty"`
+}
+
+const (
+	defaultHTTPTimeout    = time.Second * 10
+	defaultHTTPMaxRetries = 2
+)
+
+// httpRetryBackoff is how long to wait before the first retry, doubled for the next ones
+var httpRetryBackoff = time.Millisecond * 500
+
+// httpMailEvent is the json sent to the webhook
+type httpMailEvent struct {
+	mailEvent
+	// Message is the base64 encoded message, with http_message "base64"
+	Message string `json:"message,omitempty"`
+}
+
+// httpSignature returns the signature of a request with the body, sent at the unix timestamp
+func httpSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// httpBody returns the body of the request for the envelope, and its content type
+func httpBody(config *HTTPProcessorConfig, e *mail.Envelope) ([]byte, string, error) {
+	// an anonymized event has no message
+	withMessage := config.Message != "" && Anonymization == nil
+	event := httpMailEvent{mailEvent: newMailEvent(e, false)}
+	if withMessage && config.Message == "base64" {
+		event.Message = base64.StdEncoding.EncodeToString([]byte(e.String()))
+	}
+	metadata, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+	if !withMessage || config.Message != "multipart" {
+		return metadata, "application/json", nil
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="metadata"`},
+		"Content-Type":        {"application/json"},
+	})
+	if err == nil {
+		_, err = part.Write(metadata)
+	}
+	if err == nil {
+		part, err = w.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="message"; filename="message.eml"`},
+			"Content-Type":        {"message/rfc822"},
+		})
+	}
+	if err == nil {
+		_, err = io.Copy(part, e.NewReader())
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// httpRetryable returns true for the responses that may succeed later
+func httpRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// httpPost posts the body, retrying up to config.MaxRetries times
+func httpPost(client *http.Client, config *HTTPProcessorConfig, body []byte, contentType string) error {
+	backoff := httpRetryBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if config.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set("X-Guerrilla-Timestamp", timestamp)
+			req.Header.Set("X-Guerrilla-Signature", httpSignature(config.Secret, timestamp, body))
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("the webhook returned %s", resp.Status)
+			if !httpRetryable(resp.StatusCode) {
+				return err
+			}
+		}
+		if attempt >= config.MaxRetries {
+			return err
+		}
+		Log().WithError(err).Warn("http: the webhook request failed, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func HTTP() Decorator {
+	var config *HTTPProcessorConfig
+	var client *http.Client
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&HTTPProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*HTTPProcessorConfig)
+		if config.URL == "" {
+			return errors.New("http_url is required by the http processor")
+		}
+		switch config.Message {
+		case "", "base64", "multipart":
+		default:
+			return fmt.Errorf("invalid http_message %q, expected base64 or multipart", config.Message)
+		}
+		timeout := defaultHTTPTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid http_timeout %q", config.Timeout)
+			}
+		}
+		if config.MaxRetries <= 0 {
+			config.MaxRetries = defaultHTTPMaxRetries
+		}
+		client = &http.Client{Timeout: timeout}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			body, contentType, err := httpBody(config, e)
+			if err == nil {
+				err = httpPost(client, config, body, contentType)
+			}
+			if err != nil {
+				Log().WithError(err).Errorf("http: could not post %s to the webhook", e.QueuedId)
+				return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: http_rcpt
+// ----------------------------------------------------------------------------------
+// Description   : Validates each recipient when it's given by POSTing it, with the
+//               : sender and the client's IP, to a REST endpoint as json, eg.
+//               : {"rcpt":"bob@example.com","from":"alice@example.org",
+//               : "ip":"192.0.2.1","helo":"mx.example.org","tenant":""}. The endpoint
+//               : replies with {"action":"accept"}, "reject" or "tempfail", and an
+//               : optional "message" for the client. After http_rcpt_failures
+//               : requests in a row fail, the endpoint isn't called for
+//               : http_rcpt_open_time and the recipients get http_rcpt_default, then
+//               : a single request tries it again. Put it in the validate_process
+// ----------------------------------------------------------------------------------
+// Config Options: http_rcpt_url string - the URL of the endpoint. Required
+//               : http_rcpt_timeout string - timeout of each request, default "2s"
+//               : http_rcpt_secret string - the key to sign the requests with, as for
+//               : the http processor
+//               : http_rcpt_default string - "accept", "reject" or "tempfail", the
+//               : action when the endpoint fails or isn't called, default "tempfail"
+//               : http_rcpt_failures int - how many failed requests in a row stop the
+//               : calls to the endpoint, default 5
+//               : http_rcpt_open_time string - how long the endpoint isn't called
+//               : after it failed, default "30s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, e.MailFrom, e.RemoteIP, e.Helo, e.Tenant
+// ----------------------------------------------------------------------------------
+// Output        : NoSuchUser, or an error with the endpoint's message, when the
+//               : last recipient was rejected, StorageTooBusy when it's tempfailed
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["http_rcpt"] = func() Decorator {
+		return HTTPRcpt()
+	}
+}
+
+type HTTPRcptProcessorConfig struct {
+	URL      string `json:"http_rcpt_url"`
+	Timeout  string `json:"http_rcpt_timeout,omitempty"`
+	Secret   string `json:"http_rcpt_secret,omitempty"`
+	Default  string `json:"http_rcpt_default,omitempty"`
+	Failures int    `json:"http_rcpt_failures,omitempty"`
+	OpenTime string `json:"http_rcpt_open_time,omitempty"`
+}
+
+// The actions of the endpoint
+const (
+	httpRcptAccept   = "accept"
+	httpRcptReject   = "reject"
+	httpRcptTempfail = "tempfail"
+)
+
+const (
+	defaultHTTPRcptTimeout  = time.Second * 2
+	defaultHTTPRcptFailures = 5
+	defaultHTTPRcptOpenTime = time.Second * 30
+)
+
+// httpRcptRequest is the json posted to the endpoint
+type httpRcptRequest struct {
+	Rcpt   string `json:"rcpt"`
+	From   string `json:"from"`
+	IP     string `json:"ip"`
+	Helo   string `json:"helo"`
+	Tenant string `json:"tenant"`
+	// Verify is set for the address probes, eg. VRFY, that the endpoint shouldn't keep any state for
+	Verify bool `json:"verify,omitempty"`
+}
+
+// httpRcptReply is the json the endpoint replies with
+type httpRcptReply struct {
+	Action  string `json:"action"`
+	Message string `json:"message,omitempty"`
+}
+
+// httpRcptBreaker stops calling an endpoint that keeps failing, shared by the workers
+type httpRcptBreaker struct {
+	sync.Mutex
+	failures int
+	// openUntil is when a request may try the endpoint again, while the breaker is open
+	openUntil time.Time
+	// trying is true while the request that tries the endpoint again is made
+	trying bool
+}
+
+// the breakers of the endpoints, by their URL
+var httpRcptBreakers sync.Map
+
+// allow returns true when the endpoint may be called. Once the breaker has been open for
+// long enough, one request is let through to find out if the endpoint is back
+func (b *httpRcptBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.trying || Now().Before(b.openUntil) {
+		return false
+	}
+	b.trying = true
+	return true
+}
+
+// done records the outcome of a request, opening the breaker after max failures in a row
+func (b *httpRcptBreaker) done(url string, err error, max int, openTime time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.trying = false
+	if err == nil {
+		if !b.openUntil.IsZero() {
+			Log().Infof("http_rcpt: %s is back, calling it again", url)
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	if b.failures++; b.failures >= max {
+		if b.openUntil.IsZero() {
+			Log().WithError(err).Errorf("http_rcpt: %s failed %d times, not calling it for %s", url,
+				b.failures, openTime)
+		}
+		b.openUntil = Now().Add(openTime)
+	}
+}
+
+// httpRcptCall posts the request to the endpoint and returns its action
+func httpRcptCall(client *http.Client, config *HTTPRcptProcessorConfig, request *httpRcptRequest) (*httpRcptReply, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Guerrilla-Timestamp", timestamp)
+		req.Header.Set("X-Guerrilla-Signature", httpSignature(config.Secret, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("the endpoint returned %s", resp.Status)
+	}
+	reply := &httpRcptReply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return nil, fmt.Errorf("the endpoint replied with invalid json: %v", err)
+	}
+	switch reply.Action {
+	case httpRcptAccept, httpRcptReject, httpRcptTempfail:
+		return reply, nil
+	}
+	return nil, fmt.Errorf("the endpoint replied with an unknown action %q", reply.Action)
+}
+
+// httpRcptResult returns the result of the action
+func httpRcptResult(reply *httpRcptReply) (Result, error) {
+	message := strings.TrimSpace(strings.Replace(reply.Message, "\n", " ", -1))
+	switch reply.Action {
+	case httpRcptReject:
+		if message != "" {
+			return NewResult(response.Canned.FailRcptCmd), RcptError(errors.New(message))
+		}
+		return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+	case httpRcptTempfail:
+		return NewResult(response.Canned.ErrorRcptValidation), StorageTooBusy
+	}
+	return nil, nil
+}
+
+func HTTPRcpt() Decorator {
+	var config *HTTPRcptProcessorConfig
+	var client *http.Client
+	var breaker *httpRcptBreaker
+	var openTime time.Duration
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&HTTPRcptProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*HTTPRcptProcessorConfig)
+		if config.URL == "" {
+			return errors.New("http_rcpt_url is required by the http_rcpt processor")
+		}
+		switch config.Default {
+		case "":
+			config.Default = httpRcptTempfail
+		case httpRcptAccept, httpRcptReject, httpRcptTempfail:
+		default:
+			return fmt.Errorf("invalid http_rcpt_default %q, expected accept, reject or tempfail", config.Default)
+		}
+		timeout := defaultHTTPRcptTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid http_rcpt_timeout %q", config.Timeout)
+			}
+		}
+		openTime = defaultHTTPRcptOpenTime
+		if config.OpenTime != "" {
+			if openTime, err = time.ParseDuration(config.OpenTime); err != nil || openTime <= 0 {
+				return fmt.Errorf("invalid http_rcpt_open_time %q", config.OpenTime)
+			}
+		}
+		if config.Failures <= 0 {
+			config.Failures = defaultHTTPRcptFailures
+		}
+		client = &http.Client{Timeout: timeout}
+		b, _ := httpRcptBreakers.LoadOrStore(config.URL, &httpRcptBreaker{})
+		breaker = b.(*httpRcptBreaker)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskValidateRcpt || len(e.RcptTo) == 0 {
+				return p.Process(e, task)
+			}
+			reply := &httpRcptReply{Action: config.Default}
+			if breaker.allow() {
+				last := e.RcptTo[len(e.RcptTo)-1]
+				r, err := httpRcptCall(client, config, &httpRcptRequest{
+					Rcpt:   last.String(),
+					From:   e.MailFrom.String(),
+					IP:     e.RemoteIP,
+					Helo:   e.Helo,
+					Tenant: e.Tenant,
+					Verify: IsVerifyOnly(e),
+				})
+				breaker.done(config.URL, err, config.Failures, openTime)
+				if err != nil {
+					Log().WithError(err).Warnf("http_rcpt: could not validate %s, it gets %s", last.String(),
+						config.Default)
+				} else {
+					reply = r
+				}
+			}
+			if result, err := httpRcptResult(reply); err != nil {
+				return result, err
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestHTTPRcpt(t *testing.T) {
+	c := NewManualClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(c))
+	var down, calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var request httpRcptRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.IP != "192.0.2.1" ||
+			request.From != "test@example.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch request.Rcpt {
+		case "bob@acme.com":
+			_, _ = w.Write([]byte(`{"action":"accept"}`))
+		case "full@acme.com":
+			_, _ = w.Write([]byte(`{"action":"tempfail"}`))
+		case "gone@acme.com":
+			_, _ = w.Write([]byte(`{"action":"reject","message":"moved to example.net"}`))
+		default:
+			_, _ = w.Write([]byte(`{"action":"reject"}`))
+		}
+	}))
+	defer server.Close()
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":        "Debugger",
+		"validate_process":    "http_rcpt",
+		"http_rcpt_url":       server.URL,
+		"http_rcpt_default":   "accept",
+		"http_rcpt_failures":  2,
+		"http_rcpt_open_time": "1m",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	validate := func(user string) error {
+		e := mail.NewEnvelope("192.0.2.1", 1)
+		e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+		e.RcptTo = []mail.Address{{User: user, Host: "acme.com"}}
+		return backend.ValidateRcpt(e)
+	}
+	if err := validate("bob"); err != nil {
+		t.Error("expected bob to be accepted, got", err)
+	}
+	if err := validate("eve"); err != NoSuchUser {
+		t.Error("expected eve to be rejected, got", err)
+	}
+	if err := validate("full"); err != StorageTooBusy {
+		t.Error("expected full to be tempfailed, got", err)
+	}
+	if err := validate("gone"); err == nil || err.Error() != "moved to example.net" {
+		t.Error("expected the endpoint's message, got", err)
+	}
+
+	// the endpoint is down, the default is used, and it's not called after 2 failures
+	atomic.StoreInt32(&down, 1)
+	atomic.StoreInt32(&calls, 0)
+	for i := 0; i < 4; i++ {
+		if err := validate("eve"); err != nil {
+			t.Error("expected the default to accept eve, got", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Error("expected 2 calls before the breaker opens, got", n)
+	}
+	// a request tries it again after the open time, it's still down
+	c.Advance(time.Minute)
+	_ = validate("eve")
+	_ = validate("eve")
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Error("expected a single call to try the endpoint again, got", n)
+	}
+	atomic.StoreInt32(&down, 0)
+	c.Advance(time.Minute)
+	if err := validate("eve"); err != NoSuchUser {
+		t.Error("expected the endpoint to be called again, got", err)
+	}
+	if err := validate("eve"); err != NoSuchUser || atomic.LoadInt32(&calls) != 5 {
+		t.Error("expected the breaker to be closed, got", err, calls)
+	}
+}
@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPProcessor(t *testing.T) {
+	saved := httpRetryBackoff
+	httpRetryBackoff = time.Millisecond
+	defer func() {
+		httpRetryBackoff = saved
+	}()
+	var requests, status int32
+	var event httpMailEvent
+	var message string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request of each email fails
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if code := atomic.LoadInt32(&status); code != 0 {
+			w.WriteHeader(int(code))
+			return
+		}
+		var body []byte
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Error(err)
+			}
+			body = []byte(r.FormValue("metadata"))
+			f, _, err := r.FormFile("message")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(f)
+			message = string(data)
+		} else {
+			body, _ = ioutil.ReadAll(r.Body)
+			if r.Header.Get("X-Guerrilla-Signature") != httpSignature("s3cret", r.Header.Get("X-Guerrilla-Timestamp"), body) {
+				t.Error("unexpected signature", r.Header.Get("X-Guerrilla-Signature"))
+			}
+		}
+		event = httpMailEvent{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	// metadata and a base64 message, signed
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process": "HeadersParser|HTTP|Debugger",
+		"http_url":     server.URL,
+		"http_message": "base64",
+		"http_secret":  "s3cret",
+	})
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be accepted after a retry, got", result)
+	}
+	if event.From != "test@example.com" || len(event.To) != 2 || event.Subject != "hello" ||
+		event.MessageId != "m1@example.com" || event.Tenant != "acme" {
+		t.Error("unexpected event", event)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(event.Message); !strings.HasSuffix(string(data), "\n\nhi\n") {
+		t.Errorf("unexpected message %q", data)
+	}
+
+	// the webhook refuses it, it's not retried
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	requests = 0
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail, got", result)
+	}
+	if requests != 2 {
+		t.Error("expected the 400 not to be retried, got", requests, "requests")
+	}
+	atomic.StoreInt32(&status, 0)
+	_ = backend.Shutdown()
+
+	// multipart, and retries run out
+	backend = newBrokerTestBackend(t, BackendConfig{
+		"save_process":     "HeadersParser|HTTP|Debugger",
+		"http_url":         server.URL,
+		"http_message":     "multipart",
+		"http_max_retries": 1,
+	})
+	requests = 0
+	message = ""
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be accepted, got", result)
+	}
+	if event.QueuedId == "" || !strings.HasSuffix(message, "Message-Id: <m1@example.com>\n\nhi\n") {
+		t.Errorf("unexpected multipart request %v %q", event, message)
+	}
+	server.Close()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail while the webhook is down, got", result)
+	}
+	_ = backend.Shutdown()
+
+	if _, err := New(BackendConfig{
+		"save_process": "HTTP",
+		"http_url":     server.URL,
+		"http_message": "xml",
+	}, Log()); err == nil {
+		t.Error("expected an invalid http_message to be refused")
+	}
+	// the initializers of the backend that failed are left behind
+	Svc.reset()
+}
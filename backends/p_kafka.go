@@ -0,0 +1,255 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+	"github.com/segmentio/kafka-go"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: kafka
+// ----------------------------------------------------------------------------------
+// Description   : Publishes each email to a Kafka topic, as the raw message or as json
+//               : with the headers and the envelope. The key is the domain of the first
+//               : recipient, so the mail of a domain goes to the same partition. The
+//               : email is only accepted once the brokers acknowledged it; when they
+//               : can't be reached in kafka_timeout, a 451 asks the client to try later
+// ----------------------------------------------------------------------------------
+// Config Options: kafka_brokers string - comma separated host:port list. Required
+//               : kafka_topic string - {tenant} is replaced with the tenant. Required
+//               : kafka_format string - "rfc822" (default), "json", or "avro" or
+//               : "protobuf" with the schema registered in kafka_schema_registry
+//               : kafka_json_data bool - add the message to the event, as "data"
+//               : kafka_schema_registry string - the url of a Confluent schema registry
+//               : kafka_schema_subject string - {topic} is replaced with the topic,
+//               : default "{topic}-value"
+//               : kafka_schema_registry_username, kafka_schema_registry_password
+//               : string - for basic authentication with the registry
+//               : kafka_acks string - "all" (default), "1" for the leader only, or "0"
+//               : kafka_timeout string - how long to wait for the brokers, default "10s"
+//               : kafka_max_attempts int - attempts to write a message, default 10
+//               : kafka_queue_size int - messages buffered by the writer, default 100
+//               : kafka_batch_size int - messages sent in a request, default 100
+//               : kafka_max_message_bytes int - larger emails are refused with a 554,
+//               : default 1048576, the default message.max.bytes of the brokers
+//               : kafka_tls bool - connect with TLS
+//               : kafka_username, kafka_password string - for SASL PLAIN
+//               : kafka_journal string - a file where the messages that the brokers
+//               : acknowledged are recorded, so that a message the client sends again
+//               : isn't published twice. Needs kafka_acks "all", and the HeadersParser
+//               : before, a message is known again by its Message-ID
+//               : kafka_journal_retention string - how long a message is remembered,
+//               : default "168h"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by Header() processor
+//               : e.Header generated by ParseHeader() processor
+//               : e.Hashes - set by the hasher processor, optional
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.QueuedId with the first item fromHashes[0], if set
+//               : the records have a message_id header with kafka_journal, for the
+//               : consumers to drop a message published again after a timeout
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["kafka"] = func() Decorator {
+		return Kafka()
+	}
+	Svc.AddWholeMessage("kafka")
+}
+
+type KafkaProcessorConfig struct {
+	Brokers          string `json:"kafka_brokers"`
+	Topic            string `json:"kafka_topic"`
+	Format           string `json:"kafka_format,omitempty"`
+	JSONData         bool   `json:"kafka_json_data,omitempty"`
+	Acks             string `json:"kafka_acks,omitempty"`
+	Timeout          string `json:"kafka_timeout,omitempty"`
+	MaxAttempts      int    `json:"kafka_max_attempts,omitempty"`
+	QueueSize        int    `json:"kafka_queue_size,omitempty"`
+	BatchSize        int    `json:"kafka_batch_size,omitempty"`
+	MaxMessageBytes  int    `json:"kafka_max_message_bytes,omitempty"`
+	TLS              bool   `json:"kafka_tls,omitempty"`
+	Username         string `json:"kafka_username,omitempty"`
+	Password         string `json:"kafka_password,omitempty"`
+	Journal          string `json:"kafka_journal,omitempty"`
+	JournalRetention string `json:"kafka_journal_retention,omitempty"`
+	SchemaRegistry   string `json:"kafka_schema_registry,omitempty"`
+	SchemaSubject    string `json:"kafka_schema_subject,omitempty"`
+	RegistryUsername string `json:"kafka_schema_registry_username,omitempty"`
+	RegistryPassword string `json:"kafka_schema_registry_password,omitempty"`
+}
+
+const (
+	defaultKafkaTimeout         = time.Second * 10
+	defaultKafkaMaxMessageBytes = 1048576
+	defaultKafkaSchemaSubject   = "{topic}-value"
+	// defaultKafkaJournalRetention covers the retries of the clients, which give up after about 5 days
+	defaultKafkaJournalRetention = time.Hour * 24 * 7
+)
+
+func (c *KafkaProcessorConfig) brokers() []string {
+	var brokers []string
+	for _, b := range strings.Split(c.Brokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	return brokers
+}
+
+// acks returns the RequiredAcks of the writer, -1 for all the in-sync replicas
+func (c *KafkaProcessorConfig) acks() int {
+	if n, err := strconv.Atoi(c.Acks); err == nil {
+		return n
+	}
+	return -1
+}
+
+// check validates the config and sets the defaults
+func (c *KafkaProcessorConfig) check() error {
+	if len(c.brokers()) == 0 {
+		return fmt.Errorf("kafka_brokers is required by the kafka processor")
+	}
+	if c.Topic == "" {
+		return fmt.Errorf("kafka_topic is required by the kafka processor")
+	}
+	c.Format = strings.ToLower(c.Format)
+	if c.Format == "" {
+		c.Format = "rfc822"
+	} else if c.Format != "rfc822" && c.Format != "json" && c.Format != "avro" && c.Format != "protobuf" {
+		return fmt.Errorf("invalid kafka_format %q, expected rfc822, json, avro or protobuf", c.Format)
+	}
+	if (c.Format == "avro" || c.Format == "protobuf") && c.SchemaRegistry == "" {
+		return fmt.Errorf("kafka_format %s needs kafka_schema_registry", c.Format)
+	}
+	if c.SchemaSubject == "" {
+		c.SchemaSubject = defaultKafkaSchemaSubject
+	}
+	switch strings.ToLower(c.Acks) {
+	case "", "all", "-1", "1", "0":
+	default:
+		return fmt.Errorf("invalid kafka_acks %q, expected all, 1 or 0", c.Acks)
+	}
+	if c.Journal != "" && c.acks() != -1 {
+		return fmt.Errorf("kafka_journal needs kafka_acks all")
+	}
+	if c.MaxMessageBytes == 0 {
+		c.MaxMessageBytes = defaultKafkaMaxMessageBytes
+	}
+	return nil
+}
+
+func Kafka() Decorator {
+	var config *KafkaProcessorConfig
+	var producer *kafkaProducer
+	var journal *kafkaJournal
+	var registry *schemaRegistry
+	timeout := defaultKafkaTimeout
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&KafkaProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*KafkaProcessorConfig)
+		if err := config.check(); err != nil {
+			return err
+		}
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid kafka_timeout %q", config.Timeout)
+			}
+		}
+		if config.Format == "avro" || config.Format == "protobuf" {
+			registry, err = newSchemaRegistry(config.SchemaRegistry, config.RegistryUsername,
+				config.RegistryPassword, config.Format)
+			if err != nil {
+				return err
+			}
+		}
+		producer = useKafkaProducer(config)
+		journal, err = producer.openJournal()
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if producer != nil {
+			err := producer.release()
+			producer = nil
+			return err
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if len(e.Hashes) > 0 {
+					e.QueuedId = e.Hashes[0]
+				}
+				msg := kafka.Message{
+					Key: kafkaKey(e),
+					Headers: []kafka.Header{
+						{Key: "queued_id", Value: []byte(e.QueuedId)},
+						{Key: "tenant", Value: []byte(e.Tenant)},
+					},
+				}
+				topic := ForTenant(config.Topic, e.Tenant)
+				if registry != nil {
+					ev := newMailEvent(e, config.JSONData)
+					subject := strings.Replace(config.SchemaSubject, "{topic}", topic, -1)
+					data, err := registry.encode(subject, &ev)
+					if err != nil {
+						// the registry may be back soon
+						Log().WithError(err).Warn("could not encode the email for kafka")
+						return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+					}
+					msg.Value = data
+				} else if config.Format == "json" || Anonymization != nil {
+					// anonymized mail is only published as json, without the message
+					data, err := json.Marshal(newMailEvent(e, config.JSONData))
+					if err != nil {
+						Log().WithError(err).Error("could not encode the email for kafka")
+						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					}
+					msg.Value = data
+				} else {
+					msg.Value = []byte(e.String())
+				}
+				var id string
+				if journal != nil {
+					id = kafkaMessageID(e)
+					if journal.begin(id) {
+						Log().WithField("message_id", id).Info("the email was published to kafka already")
+						TrackDelivery(e, DeliveryStored, "kafka")
+						return p.Process(e, task)
+					}
+					msg.Headers = append(msg.Headers, kafka.Header{Key: "message_id", Value: []byte(id)})
+				}
+				err := producer.publish(topic, msg, timeout)
+				if journal != nil {
+					if journalErr := journal.finish(id, err == nil); journalErr != nil {
+						// the message is in kafka, refusing it now would publish it again
+						Log().WithError(journalErr).Error("could not record the email in kafka_journal")
+					}
+				}
+				if err != nil {
+					if _, ok := err.(kafka.MessageTooLargeError); ok {
+						Log().WithError(err).Errorf("the email is larger than kafka_max_message_bytes (%d)", config.MaxMessageBytes)
+						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					}
+					// the brokers may be back soon, so the client should try again later
+					Log().WithError(err).Warn("could not publish the email to kafka topic ", topic)
+					return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+				}
+				TrackDelivery(e, DeliveryStored, "kafka")
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka keeps the messages written to each topic, or fails with err
+type fakeKafka struct {
+	messages map[string][]kafka.Message
+	configs  map[string]kafka.WriterConfig
+	closed   int
+	err      error
+	sync.Mutex
+}
+
+type fakeKafkaWriter struct {
+	topic string
+	k     *fakeKafka
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.k.Lock()
+	defer w.k.Unlock()
+	if w.k.err != nil {
+		return w.k.err
+	}
+	w.k.messages[w.topic] = append(w.k.messages[w.topic], msgs...)
+	return nil
+}
+
+func (w *fakeKafkaWriter) Close() error {
+	w.k.Lock()
+	defer w.k.Unlock()
+	w.k.closed++
+	return nil
+}
+
+func useFakeKafka() (*fakeKafka, func()) {
+	k := &fakeKafka{messages: make(map[string][]kafka.Message), configs: make(map[string]kafka.WriterConfig)}
+	saved := newKafkaWriter
+	newKafkaWriter = func(config kafka.WriterConfig) kafkaWriter {
+		k.Lock()
+		defer k.Unlock()
+		k.configs[config.Topic] = config
+		return &fakeKafkaWriter{topic: config.Topic, k: k}
+	}
+	return k, func() { newKafkaWriter = saved }
+}
+
+func TestKafkaConfig(t *testing.T) {
+	c := &KafkaProcessorConfig{Brokers: " k1:9092, ,k2:9092", Topic: "mail"}
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.brokers()) != 2 || c.Format != "rfc822" || c.acks() != -1 || c.MaxMessageBytes != defaultKafkaMaxMessageBytes {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+	for _, bad := range []KafkaProcessorConfig{
+		{Topic: "mail"},
+		{Brokers: "k1:9092"},
+		{Brokers: "k1:9092", Topic: "mail", Format: "xml"},
+		{Brokers: "k1:9092", Topic: "mail", Acks: "2"},
+		{Brokers: "k1:9092", Topic: "mail", Acks: "1", Journal: "kafka.journal"},
+	} {
+		if err := bad.check(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func newBrokerTestBackend(t *testing.T, config BackendConfig) Backend {
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	config["log_received_mails"] = true
+	backend, err := New(config, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	return backend
+}
+
+func newBrokerTestEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Helo = "client.example.com"
+	e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+	e.RcptTo = []mail.Address{{User: "bob", Host: "Acme.com"}, {User: "eve", Host: "other.com"}}
+	e.Tenant = "acme"
+	e.Data.WriteString("Subject: hello\nMessage-Id: <m1@example.com>\n\nhi\n")
+	return e
+}
+
+func TestKafkaProcessor(t *testing.T) {
+	k, restore := useFakeKafka()
+	defer restore()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":    "HeadersParser|Hasher|Kafka|Debugger",
+		"kafka_brokers":   "k1:9092",
+		"kafka_topic":     "mail-{tenant}",
+		"kafka_format":    "json",
+		"kafka_json_data": true,
+		"kafka_acks":      "1",
+	})
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be published, got", result)
+	}
+	msgs := k.messages["mail-acme"]
+	if len(msgs) != 1 || string(msgs[0].Key) != "acme.com" || k.configs["mail-acme"].RequiredAcks != 1 {
+		t.Fatal("expected a message keyed by the recipient domain, got", msgs)
+	}
+	var doc mailEvent
+	if err := json.Unmarshal(msgs[0].Value, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.QueuedId != e.Hashes[0] || doc.Tenant != "acme" || len(doc.To) != 2 || doc.Helo != "client.example.com" ||
+		doc.MessageId != "m1@example.com" || doc.Headers["Subject"][0] != "hello" || !strings.HasSuffix(doc.Data, "\n\nhi\n") {
+		t.Errorf("unexpected document %+v", doc)
+	}
+
+	// the client is asked to try again when the brokers can't be reached
+	k.err = errors.New("dial tcp: connection refused")
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451 4.3.0") {
+		t.Error("expected a tempfail, got", result)
+	}
+	k.err = kafka.MessageTooLargeError{}
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "554") {
+		t.Error("expected a permanent failure, got", result)
+	}
+	_ = backend.Shutdown()
+	if k.closed != 1 {
+		t.Error("expected the writer to be closed once, got", k.closed)
+	}
+}
+
+func TestKafkaProcessorRaw(t *testing.T) {
+	k, restore := useFakeKafka()
+	defer restore()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Header|Kafka|Debugger",
+		"kafka_brokers":     "k1:9092",
+		"kafka_topic":       "mail",
+		"primary_mail_host": "acme.com",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be published, got", result)
+	}
+	msgs := k.messages["mail"]
+	if len(msgs) != 1 || !strings.Contains(string(msgs[0].Value), "Received: from 127.0.0.1") ||
+		!strings.HasSuffix(string(msgs[0].Value), "\n\nhi\n") {
+		t.Fatal("expected the raw message, got", msgs)
+	}
+}
+
+func TestKafkaJournal(t *testing.T) {
+	c := NewManualClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(c))
+	dir, err := ioutil.TempDir("", "kafka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "kafka.journal")
+	k, restore := useFakeKafka()
+	defer restore()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":  "HeadersParser|Kafka|Debugger",
+		"kafka_brokers": "k1:9092",
+		"kafka_topic":   "mail",
+		"kafka_journal": path,
+	})
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be published, got", result)
+	}
+	// the client didn't get the reply, and sends the message again
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted again, got", result)
+	}
+	msgs := k.messages["mail"]
+	if len(msgs) != 1 {
+		t.Fatal("expected the mail to be published once, got", len(msgs))
+	}
+	e := newBrokerTestEnvelope()
+	if err := e.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	id := kafkaMessageID(e)
+	if h := msgs[0].Headers[len(msgs[0].Headers)-1]; h.Key != "message_id" || string(h.Value) != id {
+		t.Error("expected the message_id header, got", msgs[0].Headers)
+	}
+
+	// a message that wasn't published isn't recorded
+	e = newBrokerTestEnvelope()
+	e.RcptTo = e.RcptTo[:1]
+	k.err = errors.New("no brokers")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "451") {
+		t.Fatal("expected the mail to be deferred, got", result)
+	}
+	k.err = nil
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") || len(k.messages["mail"]) != 2 {
+		t.Fatal("expected the retry to be published, got", result, len(k.messages["mail"]))
+	}
+	// without a Message-ID, two copies aren't known to be the same message
+	for i := 0; i < 2; i++ {
+		e = newBrokerTestEnvelope()
+		e.QueuedId = fmt.Sprintf("copy%d", i)
+		e.Data.Reset()
+		e.Data.WriteString("Subject: hello\n\nhi\n")
+		if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+			t.Fatal("expected the mail to be published, got", result)
+		}
+	}
+	if len(k.messages["mail"]) != 4 {
+		t.Error("expected both copies without a Message-ID to be published, got", len(k.messages["mail"]))
+	}
+	if err := backend.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := openKafkaJournal(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.begin(id) || len(j.done) != 4 {
+		t.Error("expected the journal to have the messages, got", j.done)
+	}
+	_ = j.close()
+	c.Advance(time.Hour)
+	if j, err = openKafkaJournal(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	_ = j.close()
+	if data, _ := ioutil.ReadFile(path); len(j.done) != 0 || len(data) != 0 {
+		t.Error("expected the journal to be compacted, got", string(data))
+	}
+}
+
+func TestKafkaJournalPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	j, err := openKafkaJournal(filepath.Join(dir, "kafka.journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = j.close()
+	}()
+	if j.begin("m1") {
+		t.Fatal("expected m1 to be new")
+	}
+	// the same message waits for the first one to be published
+	published := make(chan bool)
+	go func() {
+		published <- j.begin("m1")
+	}()
+	select {
+	case <-published:
+		t.Fatal("expected the message to wait")
+	case <-time.After(time.Millisecond * 50):
+	}
+	if err := j.finish("m1", true); err != nil {
+		t.Fatal(err)
+	}
+	if !<-published {
+		t.Error("expected the message to have been published")
+	}
+	// a failure lets the next one publish
+	if j.begin("m2") {
+		t.Fatal("expected m2 to be new")
+	}
+	go func() {
+		published <- j.begin("m2")
+	}()
+	_ = j.finish("m2", false)
+	if <-published {
+		t.Error("expected m2 to be published again")
+	}
+}
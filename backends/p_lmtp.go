@@ -0,0 +1,200 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: lmtp
+// ----------------------------------------------------------------------------------
+// Description   : Hands the email to a local delivery agent over LMTP, eg. Dovecot.
+//               : LMTP replies for each recipient: when all of them failed, the
+//               : client gets the reply of the first recipient that may succeed
+//               : later, or else the first one. When only some failed, the email is
+//               : accepted: the recipients refused with a 5xx are bounced to the sender,
+//               : and the ones deferred with a 4xx are retried in the background, then
+//               : bounced once gw_retry_for has passed
+// ----------------------------------------------------------------------------------
+// Config Options: lmtp_address string - host:port, or unix:/path of a socket,
+//               : eg. unix:/var/run/dovecot/lmtp
+//               : lmtp_helo string - the name sent with LHLO, default localhost
+//               : lmtp_timeout string - how long a session may take, default 30s
+//               : lmtp_validate_rcpt bool - check the recipients with the delivery
+//               : agent when they are added, and refuse the unknown ones
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader generated by the Header() processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["lmtp_failed"] map[string]string - the reply for each
+//               : recipient that failed, when the others were delivered
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["lmtp"] = func() Decorator {
+		return LMTP()
+	}
+	Svc.AddWholeMessage("lmtp")
+}
+
+type LMTPProcessorConfig struct {
+	Address      string `json:"lmtp_address"`
+	Helo         string `json:"lmtp_helo,omitempty"`
+	Timeout      string `json:"lmtp_timeout,omitempty"`
+	ValidateRcpt bool   `json:"lmtp_validate_rcpt,omitempty"`
+}
+
+const (
+	defaultLMTPHelo    = "localhost"
+	defaultLMTPTimeout = time.Second * 30
+)
+
+var errLMTPDelivery = errors.New("lmtp: the delivery failed for all recipients")
+
+// lmtpResult records the reply of each recipient, and returns a result when none of them
+// were delivered. When some were, the others are bounced, or retried with retry
+func lmtpResult(e *mail.Envelope, replies []lmtpReply, retry RetryFunc) (Result, error) {
+	var failed map[string]string
+	var tempfail, permfail *lmtpReply
+	var deferred []mail.Address
+	for i := range replies {
+		rcpt := e.RcptTo[i]
+		if replies[i].Code/100 == 2 {
+			TrackRcptDelivery(e, rcpt, DeliveryStored, "lmtp")
+			continue
+		}
+		if failed == nil {
+			failed = make(map[string]string)
+		}
+		failed[rcpt.String()] = replies[i].String()
+		if replies[i].Code/100 == 4 {
+			deferred = append(deferred, rcpt)
+			if tempfail == nil {
+				tempfail = &replies[i]
+			}
+		} else if permfail == nil {
+			permfail = &replies[i]
+		}
+	}
+	if len(failed) == 0 {
+		return nil, nil
+	}
+	if len(failed) < len(replies) {
+		Log().Warnf("lmtp delivered %s to %d of %d recipients, failed: %v",
+			e.QueuedId, len(replies)-len(failed), len(replies), failed)
+		e.Values["lmtp_failed"] = failed
+		for i := range replies {
+			if replies[i].Code/100 == 5 {
+				BounceRcpt(e, e.RcptTo[i], replies[i].String())
+			}
+		}
+		if len(deferred) > 0 {
+			RetryRcpts(e, deferred, retry)
+		}
+		return nil, nil
+	}
+	for i := range replies {
+		TrackRcptDelivery(e, e.RcptTo[i], DeliveryRejected, replies[i].String())
+	}
+	// the client may retry, unless the failures are all permanent
+	if tempfail != nil {
+		return NewResult(tempfail.String()), errLMTPDelivery
+	}
+	return NewResult(permfail.String()), errLMTPDelivery
+}
+
+// lmtpRetry returns the RetryFunc that delivers the email again with a new session
+func lmtpRetry(address, helo string, timeout time.Duration) RetryFunc {
+	return func(e *mail.Envelope) map[string]string {
+		failed := make(map[string]string, len(e.RcptTo))
+		c, err := dialLMTP(address, helo, timeout)
+		var replies []lmtpReply
+		if err == nil {
+			replies, err = lmtpDeliver(c, e)
+			_ = c.Close()
+		}
+		if err != nil {
+			for i := range e.RcptTo {
+				failed[e.RcptTo[i].String()] = err.Error()
+			}
+			return failed
+		}
+		for i := range replies {
+			if replies[i].Code/100 == 2 {
+				TrackRcptDelivery(e, e.RcptTo[i], DeliveryStored, "lmtp")
+			} else {
+				failed[e.RcptTo[i].String()] = replies[i].String()
+			}
+		}
+		return failed
+	}
+}
+
+func LMTP() Decorator {
+	var config *LMTPProcessorConfig
+	timeout := defaultLMTPTimeout
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&LMTPProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*LMTPProcessorConfig)
+		if config.Address == "" {
+			return errors.New("lmtp_address is required by the lmtp processor")
+		}
+		if config.Helo == "" {
+			config.Helo = defaultLMTPHelo
+		}
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid lmtp_timeout %q", config.Timeout)
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && config.ValidateRcpt && len(e.RcptTo) > 0 {
+				// validate only the last recipient, it was just added
+				last := e.RcptTo[len(e.RcptTo)-1]
+				c, err := dialLMTP(config.Address, config.Helo, timeout)
+				if err != nil {
+					// the email is refused or deferred with DATA instead
+					Log().WithError(err).Warn("could not connect to lmtp to validate a recipient")
+					return p.Process(e, task)
+				}
+				var reply lmtpReply
+				if err = c.mail(e.MailFrom.String()); err == nil {
+					reply, err = c.rcpt(last.String())
+				}
+				_ = c.Close()
+				if err == nil && reply.Code/100 == 5 {
+					return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+				}
+				return p.Process(e, task)
+			}
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			c, err := dialLMTP(config.Address, config.Helo, timeout)
+			if err != nil {
+				Log().WithError(err).Warn("could not connect to lmtp at ", config.Address)
+				return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+			}
+			replies, err := lmtpDeliver(c, e)
+			_ = c.Close()
+			if err != nil {
+				Log().WithError(err).Warn("lmtp session failed")
+				return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+			}
+			if result, err := lmtpResult(e, replies, lmtpRetry(config.Address, config.Helo, timeout)); result != nil {
+				return result, err
+			}
+			return p.Process(e, task)
+		})
+	}
+}
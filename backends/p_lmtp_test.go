@@ -0,0 +1,187 @@
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeLMTP is a delivery agent that knows bob and full, whose mailbox is full
+type fakeLMTP struct {
+	ln        net.Listener
+	delivered map[string]string
+	sync.Mutex
+}
+
+func newFakeLMTP(t *testing.T, network, addr string) *fakeLMTP {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLMTP{ln: ln, delivered: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLMTP) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, _ = fmt.Fprint(conn, s+"\r\n")
+	}
+	reply("220 lmtp ready")
+	var rcpts []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "LHLO "):
+			reply("250-lmtp\r\n250 PIPELINING")
+		case strings.HasPrefix(line, "MAIL FROM:"):
+			reply("250 2.1.0 OK")
+		case strings.HasPrefix(line, "RCPT TO:"):
+			rcpt := strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			if strings.HasPrefix(rcpt, "bob@") || strings.HasPrefix(rcpt, "full@") {
+				rcpts = append(rcpts, rcpt)
+				reply("250 2.1.5 OK")
+			} else {
+				reply("550 5.1.1 <" + rcpt + "> User doesn't exist")
+			}
+		case line == "DATA":
+			reply("354 OK")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			for _, rcpt := range rcpts {
+				if strings.HasPrefix(rcpt, "full@") {
+					reply("452 4.2.2 <" + rcpt + "> Mailbox is full")
+					continue
+				}
+				f.Lock()
+				f.delivered[rcpt] = data.String()
+				f.Unlock()
+				reply("250 2.0.0 <" + rcpt + "> Saved")
+			}
+			rcpts = nil
+		case line == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("500 5.5.1 Unknown command")
+		}
+	}
+}
+
+func TestLMTPProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	socket := filepath.Join(dir, "lmtp")
+	f := newFakeLMTP(t, "unix", socket)
+	defer func() {
+		_ = f.ln.Close()
+	}()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":       "HeadersParser|LMTP|Debugger",
+		"validate_process":   "LMTP",
+		"lmtp_address":       "unix:" + socket,
+		"lmtp_validate_rcpt": true,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+
+	// the last recipient is validated
+	e := newBrokerTestEnvelope()
+	if err := backend.ValidateRcpt(e); err != NoSuchUser {
+		t.Error("expected eve to be unknown, got", err)
+	}
+	e.RcptTo = e.RcptTo[:1]
+	if err := backend.ValidateRcpt(e); err != nil {
+		t.Error("expected bob to be valid, got", err)
+	}
+
+	// eve is refused at RCPT, and only bob is delivered
+	e = newBrokerTestEnvelope()
+	e.Data.Reset()
+	e.Data.WriteString("Subject: hello\n\n.hidden\nhi\n")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected a partial delivery to be accepted, got", result)
+	}
+	if data := f.delivered["bob@Acme.com"]; data != "Subject: hello\r\n\r\n..hidden\r\nhi\r\n" {
+		t.Errorf("unexpected delivery %q", data)
+	}
+	if failed, _ := e.Values["lmtp_failed"].(map[string]string); len(failed) != 1 ||
+		!strings.HasPrefix(failed["eve@other.com"], "550 5.1.1") {
+		t.Error("expected eve's failure to be recorded, got", e.Values["lmtp_failed"])
+	}
+	if bounced, _ := e.Values[bouncedValue].([]BouncedRcpt); len(bounced) != 1 ||
+		bounced[0].Rcpt.String() != "eve@other.com" || !strings.HasPrefix(bounced[0].Reply, "550 5.1.1") {
+		t.Error("expected eve to be bounced, got", e.Values[bouncedValue])
+	}
+
+	// full is deferred, and retried once the email is accepted
+	e = newBrokerTestEnvelope()
+	e.RcptTo[1].User = "full"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected a partial delivery to be accepted, got", result)
+	}
+	if retries, _ := e.Values[retryValue].([]retryRcpts); len(retries) != 1 || len(retries[0].rcpts) != 1 {
+		t.Error("expected full to be retried, got", e.Values[retryValue])
+	} else {
+		c := e.Clone()
+		c.RcptTo = retries[0].rcpts
+		if failed := retries[0].retry(c); !strings.HasPrefix(failed["full@other.com"], "452 4.2.2") {
+			t.Error("expected the retry to be deferred again, got", failed)
+		}
+	}
+
+	// none delivered, the temporary failure is preferred
+	e = newBrokerTestEnvelope()
+	e.RcptTo[0].User = "full"
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "452 4.2.2") {
+		t.Error("expected the mailbox full tempfail, got", result)
+	}
+	e = newBrokerTestEnvelope()
+	e.RcptTo = e.RcptTo[1:]
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "550 5.1.1") {
+		t.Error("expected the unknown user to be refused, got", result)
+	}
+
+	// the delivery agent is down
+	_ = f.ln.Close()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail, got", result)
+	}
+}
@@ -0,0 +1,69 @@
+package backends
+
+import (
+	"errors"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: loopcheck
+// ----------------------------------------------------------------------------------
+// Description   : Rejects bounces (MAIL FROM:<>) that passed through too many hops,
+//               : a sign of a mail loop. Meant for the bounce_process chain.
+// ----------------------------------------------------------------------------------
+// Config Options: loopcheck_max_hops int - maximum number of Received headers,
+//               : defaults to 100 (RFC 5321 section 6.3)
+//               : loopcheck_all bool - check all envelopes, not just bounces
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header, parsed if not already populated by headersparser
+// ----------------------------------------------------------------------------------
+// Output        : none
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["loopcheck"] = func() Decorator {
+		return LoopCheck()
+	}
+}
+
+type LoopCheckConfig struct {
+	MaxHops int  `json:"loopcheck_max_hops,omitempty"`
+	All     bool `json:"loopcheck_all,omitempty"`
+}
+
+const defaultLoopCheckMaxHops = 100
+
+var errMailLoop = errors.New("mail loop detected, too many hops")
+
+func LoopCheck() Decorator {
+	var config *LoopCheckConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&LoopCheckConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*LoopCheckConfig)
+		if config.MaxHops <= 0 {
+			config.MaxHops = defaultLoopCheckMaxHops
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail && (e.MailFrom.NullPath || config.All) {
+				if e.HeaderIndex == nil {
+					if err := e.ParseHeaders(); err != nil {
+						Log().WithError(err).Error("parse headers error")
+					}
+				}
+				if hops := len(e.HeaderIndex.GetAll("Received")); hops > config.MaxHops {
+					Log().WithError(errMailLoop).Warnf("rejected %s, %d hops", e.QueuedId, hops)
+					return NewResult("554 5.4.6 Error: ", errMailLoop), errMailLoop
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: maildir
+// ----------------------------------------------------------------------------------
+// Description   : Delivers the email to the maildir of each recipient, honouring the
+//               : Maildir++ quota in its maildirsize file like Courier and Dovecot, so
+//               : that they agree on the usage. A recipient over quota gets a 452, so
+//               : that the sender tries again once there's room. When only some of the
+//               : recipients failed, the others keep the email, and the failed ones are
+//               : retried or bounced
+// ----------------------------------------------------------------------------------
+// Config Options: maildir_path string - the maildir of a recipient, {user}, {domain}
+//               : and {tenant} are replaced, eg. /var/vmail/{domain}/{user}/Maildir.
+//               : The cur, new and tmp directories are created when missing
+//               : maildir_quota string - the quota of the maildirs that have no
+//               : maildirsize file yet, eg. "1000000000S,10000C". By default, only the
+//               : maildirs with a maildirsize file have a quota
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader generated by the Header() processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["maildir"] is set to the files the email was saved to, and
+//               : e.Values["maildir_failed"] to the reply of each recipient that failed
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["maildir"] = func() Decorator {
+		return Maildir()
+	}
+	Svc.AddWholeMessage("maildir")
+}
+
+type MaildirProcessorConfig struct {
+	Path  string `json:"maildir_path"`
+	Quota string `json:"maildir_quota,omitempty"`
+}
+
+// maildirUserPlaceholder and maildirDomainPlaceholder are replaced in maildir_path
+const (
+	maildirUserPlaceholder   = "{user}"
+	maildirDomainPlaceholder = "{domain}"
+)
+
+var errMaildirDelivery = errors.New("maildir: the email could not be delivered")
+
+// maildirSeq makes the names of the files unique within the process
+var maildirSeq uint64
+
+// maildirDir returns the maildir of the recipient, or "" if its address can't be a directory name
+func maildirDir(path string, e *mail.Envelope, rcpt mail.Address) string {
+	user, domain := strings.ToLower(rcpt.User), strings.ToLower(rcpt.Host)
+	for _, name := range []string{user, domain} {
+		if strings.ContainsAny(name, "/\\\x00") || strings.HasPrefix(name, ".") {
+			return ""
+		}
+	}
+	if user == "" && strings.Contains(path, maildirUserPlaceholder) {
+		return ""
+	}
+	path = strings.Replace(ForTenant(path, e.Tenant), maildirUserPlaceholder, user, -1)
+	return strings.Replace(path, maildirDomainPlaceholder, domain, -1)
+}
+
+// maildirName returns a unique name for a message of size bytes, as Maildir++ writers do
+func maildirName(now time.Time, size int) string {
+	host, _ := os.Hostname()
+	host = strings.Replace(strings.Replace(host, "/", "\\057", -1), ":", "\\072", -1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&maildirSeq, 1), host, size)
+}
+
+// maildirDeliver saves the message to the new directory of the maildir, through its tmp
+// directory, if it fits in the quota. quotaBytes and quotaCount are the quota of a maildir
+// without a maildirsize file, 0 for none. It returns the file, or the reply for the recipient
+func maildirDeliver(dir string, data []byte, quotaBytes, quotaCount int64) (string, Result, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			Log().WithError(err).Error("could not create the maildir ", dir)
+			return "", NewResult(response.Canned.FailBackendTransaction), err
+		}
+	}
+	size := int64(len(data))
+	q, result, err := CheckMaildirQuota(dir, size)
+	if err != nil {
+		return "", result, err
+	}
+	if q == nil && (quotaBytes > 0 || quotaCount > 0) {
+		if q, err = SetMaildirQuota(dir, quotaBytes, quotaCount); err != nil {
+			Log().WithError(err).Error("could not set the maildir quota of ", dir)
+			return "", NewResult(response.Canned.FailBackendTransaction), err
+		}
+		if !q.Fits(size) {
+			return "", NewResult(response.Canned.ErrorMailboxOverQuota), QuotaExceeded
+		}
+	}
+	name := maildirName(time.Now(), len(data))
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		if _, err = f.Write(data); err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(dir, "new", name))
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		Log().WithError(err).Error("could not save the email to the maildir ", dir)
+		return "", NewResult(response.Canned.FailBackendTransaction), err
+	}
+	if q != nil {
+		if err := q.Add(size, 1); err != nil {
+			// the message is delivered, the usage is recalculated later
+			Log().WithError(err).Warn("could not update the maildir quota of ", dir)
+		}
+	}
+	return filepath.Join(dir, "new", name), nil, nil
+}
+
+// maildirDeliverAll delivers the email to the maildir of each of its recipients. It returns the
+// files, and the reply of each recipient that failed, by address
+func maildirDeliverAll(config *MaildirProcessorConfig, e *mail.Envelope) ([]string, map[string]Result) {
+	quotaBytes, quotaCount, _ := parseMaildirQuota(config.Quota)
+	data := []byte(e.String())
+	var files []string
+	var failed map[string]Result
+	for _, rcpt := range e.RcptTo {
+		var result Result
+		var file string
+		if dir := maildirDir(config.Path, e, rcpt); dir == "" {
+			result = NewResult(response.Canned.FailRcptCmd)
+		} else {
+			file, result, _ = maildirDeliver(dir, data, quotaBytes, quotaCount)
+		}
+		if result != nil {
+			if failed == nil {
+				failed = make(map[string]Result)
+			}
+			failed[rcpt.String()] = result
+			continue
+		}
+		files = append(files, file)
+		TrackRcptDelivery(e, rcpt, DeliveryStored, "maildir")
+	}
+	return files, failed
+}
+
+// maildirRetry returns the RetryFunc that delivers the email again to the recipients
+func maildirRetry(config *MaildirProcessorConfig) RetryFunc {
+	return func(e *mail.Envelope) map[string]string {
+		_, failed := maildirDeliverAll(config, e)
+		replies := make(map[string]string, len(failed))
+		for rcpt, result := range failed {
+			replies[rcpt] = result.String()
+		}
+		return replies
+	}
+}
+
+func Maildir() Decorator {
+	var config *MaildirProcessorConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MaildirProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*MaildirProcessorConfig)
+		if config.Path == "" {
+			return errors.New("the maildir processor needs a maildir_path")
+		}
+		if _, _, err := parseMaildirQuota(config.Quota); err != nil {
+			return err
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			files, failed := maildirDeliverAll(config, e)
+			if len(failed) == len(e.RcptTo) && len(failed) > 0 {
+				// the client may retry, unless the failures are all permanent
+				var result Result
+				for _, rcpt := range e.RcptTo {
+					r := failed[rcpt.String()]
+					TrackRcptDelivery(e, rcpt, DeliveryRejected, r.String())
+					if result == nil || r.Code()/100 == 4 {
+						result = r
+					}
+				}
+				return result, errMaildirDelivery
+			}
+			if len(failed) > 0 {
+				replies := make(map[string]string, len(failed))
+				var deferred []mail.Address
+				for _, rcpt := range e.RcptTo {
+					r, ok := failed[rcpt.String()]
+					if !ok {
+						continue
+					}
+					replies[rcpt.String()] = r.String()
+					if r.Code()/100 == 4 {
+						deferred = append(deferred, rcpt)
+					} else {
+						BounceRcpt(e, rcpt, r.String())
+					}
+				}
+				Log().Warnf("maildir delivered %s to %d of %d recipients, failed: %v",
+					e.QueuedId, len(e.RcptTo)-len(failed), len(e.RcptTo), replies)
+				e.Values["maildir_failed"] = replies
+				if len(deferred) > 0 {
+					RetryRcpts(e, deferred, maildirRetry(config))
+				}
+			}
+			e.Values["maildir"] = files
+			return p.Process(e, task)
+		})
+	}
+}
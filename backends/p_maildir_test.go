@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	h, err := NewProcessorHarness(BackendConfig{
+		"maildir_path":       filepath.Join(dir, "{domain}", "{user}"),
+		"maildir_quota":      "100S",
+		"log_received_mails": false,
+	}, func() Decorator { return Maildir() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = h.Shutdown()
+	}()
+
+	e, err := h.Envelope("sender@example.com", "Subject: hi\r\n\r\nhello\r\n", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := h.Save(e); err != nil || result.Code() != 200 {
+		t.Fatal("expected the email to be delivered", result, err)
+	}
+	files, _ := e.Values["maildir"].([]string)
+	if len(files) != 1 || !strings.HasPrefix(files[0], filepath.Join(dir, "example.com", "alice", "new")+"/") {
+		t.Fatal("unexpected files", files)
+	}
+	if data, err := ioutil.ReadFile(files[0]); err != nil || !strings.Contains(string(data), "hello") {
+		t.Error("expected the email in the maildir", string(data), err)
+	}
+	q, err := ReadMaildirQuota(filepath.Join(dir, "example.com", "alice"))
+	if err != nil || q == nil || q.Bytes != 100 || q.UsedCount != 1 {
+		t.Fatal("expected the default quota to be set and the usage updated", q, err)
+	}
+
+	// alice is now over quota, so she's retried while bob keeps the email,
+	// and .root can't be a directory name so it's bounced
+	big := "Subject: big\r\n\r\n" + strings.Repeat("x", 80) + "\r\n"
+	e, err = h.Envelope("sender@example.com", big, "alice@example.com", "bob@example.com", "\".root\"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := h.Save(e); err != nil || result.Code() != 200 {
+		t.Fatal("expected bob to get the email", result, err)
+	}
+	if files, _ := e.Values["maildir"].([]string); len(files) != 1 || !strings.Contains(files[0], "bob") {
+		t.Error("expected only bob's file, got", files)
+	}
+	failed, _ := e.Values["maildir_failed"].(map[string]string)
+	if len(failed) != 2 || !strings.HasPrefix(failed["alice@example.com"], "452") {
+		t.Error("expected alice to be over quota, got", failed)
+	}
+	if bounced, _ := e.Values[bouncedValue].([]BouncedRcpt); len(bounced) != 1 || bounced[0].Rcpt.User != ".root" {
+		t.Error("expected .root to be bounced, got", e.Values[bouncedValue])
+	}
+	retries, _ := e.Values[retryValue].([]retryRcpts)
+	if len(retries) != 1 || len(retries[0].rcpts) != 1 || retries[0].rcpts[0].User != "alice" {
+		t.Fatal("expected alice to be retried, got", e.Values[retryValue])
+	}
+	// still over quota when retried
+	e.RcptTo = retries[0].rcpts
+	if replies := retries[0].retry(e); !strings.HasPrefix(replies["alice@example.com"], "452") {
+		t.Error("expected the retry to fail while alice is over quota, got", replies)
+	}
+
+	// when nobody got the email, the client is told to try again
+	e, err = h.Envelope("sender@example.com", big, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := h.Save(e); err == nil || result.Code() != 452 {
+		t.Error("expected a 452 when alice is over quota", result, err)
+	}
+}
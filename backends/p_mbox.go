@@ -0,0 +1,109 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mbox
+// ----------------------------------------------------------------------------------
+// Description   : Appends the email to mbox files for archiving, in the mboxrd format.
+//               : The files are locked while writing, and rotated when they get too big
+// ----------------------------------------------------------------------------------
+// Config Options: mbox_path string - the file to append to, {tenant}, {domain} (of the
+//               : recipients) and {date} (2006-01-02) are replaced,
+//               : eg. /var/archive/{domain}/{date}.mbox. With {domain}, the email is
+//               : appended once for each domain of its recipients
+//               : mbox_max_size int - the size in bytes a file may grow to, before it is
+//               : renamed to <name>.1, <name>.2 etc. 0 doesn't rotate
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader generated by the Header() processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["mbox"] is set to the files the email was appended to
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["mbox"] = func() Decorator {
+		return Mbox()
+	}
+	Svc.AddWholeMessage("mbox")
+}
+
+type MboxProcessorConfig struct {
+	Path    string `json:"mbox_path"`
+	MaxSize int    `json:"mbox_max_size,omitempty"`
+}
+
+// mboxDomainPlaceholder and mboxDatePlaceholder are replaced in mbox_path
+const (
+	mboxDomainPlaceholder = "{domain}"
+	mboxDatePlaceholder   = "{date}"
+)
+
+// mboxFiles returns the files the envelope is appended to
+func mboxFiles(path string, e *mail.Envelope, now time.Time) []string {
+	path = strings.Replace(ForTenant(path, e.Tenant), mboxDatePlaceholder, now.Format("2006-01-02"), -1)
+	if !strings.Contains(path, mboxDomainPlaceholder) {
+		return []string{path}
+	}
+	var files []string
+	seen := make(map[string]bool)
+	for i := range e.RcptTo {
+		domain := strings.ToLower(e.RcptTo[i].Host)
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		files = append(files, strings.Replace(path, mboxDomainPlaceholder, domain, -1))
+	}
+	return files
+}
+
+func Mbox() Decorator {
+	var config *MboxProcessorConfig
+	// writes are serialized here too, where the files can't be locked
+	var mu sync.Mutex
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MboxProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*MboxProcessorConfig)
+		if config.Path == "" {
+			return errors.New("the mbox processor needs an mbox_path")
+		}
+		if config.MaxSize < 0 {
+			return errors.New("mbox_max_size can't be negative")
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			now := time.Now()
+			files := mboxFiles(config.Path, e, now)
+			data := []byte(e.String())
+			mu.Lock()
+			for _, name := range files {
+				if err := appendMbox(name, int64(config.MaxSize), e.MailFrom.String(), now, data); err != nil {
+					mu.Unlock()
+					Log().WithError(err).Errorf("could not append the email to %s", name)
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+			}
+			mu.Unlock()
+			e.Values["mbox"] = files
+			TrackDelivery(e, DeliveryStored, "mbox")
+			return p.Process(e, task)
+		})
+	}
+}
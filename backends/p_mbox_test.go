@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":  "HeadersParser|Mbox|Debugger",
+		"mbox_path":     filepath.Join(dir, "{tenant}", "{domain}", "{date}.mbox"),
+		"mbox_max_size": 120,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	e.Data.Reset()
+	e.Data.WriteString("Subject: hello\r\n\r\nFrom here\r\n>From there\r\nbye")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	date := time.Now().Format("2006-01-02")
+	acme := filepath.Join(dir, "acme", "acme.com", date+".mbox")
+	if files, _ := e.Values["mbox"].([]string); len(files) != 2 || files[0] != acme {
+		t.Error("expected a file for each recipient domain, got", e.Values["mbox"])
+	}
+	data, err := ioutil.ReadFile(acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(data)
+	if !strings.HasPrefix(msg, "From test@example.com ") || strings.Contains(msg, "\r") ||
+		!strings.HasSuffix(msg, "\n>From here\n>>From there\nbye\n\n") {
+		t.Errorf("unexpected mbox %q", msg)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme", "other.com", date+".mbox")); err != nil {
+		t.Error("expected a file for other.com,", err)
+	}
+
+	// a bounce doesn't fit, the file is rotated
+	e = newBrokerTestEnvelope()
+	e.MailFrom.User, e.MailFrom.Host = "", ""
+	e.RcptTo = e.RcptTo[:1]
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	data, _ = ioutil.ReadFile(acme)
+	rotated, _ := ioutil.ReadFile(acme + ".1")
+	if !strings.HasPrefix(string(data), "From MAILER-DAEMON ") || string(rotated) != msg {
+		t.Errorf("expected the file to be rotated, got %q and %q", data, rotated)
+	}
+}
+
+func TestAppendMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	name := filepath.Join(dir, "archive.mbox")
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := appendMbox(name, 0, "a@example.com", date, []byte("Subject: hi\n\nhi\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := ioutil.ReadFile(name)
+	if strings.Count(string(data), "From a@example.com Thu Jan  2 03:04:05 2020\n") != 5 {
+		t.Errorf("expected 5 messages, got %q", data)
+	}
+	if _, err := os.Stat(name + ".1"); !os.IsNotExist(err) {
+		t.Error("expected no rotation without a max size")
+	}
+}
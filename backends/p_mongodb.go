@@ -0,0 +1,395 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mongodb
+// ----------------------------------------------------------------------------------
+// Description   : Saves the e.Data (email data) and e.DeliveryHeader together in
+//               : MongoDB, as a document for each recipient with the same fields as
+//               : the sql processor, and the headers as a sub-document. Mail larger
+//               : than mongo_gridfs_threshold is saved once in GridFS, and the
+//               : documents refer to the file. The driver supports MongoDB 3.6 and later
+// ----------------------------------------------------------------------------------
+// Config Options: mongo_uri string - connection string, eg. "mongodb://host/mail".
+//               : Required
+//               : mongo_database string - defaults to the database of mongo_uri,
+//               : otherwise "guerrilla"
+//               : mongo_collection string - {tenant} is replaced with the envelope's
+//               : tenant. Defaults to "mail"
+//               : mongo_write_concern string - the number of servers that must
+//               : acknowledge a save, "majority" or a tag set. Defaults to "1", "0"
+//               : doesn't wait for an acknowledgement
+//               : mongo_journal bool - wait for the save to be in the journal
+//               : mongo_write_timeout string - how long to wait for the write concern,
+//               : eg. "5s"
+//               : mongo_gridfs_threshold int - mail larger than this number of bytes is
+//               : saved in GridFS. Off when 0
+//               : mongo_gridfs_prefix string - name of the GridFS bucket, default "fs"
+//               : primary_mail_host string - primary host name
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by ParseHeader() processor
+//               : e.Header generated by ParseHeader() processor
+//               : e.MailFrom
+//               : e.Subject - generated by by ParseHeader() processor
+//               : e.Tags
+//               : e.Values["zlib-compressor"] - set by the compressor processor
+//               : e.Values["redis"] - set by the redis processor
+//               : e.Values["s3"] - set by the s3 processor
+//               : a streamed email is refused without it
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.QueuedId with the first item fromHashes[0]
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["mongodb"] = func() Decorator {
+		return MongoDB()
+	}
+	Svc.AddDependencies("mongodb", "hasher", "headersparser")
+}
+
+type MongoDBProcessorConfig struct {
+	URI             string `json:"mongo_uri"`
+	Database        string `json:"mongo_database,omitempty"`
+	Collection      string `json:"mongo_collection,omitempty"`
+	WriteConcern    string `json:"mongo_write_concern,omitempty"`
+	Journal         bool   `json:"mongo_journal,omitempty"`
+	WriteTimeout    string `json:"mongo_write_timeout,omitempty"`
+	GridFSThreshold int    `json:"mongo_gridfs_threshold,omitempty"`
+	GridFSPrefix    string `json:"mongo_gridfs_prefix,omitempty"`
+	PrimaryHost     string `json:"primary_mail_host"`
+}
+
+const (
+	defaultMongoDatabase   = "guerrilla"
+	defaultMongoCollection = "mail"
+	mongoDialTimeout       = 10 * time.Second
+	// mongoSaveTimeout is how long a save may take, including waiting for the write concern
+	mongoSaveTimeout = time.Minute
+)
+
+func (c *MongoDBProcessorConfig) collection() string {
+	if c.Collection == "" {
+		return defaultMongoCollection
+	}
+	return c.Collection
+}
+
+func (c *MongoDBProcessorConfig) gridFSPrefix() string {
+	if c.GridFSPrefix == "" {
+		return "fs"
+	}
+	return c.GridFSPrefix
+}
+
+// writeConcern returns the write concern of the saves
+func (c *MongoDBProcessorConfig) writeConcern() (*writeconcern.WriteConcern, error) {
+	wc := &writeconcern.WriteConcern{}
+	if c.Journal {
+		journal := true
+		wc.Journal = &journal
+	}
+	switch w := strings.TrimSpace(c.WriteConcern); w {
+	case "":
+		wc.W = 1
+	case "majority":
+		wc.W = w
+	default:
+		if n, err := strconv.Atoi(w); err == nil {
+			if n < 0 {
+				return nil, fmt.Errorf("invalid mongo_write_concern %q", c.WriteConcern)
+			}
+			if n > 0 || !c.Journal {
+				// waiting for the journal is an acknowledgement, so w is left to the server then
+				wc.W = n
+			}
+		} else {
+			// the name of a tag set in the replica set's configuration
+			wc.W = w
+		}
+	}
+	if c.WriteTimeout != "" {
+		d, err := time.ParseDuration(c.WriteTimeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid mongo_write_timeout %q", c.WriteTimeout)
+		}
+		wc.WTimeout = d
+	}
+	return wc, nil
+}
+
+// mongoMail is the document saved for each recipient
+type mongoMail struct {
+	Id          primitive.ObjectID  `bson:"_id"`
+	Date        time.Time           `bson:"date"`
+	To          string              `bson:"to"`
+	From        string              `bson:"from"`
+	Subject     string              `bson:"subject"`
+	Body        string              `bson:"body"`
+	Mail        []byte              `bson:"mail,omitempty"`
+	MailFile    interface{}         `bson:"mail_file,omitempty"`
+	Hash        string              `bson:"hash"`
+	Headers     map[string][]string `bson:"headers"`
+	ContentType string              `bson:"content_type"`
+	Recipient   string              `bson:"recipient"`
+	IPAddr      string              `bson:"ip_addr"`
+	ReturnPath  string              `bson:"return_path"`
+	IsTLS       bool                `bson:"is_tls"`
+	MessageId   string              `bson:"message_id"`
+	ReplyTo     string              `bson:"reply_to"`
+	Sender      string              `bson:"sender"`
+	Tenant      string              `bson:"tenant,omitempty"`
+	Tags        []string            `bson:"tags,omitempty"`
+}
+
+// mongoHeaders returns the headers as a sub-document. Field names can't contain dots
+// or start with a $, so these are replaced with an underscore
+func mongoHeaders(e *mail.Envelope) map[string][]string {
+	headers := make(map[string][]string, len(e.Header))
+	for k, v := range e.Header {
+		k = strings.Replace(k, ".", "_", -1)
+		if strings.HasPrefix(k, "$") {
+			k = "_" + k[1:]
+		}
+		headers[k] = append(headers[k], v...)
+	}
+	return headers
+}
+
+type MongoDBProcessor struct {
+	client *mongo.Client
+	config *MongoDBProcessorConfig
+	// used for the helpers that fill in the fields shared with the sql processor
+	fields *SQLProcessor
+}
+
+func (m *MongoDBProcessor) connect() (*mongo.Client, error) {
+	cs, err := connstring.ParseAndValidate(m.config.URI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mongo_uri: %s", err)
+	}
+	wc, err := m.config.writeConcern()
+	if err != nil {
+		return nil, err
+	}
+	if m.config.Database == "" {
+		m.config.Database = cs.Database
+		if m.config.Database == "" {
+			m.config.Database = defaultMongoDatabase
+		}
+	}
+	opts := options.Client().ApplyURI(m.config.URI).
+		SetConnectTimeout(mongoDialTimeout).
+		SetServerSelectionTimeout(mongoDialTimeout).
+		SetReadPreference(readpref.Primary()).
+		SetWriteConcern(wc)
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDialTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, opts)
+	if err == nil {
+		// Connect doesn't wait for the servers, so fail now rather than at the first save
+		if err = client.Ping(ctx, readpref.Primary()); err != nil {
+			_ = client.Disconnect(context.Background())
+		}
+	}
+	if err != nil {
+		Log().WithError(err).Error("cannot connect to MongoDB")
+		return nil, err
+	}
+	return client, nil
+}
+
+// documents returns a document for each recipient, data is the mail, or empty if it
+// was saved in GridFS or Redis
+func (m *MongoDBProcessor) documents(e *mail.Envelope, body string, data []byte, file interface{}) []interface{} {
+	hash := ""
+	if len(e.Hashes) > 0 {
+		hash = e.Hashes[0]
+	}
+	contentType := trimToLimit(e.Header.Get("Content-Type"), 255)
+	headers := mongoHeaders(e)
+	var tags []string
+	if len(e.Tags) > 0 {
+		tags = e.Tags.Strings()
+	}
+	now := time.Now()
+	docs := make([]interface{}, 0, len(e.RcptTo))
+	for i := range e.RcptTo {
+		// use the To header, otherwise rcpt to
+		to := trimToLimit(m.fields.fillAddressFromHeader(e, "To"), 255)
+		if to == "" {
+			to = trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255)
+		}
+		mid := trimToLimit(m.fields.fillAddressFromHeader(e, "Message-Id"), 255)
+		if mid == "" {
+			mid = fmt.Sprintf("%s.%s@%s", hash, e.RcptTo[i].User, m.config.PrimaryHost)
+		}
+		docs = append(docs, &mongoMail{
+			Id:          primitive.NewObjectID(),
+			Date:        now,
+			To:          to,
+			From:        trimToLimit(e.MailFrom.String(), 255),
+			Subject:     trimToLimit(e.Subject, 255),
+			Body:        body,
+			Mail:        data,
+			MailFile:    file,
+			Hash:        hash,
+			Headers:     headers,
+			ContentType: contentType,
+			Recipient:   trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255),
+			IPAddr:      e.RemoteIP,
+			ReturnPath:  trimToLimit(e.MailFrom.String(), 255),
+			IsTLS:       e.TLS,
+			MessageId:   mid,
+			ReplyTo:     trimToLimit(m.fields.fillAddressFromHeader(e, "Reply-To"), 255),
+			Sender:      trimToLimit(m.fields.fillAddressFromHeader(e, "Sender"), 255),
+			Tenant:      e.Tenant,
+			Tags:        tags,
+		})
+	}
+	return docs
+}
+
+// saveFile saves the mail in GridFS, once for all the recipients, and returns the id of the file
+func (m *MongoDBProcessor) saveFile(db *mongo.Database, deadline time.Time, e *mail.Envelope, data []byte) (interface{}, error) {
+	// a bucket for each save, as its deadline is shared by its uploads
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(m.config.gridFSPrefix()))
+	if err != nil {
+		return nil, err
+	}
+	if err = bucket.SetWriteDeadline(deadline); err != nil {
+		return nil, err
+	}
+	id, err := bucket.UploadFromStream(e.QueuedId, bytes.NewReader(data),
+		options.GridFSUpload().SetMetadata(bson.D{{Key: "contentType", Value: "message/rfc822"}}))
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func MongoDB() Decorator {
+	var config *MongoDBProcessorConfig
+	m := &MongoDBProcessor{fields: &SQLProcessor{}}
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MongoDBProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*MongoDBProcessorConfig)
+		if config.URI == "" {
+			return errors.New("mongo_uri is required by the mongodb processor")
+		}
+		if config.GridFSThreshold < 0 {
+			return fmt.Errorf("invalid mongo_gridfs_threshold %d", config.GridFSThreshold)
+		}
+		m.config = config
+		m.client, err = m.connect()
+		return err
+	}))
+
+	// shutdown closes the connections
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if m.client != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), mongoDialTimeout)
+			defer cancel()
+			err := m.client.Disconnect(ctx)
+			m.client = nil
+			return err
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if missingStreamedBody(e) {
+					// only the header section is here, and the message was not saved to a bucket
+					Log().Error("mongodb: the streamed email was not saved to s3, refusing to save only its header")
+					return NewResult(response.Canned.FailBackendTransaction), StorageError
+				}
+				var body string
+				if len(e.Hashes) > 0 {
+					e.QueuedId = e.Hashes[0]
+				}
+				var data []byte
+				if c, ok := e.Values["zlib-compressor"]; ok {
+					// a compressor was set by the Compress processor
+					body = "gzip"
+					data = []byte(c.(*DataCompressor).String())
+				} else {
+					data = []byte(e.String())
+				}
+				if _, ok := e.Values["redis"]; ok {
+					body = "redis"
+					data = nil
+				}
+				if s3, ok := e.Values["s3"].(string); ok {
+					// the message is in the bucket, save its URL
+					body = "s3"
+					data = []byte(s3)
+				}
+				// the client has a pool of connections, shared by the workers
+				ctx, cancel := context.WithTimeout(context.Background(), mongoSaveTimeout)
+				defer cancel()
+				deadline, _ := ctx.Deadline()
+				db := m.client.Database(config.Database)
+				var file interface{}
+				if config.GridFSThreshold > 0 && len(data) > config.GridFSThreshold {
+					var err error
+					if file, err = m.saveFile(db, deadline, e, data); err != nil {
+						Log().WithError(err).Error("could not save the email to GridFS")
+						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					}
+					data = nil
+				}
+				docs := m.documents(e, body, data, file)
+				if len(docs) > 0 {
+					_, err := db.Collection(ForTenant(config.collection(), e.Tenant)).InsertMany(ctx, docs)
+					if err != nil {
+						Log().WithError(err).Error("There was a problem the insert")
+						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					}
+				}
+				for i := range e.RcptTo {
+					TrackRcptDelivery(e, e.RcptTo[i], DeliveryStored, "mongodb")
+				}
+
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else if task == TaskValidateRcpt {
+				if len(e.RcptTo) > 0 {
+					// validate only the _last_ recipient that was appended
+					last := e.RcptTo[len(e.RcptTo)-1]
+					if len(last.User) > 255 {
+						return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+					}
+				}
+				return p.Process(e, task)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
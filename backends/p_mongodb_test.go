@@ -0,0 +1,165 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var mongoURIFlag = flag.String("mongo-uri", "", "Connection string to use for testing the MongoDB backend")
+
+func TestMongoDBWriteConcern(t *testing.T) {
+	for _, test := range []struct {
+		concern, timeout string
+		journal          bool
+		w                interface{}
+		wtimeout         time.Duration
+		acknowledged     bool
+	}{
+		{"", "", false, 1, 0, true},
+		{"0", "", false, 0, 0, false},
+		{"0", "", true, nil, 0, true},
+		{"2", "1500ms", false, 2, 1500 * time.Millisecond, true},
+		{"majority", "", true, "majority", 0, true},
+		{"dc-east", "", false, "dc-east", 0, true},
+	} {
+		c := &MongoDBProcessorConfig{WriteConcern: test.concern, WriteTimeout: test.timeout, Journal: test.journal}
+		wc, err := c.writeConcern()
+		if err != nil {
+			t.Error(test.concern, err)
+			continue
+		}
+		if wc.W != test.w || wc.GetJ() != test.journal || wc.WTimeout != test.wtimeout ||
+			wc.Acknowledged() != test.acknowledged || !wc.IsValid() {
+			t.Errorf("%q: unexpected write concern %+v", test.concern, wc)
+		}
+	}
+	for _, c := range []*MongoDBProcessorConfig{{WriteConcern: "-1"}, {WriteTimeout: "soon"}} {
+		if _, err := c.writeConcern(); err == nil {
+			t.Error("expected an error for", c)
+		}
+	}
+}
+
+func TestMongoDBDocuments(t *testing.T) {
+	m := &MongoDBProcessor{config: &MongoDBProcessorConfig{PrimaryHost: "example.com"}, fields: &SQLProcessor{}}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "user", Host: "example.com"}, {User: "other", Host: "example.com"}}
+	e.Hashes = []string{"abc123"}
+	e.Tags.Add("dkim", "pass")
+	e.Data.WriteString("Subject: test\nContent-Type: text/plain\nX.Dotted: yes\n$Dollar: 1\n\nhello\n")
+	e.ParseHeaders()
+	docs := m.documents(e, "", []byte(e.String()), nil)
+	if len(docs) != 2 {
+		t.Fatal("expected a document for each recipient, got", len(docs))
+	}
+	doc := docs[1].(*mongoMail)
+	if doc.Recipient != "other@example.com" || doc.Hash != "abc123" || doc.Subject != "test" ||
+		doc.ContentType != "text/plain" || doc.MessageId != "abc123.other@example.com" || doc.IPAddr != "127.0.0.1" {
+		t.Errorf("unexpected document %+v", doc)
+	}
+	if len(doc.Tags) != 1 || doc.Tags[0] != "dkim:pass" {
+		t.Error("expected the tags, got", doc.Tags)
+	}
+	if doc.Headers["X_dotted"] == nil || doc.Headers["_dollar"] == nil || doc.Headers["Subject"][0] != "test" {
+		t.Error("unexpected headers", doc.Headers)
+	}
+	// the headers must be valid field names
+	if _, err := bson.Marshal(doc); err != nil {
+		t.Error(err)
+	}
+	if docs[0].(*mongoMail).Id == doc.Id {
+		t.Error("expected each document to have an id")
+	}
+	file := primitive.NewObjectID()
+	doc = m.documents(e, "gzip", nil, file)[0].(*mongoMail)
+	raw, _ := bson.Marshal(doc)
+	var fields bson.M
+	_ = bson.Unmarshal(raw, &fields)
+	if _, ok := fields["mail"]; ok || fields["mail_file"] != file || fields["body"] != "gzip" {
+		t.Error("expected a reference to the file instead of the mail, got", fields)
+	}
+}
+
+func TestMongoDB(t *testing.T) {
+	if *mongoURIFlag == "" {
+		t.Skip("requires -mongo-uri to run")
+	}
+	logger, err := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	if err != nil {
+		t.Fatal("get logger:", err)
+	}
+	collection := "test_" + primitive.NewObjectID().Hex()
+	cfg := BackendConfig{
+		"save_process":           "HeadersParser|Hasher|MongoDB",
+		"mongo_uri":              *mongoURIFlag,
+		"mongo_database":         "guerrilla_test",
+		"mongo_collection":       collection,
+		"mongo_gridfs_threshold": 16,
+		"mongo_gridfs_prefix":    collection,
+		"primary_mail_host":      "example.com",
+	}
+	backend, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*mongoURIFlag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Disconnect(ctx)
+	}()
+	db := client.Database("guerrilla_test")
+	defer func() {
+		_ = db.Collection(collection).Drop(ctx)
+		_ = db.Collection(collection + ".files").Drop(ctx)
+		_ = db.Collection(collection + ".chunks").Drop(ctx)
+	}()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "user", Host: "example.com"}, {User: "other", Host: "example.com"}}
+	e.Hashes = []string{"abc123"}
+	e.Data.WriteString("Subject: test\n\nhello, this is longer than the threshold\n")
+	if result := backend.Process(e); !strings.Contains(result.String(), "abc123") {
+		t.Fatalf("expected message to be queued with hash, got %q", result)
+	}
+	var docs []mongoMail
+	cursor, err := db.Collection(collection).Find(ctx, bson.M{"hash": "abc123"})
+	if err == nil {
+		err = cursor.All(ctx, &docs)
+	}
+	if err != nil || len(docs) != 2 {
+		t.Fatal("expected a document for each recipient, got", len(docs), err)
+	}
+	if docs[0].MailFile == nil || docs[0].MailFile != docs[1].MailFile || len(docs[0].Mail) != 0 {
+		t.Fatal("expected the mail to be saved once in GridFS", docs[0].MailFile, docs[1].MailFile)
+	}
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(collection))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := bucket.DownloadToStream(docs[0].MailFile, &buf); err != nil || !strings.Contains(buf.String(), "hello") {
+		t.Error("expected the message in GridFS, got", buf.String(), err)
+	}
+}
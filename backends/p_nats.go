@@ -0,0 +1,172 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+	"github.com/nats-io/nats.go"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: nats
+// ----------------------------------------------------------------------------------
+// Description   : Publishes each email to a NATS JetStream stream, as the raw message
+//               : or as json with the headers and the envelope. The first hash of
+//               : e.Hashes is the Nats-Msg-Id, so that the stream drops the email if it's
+//               : published again in its duplicate window, eg. when a client retries.
+//               : The email is only accepted once the stream acknowledged it; when NATS
+//               : can't be reached in nats_timeout, a 451 asks the client to try later
+// ----------------------------------------------------------------------------------
+// Config Options: nats_url string - eg. "nats://localhost:4222", or a comma separated
+//               : list of servers. Required
+//               : nats_subject string - a subject of the stream, {tenant} is replaced
+//               : with the tenant and {domain} with the domain of the first recipient,
+//               : eg. "mail.{tenant}.{domain}". Required
+//               : nats_stream string - the name of the stream, the publish fails if the
+//               : subject belongs to another stream. Not checked if empty
+//               : nats_format string - "rfc822" (default) or "json"
+//               : nats_json_data bool - add the message to the json, as "data"
+//               : nats_timeout string - how long to wait for the ack, default "10s"
+//               : nats_tls bool - connect with TLS
+//               : nats_credentials string - path of a .creds file
+//               : nats_username, nats_password string - for user and password auth
+//               : nats_token string - for token auth
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by Header() processor
+//               : e.Header generated by ParseHeader() processor
+//               : e.Hashes - set by the hasher processor, needed for the deduplication
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.QueuedId with the first item fromHashes[0], if set
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["nats"] = func() Decorator {
+		return NATS()
+	}
+	Svc.AddWholeMessage("nats")
+}
+
+type NATSProcessorConfig struct {
+	URL         string `json:"nats_url"`
+	Subject     string `json:"nats_subject"`
+	Stream      string `json:"nats_stream,omitempty"`
+	Format      string `json:"nats_format,omitempty"`
+	JSONData    bool   `json:"nats_json_data,omitempty"`
+	Timeout     string `json:"nats_timeout,omitempty"`
+	TLS         bool   `json:"nats_tls,omitempty"`
+	Credentials string `json:"nats_credentials,omitempty"`
+	Username    string `json:"nats_username,omitempty"`
+	Password    string `json:"nats_password,omitempty"`
+	Token       string `json:"nats_token,omitempty"`
+}
+
+const defaultNATSTimeout = time.Second * 10
+
+// check validates the config and sets the defaults
+func (c *NATSProcessorConfig) check() error {
+	if c.URL == "" || c.Subject == "" {
+		return fmt.Errorf("nats_url and nats_subject are required by the nats processor")
+	}
+	c.Format = strings.ToLower(c.Format)
+	if c.Format == "" {
+		c.Format = "rfc822"
+	} else if c.Format != "rfc822" && c.Format != "json" {
+		return fmt.Errorf("invalid nats_format %q, expected rfc822 or json", c.Format)
+	}
+	return nil
+}
+
+// natsMsg returns the message of the envelope, with the envelope in the headers
+func natsMsg(subject string, e *mail.Envelope, config *NATSProcessorConfig) (*nats.Msg, error) {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("Queued-Id", e.QueuedId)
+	if e.Tenant != "" {
+		msg.Header.Set("Tenant", e.Tenant)
+	}
+	// anonymized mail is only published as json, without the message
+	if config.Format == "json" || Anonymization != nil {
+		data, err := json.Marshal(newMailEvent(e, config.JSONData))
+		if err != nil {
+			return nil, err
+		}
+		msg.Header.Set("Content-Type", "application/json")
+		msg.Data = data
+		return msg, nil
+	}
+	msg.Header.Set("Content-Type", "message/rfc822")
+	msg.Header.Set("Mail-From", e.MailFrom.String())
+	for i := range e.RcptTo {
+		msg.Header.Add("Rcpt-To", e.RcptTo[i].String())
+	}
+	msg.Data = []byte(e.String())
+	return msg, nil
+}
+
+func NATS() Decorator {
+	var config *NATSProcessorConfig
+	var publisher *natsPublisher
+	timeout := defaultNATSTimeout
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&NATSProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*NATSProcessorConfig)
+		if err := config.check(); err != nil {
+			return err
+		}
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid nats_timeout %q", config.Timeout)
+			}
+		}
+		if publisher, err = useNATSPublisher(config); err != nil {
+			return fmt.Errorf("could not connect to nats: %s", err)
+		}
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if publisher != nil {
+			publisher.release()
+			publisher = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				var id string
+				if len(e.Hashes) > 0 {
+					e.QueuedId = e.Hashes[0]
+					id = e.Hashes[0]
+				}
+				subject := natsSubject(config.Subject, e)
+				msg, err := natsMsg(subject, e, config)
+				if err != nil {
+					Log().WithError(err).Error("could not encode the email for nats")
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				}
+				ack, err := publisher.publish(msg, id, config.Stream, timeout)
+				if err == nats.ErrMaxPayload {
+					Log().WithError(err).Error("the email is larger than the max_payload of the nats server")
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				} else if err != nil {
+					// the servers may be back soon, so the client should try again later
+					Log().WithError(err).Warn("could not publish the email to nats subject ", subject)
+					return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+				}
+				if ack.Duplicate {
+					Log().Debugf("the email %s was published to the %s stream already", id, ack.Stream)
+				}
+				TrackDelivery(e, DeliveryStored, "nats")
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package backends
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeNATS is a stream that keeps the messages and detects duplicates, or fails with err
+type fakeNATS struct {
+	messages []*nats.Msg
+	ids      map[string]bool
+	connects int
+	closed   int
+	err      error
+	sync.Mutex
+}
+
+func (n *fakeNATS) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.err != nil {
+		return nil, n.err
+	}
+	ack := &nats.PubAck{Stream: "MAIL", Sequence: uint64(len(n.messages) + 1)}
+	if id := m.Header.Get(nats.MsgIdHdr); id != "" {
+		if n.ids[id] {
+			ack.Duplicate = true
+			return ack, nil
+		}
+		n.ids[id] = true
+	}
+	n.messages = append(n.messages, m)
+	return ack, nil
+}
+
+func (n *fakeNATS) Close() {
+	n.Lock()
+	defer n.Unlock()
+	n.closed++
+}
+
+func useFakeNATS() (*fakeNATS, func()) {
+	n := &fakeNATS{ids: make(map[string]bool)}
+	saved := natsConnect
+	natsConnect = func(config *NATSProcessorConfig) (natsStream, error) {
+		n.Lock()
+		defer n.Unlock()
+		n.connects++
+		return n, nil
+	}
+	return n, func() { natsConnect = saved }
+}
+
+func TestNATSProcessor(t *testing.T) {
+	n, restore := useFakeNATS()
+	defer restore()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Hasher|NATS|Debugger",
+		"save_workers_size": 2,
+		"nats_url":          "nats://localhost:4222",
+		"nats_subject":      "mail.{tenant}.{domain}",
+		"nats_format":       "json",
+		"nats_stream":       "MAIL",
+	})
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be published, got", result)
+	}
+	if len(n.messages) != 1 || n.messages[0].Subject != "mail.acme.acme.com" || n.connects != 1 {
+		t.Fatal("expected a message for the recipient domain on one connection, got", n.messages, n.connects)
+	}
+	msg := n.messages[0]
+	if msg.Header.Get(nats.MsgIdHdr) != e.Hashes[0] || msg.Header.Get(nats.ExpectedStreamHdr) != "MAIL" ||
+		msg.Header.Get("Queued-Id") != e.Hashes[0] {
+		t.Error("expected the hash to be the message id, got", msg.Header)
+	}
+	var event mailEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Subject != "hello" || len(event.To) != 2 || event.Data != "" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	// the same email is accepted again, but not added to the stream
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") ||
+		len(n.messages) != 1 {
+		t.Error("expected the duplicate to be dropped, got", result, len(n.messages))
+	}
+
+	// the client is asked to try again when the servers can't be reached
+	n.err = nats.ErrTimeout
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451 4.3.0") {
+		t.Error("expected a tempfail, got", result)
+	}
+	n.err = nats.ErrMaxPayload
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "554") {
+		t.Error("expected a permanent failure, got", result)
+	}
+	_ = backend.Shutdown()
+	if n.closed != 1 {
+		t.Error("expected the connection to be closed once, got", n.closed)
+	}
+}
+
+func TestNATSProcessorRaw(t *testing.T) {
+	n, restore := useFakeNATS()
+	defer restore()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Header|NATS|Debugger",
+		"primary_mail_host": "mail.acme.com",
+		"nats_url":          "nats://localhost:4222",
+		"nats_subject":      "mail",
+		"nats_timeout":      "1s",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be published, got", result)
+	}
+	if len(n.messages) != 1 {
+		t.Fatal("expected a message, got", n.messages)
+	}
+	msg := n.messages[0]
+	if !strings.Contains(string(msg.Data), "Received: from") || msg.Header.Get(nats.MsgIdHdr) != "" ||
+		len(msg.Header["Rcpt-To"]) != 2 || msg.Header.Get("Mail-From") != "test@example.com" {
+		t.Error("expected the raw message with the envelope in the headers, got", msg.Header, string(msg.Data))
+	}
+}
+
+func TestNATSConfig(t *testing.T) {
+	c := &NATSProcessorConfig{URL: "nats://localhost:4222", Subject: "mail"}
+	if err := c.check(); err != nil || c.Format != "rfc822" {
+		t.Error("unexpected defaults", c, err)
+	}
+	for _, bad := range []NATSProcessorConfig{
+		{Subject: "mail"},
+		{URL: "nats://localhost:4222"},
+		{URL: "nats://localhost:4222", Subject: "mail", Format: "xml"},
+	} {
+		if err := bad.check(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package backends
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/ipaddr"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+
+	_ "github.com/lib/pq"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: postgresql
+// ----------------------------------------------------------------------------------
+// Description   : Saves the e.Data (email data) and e.DeliveryHeader together in
+//               : PostgreSQL, with the same columns as the sql processor. The mail
+//               : and ip_addr columns are bytea
+// ----------------------------------------------------------------------------------
+// Config Options: pg_table string - name of table for storing emails, {tenant} is
+//               : replaced with the envelope's tenant
+//               : pg_host string - host name or socket directory, default localhost
+//               : pg_port int - default 5432
+//               : pg_user string, pg_password string, pg_database string
+//               : pg_sslmode string - disable, require (default), verify-ca or
+//               : verify-full
+//               : pg_sslrootcert, pg_sslcert, pg_sslkey string - paths of the CA,
+//               : client certificate and key files in PEM format
+//               : pg_dsn string - a libpq connection string, used instead of the
+//               : options above when set
+//               : pg_max_open_conns, pg_max_idle_conns, pg_max_conn_lifetime - like
+//               : the sql_ options of the sql processor
+//               : pg_tags_column string - column for saving e.Tags as a comma
+//               : separated list. Not saved if empty (default)
+//               : pg_columns []string - the columns of the table, and the fields saved
+//               : to them, like sql_columns of the sql processor
+//               : primary_mail_host string - primary host name
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by ParseHeader() processor
+//               : e.MailFrom
+//               : e.Subject - generated by by ParseHeader() processor
+//               : e.Tags
+//               : e.Values["zlib-compressor"] - set by the compressor processor
+//               : e.Values["redis"] - set by the redis processor
+//               : e.Values["s3"] - set by the s3 processor
+//               : a streamed email is refused without it
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.QueuedId with the first item fromHashes[0]
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["postgresql"] = func() Decorator {
+		return PostgreSQL()
+	}
+	Svc.AddDependencies("postgresql", "hasher", "headersparser")
+}
+
+type PostgreSQLProcessorConfig struct {
+	Table           string   `json:"pg_table"`
+	Host            string   `json:"pg_host,omitempty"`
+	Port            int      `json:"pg_port,omitempty"`
+	User            string   `json:"pg_user,omitempty"`
+	Password        string   `json:"pg_password,omitempty"`
+	Database        string   `json:"pg_database,omitempty"`
+	SSLMode         string   `json:"pg_sslmode,omitempty"`
+	SSLRootCert     string   `json:"pg_sslrootcert,omitempty"`
+	SSLCert         string   `json:"pg_sslcert,omitempty"`
+	SSLKey          string   `json:"pg_sslkey,omitempty"`
+	DSN             string   `json:"pg_dsn,omitempty"`
+	PrimaryHost     string   `json:"primary_mail_host"`
+	MaxConnLifetime string   `json:"pg_max_conn_lifetime,omitempty"`
+	MaxOpenConns    int      `json:"pg_max_open_conns,omitempty"`
+	MaxIdleConns    int      `json:"pg_max_idle_conns,omitempty"`
+	TagsColumn      string   `json:"pg_tags_column,omitempty"`
+	Columns         []string `json:"pg_columns,omitempty"`
+}
+
+// connString returns pg_dsn, or a connection string made of the other options
+func (c *PostgreSQLProcessorConfig) connString() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+	var params []string
+	add := func(key, value string) {
+		if value != "" {
+			value = strings.Replace(value, `\`, `\\`, -1)
+			value = strings.Replace(value, `'`, `\'`, -1)
+			params = append(params, key+"='"+value+"'")
+		}
+	}
+	add("host", c.Host)
+	if c.Port != 0 {
+		add("port", strconv.Itoa(c.Port))
+	}
+	add("user", c.User)
+	add("password", c.Password)
+	add("dbname", c.Database)
+	add("sslmode", c.SSLMode)
+	add("sslrootcert", c.SSLRootCert)
+	add("sslcert", c.SSLCert)
+	add("sslkey", c.SSLKey)
+	return strings.Join(params, " ")
+}
+
+type PostgreSQLProcessor struct {
+	// prepared statements for each table
+	cache  map[string]*sql.Stmt
+	config *PostgreSQLProcessorConfig
+	// columns are set by pg_columns
+	columns []sqlColumn
+}
+
+func (s *PostgreSQLProcessor) connect() (*sql.DB, error) {
+	db, err := sql.Open("postgres", s.config.connString())
+	if err != nil {
+		Log().Error("cannot open database: ", err)
+		return nil, err
+	}
+	if s.config.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(s.config.MaxOpenConns)
+	}
+	if s.config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(s.config.MaxIdleConns)
+	}
+	if s.config.MaxConnLifetime != "" {
+		t, err := time.ParseDuration(s.config.MaxConnLifetime)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		db.SetConnMaxLifetime(t)
+	}
+	if strings.Contains(s.config.Table, TenantPlaceholder) {
+		// tables for each tenant may not exist yet
+		return db, nil
+	}
+	// do we have permission to access the table?
+	check := "mail_id"
+	if s.columns != nil {
+		// a mapped table may not have the mail_id column
+		check = sqlColumnNames(s.columns, `"`)
+	}
+	rows, err := db.Query("SELECT " + check + " FROM " + s.config.Table + " LIMIT 1")
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+	return db, nil
+}
+
+// insertQuery returns the INSERT statement for the table
+func (s *PostgreSQLProcessor) insertQuery(table string) string {
+	if s.columns != nil {
+		values := make([]string, len(s.columns))
+		for i := range values {
+			values[i] = "$" + strconv.Itoa(i+1)
+		}
+		return "INSERT INTO " + table + " (" + sqlColumnNames(s.columns, `"`) + ") VALUES (" +
+			strings.Join(values, ", ") + ")"
+	}
+	columns := `"date", "to", "from", "subject", "body", "mail", "hash", "content_type", "recipient", ` +
+		`"has_attach", "ip_addr", "return_path", "is_tls", "message_id", "reply_to", "sender", "spam_score"`
+	values := "NOW(), $1, $2, $3, $4, $5, $6, $7, $8, false, $9, $10, $11, $12, $13, $14, $15"
+	if s.config.TagsColumn != "" {
+		columns += `, "` + strings.Replace(s.config.TagsColumn, `"`, `""`, -1) + `"`
+		values += ", $16"
+	}
+	return "INSERT INTO " + table + " (" + columns + ") VALUES (" + values + ")"
+}
+
+// prepare returns the prepared INSERT statement for the tenant's table, see ForTenant
+func (s *PostgreSQLProcessor) prepare(db *sql.DB, tenant string) (*sql.Stmt, error) {
+	table := ForTenant(s.config.Table, tenant)
+	if stmt, ok := s.cache[table]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(s.insertQuery(table))
+	if err != nil {
+		return nil, err
+	}
+	if s.cache == nil {
+		s.cache = make(map[string]*sql.Stmt)
+	}
+	s.cache[table] = stmt
+	return stmt, nil
+}
+
+func PostgreSQL() Decorator {
+	var config *PostgreSQLProcessorConfig
+	var db *sql.DB
+	s := &PostgreSQLProcessor{}
+	// for the helpers that fill in the columns shared with the sql processor
+	fields := &SQLProcessor{}
+
+	// open the database connection (it will also check if we can select the table)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&PostgreSQLProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*PostgreSQLProcessorConfig)
+		s.config = config
+		if s.columns, err = parseSQLColumns("pg_columns", config.Columns); err != nil {
+			return err
+		}
+		if s.columns != nil && config.TagsColumn != "" {
+			return errors.New("pg_columns can't be used with pg_tags_column")
+		}
+		db, err = s.connect()
+		return err
+	}))
+
+	// shutdown will close the database connection
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if db != nil {
+			return db.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if missingStreamedBody(e) {
+					// only the header section is here, and the message was not saved to a bucket
+					Log().Error("postgresql: the streamed email was not saved to s3, refusing to save only its header")
+					return NewResult(response.Canned.FailBackendTransaction), StorageError
+				}
+				var body string
+				hash := ""
+				if len(e.Hashes) > 0 {
+					hash = e.Hashes[0]
+					e.QueuedId = e.Hashes[0]
+				}
+				// the mail column, unless it was saved in Redis
+				var data []byte
+				if c, ok := e.Values["zlib-compressor"]; ok {
+					// a compressor was set by the Compress processor
+					body = "gzip"
+					data = []byte(c.(*DataCompressor).String())
+				} else {
+					data = []byte(e.String())
+				}
+				if _, ok := e.Values["redis"]; ok {
+					body = "redis"
+					data = []byte{}
+				}
+				if s3, ok := e.Values["s3"].(string); ok {
+					// the message is in the bucket, save its URL
+					body = "s3"
+					data = []byte(s3)
+				}
+				stmt, err := s.prepare(db, e.Tenant)
+				if err != nil {
+					Log().WithError(err).Error("could not prepare the insert")
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				}
+
+				for i := range e.RcptTo {
+					// use the To header, otherwise rcpt to
+					to := trimToLimit(fields.fillAddressFromHeader(e, "To"), 255)
+					if to == "" {
+						to = trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255)
+					}
+					mid := trimToLimit(fields.fillAddressFromHeader(e, "Message-Id"), 255)
+					if mid == "" {
+						mid = fmt.Sprintf("%s.%s@%s", hash, e.RcptTo[i].User, config.PrimaryHost)
+					}
+					contentType := trimToLimit(e.Header.Get("Content-Type"), 255)
+					vals := []interface{}{
+						to,
+						trimToLimit(e.MailFrom.String(), 255), // from
+						trimToLimit(e.Subject, 255),
+						body, // how to interpret the mail column, eg. 'redis' or 'gzip'
+						data,
+						hash,
+						contentType,
+						trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255), // recipient
+						ipaddr.Bytes(e.RemoteIP),                                  // ip_addr
+						trimToLimit(e.MailFrom.String(), 255),                     // return_path
+						e.TLS,
+						mid,
+						trimToLimit(fields.fillAddressFromHeader(e, "Reply-To"), 255),
+						trimToLimit(fields.fillAddressFromHeader(e, "Sender"), 255),
+						SpamScore(e),
+					}
+					if config.TagsColumn != "" {
+						vals = append(vals, e.Tags.String())
+					}
+					if s.columns != nil {
+						vals = sqlColumnValues(s.columns, e, vals)
+					}
+					if _, err := stmt.Exec(vals...); err != nil {
+						Log().WithError(err).Error("There was a problem the insert")
+						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					}
+					TrackRcptDelivery(e, e.RcptTo[i], DeliveryStored, "postgresql")
+				}
+
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else if task == TaskValidateRcpt {
+				if len(e.RcptTo) > 0 {
+					// validate only the _last_ recipient that was appended
+					last := e.RcptTo[len(e.RcptTo)-1]
+					if len(last.User) > 255 {
+						return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+					}
+				}
+				return p.Process(e, task)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package backends
+
+import (
+	"database/sql"
+	"flag"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+var (
+	pgTableFlag = flag.String("pg-table", "test", "Table to use for testing the PostgreSQL backend")
+	pgDSNFlag   = flag.String("pg-dsn", "", "Connection string to use for testing the PostgreSQL backend")
+)
+
+func TestPostgreSQLConnString(t *testing.T) {
+	c := &PostgreSQLProcessorConfig{
+		Host:        "db.example.com",
+		Port:        5433,
+		User:        "guerrilla",
+		Password:    `it's a \secret`,
+		Database:    "mail",
+		SSLMode:     "verify-full",
+		SSLRootCert: "/etc/ssl/ca.pem",
+	}
+	expect := `host='db.example.com' port='5433' user='guerrilla' password='it\'s a \\secret' ` +
+		`dbname='mail' sslmode='verify-full' sslrootcert='/etc/ssl/ca.pem'`
+	if s := c.connString(); s != expect {
+		t.Error("unexpected connection string", s)
+	}
+	c.DSN = "postgres://localhost/mail"
+	if s := c.connString(); s != c.DSN {
+		t.Error("expected pg_dsn to be used, got", s)
+	}
+}
+
+func TestPostgreSQLInsertQuery(t *testing.T) {
+	s := &PostgreSQLProcessor{config: &PostgreSQLProcessorConfig{Table: "mail_{tenant}"}}
+	q := s.insertQuery(ForTenant(s.config.Table, "acme"))
+	if !strings.HasPrefix(q, `INSERT INTO mail_acme ("date", "to", "from",`) || !strings.HasSuffix(q, "$14, $15)") {
+		t.Error("unexpected query", q)
+	}
+	s.config.TagsColumn = "tags"
+	if q := s.insertQuery("mail"); !strings.Contains(q, `"sender", "spam_score", "tags")`) || !strings.HasSuffix(q, "$15, $16)") {
+		t.Error("expected the tags column, got", q)
+	}
+	s.config.TagsColumn = ""
+	s.columns, _ = parseSQLColumns("pg_columns", []string{"rcpt=recipient", "received=date"})
+	if q := s.insertQuery("mail"); q != `INSERT INTO mail ("rcpt", "received") VALUES ($1, $2)` {
+		t.Error("expected the mapped columns, got", q)
+	}
+}
+
+func TestPostgreSQL(t *testing.T) {
+	if *pgDSNFlag == "" {
+		t.Skip("requires -pg-dsn to run")
+	}
+	logger, err := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	if err != nil {
+		t.Fatal("get logger:", err)
+	}
+	cfg := BackendConfig{
+		"save_process":      "HeadersParser|Hasher|Compressor|PostgreSQL",
+		"pg_table":          *pgTableFlag,
+		"pg_dsn":            *pgDSNFlag,
+		"primary_mail_host": "example.com",
+	}
+	backend, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+
+	hash := strconv.FormatInt(time.Now().UnixNano(), 10)
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "user", Host: "example.com"}}
+	e.Hashes = []string{hash}
+	e.Data.WriteString("Subject: test\n\nhello\n")
+	if result := backend.Process(e); !strings.Contains(result.String(), hash) {
+		t.Errorf("expected message to be queued with hash, got %q", result)
+	}
+
+	db, err := sql.Open("postgres", *pgDSNFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	var body string
+	var data []byte
+	if err := db.QueryRow("SELECT body, mail FROM "+*pgTableFlag+" WHERE hash = $1", hash).Scan(&body, &data); err != nil {
+		t.Fatal("find row: ", err)
+	}
+	if body != "gzip" {
+		t.Error("expected the compressed mail, got", body)
+	}
+	if data, err := uncompressStored(data); err != nil || !strings.Contains(string(data), "hello") {
+		t.Error("expected the message, got", string(data), err)
+	}
+}
@@ -1,7 +1,9 @@
 package backends
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/artpar/go-guerrilla/mail"
 	"github.com/artpar/go-guerrilla/response"
@@ -14,25 +16,73 @@ import (
 //               : using the hash generated by the "hash" processor and stored in
 //               : e.Hashes
 // ----------------------------------------------------------------------------------
-// Config Options: redis_expire_seconds int - how many seconds to expiry
+// Config Options: redis_expire_seconds int - how many seconds to expiry, 0 keeps the
+//               : keys without a TTL
 //               : redis_interface string - <host>:<port> eg, 127.0.0.1:6379
+//               : redis_key_prefix string - prepended to the key, {tenant} is
+//               : replaced with the envelope's tenant
+//               : redis_username string - the ACL user to AUTH as, with redis 6
+//               : redis_password string - the password to AUTH with
+//               : redis_db int - the database to SELECT
+//               : redis_tls bool - connect with TLS
+//               : redis_ca_file string - PEM file of the CAs to verify redis with
+//               : redis_tls_skip_verify bool - don't verify the certificate
+//               : redis_sentinel_master string - the name of the master to ask
+//               : the sentinels for, instead of redis_interface
+//               : redis_sentinel_addresses []string - <host>:<port> of the sentinels
+//               : redis_sentinel_password string - the password of the sentinels
+//               : redis_cluster_addresses []string - <host>:<port> of some nodes
+//               : of a Redis Cluster, instead of redis_interface
+//               : redis_write_behind_size int - when redis can't be reached, buffer
+//               : the keys of up to this many bytes in memory and accept the emails,
+//               : they're set once redis is back. The buffered keys are lost if the
+//               : daemon crashes. 0 (default) is off
+//               : redis_write_behind_time string - how long redis may stall before
+//               : the emails fail again, default "30s"
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by Header() processor
-//               :
+//               : e.Values["s3"] - set by the s3 processor, the URL is saved instead
+//               : a streamed email is refused without it
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
+//               : e.Tags, if any, are saved under the same key with a :tags suffix
 // ----------------------------------------------------------------------------------
 func init() {
 
 	processors["redis"] = func() Decorator {
 		return Redis()
 	}
+	Svc.AddDependencies("redis", "hasher")
 }
 
 type RedisProcessorConfig struct {
-	RedisExpireSeconds int    `json:"redis_expire_seconds"`
-	RedisInterface     string `json:"redis_interface"`
+	RedisExpireSeconds     int      `json:"redis_expire_seconds,omitempty"`
+	RedisInterface         string   `json:"redis_interface,omitempty"`
+	RedisKeyPrefix         string   `json:"redis_key_prefix,omitempty"`
+	RedisUsername          string   `json:"redis_username,omitempty"`
+	RedisPassword          string   `json:"redis_password,omitempty"`
+	RedisDB                int      `json:"redis_db,omitempty"`
+	RedisTLS               bool     `json:"redis_tls,omitempty"`
+	RedisCAFile            string   `json:"redis_ca_file,omitempty"`
+	RedisTLSSkipVerify     bool     `json:"redis_tls_skip_verify,omitempty"`
+	RedisSentinelMaster    string   `json:"redis_sentinel_master,omitempty"`
+	RedisSentinelAddresses []string `json:"redis_sentinel_addresses,omitempty"`
+	RedisSentinelPassword  string   `json:"redis_sentinel_password,omitempty"`
+	RedisClusterAddresses  []string `json:"redis_cluster_addresses,omitempty"`
+	RedisWriteBehindSize   int      `json:"redis_write_behind_size,omitempty"`
+	RedisWriteBehindTime   string   `json:"redis_write_behind_time,omitempty"`
+}
+
+// check returns an error unless the config says where redis is
+func (c *RedisProcessorConfig) check() error {
+	switch {
+	case c.RedisSentinelMaster != "" && len(c.RedisSentinelAddresses) == 0:
+		return errors.New("redis_sentinel_master needs the redis_sentinel_addresses")
+	case c.RedisInterface == "" && c.RedisSentinelMaster == "" && len(c.RedisClusterAddresses) == 0:
+		return errors.New("redis_interface, redis_sentinel_master or redis_cluster_addresses is required")
+	}
+	return nil
 }
 
 type RedisProcessor struct {
@@ -40,9 +90,9 @@ type RedisProcessor struct {
 	conn        RedisConn
 }
 
-func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
+func (r *RedisProcessor) redisConnection(config *RedisProcessorConfig) (err error) {
 	if r.isConnected == false {
-		r.conn, err = RedisDialer("tcp", redisInterface)
+		r.conn, err = dialRedis(config)
 		if err != nil {
 			// handle error
 			return err
@@ -52,11 +102,28 @@ func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
 	return nil
 }
 
+// set saves the value with the expiry of the config
+func (r *RedisProcessor) set(config *RedisProcessorConfig, key string, value interface{}) error {
+	var err error
+	if config.RedisExpireSeconds > 0 {
+		_, err = r.conn.Do("SETEX", key, config.RedisExpireSeconds, value)
+	} else {
+		_, err = r.conn.Do("SET", key, value)
+	}
+	if err != nil {
+		// connect again for the next email, eg. to the new master after a failover
+		_ = r.conn.Close()
+		r.isConnected = false
+	}
+	return err
+}
+
 // The redis decorator stores the email data in redis
 
 func Redis() Decorator {
 
 	var config *RedisProcessorConfig
+	var wb *writeBehind
 	redisClient := &RedisProcessor{}
 	// read the config into RedisProcessorConfig
 	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
@@ -66,50 +133,85 @@ func Redis() Decorator {
 			return err
 		}
 		config = bcfg.(*RedisProcessorConfig)
-		if redisErr := redisClient.redisConnection(config.RedisInterface); redisErr != nil {
+		if err := config.check(); err != nil {
+			return err
+		}
+		if redisErr := redisClient.redisConnection(config); redisErr != nil {
 			err := fmt.Errorf("redis cannot connect, check your settings: %s", redisErr)
 			return err
 		}
-		return nil
+		if config.RedisWriteBehindSize > 0 {
+			wb, err = useRedisWriteBehind(config)
+		}
+		return err
 	}))
 	// When shutting down
 	Svc.AddShutdowner(ShutdownWith(func() error {
+		if wb != nil {
+			w := wb
+			wb = nil
+			_ = w.release()
+		}
 		if redisClient.isConnected {
 			return redisClient.conn.Close()
 		}
 		return nil
 	}))
 
-	var redisErr error
-
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 
 			if task == TaskSaveMail {
+				if missingStreamedBody(e) {
+					// only the header section is here, and the message was not saved to a bucket
+					Log().Error("redis: the streamed email was not saved to s3, refusing to save only its header")
+					return NewResult(response.Canned.FailBackendTransaction), StorageError
+				}
 				hash := ""
 				if len(e.Hashes) > 0 {
 					e.QueuedId = e.Hashes[0]
 					hash = e.Hashes[0]
-					var stringer fmt.Stringer
-					// a compressor was set
-					if c, ok := e.Values["zlib-compressor"]; ok {
-						stringer = c.(*DataCompressor)
+					var data interface{}
+					if s3, ok := e.Values["s3"].(string); ok {
+						// saved to a bucket by the S3 processor, keep its URL
+						data = s3
+					} else if c, ok := e.Values["zlib-compressor"]; ok {
+						// a compressor was set
+						data = c.(*DataCompressor)
 					} else {
-						stringer = e
+						data = e
 					}
-					redisErr = redisClient.redisConnection(config.RedisInterface)
-					if redisErr != nil {
-						Log().WithError(redisErr).Warn("Error while connecting to redis")
-						result := NewResult(response.Canned.FailBackendTransaction)
-						return result, redisErr
+					key := ForTenant(config.RedisKeyPrefix, e.Tenant) + hash
+					writes := []redisWrite{{key: key, value: data}}
+					if len(e.Tags) > 0 {
+						writes = append(writes, redisWrite{key: key + ":tags", value: e.Tags.String()})
 					}
-					_, doErr := redisClient.conn.Do("SETEX", hash, config.RedisExpireSeconds, stringer)
-					if doErr != nil {
-						Log().WithError(doErr).Warn("Error while SETEX to redis")
+					if wb != nil {
+						// the compressor can only be read once, so the data is read before it may
+						// need to be buffered
+						writes[0].value = fmt.Sprint(data)
+					}
+					// the keys up to done were set
+					done := 0
+					var err error
+					if wb != nil && wb.pending() {
+						err = errWriteBehindPending
+					} else if err = redisClient.redisConnection(config); err != nil {
+						Log().WithError(err).Warn("Error while connecting to redis")
+					} else {
+						for ; done < len(writes); done++ {
+							if err = redisClient.set(config, writes[done].key, writes[done].value); err != nil {
+								Log().WithError(err).Warn("Error while SETEX to redis")
+								break
+							}
+						}
+					}
+					if err != nil && (wb == nil || !wb.add(redisWriteBehindItem(e, writes[done:]))) {
 						result := NewResult(response.Canned.FailBackendTransaction)
-						return result, doErr
+						return result, err
 					}
 					e.Values["redis"] = "redis" // the next processor will know to look in redis for the message data
+					TrackDelivery(e, DeliveryStored, "redis")
 				} else {
 					Log().Error("Redis needs a Hasher() process before it")
 					result := NewResult(response.Canned.FailBackendTransaction)
@@ -125,3 +227,59 @@ func Redis() Decorator {
 		})
 	}
 }
+
+// redisWrite is a key to set, buffered while redis is away
+type redisWrite struct {
+	key   string
+	value interface{}
+}
+
+func redisWriteBehindItem(e *mail.Envelope, writes []redisWrite) writeBehindItem {
+	size := 0
+	for _, w := range writes {
+		size += writeBehindSize(w.key, w.value)
+	}
+	return writeBehindItem{id: e.QueuedId, size: size, value: writes}
+}
+
+// useRedisWriteBehind returns the write-behind buffer for the config, which sets the buffered
+// keys with its own connection
+func useRedisWriteBehind(config *RedisProcessorConfig) (*writeBehind, error) {
+	stall := defaultWriteBehindStall
+	if config.RedisWriteBehindTime != "" {
+		var err error
+		if stall, err = time.ParseDuration(config.RedisWriteBehindTime); err != nil || stall <= 0 {
+			return nil, fmt.Errorf("invalid redis_write_behind_time %q", config.RedisWriteBehindTime)
+		}
+	}
+	return useWriteBehind(fmt.Sprintf("redis %+v", *config), func() (*writeBehind, error) {
+		r := &RedisProcessor{}
+		return &writeBehind{
+			name:     "redis",
+			maxBytes: config.RedisWriteBehindSize,
+			maxStall: stall,
+			batch:    GuerrillaDBAndRedisBatchMax,
+			write: func(items []writeBehindItem) (int, error) {
+				if err := r.redisConnection(config); err != nil {
+					return 0, err
+				}
+				for i, item := range items {
+					for _, w := range item.value.([]redisWrite) {
+						if err := r.set(config, w.key, w.value); err != nil {
+							return i, err
+						}
+					}
+				}
+				return len(items), nil
+			},
+			// a SET is only refused when redis is unwell, and setting a key again is harmless
+			retry: func(error) bool { return true },
+			close: func() error {
+				if r.isConnected {
+					return r.conn.Close()
+				}
+				return nil
+			},
+		}, nil
+	})
+}
@@ -0,0 +1,407 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: s3
+// ----------------------------------------------------------------------------------
+// Description   : Saves the e.Data (email data) and e.DeliveryHeader together to a
+//               : bucket of S3, or of an S3 compatible service such as MinIO, keyed
+//               : by the hash. Mail larger than s3_part_size is sent with a multipart
+//               : upload, a part at a time. The processors after it, eg. sql or redis,
+//               : save the s3:// URL of the object instead of the message
+// ----------------------------------------------------------------------------------
+// Config Options: s3_bucket string - name of the bucket. Required
+//               : s3_endpoint string - defaults to "https://s3.<region>.amazonaws.com",
+//               : eg. "http://localhost:9000" for MinIO
+//               : s3_region string - defaults to "us-east-1"
+//               : s3_access_key, s3_secret_key string - the credentials. Required
+//               : s3_session_token string - for temporary credentials
+//               : s3_key_prefix string - added to the hash, {tenant} is replaced with
+//               : the envelope's tenant, eg. "mail/{tenant}/"
+//               : s3_path_style bool - put the bucket in the path rather than the host
+//               : name, which MinIO needs
+//               : s3_part_size int - size of the parts of a multipart upload, at
+//               : least and by default 5242880 (5 MiB)
+//               : s3_storage_class string - eg. "STANDARD_IA"
+//               : s3_storage_classes []string - tag=class, the storage class of the
+//               : emails with the tag, eg. "spam:yes=ONEZONE_IA". The tag is a key,
+//               : or key:value, the first that matches wins, the others get
+//               : s3_storage_class
+//               : s3_object_tags []string - the keys of the email's tags that are set
+//               : as tags of the object, with the values joined with "/", for the
+//               : lifecycle rules of the bucket, eg. ["spam", "virus"]. "tenant" is
+//               : the envelope's tenant. At most 10
+//               : s3_timeout string - timeout of a request, default "60s"
+//               : s3_pack_size int - pack the small messages into objects of about
+//               : this size, with a json index next to each, as a request per message
+//               : costs more than their storage. 0, the default, doesn't pack
+//               : s3_pack_threshold int - the messages bigger than this are saved
+//               : alone, default 131072
+//               : s3_pack_wait string - how long a message may wait for its pack to
+//               : fill, the client gets its reply once the pack is saved. Default "5s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by Header() processor
+//               : e.Hashes - set by the hasher processor
+//               : e.Values["zlib-compressor"] - set by the compressor processor
+//               : e.Tags - for s3_storage_classes and s3_object_tags
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.QueuedId with the first item fromHashes[0]
+//               : e.Values["s3"] - the s3://<bucket>/<key> URL of the object, and
+//               : #bytes=<start>-<end> of the message when it's in a pack
+// ----------------------------------------------------------------------------------
+// Stream        : in stream_save_process, it uploads the message while it's received,
+//               : holding at most s3_part_size of it in memory. The key is the prefix
+//               : and e.QueuedId, as the hash is not known yet. The upload is aborted
+//               : when the message is incomplete. Sets e.Values["s3"] when done.
+//               : The storage class and the object tags are chosen with the tags that
+//               : the envelope has when the message starts
+//               : The streamed messages aren't packed
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["s3"] = func() Decorator {
+		return S3()
+	}
+	streamProcessors["s3"] = func() StreamDecorator {
+		return StreamS3()
+	}
+	streamStores["s3"] = ""
+	Svc.AddWholeMessage("s3")
+}
+
+type S3ProcessorConfig struct {
+	Bucket         string   `json:"s3_bucket"`
+	Endpoint       string   `json:"s3_endpoint,omitempty"`
+	Region         string   `json:"s3_region,omitempty"`
+	AccessKey      string   `json:"s3_access_key"`
+	SecretKey      string   `json:"s3_secret_key"`
+	SessionToken   string   `json:"s3_session_token,omitempty"`
+	KeyPrefix      string   `json:"s3_key_prefix,omitempty"`
+	PathStyle      bool     `json:"s3_path_style,omitempty"`
+	PartSize       int      `json:"s3_part_size,omitempty"`
+	StorageClass   string   `json:"s3_storage_class,omitempty"`
+	StorageClasses []string `json:"s3_storage_classes,omitempty"`
+	ObjectTags     []string `json:"s3_object_tags,omitempty"`
+	Timeout        string   `json:"s3_timeout,omitempty"`
+	PackSize       int      `json:"s3_pack_size,omitempty"`
+	PackThreshold  int      `json:"s3_pack_threshold,omitempty"`
+	PackWait       string   `json:"s3_pack_wait,omitempty"`
+
+	// classes are the parsed StorageClasses
+	classes []s3ClassRule
+}
+
+// s3ClassRule is an entry of s3_storage_classes
+type s3ClassRule struct {
+	tag   mail.Tag
+	class string
+}
+
+// matches returns true when the tags have the key of the rule, and its value if it has one
+func (r s3ClassRule) matches(tags mail.Tags) bool {
+	for _, tag := range tags {
+		if tag.Key == r.tag.Key && (r.tag.Value == "" || tag.Value == r.tag.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultS3Region  = "us-east-1"
+	defaultS3Timeout = time.Second * 60
+	// s3MaxObjectTags is how many tags S3 allows on an object
+	s3MaxObjectTags        = 10
+	defaultS3PackThreshold = 128 << 10
+	defaultS3PackWait      = time.Second * 5
+)
+
+// client returns a client for the bucket of the config
+func (c *S3ProcessorConfig) client() (*s3Client, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("s3_bucket is required by the s3 processor")
+	}
+	region := c.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3_endpoint %q", c.Endpoint)
+	}
+	timeout := defaultS3Timeout
+	if c.Timeout != "" {
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid s3_timeout %q", c.Timeout)
+		}
+	}
+	return &s3Client{
+		endpoint:     u,
+		region:       region,
+		bucket:       c.Bucket,
+		accessKey:    c.AccessKey,
+		secretKey:    c.SecretKey,
+		sessionToken: c.SessionToken,
+		pathStyle:    c.PathStyle,
+		client:       &http.Client{Timeout: timeout},
+		now:          time.Now,
+	}, nil
+}
+
+// parseClasses reads the s3_storage_classes and checks the s3_object_tags
+func (c *S3ProcessorConfig) parseClasses() error {
+	c.classes = nil
+	for _, entry := range c.StorageClasses {
+		i := strings.LastIndexByte(entry, '=')
+		if i <= 0 || strings.TrimSpace(entry[i+1:]) == "" {
+			return fmt.Errorf("s3_storage_classes entry %q should be tag=class", entry)
+		}
+		c.classes = append(c.classes, s3ClassRule{
+			tag:   mail.ParseTag(entry[:i]),
+			class: strings.TrimSpace(entry[i+1:]),
+		})
+	}
+	if len(c.ObjectTags) > s3MaxObjectTags {
+		return fmt.Errorf("s3_object_tags can have at most %d keys", s3MaxObjectTags)
+	}
+	return nil
+}
+
+// objectHeader returns the headers of the object of the envelope: its storage class, and its tags
+func (c *S3ProcessorConfig) objectHeader(e *mail.Envelope) http.Header {
+	header := http.Header{"Content-Type": {"message/rfc822"}}
+	class := c.StorageClass
+	for _, rule := range c.classes {
+		if rule.matches(e.Tags) {
+			class = rule.class
+			break
+		}
+	}
+	if class != "" {
+		header.Set("X-Amz-Storage-Class", class)
+	}
+	tagging := url.Values{}
+	for _, key := range c.ObjectTags {
+		if key == "tenant" && e.Tenant != "" {
+			tagging.Set(key, e.Tenant)
+		} else if values := e.Tags.Values(key); len(values) > 0 {
+			tagging.Set(key, strings.Join(values, "/"))
+		}
+	}
+	if len(tagging) > 0 {
+		header.Set("X-Amz-Tagging", tagging.Encode())
+	}
+	return header
+}
+
+// s3URL is the reference to an object, that's saved by the processors after the s3 processor
+func s3URL(bucket, key string) string {
+	return "s3://" + bucket + "/" + key
+}
+
+// parseS3URL returns the bucket and key of an s3:// URL
+func parseS3URL(s string) (bucket, key string, ok bool) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// newS3Config reads the config of the s3 processor and returns a client for its bucket
+func newS3Config(backendConfig BackendConfig) (*S3ProcessorConfig, *s3Client, error) {
+	configType := BaseConfig(&S3ProcessorConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := bcfg.(*S3ProcessorConfig)
+	if config.PartSize == 0 {
+		config.PartSize = s3MinPartSize
+	} else if config.PartSize < s3MinPartSize {
+		return nil, nil, fmt.Errorf("s3_part_size must be at least %d", s3MinPartSize)
+	}
+	if err := config.parseClasses(); err != nil {
+		return nil, nil, err
+	}
+	client, err := config.client()
+	return config, client, err
+}
+
+func S3() Decorator {
+	var config *S3ProcessorConfig
+	var client *s3Client
+	var packer *s3Packer
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) (err error) {
+		if config, client, err = newS3Config(backendConfig); err != nil {
+			return err
+		}
+		packer = nil
+		if config.PackSize < 0 {
+			return fmt.Errorf("invalid s3_pack_size %d", config.PackSize)
+		} else if config.PackSize > 0 {
+			wait := defaultS3PackWait
+			if config.PackWait != "" {
+				if wait, err = time.ParseDuration(config.PackWait); err != nil || wait <= 0 {
+					return fmt.Errorf("invalid s3_pack_wait %q", config.PackWait)
+				}
+			}
+			if config.PackThreshold <= 0 {
+				config.PackThreshold = defaultS3PackThreshold
+			}
+			packer = newS3Packer(client, config.PackSize, config.PartSize, wait)
+		}
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if packer != nil {
+			packer.flushAll()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if len(e.Hashes) == 0 {
+					Log().Error("S3 needs a Hasher() process before it")
+					return NewResult(response.Canned.FailBackendTransaction), StorageError
+				}
+				e.QueuedId = e.Hashes[0]
+				key := ForTenant(config.KeyPrefix, e.Tenant) + e.Hashes[0]
+				var r io.Reader
+				header := config.objectHeader(e)
+				if c, ok := e.Values["zlib-compressor"]; ok {
+					// a compressor was set by the Compress processor
+					r = strings.NewReader(c.(*DataCompressor).String())
+					header.Set("Content-Encoding", "deflate")
+				} else {
+					r = e.NewReader()
+				}
+				s3url := s3URL(config.Bucket, key)
+				var err error
+				if packer != nil && e.Len() <= config.PackThreshold {
+					var data []byte
+					if data, err = ioutil.ReadAll(r); err == nil {
+						s3url, err = packer.add(ForTenant(config.KeyPrefix, e.Tenant), header, e.Hashes[0],
+							data, header.Get("Content-Encoding"))
+					}
+				} else {
+					err = client.putObject(key, r, config.PartSize, header)
+				}
+				if err != nil {
+					Log().WithError(err).Error("could not save the email to s3")
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				}
+				// the next processors save the URL instead of the message
+				e.Values["s3"] = s3url
+				TrackDelivery(e, DeliveryStored, "s3")
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// streamS3 uploads the message that's written to it through a pipe
+type streamS3 struct {
+	e      *mail.Envelope
+	config *S3ProcessorConfig
+	client *s3Client
+	key    string
+	next   StreamProcessor
+	pw     *io.PipeWriter
+	// done gets the result of the upload
+	done chan error
+}
+
+// start starts the upload. It's started by the first write, once the stream processors
+// before it set e.Values["stream-encoding"]
+func (s *streamS3) start() {
+	header := s.config.objectHeader(s.e)
+	if encoding, ok := s.e.Values["stream-encoding"].(string); ok {
+		header.Set("Content-Encoding", encoding)
+	}
+	pr, pw := io.Pipe()
+	s.pw, s.done = pw, make(chan error, 1)
+	go func() {
+		err := s.client.putObject(s.key, pr, s.config.PartSize, header)
+		// so that the writes fail if the upload stopped early
+		if err != nil {
+			_ = pr.CloseWithError(err)
+		} else {
+			_ = pr.Close()
+		}
+		s.done <- err
+	}()
+}
+
+func (s *streamS3) Write(p []byte) (int, error) {
+	if s.pw == nil {
+		s.start()
+	}
+	if n, err := s.pw.Write(p); err != nil {
+		return n, err
+	}
+	return s.next.Write(p)
+}
+
+func (s *streamS3) Close(err error) error {
+	if s.pw == nil && err == nil {
+		// an empty message
+		s.start()
+	}
+	if s.pw != nil {
+		// the upload is aborted if err is not nil
+		_ = s.pw.CloseWithError(err)
+		if uploadErr := <-s.done; uploadErr != nil && err == nil {
+			Log().WithError(uploadErr).Error("could not stream the email to s3")
+			_ = s.next.Close(uploadErr)
+			return uploadErr
+		}
+	}
+	if err == nil {
+		// the save_process processors save the URL instead of the message
+		s.e.Values["s3"] = s3URL(s.config.Bucket, s.key)
+		TrackDelivery(s.e, DeliveryStored, "s3")
+	}
+	return s.next.Close(err)
+}
+
+func StreamS3() StreamDecorator {
+	var config *S3ProcessorConfig
+	var client *s3Client
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) (err error) {
+		config, client, err = newS3Config(backendConfig)
+		return err
+	}))
+
+	return func(e *mail.Envelope, next StreamProcessor) (StreamProcessor, error) {
+		return &streamS3{
+			e:      e,
+			config: config,
+			client: client,
+			key:    ForTenant(config.KeyPrefix, e.Tenant) + e.QueuedId,
+			next:   next,
+		}, nil
+	}
+}
@@ -0,0 +1,191 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sample
+// ----------------------------------------------------------------------------------
+// Description   : Copies a percentage of the accepted envelopes to an inspection file
+//               : or redis stream, to look at the traffic without archiving all of it.
+//               : Place it first in the chain, the envelope is sampled once the rest
+//               : of the chain accepted it
+// ----------------------------------------------------------------------------------
+// Config Options: sample_rate float - the percentage of envelopes to sample, eg 0.5
+//               : sample_full bool - include the message, otherwise only the envelope
+//               : and headers are copied
+//               : sample_file string - a file the samples are appended to as json lines,
+//               : {tenant} and {date} (2006-01-02) are replaced
+//               : sample_redis_interface string - <host>:<port> of redis, eg. 127.0.0.1:6379
+//               : sample_redis_stream string - the redis stream the samples are added to,
+//               : {tenant} is replaced
+//               : sample_redis_maxlen int - the approximate length the stream is trimmed
+//               : to, default 10000
+//               : sample_seed int - seed for the random source, 0 seeds from the clock
+// --------------:-------------------------------------------------------------------
+// Input         : envelope, e.Hashes if a Hasher is in the chain
+// ----------------------------------------------------------------------------------
+// Output        : none, the envelope is passed through untouched
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["sample"] = func() Decorator {
+		return Sample()
+	}
+}
+
+type SampleProcessorConfig struct {
+	Rate           float64 `json:"sample_rate"`
+	Full           bool    `json:"sample_full,omitempty"`
+	File           string  `json:"sample_file,omitempty"`
+	RedisInterface string  `json:"sample_redis_interface,omitempty"`
+	RedisStream    string  `json:"sample_redis_stream,omitempty"`
+	RedisMaxLen    int     `json:"sample_redis_maxlen,omitempty"`
+	Seed           int     `json:"sample_seed,omitempty"`
+}
+
+const defaultSampleRedisMaxLen = 10000
+
+// sampleDatePlaceholder is replaced with the day the envelope was sampled in sample_file
+const sampleDatePlaceholder = "{date}"
+
+// sampler decides which envelopes to sample and writes them, it's shared between the workers
+type sampler struct {
+	config *SampleProcessorConfig
+	rnd    *rand.Rand
+	conn   RedisConn
+	sync.Mutex
+}
+
+// roll returns true for sample_rate percent of the calls
+func (s *sampler) roll() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.rnd.Float64()*100 < s.config.Rate
+}
+
+// sample writes the envelope to the file and the stream
+func (s *sampler) sample(e *mail.Envelope) error {
+	event, err := json.Marshal(newMailEvent(e, s.config.Full))
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	var errs []string
+	if s.config.File != "" {
+		if err := s.appendFile(e, event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if s.config.RedisStream != "" {
+		if err := s.addToStream(e, event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *sampler) appendFile(e *mail.Envelope, event []byte) error {
+	name := strings.Replace(ForTenant(s.config.File, e.Tenant), sampleDatePlaceholder, time.Now().Format("2006-01-02"), -1)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(event, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *sampler) addToStream(e *mail.Envelope, event []byte) (err error) {
+	if s.conn == nil {
+		if s.conn, err = RedisDialer("tcp", s.config.RedisInterface); err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	_, err = s.conn.Do("XADD", ForTenant(s.config.RedisStream, e.Tenant),
+		"MAXLEN", "~", s.config.RedisMaxLen, "*", "event", event)
+	if err != nil {
+		// connect again for the next sample
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *sampler) close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func Sample() Decorator {
+	s := &sampler{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SampleProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*SampleProcessorConfig)
+		if config.Rate <= 0 || config.Rate > 100 {
+			return errors.New("sample_rate must be a percentage above 0, up to 100")
+		}
+		if config.File == "" && config.RedisStream == "" {
+			return errors.New("the sample processor needs a sample_file or a sample_redis_stream")
+		}
+		if config.RedisStream != "" && config.RedisInterface == "" {
+			return errors.New("sample_redis_stream needs a sample_redis_interface")
+		}
+		if config.RedisMaxLen <= 0 {
+			config.RedisMaxLen = defaultSampleRedisMaxLen
+		}
+		seed := int64(config.Seed)
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		s.config = config
+		s.rnd = rand.New(rand.NewSource(seed))
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		return s.close()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			result, err := p.Process(e, task)
+			if task != TaskSaveMail || err != nil || result == nil || result.Code()/100 != 2 || !s.roll() {
+				return result, err
+			}
+			if sampleErr := s.sample(e); sampleErr != nil {
+				// the inspection copy is best effort, the email was accepted anyway
+				Log().WithError(sampleErr).Warn("could not sample the email")
+			}
+			return result, err
+		})
+	}
+}
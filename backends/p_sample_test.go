@@ -0,0 +1,135 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// fakeRedisStream records the XADD commands
+type fakeRedisStream struct {
+	added map[string][][]byte
+}
+
+func (f *fakeRedisStream) Close() error {
+	return nil
+}
+
+func (f *fakeRedisStream) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName == "XADD" {
+		key := args[0].(string)
+		f.added[key] = append(f.added[key], args[len(args)-1].([]byte))
+	}
+	return "1-0", nil
+}
+
+func TestSampleProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	stream := &fakeRedisStream{added: make(map[string][][]byte)}
+	saved := RedisDialer
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		return stream, nil
+	}
+	defer func() {
+		RedisDialer = saved
+	}()
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":           "Sample|HeadersParser|Hasher|Debugger",
+		"sample_rate":            100.0,
+		"sample_file":            filepath.Join(dir, "{tenant}", "{date}.jsonl"),
+		"sample_redis_interface": "127.0.0.1:6379",
+		"sample_redis_stream":    "samples:{tenant}",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	for i := 0; i < 2; i++ {
+		if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+			t.Fatal("expected the mail to be accepted, got", result)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "acme", time.Now().Format("2006-01-02")+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("expected 2 samples in the file, got", len(lines))
+	}
+	var event mailEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Subject != "hello" || event.Hash == "" || event.Data != "" || len(event.Headers["Message-Id"]) != 1 {
+		t.Errorf("expected the headers without the message, got %+v", event)
+	}
+	if len(stream.added["samples:acme"]) != 2 {
+		t.Error("expected 2 samples in the stream, got", len(stream.added["samples:acme"]))
+	}
+}
+
+func TestSampleProcessorRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "samples.jsonl")
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process": "HeadersParser|Sample|Debugger",
+		"sample_rate":  20.0,
+		"sample_full":  true,
+		"sample_file":  file,
+		"sample_seed":  1,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	for i := 0; i < 200; i++ {
+		backend.Process(newBrokerTestEnvelope())
+	}
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 20 || len(lines) > 60 {
+		t.Error("expected about 40 of 200 envelopes to be sampled, got", len(lines))
+	}
+	var event mailEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil || !strings.Contains(event.Data, "hi\n") {
+		t.Error("expected the full message, got", event.Data, err)
+	}
+}
+
+func TestSampleProcessorConfig(t *testing.T) {
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	for _, config := range []BackendConfig{
+		{"sample_file": "samples.jsonl"},
+		{"sample_rate": 150.0, "sample_file": "samples.jsonl"},
+		{"sample_rate": 1.0},
+		{"sample_rate": 1.0, "sample_redis_stream": "samples"},
+	} {
+		config["save_process"] = "Sample|Debugger"
+		backend, err := New(config, logger)
+		if err == nil {
+			err = backend.Start()
+			_ = backend.Shutdown()
+		}
+		if err == nil {
+			t.Errorf("expected %v to be refused", config)
+		}
+	}
+}
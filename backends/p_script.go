@@ -0,0 +1,271 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: script
+// ----------------------------------------------------------------------------------
+// Description   : Runs a policy written in Lua, for quick rules that don't need a new
+//               : processor, eg.
+//               :   if mail.subject:find("viagra") and not in_list("trusted", mail.from) then
+//               :     reject("no thanks")
+//               :   end
+//               : The script can read the mail table: from, to (a table), rcpt (the
+//               : recipient being validated), subject, tenant, remote_ip, helo, tls,
+//               : size, task ("save" or "rcpt") and verify (true for the probes of
+//               : VRFY, which shouldn't change any state), and call these functions:
+//               :   header(name) - first value of a header, or nil
+//               :   data() - the raw message
+//               :   in_list(name, address) - true if the address, or its domain, is in
+//               :     the list from script_lists
+//               :   tag(key, value), verdict(method, result, reason)
+//               :   reject(text), tempfail(text) - stop the script and reject the email
+//               :     with a 5xx or 4xx code
+//               : Only the base, string, table and math libraries are available.
+// ----------------------------------------------------------------------------------
+// Config Options: script string - the Lua code of the policy
+//               : script_file string - path of a file to read the policy from, instead
+//               : script_lists []string - lists for in_list, as "name=value,value,..."
+//               : script_timeout string - how long the script may run, default "50ms"
+//               : script_validate_rcpt bool - also run the script for each recipient
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header and e.Subject, parsed by HeadersParser
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags, verdicts
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["script"] = func() Decorator {
+		return Script()
+	}
+}
+
+type ScriptConfig struct {
+	Script       string   `json:"script,omitempty"`
+	File         string   `json:"script_file,omitempty"`
+	Lists        []string `json:"script_lists,omitempty"`
+	Timeout      string   `json:"script_timeout,omitempty"`
+	ValidateRcpt bool     `json:"script_validate_rcpt,omitempty"`
+	timeout      time.Duration
+}
+
+// scriptPolicy is the compiled script and its lists, shared by all workers
+type scriptPolicy struct {
+	config *ScriptConfig
+	proto  *lua.FunctionProto
+	lists  map[string]map[string]bool
+}
+
+var errScriptRejected = errors.New("script: rejected by the policy")
+
+// inList checks if the address or its domain is in the list
+func (s *scriptPolicy) inList(name, address string) bool {
+	list := s.lists[name]
+	address = strings.ToLower(strings.TrimSpace(address))
+	if list[address] {
+		return true
+	}
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return list[address[i+1:]]
+	}
+	return false
+}
+
+// load compiles the script and parses the lists
+func (s *scriptPolicy) load(config *ScriptConfig) error {
+	code := config.Script
+	name := "script"
+	if config.File != "" {
+		b, err := ioutil.ReadFile(config.File)
+		if err != nil {
+			return err
+		}
+		code, name = string(b), config.File
+	}
+	if strings.TrimSpace(code) == "" {
+		return errors.New("script: no script, set script or script_file")
+	}
+	chunk, err := parse.Parse(strings.NewReader(code), name)
+	if err != nil {
+		return err
+	}
+	if s.proto, err = lua.Compile(chunk, name); err != nil {
+		return err
+	}
+	s.lists = make(map[string]map[string]bool, len(config.Lists))
+	for _, l := range config.Lists {
+		i := strings.Index(l, "=")
+		if i < 1 {
+			return fmt.Errorf("script: invalid script_lists entry [%s], expecting name=value,value", l)
+		}
+		list := make(map[string]bool)
+		for _, v := range strings.Split(l[i+1:], ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				list[v] = true
+			}
+		}
+		s.lists[strings.TrimSpace(l[:i])] = list
+	}
+	s.config = config
+	return nil
+}
+
+// scriptRun is the state of a worker's Lua interpreter
+type scriptRun struct {
+	policy *scriptPolicy
+	L      *lua.LState
+	e      *mail.Envelope
+	// result is set when the script rejects the email
+	result Result
+}
+
+func newScriptRun(policy *scriptPolicy) *scriptRun {
+	r := &scriptRun{policy: policy, L: lua.NewState(lua.Options{SkipOpenLibs: true})}
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		r.L.Push(r.L.NewFunction(lib.open))
+		r.L.Push(lua.LString(lib.name))
+		r.L.Call(1, 0)
+	}
+	// no access to the file system
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		r.L.SetGlobal(name, lua.LNil)
+	}
+	r.L.SetGlobal("header", r.L.NewFunction(func(L *lua.LState) int {
+		if name := L.CheckString(1); r.e.HeaderIndex.Has(name) {
+			L.Push(lua.LString(r.e.Header.Get(name)))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+	r.L.SetGlobal("data", r.L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(r.e.Data.String()))
+		return 1
+	}))
+	r.L.SetGlobal("in_list", r.L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(r.policy.inList(L.CheckString(1), L.CheckString(2))))
+		return 1
+	}))
+	r.L.SetGlobal("tag", r.L.NewFunction(func(L *lua.LState) int {
+		r.e.Tags.Add(L.CheckString(1), L.OptString(2, ""))
+		return 0
+	}))
+	r.L.SetGlobal("verdict", r.L.NewFunction(func(L *lua.LState) int {
+		AddVerdict(r.e, Verdict{Method: L.CheckString(1), Result: L.CheckString(2), Reason: L.OptString(3, "")})
+		return 0
+	}))
+	reject := func(code int, status string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			text := L.OptString(1, "Error: rejected by policy")
+			r.result = NewResult(fmt.Sprintf("%d %s %s", code, status, text))
+			L.RaiseError("%s", errScriptRejected)
+			return 0
+		}
+	}
+	r.L.SetGlobal("reject", r.L.NewFunction(reject(554, "5.7.1")))
+	r.L.SetGlobal("tempfail", r.L.NewFunction(reject(451, "4.7.1")))
+	return r
+}
+
+// run runs the script for the envelope, the result is nil if the script did not reject it
+func (r *scriptRun) run(e *mail.Envelope, task SelectTask) (Result, error) {
+	r.e, r.result = e, nil
+	defer func() {
+		r.e = nil
+	}()
+	m := r.L.NewTable()
+	m.RawSetString("from", lua.LString(e.MailFrom.String()))
+	to := r.L.NewTable()
+	for i := range e.RcptTo {
+		to.Append(lua.LString(e.RcptTo[i].String()))
+	}
+	m.RawSetString("to", to)
+	if len(e.RcptTo) > 0 {
+		m.RawSetString("rcpt", lua.LString(e.RcptTo[len(e.RcptTo)-1].String()))
+	}
+	m.RawSetString("subject", lua.LString(e.Subject))
+	m.RawSetString("tenant", lua.LString(e.Tenant))
+	m.RawSetString("remote_ip", lua.LString(e.RemoteIP))
+	m.RawSetString("helo", lua.LString(e.Helo))
+	m.RawSetString("tls", lua.LBool(e.TLS))
+	m.RawSetString("size", lua.LNumber(e.Data.Len()))
+	if task == TaskValidateRcpt {
+		m.RawSetString("task", lua.LString("rcpt"))
+		m.RawSetString("verify", lua.LBool(IsVerifyOnly(e)))
+	} else {
+		m.RawSetString("task", lua.LString("save"))
+	}
+	r.L.SetGlobal("mail", m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.policy.config.timeout)
+	defer cancel()
+	r.L.SetContext(ctx)
+	defer r.L.RemoveContext()
+	r.L.Push(r.L.NewFunctionFromProto(r.policy.proto))
+	err := r.L.PCall(0, lua.MultRet, nil)
+	// discard anything the script returned
+	r.L.SetTop(0)
+	if r.result != nil {
+		return r.result, errScriptRejected
+	}
+	if err != nil {
+		return NewResult("451 4.3.0 Error: ", err), err
+	}
+	return nil, nil
+}
+
+// Script runs a Lua policy
+func Script() Decorator {
+	policy := &scriptPolicy{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ScriptConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*ScriptConfig)
+		if config.Timeout == "" {
+			config.Timeout = "50ms"
+		}
+		if config.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return err
+		}
+		return policy.load(config)
+	}))
+	return func(p Processor) Processor {
+		// each worker has its own interpreter, created when first needed
+		var run *scriptRun
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail || (task == TaskValidateRcpt && policy.config.ValidateRcpt) {
+				if run == nil {
+					run = newScriptRun(policy)
+				}
+				if result, err := run.run(e, task); result != nil {
+					if err != errScriptRejected {
+						Log().WithError(err).Error("script failed")
+					}
+					return result, err
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
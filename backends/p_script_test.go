@@ -0,0 +1,93 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestScript(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	policy := `
+if mail.task == "rcpt" then
+	if mail.rcpt == "nobody@example.com" then reject("no such user") end
+	return
+end
+local subject = header("subject") or ""
+if subject:find("viagra") and not in_list("trusted", mail.from) then
+	reject("no thanks")
+end
+if mail.tenant == "busy" then tempfail() end
+if mail.tenant == "slow" then while true do end end
+if mail.tenant == "broken" then error("oops") end
+if mail.tenant == "sandbox" then dofile("/etc/passwd") end
+tag("policy", "checked")
+verdict("spam", "no")
+`
+	config := BackendConfig{
+		"script":               policy,
+		"script_lists":         []interface{}{"trusted=pharmacy.example.com, boss@example.com"},
+		"script_timeout":       "50ms",
+		"script_validate_rcpt": true,
+	}
+	h, err := NewProcessorHarness(config, Script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		from    string
+		subject string
+		tenant  string
+		code    int
+	}{
+		{"passed", "sender@example.com", "hello", "", 200},
+		{"rejected", "sender@example.com", "cheap viagra", "", 554},
+		{"trusted domain", "sales@pharmacy.example.com", "cheap viagra", "", 200},
+		{"trusted address", "Boss@example.com", "cheap viagra", "", 200},
+		{"tempfail", "sender@example.com", "hello", "busy", 451},
+		{"timed out", "sender@example.com", "hello", "slow", 451},
+		{"error", "sender@example.com", "hello", "broken", 451},
+		{"no file access", "sender@example.com", "hello", "sandbox", 451},
+	}
+	for _, tt := range tests {
+		e, err := h.Envelope(tt.from, "Subject: "+tt.subject+"\n\nhello\n", "rcpt@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Tenant = tt.tenant
+		result, err := h.Save(e)
+		if result.Code() != tt.code {
+			t.Error(tt.name, "expected", tt.code, "but got", result, err)
+		}
+		if tagged := e.Tags.Has("policy"); tagged != (tt.code == 200) {
+			t.Error(tt.name, "unexpected tags", e.Tags)
+		}
+		if tt.code == 200 && len(GetVerdicts(e)) != 1 {
+			t.Error(tt.name, "expected a verdict, got", GetVerdicts(e))
+		}
+	}
+
+	e, _ := h.Envelope("sender@example.com", "", "nobody@example.com")
+	if result, _ := h.ValidateRcpt(e); result.Code() != 554 || result.String() != "554 5.7.1 no such user" {
+		t.Error("expected the recipient to be rejected, got", result)
+	}
+	e, _ = h.Envelope("sender@example.com", "", "rcpt@example.com")
+	if result, _ := h.ValidateRcpt(e); result.Code() != 200 {
+		t.Error("expected the recipient to be accepted, got", result)
+	}
+	_ = h.Shutdown()
+
+	for _, c := range []BackendConfig{
+		{},
+		{"script": "if then"},
+		{"script": "tag('a')", "script_lists": []interface{}{"no list"}},
+		{"script_file": "/does/not/exist.lua"},
+	} {
+		if _, err := NewProcessorHarness(c, Script); err == nil {
+			t.Error("expected the config to be refused", c)
+		}
+	}
+	_ = Svc.shutdown()
+}
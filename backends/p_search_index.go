@@ -0,0 +1,77 @@
+package backends
+
+import (
+	"errors"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: searchindex
+// ----------------------------------------------------------------------------------
+// Description   : Adds the email to a local full-text index, so that stored mail can
+//               : be searched by sender, recipient, subject and body without running
+//               : a search server. See SearchIndex and the /search admin API
+// ----------------------------------------------------------------------------------
+// Config Options: search_index_path string - directory of the index, created if it
+//               : does not exist. Required
+//               : search_index_max_body int - how many bytes of the body to index,
+//               : defaults to 65536
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId - place it after the processor that saves the email, eg.
+//               : "HeadersParser|Hasher|Sql|SearchIndex", so that the id is the hash
+//               : e.Subject - set by the headersparser processor
+// ----------------------------------------------------------------------------------
+// Output        : none, a failure to index is logged and does not fail the transaction
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["searchindex"] = func() Decorator {
+		return SearchIndexer()
+	}
+}
+
+type SearchIndexConfig struct {
+	Path    string `json:"search_index_path"`
+	MaxBody int    `json:"search_index_max_body,omitempty"`
+}
+
+const defaultSearchIndexMaxBody = 65536
+
+func SearchIndexer() Decorator {
+	var config *SearchIndexConfig
+	var index *MailIndex
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SearchIndexConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SearchIndexConfig)
+		if config.Path == "" {
+			return errors.New("search_index_path is required by the searchindex processor")
+		}
+		if config.MaxBody <= 0 {
+			config.MaxBody = defaultSearchIndexMaxBody
+		}
+		index, err = useSearchIndex(config.Path)
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if index == nil {
+			return nil
+		}
+		index = nil
+		return releaseSearchIndex()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := index.Add(e, config.MaxBody); err != nil {
+					Log().WithError(err).Warn("could not add the email to the search index")
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestSearchIndex(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "searchindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	config := BackendConfig{"search_index_path": filepath.Join(dir, "index")}
+	h, err := NewProcessorHarness(config, SearchIndexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []struct {
+		id, tenant, from, subject, body string
+	}{
+		{"m1", "acme", "alice@example.com", "Invoice 42", "please pay the invoice"},
+		{"m2", "acme", "bob@example.org", "Lunch", "pizza on friday"},
+		{"m3", "globex", "alice@example.com", "Invoice 43", "the payment is late"},
+	}
+	for _, m := range messages {
+		e, err := h.Envelope(m.from, "Subject: "+m.subject+"\n\n"+m.body+"\n", "rcpt@"+m.tenant+".com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.QueuedId = m.id
+		e.Tenant = m.tenant
+		if result, _ := h.Save(e); result.Code() != 200 {
+			t.Fatal("unexpected result", result)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		query  MailQuery
+		expect []string
+	}{
+		{"sender", MailQuery{From: "alice@example.com"}, []string{"m3", "m1"}},
+		{"sender domain", MailQuery{From: "example.org"}, []string{"m2"}},
+		{"recipient", MailQuery{To: "rcpt@globex.com"}, []string{"m3"}},
+		{"subject", MailQuery{Subject: "invoice"}, []string{"m3", "m1"}},
+		{"body needs all the words", MailQuery{Body: "pay invoice"}, []string{"m1"}},
+		{"tenant", MailQuery{Subject: "invoice", Tenant: "acme"}, []string{"m1"}},
+		{"query string", MailQuery{Text: "pizza"}, []string{"m2"}},
+		{"limit", MailQuery{From: "alice@example.com", Limit: 1}, []string{"m3"}},
+	}
+	for _, tt := range tests {
+		hits, err := SearchIndex.Search(tt.query)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		var ids []string
+		for _, hit := range hits {
+			ids = append(ids, hit.QueuedId)
+		}
+		if len(ids) != len(tt.expect) {
+			t.Error(tt.name, "expected", tt.expect, "got", ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.expect[i] {
+				t.Error(tt.name, "expected", tt.expect, "got", ids)
+				break
+			}
+		}
+	}
+	hits, _ := SearchIndex.Search(MailQuery{Subject: "lunch"})
+	if len(hits) != 1 || hits[0].From != "bob@example.org" || hits[0].Subject != "Lunch" ||
+		len(hits[0].To) != 1 || hits[0].To[0] != "rcpt@acme.com" || hits[0].Date.IsZero() {
+		t.Error("unexpected hit", hits)
+	}
+	if _, err := SearchIndex.Search(MailQuery{}); err == nil {
+		t.Error("expected an error for an empty query")
+	}
+
+	if err := h.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	if SearchIndex != nil {
+		t.Error("expected the index to be closed")
+	}
+	// the index is kept on disk
+	ix, err := OpenMailIndex(filepath.Join(dir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ix.Close()
+	}()
+	if hits, _ := ix.Search(MailQuery{Body: "pizza"}); len(hits) != 1 {
+		t.Error("expected the index to be reopened", hits)
+	}
+}
@@ -0,0 +1,169 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: spamcheck
+// ----------------------------------------------------------------------------------
+// Description   : Sends the email to rspamd's HTTP API, or SpamAssassin's spamd, and
+//               : records the score as a spam verdict, which the sql processors save
+//               : in the spam_score column. Depending on the score, the email can be
+//               : rejected, have its subject tagged, or get X-Spam headers
+// ----------------------------------------------------------------------------------
+// Config Options: spamcheck_url string - http://127.0.0.1:11333 for rspamd (default),
+//               : spamd://127.0.0.1:783 or spamd:///path/to/socket for spamd
+//               : spamcheck_timeout string - timeout of the scan, default "10s"
+//               : spamcheck_max_size int - bigger emails aren't scanned, default 512000
+//               : spamcheck_spam_score float64 - the score of spam, defaults to the
+//               : required score of the scanner
+//               : spamcheck_reject_score float64 - reject the email with a 550 from this
+//               : score, 0 (default) never rejects
+//               : spamcheck_subject_score float64 - prefix the subject from this score,
+//               : 0 (default) leaves the subject
+//               : spamcheck_subject_prefix string - default "[SPAM] "
+//               : spamcheck_headers bool - add X-Spam-Flag, X-Spam-Score and
+//               : X-Spam-Status headers. Not needed with the verdicts processor
+//               : spamcheck_tempfail bool - defer the email with a 451 when the scanner
+//               : can't be reached. By default it's passed on unscanned
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader, the envelope
+// ----------------------------------------------------------------------------------
+// Output        : a "spam" verdict with the score, see SpamScore
+//               : e.Data with the prefixed subject, and e.Subject
+//               : X-Spam headers appended to e.DeliveryHeader, so place it after Header
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["spamcheck"] = func() Decorator {
+		return SpamCheck()
+	}
+	Svc.AddWholeMessage("spamcheck")
+}
+
+type SpamCheckProcessorConfig struct {
+	URL           string  `json:"spamcheck_url,omitempty"`
+	Timeout       string  `json:"spamcheck_timeout,omitempty"`
+	MaxSize       int     `json:"spamcheck_max_size,omitempty"`
+	SpamScore     float64 `json:"spamcheck_spam_score,omitempty"`
+	RejectScore   float64 `json:"spamcheck_reject_score,omitempty"`
+	SubjectScore  float64 `json:"spamcheck_subject_score,omitempty"`
+	SubjectPrefix string  `json:"spamcheck_subject_prefix,omitempty"`
+	Headers       bool    `json:"spamcheck_headers,omitempty"`
+	TempFail      bool    `json:"spamcheck_tempfail,omitempty"`
+}
+
+const (
+	defaultSpamCheckURL     = "http://127.0.0.1:11333"
+	defaultSpamCheckTimeout = time.Second * 10
+	// defaultSpamCheckMaxSize is spamc's default
+	defaultSpamCheckMaxSize = 512000
+	defaultSpamCheckPrefix  = "[SPAM] "
+)
+
+var errSpamRejected = errors.New("spamcheck: rejected as spam")
+
+// spamHeaders returns the X-Spam headers for the verdict
+func spamHeaders(v Verdict) string {
+	flag := "NO"
+	if v.Result == "yes" {
+		flag = "YES"
+	}
+	return fmt.Sprintf("X-Spam-Flag: %s\nX-Spam-Score: %.1f\n", flag, v.Score) + spamStatusHeader(v)
+}
+
+func SpamCheck() Decorator {
+	var config *SpamCheckProcessorConfig
+	var scanner spamScanner
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SpamCheckProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SpamCheckProcessorConfig)
+		if config.URL == "" {
+			config.URL = defaultSpamCheckURL
+		}
+		timeout := defaultSpamCheckTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid spamcheck_timeout %q", config.Timeout)
+			}
+		}
+		if config.MaxSize <= 0 {
+			config.MaxSize = defaultSpamCheckMaxSize
+		}
+		if config.SubjectPrefix == "" {
+			config.SubjectPrefix = defaultSpamCheckPrefix
+		}
+		if scanner, err = newSpamScanner(config.URL, timeout); err != nil {
+			return fmt.Errorf("invalid spamcheck_url: %s", err)
+		}
+		return nil
+	}))
+	Svc.AddHealthCheck(func() error {
+		return scanner.ping()
+	})
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			if e.Len() > config.MaxSize {
+				Log().Debugf("spamcheck: %s is too big to be scanned", e.QueuedId)
+				return p.Process(e, task)
+			}
+			r, err := scanner.check(e)
+			if err != nil {
+				Log().WithError(err).Warnf("spamcheck: could not scan %s", e.QueuedId)
+				if config.TempFail {
+					return NewResult("451 4.7.1 Error: the email could not be scanned, try again later"), StorageError
+				}
+				return p.Process(e, task)
+			}
+			v := Verdict{Method: VerdictSpam, Result: "no", Score: r.score, Required: r.required,
+				Reason: strings.Join(r.symbols, ","), Scanner: scanner.name()}
+			if config.SpamScore > 0 {
+				v.Required = config.SpamScore
+			}
+			if r.score >= v.Required {
+				v.Result = "yes"
+			}
+			AddVerdict(e, v)
+
+			if config.RejectScore > 0 && r.score >= config.RejectScore {
+				Log().Infof("spamcheck: rejected %s with a score of %.1f", e.QueuedId, r.score)
+				return NewResult("550 5.7.1 Error: the email was classified as spam"), errSpamRejected
+			}
+			if config.SubjectScore > 0 && r.score >= config.SubjectScore {
+				data := prefixSubject(e.Data.Bytes(), config.SubjectPrefix)
+				if !bytes.Equal(data, e.Data.Bytes()) {
+					e.Data.Reset()
+					e.Data.Write(data)
+					e.Subject = strings.TrimSpace(config.SubjectPrefix + e.Subject)
+					if e.Header != nil {
+						subject := strings.TrimSpace(config.SubjectPrefix + e.Header.Get("Subject"))
+						e.Header.Set("Subject", subject)
+					}
+					if e.HeaderIndex != nil {
+						subject := strings.TrimSpace(config.SubjectPrefix + e.HeaderIndex.Get("Subject"))
+						e.HeaderIndex.Del("Subject")
+						e.HeaderIndex.Add("Subject", subject)
+					}
+				}
+			}
+			if config.Headers {
+				e.DeliveryHeader += spamHeaders(v)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
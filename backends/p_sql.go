@@ -1,14 +1,20 @@
 package backends
 
 import (
+	"bytes"
+	"crypto/tls"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/artpar/go-guerrilla/ipaddr"
 	"github.com/artpar/go-guerrilla/mail"
+	"github.com/go-sql-driver/mysql"
 
-	"math/big"
 	"net"
 	"runtime/debug"
 
@@ -22,51 +28,206 @@ import (
 //               : using the hash generated by the "hash" processor and stored in
 //               : e.Hashes
 // ----------------------------------------------------------------------------------
-// Config Options: mail_table string - name of table for storing emails
+// Config Options: mail_table string - name of table for storing emails, {tenant} is
+//               : replaced with the envelope's tenant
 //               : sql_driver string - database driver name, eg. mysql
 //               : sql_dsn string - driver-specific data source name
 //               : primary_mail_host string - primary host name
 //               : sql_max_open_conns - sets the maximum number of open connections
-//               : to the database. The default is 0 (unlimited)
+//               : to the database, by all the workers. The default is 0 (unlimited)
 //               : sql_max_idle_conns - sets the maximum number of connections in the
 //               : idle connection pool. The default is 2
 //               : sql_max_conn_lifetime - sets the maximum amount of time
 //               : a connection may be reused
+//               : sql_tls string - for MySQL, "true" requires TLS to the database,
+//               : "skip-verify" doesn't verify its certificate, and "false" turns TLS
+//               : off. Overrides the tls parameter of the DSN
+//               : sql_ca_file string - for MySQL, PEM file of the CAs to verify the
+//               : database with, instead of the system's. Implies sql_tls "true"
+//               : sql_tags_column string - column for saving e.Tags as a comma
+//               : separated list. When sql_values is set, the tags are bound to
+//               : the last placeholder. Not saved if empty (default)
+//               : sql_columns []string - the columns of the table, and the fields
+//               : saved to them, eg. ["rcpt=recipient", "received=date"], instead of
+//               : the default columns. The fields are to, from, subject, body, mail,
+//               : hash, content_type, recipient, ip_addr, return_path, is_tls,
+//               : message_id, reply_to, sender, date, tags, tenant, queued_id, helo,
+//               : remote_ip and header:<name>. The table can't be migrated, swept by
+//               : retention or read back, which need the default columns
+//               : mysql_auto_migrate bool - create the table, and upgrade it to the
+//               : latest schema, when the processor starts. A {tenant} table is
+//               : migrated before its first insert. Only for the mysql driver
+//               : sql_batch_size int - insert up to this many rows, a row for each
+//               : recipient of the emails saved by all the workers, with one
+//               : INSERT. The default is 1 (no batching), at most 50
+//               : sql_batch_interval string - how long the first email of a batch
+//               : waits for the batch to fill up, default "50ms"
+//               : sql_write_behind_size int - when the database can't be reached,
+//               : buffer the rows of up to this many bytes in memory and accept the
+//               : emails, the rows are inserted in batches once it's back. The
+//               : buffered rows are lost if the daemon crashes. 0 (default) is off
+//               : sql_write_behind_time string - how long the database may stall
+//               : before the emails fail again with a temporary error, default "30s"
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by ParseHeader() processor
 //               : e.MailFrom
 //               : e.Subject - generated by by ParseHeader() processor
+//               : e.Tags
+//               : e.Values["s3"] - set by the s3 processor
+//               : e.Values["sql-stream"] - the row that the message was streamed to
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
 // ----------------------------------------------------------------------------------
+// Stream        : in stream_save_process, it appends the message to a new row of the
+//               : mail_table while it's received, holding at most 256 KiB of it in
+//               : memory, and sets e.Values["sql-stream"] to its mail_id. The sql
+//               : processor of save_process, which is required, then fills in the
+//               : row for the first recipient, prepending e.DeliveryHeader unless the
+//               : message was compressed, and copies the message to the rows of the
+//               : other recipients in the database. The row is deleted when the message
+//               : is incomplete, a row whose body is still "stream" was not saved.
+//               : Only the default columns, without batching or write-behind
+// ----------------------------------------------------------------------------------
 func init() {
 	processors["sql"] = func() Decorator {
 		return SQL()
 	}
+	streamProcessors["sql"] = func() StreamDecorator {
+		return StreamSQL()
+	}
+	streamStores["sql"] = "sql"
+	Svc.AddDependencies("sql", "hasher", "headersparser")
 }
 
 type SQLProcessorConfig struct {
-	Table           string `json:"mail_table"`
-	Driver          string `json:"sql_driver"`
-	DSN             string `json:"sql_dsn"`
-	SQLInsert       string `json:"sql_insert,omitempty"`
-	SQLValues       string `json:"sql_values,omitempty"`
-	PrimaryHost     string `json:"primary_mail_host"`
-	MaxConnLifetime string `json:"sql_max_conn_lifetime,omitempty"`
-	MaxOpenConns    int    `json:"sql_max_open_conns,omitempty"`
-	MaxIdleConns    int    `json:"sql_max_idle_conns,omitempty"`
+	Table           string   `json:"mail_table"`
+	Driver          string   `json:"sql_driver"`
+	DSN             string   `json:"sql_dsn"`
+	SQLInsert       string   `json:"sql_insert,omitempty"`
+	SQLValues       string   `json:"sql_values,omitempty"`
+	PrimaryHost     string   `json:"primary_mail_host"`
+	MaxConnLifetime string   `json:"sql_max_conn_lifetime,omitempty"`
+	MaxOpenConns    int      `json:"sql_max_open_conns,omitempty"`
+	MaxIdleConns    int      `json:"sql_max_idle_conns,omitempty"`
+	TagsColumn      string   `json:"sql_tags_column,omitempty"`
+	Columns         []string `json:"sql_columns,omitempty"`
+	TLS             string   `json:"sql_tls,omitempty"`
+	CAFile          string   `json:"sql_ca_file,omitempty"`
+	BatchSize       int      `json:"sql_batch_size,omitempty"`
+	BatchInterval   string   `json:"sql_batch_interval,omitempty"`
+	AutoMigrate     bool     `json:"mysql_auto_migrate,omitempty"`
+	WriteBehindSize int      `json:"sql_write_behind_size,omitempty"`
+	WriteBehindTime string   `json:"sql_write_behind_time,omitempty"`
 }
 
+const defaultSQLBatchInterval = time.Millisecond * 50
+
 type SQLProcessor struct {
-	cache  stmtCache
+	// prepared statements for each table
+	cache  map[string]*stmtCache
 	config *SQLProcessorConfig
+	// columns are set by sql_columns
+	columns []sqlColumn
+	// backoff is the wait before trying the database again, after it couldn't be reached
+	backoff sqlBackoff
+}
+
+var (
+	// sqlMinBackoff is the wait after the database couldn't be reached, doubled after each
+	// failure up to sqlMaxBackoff
+	sqlMinBackoff = time.Second
+	sqlMaxBackoff = time.Minute
+)
+
+// sqlBackoff fails the saves straight away while the database can't be reached, and lets a
+// save try again once the backoff has passed
+type sqlBackoff struct {
+	sync.Mutex
+	wait    time.Duration
+	retryAt time.Time
+}
+
+// waiting returns true until the backoff has passed
+func (b *sqlBackoff) waiting() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.wait > 0 && Now().Before(b.retryAt)
+}
+
+// failed doubles the backoff
+func (b *sqlBackoff) failed() {
+	b.Lock()
+	defer b.Unlock()
+	if b.wait *= 2; b.wait < sqlMinBackoff {
+		b.wait = sqlMinBackoff
+	} else if b.wait > sqlMaxBackoff {
+		b.wait = sqlMaxBackoff
+	}
+	b.retryAt = Now().Add(b.wait)
+}
+
+// ok resets the backoff
+func (b *sqlBackoff) ok() {
+	b.Lock()
+	defer b.Unlock()
+	b.wait = 0
+}
+
+// errSQLBackoff is returned instead of trying the database again before the backoff has passed
+var errSQLBackoff = errors.New("the database can't be reached, waiting to try again")
+
+// isSQLConnError returns true if the database could not be reached, as opposed to an error
+// returned by the database
+func isSQLConnError(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn || err == errSQLBackoff {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
 }
 
+// dsn returns the DSN with the TLS options applied
+func (s *SQLProcessor) dsn() (string, error) {
+	if s.config.Driver != "mysql" || (s.config.TLS == "" && s.config.CAFile == "") {
+		return s.config.DSN, nil
+	}
+	cfg, err := mysql.ParseDSN(s.config.DSN)
+	if err != nil {
+		return "", err
+	}
+	switch s.config.TLS {
+	case "", "true", "skip-verify", "false":
+	default:
+		return "", fmt.Errorf("invalid sql_tls %q, expected true, skip-verify or false", s.config.TLS)
+	}
+	cfg.TLSConfig = s.config.TLS
+	if s.config.CAFile != "" && s.config.TLS != "false" {
+		pool, err := readCAFile("sql_ca_file", s.config.CAFile)
+		if err != nil {
+			return "", err
+		}
+		name := "guerrilla:" + s.config.CAFile
+		if err := mysql.RegisterTLSConfig(name, &tls.Config{
+			RootCAs:            pool,
+			InsecureSkipVerify: s.config.TLS == "skip-verify",
+		}); err != nil {
+			return "", err
+		}
+		cfg.TLSConfig = name
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// connect opens the database. When the database can't be reached, it's returned with the error,
+// so that the saves can try again later, see isSQLConnError
 func (s *SQLProcessor) connect() (*sql.DB, error) {
 	var db *sql.DB
-	var err error
-	if db, err = sql.Open(s.config.Driver, s.config.DSN); err != nil {
+	dsn, err := s.dsn()
+	if err != nil {
+		return nil, err
+	}
+	if db, err = openSQLPool(s.config.Driver, dsn); err != nil {
 		Log().Error("cannot open database: ", err)
 		return nil, err
 	}
@@ -85,25 +246,64 @@ func (s *SQLProcessor) connect() (*sql.DB, error) {
 		db.SetConnMaxLifetime(t)
 	}
 
+	if strings.Contains(s.config.Table, TenantPlaceholder) {
+		// tables for each tenant may not exist yet
+		return db, err
+	}
+	if err = s.migrate(db, s.config.Table); err != nil {
+		if isSQLConnError(err) {
+			return db, err
+		}
+		_ = closeSQLPool(db)
+		return nil, err
+	}
 	// do we have permission to access the table?
-	_, err = db.Query("SELECT mail_id FROM " + s.config.Table + " LIMIT 1")
+	check := "mail_id"
+	if s.columns != nil {
+		// a mapped table may not have the mail_id column
+		check = sqlColumnNames(s.columns, "`")
+	}
+	rows, err := db.Query("SELECT " + check + " FROM " + s.config.Table + " LIMIT 1")
 	if err != nil {
+		if isSQLConnError(err) {
+			return db, err
+		}
+		_ = closeSQLPool(db)
 		return nil, err
 	}
+	_ = rows.Close()
 	return db, err
 }
 
 // prepares the sql query with the number of rows that can be batched with it
-func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
+// tenant is used for the table name, see ForTenant
+func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB, tenant string) (*sql.Stmt, error) {
 	var sqlstr, values string
 	if rows == 0 {
 		panic("rows argument cannot be 0")
 	}
-	if s.cache[rows-1] != nil {
-		return s.cache[rows-1]
+	table := ForTenant(s.config.Table, tenant)
+	if s.cache == nil {
+		s.cache = make(map[string]*stmtCache)
+	}
+	cache, ok := s.cache[table]
+	if !ok {
+		if strings.Contains(s.config.Table, TenantPlaceholder) {
+			// the table of a new tenant
+			if err := s.migrate(db, table); err != nil {
+				return nil, err
+			}
+		}
+		cache = &stmtCache{}
+		s.cache[table] = cache
+	}
+	if cache[rows-1] != nil {
+		return cache[rows-1], nil
 	}
-	if s.config.SQLInsert != "" {
-		sqlstr = s.config.SQLInsert
+	if s.columns != nil {
+		sqlstr = "INSERT INTO " + table + " (" + sqlColumnNames(s.columns, "`") + ") VALUES "
+	} else if s.config.SQLInsert != "" {
+		sqlstr = ForTenant(s.config.SQLInsert, tenant)
 		if !strings.HasSuffix(sqlstr, " ") {
 			// Add a trailing space so we can concatinate our values string
 			// without causing a syntax error
@@ -111,16 +311,33 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 		}
 	} else {
 		// Default to MySQL SQL
-		sqlstr = "INSERT INTO " + s.config.Table + " "
-		sqlstr += "(`date`, `to`, `from`, `subject`, `body`,  `mail`, `spam_score`, "
+		sqlstr = "INSERT INTO " + table + " "
+		sqlstr += "(`date`, `to`, `from`, `subject`, `body`,  `mail`, "
 		sqlstr += "`hash`, `content_type`, `recipient`, `has_attach`, `ip_addr`, "
-		sqlstr += "`return_path`, `is_tls`, `message_id`, `reply_to`, `sender`)"
+		sqlstr += "`return_path`, `is_tls`, `message_id`, `reply_to`, `sender`, `spam_score`"
+		if s.config.TagsColumn != "" {
+			sqlstr += ", `" + s.config.TagsColumn + "`"
+		}
+		sqlstr += ")"
 		sqlstr += " VALUES "
 	}
-	if s.config.SQLValues != "" {
+	if s.columns != nil {
+		values = "(" + strings.Repeat("?, ", len(s.columns)-1) + "?)"
+	} else if s.config.SQLValues != "" {
 		values = s.config.SQLValues
+	} else if s.config.SQLInsert != "" {
+		// a custom INSERT with the columns of the default one, where the spam_score was 0
+		values = "(NOW(), ?, ?, ?, ? , ?, 0, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?"
+		if s.config.TagsColumn != "" {
+			values += ", ?"
+		}
+		values += ")"
 	} else {
-		values = "(NOW(), ?, ?, ?, ? , ?, 0, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?)"
+		values = "(NOW(), ?, ?, ?, ? , ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?"
+		if s.config.TagsColumn != "" {
+			values += ", ?"
+		}
+		values += ")"
 	}
 	// add more rows
 	comma := ""
@@ -132,11 +349,12 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 	}
 	stmt, sqlErr := db.Prepare(sqlstr)
 	if sqlErr != nil {
-		Log().WithError(sqlErr).Panic("failed while db.Prepare(INSERT...)")
+		Log().WithError(sqlErr).Error("failed while db.Prepare(INSERT...)")
+		return nil, sqlErr
 	}
 	// cache it
-	s.cache[rows-1] = stmt
-	return stmt
+	cache[rows-1] = stmt
+	return stmt, nil
 }
 
 func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
@@ -153,8 +371,6 @@ func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]
 			panic("query failed")
 		}
 	}()
-	// prepare the query used to insert when rows reaches batchMax
-	insertStmt = s.prepareInsertQuery(c, db)
 	_, execErr = insertStmt.Exec(*vals...)
 	if execErr != nil {
 		Log().WithError(execErr).Error("There was a problem the insert")
@@ -162,21 +378,53 @@ func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]
 	return
 }
 
-// for storing ip addresses in the ip_addr column
-func (s *SQLProcessor) ip2bint(ip string) *big.Int {
-	bint := big.NewInt(0)
-	addr := net.ParseIP(ip)
-	if strings.Index(ip, "::") > 0 {
-		bint.SetBytes(addr.To16())
-	} else {
-		bint.SetBytes(addr.To4())
+// insert inserts the rows, up to max rows with each statement. While the database can't be
+// reached, it's tried again after a backoff rather than for each email
+func (s *SQLProcessor) insert(db *sql.DB, tenant string, rows [][]interface{}, max int) (err error) {
+	if s.backoff.waiting() {
+		return errSQLBackoff
+	}
+	defer func() {
+		// doQuery panics when the statement can't be run
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sql insert failed: %v", r)
+		}
+		if err == nil {
+			s.backoff.ok()
+		} else if isSQLConnError(err) {
+			s.backoff.failed()
+		}
+	}()
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > max {
+			n = max
+		}
+		var vals []interface{}
+		for _, row := range rows[:n] {
+			vals = append(vals, row...)
+		}
+		stmt, err := s.prepareInsertQuery(n, db, tenant)
+		if err != nil {
+			return err
+		}
+		if err = s.doQuery(n, db, stmt, &vals); err != nil {
+			return err
+		}
+		rows = rows[n:]
 	}
-	return bint
+	return nil
+}
+
+// spamScoreValue returns true when the spam score is one of the values, after the sender. The
+// custom sql_insert and sql_values have their own
+func (s *SQLProcessor) spamScoreValue() bool {
+	return s.columns == nil && s.config.SQLInsert == "" && s.config.SQLValues == ""
 }
 
 func (s *SQLProcessor) fillAddressFromHeader(e *mail.Envelope, headerKey string) string {
-	if v, ok := e.Header[headerKey]; ok {
-		addr, err := mail.NewAddress(v[0])
+	if v := e.Header.Get(headerKey); v != "" {
+		addr, err := mail.NewAddress(v)
 		if err != nil {
 			return ""
 		}
@@ -189,6 +437,8 @@ func SQL() Decorator {
 	var config *SQLProcessorConfig
 	var vals []interface{}
 	var db *sql.DB
+	var batcher *sqlBatcher
+	var wb *writeBehind
 	s := &SQLProcessor{}
 
 	// open the database connection (it will also check if we can select the table)
@@ -200,17 +450,66 @@ func SQL() Decorator {
 		}
 		config = bcfg.(*SQLProcessorConfig)
 		s.config = config
-		db, err = s.connect()
-		if err != nil {
+		if s.columns, err = parseSQLColumns("sql_columns", config.Columns); err != nil {
 			return err
 		}
-		return nil
+		if config.AutoMigrate && config.Driver != "mysql" {
+			return errors.New("mysql_auto_migrate can only be used with the mysql sql_driver")
+		}
+		if s.columns != nil && (config.SQLInsert != "" || config.SQLValues != "" || config.TagsColumn != "") {
+			return errors.New("sql_columns can't be used with sql_insert, sql_values or sql_tags_column")
+		}
+		if s.columns != nil && config.AutoMigrate {
+			// the migrations create and upgrade the default columns
+			return errors.New("sql_columns can't be used with mysql_auto_migrate")
+		}
+		if config.BatchSize > GuerrillaDBAndRedisBatchMax {
+			return fmt.Errorf("sql_batch_size can be at most %d", GuerrillaDBAndRedisBatchMax)
+		}
+		if config.WriteBehindSize > 0 {
+			if wb, err = useSQLWriteBehind(config); err != nil {
+				return err
+			}
+		}
+		if config.BatchSize > 1 {
+			interval := defaultSQLBatchInterval
+			if config.BatchInterval != "" {
+				if interval, err = time.ParseDuration(config.BatchInterval); err != nil || interval <= 0 {
+					return fmt.Errorf("invalid sql_batch_interval %q", config.BatchInterval)
+				}
+			}
+			// the batcher has the connection
+			batcher, err = useSQLBatcher(config, interval)
+			return err
+		}
+		db, err = s.connect()
+		if isSQLConnError(err) {
+			// the saves are deferred until the database is back
+			Log().WithError(err).Warn("sql: the database can't be reached, it will be tried again")
+			s.backoff.failed()
+			return nil
+		}
+		return err
 	}))
 
 	// shutdown will close the database connection
 	Svc.AddShutdowner(ShutdownWith(func() error {
+		if wb != nil {
+			w := wb
+			wb = nil
+			if err := w.release(); err != nil {
+				Log().WithError(err).Error("sql: could not close the write-behind database")
+			}
+		}
+		if batcher != nil {
+			b := batcher
+			batcher = nil
+			return b.release()
+		}
 		if db != nil {
-			return db.Close()
+			d := db
+			db = nil
+			return closeSQLPool(d)
 		}
 		return nil
 	}))
@@ -237,7 +536,21 @@ func SQL() Decorator {
 				if _, ok := e.Values["redis"]; ok {
 					body = "redis"
 				}
+				// was saved to a bucket by the S3 processor, the mail column has its URL
+				s3, isS3 := e.Values["s3"].(string)
+				if isS3 {
+					body = "s3"
+				}
+				// was streamed to a row by the sql stream processor, the mail column has the message
+				streamID, isStream := e.Values[sqlStreamValue].(int64)
+				if isStream {
+					body = ""
+					if e.Values["stream-encoding"] == "deflate" {
+						body = "gzip"
+					}
+				}
 
+				var rows [][]interface{}
 				for i := range e.RcptTo {
 
 					// use the To header, otherwise rcpt to
@@ -256,10 +569,7 @@ func SQL() Decorator {
 					sender := trimToLimit(s.fillAddressFromHeader(e, "Sender"), 255)
 
 					recipient := trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255)
-					contentType := ""
-					if v, ok := e.Header["Content-Type"]; ok {
-						contentType = trimToLimit(v[0], 255)
-					}
+					contentType := trimToLimit(e.Header.Get("Content-Type"), 255)
 
 					// build the values for the query
 					vals = []interface{}{} // clear the vals
@@ -270,9 +580,18 @@ func SQL() Decorator {
 						body, // body describes how to interpret the data, eg 'redis' means stored in redis, and 'gzip' stored in mysql, using gzip compression
 					)
 					// `mail` column
-					if body == "redis" {
+					if isStream {
+						// prepended to the streamed message, which has no delivery header
+						if body == "gzip" {
+							vals = append(vals, "")
+						} else {
+							vals = append(vals, e.DeliveryHeader)
+						}
+					} else if body == "redis" {
 						// data already saved in redis
 						vals = append(vals, "")
+					} else if isS3 {
+						vals = append(vals, s3)
 					} else if co != nil {
 						// use a compressor (automatically adds e.DeliveryHeader)
 						vals = append(vals, co.String())
@@ -285,7 +604,7 @@ func SQL() Decorator {
 						hash, // hash (redis hash if saved in redis)
 						contentType,
 						recipient,
-						s.ip2bint(e.RemoteIP).Bytes(),         // ip_addr store as varbinary(16)
+						ipaddr.Bytes(e.RemoteIP),              // ip_addr store as varbinary(16)
 						trimToLimit(e.MailFrom.String(), 255), // return_path
 						// is_tls
 						e.TLS,
@@ -295,12 +614,46 @@ func SQL() Decorator {
 						replyTo,
 						sender,
 					)
-
-					stmt := s.prepareInsertQuery(1, db)
-					err := s.doQuery(1, db, stmt, &vals)
-					if err != nil {
-						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					if s.spamScoreValue() {
+						vals = append(vals, SpamScore(e))
+					}
+					if config.TagsColumn != "" {
+						vals = append(vals, e.Tags.String())
+					}
+					if s.columns != nil {
+						vals = sqlColumnValues(s.columns, e, vals)
+					}
+					rows = append(rows, vals)
+				}
+				// the rows up to stored were inserted
+				stored := 0
+				var err error
+				if isStream {
+					if err = s.completeStream(db, e.Tenant, streamID, rows); err == nil {
+						stored = len(rows)
+					}
+				} else if wb != nil && wb.pending() {
+					err = errWriteBehindPending
+				} else if batcher != nil && len(rows) > 0 {
+					if err = batcher.insert(e.Tenant, rows); err == nil {
+						stored = len(rows)
 					}
+				} else {
+					for ; stored < len(rows); stored++ {
+						if err = s.insert(db, e.Tenant, rows[stored:stored+1], 1); err != nil {
+							break
+						}
+					}
+				}
+				if err == errWriteBehindPending || isSQLConnError(err) {
+					if wb == nil || !wb.add(sqlWriteBehindItem(e, rows[stored:])) {
+						return NewResult(response.Canned.ErrorStorageUnavailable), StorageError
+					}
+				} else if err != nil {
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				}
+				for i := range e.RcptTo {
+					TrackRcptDelivery(e, e.RcptTo[i], DeliveryStored, "mysql")
 				}
 
 				// continue to the next Processor in the decorator chain
@@ -325,3 +678,185 @@ func SQL() Decorator {
 		})
 	}
 }
+
+// sqlStreamValue is the key of e.Values that has the mail_id of the row that the message was streamed to
+const sqlStreamValue = "sql-stream"
+
+// sqlStreamBody is the body of the row while the message is streamed to it, until the sql processor of
+// save_process fills in the other columns
+const sqlStreamBody = "stream"
+
+// sqlStreamChunk is how much of the streamed message is held before it's appended to its row
+const sqlStreamChunk = 256 << 10
+
+// concat returns the SQL that concatenates a and b, for the driver
+func (s *SQLProcessor) concat(a, b string) string {
+	if s.config.Driver == "mysql" {
+		return "CONCAT(" + a + ", " + b + ")"
+	}
+	return a + " || " + b
+}
+
+// completeStream fills in the row that the message was streamed to with the first of the rows, and
+// copies the message to the rows of the other recipients in the database, so it's never loaded
+func (s *SQLProcessor) completeStream(db *sql.DB, tenant string, id int64, rows [][]interface{}) error {
+	if db == nil {
+		return errSQLBackoff
+	}
+	table := ForTenant(s.config.Table, tenant)
+	columns := []string{"`to`", "`from`", "`subject`", "`body`", "`mail`", "`hash`", "`content_type`",
+		"`recipient`", "`ip_addr`", "`return_path`", "`is_tls`", "`message_id`", "`reply_to`", "`sender`",
+		"`spam_score`"}
+	if s.config.TagsColumn != "" {
+		columns = append(columns, "`"+s.config.TagsColumn+"`")
+	}
+	// the index of the mail column in a row
+	const mailColumn = 4
+	set := make([]string, len(columns))
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		set[i], values[i] = column+" = ?", "?"
+	}
+	set[mailColumn] = "`mail` = " + s.concat("?", "`mail`")
+	values[mailColumn] = "`mail`"
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	args := append(append([]interface{}{Now()}, rows[0]...), id)
+	_, err = tx.Exec("UPDATE "+table+" SET `date` = ?, "+strings.Join(set, ", ")+" WHERE `mail_id` = ?", args...)
+	for _, row := range rows[1:] {
+		if err != nil {
+			break
+		}
+		args = append([]interface{}{Now()}, row[:mailColumn]...)
+		args = append(append(args, row[mailColumn+1:]...), id)
+		_, err = tx.Exec("INSERT INTO "+table+" (`date`, "+strings.Join(columns, ", ")+") SELECT ?, "+
+			strings.Join(values, ", ")+" FROM "+table+" WHERE `mail_id` = ?", args...)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// streamSQL appends the message that's written to it to a row of the mail table, a chunk at a time
+type streamSQL struct {
+	e     *mail.Envelope
+	s     *SQLProcessor
+	db    *sql.DB
+	table string
+	// id is the mail_id of the row, once the first chunk was inserted
+	id   int64
+	buf  bytes.Buffer
+	next StreamProcessor
+}
+
+// flush inserts the row with the buffered chunk, or appends the chunk to it
+func (s *streamSQL) flush() error {
+	chunk := s.buf.Bytes()
+	if chunk == nil {
+		// an empty message
+		chunk = []byte{}
+	}
+	if s.id == 0 {
+		res, err := s.db.Exec("INSERT INTO "+s.table+" (`date`, `to`, `from`, `subject`, `body`, `mail`, `hash`, "+
+			"`content_type`, `recipient`, `ip_addr`, `return_path`, `is_tls`, `message_id`, `reply_to`, `sender`) "+
+			"VALUES (?, '', '', '', ?, ?, '', '', '', ?, '', 0, '', '', '')", Now(), sqlStreamBody, chunk, []byte{})
+		if err != nil {
+			return err
+		}
+		if s.id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	} else if _, err := s.db.Exec("UPDATE "+s.table+" SET `mail` = "+s.s.concat("`mail`", "?")+
+		" WHERE `mail_id` = ?", chunk, s.id); err != nil {
+		return err
+	}
+	s.buf.Reset()
+	return nil
+}
+
+// remove deletes the row of an incomplete message
+func (s *streamSQL) remove() {
+	if s.id == 0 {
+		return
+	}
+	if _, err := s.db.Exec("DELETE FROM "+s.table+" WHERE `mail_id` = ?", s.id); err != nil {
+		Log().WithError(err).Errorf("could not delete the row %d of an incomplete email from %s", s.id, s.table)
+	}
+}
+
+func (s *streamSQL) Write(p []byte) (int, error) {
+	s.buf.Write(p)
+	if s.buf.Len() >= sqlStreamChunk {
+		if err := s.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return s.next.Write(p)
+}
+
+func (s *streamSQL) Close(err error) error {
+	if err == nil {
+		if err = s.flush(); err != nil {
+			Log().WithError(err).Error("could not stream the email to sql")
+			s.remove()
+			_ = s.next.Close(err)
+			return err
+		}
+		// the sql processor of save_process fills in the row
+		s.e.Values[sqlStreamValue] = s.id
+		return s.next.Close(nil)
+	}
+	s.remove()
+	return s.next.Close(err)
+}
+
+func StreamSQL() StreamDecorator {
+	s := &SQLProcessor{}
+	var db *sql.DB
+	var migrated sync.Map
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		bcfg, err := Svc.ExtractConfig(backendConfig, &SQLProcessorConfig{})
+		if err != nil {
+			return err
+		}
+		s.config = bcfg.(*SQLProcessorConfig)
+		if len(s.config.Columns) > 0 || s.config.SQLInsert != "" || s.config.SQLValues != "" {
+			return errors.New("the sql stream processor saves the default columns, " +
+				"it can't be used with sql_columns, sql_insert or sql_values")
+		}
+		if s.config.BatchSize > 1 || s.config.WriteBehindSize > 0 {
+			return errors.New("the sql stream processor can't be used with sql_batch_size or sql_write_behind_size")
+		}
+		db, err = s.connect()
+		if isSQLConnError(err) {
+			// the streams fail until the database is back
+			Log().WithError(err).Warn("sql: the database can't be reached, it will be tried again")
+			return nil
+		}
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		d := db
+		db = nil
+		return closeSQLPool(d)
+	}))
+
+	return func(e *mail.Envelope, next StreamProcessor) (StreamProcessor, error) {
+		if db == nil {
+			return nil, errors.New("sql: the database can't be reached")
+		}
+		table := ForTenant(s.config.Table, e.Tenant)
+		if _, ok := migrated.Load(table); !ok && strings.Contains(s.config.Table, TenantPlaceholder) {
+			// the table of a new tenant
+			if err := s.migrate(db, table); err != nil {
+				return nil, err
+			}
+			migrated.Store(table, true)
+		}
+		return &streamSQL{e: e, s: s, db: db, table: table, next: next}, nil
+	}
+}
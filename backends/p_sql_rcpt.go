@@ -0,0 +1,314 @@
+package backends
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sql_rcpt
+// ----------------------------------------------------------------------------------
+// Description   : Validates each recipient when it's given, by looking it up in a
+//               : users or aliases table. A recipient exists when sql_rcpt_query
+//               : returns a row. The database of the sql_driver and sql_dsn options
+//               : is shared with the sql processor, using one connection pool.
+//               : The answers are cached by all the workers. Put it in the
+//               : validate_process. While the database can't be reached, the
+//               : recipients are deferred with a 451
+// ----------------------------------------------------------------------------------
+// Config Options: sql_driver string - database driver name, eg. mysql
+//               : sql_dsn string - driver-specific data source name
+//               : sql_tls string, sql_ca_file string - TLS to MySQL, as for the sql
+//               : processor
+//               : sql_rcpt_query string - the query, each ? is replaced with the
+//               : recipient's address, in lower case, eg. "SELECT 1 FROM users WHERE
+//               : email = ? UNION SELECT 1 FROM aliases WHERE alias = ?". Required
+//               : sql_rcpt_cache_ttl string - how long a recipient that exists is
+//               : cached, default "5m", "0s" to not cache them
+//               : sql_rcpt_negative_ttl string - how long a recipient that doesn't
+//               : exist is cached, default "1m", "0s" to not cache them
+//               : sql_rcpt_cache_size int - the most recipients cached, default 10000
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : NoSuchUser when the last recipient wasn't found
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["sql_rcpt"] = func() Decorator {
+		return SQLRcpt()
+	}
+}
+
+type SQLRcptProcessorConfig struct {
+	Driver      string `json:"sql_driver"`
+	DSN         string `json:"sql_dsn"`
+	TLS         string `json:"sql_tls,omitempty"`
+	CAFile      string `json:"sql_ca_file,omitempty"`
+	Query       string `json:"sql_rcpt_query"`
+	CacheTTL    string `json:"sql_rcpt_cache_ttl,omitempty"`
+	NegativeTTL string `json:"sql_rcpt_negative_ttl,omitempty"`
+	CacheSize   int    `json:"sql_rcpt_cache_size,omitempty"`
+}
+
+const (
+	defaultSQLRcptCacheTTL    = time.Minute * 5
+	defaultSQLRcptNegativeTTL = time.Minute
+	defaultSQLRcptCacheSize   = 10000
+)
+
+// sqlRcptEntry is a cached answer
+type sqlRcptEntry struct {
+	exists  bool
+	expires time.Time
+}
+
+// sqlRcptValidator looks up the recipients for the workers that have the same config
+type sqlRcptValidator struct {
+	db          *sql.DB
+	query       string
+	args        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	mu          sync.Mutex
+	cache       map[string]sqlRcptEntry
+	// how many processors use the validator
+	users int
+}
+
+var (
+	sqlRcptValidatorsGuard sync.Mutex
+	// the validators of the processors, by their config, so that the workers share the cache
+	sqlRcptValidators = make(map[string]*sqlRcptValidator)
+)
+
+// parseTTL parses the duration of the option, the default is used when it's not set
+func (c *SQLRcptProcessorConfig) parseTTL(option, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", option, value)
+	}
+	return d, nil
+}
+
+// sqlRcptQuery returns the query with the placeholders of the driver, and how many there are
+func sqlRcptQuery(driver, query string) (string, int) {
+	n := strings.Count(query, "?")
+	if driver != "postgres" {
+		return query, n
+	}
+	var b strings.Builder
+	i := 0
+	for _, r := range query {
+		if r == '?' {
+			i++
+			b.WriteString("$" + strconv.Itoa(i))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), n
+}
+
+// useSQLRcptValidator returns the validator for the config, opening the database if it's not used already
+func useSQLRcptValidator(config *SQLRcptProcessorConfig) (*sqlRcptValidator, error) {
+	if config.Query == "" {
+		return nil, errors.New("sql_rcpt_query is required")
+	}
+	query, args := sqlRcptQuery(config.Driver, config.Query)
+	if args == 0 {
+		return nil, errors.New("sql_rcpt_query has no ? placeholder for the recipient")
+	}
+	ttl, err := config.parseTTL("sql_rcpt_cache_ttl", config.CacheTTL, defaultSQLRcptCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	negativeTTL, err := config.parseTTL("sql_rcpt_negative_ttl", config.NegativeTTL, defaultSQLRcptNegativeTTL)
+	if err != nil {
+		return nil, err
+	}
+	size := config.CacheSize
+	if size <= 0 {
+		size = defaultSQLRcptCacheSize
+	}
+	key := fmt.Sprintf("%+v", *config)
+	sqlRcptValidatorsGuard.Lock()
+	defer sqlRcptValidatorsGuard.Unlock()
+	if v, ok := sqlRcptValidators[key]; ok {
+		v.users++
+		return v, nil
+	}
+	// the DSN with the TLS options, as the sql processor has it, so that they open the same pool
+	s := &SQLProcessor{config: &SQLProcessorConfig{
+		Driver: config.Driver,
+		DSN:    config.DSN,
+		TLS:    config.TLS,
+		CAFile: config.CAFile,
+	}}
+	dsn, err := s.dsn()
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLPool(config.Driver, dsn)
+	if err != nil {
+		Log().Error("cannot open database: ", err)
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		if !isSQLConnError(err) {
+			_ = closeSQLPool(db)
+			return nil, err
+		}
+		Log().WithError(err).Warn("sql_rcpt: the database can't be reached, it will be tried again")
+	}
+	v := &sqlRcptValidator{
+		db:          db,
+		query:       query,
+		args:        args,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		cache:       make(map[string]sqlRcptEntry),
+		users:       1,
+	}
+	sqlRcptValidators[key] = v
+	return v, nil
+}
+
+// release closes the database when the last processor that used the validator is shut down
+func (v *sqlRcptValidator) release() error {
+	sqlRcptValidatorsGuard.Lock()
+	v.users--
+	last := v.users == 0
+	if last {
+		for key, u := range sqlRcptValidators {
+			if u == v {
+				delete(sqlRcptValidators, key)
+			}
+		}
+	}
+	sqlRcptValidatorsGuard.Unlock()
+	if !last {
+		return nil
+	}
+	return closeSQLPool(v.db)
+}
+
+// exists returns true when the query returns a row for the address, with the cached answer if
+// it hasn't expired. The answer is cached unless verify is set, for the address probes
+func (v *sqlRcptValidator) exists(address string, verify bool) (bool, error) {
+	now := Now()
+	v.mu.Lock()
+	entry, ok := v.cache[address]
+	v.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.exists, nil
+	}
+	args := make([]interface{}, v.args)
+	for i := range args {
+		args[i] = address
+	}
+	var found bool
+	rows, err := v.db.Query(v.query, args...)
+	if err != nil {
+		return false, err
+	}
+	found = rows.Next()
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if !verify {
+		v.store(address, found, now)
+	}
+	return found, nil
+}
+
+// store caches the answer, unless its ttl is 0
+func (v *sqlRcptValidator) store(address string, exists bool, now time.Time) {
+	ttl := v.ttl
+	if !exists {
+		ttl = v.negativeTTL
+	}
+	if ttl == 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.cache[address]; !ok && len(v.cache) >= v.size {
+		// make room, with the expired entries, or any entry if none expired
+		for key, e := range v.cache {
+			if now.After(e.expires) {
+				delete(v.cache, key)
+			}
+		}
+		for key := range v.cache {
+			if len(v.cache) < v.size {
+				break
+			}
+			delete(v.cache, key)
+		}
+	}
+	v.cache[address] = sqlRcptEntry{exists: exists, expires: now.Add(ttl)}
+}
+
+func SQLRcpt() Decorator {
+	var v *sqlRcptValidator
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SQLRcptProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		v, err = useSQLRcptValidator(bcfg.(*SQLRcptProcessorConfig))
+		return err
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if v != nil {
+			u := v
+			v = nil
+			return u.release()
+		}
+		return nil
+	}))
+
+	Svc.AddHealthCheck(func() error {
+		if v == nil {
+			return nil
+		}
+		return v.db.Ping()
+	})
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskValidateRcpt || len(e.RcptTo) == 0 {
+				return p.Process(e, task)
+			}
+			// validate only the last recipient that was appended
+			last := e.RcptTo[len(e.RcptTo)-1]
+			address := strings.ToLower(last.User + "@" + last.Host)
+			found, err := v.exists(address, IsVerifyOnly(e))
+			if err != nil {
+				Log().WithError(err).Error("sql_rcpt: could not look up ", address)
+				return NewResult(response.Canned.ErrorRcptValidation), StorageNotAvailable
+			}
+			if !found {
+				return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package backends
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestSQLRcpt(t *testing.T) {
+	c := NewManualClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(c))
+	dir, err := ioutil.TempDir("", "sqlrcpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dsn := "file:" + filepath.Join(dir, "users.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	exec := func(query string) {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec("CREATE TABLE users (email TEXT)")
+	exec("CREATE TABLE aliases (alias TEXT)")
+	exec("INSERT INTO users VALUES ('bob@acme.com')")
+	exec("INSERT INTO aliases VALUES ('sales@acme.com')")
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":     "Debugger",
+		"validate_process": "sql_rcpt",
+		"sql_driver":       "sqlite3",
+		"sql_dsn":          dsn,
+		"sql_rcpt_query":   "SELECT 1 FROM users WHERE email = ? UNION SELECT 1 FROM aliases WHERE alias = ?",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	validate := func(user string) error {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.RcptTo = []mail.Address{{User: user, Host: "Acme.com"}}
+		return backend.ValidateRcpt(e)
+	}
+	// the answer to a probe isn't cached
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "dan", Host: "acme.com"}}
+	VerifyOnly(e)
+	if err := backend.ValidateRcpt(e); err != NoSuchUser {
+		t.Error("expected dan not to exist, got", err)
+	}
+	exec("INSERT INTO users VALUES ('dan@acme.com')")
+	if err := validate("dan"); err != nil {
+		t.Error("expected dan to be found, got", err)
+	}
+	for _, step := range []struct {
+		advance time.Duration
+		exec    string
+		user    string
+		want    error
+	}{
+		{0, "", "Bob", nil},
+		{0, "", "sales", nil},
+		{0, "", "eve", NoSuchUser},
+		// the answers are cached
+		{0, "INSERT INTO users VALUES ('eve@acme.com')", "eve", NoSuchUser},
+		{0, "DELETE FROM users WHERE email = 'bob@acme.com'", "bob", nil},
+		{defaultSQLRcptNegativeTTL, "", "eve", nil},
+		{defaultSQLRcptCacheTTL, "", "bob", NoSuchUser},
+		// the lookup fails
+		{defaultSQLRcptCacheTTL, "DROP TABLE aliases", "sales", StorageNotAvailable},
+	} {
+		c.Advance(step.advance)
+		if step.exec != "" {
+			exec(step.exec)
+		}
+		if err := validate(step.user); err != step.want {
+			t.Errorf("expected %v for %s, got %v", step.want, step.user, err)
+		}
+	}
+
+	for _, config := range []*SQLRcptProcessorConfig{
+		{Driver: "sqlite3", DSN: dsn},
+		{Driver: "sqlite3", DSN: dsn, Query: "SELECT 1 FROM users"},
+		{Driver: "sqlite3", DSN: dsn, Query: "SELECT 1 FROM users WHERE email = ?", CacheTTL: "5"},
+	} {
+		if _, err := useSQLRcptValidator(config); err == nil {
+			t.Error("expected the config to be refused", config)
+		}
+	}
+	if q, n := sqlRcptQuery("postgres", "SELECT 1 FROM users WHERE email = ? OR alias = ?"); n != 2 ||
+		q != "SELECT 1 FROM users WHERE email = $1 OR alias = $2" {
+		t.Error("unexpected postgres query", q, n)
+	}
+}
+
+func TestSQLPool(t *testing.T) {
+	a, err := openSQLPool("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := openSQLPool("sqlite3", "file::memory:")
+	if a != b {
+		t.Fatal("expected the pool to be shared")
+	}
+	if err := closeSQLPool(a); err != nil || a.Ping() != nil {
+		t.Error("expected the pool to stay open for its other user", err)
+	}
+	if err := closeSQLPool(b); err != nil || a.Ping() == nil {
+		t.Error("expected the pool to be closed by its last user", err)
+	}
+}
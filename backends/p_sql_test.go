@@ -2,8 +2,14 @@ package backends
 
 import (
 	"database/sql"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -32,7 +38,7 @@ func TestSQL(t *testing.T) {
 	}
 
 	cfg := BackendConfig{
-		"save_process":      "sql",
+		"save_process":      "HeadersParser|Hasher|sql",
 		"mail_table":        *mailTableFlag,
 		"primary_mail_host": "example.com",
 		"sql_driver":        *sqlDriverFlag,
@@ -93,3 +99,83 @@ func findRows(hash string) ([]string, error) {
 	}
 	return results, nil
 }
+
+func TestSQLDSN(t *testing.T) {
+	s := &SQLProcessor{config: &SQLProcessorConfig{Driver: "mysql", DSN: "u:p@tcp(db:3306)/mail?tls=false", TLS: "true"}}
+	if dsn, err := s.dsn(); err != nil || dsn != "u:p@tcp(db:3306)/mail?tls=true" {
+		t.Error("expected sql_tls to override the DSN, got", dsn, err)
+	}
+	s.config.TLS = "required"
+	if _, err := s.dsn(); err == nil {
+		t.Error("expected an invalid sql_tls to be refused")
+	}
+
+	server := httptest.NewTLSServer(nil)
+	server.Close()
+	dir, err := ioutil.TempDir("", "sqltls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.config.TLS, s.config.CAFile = "", caFile
+	if dsn, err := s.dsn(); err != nil || !strings.HasSuffix(dsn, "?tls="+url.QueryEscape("guerrilla:"+caFile)) {
+		t.Error("expected a TLS config with the CA, got", dsn, err)
+	}
+	s.config.CAFile = filepath.Join(dir, "missing.pem")
+	if _, err := s.dsn(); err == nil {
+		t.Error("expected a missing sql_ca_file to be refused")
+	}
+	// other drivers have their own options
+	s.config.Driver = "sqlite3"
+	if dsn, err := s.dsn(); err != nil || dsn != s.config.DSN {
+		t.Error("expected the DSN to be used as it is, got", dsn, err)
+	}
+}
+
+func TestSQLReconnect(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	defer SetClock(SetClock(clock))
+	// nothing listens on port 1, the backend starts anyway
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Hasher|sql",
+		"mail_table":        "mail",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "mysql",
+		"sql_dsn":           "u:p@tcp(127.0.0.1:1)/mail?timeout=1s",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "451") {
+		t.Error("expected a tempfail while the database is down, got", result)
+	}
+
+	b := &sqlBackoff{}
+	for i, wait := range []time.Duration{sqlMinBackoff, sqlMinBackoff * 2, sqlMinBackoff * 4} {
+		b.failed()
+		if b.wait != wait || !b.waiting() {
+			t.Error("expected to back off for", wait, "after", i+1, "failures, got", b.wait)
+		}
+	}
+	clock.Advance(sqlMinBackoff * 4)
+	if b.waiting() {
+		t.Error("expected to try again after the backoff")
+	}
+	for i := 0; i < 10; i++ {
+		b.failed()
+	}
+	if b.wait != sqlMaxBackoff {
+		t.Error("expected the backoff to be at most", sqlMaxBackoff, "got", b.wait)
+	}
+	b.ok()
+	if b.waiting() {
+		t.Error("expected the backoff to be reset")
+	}
+}
@@ -0,0 +1,323 @@
+package backends
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/ipaddr"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sqlite
+// ----------------------------------------------------------------------------------
+// Description   : Saves the e.Data (email data) and e.DeliveryHeader together in a
+//               : local SQLite file, with the same columns as the sql processor, so
+//               : that a single server needs no database server. The file is opened
+//               : in WAL mode and the tables are created when they don't exist.
+//               : Old mail is deleted by the retention job, with "sqlite" in
+//               : retention_stores. Needs cgo
+// ----------------------------------------------------------------------------------
+// Config Options: sqlite_file string - path of the database file, created if it does
+//               : not exist. Required
+//               : sqlite_table string - name of the table, {tenant} is replaced with
+//               : the envelope's tenant. Defaults to "mail"
+//               : sqlite_vacuum_interval string - how often to give the space of
+//               : deleted mail back to the file system, eg. "24h". Off when empty
+//               : primary_mail_host string - primary host name
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by ParseHeader() processor
+//               : e.MailFrom
+//               : e.Subject - generated by by ParseHeader() processor
+//               : e.Tags
+//               : e.Values["zlib-compressor"] - set by the compressor processor
+//               : e.Values["redis"] - set by the redis processor
+//               : e.Values["s3"] - set by the s3 processor
+//               : a streamed email is refused without it
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.QueuedId with the first item fromHashes[0]
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["sqlite"] = func() Decorator {
+		return SQLite()
+	}
+	Svc.AddDependencies("sqlite", "hasher", "headersparser")
+}
+
+type SQLiteProcessorConfig struct {
+	File           string `json:"sqlite_file"`
+	Table          string `json:"sqlite_table,omitempty"`
+	VacuumInterval string `json:"sqlite_vacuum_interval,omitempty"`
+	PrimaryHost    string `json:"primary_mail_host"`
+}
+
+const defaultSQLiteTable = "mail"
+
+// dsn opens the file in WAL mode, waits for the locks of other connections, and lets
+// the space of deleted rows be given back by an incremental vacuum
+func (c *SQLiteProcessorConfig) dsn() string {
+	return "file:" + (&url.URL{Path: c.File}).EscapedPath() +
+		"?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_auto_vacuum=incremental"
+}
+
+func (c *SQLiteProcessorConfig) table() string {
+	if c.Table == "" {
+		return defaultSQLiteTable
+	}
+	return c.Table
+}
+
+// sqliteQuote quotes a table or index name
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqliteSchema creates the table and its indexes, the columns are the ones of the sql processor
+func sqliteSchema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + sqliteQuote(table) + ` (
+			mail_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			date DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			"to" TEXT NOT NULL, "from" TEXT NOT NULL, subject TEXT NOT NULL,
+			body TEXT NOT NULL, mail BLOB NOT NULL, spam_score REAL NOT NULL DEFAULT 0,
+			hash TEXT NOT NULL, content_type TEXT NOT NULL, recipient TEXT NOT NULL,
+			has_attach INTEGER NOT NULL DEFAULT 0, ip_addr BLOB NOT NULL, return_path TEXT NOT NULL,
+			is_tls INTEGER NOT NULL, message_id TEXT NOT NULL, reply_to TEXT NOT NULL,
+			sender TEXT NOT NULL, tags TEXT NOT NULL DEFAULT '')`,
+		"CREATE INDEX IF NOT EXISTS " + sqliteQuote(table+"_date") + " ON " + sqliteQuote(table) + " (date)",
+		"CREATE INDEX IF NOT EXISTS " + sqliteQuote(table+"_hash") + " ON " + sqliteQuote(table) + " (hash)",
+	}
+}
+
+type SQLiteProcessor struct {
+	// prepared statements for each table, created with the table
+	cache  map[string]*sql.Stmt
+	config *SQLiteProcessorConfig
+	sync.Mutex
+}
+
+func (s *SQLiteProcessor) connect() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", s.config.dsn())
+	if err != nil {
+		Log().Error("cannot open database: ", err)
+		return nil, err
+	}
+	// SQLite has a single writer, the saves take turns rather than wait for the busy timeout
+	db.SetMaxOpenConns(1)
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if mode != "wal" {
+		Log().Warnf("sqlite: %s is in %s mode instead of WAL", s.config.File, mode)
+	}
+	return db, nil
+}
+
+// prepare returns the INSERT statement for the tenant's table, creating the table if needed
+func (s *SQLiteProcessor) prepare(db *sql.DB, tenant string) (*sql.Stmt, error) {
+	table := ForTenant(s.config.table(), tenant)
+	s.Lock()
+	defer s.Unlock()
+	if stmt, ok := s.cache[table]; ok {
+		return stmt, nil
+	}
+	for _, q := range sqliteSchema(table) {
+		if _, err := db.Exec(q); err != nil {
+			return nil, err
+		}
+	}
+	stmt, err := db.Prepare("INSERT INTO " + sqliteQuote(table) + " " +
+		`("date", "to", "from", "subject", "body", "mail", "hash", "content_type", "recipient", ` +
+		`"ip_addr", "return_path", "is_tls", "message_id", "reply_to", "sender", "spam_score", "tags") ` +
+		`VALUES (CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache == nil {
+		s.cache = make(map[string]*sql.Stmt)
+	}
+	s.cache[table] = stmt
+	return stmt, nil
+}
+
+// vacuum gives the pages freed by deleted mail back to the file system, and truncates the WAL
+func (s *SQLiteProcessor) vacuum(db *sql.DB) error {
+	if _, err := db.Exec("PRAGMA incremental_vacuum"); err != nil {
+		return err
+	}
+	_, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+func SQLite() Decorator {
+	var config *SQLiteProcessorConfig
+	var db *sql.DB
+	var stop chan struct{}
+	var wg sync.WaitGroup
+	s := &SQLiteProcessor{}
+	// for the helpers that fill in the columns shared with the sql processor
+	fields := &SQLProcessor{}
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SQLiteProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SQLiteProcessorConfig)
+		if config.File == "" {
+			return errors.New("sqlite_file is required by the sqlite processor")
+		}
+		var interval time.Duration
+		if config.VacuumInterval != "" {
+			if interval, err = time.ParseDuration(config.VacuumInterval); err != nil || interval <= 0 {
+				return fmt.Errorf("invalid sqlite_vacuum_interval %q", config.VacuumInterval)
+			}
+		}
+		s.config = config
+		s.cache = nil
+		if db, err = s.connect(); err != nil {
+			return err
+		}
+		if !strings.Contains(config.table(), TenantPlaceholder) {
+			// create the table now, rather than with the first email
+			if _, err = s.prepare(db, ""); err != nil {
+				return err
+			}
+		}
+		if interval > 0 {
+			stop = make(chan struct{})
+			wg.Add(1)
+			go func(db *sql.DB, stop chan struct{}) {
+				defer wg.Done()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C:
+						if err := s.vacuum(db); err != nil {
+							Log().WithError(err).Warn("sqlite: vacuum failed")
+						}
+					}
+				}
+			}(db, stop)
+		}
+		return nil
+	}))
+
+	// shutdown stops the vacuum and closes the database
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if stop != nil {
+			close(stop)
+			wg.Wait()
+			stop = nil
+		}
+		if db != nil {
+			return db.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if missingStreamedBody(e) {
+					// only the header section is here, and the message was not saved to a bucket
+					Log().Error("sqlite: the streamed email was not saved to s3, refusing to save only its header")
+					return NewResult(response.Canned.FailBackendTransaction), StorageError
+				}
+				var body string
+				hash := ""
+				if len(e.Hashes) > 0 {
+					hash = e.Hashes[0]
+					e.QueuedId = e.Hashes[0]
+				}
+				// the mail column, unless it was saved in Redis
+				var data []byte
+				if c, ok := e.Values["zlib-compressor"]; ok {
+					// a compressor was set by the Compress processor
+					body = "gzip"
+					data = []byte(c.(*DataCompressor).String())
+				} else {
+					data = []byte(e.String())
+				}
+				if _, ok := e.Values["redis"]; ok {
+					body = "redis"
+					data = []byte{}
+				}
+				if s3, ok := e.Values["s3"].(string); ok {
+					// the message is in the bucket, save its URL
+					body = "s3"
+					data = []byte(s3)
+				}
+				stmt, err := s.prepare(db, e.Tenant)
+				if err != nil {
+					Log().WithError(err).Error("could not prepare the insert")
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				}
+
+				for i := range e.RcptTo {
+					// use the To header, otherwise rcpt to
+					to := trimToLimit(fields.fillAddressFromHeader(e, "To"), 255)
+					if to == "" {
+						to = trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255)
+					}
+					mid := trimToLimit(fields.fillAddressFromHeader(e, "Message-Id"), 255)
+					if mid == "" {
+						mid = fmt.Sprintf("%s.%s@%s", hash, e.RcptTo[i].User, config.PrimaryHost)
+					}
+					contentType := trimToLimit(e.Header.Get("Content-Type"), 255)
+					_, err := stmt.Exec(
+						to,
+						trimToLimit(e.MailFrom.String(), 255), // from
+						trimToLimit(e.Subject, 255),
+						body, // how to interpret the mail column, eg. 'redis' or 'gzip'
+						data,
+						hash,
+						contentType,
+						trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255), // recipient
+						ipaddr.Bytes(e.RemoteIP),                                  // ip_addr
+						trimToLimit(e.MailFrom.String(), 255),                     // return_path
+						e.TLS,
+						mid,
+						trimToLimit(fields.fillAddressFromHeader(e, "Reply-To"), 255),
+						trimToLimit(fields.fillAddressFromHeader(e, "Sender"), 255),
+						SpamScore(e),
+						e.Tags.String(),
+					)
+					if err != nil {
+						Log().WithError(err).Error("There was a problem the insert")
+						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+					}
+					TrackRcptDelivery(e, e.RcptTo[i], DeliveryStored, "sqlite")
+				}
+
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else if task == TaskValidateRcpt {
+				if len(e.RcptTo) > 0 {
+					// validate only the _last_ recipient that was appended
+					last := e.RcptTo[len(e.RcptTo)-1]
+					if len(last.User) > 255 {
+						return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+					}
+				}
+				return p.Process(e, task)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	logger, err := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	if err != nil {
+		t.Fatal("get logger:", err)
+	}
+	file := filepath.Join(dir, "mail.db")
+	cfg := BackendConfig{
+		"save_process":           "HeadersParser|Hasher|Compressor|SQLite",
+		"sqlite_file":            file,
+		"sqlite_table":           "mail_{tenant}",
+		"sqlite_vacuum_interval": "1h",
+		"primary_mail_host":      "example.com",
+	}
+	backend, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			_ = backend.Shutdown()
+		}
+	}()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "user", Host: "example.com"}, {User: "other", Host: "example.com"}}
+	e.Hashes = []string{"abc123"}
+	e.Tenant = "acme"
+	e.Tags.Add("dkim", "pass")
+	e.Data.WriteString("Subject: test\n\nhello\n")
+	if result := backend.Process(e); !strings.Contains(result.String(), "abc123") {
+		t.Errorf("expected message to be queued with hash, got %q", result)
+	}
+	if err := backend.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	stopped = true
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Error("expected the WAL mode, got", mode, err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mail_acme WHERE hash = ?", "abc123").Scan(&count); err != nil || count != 2 {
+		t.Fatal("expected a row for each recipient, got", count, err)
+	}
+	var body, recipient, tags string
+	var data []byte
+	err = db.QueryRow("SELECT body, mail, recipient, tags FROM mail_acme ORDER BY mail_id LIMIT 1").
+		Scan(&body, &data, &recipient, &tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "gzip" || recipient != "user@example.com" || !strings.Contains(tags, "dkim:pass") {
+		t.Error("unexpected row", body, recipient, tags)
+	}
+	if data, err := uncompressStored(data); err != nil || !strings.Contains(string(data), "hello") {
+		t.Error("expected the message, got", string(data), err)
+	}
+}
+
+func TestSQLiteRetention(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	config := &SQLiteProcessorConfig{File: filepath.Join(dir, "mail.db")}
+	s := &SQLiteProcessor{config: config}
+	db, err := s.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if _, err := s.prepare(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	insert := `INSERT INTO mail (date, "to", "from", subject, body, mail, hash, content_type, recipient,
+		ip_addr, return_path, is_tls, message_id, reply_to, sender)
+		VALUES (datetime('now', ?), '', '', '', '', ?, '', '', ?, x'', '', 0, '', '', '')`
+	for _, row := range [][]string{
+		{"-10 days", "a@example.com"},
+		{"-1 days", "b@example.com"},
+		{"-10 days", "c@keep.com"},
+	} {
+		if _, err := db.Exec(insert, row[0], []byte("Subject: "+row[1]), row[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, err := NewRetentionJob(BackendConfig{
+		"retention_interval":    "1h",
+		"retention_days":        5,
+		"retention_domain_days": []interface{}{"keep.com=0"},
+		"retention_stores":      []interface{}{"sqlite"},
+		"sqlite_file":           config.File,
+		"primary_mail_host":     "example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := j.Run(false)
+	if len(reports) != 1 || reports[0].Store != "sqlite" || reports[0].Deleted != 1 || reports[0].Error != "" {
+		t.Fatal("unexpected report", reports)
+	}
+	var recipients []string
+	rows, err := db.Query("SELECT recipient FROM mail ORDER BY mail_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var r string
+		_ = rows.Scan(&r)
+		recipients = append(recipients, r)
+	}
+	_ = rows.Close()
+	if strings.Join(recipients, ",") != "b@example.com,c@keep.com" {
+		t.Error("expected the expired row to be deleted, got", recipients)
+	}
+	if err := s.vacuum(db); err != nil {
+		t.Error("vacuum:", err)
+	}
+}
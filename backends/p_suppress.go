@@ -0,0 +1,187 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: suppress
+// ----------------------------------------------------------------------------------
+// Description   : Adds the recipients that a delivery status notification (RFC 3464)
+//               : reports as permanently failed, and the recipients that complained in
+//               : an abuse report (RFC 5965), to the Suppressions list of the tenant.
+//               : Place it in the bounce_process chain, and in save_process if abuse
+//               : reports are received from feedback loops. The recipients that a DSN
+//               : reports as failed are also recorded as bounced for the original
+//               : message, found by the Message-Id of the headers that the DSN returns
+// ----------------------------------------------------------------------------------
+// Config Options: none, the list is configured by the suppression_* options
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.Tenant
+// ----------------------------------------------------------------------------------
+// Output        : the bounced delivery states, when delivery_tracking_size is set
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["suppress"] = func() Decorator {
+		return Suppress()
+	}
+}
+
+func Suppress() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				for _, s := range reportedSuppressions(e.Data.Bytes()) {
+					s.Tenant = e.Tenant
+					if err := Suppressions.Add(s); err != nil {
+						Log().WithError(err).Error("could not add to the suppression list")
+						break
+					}
+					Log().Infof("suppressed %s, %s: %s", s.Address, s.Reason, s.Detail)
+				}
+				if _, own := e.Values[dsnOfValue]; !own {
+					// the DSNs made by the gateway were recorded already
+					trackReportedBounces(reportedBounces(e.Data.Bytes()))
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// reportedSuppressions returns the addresses to suppress from a multipart/report message,
+// nil for other messages
+func reportedSuppressions(data []byte) []Suppression {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil
+	}
+	if params["report-type"] == "feedback-report" {
+		r, err := ParseFeedbackReport(data)
+		if err != nil || !r.Complaint() {
+			return nil
+		}
+		var list []Suppression
+		for _, rcpt := range r.OriginalRcptTo {
+			list = append(list, Suppression{Address: rcpt, Reason: SuppressionComplaint, Detail: r.FeedbackType})
+		}
+		return list
+	}
+	var list []Suppression
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType == "message/delivery-status" || partType == "message/global-delivery-status" {
+			list = append(list, failedRecipients(part)...)
+		}
+	}
+	return list
+}
+
+// failedRecipients returns the recipients of a delivery-status part that failed permanently
+func failedRecipients(r io.Reader) []Suppression {
+	var list []Suppression
+	tp := textproto.NewReader(bufio.NewReader(r))
+	// the first group of fields is about the message, the next ones each about a recipient
+	if _, err := tp.ReadMIMEHeader(); err != nil {
+		return nil
+	}
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if len(fields) > 0 && strings.EqualFold(fields.Get("Action"), "failed") &&
+			strings.HasPrefix(strings.TrimSpace(fields.Get("Status")), "5") {
+			// eg. "rfc822; user@example.com"
+			rcpt := fields.Get("Final-Recipient")
+			if i := strings.IndexByte(rcpt, ';'); i > -1 {
+				rcpt = rcpt[i+1:]
+			}
+			detail := strings.TrimSpace(fields.Get("Status"))
+			if code := fields.Get("Diagnostic-Code"); code != "" {
+				detail += " " + strings.TrimSpace(code)
+			}
+			if rcpt = trimAddress(rcpt); rcpt != "" {
+				list = append(list, Suppression{Address: rcpt, Reason: SuppressionBounce, Detail: detail})
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return list
+}
+
+// reportedBounces returns the Message-Id of the original message and the recipients that a DSN
+// reports as failed, permanently or not
+func reportedBounces(data []byte) (string, []BouncedRcpt) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		return "", nil
+	}
+	var messageId string
+	var failed []BouncedRcpt
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			tp := textproto.NewReader(bufio.NewReader(part))
+			if _, err := tp.ReadMIMEHeader(); err != nil {
+				continue
+			}
+			for {
+				fields, err := tp.ReadMIMEHeader()
+				if len(fields) > 0 && strings.EqualFold(fields.Get("Action"), "failed") {
+					rcpt := fields.Get("Final-Recipient")
+					if i := strings.IndexByte(rcpt, ';'); i > -1 {
+						rcpt = rcpt[i+1:]
+					}
+					reply := strings.TrimSpace(fields.Get("Status"))
+					if code := fields.Get("Diagnostic-Code"); code != "" {
+						reply += " " + strings.TrimSpace(code)
+					}
+					if a, err := mail.NewAddress(trimAddress(rcpt)); err == nil {
+						failed = append(failed, BouncedRcpt{Rcpt: *a, Reply: reply})
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+		case "text/rfc822-headers", "message/rfc822", "message/global", "message/global-headers":
+			// the header may end without a blank line
+			h, _ := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			messageId = strings.Trim(h.Get("Message-Id"), "<> ")
+		}
+	}
+	return messageId, failed
+}
+
+func trimAddress(addr string) string {
+	return strings.Trim(strings.TrimSpace(addr), "<>")
+}
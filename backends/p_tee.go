@@ -0,0 +1,177 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: tee
+// ----------------------------------------------------------------------------------
+// Description   : Passes a copy of each accepted envelope to another chain of
+//               : process_chains in the background, eg. to stream it to analytics
+//               : while the save chain stores it. The copy is made once the rest of
+//               : the chain accepted the envelope, and what the other chain does with
+//               : it doesn't change the reply to the client. When the queue is full,
+//               : the copy is dropped
+// ----------------------------------------------------------------------------------
+// Config Options: tee_chain string - the name of the chain in process_chains. Required
+//               : tee_queue_size int - how many copies may wait for the chain,
+//               : default 100
+//               : tee_workers int - how many copies are processed at once, default 1
+// --------------:-------------------------------------------------------------------
+// Input         : envelope
+// ----------------------------------------------------------------------------------
+// Output        : none, the copy has e.Values["tee"] set to the chain's name, and isn't
+//               : passed on by a tee of the other chain
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["tee"] = func() Decorator {
+		return Tee()
+	}
+}
+
+type TeeProcessorConfig struct {
+	Chain     string `json:"tee_chain"`
+	QueueSize int    `json:"tee_queue_size,omitempty"`
+	Workers   int    `json:"tee_workers,omitempty"`
+}
+
+const (
+	defaultTeeQueueSize = 100
+	defaultTeeWorkers   = 1
+)
+
+// teeValue is the key of e.Values that marks the copies
+const teeValue = "tee"
+
+// teeQueue passes the copies to the chain, it's shared between the workers
+type teeQueue struct {
+	chain  string
+	gw     *BackendGateway
+	copies chan *mail.Envelope
+	stop   chan struct{}
+	users  int
+}
+
+var (
+	teeQueuesGuard sync.Mutex
+	// the queues of the processors, by their config
+	teeQueues = make(map[string]*teeQueue)
+)
+
+// useTeeQueue returns the queue for the config, starting it if it's the first user
+func useTeeQueue(config *TeeProcessorConfig) (*teeQueue, error) {
+	config.Chain = strings.ToLower(strings.TrimSpace(config.Chain))
+	if config.Chain == "" {
+		return nil, errors.New("tee_chain is required")
+	}
+	gw, _ := Svc.gateway.Load().(*BackendGateway)
+	if gw == nil || !gw.hasChain(config.Chain) {
+		return nil, fmt.Errorf("tee_chain %q is not in process_chains", config.Chain)
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultTeeQueueSize
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultTeeWorkers
+	}
+	key := fmt.Sprintf("%+v", *config)
+	teeQueuesGuard.Lock()
+	defer teeQueuesGuard.Unlock()
+	if q, ok := teeQueues[key]; ok && q.gw == gw {
+		q.users++
+		return q, nil
+	}
+	q := &teeQueue{
+		chain:  config.Chain,
+		gw:     gw,
+		copies: make(chan *mail.Envelope, config.QueueSize),
+		stop:   make(chan struct{}),
+		users:  1,
+	}
+	for i := 0; i < config.Workers; i++ {
+		go q.run()
+	}
+	teeQueues[key] = q
+	return q, nil
+}
+
+// release stops the queue when its last user is done with it
+func (q *teeQueue) release() {
+	teeQueuesGuard.Lock()
+	defer teeQueuesGuard.Unlock()
+	if q.users--; q.users > 0 {
+		return
+	}
+	for key, v := range teeQueues {
+		if v == q {
+			delete(teeQueues, key)
+		}
+	}
+	// the copies still waiting are dropped. The workers of the gateway have stopped,
+	// so the one being processed is left to time out
+	close(q.stop)
+}
+
+func (q *teeQueue) run() {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case e := <-q.copies:
+			result := q.gw.ProcessChain(e, q.chain)
+			if result.Code()/100 != 2 {
+				Log().Warnf("tee: chain %s did not accept the copy of %s: %s", q.chain, e.QueuedId, result)
+			}
+		}
+	}
+}
+
+// add queues a copy of the envelope, or drops it when the queue is full
+func (q *teeQueue) add(e *mail.Envelope) {
+	c := e.Clone()
+	c.Values[teeValue] = q.chain
+	select {
+	case q.copies <- c:
+	default:
+		Log().Warnf("tee: the queue of chain %s is full, the copy of %s was dropped", q.chain, e.QueuedId)
+	}
+}
+
+func Tee() Decorator {
+	var q *teeQueue
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&TeeProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		q, err = useTeeQueue(bcfg.(*TeeProcessorConfig))
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if q != nil {
+			q.release()
+			q = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			result, err := p.Process(e, task)
+			if task != TaskSaveMail || err != nil || result == nil || result.Code()/100 != 2 {
+				return result, err
+			}
+			if _, teed := e.Values[teeValue]; !teed {
+				q.add(e)
+			}
+			return result, err
+		})
+	}
+}
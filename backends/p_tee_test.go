@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+func TestTee(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	teed := make(chan *mail.Envelope, 10)
+	processors["teesink"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					teed <- e
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	processors["teefail"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				return NewResult(response.Canned.FailBackendTransaction), errors.New("failed")
+			})
+		}
+	}
+	defer delete(processors, "teesink")
+	defer delete(processors, "teefail")
+
+	start := func(config BackendConfig) *BackendGateway {
+		Svc.reset()
+		gateway := &BackendGateway{}
+		if err := gateway.Initialize(config); err != nil {
+			t.Fatal("Gateway did not init because:", err)
+		}
+		if err := gateway.Start(); err != nil {
+			t.Fatal("Gateway did not start because:", err)
+		}
+		return gateway
+	}
+	envelope := func() *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.RcptTo = []mail.Address{{User: "test", Host: "example.com"}}
+		e.Data.WriteString("Subject: hello\n\nhi\n")
+		return e
+	}
+
+	// the copy goes to the other chain, and its failure isn't the client's
+	gateway := start(BackendConfig{
+		"save_process":   "Tee|TeeSink",
+		"process_chains": []interface{}{"analytics=TeeSink|TeeFail"},
+		"tee_chain":      "Analytics",
+	})
+	e := envelope()
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expected 250, got", result)
+	}
+	if saved := <-teed; saved != e {
+		t.Error("expected the save chain to get the envelope")
+	}
+	e.ResetTransaction()
+	select {
+	case c := <-teed:
+		if c == e || c.Values["tee"] != "analytics" || c.Data.String() != "Subject: hello\n\nhi\n" {
+			t.Error("expected a copy of the envelope, got", c.Values, c.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the copy to be passed to the analytics chain")
+	}
+	_ = gateway.Shutdown()
+
+	// nothing is copied when the save chain fails
+	gateway = start(BackendConfig{
+		"save_process":   "Tee|TeeFail",
+		"process_chains": []interface{}{"analytics=TeeSink"},
+		"tee_chain":      "analytics",
+	})
+	if result := gateway.Process(envelope()); result.Code() == 250 {
+		t.Error("expected the save chain to fail, got", result)
+	}
+	select {
+	case <-teed:
+		t.Error("expected no copy of a failed envelope")
+	case <-time.After(time.Millisecond * 100):
+	}
+	_ = gateway.Shutdown()
+
+	// a tee in the other chain doesn't copy the copy
+	gateway = start(BackendConfig{
+		"save_process":   "Tee",
+		"process_chains": []interface{}{"analytics=Tee|TeeSink"},
+		"tee_chain":      "analytics",
+	})
+	if result := gateway.Process(envelope()); result.Code() != 250 {
+		t.Error("expected 250, got", result)
+	}
+	<-teed
+	select {
+	case <-teed:
+		t.Error("expected the copy to be passed on once")
+	case <-time.After(time.Millisecond * 100):
+	}
+	_ = gateway.Shutdown()
+
+	Svc.reset()
+	if err := (&BackendGateway{}).Initialize(BackendConfig{"save_process": "Tee", "tee_chain": "nosuch"}); err == nil {
+		t.Error("expected a tee_chain that isn't in process_chains to be refused")
+	}
+	if len(teeQueues) != 0 {
+		t.Error("expected the queues to be stopped, got", teeQueues)
+	}
+}
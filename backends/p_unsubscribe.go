@@ -0,0 +1,179 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/mail/rfc5321"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: unsubscribe
+// ----------------------------------------------------------------------------------
+// Description   : Adds List-Unsubscribe and List-Unsubscribe-Post (RFC 8058) headers to
+//               : the mail of authenticated clients, ie. mail relayed out, that has one
+//               : recipient and no List-Unsubscribe header. The mailto address and the
+//               : URL have a token signed with unsubscribe_secret, for the recipient and
+//               : the List-Id of the message. Mail sent back to the mailto address, and
+//               : the one-click POST of the URL, are passed to the unsubscribe handlers:
+//               : the recipient is added to the Suppressions list of the tenant, other
+//               : handlers can be added with RegisterUnsubscribeHandler
+// ----------------------------------------------------------------------------------
+// Config Options: unsubscribe_secret string - signs the tokens. Required
+//               : unsubscribe_url string - eg. "https://mail.example.com/unsubscribe", the
+//               : token is added as the token parameter. {tenant} is replaced with the
+//               : tenant. No URL is added when empty
+//               : unsubscribe_listen string - eg. "127.0.0.1:8026", serves the URL, behind
+//               : a proxy that terminates TLS. Not served when empty, see
+//               : UnsubscribeHTTPHandler to serve it elsewhere
+//               : unsubscribe_mailto_user string - the local part of the mailto address,
+//               : before +<token>. Default "unsubscribe"
+//               : unsubscribe_mailto_host string - the domain of the mailto address, it
+//               : must be received by this server. Defaults to primary_mail_host, no
+//               : mailto address is added when both are empty
+//               : unsubscribe_all bool - add the headers to the mail of all clients
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo
+//               : e.Header generated by ParseHeader() processor
+//               : e.DeliveryHeader generated by Header() processor, so place this
+//               : processor after Header
+//               : e.AuthorizedLogin
+// ----------------------------------------------------------------------------------
+// Output        : Headers appended to e.DeliveryHeader
+//               : e.Values["unsubscribe"] - the *UnsubscribeRequest of mail sent to the
+//               : mailto address
+//               : e.Tags - "unsubscribe" with the recipient
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["unsubscribe"] = func() Decorator {
+		return Unsubscribe()
+	}
+}
+
+type UnsubscribeConfig struct {
+	Secret      string `json:"unsubscribe_secret"`
+	URL         string `json:"unsubscribe_url,omitempty"`
+	Listen      string `json:"unsubscribe_listen,omitempty"`
+	MailtoUser  string `json:"unsubscribe_mailto_user,omitempty"`
+	MailtoHost  string `json:"unsubscribe_mailto_host,omitempty"`
+	All         bool   `json:"unsubscribe_all,omitempty"`
+	PrimaryHost string `json:"primary_mail_host"`
+}
+
+const defaultUnsubscribeMailtoUser = "unsubscribe"
+
+// unsubscribeHeaders returns the List-Unsubscribe headers for the tenant's recipient,
+// or an empty string if there is no mailto address or URL to add
+func (c *UnsubscribeConfig) unsubscribeHeaders(tenant, recipient, list string) string {
+	token := UnsubscribeToken([]byte(c.Secret), tenant, recipient, list)
+	var uris []string
+	// a local part that is too long would be refused
+	if local := c.MailtoUser + "+" + token; c.MailtoHost != "" && len(local) <= rfc5321.LimitLocalPart {
+		uris = append(uris, "<mailto:"+local+"@"+c.MailtoHost+">")
+	}
+	if c.URL != "" {
+		u := ForTenant(c.URL, tenant)
+		if strings.Contains(u, "?") {
+			u += "&token=" + token
+		} else {
+			u += "?token=" + token
+		}
+		uris = append(uris, "<"+u+">")
+	}
+	if len(uris) == 0 {
+		return ""
+	}
+	headers := "List-Unsubscribe: " + strings.Join(uris, ",\n\t") + "\n"
+	if c.URL != "" {
+		headers += "List-Unsubscribe-Post: List-Unsubscribe=One-Click\n"
+	}
+	return headers
+}
+
+// unsubscribeRequest returns the request of a recipient that is the mailto address
+func (c *UnsubscribeConfig) unsubscribeRequest(rcpt mail.Address) *UnsubscribeRequest {
+	prefix := strings.ToLower(c.MailtoUser) + "+"
+	user := strings.ToLower(rcpt.User)
+	if !strings.HasPrefix(user, prefix) || !strings.EqualFold(rcpt.Host, c.MailtoHost) {
+		return nil
+	}
+	r, err := ParseUnsubscribeToken([]byte(c.Secret), user[len(prefix):])
+	if err != nil {
+		Log().Warnf("unsubscribe mail to %s with an invalid token", rcpt.String())
+		return nil
+	}
+	return r
+}
+
+// listId returns the id of a List-Id header, eg. "list.example.com" for "News <list.example.com>"
+func listId(header string) string {
+	if i := strings.LastIndexByte(header, '<'); i > -1 {
+		header = header[i+1:]
+		if j := strings.IndexByte(header, '>'); j > -1 {
+			header = header[:j]
+		}
+	}
+	return strings.TrimSpace(header)
+}
+
+func Unsubscribe() Decorator {
+	var config *UnsubscribeConfig
+	var server *unsubscribeServer
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&UnsubscribeConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*UnsubscribeConfig)
+		if config.Secret == "" {
+			return fmt.Errorf("unsubscribe_secret is required by the unsubscribe processor")
+		}
+		if config.MailtoUser == "" {
+			config.MailtoUser = defaultUnsubscribeMailtoUser
+		}
+		if config.MailtoHost == "" {
+			config.MailtoHost = config.PrimaryHost
+		}
+		if config.Listen != "" {
+			if server, err = useUnsubscribeServer(config.Listen, []byte(config.Secret)); err != nil {
+				return fmt.Errorf("could not listen on unsubscribe_listen %s: %s", config.Listen, err)
+			}
+		}
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if server != nil {
+			err := server.release(config.Listen)
+			server = nil
+			return err
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				unsubscribed := false
+				for i := range e.RcptTo {
+					if r := config.unsubscribeRequest(e.RcptTo[i]); r != nil {
+						r.Method = "mailto"
+						r.Time = time.Now()
+						e.Values["unsubscribe"] = r
+						e.Tags.Add("unsubscribe", r.Recipient)
+						handleUnsubscribe(r)
+						unsubscribed = true
+					}
+				}
+				if !unsubscribed && len(e.RcptTo) == 1 && (config.All || e.AuthorizedLogin != "") &&
+					e.Header.Get("List-Unsubscribe") == "" {
+					e.DeliveryHeader += config.unsubscribeHeaders(e.Tenant, e.RcptTo[0].String(),
+						listId(e.Header.Get("List-Id")))
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
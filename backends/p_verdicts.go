@@ -0,0 +1,56 @@
+package backends
+
+import (
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: verdicts
+// ----------------------------------------------------------------------------------
+// Description   : Adds standard headers for the verdicts of scanner processors:
+//               : Authentication-Results, X-Spam-Status and X-Virus-Scanned
+// ----------------------------------------------------------------------------------
+// Config Options: authserv_id string - identifies this server in Authentication-Results,
+//               : defaults to primary_mail_host
+// --------------:-------------------------------------------------------------------
+// Input         : verdicts added with AddVerdict
+//               : e.DeliveryHeader generated by Header() processor, so place this
+//               : processor after Header
+// ----------------------------------------------------------------------------------
+// Output        : Headers appended to e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["verdicts"] = func() Decorator {
+		return Verdicts()
+	}
+}
+
+type VerdictsConfig struct {
+	AuthservID  string `json:"authserv_id,omitempty"`
+	PrimaryHost string `json:"primary_mail_host"`
+}
+
+// Verdicts adds the headers for the verdicts that were recorded in the envelope
+func Verdicts() Decorator {
+	var config *VerdictsConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&VerdictsConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*VerdictsConfig)
+		if config.AuthservID == "" {
+			config.AuthservID = config.PrimaryHost
+		}
+		return nil
+	}))
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				e.DeliveryHeader += VerdictHeaders(config.AuthservID, GetVerdicts(e))
+			}
+			return p.Process(e, task)
+		})
+	}
+}
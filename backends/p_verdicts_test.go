@@ -0,0 +1,48 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestVerdicts(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Verdicts())
+	if errs := Svc.initialize(BackendConfig{"primary_mail_host": "mx.example.com"}); errs != nil {
+		t.Fatal("initialize:", errs)
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	if e.DeliveryHeader != "Authentication-Results: mx.example.com;\n\tnone\n" {
+		t.Error("unexpected header for no verdicts:", e.DeliveryHeader)
+	}
+
+	e.ResetTransaction()
+	AddVerdict(e, Verdict{Method: "SPF", Result: "pass", Properties: []string{"smtp.mailfrom=example.org"}})
+	AddVerdict(e, Verdict{Method: "dkim", Result: "fail", Reason: "bad signature", Properties: []string{"header.d=example.org"}})
+	AddVerdict(e, Verdict{Method: VerdictSpam, Result: "yes", Score: 7.25, Required: 5, Reason: "BAYES_99"})
+	AddVerdict(e, Verdict{Method: VerdictVirus, Result: "clean", Scanner: "ClamAV"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	expect := "Authentication-Results: mx.example.com;\n" +
+		"\tspf=pass smtp.mailfrom=example.org;\n" +
+		"\tdkim=fail reason=\"bad signature\" header.d=example.org\n" +
+		"X-Spam-Status: Yes, score=7.2 required=5.0\n\ttests=BAYES_99\n" +
+		"X-Virus-Scanned: ClamAV on mx.example.com\n" +
+		"X-Virus-Status: Clean\n"
+	if e.DeliveryHeader != expect {
+		t.Error("expected headers:\n", expect, "but got:\n", e.DeliveryHeader)
+	}
+	if tags := e.Tags.String(); !strings.Contains(tags, "spf:pass") || !strings.Contains(tags, "spam:yes") {
+		t.Error("expected the verdicts to be tagged, got", tags)
+	}
+}
@@ -0,0 +1,493 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/exec"
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/go-interpreter/wagon/wasm/operators"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: wasmfilter
+// ----------------------------------------------------------------------------------
+// Description   : EXPERIMENTAL. Runs a filter compiled to WebAssembly, so that untrusted
+//               : filtering code (eg. supplied by a tenant) can run sandboxed.
+//               : The module must export a function "filter" that takes no arguments and
+//               : returns an i32: 0 to pass the email on, or a 4xx/5xx code to reject it.
+//               : It may import these functions from the "env" module, where strings
+//               : are passed as a pointer and length in the module's memory:
+//               :   header_get(name, name_len, buf, buf_len i32) i32 - copies the first
+//               :     value of a header to buf, returns its length or -1 if not present
+//               :   message_size() i32 - size of the raw message, headers included
+//               :   message_read(offset, buf, buf_len i32) i32 - copies the raw message
+//               :     from offset to buf, returns the number of bytes copied
+//               :   tag_add(key, key_len, value, value_len i32) - adds a tag
+//               :   verdict_add(method, method_len, result, result_len, reason, reason_len i32)
+//               :     - adds a verdict, see the verdicts processor
+//               :   reply_set(text, text_len i32) - text of the reply when rejecting, on
+//               :     one line and up to 200 bytes, control characters become spaces
+//               : Each email runs in a new instance of the module. Modules that grow their
+//               : memory are refused, declare enough initial memory instead.
+//               : A filter that times out can't be stopped safely, so its instance is
+//               : abandoned: it no longer sees the email, and stops at its next host
+//               : function call. A filter that never calls one keeps running, holding
+//               : a goroutine and its memory, and once wasmMaxAbandoned (8) of them
+//               : run, the filters fail with a 451 until the server is restarted
+// ----------------------------------------------------------------------------------
+// Config Options: wasm_module string - path to the .wasm module to run
+//               : wasm_tenant_modules []string - modules for tenants, as "tenant=path".
+//               :   Tenants not listed run wasm_module, if set
+//               : wasm_timeout string - how long a filter may run, default "100ms"
+//               : wasm_memory_pages int - the most memory a module may declare, in 64KiB
+//               :   pages, default 16
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header parsed by HeadersParser, e.Data, e.Tenant
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags, verdicts
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["wasmfilter"] = func() Decorator {
+		return WASMFilter()
+	}
+	Svc.AddWholeMessage("wasmfilter")
+}
+
+type WASMFilterConfig struct {
+	Module        string   `json:"wasm_module,omitempty"`
+	TenantModules []string `json:"wasm_tenant_modules,omitempty"`
+	Timeout       string   `json:"wasm_timeout,omitempty"`
+	MemoryPages   int      `json:"wasm_memory_pages,omitempty"`
+	timeout       time.Duration
+}
+
+var (
+	errWASMTimeout = errors.New("wasm: the filter timed out")
+	errWASMStuck   = errors.New("wasm: too many filters that timed out are still running")
+	errWASMBounds  = errors.New("wasm: the filter accessed memory out of bounds")
+)
+
+const (
+	wasmHostModule = "env"
+	wasmEntryPoint = "filter"
+	// wasmMaxReply is the longest reply text a filter may set, the rest is cut
+	wasmMaxReply = 200
+	// wasmMaxAbandoned is how many filters that timed out may still be running
+	wasmMaxAbandoned = 8
+)
+
+// wasmAbandoned counts the filters that timed out and are still running
+var wasmAbandoned int32
+
+// wasmCall is the state of the filter that is running, used by the host functions.
+// The host functions hold the lock, so that the filter can be abandoned when it times out
+type wasmCall struct {
+	sync.Mutex
+	e         *mail.Envelope
+	reply     string
+	err       error
+	abandoned bool
+}
+
+// enter locks the call for a host function. It returns false, and stops the filter, if it
+// was abandoned
+func (c *wasmCall) enter(proc *exec.Process) bool {
+	c.Lock()
+	if c.abandoned {
+		c.Unlock()
+		proc.Terminate()
+		return false
+	}
+	return true
+}
+
+// mem returns n bytes of the module's memory at ptr, or nil and aborts the filter
+// if they are out of bounds
+func (c *wasmCall) mem(proc *exec.Process, ptr, n int32) []byte {
+	if ptr < 0 || n < 0 || int(ptr)+int(n) > proc.MemSize() {
+		c.err = errWASMBounds
+		proc.Terminate()
+		return nil
+	}
+	b := make([]byte, n)
+	_, _ = proc.ReadAt(b, int64(ptr))
+	return b
+}
+
+// write copies b to the module's memory at ptr, truncating it to n bytes.
+// Returns the number of bytes written
+func (c *wasmCall) write(proc *exec.Process, b []byte, ptr, n int32) int32 {
+	if c.mem(proc, ptr, n) == nil {
+		return 0
+	}
+	if len(b) > int(n) {
+		b = b[:n]
+	}
+	_, _ = proc.WriteAt(b, int64(ptr))
+	return int32(len(b))
+}
+
+// wasmHostFunc is a host function of the "env" module
+type wasmHostFunc struct {
+	name string
+	f    interface{}
+}
+
+// wasmHostFuncs returns the host functions, which operate on the call
+func wasmHostFuncs(c *wasmCall) []wasmHostFunc {
+	return []wasmHostFunc{
+		{"header_get", func(proc *exec.Process, name, nameLen, buf, bufLen int32) int32 {
+			if !c.enter(proc) {
+				return -1
+			}
+			defer c.Unlock()
+			key := c.mem(proc, name, nameLen)
+			if key == nil || !c.e.HeaderIndex.Has(string(key)) {
+				return -1
+			}
+			value := c.e.Header.Get(string(key))
+			c.write(proc, []byte(value), buf, bufLen)
+			return int32(len(value))
+		}},
+		{"message_size", func(proc *exec.Process) int32 {
+			if !c.enter(proc) {
+				return 0
+			}
+			defer c.Unlock()
+			return int32(c.e.Data.Len())
+		}},
+		{"message_read", func(proc *exec.Process, offset, buf, bufLen int32) int32 {
+			if !c.enter(proc) {
+				return 0
+			}
+			defer c.Unlock()
+			data := c.e.Data.Bytes()
+			if offset < 0 || int(offset) > len(data) {
+				return 0
+			}
+			return c.write(proc, data[offset:], buf, bufLen)
+		}},
+		{"tag_add", func(proc *exec.Process, key, keyLen, value, valueLen int32) {
+			if !c.enter(proc) {
+				return
+			}
+			defer c.Unlock()
+			k, v := c.mem(proc, key, keyLen), c.mem(proc, value, valueLen)
+			if k != nil && v != nil {
+				c.e.Tags.Add(string(k), string(v))
+			}
+		}},
+		{"verdict_add", func(proc *exec.Process, method, methodLen, result, resultLen, reason, reasonLen int32) {
+			if !c.enter(proc) {
+				return
+			}
+			defer c.Unlock()
+			m, r, why := c.mem(proc, method, methodLen), c.mem(proc, result, resultLen), c.mem(proc, reason, reasonLen)
+			if m != nil && r != nil && why != nil {
+				AddVerdict(c.e, Verdict{Method: string(m), Result: string(r), Reason: string(why)})
+			}
+		}},
+		{"reply_set", func(proc *exec.Process, text, textLen int32) {
+			if !c.enter(proc) {
+				return
+			}
+			defer c.Unlock()
+			if t := c.mem(proc, text, textLen); t != nil {
+				c.reply = wasmReplyText(string(t))
+			}
+		}},
+	}
+}
+
+// wasmHost builds the "env" module with the host functions
+func wasmHost(funcs []wasmHostFunc) *wasm.Module {
+	m := wasm.NewModule()
+	m.Types = &wasm.SectionTypes{Entries: make([]wasm.FunctionSig, len(funcs))}
+	m.FunctionIndexSpace = make([]wasm.Function, len(funcs))
+	m.Export = &wasm.SectionExports{Entries: make(map[string]wasm.ExportEntry, len(funcs))}
+	for i, fn := range funcs {
+		t := reflect.TypeOf(fn.f)
+		sig := wasm.FunctionSig{Form: 0x60}
+		// the first argument is the *exec.Process
+		for j := 1; j < t.NumIn(); j++ {
+			sig.ParamTypes = append(sig.ParamTypes, wasm.ValueTypeI32)
+		}
+		if t.NumOut() > 0 {
+			sig.ReturnTypes = []wasm.ValueType{wasm.ValueTypeI32}
+		}
+		m.Types.Entries[i] = sig
+		m.FunctionIndexSpace[i] = wasm.Function{
+			Sig:  &m.Types.Entries[i],
+			Host: reflect.ValueOf(fn.f),
+			Body: &wasm.FunctionBody{},
+		}
+		m.Export.Entries[fn.name] = wasm.ExportEntry{FieldStr: fn.name, Kind: wasm.ExternalFunction, Index: uint32(i)}
+	}
+	return m
+}
+
+// wasmFilter is a compiled module. Its host functions are bound to a new call for each run
+type wasmFilter struct {
+	module *wasm.Module
+	entry  int64
+	// hosts are the names of the host functions, by their index in the module
+	hosts map[int]string
+}
+
+// compileWASM reads the module and checks that it can be run safely
+func compileWASM(code []byte, maxPages int) (*wasmFilter, error) {
+	f := &wasmFilter{hosts: make(map[int]string)}
+	funcs := wasmHostFuncs(&wasmCall{})
+	m, err := wasm.ReadModule(bytes.NewReader(code), func(name string) (*wasm.Module, error) {
+		if name != wasmHostModule {
+			return nil, fmt.Errorf("wasm: unknown module %s, only %s can be imported", name, wasmHostModule)
+		}
+		return wasmHost(funcs), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m.Import != nil {
+		// the imported functions come first, in the order of the imports
+		i := 0
+		for _, entry := range m.Import.Entries {
+			if _, ok := entry.Type.(wasm.FuncImport); ok {
+				f.hosts[i] = entry.FieldName
+				i++
+			}
+		}
+	}
+	if m.Memory != nil {
+		for _, entry := range m.Memory.Entries {
+			if entry.Limits.Initial > uint32(maxPages) {
+				return nil, fmt.Errorf("wasm: the module needs %d pages of memory, at most %d are allowed",
+					entry.Limits.Initial, maxPages)
+			}
+		}
+	}
+	for _, fn := range m.FunctionIndexSpace {
+		if fn.IsHost() || fn.Body == nil {
+			continue
+		}
+		instr, err := disasm.Disassemble(fn.Body.Code)
+		if err != nil {
+			return nil, err
+		}
+		for _, in := range instr {
+			if in.Op.Code == operators.GrowMemory {
+				return nil, errors.New("wasm: the module grows its memory, which is not allowed")
+			}
+		}
+	}
+	var export wasm.ExportEntry
+	ok := false
+	if m.Export != nil {
+		export, ok = m.Export.Entries[wasmEntryPoint]
+	}
+	if !ok || export.Kind != wasm.ExternalFunction {
+		return nil, fmt.Errorf("wasm: the module does not export the %s function", wasmEntryPoint)
+	}
+	sig := m.FunctionIndexSpace[export.Index].Sig
+	if len(sig.ParamTypes) != 0 || len(sig.ReturnTypes) != 1 || sig.ReturnTypes[0] != wasm.ValueTypeI32 {
+		return nil, fmt.Errorf("wasm: %s must take no arguments and return an i32", wasmEntryPoint)
+	}
+	f.module = m
+	f.entry = int64(export.Index)
+	return f, nil
+}
+
+// instance returns a copy of the module with its host functions bound to the call
+func (f *wasmFilter) instance(c *wasmCall) *wasm.Module {
+	funcs := make(map[string]interface{})
+	for _, host := range wasmHostFuncs(c) {
+		funcs[host.name] = host.f
+	}
+	m := *f.module
+	m.FunctionIndexSpace = append([]wasm.Function(nil), f.module.FunctionIndexSpace...)
+	for i, name := range f.hosts {
+		m.FunctionIndexSpace[i].Host = reflect.ValueOf(funcs[name])
+	}
+	return &m
+}
+
+// run executes the filter on a new instance of the module, returning the code that the filter returned.
+// When it times out, the instance is abandoned, as the interpreter can't be stopped from another goroutine
+func (f *wasmFilter) run(e *mail.Envelope, timeout time.Duration) (int, string, error) {
+	if atomic.LoadInt32(&wasmAbandoned) >= wasmMaxAbandoned {
+		return 0, "", errWASMStuck
+	}
+	call := &wasmCall{e: e}
+	vm, err := exec.NewVM(f.instance(call))
+	if err != nil {
+		return 0, "", err
+	}
+	vm.RecoverPanic = true
+	type returned struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan returned, 1)
+	go func() {
+		value, err := vm.ExecCode(f.entry)
+		done <- returned{value, err}
+	}()
+	var ret returned
+	select {
+	case ret = <-done:
+	case <-time.After(timeout):
+		call.Lock()
+		call.abandoned = true
+		call.Unlock()
+		atomic.AddInt32(&wasmAbandoned, 1)
+		go func() {
+			<-done
+			atomic.AddInt32(&wasmAbandoned, -1)
+		}()
+		return 0, "", errWASMTimeout
+	}
+	if call.err != nil {
+		return 0, "", call.err
+	}
+	if ret.err != nil {
+		return 0, "", ret.err
+	}
+	code, _ := ret.value.(uint32)
+	return int(int32(code)), call.reply, nil
+}
+
+// wasmReplyText makes the reply text set by a filter safe to send: it's on one line, without
+// control characters which could inject other replies, and at most wasmMaxReply long
+func wasmReplyText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, text)
+	if len(text) > wasmMaxReply {
+		// cut at the start of a character
+		end := 0
+		for i := range text {
+			if i > wasmMaxReply {
+				break
+			}
+			end = i
+		}
+		text = text[:end]
+	}
+	return strings.TrimSpace(text)
+}
+
+// wasmResult converts the code returned by a filter to a result, nil to pass the email on
+func wasmResult(code int, reply string) (Result, error) {
+	if code == 0 {
+		return nil, nil
+	}
+	reply = wasmReplyText(reply)
+	if reply == "" {
+		reply = "Error: rejected by the filter"
+	}
+	var err error
+	switch {
+	case code >= 400 && code < 500:
+		err = fmt.Errorf("wasm: filter rejected the email with %d %s", code, reply)
+		return NewResult(fmt.Sprintf("%d 4.7.1 %s", code, reply)), err
+	case code >= 500 && code < 600:
+		err = fmt.Errorf("wasm: filter rejected the email with %d %s", code, reply)
+		return NewResult(fmt.Sprintf("%d 5.7.1 %s", code, reply)), err
+	}
+	err = fmt.Errorf("wasm: the filter returned %d, expected 0 or a 4xx/5xx code", code)
+	return NewResult("451 4.3.0 Error: ", err), err
+}
+
+// WASMFilter runs a WebAssembly filter for the email's tenant
+func WASMFilter() Decorator {
+	var config *WASMFilterConfig
+	// modules holds the code of the modules, keyed by tenant. The default module has the key ""
+	modules := make(map[string][]byte)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&WASMFilterConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*WASMFilterConfig)
+		if config.Timeout == "" {
+			config.Timeout = "100ms"
+		}
+		if config.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return err
+		}
+		if config.MemoryPages <= 0 {
+			config.MemoryPages = 16
+		}
+		paths := make(map[string]string)
+		if config.Module != "" {
+			paths[""] = config.Module
+		}
+		for _, tm := range config.TenantModules {
+			i := strings.Index(tm, "=")
+			if i < 1 {
+				return fmt.Errorf("wasm: invalid wasm_tenant_modules entry [%s], expecting tenant=path", tm)
+			}
+			paths[strings.TrimSpace(tm[:i])] = strings.TrimSpace(tm[i+1:])
+		}
+		for tenant, path := range paths {
+			code, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			// compile it once to check it, so a bad module is reported on startup
+			if _, err = compileWASM(code, config.MemoryPages); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			modules[tenant] = code
+		}
+		Log().Warn("the wasmfilter processor is experimental")
+		return nil
+	}))
+	return func(p Processor) Processor {
+		// the compiled modules of this worker, keyed by tenant
+		filters := make(map[string]*wasmFilter)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			tenant := e.Tenant
+			if _, ok := modules[tenant]; !ok {
+				tenant = ""
+			}
+			module, ok := modules[tenant]
+			if !ok {
+				return p.Process(e, task)
+			}
+			f, ok := filters[tenant]
+			if !ok {
+				var err error
+				if f, err = compileWASM(module, config.MemoryPages); err != nil {
+					return NewResult("451 4.3.0 Error: ", err), err
+				}
+				filters[tenant] = f
+			}
+			code, reply, err := f.run(e, config.timeout)
+			if err != nil {
+				Log().WithError(err).WithField("tenant", e.Tenant).Error("wasm filter failed")
+				return NewResult("451 4.3.0 Error: ", err), err
+			}
+			if result, err := wasmResult(code, reply); result != nil {
+				return result, err
+			}
+			return p.Process(e, task)
+		})
+	}
+}
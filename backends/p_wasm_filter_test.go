@@ -0,0 +1,285 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// the binary encoding of WebAssembly modules, just enough to write the test modules
+
+func wasmU32(n uint32) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func wasmI32Const(n int32) []byte {
+	b := []byte{0x41}
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmString(s string) []byte {
+	return append(wasmU32(uint32(len(s))), s...)
+}
+
+func wasmVec(items ...[]byte) []byte {
+	b := wasmU32(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func wasmSection(id byte, content []byte) []byte {
+	return append(append([]byte{id}, wasmU32(uint32(len(content)))...), content...)
+}
+
+func wasmFuncType(params, results int) []byte {
+	b := []byte{0x60}
+	b = append(b, wasmU32(uint32(params))...)
+	for i := 0; i < params; i++ {
+		b = append(b, 0x7f)
+	}
+	b = append(b, wasmU32(uint32(results))...)
+	for i := 0; i < results; i++ {
+		b = append(b, 0x7f)
+	}
+	return b
+}
+
+func wasmCode(instr ...[]byte) []byte {
+	var b []byte
+	for _, in := range instr {
+		b = append(b, in...)
+	}
+	return b
+}
+
+// testWASMModule builds a module with the types, imports of "env" (name and type index),
+// one exported "filter" function of type filterType, a page of memory and a data segment at 0
+func testWASMModule(types [][]byte, imports map[string]int, filterType int, body []byte, data string) []byte {
+	m := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	m = append(m, wasmSection(1, wasmVec(types...))...)
+	// imports are sorted by their function index
+	names := make([]string, len(imports))
+	for name, i := range imports {
+		names[i] = name
+	}
+	var entries [][]byte
+	for _, name := range names {
+		entries = append(entries, wasmCode(wasmString("env"), wasmString(name), []byte{0x00}, wasmU32(uint32(imports[name]))))
+	}
+	m = append(m, wasmSection(2, wasmVec(entries...))...)
+	m = append(m, wasmSection(3, wasmVec(wasmU32(uint32(filterType))))...)
+	m = append(m, wasmSection(5, wasmVec([]byte{0x00, 0x01}))...)
+	m = append(m, wasmSection(7, wasmVec(wasmCode(wasmString("filter"), []byte{0x00}, wasmU32(uint32(len(imports))))))...)
+	// no locals
+	fn := append([]byte{0x00}, body...)
+	m = append(m, wasmSection(10, wasmVec(append(wasmU32(uint32(len(fn))), fn...)))...)
+	if data != "" {
+		m = append(m, wasmSection(11, wasmVec(wasmCode([]byte{0x00}, wasmI32Const(0), []byte{0x0b}, wasmString(data))))...)
+	}
+	return m
+}
+
+// wasmTestCall calls the function with the index, after pushing the i32 arguments
+func wasmTestCall(index uint32, args ...int32) []byte {
+	var b []byte
+	for _, a := range args {
+		b = append(b, wasmI32Const(a)...)
+	}
+	return append(append(b, 0x10), wasmU32(index)...)
+}
+
+// the filter rejects emails with a subject starting with S, else tags the email and adds a verdict
+var testWASMFilter = testWASMModule(
+	[][]byte{wasmFuncType(4, 1), wasmFuncType(4, 0), wasmFuncType(6, 0), wasmFuncType(2, 0), wasmFuncType(0, 1)},
+	map[string]int{"header_get": 0, "tag_add": 1, "verdict_add": 2, "reply_set": 3},
+	4,
+	wasmCode(
+		wasmTestCall(0, 0, 7, 64, 64),
+		wasmI32Const(0), []byte{0x4a}, // i32.gt_s
+		[]byte{0x04, 0x40},                         // if
+		wasmI32Const(64), []byte{0x2d, 0x00, 0x00}, // i32.load8_u
+		wasmI32Const('S'), []byte{0x46}, // i32.eq
+		[]byte{0x04, 0x40}, // if
+		wasmTestCall(3, 26, 7),
+		wasmI32Const(554), []byte{0x0f}, // return
+		[]byte{0x0b, 0x0b}, // end end
+		wasmTestCall(1, 8, 4, 12, 7),
+		wasmTestCall(2, 20, 4, 24, 2, 0, 0),
+		wasmI32Const(0), []byte{0x0b},
+	),
+	"Subject\x00wasmchecked\x00spamnogo away",
+)
+
+// the filter never returns, but calls a host function in its loop, so it stops once abandoned
+var testWASMLoop = testWASMModule(
+	[][]byte{wasmFuncType(0, 1)}, map[string]int{"message_size": 0}, 0,
+	wasmCode([]byte{0x03, 0x40}, wasmTestCall(0), []byte{0x1a, 0x0c, 0x00, 0x0b}, wasmI32Const(0), []byte{0x0b}), "")
+
+// the filter grows its memory
+var testWASMGrow = testWASMModule(
+	[][]byte{wasmFuncType(0, 1)}, nil, 0,
+	wasmCode(wasmI32Const(1), []byte{0x40, 0x00, 0x1a}, wasmI32Const(0), []byte{0x0b}), "")
+
+// the filter reads out of bounds
+var testWASMBounds = testWASMModule(
+	[][]byte{wasmFuncType(2, 0), wasmFuncType(0, 1)},
+	map[string]int{"reply_set": 0}, 1,
+	wasmCode(wasmTestCall(0, 65530, 100), wasmI32Const(0), []byte{0x0b}), "")
+
+func TestWASMFilter(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	write := func(name string, code []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, code, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	config := BackendConfig{
+		"wasm_module": write("filter.wasm", testWASMFilter),
+		"wasm_tenant_modules": []interface{}{
+			"slow=" + write("loop.wasm", testWASMLoop),
+			"bad=" + write("bounds.wasm", testWASMBounds),
+		},
+		"wasm_timeout": "50ms",
+	}
+
+	tests := []struct {
+		name    string
+		tenant  string
+		subject string
+		code    int
+		tagged  bool
+	}{
+		{"passed", "", "hello", 200, true},
+		{"rejected", "", "Spam", 554, false},
+		{"no subject", "other", "", 200, true},
+		{"timed out", "slow", "hello", 451, false},
+		{"out of bounds", "bad", "hello", 451, false},
+	}
+	h, err := NewProcessorHarness(config, WASMFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		data := "\n\nhello\n"
+		if tt.subject != "" {
+			data = "Subject: " + tt.subject + data
+		}
+		e, err := h.Envelope("sender@example.com", data, "rcpt@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Tenant = tt.tenant
+		result, err := h.Save(e)
+		if result.Code() != tt.code {
+			t.Error(tt.name, "expected", tt.code, "but got", result, err)
+		}
+		if tt.code == 554 && !strings.Contains(result.String(), "go away") {
+			t.Error(tt.name, "expected the filter's reply, got", result)
+		}
+		if e.Tags.Has("wasm") != tt.tagged {
+			t.Error(tt.name, "unexpected tags", e.Tags)
+		}
+		if tt.tagged && (len(GetVerdicts(e)) != 1 || GetVerdicts(e)[0].Method != VerdictSpam) {
+			t.Error(tt.name, "expected a spam verdict, got", GetVerdicts(e))
+		}
+	}
+	if err := h.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	// the filter that timed out stopped at its next host function call
+	for i := 0; atomic.LoadInt32(&wasmAbandoned) > 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the abandoned filter to stop")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// too many abandoned filters
+	f, err := compileWASM(testWASMFilter, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&wasmAbandoned, wasmMaxAbandoned)
+	if _, _, err := f.run(mail.NewEnvelope("127.0.0.1", 1), time.Second); err != errWASMStuck {
+		t.Error("expected the filter not to run, got", err)
+	}
+	atomic.StoreInt32(&wasmAbandoned, 0)
+
+	// modules that grow their memory or need too much of it are refused
+	for _, c := range []BackendConfig{
+		{"wasm_module": write("grow.wasm", testWASMGrow)},
+		{"wasm_module": write("junk.wasm", []byte("not wasm"))},
+	} {
+		if _, err := NewProcessorHarness(c, WASMFilter); err == nil {
+			t.Error("expected", c["wasm_module"], "to be refused")
+		}
+	}
+	_ = Svc.shutdown()
+	if _, err := compileWASM(testWASMFilter, 0); err == nil {
+		t.Error("expected a module that needs more memory than allowed to be refused")
+	}
+}
+
+func TestWASMResult(t *testing.T) {
+	for code, expect := range map[int]string{
+		0:   "",
+		451: "451 4.7.1 Error: rejected by the filter",
+		550: "550 5.7.1 Error: rejected by the filter",
+		42:  "451 4.3.0 Error: wasm: the filter returned 42, expected 0 or a 4xx/5xx code",
+	} {
+		result, _ := wasmResult(code, "")
+		if expect == "" && result != nil {
+			t.Error(code, "expected no result, got", result)
+		} else if expect != "" && (result == nil || result.String() != expect) {
+			t.Error(code, "expected", expect, "got", result)
+		}
+	}
+}
+
+func TestWASMReplyText(t *testing.T) {
+	result, _ := wasmResult(550, "Go away\r\n250 2.0.0 OK\x00")
+	if result == nil || result.String() != "550 5.7.1 Go away  250 2.0.0 OK" {
+		t.Error("expected the control characters to be replaced, got", result)
+	}
+	long := wasmReplyText(strings.Repeat("é", wasmMaxReply))
+	if len(long) != wasmMaxReply || !utf8.ValidString(long) {
+		t.Error("expected the reply to be cut to", wasmMaxReply, "bytes, got", len(long))
+	}
+}
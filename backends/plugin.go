@@ -0,0 +1,41 @@
+package backends
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// PluginSymbol is the name of the function that a processor plugin must export.
+// Its signature must be func() map[string]backends.ProcessorConstructor, returning the
+// constructors keyed by the names to use in save_process and validate_process, eg.
+//
+//	package main
+//
+//	func Processors() map[string]backends.ProcessorConstructor {
+//		return map[string]backends.ProcessorConstructor{"MyProcessor": MyProcessor}
+//	}
+//
+// Build it with go build -buildmode=plugin, using the same version of Go and go-guerrilla as the daemon
+const PluginSymbol = "Processors"
+
+// LoadPlugin opens a processor plugin (.so file) and adds its processors.
+// A plugin stays loaded until the program exits, opening it again is harmless
+func LoadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not load processor plugin %s: %s", path, err)
+	}
+	sym, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return fmt.Errorf("could not load processor plugin %s: %s", path, err)
+	}
+	f, ok := sym.(func() map[string]ProcessorConstructor)
+	if !ok {
+		return fmt.Errorf("could not load processor plugin %s: %s has the wrong type %T", path, PluginSymbol, sym)
+	}
+	for name, c := range f() {
+		Svc.AddProcessor(name, c)
+		Log().Infof("added processor [%s] from plugin %s", name, path)
+	}
+	return nil
+}
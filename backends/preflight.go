@@ -0,0 +1,100 @@
+package backends
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// PreflightHeader marks the test message of a preflight, so that the processors and the
+// systems that receive the mail can tell it apart
+const PreflightHeader = "X-Guerrilla-Preflight"
+
+// PreflightCheck is the outcome of checking a component before serving mail
+type PreflightCheck struct {
+	// Component is what was checked, eg. "processor sql"
+	Component string
+	// Err is nil when the check passed
+	Err error
+}
+
+// PreflightProcessors initializes each processor of the save, validate and bounce processes and
+// the process chains on its own, then shuts it down, so that the failures are reported for each
+// processor. It uses the initializers of the service, so it must not run while a backend is running
+func PreflightProcessors(backendConfig BackendConfig) []PreflightCheck {
+	bcfg, err := Svc.ExtractConfig(backendConfig, &GatewayConfig{})
+	if err != nil {
+		return []PreflightCheck{{Component: "backend config", Err: err}}
+	}
+	gwConfig := bcfg.(*GatewayConfig)
+	var checks []PreflightCheck
+	for _, path := range gwConfig.Plugins {
+		checks = append(checks, PreflightCheck{Component: "plugin " + path, Err: LoadPlugin(path)})
+	}
+	chains, err := parseChains(gwConfig.Chains)
+	if err != nil {
+		return append(checks, PreflightCheck{Component: "process_chains", Err: err})
+	}
+	stacks := []string{gwConfig.SaveProcess, gwConfig.ValidateProcess, gwConfig.BounceProcess}
+	names := make([]string, 0, len(chains))
+	for name := range chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stacks = append(stacks, chains[name])
+	}
+	seen := make(map[string]bool)
+	for _, stack := range stacks {
+		for _, name := range strings.Split(strings.ToLower(stack), "|") {
+			name = strings.TrimSuffix(strings.TrimSpace(name), "?")
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			checks = append(checks, PreflightCheck{
+				Component: "processor " + name,
+				Err:       preflightProcessor(backendConfig, name),
+			})
+		}
+	}
+	return checks
+}
+
+// preflightProcessor initializes the processor, then shuts it down
+func preflightProcessor(backendConfig BackendConfig, name string) error {
+	makeFunc, ok := processors[name]
+	if !ok {
+		return fmt.Errorf("processor [%s] not found", name)
+	}
+	Svc.reset()
+	defer Svc.reset()
+	makeFunc()
+	Svc.scopeInitializers(0, name)
+	if errs := Svc.initialize(backendConfig); errs != nil {
+		_ = Svc.shutdown()
+		return errs
+	}
+	if errs := Svc.shutdown(); errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// NewPreflightEnvelope returns a test message from the sender to the recipient. It has the
+// PreflightHeader, the "preflight" tag and e.Values["preflight"] set to true
+func NewPreflightEnvelope(from, to mail.Address) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 0)
+	e.Helo = "preflight"
+	e.MailFrom = from
+	e.RcptTo = []mail.Address{to}
+	e.Values["preflight"] = true
+	e.Tags.Add("preflight", "")
+	_, _ = fmt.Fprintf(&e.Data, "%s: yes\nFrom: <%s>\nTo: <%s>\n"+
+		"Subject: guerrillad preflight\nMessage-Id: <preflight.%s@%s>\n\n"+
+		"This is a test message sent by guerrillad preflight, it can be discarded.\n",
+		PreflightHeader, from.String(), to.String(), e.QueuedId, from.Host)
+	return e
+}
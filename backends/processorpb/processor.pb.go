@@ -0,0 +1,437 @@
+// The service implemented by external processors, called by the grpc processor, see p_grpc.go.
+// Generate a server for it in any language with protoc, eg.
+//
+//   python -m grpc_tools.protoc -I. --python_out=. --grpc_python_out=. processor.proto
+//
+// The Go stubs in processorpb, which Go services can import, are generated in this directory with
+//
+//   protoc --go_out=. --go_opt=module=github.com/artpar/go-guerrilla/backends \
+//     --go-grpc_out=. --go-grpc_opt=module=github.com/artpar/go-guerrilla/backends processor.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: processor.proto
+
+package processorpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Envelope struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	QueuedId string                 `protobuf:"bytes,1,opt,name=queued_id,json=queuedId,proto3" json:"queued_id,omitempty"`
+	// mail_from is empty for the null sender of bounces
+	MailFrom string   `protobuf:"bytes,2,opt,name=mail_from,json=mailFrom,proto3" json:"mail_from,omitempty"`
+	RcptTo   []string `protobuf:"bytes,3,rep,name=rcpt_to,json=rcptTo,proto3" json:"rcpt_to,omitempty"`
+	RemoteIp string   `protobuf:"bytes,4,opt,name=remote_ip,json=remoteIp,proto3" json:"remote_ip,omitempty"`
+	Helo     string   `protobuf:"bytes,5,opt,name=helo,proto3" json:"helo,omitempty"`
+	Tls      bool     `protobuf:"varint,6,opt,name=tls,proto3" json:"tls,omitempty"`
+	Tenant   string   `protobuf:"bytes,7,opt,name=tenant,proto3" json:"tenant,omitempty"`
+	// subject is set when the headersparser processor runs before
+	Subject string `protobuf:"bytes,8,opt,name=subject,proto3" json:"subject,omitempty"`
+	// size of the message in bytes, with the delivery header
+	Size          uint64 `protobuf:"varint,9,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Envelope) Reset() {
+	*x = Envelope{}
+	mi := &file_processor_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Envelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Envelope) ProtoMessage() {}
+
+func (x *Envelope) ProtoReflect() protoreflect.Message {
+	mi := &file_processor_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Envelope.ProtoReflect.Descriptor instead.
+func (*Envelope) Descriptor() ([]byte, []int) {
+	return file_processor_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Envelope) GetQueuedId() string {
+	if x != nil {
+		return x.QueuedId
+	}
+	return ""
+}
+
+func (x *Envelope) GetMailFrom() string {
+	if x != nil {
+		return x.MailFrom
+	}
+	return ""
+}
+
+func (x *Envelope) GetRcptTo() []string {
+	if x != nil {
+		return x.RcptTo
+	}
+	return nil
+}
+
+func (x *Envelope) GetRemoteIp() string {
+	if x != nil {
+		return x.RemoteIp
+	}
+	return ""
+}
+
+func (x *Envelope) GetHelo() string {
+	if x != nil {
+		return x.Helo
+	}
+	return ""
+}
+
+func (x *Envelope) GetTls() bool {
+	if x != nil {
+		return x.Tls
+	}
+	return false
+}
+
+func (x *Envelope) GetTenant() string {
+	if x != nil {
+		return x.Tenant
+	}
+	return ""
+}
+
+func (x *Envelope) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *Envelope) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type ValidateRcptRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Envelope *Envelope              `protobuf:"bytes,1,opt,name=envelope,proto3" json:"envelope,omitempty"`
+	// rcpt is the recipient that was added, the last of envelope.rcpt_to
+	Rcpt          string `protobuf:"bytes,2,opt,name=rcpt,proto3" json:"rcpt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ValidateRcptRequest) Reset() {
+	*x = ValidateRcptRequest{}
+	mi := &file_processor_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ValidateRcptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValidateRcptRequest) ProtoMessage() {}
+
+func (x *ValidateRcptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_processor_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValidateRcptRequest.ProtoReflect.Descriptor instead.
+func (*ValidateRcptRequest) Descriptor() ([]byte, []int) {
+	return file_processor_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ValidateRcptRequest) GetEnvelope() *Envelope {
+	if x != nil {
+		return x.Envelope
+	}
+	return nil
+}
+
+func (x *ValidateRcptRequest) GetRcpt() string {
+	if x != nil {
+		return x.Rcpt
+	}
+	return ""
+}
+
+type SaveMailRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Part:
+	//
+	//	*SaveMailRequest_Envelope
+	//	*SaveMailRequest_Chunk
+	Part          isSaveMailRequest_Part `protobuf_oneof:"part"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SaveMailRequest) Reset() {
+	*x = SaveMailRequest{}
+	mi := &file_processor_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SaveMailRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SaveMailRequest) ProtoMessage() {}
+
+func (x *SaveMailRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_processor_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SaveMailRequest.ProtoReflect.Descriptor instead.
+func (*SaveMailRequest) Descriptor() ([]byte, []int) {
+	return file_processor_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SaveMailRequest) GetPart() isSaveMailRequest_Part {
+	if x != nil {
+		return x.Part
+	}
+	return nil
+}
+
+func (x *SaveMailRequest) GetEnvelope() *Envelope {
+	if x != nil {
+		if x, ok := x.Part.(*SaveMailRequest_Envelope); ok {
+			return x.Envelope
+		}
+	}
+	return nil
+}
+
+func (x *SaveMailRequest) GetChunk() []byte {
+	if x != nil {
+		if x, ok := x.Part.(*SaveMailRequest_Chunk); ok {
+			return x.Chunk
+		}
+	}
+	return nil
+}
+
+type isSaveMailRequest_Part interface {
+	isSaveMailRequest_Part()
+}
+
+type SaveMailRequest_Envelope struct {
+	Envelope *Envelope `protobuf:"bytes,1,opt,name=envelope,proto3,oneof"`
+}
+
+type SaveMailRequest_Chunk struct {
+	Chunk []byte `protobuf:"bytes,2,opt,name=chunk,proto3,oneof"`
+}
+
+func (*SaveMailRequest_Envelope) isSaveMailRequest_Part() {}
+
+func (*SaveMailRequest_Chunk) isSaveMailRequest_Part() {}
+
+type Reply struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// code is an SMTP code: 0 or 2xx accepts the recipient or the email, 4xx defers it and
+	// 5xx refuses it, with the message, eg. code 550 and message "5.1.1 No such user"
+	Code    int32  `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	// tags are added to the email's tags, for the processors after this one
+	Tags          map[string]string `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reply) Reset() {
+	*x = Reply{}
+	mi := &file_processor_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reply) ProtoMessage() {}
+
+func (x *Reply) ProtoReflect() protoreflect.Message {
+	mi := &file_processor_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reply.ProtoReflect.Descriptor instead.
+func (*Reply) Descriptor() ([]byte, []int) {
+	return file_processor_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Reply) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *Reply) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Reply) GetTags() map[string]string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+var File_processor_proto protoreflect.FileDescriptor
+
+const file_processor_proto_rawDesc = "" +
+	"\n" +
+	"\x0fprocessor.proto\x12\x16guerrilla.processor.v1\"\xe6\x01\n" +
+	"\bEnvelope\x12\x1b\n" +
+	"\tqueued_id\x18\x01 \x01(\tR\bqueuedId\x12\x1b\n" +
+	"\tmail_from\x18\x02 \x01(\tR\bmailFrom\x12\x17\n" +
+	"\arcpt_to\x18\x03 \x03(\tR\x06rcptTo\x12\x1b\n" +
+	"\tremote_ip\x18\x04 \x01(\tR\bremoteIp\x12\x12\n" +
+	"\x04helo\x18\x05 \x01(\tR\x04helo\x12\x10\n" +
+	"\x03tls\x18\x06 \x01(\bR\x03tls\x12\x16\n" +
+	"\x06tenant\x18\a \x01(\tR\x06tenant\x12\x18\n" +
+	"\asubject\x18\b \x01(\tR\asubject\x12\x12\n" +
+	"\x04size\x18\t \x01(\x04R\x04size\"g\n" +
+	"\x13ValidateRcptRequest\x12<\n" +
+	"\benvelope\x18\x01 \x01(\v2 .guerrilla.processor.v1.EnvelopeR\benvelope\x12\x12\n" +
+	"\x04rcpt\x18\x02 \x01(\tR\x04rcpt\"q\n" +
+	"\x0fSaveMailRequest\x12>\n" +
+	"\benvelope\x18\x01 \x01(\v2 .guerrilla.processor.v1.EnvelopeH\x00R\benvelope\x12\x16\n" +
+	"\x05chunk\x18\x02 \x01(\fH\x00R\x05chunkB\x06\n" +
+	"\x04part\"\xab\x01\n" +
+	"\x05Reply\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\x05R\x04code\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12;\n" +
+	"\x04tags\x18\x03 \x03(\v2'.guerrilla.processor.v1.Reply.TagsEntryR\x04tags\x1a7\n" +
+	"\tTagsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012\xbd\x01\n" +
+	"\tProcessor\x12Z\n" +
+	"\fValidateRcpt\x12+.guerrilla.processor.v1.ValidateRcptRequest\x1a\x1d.guerrilla.processor.v1.Reply\x12T\n" +
+	"\bSaveMail\x12'.guerrilla.processor.v1.SaveMailRequest\x1a\x1d.guerrilla.processor.v1.Reply(\x01B5Z3github.com/artpar/go-guerrilla/backends/processorpbb\x06proto3"
+
+var (
+	file_processor_proto_rawDescOnce sync.Once
+	file_processor_proto_rawDescData []byte
+)
+
+func file_processor_proto_rawDescGZIP() []byte {
+	file_processor_proto_rawDescOnce.Do(func() {
+		file_processor_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_processor_proto_rawDesc), len(file_processor_proto_rawDesc)))
+	})
+	return file_processor_proto_rawDescData
+}
+
+var file_processor_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_processor_proto_goTypes = []any{
+	(*Envelope)(nil),            // 0: guerrilla.processor.v1.Envelope
+	(*ValidateRcptRequest)(nil), // 1: guerrilla.processor.v1.ValidateRcptRequest
+	(*SaveMailRequest)(nil),     // 2: guerrilla.processor.v1.SaveMailRequest
+	(*Reply)(nil),               // 3: guerrilla.processor.v1.Reply
+	nil,                         // 4: guerrilla.processor.v1.Reply.TagsEntry
+}
+var file_processor_proto_depIdxs = []int32{
+	0, // 0: guerrilla.processor.v1.ValidateRcptRequest.envelope:type_name -> guerrilla.processor.v1.Envelope
+	0, // 1: guerrilla.processor.v1.SaveMailRequest.envelope:type_name -> guerrilla.processor.v1.Envelope
+	4, // 2: guerrilla.processor.v1.Reply.tags:type_name -> guerrilla.processor.v1.Reply.TagsEntry
+	1, // 3: guerrilla.processor.v1.Processor.ValidateRcpt:input_type -> guerrilla.processor.v1.ValidateRcptRequest
+	2, // 4: guerrilla.processor.v1.Processor.SaveMail:input_type -> guerrilla.processor.v1.SaveMailRequest
+	3, // 5: guerrilla.processor.v1.Processor.ValidateRcpt:output_type -> guerrilla.processor.v1.Reply
+	3, // 6: guerrilla.processor.v1.Processor.SaveMail:output_type -> guerrilla.processor.v1.Reply
+	5, // [5:7] is the sub-list for method output_type
+	3, // [3:5] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_processor_proto_init() }
+func file_processor_proto_init() {
+	if File_processor_proto != nil {
+		return
+	}
+	file_processor_proto_msgTypes[2].OneofWrappers = []any{
+		(*SaveMailRequest_Envelope)(nil),
+		(*SaveMailRequest_Chunk)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_processor_proto_rawDesc), len(file_processor_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_processor_proto_goTypes,
+		DependencyIndexes: file_processor_proto_depIdxs,
+		MessageInfos:      file_processor_proto_msgTypes,
+	}.Build()
+	File_processor_proto = out.File
+	file_processor_proto_goTypes = nil
+	file_processor_proto_depIdxs = nil
+}
@@ -0,0 +1,169 @@
+// The service implemented by external processors, called by the grpc processor, see p_grpc.go.
+// Generate a server for it in any language with protoc, eg.
+//
+//   python -m grpc_tools.protoc -I. --python_out=. --grpc_python_out=. processor.proto
+//
+// The Go stubs in processorpb, which Go services can import, are generated in this directory with
+//
+//   protoc --go_out=. --go_opt=module=github.com/artpar/go-guerrilla/backends \
+//     --go-grpc_out=. --go-grpc_opt=module=github.com/artpar/go-guerrilla/backends processor.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: processor.proto
+
+package processorpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Processor_ValidateRcpt_FullMethodName = "/guerrilla.processor.v1.Processor/ValidateRcpt"
+	Processor_SaveMail_FullMethodName     = "/guerrilla.processor.v1.Processor/SaveMail"
+)
+
+// ProcessorClient is the client API for Processor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProcessorClient interface {
+	// ValidateRcpt is called for each recipient when it's added, with grpc_validate_rcpt
+	ValidateRcpt(ctx context.Context, in *ValidateRcptRequest, opts ...grpc.CallOption) (*Reply, error)
+	// SaveMail is called for each email. The first request has the envelope, and the next
+	// ones have the message in chunks, in order
+	SaveMail(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SaveMailRequest, Reply], error)
+}
+
+type processorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProcessorClient(cc grpc.ClientConnInterface) ProcessorClient {
+	return &processorClient{cc}
+}
+
+func (c *processorClient) ValidateRcpt(ctx context.Context, in *ValidateRcptRequest, opts ...grpc.CallOption) (*Reply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Reply)
+	err := c.cc.Invoke(ctx, Processor_ValidateRcpt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *processorClient) SaveMail(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SaveMailRequest, Reply], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Processor_ServiceDesc.Streams[0], Processor_SaveMail_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SaveMailRequest, Reply]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Processor_SaveMailClient = grpc.ClientStreamingClient[SaveMailRequest, Reply]
+
+// ProcessorServer is the server API for Processor service.
+// All implementations must embed UnimplementedProcessorServer
+// for forward compatibility.
+type ProcessorServer interface {
+	// ValidateRcpt is called for each recipient when it's added, with grpc_validate_rcpt
+	ValidateRcpt(context.Context, *ValidateRcptRequest) (*Reply, error)
+	// SaveMail is called for each email. The first request has the envelope, and the next
+	// ones have the message in chunks, in order
+	SaveMail(grpc.ClientStreamingServer[SaveMailRequest, Reply]) error
+	mustEmbedUnimplementedProcessorServer()
+}
+
+// UnimplementedProcessorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedProcessorServer struct{}
+
+func (UnimplementedProcessorServer) ValidateRcpt(context.Context, *ValidateRcptRequest) (*Reply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ValidateRcpt not implemented")
+}
+func (UnimplementedProcessorServer) SaveMail(grpc.ClientStreamingServer[SaveMailRequest, Reply]) error {
+	return status.Errorf(codes.Unimplemented, "method SaveMail not implemented")
+}
+func (UnimplementedProcessorServer) mustEmbedUnimplementedProcessorServer() {}
+func (UnimplementedProcessorServer) testEmbeddedByValue()                   {}
+
+// UnsafeProcessorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProcessorServer will
+// result in compilation errors.
+type UnsafeProcessorServer interface {
+	mustEmbedUnimplementedProcessorServer()
+}
+
+func RegisterProcessorServer(s grpc.ServiceRegistrar, srv ProcessorServer) {
+	// If the following call pancis, it indicates UnimplementedProcessorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Processor_ServiceDesc, srv)
+}
+
+func _Processor_ValidateRcpt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidateRcptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProcessorServer).ValidateRcpt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Processor_ValidateRcpt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProcessorServer).ValidateRcpt(ctx, req.(*ValidateRcptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Processor_SaveMail_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ProcessorServer).SaveMail(&grpc.GenericServerStream[SaveMailRequest, Reply]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Processor_SaveMailServer = grpc.ClientStreamingServer[SaveMailRequest, Reply]
+
+// Processor_ServiceDesc is the grpc.ServiceDesc for Processor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Processor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "guerrilla.processor.v1.Processor",
+	HandlerType: (*ProcessorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ValidateRcpt",
+			Handler:    _Processor_ValidateRcpt_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SaveMail",
+			Handler:       _Processor_SaveMail_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "processor.proto",
+}
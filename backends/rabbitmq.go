@@ -0,0 +1,222 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// amqpChannel is the part of *amqp.Channel used to publish
+type amqpChannel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpConnection is the part of *amqp.Connection used to publish
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type amqpConn struct {
+	*amqp.Connection
+}
+
+func (c amqpConn) Channel() (amqpChannel, error) {
+	return c.Connection.Channel()
+}
+
+// amqpDial connects to the broker, it's replaced by the tests
+var amqpDial = func(url string) (amqpConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConn{conn}, nil
+}
+
+// errAMQPNack is returned when the broker could not take the message
+var errAMQPNack = errors.New("rabbitmq: the message was not acknowledged")
+
+// rabbitMQConn is the connection shared by the workers that publish to the same url.
+// It's opened again by the next publish after the broker closed it
+type rabbitMQConn struct {
+	url    string
+	conn   amqpConnection
+	closed chan *amqp.Error
+	// lastDial is when the connection was last attempted, so that a broker that is down
+	// is not dialed for every email
+	lastDial time.Time
+	users    int
+	sync.Mutex
+}
+
+var (
+	rabbitMQConnsGuard sync.Mutex
+	rabbitMQConns      = make(map[string]*rabbitMQConn)
+)
+
+// rabbitMQRedialInterval is the least time between two attempts to connect
+var rabbitMQRedialInterval = time.Second * 5
+
+// useRabbitMQConn returns the connection of the url, it's connected when a channel is opened
+func useRabbitMQConn(url string) *rabbitMQConn {
+	rabbitMQConnsGuard.Lock()
+	defer rabbitMQConnsGuard.Unlock()
+	if c, ok := rabbitMQConns[url]; ok {
+		c.users++
+		return c
+	}
+	c := &rabbitMQConn{url: url, users: 1}
+	rabbitMQConns[url] = c
+	return c
+}
+
+// release closes the connection when the last processor that used it is shut down
+func (c *rabbitMQConn) release() error {
+	rabbitMQConnsGuard.Lock()
+	c.users--
+	last := c.users == 0
+	if last {
+		delete(rabbitMQConns, c.url)
+	}
+	rabbitMQConnsGuard.Unlock()
+	if !last {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != nil {
+		err := c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// channel opens a channel, connecting first if there is no connection or it was closed
+func (c *rabbitMQConn) channel() (amqpChannel, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != nil {
+		select {
+		case err := <-c.closed:
+			Log().WithError(err).Warn("rabbitmq: the connection was closed, reconnecting")
+			c.conn = nil
+		default:
+		}
+	}
+	if c.conn == nil {
+		if time.Since(c.lastDial) < rabbitMQRedialInterval {
+			return nil, errors.New("rabbitmq: not connected, waiting to reconnect")
+		}
+		c.lastDial = time.Now()
+		conn, err := amqpDial(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.closed = conn.NotifyClose(make(chan *amqp.Error, 1))
+	}
+	ch, err := c.conn.Channel()
+	if err != nil {
+		// the connection is likely broken, dial again next time
+		_ = c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	return ch, nil
+}
+
+// rabbitMQPublisher publishes with a channel in confirm mode, for a worker. The channel is
+// opened again after an error
+type rabbitMQPublisher struct {
+	conn     *rabbitMQConn
+	config   *RabbitMQProcessorConfig
+	ch       amqpChannel
+	confirms chan amqp.Confirmation
+	closed   chan *amqp.Error
+	// the exchanges that were declared
+	declared map[string]bool
+}
+
+// open returns a channel that is ready to publish
+func (p *rabbitMQPublisher) open() error {
+	if p.ch != nil {
+		select {
+		case err := <-p.closed:
+			Log().WithError(err).Warn("rabbitmq: the channel was closed, opening another")
+			p.ch = nil
+		default:
+			return nil
+		}
+	}
+	ch, err := p.conn.channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return err
+	}
+	p.ch = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.closed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	p.declared = make(map[string]bool)
+	return nil
+}
+
+// reset closes the channel, so that a late confirm is not taken for the next message
+func (p *rabbitMQPublisher) reset() {
+	if p.ch != nil {
+		_ = p.ch.Close()
+		p.ch = nil
+	}
+}
+
+// publish sends the message and waits for the broker to confirm it
+func (p *rabbitMQPublisher) publish(exchange, key string, msg amqp.Publishing, timeout time.Duration) error {
+	if err := p.open(); err != nil {
+		return err
+	}
+	if p.config.ExchangeType != "" && !p.declared[exchange] {
+		if err := p.ch.ExchangeDeclare(exchange, p.config.ExchangeType, true, false, false, false, nil); err != nil {
+			p.reset()
+			return err
+		}
+		p.declared[exchange] = true
+	}
+	if err := p.ch.Publish(exchange, key, false, false, msg); err != nil {
+		p.reset()
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-p.confirms:
+		if !ok {
+			p.ch = nil
+			return errors.New("rabbitmq: the channel was closed before the message was confirmed")
+		}
+		if !confirm.Ack {
+			return errAMQPNack
+		}
+		return nil
+	case <-timer.C:
+		p.reset()
+		return fmt.Errorf("rabbitmq: the message was not confirmed in %s", timeout)
+	}
+}
+
+// close closes the channel of the worker
+func (p *rabbitMQPublisher) close() {
+	p.reset()
+}
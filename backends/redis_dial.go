@@ -0,0 +1,397 @@
+package backends
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisDialTimeout limits connecting to each redis, sentinel or cluster node, so that
+	// the next one is tried when one is down
+	redisDialTimeout = time.Second * 5
+	// redisClusterSlots is the number of hash slots of a Redis Cluster
+	redisClusterSlots = 16384
+	// redisClusterMaxRedirects is how many MOVED or ASK redirections a command may follow
+	redisClusterMaxRedirects = 5
+)
+
+// dialRedis connects to the redis of the config: the nodes of redis_cluster_addresses, the
+// master that the sentinels name for redis_sentinel_master, or else redis_interface
+func dialRedis(config *RedisProcessorConfig) (RedisConn, error) {
+	options := []RedisDialOption{RedisDialTimeout(redisDialTimeout)}
+	if config.RedisTLS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.RedisTLSSkipVerify}
+		if config.RedisCAFile != "" {
+			pool, err := readCAFile("redis_ca_file", config.RedisCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		options = append(options, RedisDialTLS(tlsConfig))
+	}
+	switch {
+	case len(config.RedisClusterAddresses) > 0:
+		if config.RedisDB > 0 {
+			return nil, errors.New("redis_db can't be used with a redis cluster")
+		}
+		c := &redisCluster{config: config, options: options, nodes: make(map[string]RedisConn)}
+		if err := c.refresh(); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		return c, nil
+	case config.RedisSentinelMaster != "":
+		return dialRedisSentinel(config, options)
+	}
+	return dialRedisNode(config.RedisInterface, config.RedisUsername, config.RedisPassword, config.RedisDB, options)
+}
+
+// dialRedisNode connects to addr, then sends AUTH when there's a password and SELECT for a db
+func dialRedisNode(addr, username, password string, db int, options []RedisDialOption) (RedisConn, error) {
+	conn, err := RedisDialer("tcp", addr, options...)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		args := []interface{}{password}
+		if username != "" {
+			args = []interface{}{username, password}
+		}
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("redis AUTH failed at %s: %s", addr, err)
+		}
+	}
+	if db > 0 {
+		if _, err := conn.Do("SELECT", db); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("redis SELECT %d failed at %s: %s", db, addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// dialRedisSentinel asks the sentinels in turn for the address of the master, and connects
+// to it. A master that says it's a replica is skipped, the sentinel may not know of a failover yet
+func dialRedisSentinel(config *RedisProcessorConfig, options []RedisDialOption) (RedisConn, error) {
+	err := errors.New("no redis_sentinel_addresses")
+	for _, sentinel := range config.RedisSentinelAddresses {
+		var addr string
+		if addr, err = redisSentinelMaster(config, sentinel, options); err != nil {
+			continue
+		}
+		var conn RedisConn
+		conn, err = dialRedisNode(addr, config.RedisUsername, config.RedisPassword, config.RedisDB, options)
+		if err != nil {
+			continue
+		}
+		var reply interface{}
+		if reply, err = conn.Do("ROLE"); err == nil {
+			if role, _ := reply.([]interface{}); len(role) > 0 && redisString(role[0]) == "master" {
+				return conn, nil
+			}
+			err = fmt.Errorf("%s named by %s is not a master", addr, sentinel)
+		}
+		_ = conn.Close()
+	}
+	return nil, fmt.Errorf("could not find the redis master %s: %s", config.RedisSentinelMaster, err)
+}
+
+// redisSentinelMaster returns the host:port of the master that the sentinel knows
+func redisSentinelMaster(config *RedisProcessorConfig, sentinel string, options []RedisDialOption) (string, error) {
+	conn, err := dialRedisNode(sentinel, "", config.RedisSentinelPassword, 0, options)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	reply, err := conn.Do("SENTINEL", "get-master-addr-by-name", config.RedisSentinelMaster)
+	if err != nil {
+		return "", err
+	}
+	values, _ := reply.([]interface{})
+	if len(values) != 2 {
+		return "", fmt.Errorf("the sentinel %s doesn't know the master", sentinel)
+	}
+	return net.JoinHostPort(redisString(values[0]), redisString(values[1])), nil
+}
+
+// redisString returns a string or bulk string argument or reply as a string
+func redisString(v interface{}) string {
+	switch s := v.(type) {
+	case []byte:
+		return string(s)
+	case string:
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// redisConnError returns true for the errors of a connection that can't be used any more, as
+// opposed to the error replies of redis
+func redisConnError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// redisSlot returns the hash slot of the key, CRC16 of the key or of its {hash tag}
+func redisSlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % redisClusterSlots
+}
+
+// redisSlotRange is a range of slots served by a master
+type redisSlotRange struct {
+	start, end int
+	addr       string
+}
+
+// redisCluster is a connection to the masters of a Redis Cluster. Commands go to the master of
+// the slot of their first key, following the MOVED and ASK redirections. Like other RedisConns,
+// it must not be used by several goroutines at once
+type redisCluster struct {
+	config  *RedisProcessorConfig
+	options []RedisDialOption
+	nodes   map[string]RedisConn
+	slots   []redisSlotRange
+}
+
+// node returns the connection to addr, connecting if needed
+func (c *redisCluster) node(addr string) (RedisConn, error) {
+	if conn, ok := c.nodes[addr]; ok {
+		return conn, nil
+	}
+	conn, err := dialRedisNode(addr, c.config.RedisUsername, c.config.RedisPassword, 0, c.options)
+	if err != nil {
+		return nil, err
+	}
+	c.nodes[addr] = conn
+	return conn, nil
+}
+
+// drop closes the connection to addr
+func (c *redisCluster) drop(addr string) {
+	if conn, ok := c.nodes[addr]; ok {
+		_ = conn.Close()
+		delete(c.nodes, addr)
+	}
+}
+
+// masters returns the addresses of the masters, sorted
+func (c *redisCluster) masters() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, r := range c.slots {
+		if !seen[r.addr] {
+			seen[r.addr] = true
+			addrs = append(addrs, r.addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// refresh reads the slots of the masters with CLUSTER SLOTS, from the first node that answers
+func (c *redisCluster) refresh() error {
+	var err error
+	for _, addr := range append(c.masters(), c.config.RedisClusterAddresses...) {
+		var conn RedisConn
+		if conn, err = c.node(addr); err != nil {
+			continue
+		}
+		var reply interface{}
+		if reply, err = conn.Do("CLUSTER", "SLOTS"); err == nil {
+			var slots []redisSlotRange
+			if slots, err = parseRedisClusterSlots(reply); err == nil {
+				c.slots = slots
+				return nil
+			}
+		}
+		c.drop(addr)
+	}
+	return fmt.Errorf("could not read the slots of the redis cluster: %s", err)
+}
+
+// parseRedisClusterSlots parses the reply to CLUSTER SLOTS, the start and end of each range of
+// slots, followed by its master and replicas
+func parseRedisClusterSlots(reply interface{}) ([]redisSlotRange, error) {
+	ranges, ok := reply.([]interface{})
+	if !ok || len(ranges) == 0 {
+		return nil, fmt.Errorf("unexpected reply to CLUSTER SLOTS: %v", reply)
+	}
+	slots := make([]redisSlotRange, 0, len(ranges))
+	for _, item := range ranges {
+		values, _ := item.([]interface{})
+		if len(values) < 3 {
+			return nil, fmt.Errorf("unexpected slots in the reply to CLUSTER SLOTS: %v", item)
+		}
+		master, _ := values[2].([]interface{})
+		start, _ := values[0].(int64)
+		end, _ := values[1].(int64)
+		if len(master) < 2 {
+			return nil, fmt.Errorf("unexpected master in the reply to CLUSTER SLOTS: %v", values[2])
+		}
+		addr := net.JoinHostPort(redisString(master[0]), redisString(master[1]))
+		slots = append(slots, redisSlotRange{start: int(start), end: int(end), addr: addr})
+	}
+	return slots, nil
+}
+
+// addr returns the master of the slot of the key, or any master for commands without a key
+func (c *redisCluster) addr(args []interface{}) string {
+	if len(args) == 0 {
+		if masters := c.masters(); len(masters) > 0 {
+			return masters[0]
+		}
+		return c.config.RedisClusterAddresses[0]
+	}
+	slot := redisSlot(redisString(args[0]))
+	for _, r := range c.slots {
+		if slot >= r.start && slot <= r.end {
+			return r.addr
+		}
+	}
+	return c.config.RedisClusterAddresses[0]
+}
+
+// redisRedirect returns the node that a MOVED or ASK error redirects to
+func redisRedirect(err error) (kind, addr string) {
+	fields := strings.Fields(err.Error())
+	if len(fields) == 3 && (fields[0] == "MOVED" || fields[0] == "ASK") {
+		return fields[0], fields[2]
+	}
+	return "", ""
+}
+
+func (c *redisCluster) Do(commandName string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(commandName) {
+	case "SCAN":
+		return c.scan(args)
+	case "DEL", "UNLINK", "EXISTS", "TOUCH":
+		if len(args) > 1 {
+			// the keys may be in different slots, eg. the message and its :tags
+			var n int64
+			for _, key := range args {
+				reply, err := c.Do(commandName, key)
+				if err != nil {
+					return nil, err
+				}
+				count, _ := reply.(int64)
+				n += count
+			}
+			return n, nil
+		}
+	}
+	addr := c.addr(args)
+	asking := false
+	for redirects := 0; ; redirects++ {
+		conn, err := c.node(addr)
+		if err != nil {
+			return nil, err
+		}
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.Do(commandName, args...)
+		if err == nil || redirects == redisClusterMaxRedirects {
+			return reply, err
+		}
+		kind, to := redisRedirect(err)
+		switch {
+		case kind == "MOVED":
+			// the slots were moved, eg. after a failover
+			addr, asking = to, false
+			_ = c.refresh()
+		case kind == "ASK":
+			// the slot is being migrated, only this command goes to the other node
+			addr, asking = to, true
+		case redisConnError(err):
+			c.drop(addr)
+			if c.refresh() != nil {
+				return nil, err
+			}
+			addr, asking = c.addr(args), false
+		default:
+			return reply, err
+		}
+	}
+}
+
+// scan runs SCAN on each master in turn. The cursor returned is the index of the master, a dash
+// and the cursor of that master, eg. "1-17", so the callers can iterate as with a single redis
+func (c *redisCluster) scan(args []interface{}) (interface{}, error) {
+	masters := c.masters()
+	i, cursor := 0, "0"
+	if len(args) > 0 {
+		if s := redisString(args[0]); s != "0" {
+			parts := strings.SplitN(s, "-", 2)
+			var err error
+			if i, err = strconv.Atoi(parts[0]); err != nil || len(parts) != 2 || i >= len(masters) {
+				return nil, fmt.Errorf("invalid cluster SCAN cursor %q", s)
+			}
+			cursor = parts[1]
+		}
+		args = args[1:]
+	}
+	conn, err := c.node(masters[i])
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.Do("SCAN", append([]interface{}{cursor}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	next, keys, err := redisScanReply(reply)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]interface{}, len(keys))
+	for k := range keys {
+		items[k] = []byte(keys[k])
+	}
+	if next != "0" {
+		next = strconv.Itoa(i) + "-" + next
+	} else if i+1 < len(masters) {
+		next = strconv.Itoa(i+1) + "-0"
+	}
+	return []interface{}{[]byte(next), items}, nil
+}
+
+func (c *redisCluster) Close() error {
+	var err error
+	for addr, conn := range c.nodes {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(c.nodes, addr)
+	}
+	return err
+}
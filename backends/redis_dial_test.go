@@ -0,0 +1,272 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedisNodes are redis servers by address, each command is logged as "addr CMD args"
+type fakeRedisNodes struct {
+	sync.Mutex
+	log   []string
+	nodes map[string]func(cmd string, args []interface{}) (interface{}, error)
+}
+
+type fakeRedisNodeConn struct {
+	f    *fakeRedisNodes
+	addr string
+}
+
+func (f *fakeRedisNodes) dial(network, address string, options ...RedisDialOption) (RedisConn, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.nodes[address]; !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+	return &fakeRedisNodeConn{f: f, addr: address}, nil
+}
+
+func (f *fakeRedisNodes) logged(entry string) bool {
+	f.Lock()
+	defer f.Unlock()
+	for _, l := range f.log {
+		if l == entry {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fakeRedisNodeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.f.Lock()
+	entry := c.addr + " " + cmd
+	for _, arg := range args {
+		entry += " " + redisString(arg)
+	}
+	c.f.log = append(c.f.log, entry)
+	node := c.f.nodes[c.addr]
+	c.f.Unlock()
+	if cmd == "AUTH" || cmd == "SELECT" || cmd == "ASKING" {
+		return []byte("OK"), nil
+	}
+	return node(cmd, args)
+}
+
+func (c *fakeRedisNodeConn) Close() error {
+	return nil
+}
+
+func useFakeRedisNodes() (*fakeRedisNodes, func()) {
+	f := &fakeRedisNodes{nodes: make(map[string]func(string, []interface{}) (interface{}, error))}
+	saved := RedisDialer
+	RedisDialer = f.dial
+	return f, func() {
+		RedisDialer = saved
+	}
+}
+
+func TestRedisSlot(t *testing.T) {
+	if slot := redisSlot("123456789"); slot != 12739 {
+		t.Error("expected slot 12739, got", slot)
+	}
+	if slot := redisSlot("foo"); slot != 12182 {
+		t.Error("expected slot 12182, got", slot)
+	}
+	if redisSlot("{user1000}.following") != redisSlot("user1000") || redisSlot("a{}b") == redisSlot("") {
+		t.Error("expected the hash tag to be hashed when it's not empty")
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	f, restore := useFakeRedisNodes()
+	defer restore()
+	master := "10.0.0.2"
+	sentinel := func(cmd string, args []interface{}) (interface{}, error) {
+		return []interface{}{[]byte(master), []byte("6379")}, nil
+	}
+	// s2 doesn't know of the failover, and names a replica
+	f.nodes["s2:26379"] = func(cmd string, args []interface{}) (interface{}, error) {
+		return []interface{}{[]byte("10.0.0.1"), []byte("6379")}, nil
+	}
+	f.nodes["s3:26379"] = sentinel
+	replica := func(cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "ROLE" {
+			return []interface{}{[]byte("slave")}, nil
+		}
+		return nil, errors.New("READONLY You can't write against a read only replica.")
+	}
+	f.nodes["10.0.0.1:6379"] = replica
+	f.nodes["10.0.0.2:6379"] = func(cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "ROLE" {
+			return []interface{}{[]byte("master"), int64(0), []interface{}{}}, nil
+		}
+		return []byte("OK"), nil
+	}
+	f.nodes["10.0.0.3:6379"] = f.nodes["10.0.0.2:6379"]
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":             "Hasher|Redis|Debugger",
+		"redis_sentinel_master":    "mail",
+		"redis_sentinel_addresses": []interface{}{"s1:26379", "s2:26379", "s3:26379"},
+		"redis_sentinel_password":  "spw",
+		"redis_username":           "guerrilla",
+		"redis_password":           "pw",
+		"redis_db":                 2,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be saved to the master, got", result)
+	}
+	for _, entry := range []string{"s3:26379 AUTH spw", "s3:26379 SENTINEL get-master-addr-by-name mail",
+		"10.0.0.2:6379 AUTH guerrilla pw", "10.0.0.2:6379 SELECT 2"} {
+		if !f.logged(entry) {
+			t.Error("expected", entry, "in", f.log)
+		}
+	}
+	if f.logged("10.0.0.1:6379 SET") || !strings.HasPrefix(f.log[len(f.log)-1], "10.0.0.2:6379 SET ") {
+		t.Error("expected the key to be SET on the master without a TTL, got", f.log)
+	}
+
+	// after a failover, the old master refuses the write, and the next email goes to the new one
+	f.Lock()
+	f.nodes["10.0.0.2:6379"] = replica
+	master = "10.0.0.3"
+	f.Unlock()
+	if result := backend.Process(newBrokerTestEnvelope()); strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the write to the old master to fail, got", result)
+	}
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+		t.Error("expected the email to be saved to the new master, got", result)
+	}
+	if !strings.HasPrefix(f.log[len(f.log)-1], "10.0.0.3:6379 SET ") {
+		t.Error("expected the key to be SET on the new master, got", f.log)
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	f, restore := useFakeRedisNodes()
+	defer restore()
+	// n1 has the slots up to 8191, n2 the others, and n2 hands the slot of "migrated" to n1
+	data := map[string]map[string]string{"n1:7000": {}, "n2:7001": {}}
+	moved := false
+	owner := func(key string) string {
+		if redisSlot(key) < 8192 || (moved && key == "migrated") {
+			return "n1:7000"
+		}
+		return "n2:7001"
+	}
+	node := func(addr string) func(string, []interface{}) (interface{}, error) {
+		return func(cmd string, args []interface{}) (interface{}, error) {
+			switch cmd {
+			case "CLUSTER":
+				n2 := []interface{}{int64(8192), int64(16383), []interface{}{[]byte("n2"), int64(7001)}}
+				if !moved {
+					return []interface{}{[]interface{}{int64(0), int64(8191), []interface{}{[]byte("n1"), int64(7000)}}, n2}, nil
+				}
+				slot := int64(redisSlot("migrated"))
+				return []interface{}{
+					[]interface{}{int64(0), int64(8191), []interface{}{[]byte("n1"), int64(7000)}},
+					[]interface{}{slot, slot, []interface{}{[]byte("n1"), int64(7000)}},
+					n2,
+				}, nil
+			case "SCAN":
+				var keys []interface{}
+				for key := range data[addr] {
+					keys = append(keys, []byte(key))
+				}
+				return []interface{}{[]byte("0"), keys}, nil
+			}
+			key := redisString(args[0])
+			if key == "asked" && addr == "n1:7000" {
+				return nil, errors.New("ASK 1234 n2:7001")
+			}
+			if to := owner(key); to != addr && key != "asked" {
+				return nil, fmt.Errorf("MOVED %d %s", redisSlot(key), to)
+			}
+			switch cmd {
+			case "SET":
+				data[addr][key] = redisString(args[1])
+				return []byte("OK"), nil
+			case "GET":
+				return []byte(data[addr][key]), nil
+			case "DEL":
+				if _, ok := data[addr][key]; !ok {
+					return int64(0), nil
+				}
+				delete(data[addr], key)
+				return int64(1), nil
+			}
+			return nil, fmt.Errorf("ERR unknown command %s", cmd)
+		}
+	}
+	f.nodes["n1:7000"], f.nodes["n2:7001"] = node("n1:7000"), node("n2:7001")
+
+	conn, err := dialRedis(&RedisProcessorConfig{RedisClusterAddresses: []string{"down:7002", "n2:7001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	for _, key := range []string{"foo", "bar", "migrated", "foo:tags"} {
+		if _, err := conn.Do("SET", key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// foo is in slot 12182, bar in 5061
+	if data["n2:7001"]["foo"] != "v-foo" || data["n1:7000"]["bar"] != "v-bar" {
+		t.Error("expected the keys to be set on the masters of their slots, got", data)
+	}
+	if n, err := conn.Do("DEL", "foo", "foo:tags"); err != nil || n.(int64) != 2 {
+		t.Error("expected the keys of different slots to be deleted, got", n, err)
+	}
+
+	// the slot of "migrated" was migrated to n1
+	moved = true
+	data["n1:7000"]["migrated"] = data["n2:7001"]["migrated"]
+	delete(data["n2:7001"], "migrated")
+	if v, err := conn.Do("GET", "migrated"); err != nil || redisString(v) != "v-migrated" {
+		t.Error("expected to follow the MOVED redirection, got", v, err)
+	}
+	if f.log[len(f.log)-1] != "n1:7000 GET migrated" || f.log[len(f.log)-2] != "n1:7000 CLUSTER SLOTS" {
+		t.Error("expected the slots to be read again, got", f.log)
+	}
+	// "asked" is in a slot of n1, that is being migrated to n2
+	if _, err := conn.Do("SET", "asked", "v"); err != nil || data["n2:7001"]["asked"] != "v" {
+		t.Error("expected to follow the ASK redirection, got", err)
+	}
+	if f.log[len(f.log)-2] != "n2:7001 ASKING" {
+		t.Error("expected ASKING before the command, got", f.log)
+	}
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := conn.Do("SCAN", cursor, "MATCH", "*", "COUNT", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		if cursor, page, err = redisScanReply(reply); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, page...)
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "asked,bar,migrated" {
+		t.Error("expected to scan the keys of all the masters, got", keys)
+	}
+
+	if _, err := dialRedis(&RedisProcessorConfig{RedisClusterAddresses: []string{"down:7002"}}); err == nil {
+		t.Error("expected an error when no node answers")
+	}
+}
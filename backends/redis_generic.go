@@ -1,7 +1,7 @@
 package backends
 
 import (
-	"net"
+	"crypto/tls"
 	"time"
 )
 
@@ -28,16 +28,40 @@ func (m *RedisMockConn) Do(commandName string, args ...interface{}) (reply inter
 	return nil, nil
 }
 
-type dialOptions struct {
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	dial         func(network, addr string) (net.Conn, error)
-	db           int
-	password     string
+// RedisDialSettings are what the options ask of the RedisDialer, see NewRedisDialSettings.
+// AUTH and SELECT are sent by the backends after dialing, so drivers only need to connect
+type RedisDialSettings struct {
+	// ConnectTimeout is how long connecting may take, zero for the driver's default
+	ConnectTimeout time.Duration
+	// TLSConfig is set to connect with TLS
+	TLSConfig *tls.Config
 }
 
 type RedisDialOption struct {
-	f func(*dialOptions)
+	f func(*RedisDialSettings)
+}
+
+// RedisDialTimeout limits how long connecting may take
+func RedisDialTimeout(d time.Duration) RedisDialOption {
+	return RedisDialOption{f: func(s *RedisDialSettings) {
+		s.ConnectTimeout = d
+	}}
+}
+
+// RedisDialTLS connects with TLS, with the config
+func RedisDialTLS(config *tls.Config) RedisDialOption {
+	return RedisDialOption{f: func(s *RedisDialSettings) {
+		s.TLSConfig = config
+	}}
+}
+
+// NewRedisDialSettings returns the settings of the options, for drivers
+func NewRedisDialSettings(options ...RedisDialOption) RedisDialSettings {
+	var s RedisDialSettings
+	for _, o := range options {
+		o.f(&s)
+	}
+	return s
 }
 
 type redisDial func(network, address string, options ...RedisDialOption) (RedisConn, error)
@@ -0,0 +1,638 @@
+package backends
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionConfig configures the deletion of old mail from the storage, it's read from the backend config
+type RetentionConfig struct {
+	// Interval is how often to look for expired mail, eg. "1h". Retention is off when empty, unless
+	// the retention job is in the maintenance_schedule
+	Interval string `json:"retention_interval,omitempty"`
+	// Days is how many days to keep mail for, 0 keeps it forever
+	Days int `json:"retention_days,omitempty"`
+	// TenantDays overrides Days for tenants, eg. ["acme=30"]
+	TenantDays []string `json:"retention_tenant_days,omitempty"`
+	// DomainDays overrides Days and TenantDays for recipient domains, eg. ["example.com=7"]
+	DomainDays []string `json:"retention_domain_days,omitempty"`
+	// Stores lists where to look for expired mail: "sql", "sqlite", "redis" and "files".
+	// "sql", "sqlite" and "redis" use the options of the sql, sqlite and redis processors
+	Stores []string `json:"retention_stores,omitempty"`
+	// Dirs are the directories searched by the "files" store, {tenant} matches any tenant
+	Dirs []string `json:"retention_dirs,omitempty"`
+	// ArchiveDir is where expired mail is moved to, instead of being deleted
+	ArchiveDir string `json:"retention_archive_dir,omitempty"`
+	// DryRun only reports the mail that would be removed
+	DryRun bool `json:"retention_dry_run,omitempty"`
+}
+
+// RetentionPolicy decides how long mail is kept. A window of 0 keeps mail forever
+type RetentionPolicy struct {
+	Default time.Duration
+	Tenants map[string]time.Duration
+	Domains map[string]time.Duration
+}
+
+// Window returns how long to keep mail for the tenant and recipient domain.
+// The domain's window is used first, then the tenant's, then the default
+func (p *RetentionPolicy) Window(tenant, domain string) time.Duration {
+	if w, ok := p.Domains[strings.ToLower(domain)]; ok {
+		return w
+	}
+	if w, ok := p.Tenants[tenant]; ok {
+		return w
+	}
+	return p.Default
+}
+
+// windows returns the distinct windows, except 0, shortest first
+func (p *RetentionPolicy) windows() []time.Duration {
+	seen := map[time.Duration]bool{p.Default: true}
+	for _, w := range p.Tenants {
+		seen[w] = true
+	}
+	for _, w := range p.Domains {
+		seen[w] = true
+	}
+	var windows []time.Duration
+	for w := range seen {
+		if w > 0 {
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return windows
+}
+
+// RetentionReport says what was found in a store
+type RetentionReport struct {
+	Store string `json:"store"`
+	// Expired is how many messages were past their retention window
+	Expired int `json:"expired"`
+	// Deleted and Archived count the expired messages that were removed, both are 0 for a dry run
+	Deleted  int       `json:"deleted"`
+	Archived int       `json:"archived"`
+	DryRun   bool      `json:"dry_run,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// retentionStore finds the expired messages in a store, and calls remove for each of them
+type retentionStore interface {
+	name() string
+	sweep(p *RetentionPolicy, remove retentionRemover) error
+}
+
+// retentionRemover removes a message. data is read only when the message is archived, and tenant
+// and id name the archived file
+type retentionRemover func(tenant, id string, data func() ([]byte, error), remove func() error) error
+
+// RetentionJob periodically deletes, or archives, the mail that is past its retention window
+type RetentionJob struct {
+	policy     RetentionPolicy
+	stores     []retentionStore
+	archiveDir string
+	dryRun     bool
+	interval   time.Duration
+
+	last []RetentionReport
+	// only one run at a time
+	running sync.Mutex
+	sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Retention is the running retention job, nil when retention is off.
+// It's configured by the retention_* options when the backend is initialized
+var Retention *RetentionJob
+
+func init() {
+	RegisterMaintenanceJob("retention", func() error {
+		j := Retention
+		if j == nil {
+			return errors.New("retention is not configured")
+		}
+		for _, r := range j.Run(false) {
+			if r.Error != "" {
+				return fmt.Errorf("%s store: %s", r.Store, r.Error)
+			}
+		}
+		return nil
+	})
+}
+
+// Run looks for expired mail in all the stores and removes it, unless dryRun is set
+// or the job was configured as a dry run
+func (j *RetentionJob) Run(dryRun bool) []RetentionReport {
+	j.running.Lock()
+	defer j.running.Unlock()
+	dryRun = dryRun || j.dryRun
+	reports := make([]RetentionReport, 0, len(j.stores))
+	for _, store := range j.stores {
+		r := RetentionReport{Store: store.name(), DryRun: dryRun, Time: Now()}
+		err := store.sweep(&j.policy, func(tenant, id string, data func() ([]byte, error), remove func() error) error {
+			r.Expired++
+			if dryRun {
+				return nil
+			}
+			if j.archiveDir != "" {
+				b, err := data()
+				if err != nil {
+					return err
+				}
+				if err = j.archive(store.name(), tenant, id, b); err != nil {
+					return err
+				}
+			}
+			if err := remove(); err != nil {
+				return err
+			}
+			if j.archiveDir != "" {
+				r.Archived++
+			} else {
+				r.Deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			r.Error = err.Error()
+			Log().WithError(err).Errorf("retention failed for the %s store", r.Store)
+		}
+		if dryRun {
+			Log().Infof("retention dry run: %d expired messages would be removed from the %s store", r.Expired, r.Store)
+		} else {
+			Log().Infof("retention: %d expired messages in the %s store, %d deleted, %d archived",
+				r.Expired, r.Store, r.Deleted, r.Archived)
+		}
+		reports = append(reports, r)
+	}
+	if !dryRun {
+		j.Lock()
+		j.last = reports
+		j.Unlock()
+	}
+	return reports
+}
+
+// LastReports returns the reports of the last run that was not a dry run
+func (j *RetentionJob) LastReports() []RetentionReport {
+	j.Lock()
+	defer j.Unlock()
+	return append([]RetentionReport(nil), j.last...)
+}
+
+// archive saves the message to <archive dir>/<store>/<tenant>/<id>
+func (j *RetentionJob) archive(store, tenant, id string, data []byte) error {
+	if tenant == "" {
+		tenant = "_"
+	}
+	dir := filepath.Join(j.archiveDir, store, filepath.Base(tenant))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, filepath.Base(id)), data, 0600)
+}
+
+// Start runs the job every interval, in the background
+func (j *RetentionJob) Start() {
+	j.stop = make(chan struct{})
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stop:
+				return
+			case <-ticker.C:
+				j.Run(false)
+			}
+		}
+	}()
+}
+
+// Stop stops the background runs, waiting for a run in progress to finish
+func (j *RetentionJob) Stop() {
+	if j.stop != nil {
+		close(j.stop)
+		j.wg.Wait()
+		j.stop = nil
+	}
+}
+
+// parseRetentionDays parses "name=days" entries
+func parseRetentionDays(entries []string) (map[string]time.Duration, error) {
+	windows := make(map[string]time.Duration, len(entries))
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("retention entry %q should be name=days", entry)
+		}
+		days, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("retention entry %q should be name=days", entry)
+		}
+		windows[strings.TrimSpace(kv[0])] = time.Duration(days) * time.Hour * 24
+	}
+	return windows, nil
+}
+
+// NewRetentionJob returns a job configured by the backend config, or nil if retention is off
+func NewRetentionJob(backendConfig BackendConfig) (*RetentionJob, error) {
+	configType := BaseConfig(&RetentionConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return nil, err
+	}
+	config := bcfg.(*RetentionConfig)
+	if config.Interval == "" && !maintenanceScheduled(backendConfig, "retention") {
+		return nil, nil
+	}
+	j := &RetentionJob{
+		archiveDir: config.ArchiveDir,
+		dryRun:     config.DryRun,
+	}
+	if config.Interval != "" {
+		if j.interval, err = time.ParseDuration(config.Interval); err != nil {
+			return nil, err
+		}
+		if j.interval <= 0 {
+			return nil, errors.New("retention_interval must be positive")
+		}
+	}
+	j.policy.Default = time.Duration(config.Days) * time.Hour * 24
+	if j.policy.Tenants, err = parseRetentionDays(config.TenantDays); err != nil {
+		return nil, err
+	}
+	domains, err := parseRetentionDays(config.DomainDays)
+	if err != nil {
+		return nil, err
+	}
+	j.policy.Domains = make(map[string]time.Duration, len(domains))
+	for domain, w := range domains {
+		j.policy.Domains[strings.ToLower(domain)] = w
+	}
+	for _, name := range config.Stores {
+		var store retentionStore
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "sql":
+			sqlConfig, err := Svc.ExtractConfig(backendConfig, &SQLProcessorConfig{})
+			if err != nil {
+				return nil, err
+			}
+			if len(sqlConfig.(*SQLProcessorConfig).Columns) > 0 {
+				return nil, errors.New("the sql retention store needs the default columns, it can't be used with sql_columns")
+			}
+			store = &sqlRetentionStore{
+				config: sqlConfig.(*SQLProcessorConfig),
+				store:  "sql",
+				before: "DATE_SUB(NOW(), INTERVAL ? SECOND)",
+			}
+		case "sqlite":
+			sqliteConfig, err := Svc.ExtractConfig(backendConfig, &SQLiteProcessorConfig{})
+			if err != nil {
+				return nil, err
+			}
+			c := sqliteConfig.(*SQLiteProcessorConfig)
+			store = &sqlRetentionStore{
+				config: &SQLProcessorConfig{Driver: "sqlite3", DSN: c.dsn(), Table: c.table()},
+				store:  "sqlite",
+				before: "datetime('now', '-' || ? || ' seconds')",
+			}
+		case "redis":
+			redisConfig, err := Svc.ExtractConfig(backendConfig, &RedisProcessorConfig{})
+			if err != nil {
+				return nil, err
+			}
+			store = &redisRetentionStore{config: redisConfig.(*RedisProcessorConfig)}
+		case "files":
+			store = &fileRetentionStore{dirs: config.Dirs}
+		default:
+			return nil, fmt.Errorf("unknown retention store %q, expected sql, sqlite, redis or files", name)
+		}
+		j.stores = append(j.stores, store)
+	}
+	return j, nil
+}
+
+// configureRetention starts the retention job, if enabled by the config
+func configureRetention(backendConfig BackendConfig) error {
+	j, err := NewRetentionJob(backendConfig)
+	if err != nil {
+		return err
+	}
+	Retention = j
+	if j == nil || j.interval == 0 {
+		// it only runs when it's scheduled, or from the admin API
+		return nil
+	}
+	j.Start()
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		j.Stop()
+		return nil
+	}))
+	return nil
+}
+
+// deliveredToDomain returns the domain of the Delivered-To header, added by the Header processor
+func deliveredToDomain(data []byte) string {
+	return recipientDomain(HeaderAddress(data, "Delivered-To"))
+}
+
+// recipientDomain returns the domain of an address
+func recipientDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i > -1 {
+		return strings.ToLower(strings.Trim(addr[i+1:], "<> "))
+	}
+	return ""
+}
+
+// tenantPattern splits a name with the TenantPlaceholder, so that tenant can find the tenant in a name
+type tenantPattern struct {
+	prefix, suffix string
+	per            bool
+}
+
+func newTenantPattern(name string) tenantPattern {
+	i := strings.Index(name, TenantPlaceholder)
+	if i == -1 {
+		return tenantPattern{prefix: name}
+	}
+	return tenantPattern{prefix: name[:i], suffix: name[i+len(TenantPlaceholder):], per: true}
+}
+
+// tenant returns the tenant in name, empty if it cannot be found
+func (t tenantPattern) tenant(name string) string {
+	if !t.per || t.suffix == "" || !strings.HasPrefix(name, t.prefix) {
+		return ""
+	}
+	rest := name[len(t.prefix):]
+	if i := strings.Index(rest, t.suffix); i > -1 {
+		return rest[:i]
+	}
+	return ""
+}
+
+// sqlRetentionStore removes rows from the mail_table of the sql processor, or the table of the sqlite processor.
+// When the table has a {tenant} placeholder, the tables of the tenants in retention_tenant_days are searched
+type sqlRetentionStore struct {
+	config *SQLProcessorConfig
+	store  string
+	// before is the database's expression for the time a number of seconds ago, given by the placeholder
+	before string
+}
+
+func (s *sqlRetentionStore) name() string {
+	return s.store
+}
+
+func (s *sqlRetentionStore) sweep(p *RetentionPolicy, remove retentionRemover) error {
+	dsn, err := (&SQLProcessor{config: s.config}).dsn()
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(s.config.Driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	tenants := []string{""}
+	if strings.Contains(s.config.Table, TenantPlaceholder) {
+		tenants = tenants[:0]
+		for tenant := range p.Tenants {
+			tenants = append(tenants, tenant)
+		}
+		sort.Strings(tenants)
+	}
+	for _, tenant := range tenants {
+		if err := s.sweepTable(db, ForTenant(s.config.Table, tenant), tenant, p, remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepTable removes the expired rows. Each row has a single window, so the rows older than each
+// window are selected, and the ones that belong to another window are skipped
+func (s *sqlRetentionStore) sweepTable(db *sql.DB, table, tenant string, p *RetentionPolicy, remove retentionRemover) error {
+	type row struct {
+		id        int64
+		recipient string
+		body      string
+	}
+	for _, w := range p.windows() {
+		rows, err := db.Query("SELECT `mail_id`, `recipient`, `body` FROM "+table+
+			" WHERE `date` < "+s.before, int64(w/time.Second))
+		if err != nil {
+			return err
+		}
+		var expired []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.recipient, &r.body); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			if p.Window(tenant, recipientDomain(r.recipient)) == w {
+				expired = append(expired, r)
+			}
+		}
+		_ = rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range expired {
+			id := strconv.FormatInt(r.id, 10) + ".eml"
+			if r.body == "gzip" {
+				id += ".gz"
+			}
+			mailId := r.id
+			err := remove(tenant, id, func() ([]byte, error) {
+				var data []byte
+				err := db.QueryRow("SELECT `mail` FROM "+table+" WHERE `mail_id` = ?", mailId).Scan(&data)
+				return data, err
+			}, func() error {
+				_, err := db.Exec("DELETE FROM "+table+" WHERE `mail_id` = ?", mailId)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// redisRetentionStore removes the keys saved by the redis processor. A key's age is worked out from its TTL
+// and redis_expire_seconds, so keys without a TTL are skipped
+type redisRetentionStore struct {
+	config *RedisProcessorConfig
+}
+
+func (s *redisRetentionStore) name() string {
+	return "redis"
+}
+
+func (s *redisRetentionStore) sweep(p *RetentionPolicy, remove retentionRemover) error {
+	conn, err := dialRedis(s.config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	pattern := newTenantPattern(s.config.RedisKeyPrefix)
+	match := strings.Replace(s.config.RedisKeyPrefix, TenantPlaceholder, "*", -1) + "*"
+	cursor := "0"
+	for {
+		reply, err := conn.Do("SCAN", cursor, "MATCH", match, "COUNT", 100)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if cursor, keys, err = redisScanReply(reply); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if strings.HasSuffix(key, ":tags") {
+				// removed with the message
+				continue
+			}
+			if err := s.sweepKey(conn, key, pattern.tenant(key), p, remove); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (s *redisRetentionStore) sweepKey(conn RedisConn, key, tenant string, p *RetentionPolicy, remove retentionRemover) error {
+	reply, err := conn.Do("TTL", key)
+	if err != nil {
+		return err
+	}
+	ttl, ok := reply.(int64)
+	if !ok || ttl < 0 {
+		return nil
+	}
+	age := time.Duration(int64(s.config.RedisExpireSeconds)-ttl) * time.Second
+	var data []byte
+	get := func() ([]byte, error) {
+		if data == nil {
+			reply, err := conn.Do("GET", key)
+			if err != nil {
+				return nil, err
+			}
+			data, _ = reply.([]byte)
+		}
+		return data, nil
+	}
+	domain := ""
+	if len(p.Domains) > 0 {
+		b, err := get()
+		if err != nil {
+			return err
+		}
+		domain = deliveredToDomain(b)
+	}
+	if w := p.Window(tenant, domain); w == 0 || age < w {
+		return nil
+	}
+	return remove(tenant, key+".eml", get, func() error {
+		_, err := conn.Do("DEL", key, key+":tags")
+		return err
+	})
+}
+
+// redisScanReply reads the cursor and keys from a SCAN reply
+func redisScanReply(reply interface{}) (string, []string, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return "", nil, fmt.Errorf("unexpected reply to SCAN: %v", reply)
+	}
+	cursor, ok := values[0].([]byte)
+	if !ok {
+		return "", nil, fmt.Errorf("unexpected cursor in the reply to SCAN: %v", values[0])
+	}
+	items, _ := values[1].([]interface{})
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		if key, ok := item.([]byte); ok {
+			keys = append(keys, string(key))
+		}
+	}
+	return string(cursor), keys, nil
+}
+
+// fileRetentionStore removes files by their modification time. A {tenant} in a directory matches
+// any tenant, eg. "/var/mail/{tenant}/new"
+type fileRetentionStore struct {
+	dirs []string
+}
+
+func (s *fileRetentionStore) name() string {
+	return "files"
+}
+
+func (s *fileRetentionStore) sweep(p *RetentionPolicy, remove retentionRemover) error {
+	for _, dir := range s.dirs {
+		// the suffix must not be empty to find the tenant, so both end with a separator
+		pattern := newTenantPattern(dir + "/")
+		matches, err := filepath.Glob(strings.Replace(dir, TenantPlaceholder, "*", -1))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if err := s.sweepDir(match, pattern.tenant(match+"/"), p, remove); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fileRetentionStore) sweepDir(dir, tenant string, p *RetentionPolicy, remove retentionRemover) error {
+	now := Now()
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		read := func() ([]byte, error) {
+			return ioutil.ReadFile(path)
+		}
+		domain := ""
+		if len(p.Domains) > 0 {
+			b, err := read()
+			if err != nil {
+				return err
+			}
+			domain = deliveredToDomain(b)
+		}
+		if w := p.Window(tenant, domain); w == 0 || now.Sub(info.ModTime()) < w {
+			return nil
+		}
+		return remove(tenant, info.Name(), read, func() error {
+			return os.Remove(path)
+		})
+	})
+}
@@ -0,0 +1,190 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	p := RetentionPolicy{
+		Default: time.Hour,
+		Tenants: map[string]time.Duration{"acme": time.Hour * 2},
+		Domains: map[string]time.Duration{"keep.com": 0},
+	}
+	for _, c := range []struct {
+		tenant, domain string
+		expect         time.Duration
+	}{
+		{"", "example.com", time.Hour},
+		{"acme", "example.com", time.Hour * 2},
+		{"acme", "KEEP.com", 0},
+	} {
+		if w := p.Window(c.tenant, c.domain); w != c.expect {
+			t.Error("expected the window for", c.tenant, c.domain, "to be", c.expect, "got", w)
+		}
+	}
+	if w := p.windows(); len(w) != 2 || w[0] != time.Hour {
+		t.Error("unexpected windows", w)
+	}
+	if _, err := parseRetentionDays([]string{"acme"}); err == nil {
+		t.Error("expected an error for an entry without days")
+	}
+}
+
+func writeRetentionFile(t *testing.T, path, data string, age time.Duration) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRetention(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	day := time.Hour * 24
+	writeRetentionFile(t, filepath.Join(dir, "acme", "new", "old.eml"), "Delivered-To: a@acme.com\n\nhi\n", day*10)
+	writeRetentionFile(t, filepath.Join(dir, "acme", "new", "fresh.eml"), "Delivered-To: a@acme.com\n\nhi\n", day)
+	writeRetentionFile(t, filepath.Join(dir, "acme", "new", "kept.eml"), "Delivered-To: <a@keep.com>\n\nhi\n", day*10)
+	writeRetentionFile(t, filepath.Join(dir, "globex", "new", "old.eml"), "Delivered-To: a@globex.com\n\nhi\n", day*10)
+
+	archive := filepath.Join(dir, "archive")
+	j, err := NewRetentionJob(BackendConfig{
+		"retention_interval":    "1h",
+		"retention_days":        5,
+		"retention_tenant_days": []interface{}{"globex=20"},
+		"retention_domain_days": []interface{}{"keep.com=0"},
+		"retention_stores":      []interface{}{"files"},
+		"retention_dirs":        []interface{}{filepath.Join(dir, "{tenant}", "new")},
+		"retention_archive_dir": archive,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run only counts
+	reports := j.Run(true)
+	if len(reports) != 1 || reports[0].Expired != 1 || reports[0].Archived != 0 || !reports[0].DryRun {
+		t.Fatal("unexpected dry run report", reports)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme", "new", "old.eml")); err != nil {
+		t.Error("expected the dry run to leave the file", err)
+	}
+
+	reports = j.Run(false)
+	if len(reports) != 1 || reports[0].Expired != 1 || reports[0].Archived != 1 || reports[0].Error != "" {
+		t.Fatal("unexpected report", reports)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme", "new", "old.eml")); !os.IsNotExist(err) {
+		t.Error("expected the expired file to be removed", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(archive, "files", "acme", "old.eml")); err != nil || !strings.HasPrefix(string(b), "Delivered-To") {
+		t.Error("expected the expired file to be archived", err)
+	}
+	for _, kept := range []string{"acme/new/fresh.eml", "acme/new/kept.eml", "globex/new/old.eml"} {
+		if _, err := os.Stat(filepath.Join(dir, kept)); err != nil {
+			t.Error("expected", kept, "to be kept", err)
+		}
+	}
+	if last := j.LastReports(); len(last) != 1 || last[0].Archived != 1 {
+		t.Error("unexpected last reports", last)
+	}
+}
+
+// retentionRedisConn is a RedisConn with keys that were saved with a 100 second expiry
+type retentionRedisConn struct {
+	ttls map[string]int64
+	data map[string]string
+}
+
+func (c *retentionRedisConn) Close() error {
+	return nil
+}
+
+func (c *retentionRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	switch commandName {
+	case "SCAN":
+		var keys []interface{}
+		for key := range c.ttls {
+			keys = append(keys, []byte(key))
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	case "TTL":
+		return c.ttls[args[0].(string)], nil
+	case "GET":
+		return []byte(c.data[args[0].(string)]), nil
+	case "DEL":
+		for _, key := range args {
+			delete(c.ttls, key.(string))
+		}
+		return int64(len(args)), nil
+	}
+	return nil, nil
+}
+
+func TestRedisRetention(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	conn := &retentionRedisConn{
+		ttls: map[string]int64{
+			"mail:acme:old":      10,
+			"mail:acme:old:tags": 10,
+			"mail:acme:new":      90,
+			"mail:globex:old":    10,
+			"mail:acme:forever":  -1,
+		},
+		data: map[string]string{},
+	}
+	dialer := RedisDialer
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		return conn, nil
+	}
+	defer func() {
+		RedisDialer = dialer
+	}()
+	// a day is too long for the test, so the policy is set directly
+	j, err := NewRetentionJob(BackendConfig{
+		"retention_interval":   "1h",
+		"retention_stores":     []interface{}{"redis"},
+		"redis_interface":      "127.0.0.1:6379",
+		"redis_expire_seconds": 100,
+		"redis_key_prefix":     "mail:{tenant}:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.policy.Default = time.Minute
+	j.policy.Tenants = map[string]time.Duration{"globex": 0}
+
+	reports := j.Run(false)
+	if len(reports) != 1 || reports[0].Deleted != 1 || reports[0].Error != "" {
+		t.Fatal("unexpected report", reports)
+	}
+	if _, ok := conn.ttls["mail:acme:old"]; ok {
+		t.Error("expected the old key to be deleted")
+	}
+	if _, ok := conn.ttls["mail:acme:old:tags"]; ok {
+		t.Error("expected the tags of the old key to be deleted")
+	}
+	if len(conn.ttls) != 3 {
+		t.Error("expected the other keys to be kept, got", conn.ttls)
+	}
+}
@@ -0,0 +1,264 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client saves objects to a bucket of S3, or a service with the same API such as MinIO.
+// Requests are signed with AWS Signature Version 4
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// pathStyle puts the bucket in the path instead of the host name, as MinIO expects
+	pathStyle bool
+	client    *http.Client
+	now       func() time.Time
+}
+
+// s3MinPartSize is the smallest part of a multipart upload that S3 accepts, except the last one
+const s3MinPartSize = 5 << 20
+
+// s3Error is the error returned by the API
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// s3Escape encodes s as the signature expects, everything but the unreserved characters of RFC 3986
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectURL returns the URL of the object, and the escaped path that is signed
+func (c *s3Client) objectURL(key string, query url.Values) (*url.URL, string) {
+	u := *c.endpoint
+	path := "/" + s3Escape(key, true)
+	if c.pathStyle {
+		path = "/" + s3Escape(c.bucket, false) + path
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	path = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + path
+	u.Path, _ = url.PathUnescape(path)
+	u.RawPath = path
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u, path
+}
+
+// s3CanonicalQuery sorts and encodes the query parameters
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the Authorization header. All the headers of the request are signed, with the host
+func (c *s3Client) sign(req *http.Request, path, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.Join(strings.Fields(headers[k]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := amzDate[:8] + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), amzDate[:8])
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// do sends a signed request, and returns the body of a successful response
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	u, path := c.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.URL = u
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, path, sha256Hex(body), c.now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// CompleteMultipartUpload can fail after the 200 status was sent
+	head := data
+	if len(head) > 256 {
+		head = head[:256]
+	}
+	if resp.StatusCode/100 != 2 || bytes.Contains(head, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		_ = xml.Unmarshal(data, e)
+		return nil, nil, e
+	}
+	return resp.Header, data, nil
+}
+
+// putObject saves the data read from r. Data larger than partSize is uploaded in parts,
+// so that only a part is held in memory
+func (c *s3Client) putObject(key string, r io.Reader, partSize int, header http.Header) error {
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, _, err = c.do(http.MethodPut, key, nil, header, buf[:n])
+		return err
+	} else if err != nil {
+		return err
+	}
+	_, data, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &upload); err != nil || upload.UploadId == "" {
+		return errors.New("s3: no upload id in the reply")
+	}
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	err = func() error {
+		for number := 1; n > 0; number++ {
+			h, _, err := c.do(http.MethodPut, key, url.Values{
+				"partNumber": {strconv.Itoa(number)},
+				"uploadId":   {upload.UploadId},
+			}, nil, buf[:n])
+			if err != nil {
+				return err
+			}
+			parts = append(parts, part{PartNumber: number, ETag: h.Get("ETag")})
+			if n, err = io.ReadFull(r, buf); err == io.EOF {
+				n = 0
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		complete, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}{Parts: parts})
+		if err != nil {
+			return err
+		}
+		_, _, err = c.do(http.MethodPost, key, url.Values{"uploadId": {upload.UploadId}}, nil, complete)
+		return err
+	}()
+	if err != nil {
+		// so that the parts don't take up space
+		if _, _, abortErr := c.do(http.MethodDelete, key, url.Values{"uploadId": {upload.UploadId}}, nil, nil); abortErr != nil {
+			Log().WithError(abortErr).Warn("s3: could not abort the upload of ", key)
+		}
+	}
+	return err
+}
+
+// getObject returns the object's data
+func (c *s3Client) getObject(key string) ([]byte, error) {
+	_, data, err := c.do(http.MethodGet, key, nil, nil, nil)
+	return data, err
+}
+
+// getObjectRange returns the bytes from start to end of the object, inclusive
+func (c *s3Client) getObjectRange(key string, start, end int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}}
+	_, data, err := c.do(http.MethodGet, key, nil, header, nil)
+	if err == nil && int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("s3: expected %d bytes of %s, got %d", end-start+1, key, len(data))
+	}
+	return data, err
+}
@@ -0,0 +1,209 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3PackIndexSuffix is added to the key of a pack for the key of its index
+const s3PackIndexSuffix = ".idx"
+
+// S3PackEntry locates a message in a pack
+type S3PackEntry struct {
+	// ID is the hash of the message, its e.QueuedId
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Encoding is "deflate" when the message was compressed
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// S3PackIndex is the index of a pack, saved as json next to it
+type S3PackIndex struct {
+	Messages []S3PackEntry `json:"messages"`
+}
+
+// s3Pack is a pack that's being filled. The messages that were added to it wait for done
+type s3Pack struct {
+	group  string
+	key    string
+	header http.Header
+	data   bytes.Buffer
+	index  S3PackIndex
+	timer  *time.Timer
+	done   chan struct{}
+	// err is the result of the upload, set before done is closed
+	err error
+}
+
+// s3Packer packs the messages in objects of about size bytes, with one pack open for each key prefix
+// and object headers, so that the messages of a pack have the same tenant and storage class
+type s3Packer struct {
+	client   *s3Client
+	size     int
+	partSize int
+	wait     time.Duration
+	mu       sync.Mutex
+	packs    map[string]*s3Pack
+}
+
+func newS3Packer(client *s3Client, size, partSize int, wait time.Duration) *s3Packer {
+	return &s3Packer{client: client, size: size, partSize: partSize, wait: wait, packs: make(map[string]*s3Pack)}
+}
+
+// s3PackGroup is the prefix and the headers of the pack, as a string
+func s3PackGroup(prefix string, header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	group := prefix
+	for _, name := range names {
+		group += "\x00" + name + ":" + strings.Join(header[name], ",")
+	}
+	return group
+}
+
+// newS3PackKey returns a unique key for a pack, that sorts by time
+func newS3PackKey(prefix string) string {
+	var b [6]byte
+	_, _ = rand.Read(b[:])
+	return prefix + "pack-" + Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b[:])
+}
+
+// add puts the message in the pack of the prefix and headers, and waits for the pack to be uploaded.
+// It returns the s3:// URL of the message
+func (p *s3Packer) add(prefix string, header http.Header, id string, data []byte, encoding string) (string, error) {
+	// the messages are in the index as they were given, the pack is only their bytes
+	packHeader := http.Header{}
+	for name, values := range header {
+		packHeader[name] = values
+	}
+	packHeader.Del("Content-Encoding")
+	packHeader.Set("Content-Type", "application/octet-stream")
+	header = packHeader
+	group := s3PackGroup(prefix, header)
+	p.mu.Lock()
+	pack, ok := p.packs[group]
+	if !ok {
+		pack = &s3Pack{group: group, key: newS3PackKey(prefix), header: header, done: make(chan struct{})}
+		p.packs[group] = pack
+		pack.timer = time.AfterFunc(p.wait, func() {
+			p.flush(pack)
+		})
+	}
+	entry := S3PackEntry{ID: id, Offset: int64(pack.data.Len()), Length: int64(len(data)), Encoding: encoding}
+	pack.data.Write(data)
+	pack.index.Messages = append(pack.index.Messages, entry)
+	full := pack.data.Len() >= p.size
+	p.mu.Unlock()
+	if full {
+		p.flush(pack)
+	}
+	<-pack.done
+	if pack.err != nil {
+		return "", pack.err
+	}
+	return s3PackURL(p.client.bucket, pack.key, entry.Offset, entry.Length), nil
+}
+
+// flush uploads the pack and its index, unless another goroutine did
+func (p *s3Packer) flush(pack *s3Pack) {
+	p.mu.Lock()
+	if p.packs[pack.group] != pack {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.packs, pack.group)
+	pack.timer.Stop()
+	p.mu.Unlock()
+
+	pack.err = p.client.putObject(pack.key, bytes.NewReader(pack.data.Bytes()), p.partSize, pack.header)
+	if pack.err == nil {
+		var index []byte
+		if index, pack.err = json.Marshal(&pack.index); pack.err == nil {
+			pack.err = p.client.putObject(pack.key+s3PackIndexSuffix, bytes.NewReader(index), p.partSize,
+				http.Header{"Content-Type": {"application/json"}})
+		}
+	}
+	if pack.err != nil {
+		Log().WithError(pack.err).Errorf("could not save the pack %s to s3", pack.key)
+	} else {
+		Log().Debugf("saved the pack %s to s3 with %d messages", pack.key, len(pack.index.Messages))
+	}
+	close(pack.done)
+}
+
+// flushAll uploads the packs that are open, eg. at shutdown
+func (p *s3Packer) flushAll() {
+	p.mu.Lock()
+	packs := make([]*s3Pack, 0, len(p.packs))
+	for _, pack := range p.packs {
+		packs = append(packs, pack)
+	}
+	p.mu.Unlock()
+	for _, pack := range packs {
+		p.flush(pack)
+	}
+}
+
+// s3PackURL is the URL of a message in a pack, with the range of its bytes in the fragment
+func s3PackURL(bucket, key string, offset, length int64) string {
+	return fmt.Sprintf("%s#bytes=%d-%d", s3URL(bucket, key), offset, offset+length-1)
+}
+
+// splitS3Range returns the key and the byte range of a message in a pack, ok is false for other keys
+func splitS3Range(key string) (string, int64, int64, bool) {
+	i := strings.LastIndex(key, "#bytes=")
+	if i < 0 {
+		return key, 0, 0, false
+	}
+	r := strings.SplitN(key[i+len("#bytes="):], "-", 2)
+	if len(r) != 2 {
+		return key, 0, 0, false
+	}
+	start, err1 := strconv.ParseInt(r[0], 10, 64)
+	end, err2 := strconv.ParseInt(r[1], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return key, 0, 0, false
+	}
+	return key[:i], start, end, true
+}
+
+// getMessage returns the object at the key, or only the bytes of the message when it's in a pack
+func (c *s3Client) getMessage(key string) ([]byte, error) {
+	if pack, start, end, ok := splitS3Range(key); ok {
+		return c.getObjectRange(pack, start, end)
+	}
+	return c.getObject(key)
+}
+
+// ReadS3Message returns a message that was saved by the s3 processor, from its s3:// URL, with the s3
+// options of the backend config. A message in a pack is read with a range request, so that only its
+// bytes are fetched
+func ReadS3Message(backendConfig BackendConfig, s3url string) ([]byte, error) {
+	config, err := Svc.ExtractConfig(backendConfig.Section("s3"), &S3ProcessorConfig{})
+	if err != nil {
+		return nil, err
+	}
+	client, err := config.(*S3ProcessorConfig).client()
+	if err != nil {
+		return nil, err
+	}
+	bucket, key, ok := parseS3URL(s3url)
+	if !ok || bucket != client.bucket {
+		return nil, errors.New("not an s3:// URL of s3_bucket: " + s3url)
+	}
+	return client.getMessage(key)
+}
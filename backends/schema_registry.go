@@ -0,0 +1,353 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The schemas of the mail events, registered with a Confluent schema registry by the processors that
+// publish events in the avro or protobuf formats. Fields are only ever added, with a default, so that
+// the new versions stay compatible with the consumers
+const (
+	mailEventAvroSchema = `{"type":"record","name":"MailEvent","namespace":"guerrilla","fields":[` +
+		`{"name":"queued_id","type":"string"},` +
+		`{"name":"hash","type":"string","default":""},` +
+		`{"name":"tenant","type":"string","default":""},` +
+		`{"name":"from","type":"string"},` +
+		`{"name":"to","type":{"type":"array","items":"string"}},` +
+		`{"name":"remote_ip","type":"string"},` +
+		`{"name":"helo","type":"string"},` +
+		`{"name":"tls","type":"boolean"},` +
+		`{"name":"subject","type":"string"},` +
+		`{"name":"message_id","type":"string","default":""},` +
+		`{"name":"headers","type":{"type":"map","values":{"type":"array","items":"string"}}},` +
+		`{"name":"tags","type":{"type":"array","items":"string"},"default":[]},` +
+		`{"name":"size","type":"long"},` +
+		`{"name":"received_at","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+		`{"name":"data","type":["null","string"],"default":null}]}`
+
+	mailEventProtoSchema = `syntax = "proto3";
+package guerrilla;
+
+message MailEvent {
+  message Header {
+    string name = 1;
+    repeated string values = 2;
+  }
+  string queued_id = 1;
+  string hash = 2;
+  string tenant = 3;
+  string from = 4;
+  repeated string to = 5;
+  string remote_ip = 6;
+  string helo = 7;
+  bool tls = 8;
+  string subject = 9;
+  string message_id = 10;
+  repeated Header headers = 11;
+  repeated string tags = 12;
+  int64 size = 13;
+  // unix milliseconds
+  int64 received_at = 14;
+  string data = 15;
+}
+`
+)
+
+// defaultSchemaRegistryTimeout limits the requests to the registry
+const defaultSchemaRegistryTimeout = time.Second * 10
+
+// schemaRegistry registers the schema of the events with a Confluent schema registry, and encodes the
+// events in its wire format: a zero byte, the id of the schema, then the avro or protobuf encoding
+type schemaRegistry struct {
+	url      string
+	username string
+	password string
+	format   string
+	client   *http.Client
+	mu       sync.Mutex
+	// ids are the ids of the schema, by subject
+	ids map[string]uint32
+}
+
+func newSchemaRegistry(registryURL, username, password, format string) (*schemaRegistry, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid schema registry url %q", registryURL)
+	}
+	if format != "avro" && format != "protobuf" {
+		return nil, fmt.Errorf("the schema registry has no schema for the %s format", format)
+	}
+	return &schemaRegistry{
+		url:      strings.TrimSuffix(registryURL, "/"),
+		username: username,
+		password: password,
+		format:   format,
+		client:   &http.Client{Timeout: defaultSchemaRegistryTimeout},
+		ids:      make(map[string]uint32),
+	}, nil
+}
+
+// schemaID returns the id of the schema for the subject, registering it the first time. Registering
+// a schema that the subject has already returns its id
+func (r *schemaRegistry) schemaID(subject string) (uint32, error) {
+	r.mu.Lock()
+	id, ok := r.ids[subject]
+	r.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	request := map[string]string{"schema": mailEventAvroSchema}
+	if r.format == "protobuf" {
+		request = map[string]string{"schema": mailEventProtoSchema, "schemaType": "PROTOBUF"}
+	}
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest(http.MethodPost, r.url+"/subjects/"+url.PathEscape(subject)+"/versions",
+		bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registry: could not register the schema of %s: %s %s",
+			subject, resp.Status, bytes.TrimSpace(reply))
+	}
+	var registered struct {
+		ID uint32 `json:"id"`
+	}
+	if err := json.Unmarshal(reply, &registered); err != nil || registered.ID == 0 {
+		return 0, fmt.Errorf("schema registry: unexpected reply %q", reply)
+	}
+	r.mu.Lock()
+	r.ids[subject] = registered.ID
+	r.mu.Unlock()
+	return registered.ID, nil
+}
+
+// encode returns the event in the wire format, with the schema of the subject
+func (r *schemaRegistry) encode(subject string, ev *mailEvent) ([]byte, error) {
+	id, err := r.schemaID(subject)
+	if err != nil {
+		return nil, err
+	}
+	msg := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], id)
+	if r.format == "protobuf" {
+		// the indexes of the message in the schema, [0] for its first message is a single 0
+		msg = append(msg, 0)
+		return append(msg, protobufMailEvent(ev)...), nil
+	}
+	return append(msg, avroMailEvent(ev)...), nil
+}
+
+// headerNames returns the names of the headers of the event, sorted
+func (ev *mailEvent) headerNames() []string {
+	names := make([]string, 0, len(ev.Headers))
+	for name := range ev.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// avroBuffer encodes avro binary data
+type avroBuffer []byte
+
+func (b *avroBuffer) long(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	*b = append(*b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func (b *avroBuffer) string(v string) {
+	b.long(int64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *avroBuffer) bool(v bool) {
+	if v {
+		*b = append(*b, 1)
+	} else {
+		*b = append(*b, 0)
+	}
+}
+
+// strings encodes an array of strings as one block
+func (b *avroBuffer) strings(v []string) {
+	if len(v) > 0 {
+		b.long(int64(len(v)))
+		for _, s := range v {
+			b.string(s)
+		}
+	}
+	b.long(0)
+}
+
+// avroMailEvent encodes the event with mailEventAvroSchema
+func avroMailEvent(ev *mailEvent) []byte {
+	var b avroBuffer
+	b.string(ev.QueuedId)
+	b.string(ev.Hash)
+	b.string(ev.Tenant)
+	b.string(ev.From)
+	b.strings(ev.To)
+	b.string(ev.RemoteIP)
+	b.string(ev.Helo)
+	b.bool(ev.TLS)
+	b.string(ev.Subject)
+	b.string(ev.MessageId)
+	if len(ev.Headers) > 0 {
+		b.long(int64(len(ev.Headers)))
+		for _, name := range ev.headerNames() {
+			b.string(name)
+			b.strings(ev.Headers[name])
+		}
+	}
+	b.long(0)
+	b.strings(ev.Tags)
+	b.long(int64(ev.Size))
+	b.long(ev.ReceivedAt.UnixNano() / int64(time.Millisecond))
+	if ev.Data == "" {
+		b.long(0)
+	} else {
+		b.long(1)
+		b.string(ev.Data)
+	}
+	return b
+}
+
+// pbBuffer encodes a protobuf message. Fields with the default value are left out, as in proto3
+type pbBuffer []byte
+
+func (b *pbBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*b = append(*b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (b *pbBuffer) tag(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *pbBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, 0)
+	b.varint(v)
+}
+
+func (b *pbBuffer) bool(field int, v bool) {
+	if v {
+		b.uint(field, 1)
+	}
+}
+
+func (b *pbBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *pbBuffer) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+var errPBMalformed = errors.New("protobuf: malformed message")
+
+// pbFields calls fn for each field of the protobuf message. v is the value of varint fields,
+// and data is the value of length delimited fields
+func pbFields(msg []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errPBMalformed
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errPBMalformed
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return errPBMalformed
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return errPBMalformed
+			}
+			data, msg = msg[n:n+int(size)], msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return errPBMalformed
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		default:
+			return errPBMalformed
+		}
+		if err := fn(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protobufMailEvent encodes the event with mailEventProtoSchema
+func protobufMailEvent(ev *mailEvent) []byte {
+	var b pbBuffer
+	b.string(1, ev.QueuedId)
+	b.string(2, ev.Hash)
+	b.string(3, ev.Tenant)
+	b.string(4, ev.From)
+	for _, to := range ev.To {
+		b.bytes(5, []byte(to))
+	}
+	b.string(6, ev.RemoteIP)
+	b.string(7, ev.Helo)
+	b.bool(8, ev.TLS)
+	b.string(9, ev.Subject)
+	b.string(10, ev.MessageId)
+	for _, name := range ev.headerNames() {
+		var h pbBuffer
+		h.string(1, name)
+		for _, v := range ev.Headers[name] {
+			h.bytes(2, []byte(v))
+		}
+		b.bytes(11, h)
+	}
+	for _, tag := range ev.Tags {
+		b.bytes(12, []byte(tag))
+	}
+	b.uint(13, uint64(ev.Size))
+	b.uint(14, uint64(ev.ReceivedAt.UnixNano()/int64(time.Millisecond)))
+	b.string(15, ev.Data)
+	return b
+}
@@ -0,0 +1,122 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAvroMailEvent(t *testing.T) {
+	ev := &mailEvent{
+		QueuedId:   "q",
+		From:       "a@b",
+		To:         []string{"c@d"},
+		TLS:        true,
+		Headers:    map[string][]string{"Subject": {"hi"}},
+		Size:       2,
+		ReceivedAt: time.Unix(1, 0),
+	}
+	expected := []byte{
+		2, 'q', 0, 0, 6, 'a', '@', 'b',
+		2, 6, 'c', '@', 'd', 0,
+		0, 0, 1, 0, 0,
+		2, 14, 'S', 'u', 'b', 'j', 'e', 'c', 't', 2, 4, 'h', 'i', 0, 0,
+		0, 4, 0xd0, 0x0f, 0,
+	}
+	if b := avroMailEvent(ev); !bytes.Equal(b, expected) {
+		t.Errorf("unexpected encoding\n%v\n%v", b, expected)
+	}
+	ev.Data = "x"
+	if b := avroMailEvent(ev); !bytes.Equal(b[len(b)-3:], []byte{2, 2, 'x'}) {
+		t.Error("expected the data in the union, got", b[len(b)-3:])
+	}
+}
+
+func TestKafkaSchemaRegistry(t *testing.T) {
+	var mu sync.Mutex
+	var registered []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "reg" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/subjects/mail-acme-value/versions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var request map[string]string
+		_ = json.Unmarshal(body, &request)
+		mu.Lock()
+		registered = append(registered, request)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"id":7}`))
+	}))
+	defer server.Close()
+
+	for _, format := range []string{"avro", "protobuf"} {
+		k, restore := useFakeKafka()
+		backend := newBrokerTestBackend(t, BackendConfig{
+			"save_process":                   "HeadersParser|Kafka|Debugger",
+			"kafka_brokers":                  "k1:9092",
+			"kafka_topic":                    "mail-{tenant}",
+			"kafka_format":                   format,
+			"kafka_schema_registry":          server.URL + "/",
+			"kafka_schema_registry_username": "reg",
+			"kafka_schema_registry_password": "secret",
+		})
+		if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+			t.Fatal("expected the mail to be published, got", result)
+		}
+		_ = backend.Shutdown()
+		restore()
+		msgs := k.messages["mail-acme"]
+		if len(msgs) != 1 || !bytes.HasPrefix(msgs[0].Value, []byte{0, 0, 0, 0, 7}) {
+			t.Fatal("expected the schema id in the message, got", msgs)
+		}
+		mu.Lock()
+		request := registered[len(registered)-1]
+		mu.Unlock()
+		value := msgs[0].Value[5:]
+		if format == "avro" {
+			if request["schemaType"] != "" || !strings.Contains(request["schema"], `"name":"MailEvent"`) {
+				t.Error("expected the avro schema, got", request)
+			}
+			if !bytes.Contains(value, []byte("\x00\x08acme\x20test@example.com")) || value[len(value)-1] != 0 {
+				t.Error("unexpected avro event", value)
+			}
+			continue
+		}
+		if request["schemaType"] != "PROTOBUF" || !strings.Contains(request["schema"], "message MailEvent") {
+			t.Error("expected the protobuf schema, got", request)
+		}
+		if value[0] != 0 {
+			t.Fatal("expected the message index, got", value[0])
+		}
+		fields := make(map[int][]string)
+		if err := pbFields(value[1:], func(field int, v uint64, data []byte) error {
+			fields[field] = append(fields[field], string(data))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(fields[5], ",") != "bob@Acme.com,eve@other.com" || fields[9][0] != "hello" {
+			t.Error("unexpected protobuf event", fields)
+		}
+	}
+
+	// the registry is needed
+	c := &KafkaProcessorConfig{Brokers: "k1:9092", Topic: "mail", Format: "avro"}
+	if err := c.check(); err == nil {
+		t.Error("expected avro without a registry to be refused")
+	}
+	if _, err := newSchemaRegistry("registry:8081", "", "", "avro"); err == nil {
+		t.Error("expected an invalid url to be refused")
+	}
+}
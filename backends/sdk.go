@@ -0,0 +1,92 @@
+package backends
+
+import (
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// LoadConfig returns an initializer that fills config, a pointer to a processor's config struct,
+// from the backend config when the backend initializes, then calls validate (if not nil)
+// to check the values or to set up connections. Use it with Svc.AddInitializer:
+//
+//	config := &MyConfig{}
+//	Svc.AddInitializer(LoadConfig(config, func() error {
+//		return nil
+//	}))
+func LoadConfig(config BaseConfig, validate func() error) InitializeWith {
+	return func(backendConfig BackendConfig) error {
+		if _, err := Svc.ExtractConfig(backendConfig, config); err != nil {
+			return err
+		}
+		if validate != nil {
+			return validate()
+		}
+		return nil
+	}
+}
+
+// ProcessorHarness runs processors without a gateway or server, for testing them.
+// It uses the global Svc to initialize the processors, so it must not be used
+// while a backend is running
+type ProcessorHarness struct {
+	p Processor
+}
+
+// NewProcessorHarness builds a stack from the processor constructors, in the order they would
+// appear in save_process, and initializes it with the config
+func NewProcessorHarness(config BackendConfig, constructors ...ProcessorConstructor) (*ProcessorHarness, error) {
+	Svc.reset()
+	// the last processor is called last, so it's decorated first
+	ds := make([]Decorator, len(constructors))
+	for i := range constructors {
+		ds[len(constructors)-1-i] = constructors[i]()
+	}
+	h := &ProcessorHarness{p: Decorate(DefaultProcessor{}, ds...)}
+	if errs := Svc.initialize(config); errs != nil {
+		return nil, errs
+	}
+	return h, nil
+}
+
+// Envelope returns a new envelope with the sender, recipients and data, and with the headers parsed
+func (h *ProcessorHarness) Envelope(from string, data string, to ...string) (*mail.Envelope, error) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	if from != "" {
+		addr, err := mail.NewAddress(from)
+		if err != nil {
+			return nil, err
+		}
+		e.MailFrom = *addr
+	} else {
+		e.MailFrom = mail.Address{NullPath: true}
+	}
+	for _, rcpt := range to {
+		addr, err := mail.NewAddress(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		e.PushRcpt(*addr)
+	}
+	e.Data.WriteString(data)
+	// headers are optional
+	_ = e.ParseHeaders()
+	return e, nil
+}
+
+// Save runs the processors with the TaskSaveMail task.
+// When all the processors pass the email on, the result's code is 200
+func (h *ProcessorHarness) Save(e *mail.Envelope) (Result, error) {
+	return h.p.Process(e, TaskSaveMail)
+}
+
+// ValidateRcpt runs the processors with the TaskValidateRcpt task, for the last recipient
+func (h *ProcessorHarness) ValidateRcpt(e *mail.Envelope) (Result, error) {
+	return h.p.Process(e, TaskValidateRcpt)
+}
+
+// Shutdown calls the processors' shutdowners
+func (h *ProcessorHarness) Shutdown() error {
+	if errs := Svc.shutdown(); errs != nil {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestProcessorHarness(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	h, err := NewProcessorHarness(BackendConfig{"primary_mail_host": "example.com"}, Hasher, Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := h.Envelope("sender@example.com", "Subject: test\n\nhello\n", "rcpt@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Subject != "test" || len(e.RcptTo) != 1 {
+		t.Error("envelope not set up, got", e.Subject, e.RcptTo)
+	}
+	if result, err := h.Save(e); err != nil || result.Code() != 200 {
+		t.Error("expected a 200 result, got", result, err)
+	}
+	// Header runs after Hasher, so it can use the hash
+	if len(e.Hashes) != 1 || e.DeliveryHeader == "" {
+		t.Error("expected the hash and delivery header to be set")
+	}
+	if err := h.Shutdown(); err != nil {
+		t.Error(err)
+	}
+
+	// the config is checked when initializing
+	if _, err = NewProcessorHarness(BackendConfig{}, Header); err == nil {
+		t.Error("expected an error, primary_mail_host is missing")
+	}
+}
@@ -0,0 +1,244 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// MailIndex is a full-text index of the saved mail, kept in a local directory
+type MailIndex struct {
+	index bleve.Index
+	path  string
+}
+
+// indexedMail is the document that is indexed for a message
+type indexedMail struct {
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Tenant  string    `json:"tenant"`
+	Date    time.Time `json:"date"`
+}
+
+// MailQuery selects messages from the index. The fields that are set must all match
+type MailQuery struct {
+	// Text uses the query string syntax, eg. "invoice +from:alice", and searches all the fields
+	Text string
+	// From and To match an address, or a part of it such as the domain
+	From string
+	To   string
+	// Subject and Body match if they contain all the words
+	Subject string
+	Body    string
+	// Tenant only finds the tenant's messages
+	Tenant string
+	// Limit is the most messages to return, defaults to 20
+	Limit int
+}
+
+// MailHit is a message found by a search, the newest are returned first
+type MailHit struct {
+	QueuedId string    `json:"queued_id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Date     time.Time `json:"date"`
+}
+
+const defaultMailQueryLimit = 20
+
+// SearchIndex is the index kept by the searchindex processor, nil if the processor is not used
+var SearchIndex *MailIndex
+
+var (
+	searchIndexGuard sync.Mutex
+	// how many processors use the SearchIndex
+	searchIndexUsers int
+)
+
+// newMailIndexMapping indexes the tenant as a single term, and the other fields as text.
+// Only the body is not stored
+func newMailIndexMapping() *mapping.IndexMappingImpl {
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = standard.Name
+	body := bleve.NewTextFieldMapping()
+	body.Analyzer = standard.Name
+	body.Store = false
+	tenant := bleve.NewTextFieldMapping()
+	tenant.Analyzer = keyword.Name
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("from", text)
+	doc.AddFieldMappingsAt("to", text)
+	doc.AddFieldMappingsAt("subject", text)
+	doc.AddFieldMappingsAt("body", body)
+	doc.AddFieldMappingsAt("tenant", tenant)
+	doc.AddFieldMappingsAt("date", bleve.NewDateTimeFieldMapping())
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = standard.Name
+	return m
+}
+
+// OpenMailIndex opens the index in the directory at path, creating it if it does not exist
+func OpenMailIndex(path string) (*MailIndex, error) {
+	var index bleve.Index
+	var err error
+	if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+		index, err = bleve.New(path, newMailIndexMapping())
+	} else {
+		index, err = bleve.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MailIndex{index: index, path: path}, nil
+}
+
+// Add indexes the message, using e.QueuedId as its id. Only the first maxBody bytes of the body are indexed
+func (ix *MailIndex) Add(e *mail.Envelope, maxBody int) error {
+	doc := indexedMail{
+		From:    e.MailFrom.String(),
+		Subject: e.Subject,
+		Tenant:  e.Tenant,
+		Date:    time.Now(),
+	}
+	for i := range e.RcptTo {
+		doc.To = append(doc.To, e.RcptTo[i].String())
+	}
+	data := e.Data.Bytes()
+	if i := bytes.Index(data, []byte{'\n', '\n'}); i > -1 {
+		data = data[i+2:]
+	}
+	if len(data) > maxBody {
+		data = data[:maxBody]
+	}
+	doc.Body = string(data)
+	return ix.index.Index(e.QueuedId, doc)
+}
+
+// Delete removes a message from the index
+func (ix *MailIndex) Delete(queuedId string) error {
+	return ix.index.Delete(queuedId)
+}
+
+// Search returns the messages that match q, newest first
+func (ix *MailIndex) Search(q MailQuery) ([]MailHit, error) {
+	var queries []query.Query
+	if q.Text != "" {
+		queries = append(queries, bleve.NewQueryStringQuery(q.Text))
+	}
+	for field, value := range map[string]string{"from": q.From, "to": q.To} {
+		if value != "" {
+			mq := bleve.NewMatchPhraseQuery(value)
+			mq.SetField(field)
+			queries = append(queries, mq)
+		}
+	}
+	for field, value := range map[string]string{"subject": q.Subject, "body": q.Body} {
+		if value != "" {
+			mq := bleve.NewMatchQuery(value)
+			mq.SetField(field)
+			mq.SetOperator(query.MatchQueryOperatorAnd)
+			queries = append(queries, mq)
+		}
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+	if q.Tenant != "" {
+		tq := bleve.NewTermQuery(q.Tenant)
+		tq.SetField("tenant")
+		queries = append(queries, tq)
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultMailQueryLimit
+	}
+	req := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(queries...), q.Limit, 0, false)
+	req.Fields = []string{"from", "to", "subject", "tenant", "date"}
+	req.SortBy([]string{"-date"})
+	res, err := ix.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]MailHit, 0, len(res.Hits))
+	for _, h := range res.Hits {
+		hit := MailHit{QueuedId: h.ID}
+		hit.From, _ = h.Fields["from"].(string)
+		hit.Subject, _ = h.Fields["subject"].(string)
+		hit.Tenant, _ = h.Fields["tenant"].(string)
+		// a field with several values is a slice
+		switch to := h.Fields["to"].(type) {
+		case string:
+			hit.To = []string{to}
+		case []interface{}:
+			for _, v := range to {
+				if s, ok := v.(string); ok {
+					hit.To = append(hit.To, s)
+				}
+			}
+		}
+		if date, ok := h.Fields["date"].(string); ok {
+			hit.Date, _ = time.Parse(time.RFC3339, date)
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+// Close closes the index
+func (ix *MailIndex) Close() error {
+	return ix.index.Close()
+}
+
+// useSearchIndex opens the SearchIndex, or returns it if it's open at the same path already.
+// The index can only be opened once, so the processors of all the workers share it
+func useSearchIndex(path string) (*MailIndex, error) {
+	searchIndexGuard.Lock()
+	defer searchIndexGuard.Unlock()
+	if SearchIndex != nil && SearchIndex.path != path {
+		if searchIndexUsers > 0 {
+			return nil, errors.New("the search index is open at " + SearchIndex.path + " already")
+		}
+		_ = SearchIndex.Close()
+		SearchIndex = nil
+	}
+	if SearchIndex == nil {
+		ix, err := OpenMailIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		SearchIndex = ix
+	}
+	searchIndexUsers++
+	return SearchIndex, nil
+}
+
+// releaseSearchIndex closes the SearchIndex when the last processor that used it is shut down
+func releaseSearchIndex() error {
+	searchIndexGuard.Lock()
+	defer searchIndexGuard.Unlock()
+	if searchIndexUsers == 0 {
+		return nil
+	}
+	searchIndexUsers--
+	if searchIndexUsers > 0 || SearchIndex == nil {
+		return nil
+	}
+	err := SearchIndex.Close()
+	SearchIndex = nil
+	return err
+}
@@ -0,0 +1,275 @@
+package backends
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SMTPPoolConfig configures the cache of outbound SMTP sessions, it's read from the backend config
+type SMTPPoolConfig struct {
+	// IdleTimeout is how long an unused session is kept open, eg. "30s". Defaults to 30s
+	IdleTimeout string `json:"smtp_pool_idle_timeout,omitempty"`
+	// MaxReuse is how many messages may be sent in one session, defaults to 100
+	MaxReuse int `json:"smtp_pool_max_reuse,omitempty"`
+	// MaxIdle is how many unused sessions to keep open for each destination, defaults to 4.
+	// Set it to -1 to disable the cache, so that a new session is opened for each message
+	MaxIdle int `json:"smtp_pool_max_idle,omitempty"`
+}
+
+const (
+	defaultSMTPPoolIdleTimeout = time.Second * 30
+	defaultSMTPPoolMaxReuse    = 100
+	defaultSMTPPoolMaxIdle     = 4
+)
+
+// SMTPSession is an outbound SMTP session taken from an SMTPPool.
+// Return it with SMTPPool.Put once the message has been sent
+type SMTPSession struct {
+	*smtp.Client
+	key      string
+	uses     int
+	lastUsed time.Time
+}
+
+// Uses returns how many times the session was taken from the pool, including this time
+func (s *SMTPSession) Uses() int {
+	return s.uses
+}
+
+// SMTPPoolStats are the counters kept by the SMTPPool
+type SMTPPoolStats struct {
+	// Dials is how many sessions were opened
+	Dials int64
+	// Reuses is how many times an open session was used for another message
+	Reuses int64
+	// Idle is how many sessions are open and unused
+	Idle int
+}
+
+// SMTPPool caches open SMTP sessions for each destination, so that relaying processors
+// don't connect, greet and negotiate TLS again for every message
+type SMTPPool struct {
+	idleTimeout time.Duration
+	maxReuse    int
+	maxIdle     int
+
+	// idle sessions for each destination, the most recently used last
+	idle   map[string][]*SMTPSession
+	dials  int64
+	reuses int64
+	closed bool
+	sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// SMTPSessions are the outbound sessions that relaying processors should use.
+// It's configured by the smtp_pool_* options when the backend is initialized
+var SMTPSessions = NewSMTPPool(0, 0, 0)
+
+// NewSMTPPool returns a pool, using the defaults for values of 0. Call Start to close idle sessions
+// in the background
+func NewSMTPPool(idleTimeout time.Duration, maxReuse, maxIdle int) *SMTPPool {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultSMTPPoolIdleTimeout
+	}
+	if maxReuse <= 0 {
+		maxReuse = defaultSMTPPoolMaxReuse
+	}
+	if maxIdle == 0 {
+		maxIdle = defaultSMTPPoolMaxIdle
+	}
+	return &SMTPPool{
+		idleTimeout: idleTimeout,
+		maxReuse:    maxReuse,
+		maxIdle:     maxIdle,
+		idle:        make(map[string][]*SMTPSession),
+	}
+}
+
+// Get returns an open session for the destination identified by key, eg. "mx.example.com:25".
+// The key should also identify anything negotiated by dial, such as the TLS config or credentials.
+// A cached session is checked with RSET before it's returned, otherwise dial is called to open a new one.
+// dial should return a client that is ready for the MAIL command
+func (p *SMTPPool) Get(key string, dial func() (*smtp.Client, error)) (*SMTPSession, error) {
+	for {
+		s := p.pop(key)
+		if s == nil {
+			break
+		}
+		if err := s.Reset(); err != nil {
+			// the server probably timed it out
+			_ = s.Close()
+			continue
+		}
+		s.uses++
+		atomic.AddInt64(&p.reuses, 1)
+		return s, nil
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&p.dials, 1)
+	return &SMTPSession{Client: c, key: key, uses: 1}, nil
+}
+
+// pop takes the most recently used session that has not timed out
+func (p *SMTPPool) pop(key string) *SMTPSession {
+	p.Lock()
+	defer p.Unlock()
+	sessions := p.idle[key]
+	for len(sessions) > 0 {
+		s := sessions[len(sessions)-1]
+		sessions = sessions[:len(sessions)-1]
+		if time.Since(s.lastUsed) < p.idleTimeout {
+			p.idle[key] = sessions
+			return s
+		}
+		// the older sessions timed out too
+		for _, old := range append(sessions, s) {
+			go quitSMTPSession(old)
+		}
+		sessions = nil
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// Put returns the session to the pool. If err is not nil, or the session was used MaxReuse times,
+// it's closed instead. err should be the last error from the session. A session that got
+// an error reply (a *textproto.Error, eg. 550 for a recipient) can still be reused, but one
+// that had a network error cannot
+func (p *SMTPPool) Put(s *SMTPSession, err error) {
+	if _, ok := err.(*textproto.Error); err != nil && !ok {
+		_ = s.Close()
+		return
+	}
+	if s.uses >= p.maxReuse || p.maxIdle < 0 {
+		go quitSMTPSession(s)
+		return
+	}
+	s.lastUsed = time.Now()
+	p.Lock()
+	if p.closed || len(p.idle[s.key]) >= p.maxIdle {
+		p.Unlock()
+		go quitSMTPSession(s)
+		return
+	}
+	p.idle[s.key] = append(p.idle[s.key], s)
+	p.Unlock()
+}
+
+// quitSMTPSession ends the session politely
+func quitSMTPSession(s *SMTPSession) {
+	if err := s.Quit(); err != nil {
+		_ = s.Close()
+	}
+}
+
+// Stats returns the pool's counters
+func (p *SMTPPool) Stats() SMTPPoolStats {
+	p.Lock()
+	defer p.Unlock()
+	idle := 0
+	for _, sessions := range p.idle {
+		idle += len(sessions)
+	}
+	return SMTPPoolStats{
+		Dials:  atomic.LoadInt64(&p.dials),
+		Reuses: atomic.LoadInt64(&p.reuses),
+		Idle:   idle,
+	}
+}
+
+// Start closes the sessions that were idle for longer than the idle timeout, in the background
+func (p *SMTPPool) Start() {
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.idleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.expire()
+			}
+		}
+	}()
+}
+
+// expire closes the sessions that timed out
+func (p *SMTPPool) expire() {
+	var expired []*SMTPSession
+	p.Lock()
+	for key, sessions := range p.idle {
+		keep := sessions[:0]
+		for _, s := range sessions {
+			if time.Since(s.lastUsed) >= p.idleTimeout {
+				expired = append(expired, s)
+			} else {
+				keep = append(keep, s)
+			}
+		}
+		if len(keep) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = keep
+		}
+	}
+	p.Unlock()
+	for _, s := range expired {
+		quitSMTPSession(s)
+	}
+}
+
+// Stop stops the background expiry and closes all idle sessions.
+// Sessions that are in use are closed when they are returned
+func (p *SMTPPool) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
+	}
+	p.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*SMTPSession)
+	p.closed = true
+	p.Unlock()
+	for _, sessions := range idle {
+		for _, s := range sessions {
+			quitSMTPSession(s)
+		}
+	}
+}
+
+// configureSMTPPool replaces SMTPSessions with a pool configured by the backend config
+func configureSMTPPool(backendConfig BackendConfig) error {
+	configType := BaseConfig(&SMTPPoolConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return err
+	}
+	config := bcfg.(*SMTPPoolConfig)
+	var idleTimeout time.Duration
+	if config.IdleTimeout != "" {
+		if idleTimeout, err = time.ParseDuration(config.IdleTimeout); err != nil {
+			return err
+		}
+	}
+	pool := NewSMTPPool(idleTimeout, config.MaxReuse, config.MaxIdle)
+	pool.Start()
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		pool.Stop()
+		return nil
+	}))
+	SMTPSessions = pool
+	return nil
+}
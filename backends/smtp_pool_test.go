@@ -0,0 +1,155 @@
+package backends
+
+import (
+	"bufio"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// fakeSMTPServer accepts connections and answers every command with 250, except QUIT.
+// It counts the connections, and the connections that were closed
+type fakeSMTPServer struct {
+	l      net.Listener
+	conns  int64
+	closed int64
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		atomic.AddInt64(&s.closed, 1)
+	}()
+	r := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("220 fake ESMTP\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(strings.ToUpper(line), "QUIT") {
+			_, _ = conn.Write([]byte("221 bye\r\n"))
+			return
+		}
+		_, _ = conn.Write([]byte("250 ok\r\n"))
+	}
+}
+
+func (s *fakeSMTPServer) dial() (*smtp.Client, error) {
+	c, err := smtp.Dial(s.l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Hello("test.example.com"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestSMTPPool(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer func() {
+		_ = server.l.Close()
+	}()
+	key := server.l.Addr().String()
+	pool := NewSMTPPool(time.Millisecond*200, 3, 1)
+
+	// sending in a row uses the same session, until it has been used 3 times
+	for i := 1; i <= 4; i++ {
+		s, err := pool.Get(key, server.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := (i-1)%3 + 1; s.Uses() != expect {
+			t.Error("expected the session to be used", expect, "times, but got", s.Uses())
+		}
+		pool.Put(s, nil)
+	}
+	if stats := pool.Stats(); stats.Dials != 2 || stats.Reuses != 2 || stats.Idle != 1 {
+		t.Error("unexpected stats", stats)
+	}
+
+	// only one idle session is kept, the other is closed
+	a, _ := pool.Get(key, server.dial)
+	b, _ := pool.Get(key, server.dial)
+	pool.Put(a, nil)
+	pool.Put(b, nil)
+	if stats := pool.Stats(); stats.Dials != 3 || stats.Idle != 1 {
+		t.Error("unexpected stats", stats)
+	}
+
+	// a reply error leaves the session usable, other errors don't
+	errPool := NewSMTPPool(0, 0, 0)
+	s, _ := errPool.Get(key, server.dial)
+	errPool.Put(s, &textproto.Error{Code: 550, Msg: "no such user"})
+	if errPool.Stats().Idle != 1 {
+		t.Error("expected the session to be kept after an error reply")
+	}
+	s, _ = errPool.Get(key, server.dial)
+	errPool.Put(s, net.ErrWriteToConnected)
+	if stats := errPool.Stats(); stats.Idle != 0 || stats.Dials != 1 {
+		t.Error("expected the session to be closed after a network error", stats)
+	}
+	errPool.Stop()
+
+	// idle sessions are closed in the background
+	s, _ = pool.Get(key, server.dial)
+	pool.Put(s, nil)
+	pool.Start()
+	time.Sleep(time.Millisecond * 400)
+	if stats := pool.Stats(); stats.Idle != 0 {
+		t.Error("expected the idle session to time out, got", stats)
+	}
+	pool.Stop()
+	time.Sleep(time.Millisecond * 50)
+	if conns, closed := atomic.LoadInt64(&server.conns), atomic.LoadInt64(&server.closed); conns != closed {
+		t.Error("expected all", conns, "sessions to be closed, but", closed, "were")
+	}
+}
+
+func TestConfigureSMTPPool(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	defer func() {
+		_ = Svc.shutdown()
+	}()
+	if err := configureSMTPPool(BackendConfig{
+		"smtp_pool_idle_timeout": "1m",
+		"smtp_pool_max_reuse":    10,
+		"smtp_pool_max_idle":     2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if SMTPSessions.idleTimeout != time.Minute || SMTPSessions.maxReuse != 10 || SMTPSessions.maxIdle != 2 {
+		t.Error("the pool was not configured", SMTPSessions)
+	}
+	if err := configureSMTPPool(BackendConfig{"smtp_pool_idle_timeout": "soon"}); err == nil {
+		t.Error("expected an error for a bad idle timeout")
+	}
+}
@@ -0,0 +1,293 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// spamResult is what a spam scanner found
+type spamResult struct {
+	score    float64
+	required float64
+	// symbols are the names of the rules that matched
+	symbols []string
+}
+
+// spamScanner sends the emails to a spam scanner
+type spamScanner interface {
+	check(e *mail.Envelope) (*spamResult, error)
+	// ping checks that the scanner answers, for the health check
+	ping() error
+	// name is the name of the software, for the verdict
+	name() string
+}
+
+// newSpamScanner returns the scanner for the URL: rspamd's HTTP API for http and https,
+// SpamAssassin's spamd for spamd://host:port, or spamd:///path for a unix socket
+func newSpamScanner(rawURL string, timeout time.Duration) (spamScanner, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if !strings.HasSuffix(u.Path, "/checkv2") {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/checkv2"
+		}
+		s := &rspamdScanner{url: u.String(), client: &http.Client{Timeout: timeout}}
+		u.Path = strings.TrimSuffix(u.Path, "/checkv2") + "/ping"
+		s.pingURL = u.String()
+		return s, nil
+	case "spamd":
+		s := &spamdScanner{network: "tcp", address: u.Host, timeout: timeout}
+		if u.Host == "" {
+			s.network, s.address = "unix", u.Path
+		} else if u.Port() == "" {
+			s.address = net.JoinHostPort(u.Host, "783")
+		}
+		if s.address == "" {
+			return nil, errors.New("the spamd URL has no address")
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %q, expecting http, https or spamd", u.Scheme)
+}
+
+// rspamdScanner checks the emails with rspamd's /checkv2 endpoint
+type rspamdScanner struct {
+	url     string
+	pingURL string
+	client  *http.Client
+}
+
+// ping checks that rspamd's /ping endpoint answers pong
+func (s *rspamdScanner) ping() error {
+	resp, err := s.client.Get(s.pingURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(strings.TrimSpace(string(body)), "pong") {
+		return fmt.Errorf("rspamd: unexpected reply to ping %s %q", resp.Status, body)
+	}
+	return nil
+}
+
+func (s *rspamdScanner) name() string {
+	return "rspamd"
+}
+
+// rspamdReply is the part of the reply of /checkv2 that's used
+type rspamdReply struct {
+	Score    float64                `json:"score"`
+	Required float64                `json:"required_score"`
+	Symbols  map[string]interface{} `json:"symbols"`
+}
+
+func (s *rspamdScanner) check(e *mail.Envelope) (*spamResult, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, e.NewReader())
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(e.Len())
+	// the envelope, which rspamd can't tell from the message
+	req.Header.Set("IP", e.RemoteIP)
+	req.Header.Set("Helo", e.Helo)
+	req.Header.Set("Queue-Id", e.QueuedId)
+	if !e.MailFrom.IsEmpty() {
+		req.Header.Set("From", e.MailFrom.String())
+	}
+	for i := range e.RcptTo {
+		req.Header.Add("Rcpt", e.RcptTo[i].String())
+	}
+	if e.AuthorizedLogin != "" {
+		req.Header.Set("User", e.AuthorizedLogin)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd returned %s", resp.Status)
+	}
+	var reply rspamdReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	r := &spamResult{score: reply.Score, required: reply.Required}
+	for name := range reply.Symbols {
+		r.symbols = append(r.symbols, name)
+	}
+	sort.Strings(r.symbols)
+	return r, nil
+}
+
+// spamdScanner checks the emails with SpamAssassin's spamd, with the SYMBOLS command
+type spamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// ping checks that spamd answers the PING command
+func (s *spamdScanner) ping() error {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	if _, err := conn.Write([]byte("PING SPAMC/1.5\r\n\r\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return err
+	}
+	// eg. "SPAMD/1.5 0 PONG"
+	if fields := strings.Fields(line); len(fields) < 3 || fields[1] != "0" || fields[2] != "PONG" {
+		return fmt.Errorf("spamd: unexpected reply to PING %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+func (s *spamdScanner) name() string {
+	return "SpamAssassin"
+}
+
+func (s *spamdScanner) check(e *mail.Envelope) (*spamResult, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	w := bufio.NewWriter(conn)
+	_, _ = fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", e.Len())
+	if e.AuthorizedLogin != "" {
+		_, _ = fmt.Fprintf(w, "User: %s\r\n", e.AuthorizedLogin)
+	}
+	_, _ = w.WriteString("\r\n")
+	if _, err := io.Copy(w, e.NewReader()); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readSpamdReply(bufio.NewReader(conn))
+}
+
+// readSpamdReply reads eg. "SPAMD/1.1 0 EX_OK", the headers with "Spam: True ; 7.3 / 5.0",
+// and the names of the rules that matched, separated with commas
+func readSpamdReply(r *bufio.Reader) (*spamResult, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status := strings.Fields(line)
+	if len(status) < 3 || !strings.HasPrefix(status[0], "SPAMD/") {
+		return nil, fmt.Errorf("unexpected reply from spamd: %q", strings.TrimSpace(line))
+	} else if status[1] != "0" {
+		return nil, fmt.Errorf("spamd returned %s", strings.Join(status[1:], " "))
+	}
+	var result *spamResult
+	for {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "Spam") {
+			continue
+		}
+		// True ; 7.3 / 5.0
+		parts := strings.SplitN(kv[1], ";", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected spamd header %q", line)
+		}
+		scores := strings.SplitN(parts[1], "/", 2)
+		if len(scores) != 2 {
+			return nil, fmt.Errorf("unexpected spamd header %q", line)
+		}
+		result = &spamResult{}
+		if result.score, err = strconv.ParseFloat(strings.TrimSpace(scores[0]), 64); err == nil {
+			result.required, err = strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unexpected spamd header %q", line)
+		}
+	}
+	if result == nil {
+		return nil, errors.New("spamd didn't return a score")
+	}
+	symbols, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(string(symbols), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			result.symbols = append(result.symbols, name)
+		}
+	}
+	return result, nil
+}
+
+// prefixSubject adds the prefix to the Subject header of the message, or adds a Subject when
+// it has none. The rest of the message is left as it is
+func prefixSubject(data []byte, prefix string) []byte {
+	for offset := 0; offset < len(data); {
+		end := len(data)
+		if i := bytes.IndexByte(data[offset:], '\n'); i >= 0 {
+			end = offset + i + 1
+		}
+		line := strings.TrimRight(string(data[offset:end]), "\r\n")
+		if line == "" {
+			// the end of the header
+			break
+		}
+		folded := line[0] == ' ' || line[0] == '\t'
+		if i := strings.IndexByte(line, ':'); i > 0 && !folded && strings.EqualFold(strings.TrimSpace(line[:i]), "Subject") {
+			at := offset + i + 1
+			for at < end && (data[at] == ' ' || data[at] == '\t') {
+				at++
+			}
+			if bytes.HasPrefix(data[at:end], []byte(strings.TrimSpace(prefix))) {
+				return data
+			}
+			out := make([]byte, 0, len(data)+len(prefix))
+			out = append(out, data[:at]...)
+			out = append(out, prefix...)
+			return append(out, data[at:]...)
+		}
+		offset = end
+	}
+	return append([]byte("Subject: "+strings.TrimSpace(prefix)+"\n"), data...)
+}
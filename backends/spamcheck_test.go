@@ -0,0 +1,198 @@
+package backends
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadSpamdReply(t *testing.T) {
+	r, err := readSpamdReply(bufio.NewReader(strings.NewReader(
+		"SPAMD/1.1 0 EX_OK\r\nContent-length: 20\r\nSpam: True ; 7.3 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.score != 7.3 || r.required != 5 || strings.Join(r.symbols, ",") != "BAYES_99,URIBL_BLACK" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if _, err := readSpamdReply(bufio.NewReader(strings.NewReader("SPAMD/1.0 76 Bad header line\r\n"))); err == nil {
+		t.Error("expected an error reply to fail")
+	}
+	if _, err := readSpamdReply(bufio.NewReader(strings.NewReader("SPAMD/1.1 0 EX_OK\r\n\r\n"))); err == nil {
+		t.Error("expected a reply without a score to fail")
+	}
+}
+
+func TestPrefixSubject(t *testing.T) {
+	for in, want := range map[string]string{
+		"From: a@b.com\nsubject:\thello\n\tthere\n\nSubject: body\n": "From: a@b.com\nsubject:\t[SPAM] hello\n\tthere\n\nSubject: body\n",
+		"Subject: [SPAM] hello\n\nhi\n":                              "Subject: [SPAM] hello\n\nhi\n",
+		"From: a@b.com\n X-Subject: no\n\nhi\n":                      "Subject: [SPAM]\nFrom: a@b.com\n X-Subject: no\n\nhi\n",
+	} {
+		if got := string(prefixSubject([]byte(in), "[SPAM] ")); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestSpamCheckRspamd(t *testing.T) {
+	score := "12"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/checkv2" || r.Header.Get("IP") != "127.0.0.1" || len(r.Header["Rcpt"]) != 2 ||
+			!strings.Contains(string(body), "Subject: hello") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"score": %s, "required_score": 15, "action": "add header",
+			"symbols": {"R_SPF_FAIL": {"score": 1}, "BAYES_SPAM": {"score": 5}}}`, score)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "spamcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "mail.db")
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":            "HeadersParser|Header|Hasher|SpamCheck|SQLite",
+		"primary_mail_host":       "example.com",
+		"spamcheck_url":           server.URL,
+		"spamcheck_spam_score":    10.0,
+		"spamcheck_reject_score":  20.0,
+		"spamcheck_subject_score": 10.0,
+		"spamcheck_headers":       true,
+		"sqlite_file":             file,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	verdicts := GetVerdicts(e)
+	if len(verdicts) != 1 || verdicts[0].Result != "yes" || verdicts[0].Required != 10 ||
+		verdicts[0].Reason != "BAYES_SPAM,R_SPF_FAIL" || verdicts[0].Scanner != "rspamd" || SpamScore(e) != 12 {
+		t.Fatalf("unexpected verdicts %+v", verdicts)
+	}
+	if !strings.HasPrefix(e.Data.String(), "Subject: [SPAM] hello\n") || e.Subject != "[SPAM] hello" ||
+		e.Header.Get("Subject") != "[SPAM] hello" {
+		t.Error("expected the subject to be tagged, got", e.Subject)
+	}
+	if !strings.Contains(e.DeliveryHeader, "X-Spam-Flag: YES\nX-Spam-Score: 12.0\nX-Spam-Status: Yes, score=12.0") {
+		t.Error("expected the X-Spam headers, got", e.DeliveryHeader)
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	var saved float64
+	if err := db.QueryRow("SELECT spam_score FROM mail LIMIT 1").Scan(&saved); err != nil || saved != 12 {
+		t.Error("expected the score to be saved, got", saved, err)
+	}
+
+	score = "25"
+	if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "550 5.7.1") {
+		t.Error("expected the mail to be rejected, got", result)
+	}
+}
+
+// spamdTestServer answers each connection with the score
+func spamdTestServer(t *testing.T, score float64) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			length := 0
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+				if strings.HasPrefix(line, "PING ") {
+					_, _ = conn.Write([]byte("SPAMD/1.5 0 PONG\r\n"))
+				}
+				if strings.HasPrefix(line, "Content-length: ") {
+					length, _ = strconv.Atoi(strings.TrimSpace(line[len("Content-length: "):]))
+				}
+			}
+			_, _ = io.CopyN(ioutil.Discard, r, int64(length))
+			_, _ = fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: True ; %.1f / 5.0\r\n\r\nBAYES_99", score)
+			_ = conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestSpamCheckSpamd(t *testing.T) {
+	listener := spamdTestServer(t, 8)
+	defer func() {
+		_ = listener.Close()
+	}()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":           "SpamCheck|Debugger",
+		"spamcheck_url":          "spamd://" + listener.Addr().String(),
+		"spamcheck_reject_score": 7.5,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "550 5.7.1") {
+		t.Fatal("expected the mail to be rejected, got", result)
+	}
+	if v := GetVerdicts(e); len(v) != 1 || v[0].Score != 8 || v[0].Required != 5 || v[0].Scanner != "SpamAssassin" {
+		t.Errorf("unexpected verdicts %+v", v)
+	}
+}
+
+func TestSpamCheckUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	for _, tempfail := range []bool{false, true} {
+		backend := newBrokerTestBackend(t, BackendConfig{
+			"save_process":       "SpamCheck|Debugger",
+			"spamcheck_url":      "spamd://" + addr,
+			"spamcheck_tempfail": tempfail,
+		})
+		e := newBrokerTestEnvelope()
+		result := backend.Process(e)
+		if tempfail && !strings.HasPrefix(result.String(), "451") {
+			t.Error("expected the mail to be deferred, got", result)
+		} else if !tempfail && !strings.HasPrefix(result.String(), "250") {
+			t.Error("expected the mail to be passed on, got", result)
+		}
+		if len(GetVerdicts(e)) != 0 {
+			t.Error("expected no verdict")
+		}
+		_ = backend.Shutdown()
+	}
+}
@@ -0,0 +1,250 @@
+package backends
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// sqlBatchRequest is the rows of an email, waiting to be inserted with the rows of other emails
+type sqlBatchRequest struct {
+	tenant string
+	rows   [][]interface{}
+	// done gets the result of the insert
+	done chan error
+}
+
+// sqlBatcher inserts the rows of the emails saved by all the workers with multi-row INSERTs.
+// Unlike the elasticsearch indexer, the workers wait for their rows to be inserted, so an
+// email isn't accepted before it's saved
+type sqlBatcher struct {
+	// s has the prepared statements, and is only used by run
+	s        *SQLProcessor
+	db       *sql.DB
+	size     int
+	interval time.Duration
+	queue    chan *sqlBatchRequest
+	stop     chan struct{}
+	done     chan struct{}
+	// how many processors use the batcher
+	users int
+}
+
+var (
+	sqlBatchersGuard sync.Mutex
+	// the batchers of the processors, by their config, so that the workers share the batches
+	sqlBatchers = make(map[string]*sqlBatcher)
+)
+
+// useSQLBatcher returns the batcher for the config, connecting and starting it if it's not used already
+func useSQLBatcher(config *SQLProcessorConfig, interval time.Duration) (*sqlBatcher, error) {
+	key := fmt.Sprintf("%+v", *config)
+	sqlBatchersGuard.Lock()
+	defer sqlBatchersGuard.Unlock()
+	if b, ok := sqlBatchers[key]; ok {
+		b.users++
+		return b, nil
+	}
+	s := &SQLProcessor{config: config}
+	// the columns were checked by the processor
+	s.columns, _ = parseSQLColumns("sql_columns", config.Columns)
+	db, err := s.connect()
+	if isSQLConnError(err) {
+		Log().WithError(err).Warn("sql: the database can't be reached, it will be tried again")
+		s.backoff.failed()
+	} else if err != nil {
+		return nil, err
+	}
+	b := &sqlBatcher{
+		s:        s,
+		db:       db,
+		size:     config.BatchSize,
+		interval: interval,
+		queue:    make(chan *sqlBatchRequest, config.BatchSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		users:    1,
+	}
+	sqlBatchers[key] = b
+	go b.run()
+	return b, nil
+}
+
+// release stops the batcher and closes its database when the last processor that used it
+// is shut down. The rows in the queue are inserted first
+func (b *sqlBatcher) release() error {
+	sqlBatchersGuard.Lock()
+	b.users--
+	last := b.users == 0
+	if last {
+		for key, v := range sqlBatchers {
+			if v == b {
+				delete(sqlBatchers, key)
+			}
+		}
+	}
+	sqlBatchersGuard.Unlock()
+	if !last {
+		return nil
+	}
+	close(b.stop)
+	<-b.done
+	return closeSQLPool(b.db)
+}
+
+// insert queues the rows of an email and waits until they're inserted
+func (b *sqlBatcher) insert(tenant string, rows [][]interface{}) error {
+	r := &sqlBatchRequest{tenant: tenant, rows: rows, done: make(chan error, 1)}
+	b.queue <- r
+	return <-r.done
+}
+
+func (b *sqlBatcher) run() {
+	defer close(b.done)
+	var batch []*sqlBatchRequest
+	var rows int
+	// the timer starts with the first email of a batch, so that no email waits longer
+	// than the interval
+	var timer *time.Timer
+	var expired <-chan time.Time
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if len(batch) > 0 {
+			b.flush(batch)
+		}
+		batch, rows = nil, 0
+	}
+	add := func(r *sqlBatchRequest) {
+		batch = append(batch, r)
+		rows += len(r.rows)
+		if rows >= b.size {
+			flush()
+		} else if timer == nil {
+			timer = time.NewTimer(b.interval)
+			expired = timer.C
+		}
+	}
+	for {
+		select {
+		case r := <-b.queue:
+			add(r)
+		case <-expired:
+			flush()
+		case <-b.stop:
+			for {
+				select {
+				case r := <-b.queue:
+					add(r)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush inserts the rows of the batch, table by table. When an INSERT fails, the rows of each
+// email in it are inserted on their own, so that one bad row doesn't fail the other emails
+func (b *sqlBatcher) flush(batch []*sqlBatchRequest) {
+	var tenants []string
+	byTenant := make(map[string][]*sqlBatchRequest)
+	for _, r := range batch {
+		if _, ok := byTenant[r.tenant]; !ok {
+			tenants = append(tenants, r.tenant)
+		}
+		byTenant[r.tenant] = append(byTenant[r.tenant], r)
+	}
+	for _, tenant := range tenants {
+		var rows [][]interface{}
+		reqs := byTenant[tenant]
+		for _, r := range reqs {
+			rows = append(rows, r.rows...)
+		}
+		err := b.exec(tenant, rows)
+		for _, r := range reqs {
+			if err != nil && len(reqs) > 1 && !isSQLConnError(err) {
+				r.done <- b.exec(tenant, r.rows)
+				continue
+			}
+			r.done <- err
+		}
+	}
+}
+
+// exec inserts the rows with as few statements as the batch size allows
+func (b *sqlBatcher) exec(tenant string, rows [][]interface{}) error {
+	return b.s.insert(b.db, tenant, rows, b.size)
+}
+
+// sqlWriteBehindRows is the rows of an email, buffered while the database is away
+type sqlWriteBehindRows struct {
+	tenant string
+	rows   [][]interface{}
+}
+
+func sqlWriteBehindItem(e *mail.Envelope, rows [][]interface{}) writeBehindItem {
+	size := 0
+	for _, row := range rows {
+		size += writeBehindSize(row...)
+	}
+	return writeBehindItem{id: e.QueuedId, size: size, value: sqlWriteBehindRows{tenant: e.Tenant, rows: rows}}
+}
+
+// useSQLWriteBehind returns the write-behind buffer for the config. It has its own connection,
+// and inserts the buffered rows of up to GuerrillaDBAndRedisBatchMax emails at a time
+func useSQLWriteBehind(config *SQLProcessorConfig) (*writeBehind, error) {
+	stall := defaultWriteBehindStall
+	if config.WriteBehindTime != "" {
+		var err error
+		if stall, err = time.ParseDuration(config.WriteBehindTime); err != nil || stall <= 0 {
+			return nil, fmt.Errorf("invalid sql_write_behind_time %q", config.WriteBehindTime)
+		}
+	}
+	return useWriteBehind(fmt.Sprintf("sql %+v", *config), func() (*writeBehind, error) {
+		s := &SQLProcessor{config: config}
+		s.columns, _ = parseSQLColumns("sql_columns", config.Columns)
+		db, err := s.connect()
+		if isSQLConnError(err) {
+			s.backoff.failed()
+		} else if err != nil {
+			return nil, err
+		}
+		return &writeBehind{
+			name:     "sql",
+			maxBytes: config.WriteBehindSize,
+			maxStall: stall,
+			batch:    GuerrillaDBAndRedisBatchMax,
+			write: func(items []writeBehindItem) (int, error) {
+				// the rows of the emails for the same table are inserted together, without
+				// splitting an email's rows over two statements, so that the count is right
+				done := 0
+				for done < len(items) {
+					first := items[done].value.(sqlWriteBehindRows)
+					rows, n := append([][]interface{}(nil), first.rows...), 1
+					for done+n < len(items) {
+						r := items[done+n].value.(sqlWriteBehindRows)
+						if r.tenant != first.tenant || len(rows)+len(r.rows) > GuerrillaDBAndRedisBatchMax {
+							break
+						}
+						rows = append(rows, r.rows...)
+						n++
+					}
+					if err := s.insert(db, first.tenant, rows, GuerrillaDBAndRedisBatchMax); err != nil {
+						return done, err
+					}
+					done += n
+				}
+				return done, nil
+			},
+			retry: isSQLConnError,
+			close: db.Close,
+		}, nil
+	})
+}
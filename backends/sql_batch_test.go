@@ -0,0 +1,169 @@
+package backends
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sqlBatchTestDB creates a SQLite file with the table of the sql processor, SQLite accepts
+// its multi-row INSERT with CURRENT_TIMESTAMP instead of NOW()
+func sqlBatchTestDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sqlbatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "mail.db")
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	for _, q := range sqliteSchema("mail") {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return file, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+const sqlBatchTestValues = "(CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, 0, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?)"
+
+func countSQLBatchTestRows(t *testing.T, file string) int {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mail").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestSQLBatcher(t *testing.T) {
+	file, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	config := &SQLProcessorConfig{
+		Table:     "mail",
+		Driver:    "sqlite3",
+		DSN:       file,
+		SQLValues: sqlBatchTestValues,
+		BatchSize: 4,
+	}
+	b, err := useSQLBatcher(config, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := useSQLBatcher(config, time.Hour); other != b {
+		t.Error("expected the workers to share the batcher")
+	}
+	row := func(hash string) []interface{} {
+		return []interface{}{"to", "from", "subject", "", "mail", hash, "text/plain", "rcpt",
+			[]byte{127, 0, 0, 1}, "from", false, "mid", "", ""}
+	}
+
+	// the batch is inserted when it's full, it would otherwise wait for an hour
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rows := [][]interface{}{row("h")}
+			if i == 3 {
+				// a bad row only fails its own email
+				rows = [][]interface{}{{"to"}}
+			}
+			errs[i] = b.insert("", rows)
+		}(i)
+	}
+	wg.Wait()
+	if errs[0] != nil || errs[1] != nil || errs[2] != nil || errs[3] == nil {
+		t.Error("expected only the email with a bad row to fail, got", errs)
+	}
+	if b.s.cache["mail"][3] == nil {
+		t.Error("expected a statement inserting 4 rows")
+	}
+	if n := countSQLBatchTestRows(t, file); n != 3 {
+		t.Error("expected 3 rows, got", n)
+	}
+
+	// more rows than the batch size are inserted with several statements
+	rows := make([][]interface{}, 6)
+	for i := range rows {
+		rows[i] = row("big")
+	}
+	if err := b.insert("", rows); err != nil {
+		t.Error("expected the rows to be inserted, got", err)
+	}
+	if n := countSQLBatchTestRows(t, file); n != 9 {
+		t.Error("expected 9 rows, got", n)
+	}
+
+	_ = b.release()
+	if err := b.release(); err != nil {
+		t.Error("expected the database to be closed by the last user, got", err)
+	}
+	if len(sqlBatchers) != 0 {
+		t.Error("expected the batcher to be removed")
+	}
+}
+
+func TestSQLProcessorBatch(t *testing.T) {
+	file, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":       "HeadersParser|Hasher|sql",
+		"save_workers_size":  3,
+		"mail_table":         "mail",
+		"primary_mail_host":  "example.com",
+		"sql_driver":         "sqlite3",
+		"sql_dsn":            file,
+		"sql_values":         sqlBatchTestValues,
+		"sql_batch_size":     50,
+		"sql_batch_interval": "20ms",
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := backend.Process(newBrokerTestEnvelope()); !strings.HasPrefix(result.String(), "250") {
+				t.Error("expected the email to be saved, got", result)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := backend.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSQLBatchTestRows(t, file); n != 6 {
+		t.Error("expected a row for each recipient, got", n)
+	}
+
+	if _, err := New(BackendConfig{
+		"save_process":      "HeadersParser|Hasher|sql",
+		"mail_table":        "mail",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "sqlite3",
+		"sql_dsn":           file,
+		"sql_batch_size":    51,
+	}, Log()); err == nil {
+		t.Error("expected a sql_batch_size over 50 to be refused")
+	}
+	// the initializers of the backend that failed are left behind
+	Svc.reset()
+}
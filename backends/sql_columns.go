@@ -0,0 +1,84 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// sqlRowFields are the fields of a row saved by the sql and postgresql processors, in the order
+// of the values of their default INSERT
+var sqlRowFields = []string{"to", "from", "subject", "body", "mail", "hash", "content_type", "recipient",
+	"ip_addr", "return_path", "is_tls", "message_id", "reply_to", "sender"}
+
+// sqlEnvelopeFields are the other fields that can be mapped to a column
+var sqlEnvelopeFields = map[string]func(e *mail.Envelope) interface{}{
+	"date":       func(e *mail.Envelope) interface{} { return Now() },
+	"tags":       func(e *mail.Envelope) interface{} { return e.Tags.String() },
+	"tenant":     func(e *mail.Envelope) interface{} { return e.Tenant },
+	"queued_id":  func(e *mail.Envelope) interface{} { return e.QueuedId },
+	"helo":       func(e *mail.Envelope) interface{} { return trimToLimit(e.Helo, 255) },
+	"remote_ip":  func(e *mail.Envelope) interface{} { return e.RemoteIP },
+	"spam_score": func(e *mail.Envelope) interface{} { return SpamScore(e) },
+}
+
+// sqlHeaderField maps a header to a column, eg. "header:X-Mailer"
+const sqlHeaderField = "header:"
+
+// sqlColumn is a column of the table, and the field saved to it
+type sqlColumn struct {
+	name  string
+	field string
+	// row is the index of the field in sqlRowFields, or -1
+	row int
+}
+
+// parseSQLColumns parses the "column=field" entries of the option
+func parseSQLColumns(option string, entries []string) ([]sqlColumn, error) {
+	var columns []sqlColumn
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%s entry %q should be column=field", option, entry)
+		}
+		c := sqlColumn{name: strings.TrimSpace(kv[0]), field: strings.TrimSpace(kv[1]), row: -1}
+		for i, field := range sqlRowFields {
+			if c.field == field {
+				c.row = i
+			}
+		}
+		_, ok := sqlEnvelopeFields[c.field]
+		if c.row < 0 && !ok && (!strings.HasPrefix(c.field, sqlHeaderField) || c.field == sqlHeaderField) {
+			return nil, fmt.Errorf("%s entry %q has an unknown field %q", option, entry, c.field)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// sqlColumnNames returns the names of the columns, each quoted with quote
+func sqlColumnNames(columns []sqlColumn, quote string) string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = quote + strings.Replace(c.name, quote, quote+quote, -1) + quote
+	}
+	return strings.Join(names, ", ")
+}
+
+// sqlColumnValues returns the values of the columns for the envelope, row has the values of
+// sqlRowFields for the recipient
+func sqlColumnValues(columns []sqlColumn, e *mail.Envelope, row []interface{}) []interface{} {
+	vals := make([]interface{}, len(columns))
+	for i, c := range columns {
+		switch {
+		case c.row >= 0:
+			vals[i] = row[c.row]
+		case strings.HasPrefix(c.field, sqlHeaderField):
+			vals[i] = trimToLimit(e.Header.Get(strings.TrimPrefix(c.field, sqlHeaderField)), 255)
+		default:
+			vals[i] = sqlEnvelopeFields[c.field](e)
+		}
+	}
+	return vals
+}
@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSQLColumns(t *testing.T) {
+	columns, err := parseSQLColumns("sql_columns", []string{"rcpt = recipient", "received=date", "mailer=header:X-Mailer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 3 || columns[0].name != "rcpt" || columns[0].row != 7 || columns[1].row != -1 {
+		t.Error("unexpected columns", columns)
+	}
+	if names := sqlColumnNames(columns, `"`); names != `"rcpt", "received", "mailer"` {
+		t.Error("unexpected names", names)
+	}
+	for _, entry := range []string{"rcpt", "=recipient", "rcpt=has_attach", "mailer=header:"} {
+		if _, err := parseSQLColumns("sql_columns", []string{entry}); err == nil {
+			t.Errorf("expected %q to be refused", entry)
+		}
+	}
+}
+
+func TestSQLProcessorColumns(t *testing.T) {
+	file, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if _, err := db.Exec("CREATE TABLE inbox (rcpt TEXT, sender TEXT, received DATETIME, subject TEXT, labels TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	restore := SetClock(NewManualClock(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)))
+	defer SetClock(restore)
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":      "HeadersParser|Hasher|sql",
+		"mail_table":        "inbox",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "sqlite3",
+		"sql_dsn":           file,
+		"sql_columns": []interface{}{"rcpt=recipient", "sender=from", "received=date",
+			"subject=header:Subject", "labels=tags"},
+	})
+	e := newBrokerTestEnvelope()
+	e.Tags.Add("label", "vip")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be saved, got", result)
+	}
+	if err := backend.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT rcpt, sender, received, subject, labels FROM inbox ORDER BY rcpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var got []string
+	for rows.Next() {
+		var rcpt, sender, subject, labels string
+		var received time.Time
+		if err := rows.Scan(&rcpt, &sender, &received, &subject, &labels); err != nil {
+			t.Fatal(err)
+		}
+		if !received.Equal(Now()) {
+			t.Error("expected the date to be saved, got", received)
+		}
+		got = append(got, strings.Join([]string{rcpt, sender, subject, labels}, " "))
+	}
+	if strings.Join(got, ",") != "bob@Acme.com test@example.com hello label:vip,eve@other.com test@example.com hello label:vip" {
+		t.Error("unexpected rows", got)
+	}
+
+	if _, err := New(BackendConfig{
+		"save_process":      "HeadersParser|Hasher|sql",
+		"mail_table":        "inbox",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "sqlite3",
+		"sql_dsn":           file,
+		"sql_values":        sqlBatchTestValues,
+		"sql_columns":       []interface{}{"rcpt=recipient"},
+	}, Log()); err == nil {
+		t.Error("expected sql_columns to be refused with sql_values")
+	}
+	Svc.reset()
+	// the migrations, retention and the readers need the default columns
+	if _, err := New(BackendConfig{
+		"save_process":       "HeadersParser|Hasher|sql",
+		"mail_table":         "inbox",
+		"primary_mail_host":  "example.com",
+		"sql_driver":         "mysql",
+		"sql_dsn":            "user:pass@tcp(127.0.0.1:3306)/db",
+		"mysql_auto_migrate": true,
+		"sql_columns":        []interface{}{"rcpt=recipient"},
+	}, Log()); err == nil || !strings.Contains(err.Error(), "mysql_auto_migrate") {
+		t.Error("expected sql_columns to be refused with mysql_auto_migrate, got", err)
+	}
+	Svc.reset()
+	columns := BackendConfig{
+		"retention_interval": "1h",
+		"primary_mail_host":  "example.com",
+		"retention_stores":   []interface{}{"sql"},
+		"sql_driver":         "sqlite3",
+		"sql_dsn":            file,
+		"mail_table":         "inbox",
+		"sql_columns":        []interface{}{"rcpt=recipient"},
+	}
+	if _, err := NewRetentionJob(columns); err == nil || !strings.Contains(err.Error(), "sql_columns") {
+		t.Error("expected the sql retention store to be refused with sql_columns, got", err)
+	}
+	err = ReadStoredMail(columns, []string{"sql"}, nil, StoredMailFilter{}, func(*StoredMail) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "sql_columns") {
+		t.Error("expected the sql store not to be read with sql_columns, got", err)
+	}
+}
@@ -0,0 +1,141 @@
+package backends
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// sqlMigration is a version of the schema of the mail table, the statements upgrade the
+// table from the previous version
+type sqlMigration struct {
+	version    int
+	statements func(table string) []string
+}
+
+// mysqlMigrations create the mail table of the sql processor and upgrade it, in order.
+// Add a new version to change the table, the versions that were applied are never run again
+var mysqlMigrations = []sqlMigration{
+	{1, func(table string) []string {
+		return []string{"CREATE TABLE IF NOT EXISTS `" + table + "` (" +
+			"`mail_id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT, " +
+			"`date` DATETIME NOT NULL, " +
+			"`to` VARCHAR(255) NOT NULL, " +
+			"`from` VARCHAR(255) NOT NULL, " +
+			"`subject` VARCHAR(255) NOT NULL, " +
+			"`body` VARCHAR(16) NOT NULL, " +
+			"`mail` LONGBLOB NOT NULL, " +
+			"`spam_score` FLOAT NOT NULL DEFAULT 0, " +
+			"`hash` CHAR(32) NOT NULL, " +
+			"`content_type` VARCHAR(255) NOT NULL, " +
+			"`recipient` VARCHAR(255) NOT NULL, " +
+			"`has_attach` INT NOT NULL DEFAULT 0, " +
+			"`ip_addr` VARBINARY(16) NOT NULL, " +
+			"`return_path` VARCHAR(255) NOT NULL, " +
+			"`is_tls` BOOLEAN NOT NULL DEFAULT 0, " +
+			"PRIMARY KEY (`mail_id`), KEY `to` (`to`), KEY `hash` (`hash`), KEY `date` (`date`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"}
+	}},
+	{2, func(table string) []string {
+		return []string{
+			"ALTER TABLE `" + table + "` ADD COLUMN `message_id` VARCHAR(255) NOT NULL DEFAULT ''",
+			"ALTER TABLE `" + table + "` ADD COLUMN `reply_to` VARCHAR(255) NOT NULL DEFAULT ''",
+			"ALTER TABLE `" + table + "` ADD COLUMN `sender` VARCHAR(255) NOT NULL DEFAULT ''",
+		}
+	}},
+	// the hashes of SHA-256 and BLAKE3 are longer than MD5's
+	{3, func(table string) []string {
+		return []string{"ALTER TABLE `" + table + "` MODIFY `hash` VARCHAR(128) NOT NULL"}
+	}},
+}
+
+// sqlSchemaTable records the version of each migrated table
+const sqlSchemaTable = "guerrilla_schema"
+
+// sqlMigrateLockTimeout is how long to wait for another server that is migrating, in seconds
+const sqlMigrateLockTimeout = 30
+
+// migrateSQLTable applies the migrations that the table is missing. With lock, a MySQL
+// named lock keeps servers that start together from migrating the same table
+func migrateSQLTable(db *sql.DB, table string, migrations []sqlMigration, lock bool) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if lock {
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", sqlSchemaTable, sqlMigrateLockTimeout).
+			Scan(&locked); err != nil {
+			return err
+		}
+		if locked.Int64 != 1 {
+			return fmt.Errorf("sql: timed out waiting for another server to migrate %s", table)
+		}
+		defer func() {
+			_, _ = conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", sqlSchemaTable)
+		}()
+	}
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+sqlSchemaTable+
+		" (table_name VARCHAR(255) NOT NULL PRIMARY KEY, version INT NOT NULL, migrated DATETIME NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	err = conn.QueryRowContext(ctx, "SELECT version FROM "+sqlSchemaTable+" WHERE table_name = ?", table).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	recorded := err == nil
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		for _, q := range m.statements(table) {
+			if _, err := conn.ExecContext(ctx, q); err != nil && !isSQLDuplicateError(err) {
+				return fmt.Errorf("sql: migrating %s to version %d: %w", table, m.version, err)
+			}
+		}
+		q := "UPDATE " + sqlSchemaTable + " SET version = ?, migrated = ? WHERE table_name = ?"
+		if !recorded {
+			q = "INSERT INTO " + sqlSchemaTable + " (version, migrated, table_name) VALUES (?, ?, ?)"
+		}
+		if _, err := conn.ExecContext(ctx, q, m.version, Now().UTC().Format("2006-01-02 15:04:05"), table); err != nil {
+			return err
+		}
+		recorded, version = true, m.version
+		Log().Infof("sql: migrated %s to version %d", table, version)
+	}
+	return nil
+}
+
+// isSQLDuplicateError is true when a column or an index that a migration adds is there already,
+// eg. for a table that was created by hand before it was migrated
+func isSQLDuplicateError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	// ER_DUP_FIELDNAME and ER_DUP_KEYNAME
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1060 || mysqlErr.Number == 1061)
+}
+
+// migrate applies the mysql migrations to the table, when mysql_auto_migrate is set
+func (s *SQLProcessor) migrate(db *sql.DB, table string) error {
+	if !s.config.AutoMigrate {
+		return nil
+	}
+	if err := migrateSQLTable(db, table, mysqlMigrations, true); err != nil {
+		return err
+	}
+	if s.config.TagsColumn != "" {
+		// not versioned, the column is named by the config
+		_, err := db.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + s.config.TagsColumn + "` TEXT NOT NULL")
+		if err != nil && !isSQLDuplicateError(err) {
+			return err
+		}
+	}
+	return nil
+}
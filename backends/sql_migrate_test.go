@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestMigrateSQLTable(t *testing.T) {
+	file, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	// the same migrations as mysqlMigrations, in SQLite's dialect
+	migrations := []sqlMigration{
+		{1, func(table string) []string {
+			return []string{"CREATE TABLE IF NOT EXISTS " + table + " (mail_id INTEGER PRIMARY KEY, hash TEXT NOT NULL)"}
+		}},
+		{2, func(table string) []string {
+			return []string{"ALTER TABLE " + table + " ADD COLUMN sender TEXT NOT NULL DEFAULT ''"}
+		}},
+	}
+	version := func(table string) int {
+		var v int
+		if err := db.QueryRow("SELECT version FROM "+sqlSchemaTable+" WHERE table_name = ?", table).Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if err := migrateSQLTable(db, "inbox", migrations[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	if v := version("inbox"); v != 1 {
+		t.Error("expected version 1, got", v)
+	}
+	// an upgrade only applies the new versions, adding the column again would fail
+	for i := 0; i < 2; i++ {
+		if err := migrateSQLTable(db, "inbox", migrations, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := version("inbox"); v != 2 {
+		t.Error("expected version 2, got", v)
+	}
+	if _, err := db.Exec("INSERT INTO inbox (hash, sender) VALUES ('abc', 'test@example.com')"); err != nil {
+		t.Error("expected the migrated table, got", err)
+	}
+
+	// a failed migration leaves the table at the version before it
+	broken := append(migrations, sqlMigration{3, func(table string) []string {
+		return []string{"ALTER TABLE " + table + " ADD COLUMN"}
+	}})
+	if err := migrateSQLTable(db, "other", broken, false); err == nil || !strings.Contains(err.Error(), "version 3") {
+		t.Error("expected the migration to fail, got", err)
+	}
+	if v := version("other"); v != 2 {
+		t.Error("expected version 2, got", v)
+	}
+}
+
+func TestMySQLMigrations(t *testing.T) {
+	for i, m := range mysqlMigrations {
+		if m.version != i+1 {
+			t.Errorf("expected the migrations to be numbered in order, got %d at %d", m.version, i)
+		}
+		for _, q := range m.statements("mail_acme") {
+			if !strings.Contains(q, "`mail_acme`") {
+				t.Error("expected the statement to use the table", q)
+			}
+		}
+	}
+	if _, err := New(BackendConfig{
+		"save_process":       "HeadersParser|Hasher|sql",
+		"mail_table":         "mail",
+		"primary_mail_host":  "example.com",
+		"sql_driver":         "sqlite3",
+		"sql_dsn":            ":memory:",
+		"mysql_auto_migrate": true,
+	}, Log()); err == nil {
+		t.Error("expected mysql_auto_migrate to be refused with sqlite3")
+	}
+	Svc.reset()
+}
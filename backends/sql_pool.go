@@ -0,0 +1,63 @@
+package backends
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// sqlPool is a database opened by one or more processors
+type sqlPool struct {
+	key string
+	db  *sql.DB
+	// how many processors use the database
+	users int
+}
+
+var (
+	sqlPoolsGuard sync.Mutex
+	// the open databases, by their driver and data source name, so that the workers, and the
+	// sql and sql_rcpt processors, share the connection pool of the same database
+	sqlPools = make(map[string]*sqlPool)
+)
+
+// openSQLPool returns the database for the driver and DSN, opening it if it's not used already.
+// It's closed with closeSQLPool
+func openSQLPool(driver, dsn string) (*sql.DB, error) {
+	key := driver + "\x00" + dsn
+	sqlPoolsGuard.Lock()
+	defer sqlPoolsGuard.Unlock()
+	if p, ok := sqlPools[key]; ok {
+		p.users++
+		return p.db, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqlPools[key] = &sqlPool{key: key, db: db, users: 1}
+	return db, nil
+}
+
+// closeSQLPool closes the database when the last processor that opened it is done with it
+func closeSQLPool(db *sql.DB) error {
+	if db == nil {
+		return nil
+	}
+	sqlPoolsGuard.Lock()
+	var pool *sqlPool
+	for _, p := range sqlPools {
+		if p.db == db {
+			pool = p
+			break
+		}
+	}
+	if pool != nil {
+		if pool.users--; pool.users > 0 {
+			sqlPoolsGuard.Unlock()
+			return nil
+		}
+		delete(sqlPools, pool.key)
+	}
+	sqlPoolsGuard.Unlock()
+	return db.Close()
+}
@@ -5,6 +5,14 @@ import redigo "github.com/gomodule/redigo/redis"
 
 func init() {
 	backends.RedisDialer = func(network, address string, options ...backends.RedisDialOption) (backends.RedisConn, error) {
-		return redigo.Dial(network, address)
+		settings := backends.NewRedisDialSettings(options...)
+		var opts []redigo.DialOption
+		if settings.ConnectTimeout > 0 {
+			opts = append(opts, redigo.DialConnectTimeout(settings.ConnectTimeout))
+		}
+		if settings.TLSConfig != nil {
+			opts = append(opts, redigo.DialUseTLS(true), redigo.DialTLSConfig(settings.TLSConfig))
+		}
+		return redigo.Dial(network, address, opts...)
 	}
 }
@@ -0,0 +1,368 @@
+package backends
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/zstd"
+)
+
+// StoredMail is a message read back from the storage
+type StoredMail struct {
+	// Store is where it was found: "sql", "redis" or "files"
+	Store  string
+	Tenant string
+	// Id is the row's mail_id, the Redis key or the file's path
+	Id        string
+	Hash      string
+	From      string
+	Recipient string
+	// Date is when the message was saved. For Redis it's worked out from the key's TTL
+	Date time.Time
+	data func() ([]byte, error)
+}
+
+// Data returns the message, uncompressed if it was saved using the compressor processor, or compressed
+// with zstd
+func (m *StoredMail) Data() ([]byte, error) {
+	b, err := m.data()
+	if err != nil {
+		return nil, err
+	}
+	return uncompressStored(b)
+}
+
+// StoredMailFilter selects the stored mail to read. Empty fields match everything
+type StoredMailFilter struct {
+	Since     time.Time
+	Until     time.Time
+	Recipient string
+	Hash      string
+	// Tenants are the tenants whose tables to read when mail_table has a {tenant} placeholder
+	Tenants []string
+}
+
+func (f *StoredMailFilter) match(m *StoredMail) bool {
+	if !f.Since.IsZero() && m.Date.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !m.Date.Before(f.Until) {
+		return false
+	}
+	if f.Hash != "" && m.Hash != f.Hash {
+		return false
+	}
+	if f.Recipient != "" && !strings.EqualFold(m.Recipient, f.Recipient) {
+		return false
+	}
+	return true
+}
+
+// ReadStoredMail calls fn for each message in the stores that matches the filter.
+// The "sql" and "redis" stores use the options of the sql and redis processors in the backend config,
+// and "files" reads the dirs, where {tenant} matches any tenant. Mail saved by the s3 processor is
+// read from the bucket when the s3 options are in the backend config
+func ReadStoredMail(backendConfig BackendConfig, stores []string, dirs []string, f StoredMailFilter, fn func(*StoredMail) error) error {
+	if _, ok := backendConfig.Section("s3")["s3_bucket"]; ok {
+		config, err := Svc.ExtractConfig(backendConfig.Section("s3"), &S3ProcessorConfig{})
+		if err != nil {
+			return err
+		}
+		client, err := config.(*S3ProcessorConfig).client()
+		if err != nil {
+			return err
+		}
+		fn = readS3Objects(client, fn)
+	}
+	for _, name := range stores {
+		var err error
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "sql":
+			var config BaseConfig
+			if config, err = Svc.ExtractConfig(backendConfig.Section("sql"), &SQLProcessorConfig{}); err == nil {
+				err = readSQLMail(config.(*SQLProcessorConfig), &f, fn)
+			}
+		case "redis":
+			var config BaseConfig
+			if config, err = Svc.ExtractConfig(backendConfig.Section("redis"), &RedisProcessorConfig{}); err == nil {
+				err = readRedisMail(config.(*RedisProcessorConfig), &f, fn)
+			}
+		case "files":
+			err = readFileMail(dirs, &f, fn)
+		default:
+			err = fmt.Errorf("unknown store %q, expected sql, redis or files", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readS3Objects wraps fn so that the data of the mail is read from the bucket,
+// when the store has the URL saved by the s3 processor
+func readS3Objects(client *s3Client, fn func(*StoredMail) error) func(*StoredMail) error {
+	return func(m *StoredMail) error {
+		data := m.data
+		m.data = func() ([]byte, error) {
+			b, err := data()
+			if err != nil {
+				return nil, err
+			}
+			if bucket, key, ok := parseS3URL(string(b)); ok && bucket == client.bucket {
+				return client.getMessage(key)
+			}
+			return b, nil
+		}
+		return fn(m)
+	}
+}
+
+// zstdMagic starts a zstd frame, see RFC 8878
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// uncompressStored inflates data saved by the compressor processor, or compressed with zstd,
+// other data is returned as is
+func uncompressStored(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, zstdMagic) {
+		return zstd.Decompress(nil, data)
+	}
+	// a zlib header, see RFC 1950
+	if len(data) < 2 || data[0] != 0x78 || (uint16(data[0])<<8|uint16(data[1]))%31 != 0 {
+		return data, nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return data, nil
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return ioutil.ReadAll(r)
+}
+
+// readSQLMail reads the rows of the mail_table. Rows whose mail was saved to Redis are skipped,
+// they are read from the redis store
+func readSQLMail(config *SQLProcessorConfig, f *StoredMailFilter, fn func(*StoredMail) error) error {
+	if len(config.Columns) > 0 {
+		return errors.New("the sql store needs the default columns, it can't be read with sql_columns")
+	}
+	dsn, err := (&SQLProcessor{config: config}).dsn()
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(config.Driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	tenants := []string{""}
+	if strings.Contains(config.Table, TenantPlaceholder) {
+		tenants = append([]string(nil), f.Tenants...)
+		sort.Strings(tenants)
+	}
+	// the rows of streamed messages that were not saved are skipped too
+	where := []string{"`body` != 'redis'", "`body` != '" + sqlStreamBody + "'"}
+	var args []interface{}
+	if !f.Since.IsZero() {
+		where = append(where, "`date` >= FROM_UNIXTIME(?)")
+		args = append(args, f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "`date` < FROM_UNIXTIME(?)")
+		args = append(args, f.Until.Unix())
+	}
+	if f.Recipient != "" {
+		where = append(where, "`recipient` = ?")
+		args = append(args, f.Recipient)
+	}
+	if f.Hash != "" {
+		where = append(where, "`hash` = ?")
+		args = append(args, f.Hash)
+	}
+	for _, tenant := range tenants {
+		table := ForTenant(config.Table, tenant)
+		rows, err := db.Query("SELECT `mail_id`, `hash`, `from`, `recipient`, UNIX_TIMESTAMP(`date`) FROM "+
+			table+" WHERE "+strings.Join(where, " AND ")+" ORDER BY `mail_id`", args...)
+		if err != nil {
+			return err
+		}
+		var found []*StoredMail
+		for rows.Next() {
+			var id, date int64
+			m := &StoredMail{Store: "sql", Tenant: tenant}
+			if err := rows.Scan(&id, &m.Hash, &m.From, &m.Recipient, &date); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			m.Id = fmt.Sprint(id)
+			m.Date = time.Unix(date, 0)
+			m.data = func() ([]byte, error) {
+				var data []byte
+				err := db.QueryRow("SELECT `mail` FROM "+table+" WHERE `mail_id` = ?", id).Scan(&data)
+				return data, err
+			}
+			found = append(found, m)
+		}
+		_ = rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, m := range found {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readRedisMail reads the keys saved by the redis processor
+func readRedisMail(config *RedisProcessorConfig, f *StoredMailFilter, fn func(*StoredMail) error) error {
+	conn, err := dialRedis(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	pattern := newTenantPattern(config.RedisKeyPrefix)
+	match := strings.Replace(config.RedisKeyPrefix, TenantPlaceholder, "*", -1) + "*"
+	if f.Hash != "" {
+		match = strings.Replace(config.RedisKeyPrefix, TenantPlaceholder, "*", -1) + f.Hash
+	}
+	cursor := "0"
+	now := time.Now()
+	for {
+		reply, err := conn.Do("SCAN", cursor, "MATCH", match, "COUNT", 100)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if cursor, keys, err = redisScanReply(reply); err != nil {
+			return err
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if strings.HasSuffix(key, ":tags") {
+				continue
+			}
+			m := &StoredMail{Store: "redis", Tenant: pattern.tenant(key), Id: key}
+			// the hash follows the prefix
+			m.Hash = strings.TrimPrefix(key, ForTenant(config.RedisKeyPrefix, m.Tenant))
+			reply, err := conn.Do("TTL", key)
+			if err != nil {
+				return err
+			}
+			if ttl, ok := reply.(int64); ok && ttl >= 0 {
+				m.Date = now.Add(-time.Duration(int64(config.RedisExpireSeconds)-ttl) * time.Second)
+			}
+			var data []byte
+			m.data = func() ([]byte, error) {
+				if data == nil {
+					reply, err := conn.Do("GET", key)
+					if err != nil {
+						return nil, err
+					}
+					data, _ = reply.([]byte)
+				}
+				return data, nil
+			}
+			if err := readStoredHeaders(m); err != nil {
+				return err
+			}
+			if !f.match(m) {
+				continue
+			}
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// readFileMail reads the files in the dirs, using their modification time as the date
+func readFileMail(dirs []string, f *StoredMailFilter, fn func(*StoredMail) error) error {
+	for _, dir := range dirs {
+		pattern := newTenantPattern(dir + "/")
+		matches, err := filepath.Glob(strings.Replace(dir, TenantPlaceholder, "*", -1))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			tenant := pattern.tenant(match + "/")
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				m := &StoredMail{
+					Store:  "files",
+					Tenant: tenant,
+					Id:     path,
+					Hash:   strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+					Date:   info.ModTime(),
+					data: func() ([]byte, error) {
+						return ioutil.ReadFile(path)
+					},
+				}
+				if err := readStoredHeaders(m); err != nil {
+					return err
+				}
+				if !f.match(m) {
+					return nil
+				}
+				return fn(m)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readStoredHeaders sets the recipient from the Delivered-To header added by the Header processor,
+// and the sender from the Return-Path header
+func readStoredHeaders(m *StoredMail) error {
+	data, err := m.Data()
+	if err != nil {
+		return err
+	}
+	m.Recipient = HeaderAddress(data, "Delivered-To")
+	m.From = HeaderAddress(data, "Return-Path")
+	return nil
+}
+
+// HeaderAddress returns the address in the first header of the message with the key, without the <>
+func HeaderAddress(data []byte, key string) string {
+	end := bytes.Index(data, []byte("\n\n"))
+	if crlf := bytes.Index(data, []byte("\r\n\r\n")); crlf > -1 && (end == -1 || crlf < end) {
+		end = crlf
+	}
+	if end == -1 {
+		end = len(data)
+	}
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 && strings.EqualFold(kv[0], key) {
+			return strings.Trim(strings.TrimSpace(kv[1]), "<>")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package backends
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestReadStoredMail(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	day := time.Hour * 24
+	writeRetentionFile(t, filepath.Join(dir, "acme", "h1.eml"), "Delivered-To: a@acme.com\nReturn-Path: <s@example.com>\n\nold\n", day*10)
+	writeRetentionFile(t, filepath.Join(dir, "acme", "h2.eml"), "Delivered-To: b@acme.com\n\nnew\n", day)
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	_, _ = w.Write([]byte("Delivered-To: c@globex.com\n\nzipped\n"))
+	_ = w.Close()
+	writeRetentionFile(t, filepath.Join(dir, "globex", "h3.eml"), compressed.String(), day)
+	zstdData, _ := zstd.Compress(nil, []byte("Delivered-To: d@globex.com\n\nzstd\n"))
+	writeRetentionFile(t, filepath.Join(dir, "globex", "h4.eml"), string(zstdData), day)
+
+	read := func(f StoredMailFilter) []*StoredMail {
+		var found []*StoredMail
+		err := ReadStoredMail(BackendConfig{}, []string{"files"}, []string{filepath.Join(dir, "{tenant}")}, f,
+			func(m *StoredMail) error {
+				found = append(found, m)
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	if found := read(StoredMailFilter{}); len(found) != 4 {
+		t.Fatal("expected all the files, got", found)
+	}
+	found := read(StoredMailFilter{Until: time.Now().Add(-day * 5)})
+	if len(found) != 1 || found[0].Hash != "h1" || found[0].Tenant != "acme" ||
+		found[0].Recipient != "a@acme.com" || found[0].From != "s@example.com" {
+		t.Fatal("expected the old file, got", found)
+	}
+	found = read(StoredMailFilter{Recipient: "C@globex.com"})
+	if len(found) != 1 {
+		t.Fatal("expected the file for the recipient, got", found)
+	}
+	if data, err := found[0].Data(); err != nil || string(data) != "Delivered-To: c@globex.com\n\nzipped\n" {
+		t.Error("expected the data to be uncompressed, got", string(data), err)
+	}
+	found = read(StoredMailFilter{Hash: "h4"})
+	if len(found) != 1 || found[0].Recipient != "d@globex.com" {
+		t.Fatal("expected the zstd file, got", found)
+	}
+	if data, err := found[0].Data(); err != nil || string(data) != "Delivered-To: d@globex.com\n\nzstd\n" {
+		t.Error("expected the zstd data to be uncompressed, got", string(data), err)
+	}
+	if found := read(StoredMailFilter{Hash: "h2", Since: time.Now().Add(-day * 2)}); len(found) != 1 {
+		t.Error("expected the file with the hash, got", found)
+	}
+	if err := ReadStoredMail(BackendConfig{}, []string{"tape"}, nil, StoredMailFilter{}, nil); err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+}
+
+func TestReadStoredRedisMail(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	conn := &retentionRedisConn{
+		ttls: map[string]int64{"mail:acme:h1": 10, "mail:acme:h1:tags": 10, "mail:acme:h2": 90},
+		data: map[string]string{
+			"mail:acme:h1": "Delivered-To: a@acme.com\n\nold\n",
+			"mail:acme:h2": "Delivered-To: b@acme.com\n\nnew\n",
+		},
+	}
+	dialer := RedisDialer
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		return conn, nil
+	}
+	defer func() {
+		RedisDialer = dialer
+	}()
+	config := BackendConfig{
+		"redis_interface":      "127.0.0.1:6379",
+		"redis_expire_seconds": 100,
+		"redis_key_prefix":     "mail:{tenant}:",
+	}
+	var found []*StoredMail
+	err := ReadStoredMail(config, []string{"redis"}, nil, StoredMailFilter{Until: time.Now().Add(-time.Minute)},
+		func(m *StoredMail) error {
+			found = append(found, m)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Hash != "h1" || found[0].Tenant != "acme" || found[0].Recipient != "a@acme.com" {
+		t.Fatal("expected the old key, got", found)
+	}
+}
@@ -0,0 +1,188 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// StreamProcessor consumes the message data while the server receives it, so that the
+// message doesn't need to be held in memory. Data written to it is the message without the
+// dot-stuffing, with \n line endings
+type StreamProcessor interface {
+	// Write writes the next chunk of the message
+	Write(p []byte) (int, error)
+	// Close is called once after the last chunk. err is not nil if the message wasn't received
+	// completely, eg. it was too large or the client went away, then the processor discards
+	// what was written. It returns an error if the message could not be saved
+	Close(err error) error
+}
+
+// StreamDecorator returns a StreamProcessor for the envelope that writes to next, eg.
+// after compressing the data. It's called for each message
+type StreamDecorator func(e *mail.Envelope, next StreamProcessor) (StreamProcessor, error)
+
+// streamProcessors are the processors that can be used in stream_save_process. Their
+// constructors are called once, like the constructors of processors
+var streamProcessors = make(map[string]func() StreamDecorator)
+
+// streamStores are the stream processors that save the message, stream_save_process ends with one
+// of them. The value is the processor of save_process that completes what it saved, if any
+var streamStores = make(map[string]string)
+
+// checkStreamStores returns an error when the last stream processor of streamConfig doesn't save the
+// message, or when a processor that completes what a stream processor saved is not in saveConfig
+func checkStreamStores(streamConfig, saveConfig string) error {
+	names := strings.Split(strings.ToLower(strings.TrimSpace(streamConfig)), "|")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	last := names[len(names)-1]
+	if _, ok := streamStores[last]; !ok {
+		if _, ok := streamProcessors[last]; ok {
+			return fmt.Errorf("stream processor [%s] doesn't save the message, stream_save_process must "+
+				"end with one that does, eg. s3: %q", last, streamConfig)
+		}
+	}
+	saved := make(map[string]bool)
+	for _, name := range strings.Split(strings.ToLower(saveConfig), "|") {
+		saved[strings.TrimSuffix(strings.TrimSpace(name), "?")] = true
+	}
+	for _, name := range names {
+		if completer := streamStores[name]; completer != "" && !saved[completer] {
+			return fmt.Errorf("stream processor [%s] needs the [%s] processor in save_process: %q",
+				name, completer, saveConfig)
+		}
+	}
+	return nil
+}
+
+// missingStreamedBody is true when e.Data only has the header section of a streamed message, and no
+// stream processor left the URL of the message for the save_process processors to save instead
+func missingStreamedBody(e *mail.Envelope) bool {
+	if streamed, _ := e.Values["streamed"].(bool); !streamed {
+		return false
+	}
+	_, ok := e.Values["s3"].(string)
+	return !ok
+}
+
+// DataStreamer is a Backend that can consume the message while it's received, see the
+// stream_save_process option
+type DataStreamer interface {
+	// StreamData returns the processor to write the data of the envelope to, or nil if there
+	// are no stream processors. The envelope's Data only gets the header section of the
+	// message, for the save_process processors, which run after the processor was closed
+	StreamData(e *mail.Envelope) (StreamProcessor, error)
+}
+
+// maxStreamHeaderSize is the most of the header section that is kept in e.Data
+const maxStreamHeaderSize = 64 << 10
+
+// newStreamStack returns the stream processors of stackConfig, eg. "compressor|s3", in order
+func (gw *BackendGateway) newStreamStack(stackConfig string) ([]StreamDecorator, error) {
+	cfg := strings.ToLower(strings.TrimSpace(stackConfig))
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	var decorators []StreamDecorator
+	for _, name := range strings.Split(cfg, "|") {
+		name = strings.TrimSpace(name)
+		makeFunc, ok := streamProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("stream processor [%s] not found", name)
+		}
+		n := Svc.countInitializers()
+		decorators = append(decorators, makeFunc())
+		Svc.scopeInitializers(n, name)
+	}
+	return decorators, nil
+}
+
+// StreamData chains the stream processors for the envelope, see DataStreamer
+func (gw *BackendGateway) StreamData(e *mail.Envelope) (StreamProcessor, error) {
+	if len(gw.streamers) == 0 {
+		return nil, nil
+	}
+	var w StreamProcessor = discardStream{}
+	for i := len(gw.streamers) - 1; i >= 0; i-- {
+		next, err := gw.streamers[i](e, w)
+		if err != nil {
+			// the processors that were already made are waiting for their data
+			_ = w.Close(err)
+			return nil, err
+		}
+		w = next
+	}
+	return &dataStream{w: w, header: headerSink{e: e}}, nil
+}
+
+// dataStream writes the message to the stream processors and keeps its header section. It
+// keeps reading the message after a stream processor failed, so that the server can reply
+// once the client finished sending it
+type dataStream struct {
+	w      StreamProcessor
+	header headerSink
+	err    error
+}
+
+func (s *dataStream) Write(p []byte) (int, error) {
+	s.header.write(p)
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s *dataStream) Close(err error) error {
+	if err == nil {
+		err = s.err
+	}
+	closeErr := s.w.Close(err)
+	if s.err != nil {
+		return s.err
+	}
+	if err == nil && closeErr == nil {
+		// tells the save_process processors that e.Data is only the header
+		s.header.e.Values["streamed"] = true
+	}
+	return closeErr
+}
+
+// discardStream is the end of the stream processors
+type discardStream struct{}
+
+func (discardStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardStream) Close(err error) error {
+	return nil
+}
+
+// headerSink keeps the header section of the message in e.Data, and drops the body
+type headerSink struct {
+	e    *mail.Envelope
+	done bool
+}
+
+func (s *headerSink) write(p []byte) {
+	if s.done {
+		return
+	}
+	// the blank line may start in the previous chunk
+	start := s.e.Data.Len() - 1
+	if start < 0 {
+		start = 0
+	}
+	s.e.Data.Write(p)
+	if i := bytes.Index(s.e.Data.Bytes()[start:], []byte("\n\n")); i >= 0 {
+		s.e.Data.Truncate(start + i + 2)
+		s.done = true
+	} else if s.e.Data.Len() > maxStreamHeaderSize {
+		s.e.Data.Truncate(maxStreamHeaderSize)
+		s.done = true
+	}
+}
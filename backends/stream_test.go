@@ -0,0 +1,231 @@
+package backends
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestStreamHeaderSink(t *testing.T) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	s := &dataStream{w: discardStream{}, header: headerSink{e: e}}
+	// the blank line is split across the chunks
+	for _, chunk := range []string{"Subject: hello\nFrom: a@example.com\n", "\nbody\n", "\nmore\n"} {
+		if _, err := s.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(nil); err != nil {
+		t.Fatal(err)
+	}
+	if e.Data.String() != "Subject: hello\nFrom: a@example.com\n\n" || e.Values["streamed"] != true {
+		t.Error("expected only the header, got", e.Data.String())
+	}
+}
+
+func TestStreamS3(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	backend, err := New(BackendConfig{
+		"save_process":        "HeadersParser|Debugger",
+		"stream_save_process": "compressor|s3",
+		"s3_bucket":           "bucket",
+		"s3_endpoint":         server.URL,
+		"s3_access_key":       "key",
+		"s3_secret_key":       "secret",
+		"s3_path_style":       true,
+		"s3_key_prefix":       "{tenant}/",
+		"log_received_mails":  true,
+	}, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	defer Svc.reset()
+	gw := backend.(*BackendGateway)
+
+	stream := func(e *mail.Envelope, data []byte, readErr error) error {
+		s, err := gw.StreamData(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// written in chunks, like io.Copy does
+		for len(data) > 0 {
+			n := 32 << 10
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := s.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		return s.Close(readErr)
+	}
+
+	// larger than a part once compressed, so it's uploaded in parts while it's written
+	body := make([]byte, s3MinPartSize+s3MinPartSize/2)
+	_, _ = rand.New(rand.NewSource(1)).Read(body)
+	message := append([]byte("Subject: hello\n\n"), body...)
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Tenant = "acme"
+	if err := stream(e, message, nil); err != nil {
+		t.Fatal("expected the message to be uploaded, got", err)
+	}
+	key := "acme/" + e.QueuedId
+	if e.Values["s3"] != "s3://bucket/"+key || e.Data.String() != "Subject: hello\n\n" {
+		t.Fatal("unexpected envelope", e.Values["s3"], e.Data.String())
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(fake.objects[key]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(data, message) {
+		t.Error("expected the compressed message, got", len(data), err)
+	}
+	if fake.headers[key].Get("Content-Encoding") != "deflate" || fake.parts != 2 {
+		t.Error("expected 2 parts and the encoding to be set, got", fake.parts, fake.headers[key])
+	}
+
+	// an incomplete message is not saved
+	e = mail.NewEnvelope("127.0.0.1", 2)
+	if err := stream(e, []byte("Subject: hello\n\nhi\n"), errors.New("too large")); err != nil {
+		t.Error("expected the stream to be discarded, got", err)
+	}
+	if _, ok := fake.objects[e.QueuedId]; ok || e.Values["s3"] != nil || e.Values["streamed"] != nil {
+		t.Error("expected no object for an incomplete message")
+	}
+
+	// a failed upload fails the message
+	w, _ := gw.streamers[1](e, discardStream{})
+	// the client is shared by the messages
+	w.(*streamS3).client.accessKey = "wrong"
+	e = mail.NewEnvelope("127.0.0.1", 3)
+	if err := stream(e, []byte("Subject: hello\n\nhi\n"), nil); err == nil ||
+		!strings.Contains(err.Error(), "AccessDenied") {
+		t.Error("expected the upload to fail, got", err)
+	}
+}
+
+func TestStreamSQL(t *testing.T) {
+	file, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":        "HeadersParser|Header|Hasher|sql",
+		"stream_save_process": "sql",
+		"mail_table":          "mail",
+		"primary_mail_host":   "example.com",
+		"sql_driver":          "sqlite3",
+		"sql_dsn":             file,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	gw := backend.(*BackendGateway)
+	stream := func(e *mail.Envelope, data []byte, readErr error) error {
+		s, err := gw.StreamData(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(data) > 0 {
+			n := 32 << 10
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := s.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		return s.Close(readErr)
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// appended to its row in chunks
+	message := []byte("Subject: hello\n\n" + strings.Repeat("0123456789abcdef", sqlStreamChunk/16*2+100))
+	e := newBrokerTestEnvelope()
+	e.Data.Reset()
+	if err := stream(e, message, nil); err != nil {
+		t.Fatal("expected the message to be streamed, got", err)
+	}
+	if e.Data.String() != "Subject: hello\n\n" || e.Values[sqlStreamValue] == nil {
+		t.Fatal("unexpected envelope", e.Data.String(), e.Values)
+	}
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the email to be saved, got", result)
+	}
+	rows, err := db.Query("SELECT recipient, subject, body, mail FROM mail ORDER BY mail_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var recipient, subject, body string
+		var data []byte
+		if err := rows.Scan(&recipient, &subject, &body, &data); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, append([]byte(e.DeliveryHeader), message...)) {
+			t.Error("expected the delivery header and the message, got", len(data))
+		}
+		got = append(got, recipient+" "+subject+" "+body)
+	}
+	_ = rows.Close()
+	if strings.Join(got, ",") != "bob@Acme.com hello ,eve@other.com hello " {
+		t.Error("unexpected rows", got)
+	}
+
+	// an incomplete message leaves no row
+	e = newBrokerTestEnvelope()
+	e.Data.Reset()
+	if err := stream(e, message, errors.New("too large")); err != nil {
+		t.Error("expected the stream to be discarded, got", err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mail").Scan(&n); err != nil || n != 2 {
+		t.Error("expected the row to be deleted, got", n, err)
+	}
+}
+
+func TestCheckStreamStores(t *testing.T) {
+	for _, c := range []struct {
+		stream, save, want string
+	}{
+		{"compressor|s3", "HeadersParser|Hasher|Redis", ""},
+		{"sql", "HeadersParser|Hasher|Sql", ""},
+		{"compressor", "HeadersParser|Hasher|Sql", "stream processor [compressor] doesn't save the message"},
+		{"s3|sql", "HeadersParser|Hasher|Redis", "stream processor [sql] needs the [sql] processor"},
+	} {
+		err := checkStreamStores(c.stream, c.save)
+		if c.want == "" && err != nil {
+			t.Error("expected", c.stream, "to be valid, got", err)
+		} else if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("expected %q for %s, got %v", c.want, c.stream, err)
+		}
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Values["streamed"] = true
+	if !missingStreamedBody(e) {
+		t.Error("expected the body of a streamed message to be missing")
+	}
+	e.Values["s3"] = "s3://bucket/key"
+	if missingStreamedBody(e) {
+		t.Error("expected the body to be in the bucket")
+	}
+}
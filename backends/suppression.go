@@ -0,0 +1,249 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SuppressionReason is why mail should not be sent to an address
+type SuppressionReason string
+
+const (
+	// SuppressionBounce is for addresses that hard bounced, ie. with a 5xx reply or DSN
+	SuppressionBounce SuppressionReason = "bounce"
+	// SuppressionComplaint is for recipients that reported a message as spam
+	SuppressionComplaint SuppressionReason = "complaint"
+	// SuppressionUnsubscribe is for recipients that unsubscribed with the List-Unsubscribe header
+	SuppressionUnsubscribe SuppressionReason = "unsubscribe"
+	// SuppressionManual is for addresses added with the admin API
+	SuppressionManual SuppressionReason = "manual"
+)
+
+// Suppression is an address that relaying and auto-responding processors should not send to
+type Suppression struct {
+	Address string            `json:"address"`
+	Tenant  string            `json:"tenant,omitempty"`
+	Reason  SuppressionReason `json:"reason"`
+	// Detail is eg. the reply or the status of the bounce
+	Detail string    `json:"detail,omitempty"`
+	Added  time.Time `json:"added"`
+	// Expires is when the address may be sent to again, nil for never
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (s *Suppression) expired(now time.Time) bool {
+	return s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// SuppressionConfig is read from the backend config
+type SuppressionConfig struct {
+	// File keeps the list across restarts, it's only kept in memory when empty
+	File string `json:"suppression_file,omitempty"`
+	// BounceTTL is how long a bounced address is suppressed, eg. "720h". Forever when empty
+	BounceTTL string `json:"suppression_bounce_ttl,omitempty"`
+	// ComplaintTTL is how long an address that complained is suppressed. Forever when empty
+	ComplaintTTL string `json:"suppression_complaint_ttl,omitempty"`
+}
+
+// SuppressionList is the list of addresses that previously hard bounced or complained.
+// Processors that send mail out should check a recipient with Suppressed first, and add
+// the recipients that hard bounce with Add
+type SuppressionList struct {
+	path string
+	ttl  map[SuppressionReason]time.Duration
+	// by tenant and lower case address
+	entries map[string]*Suppression
+	sync.RWMutex
+}
+
+// Suppressions is the list used by the processors and the admin API. The suppression_*
+// options configure it when the backend is initialized
+var Suppressions = NewSuppressionList()
+
+// NewSuppressionList returns an empty list that is kept in memory
+func NewSuppressionList() *SuppressionList {
+	return &SuppressionList{
+		ttl:     make(map[SuppressionReason]time.Duration),
+		entries: make(map[string]*Suppression),
+	}
+}
+
+// OpenSuppressionList loads the list kept in the file at path, it's created with the first change
+func OpenSuppressionList(path string) (*SuppressionList, error) {
+	l := NewSuppressionList()
+	l.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []*Suppression
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("could not read the suppression list %s: %s", path, err)
+	}
+	now := Now()
+	for _, s := range entries {
+		if !s.expired(now) {
+			l.entries[suppressionKey(s.Tenant, s.Address)] = s
+		}
+	}
+	return l, nil
+}
+
+func suppressionKey(tenant, address string) string {
+	return tenant + "\x00" + strings.ToLower(strings.TrimSpace(address))
+}
+
+// SetTTL sets how long the addresses added for the reason are suppressed, 0 for forever
+func (l *SuppressionList) SetTTL(reason SuppressionReason, ttl time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.ttl[reason] = ttl
+}
+
+// Add suppresses the address for the tenant. Added is set to now, and Expires from the TTL
+// of the reason, unless it's set already
+func (l *SuppressionList) Add(s Suppression) error {
+	s.Address = strings.TrimSpace(s.Address)
+	if s.Address == "" {
+		return fmt.Errorf("the address is required")
+	}
+	if s.Reason == "" {
+		s.Reason = SuppressionManual
+	}
+	l.Lock()
+	defer l.Unlock()
+	s.Added = Now()
+	if ttl := l.ttl[s.Reason]; s.Expires == nil && ttl > 0 {
+		expires := s.Added.Add(ttl)
+		s.Expires = &expires
+	}
+	l.entries[suppressionKey(s.Tenant, s.Address)] = &s
+	return l.save()
+}
+
+// Remove lets mail be sent to the address again, it returns false if it was not suppressed
+func (l *SuppressionList) Remove(tenant, address string) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	key := suppressionKey(tenant, address)
+	if _, ok := l.entries[key]; !ok {
+		return false, nil
+	}
+	delete(l.entries, key)
+	return true, l.save()
+}
+
+// Suppressed returns the entry if mail should not be sent to the tenant's address
+func (l *SuppressionList) Suppressed(tenant, address string) (Suppression, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	s, ok := l.entries[suppressionKey(tenant, address)]
+	if !ok || s.expired(Now()) {
+		return Suppression{}, false
+	}
+	return *s, true
+}
+
+// List returns the tenant's suppressed addresses, sorted by address. All the addresses
+// are returned when all is true
+func (l *SuppressionList) List(tenant string, all bool) []Suppression {
+	l.RLock()
+	defer l.RUnlock()
+	now := Now()
+	list := make([]Suppression, 0)
+	for _, s := range l.entries {
+		if (all || s.Tenant == tenant) && !s.expired(now) {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Address == list[j].Address {
+			return list[i].Tenant < list[j].Tenant
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+// save writes the list to its file, without the expired entries. It must be called with the lock held
+func (l *SuppressionList) save() error {
+	now := Now()
+	entries := make([]*Suppression, 0, len(l.entries))
+	for key, s := range l.entries {
+		if s.expired(now) {
+			delete(l.entries, key)
+			continue
+		}
+		entries = append(entries, s)
+	}
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), "."+filepath.Base(l.path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// configureSuppressions sets the TTLs of Suppressions, and opens its file when the
+// suppression_file option changed. The entries are kept when it's the same file
+func configureSuppressions(backendConfig BackendConfig) error {
+	configType := BaseConfig(&SuppressionConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return err
+	}
+	config := bcfg.(*SuppressionConfig)
+	ttls := make(map[SuppressionReason]time.Duration)
+	for reason, value := range map[SuppressionReason]string{
+		SuppressionBounce:    config.BounceTTL,
+		SuppressionComplaint: config.ComplaintTTL,
+	} {
+		if value == "" {
+			continue
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid suppression_%s_ttl %q", reason, value)
+		}
+		ttls[reason] = ttl
+	}
+	l := Suppressions
+	if l == nil || l.path != config.File {
+		if config.File == "" {
+			l = NewSuppressionList()
+		} else if l, err = OpenSuppressionList(config.File); err != nil {
+			return err
+		}
+	}
+	l.Lock()
+	l.ttl = ttls
+	l.Unlock()
+	Suppressions = l
+	return nil
+}
@@ -0,0 +1,207 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestSuppressionList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "suppression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "suppressions.json")
+	l, err := OpenSuppressionList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetTTL(SuppressionBounce, time.Hour)
+	if err := l.Add(Suppression{Address: "Bob@Example.com", Tenant: "acme", Reason: SuppressionBounce}); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	_ = l.Add(Suppression{Address: "old@example.com", Reason: SuppressionBounce, Expires: &past})
+	_ = l.Add(Suppression{Address: "carol@example.com"})
+	if err := l.Add(Suppression{}); err == nil {
+		t.Error("expected the address to be required")
+	}
+
+	s, ok := l.Suppressed("acme", "bob@example.com")
+	if !ok || s.Expires == nil || s.Expires.Sub(s.Added) != time.Hour {
+		t.Error("expected bob to be suppressed for an hour", s, ok)
+	}
+	if _, ok := l.Suppressed("", "bob@example.com"); ok {
+		t.Error("expected the suppression to be for the tenant only")
+	}
+	if _, ok := l.Suppressed("", "old@example.com"); ok {
+		t.Error("expected the expired entry to be ignored")
+	}
+	if s, ok := l.Suppressed("", "carol@example.com"); !ok || s.Reason != SuppressionManual || s.Expires != nil {
+		t.Error("expected carol to be suppressed forever", s, ok)
+	}
+	if list := l.List("acme", false); len(list) != 1 || list[0].Address != "Bob@Example.com" {
+		t.Error("unexpected list", list)
+	}
+	if list := l.List("", true); len(list) != 2 {
+		t.Error("expected all the entries, got", list)
+	}
+
+	// the file is loaded again
+	l, err = OpenSuppressionList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Suppressed("acme", "BOB@example.com"); !ok {
+		t.Error("expected the list to be kept in the file")
+	}
+	if removed, err := l.Remove("acme", "bob@example.com"); !removed || err != nil {
+		t.Error("expected bob to be removed", removed, err)
+	}
+	if removed, _ := l.Remove("acme", "bob@example.com"); removed {
+		t.Error("expected bob to be removed already")
+	}
+	if data, _ := ioutil.ReadFile(file); strings.Contains(string(data), "Bob") || strings.Contains(string(data), "old@") {
+		t.Error("expected the removed and expired entries to be left out of the file", string(data))
+	}
+}
+
+func TestConfigureSuppressions(t *testing.T) {
+	defer func(l *SuppressionList) { Suppressions = l }(Suppressions)
+	if err := configureSuppressions(BackendConfig{"suppression_bounce_ttl": "48h"}); err != nil {
+		t.Fatal(err)
+	}
+	l := Suppressions
+	_ = l.Add(Suppression{Address: "a@example.com", Reason: SuppressionBounce})
+	if s, _ := l.Suppressed("", "a@example.com"); s.Expires == nil || s.Expires.Sub(s.Added) != time.Hour*48 {
+		t.Error("expected the bounce TTL", s)
+	}
+	// reinitializing keeps the entries
+	if err := configureSuppressions(BackendConfig{}); err != nil || Suppressions != l {
+		t.Error("expected the same list", err)
+	}
+	if err := configureSuppressions(BackendConfig{"suppression_complaint_ttl": "never"}); err == nil {
+		t.Error("expected an invalid TTL")
+	}
+}
+
+const (
+	testDSN = "From: MAILER-DAEMON@mx.example.com\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain\r\n\r\nDelivery failed\r\n" +
+		"--b1\r\nContent-Type: message/delivery-status\r\n\r\n" +
+		"Reporting-MTA: dns; mx.example.com\r\n\r\n" +
+		"Final-Recipient: rfc822; gone@example.com\r\nAction: failed\r\nStatus: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n\r\n" +
+		"Final-Recipient: rfc822; full@example.com\r\nAction: failed\r\nStatus: 4.2.2\r\n\r\n" +
+		"Final-Recipient: rfc822; <ok@example.com>\r\nAction: delivered\r\nStatus: 2.0.0\r\n" +
+		"--b1\r\nContent-Type: text/rfc822-headers\r\n\r\nTo: gone@example.com\r\n" +
+		"--b1--\r\n"
+	testARF = "From: fbl@isp.example\r\n" +
+		"Content-Type: multipart/report; report-type=feedback-report; boundary=\"b2\"\r\n\r\n" +
+		"--b2\r\nContent-Type: text/plain\r\n\r\nAn abuse report\r\n" +
+		"--b2\r\nContent-Type: message/feedback-report\r\n\r\n" +
+		"Feedback-Type: abuse\r\nUser-Agent: FBL/1.0\r\nVersion: 1\r\n" +
+		"--b2\r\nContent-Type: message/rfc822\r\n\r\nTo: Dave <dave@isp.example>\r\nSubject: offer\r\n\r\nbody\r\n" +
+		"--b2--\r\n"
+)
+
+func TestReportedSuppressions(t *testing.T) {
+	list := reportedSuppressions([]byte(testDSN))
+	if len(list) != 1 || list[0].Address != "gone@example.com" || list[0].Reason != SuppressionBounce ||
+		list[0].Detail != "5.1.1 smtp; 550 5.1.1 User unknown" {
+		t.Error("expected the hard bounce only, got", list)
+	}
+	list = reportedSuppressions([]byte(testARF))
+	if len(list) != 1 || list[0].Address != "dave@isp.example" || list[0].Reason != SuppressionComplaint ||
+		list[0].Detail != "abuse" {
+		t.Error("expected the complaint, got", list)
+	}
+	arf := strings.Replace(testARF, "Version: 1\r\n", "Version: 1\r\nOriginal-Rcpt-To: <eve@isp.example>\r\n", 1)
+	if list = reportedSuppressions([]byte(arf)); len(list) != 1 || list[0].Address != "eve@isp.example" {
+		t.Error("expected the Original-Rcpt-To, got", list)
+	}
+	if list = reportedSuppressions([]byte("Subject: hello\r\n\r\nhi\r\n")); list != nil {
+		t.Error("expected nothing for other messages, got", list)
+	}
+}
+
+func TestSuppressProcessor(t *testing.T) {
+	defer func(l *SuppressionList) { Suppressions = l }(Suppressions)
+	defer func() {
+		Deliveries = nil
+	}()
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	backend, err := New(BackendConfig{
+		"save_process":           "HeadersParser|Debugger",
+		"bounce_process":         "Suppress|Debugger",
+		"log_received_mails":     true,
+		"delivery_tracking_size": 10,
+	}, logger)
+	if err != nil {
+		t.Fatal("new backend:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("start backend: ", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{NullPath: true}
+	e.RcptTo = []mail.Address{{User: "sender", Host: "acme.com"}}
+	e.Tenant = "acme"
+	e.Data.WriteString(testDSN)
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the bounce to be accepted, got", result)
+	}
+	if _, ok := Suppressions.Suppressed("acme", "gone@example.com"); !ok {
+		t.Error("expected the bounced address to be suppressed for the tenant")
+	}
+
+	// the failed recipients are recorded as bounced for the message that the DSN returns
+	sent := mail.NewEnvelope("127.0.0.1", 1)
+	sent.QueuedId = "sent1"
+	sent.MailFrom = mail.Address{User: "sender", Host: "acme.com"}
+	sent.RcptTo = []mail.Address{{User: "gone", Host: "example.com"}, {User: "full", Host: "example.com"}}
+	sent.Data.WriteString("Message-Id: <sent1@acme.com>\n\nhi\n")
+	_ = sent.ParseHeaders()
+	TrackDelivery(sent, DeliveryRelayed, "mx.example.com")
+	bounced := func() (rcpts []string) {
+		for _, r := range Deliveries.Lookup("sent1") {
+			for _, event := range r.Events {
+				if event.State == DeliveryBounced {
+					rcpts = append(rcpts, event.Recipient+" "+event.Detail)
+				}
+			}
+		}
+		return rcpts
+	}
+	dsn := strings.Replace(testDSN, "To: gone@example.com\r\n", "To: gone@example.com\r\nMessage-Id: <sent1@acme.com>\r\n", 1)
+	for _, own := range []bool{false, true} {
+		e = mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{NullPath: true}
+		e.RcptTo = []mail.Address{{User: "sender", Host: "acme.com"}}
+		e.Data.WriteString(dsn)
+		if own {
+			// a DSN made by the gateway, which recorded the bounces already
+			e.Values[dsnOfValue] = "sent1"
+		}
+		if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+			t.Fatal("expected the bounce to be accepted, got", result)
+		}
+	}
+	if rcpts := bounced(); len(rcpts) != 2 || rcpts[0] != "gone@example.com 5.1.1 smtp; 550 5.1.1 User unknown" ||
+		rcpts[1] != "full@example.com 4.2.2" {
+		t.Error("expected gone and full to be recorded as bounced once, got", rcpts)
+	}
+}
@@ -0,0 +1,27 @@
+// This is a processor plugin used by the tests, build it with
+// go build -buildmode=plugin
+package main
+
+import (
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// Processors is looked up when the plugin is loaded
+func Processors() map[string]backends.ProcessorConstructor {
+	return map[string]backends.ProcessorConstructor{
+		"PluginTagger": PluginTagger,
+	}
+}
+
+// PluginTagger tags the envelope with plugin:loaded
+func PluginTagger() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+			if task == backends.TaskSaveMail {
+				e.Tags.Add("plugin", "loaded")
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnsubscribeRequest is a recipient asking to stop receiving the mail of a list, by sending
+// mail to the mailto address of the List-Unsubscribe header, or with the https URL
+type UnsubscribeRequest struct {
+	Tenant    string
+	Recipient string
+	// List is the List-Id of the message that the recipient unsubscribed from, if it had one
+	List string
+	// Method is "mailto", or "one-click" for a POST of the URL (RFC 8058)
+	Method string
+	Time   time.Time
+}
+
+// ErrInvalidUnsubscribeToken is returned for tokens that were not made with the secret
+var ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+// unsubscribeMACSize is how many bytes of the HMAC are kept in a token, to keep the
+// mailto address short
+const unsubscribeMACSize = 10
+
+// unsubscribeEncoding is lower case, since mailers may change the case of a local part
+var unsubscribeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// UnsubscribeToken returns the token of the List-Unsubscribe header for the tenant's
+// recipient, signed with the secret
+func UnsubscribeToken(secret []byte, tenant, recipient, list string) string {
+	payload := []byte(tenant + "\x00" + strings.ToLower(recipient) + "\x00" + list)
+	return unsubscribeEncoding.EncodeToString(append(payload, unsubscribeMAC(secret, payload)...))
+}
+
+// ParseUnsubscribeToken returns the request of a token made by UnsubscribeToken with the
+// secret. Method and Time are not set
+func ParseUnsubscribeToken(secret []byte, token string) (*UnsubscribeRequest, error) {
+	data, err := unsubscribeEncoding.DecodeString(strings.ToLower(token))
+	if err != nil || len(data) <= unsubscribeMACSize {
+		return nil, ErrInvalidUnsubscribeToken
+	}
+	payload, mac := data[:len(data)-unsubscribeMACSize], data[len(data)-unsubscribeMACSize:]
+	if !hmac.Equal(mac, unsubscribeMAC(secret, payload)) {
+		return nil, ErrInvalidUnsubscribeToken
+	}
+	fields := strings.SplitN(string(payload), "\x00", 3)
+	if len(fields) != 3 || fields[1] == "" {
+		return nil, ErrInvalidUnsubscribeToken
+	}
+	return &UnsubscribeRequest{Tenant: fields[0], Recipient: fields[1], List: fields[2]}, nil
+}
+
+func unsubscribeMAC(secret, payload []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(payload)
+	return h.Sum(nil)[:unsubscribeMACSize]
+}
+
+// UnsubscribeHandler is given the requests received by the unsubscribe processor
+type UnsubscribeHandler func(r *UnsubscribeRequest)
+
+var unsubscribeHandlers = struct {
+	sync.RWMutex
+	m map[string]UnsubscribeHandler
+}{m: map[string]UnsubscribeHandler{
+	"suppressions": suppressUnsubscribed,
+}}
+
+// RegisterUnsubscribeHandler adds a handler for the unsubscribe requests, eg. to remove the
+// recipient from a mailing list. Names are case-insensitive, a handler with the same name is
+// replaced, and a nil handler removes it. By default, the recipients are added to the
+// Suppressions, remove the "suppressions" handler when the lists are managed elsewhere
+func RegisterUnsubscribeHandler(name string, h UnsubscribeHandler) {
+	unsubscribeHandlers.Lock()
+	defer unsubscribeHandlers.Unlock()
+	if h == nil {
+		delete(unsubscribeHandlers.m, strings.ToLower(name))
+		return
+	}
+	unsubscribeHandlers.m[strings.ToLower(name)] = h
+}
+
+// handleUnsubscribe calls the handlers, in order of name
+func handleUnsubscribe(r *UnsubscribeRequest) {
+	unsubscribeHandlers.RLock()
+	names := make([]string, 0, len(unsubscribeHandlers.m))
+	for name := range unsubscribeHandlers.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	handlers := make([]UnsubscribeHandler, len(names))
+	for i, name := range names {
+		handlers[i] = unsubscribeHandlers.m[name]
+	}
+	unsubscribeHandlers.RUnlock()
+	Log().Infof("unsubscribe of %s from %q by %s", r.Recipient, r.List, r.Method)
+	for _, h := range handlers {
+		h(r)
+	}
+}
+
+// suppressUnsubscribed adds the recipient to the suppression list
+func suppressUnsubscribed(r *UnsubscribeRequest) {
+	s := Suppression{Address: r.Recipient, Tenant: r.Tenant, Reason: SuppressionUnsubscribe, Detail: r.List}
+	if err := Suppressions.Add(s); err != nil {
+		Log().WithError(err).Error("could not add to the suppression list")
+	}
+}
+
+// unsubscribePage is shown for a GET of the URL. Links are fetched by scanners, so only a
+// POST unsubscribes
+const unsubscribePage = `<!DOCTYPE html>
+<html><head><title>Unsubscribe</title></head><body>
+<form method="post"><input type="hidden" name="List-Unsubscribe" value="One-Click">
+<p>Unsubscribe %s?</p><button type="submit">Unsubscribe</button></form>
+</body></html>
+`
+
+// UnsubscribeHTTPHandler serves the https URL of the List-Unsubscribe header, with the token
+// in the token parameter. A POST unsubscribes, eg. the one-click POST of RFC 8058, and a
+// GET asks the recipient to confirm
+func UnsubscribeHTTPHandler(secret []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := ParseUnsubscribeToken(secret, r.URL.Query().Get("token"))
+		if err != nil {
+			http.Error(w, "this unsubscribe link is not valid", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = fmt.Fprintf(w, unsubscribePage, html.EscapeString(req.Recipient))
+		case http.MethodPost:
+			req.Method = "one-click"
+			req.Time = time.Now()
+			handleUnsubscribe(req)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = fmt.Fprintf(w, "%s was unsubscribed\n", req.Recipient)
+		default:
+			http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// unsubscribeServer serves UnsubscribeHTTPHandler for the processors that listen on the
+// same interface
+type unsubscribeServer struct {
+	srv   *http.Server
+	addr  string
+	users int
+}
+
+var (
+	unsubscribeServersGuard sync.Mutex
+	unsubscribeServers      = make(map[string]*unsubscribeServer)
+)
+
+// useUnsubscribeServer starts serving the URL on the interface, if it's not served already
+func useUnsubscribeServer(listen string, secret []byte) (*unsubscribeServer, error) {
+	unsubscribeServersGuard.Lock()
+	defer unsubscribeServersGuard.Unlock()
+	if s, ok := unsubscribeServers[listen]; ok {
+		s.users++
+		return s, nil
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &unsubscribeServer{
+		srv: &http.Server{
+			Handler:      UnsubscribeHTTPHandler(secret),
+			ReadTimeout:  time.Second * 30,
+			WriteTimeout: time.Second * 30,
+		},
+		addr:  l.Addr().String(),
+		users: 1,
+	}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			Log().WithError(err).Error("unsubscribe server stopped")
+		}
+	}()
+	unsubscribeServers[listen] = s
+	Log().Infof("unsubscribe URL served on %s", s.addr)
+	return s, nil
+}
+
+// release stops the server when the last processor that used it is shut down
+func (s *unsubscribeServer) release(listen string) error {
+	unsubscribeServersGuard.Lock()
+	defer unsubscribeServersGuard.Unlock()
+	s.users--
+	if s.users > 0 {
+		return nil
+	}
+	delete(unsubscribeServers, listen)
+	return s.srv.Close()
+}
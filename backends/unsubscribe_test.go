@@ -0,0 +1,124 @@
+package backends
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	secret := []byte("s3cret")
+	token := UnsubscribeToken(secret, "acme", "Dave@Example.com", "news.acme.com")
+	if strings.ToLower(token) != token {
+		t.Error("expected a lower case token, got", token)
+	}
+	r, err := ParseUnsubscribeToken(secret, strings.ToUpper(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Tenant != "acme" || r.Recipient != "dave@example.com" || r.List != "news.acme.com" {
+		t.Errorf("unexpected request %+v", r)
+	}
+	if _, err := ParseUnsubscribeToken([]byte("other"), token); err != ErrInvalidUnsubscribeToken {
+		t.Error("expected a token of another secret to be refused, got", err)
+	}
+	tampered := UnsubscribeToken(secret, "acme", "eve@example.com", "")
+	tampered = tampered[:len(tampered)-16] + token[len(token)-16:]
+	if _, err := ParseUnsubscribeToken(secret, tampered); err != ErrInvalidUnsubscribeToken {
+		t.Error("expected a tampered token to be refused, got", err)
+	}
+}
+
+func TestUnsubscribeHTTPHandler(t *testing.T) {
+	var requests []*UnsubscribeRequest
+	RegisterUnsubscribeHandler("test", func(r *UnsubscribeRequest) {
+		requests = append(requests, r)
+	})
+	defer RegisterUnsubscribeHandler("test", nil)
+	defer func(l *SuppressionList) { Suppressions = l }(Suppressions)
+	Suppressions = NewSuppressionList()
+
+	secret := []byte("s3cret")
+	h := UnsubscribeHTTPHandler(secret)
+	url := "/unsubscribe?token=" + UnsubscribeToken(secret, "acme", "dave@example.com", "")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "dave@example.com") || len(requests) != 0 {
+		t.Fatal("expected GET to ask for confirmation, got", w.Code, requests)
+	}
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, url, strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(requests) != 1 || requests[0].Method != "one-click" {
+		t.Fatal("expected POST to unsubscribe, got", w.Code, requests)
+	}
+	if s, ok := Suppressions.Suppressed("acme", "dave@example.com"); !ok || s.Reason != SuppressionUnsubscribe {
+		t.Error("expected the recipient to be suppressed", s)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/unsubscribe?token=abc", nil))
+	if w.Code != http.StatusNotFound || len(requests) != 1 {
+		t.Error("expected an invalid token to be refused, got", w.Code)
+	}
+}
+
+func TestUnsubscribeProcessor(t *testing.T) {
+	var requests []*UnsubscribeRequest
+	RegisterUnsubscribeHandler("test", func(r *UnsubscribeRequest) {
+		requests = append(requests, r)
+	})
+	defer RegisterUnsubscribeHandler("test", nil)
+	defer func(l *SuppressionList) { Suppressions = l }(Suppressions)
+	Suppressions = NewSuppressionList()
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":       "HeadersParser|Header|Unsubscribe|Debugger",
+		"primary_mail_host":  "mail.acme.com",
+		"unsubscribe_secret": "s3cret",
+		"unsubscribe_url":    "https://mail.acme.com/{tenant}/unsubscribe",
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := newBrokerTestEnvelope()
+	e.AuthorizedLogin = "news"
+	e.RcptTo = e.RcptTo[:1]
+	e.Data.Reset()
+	e.Data.WriteString("List-Id: News <news.acme.com>\nSubject: hello\n\nbody\n")
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	m := regexp.MustCompile(`List-Unsubscribe: <mailto:(unsubscribe\+(\w+))@mail\.acme\.com>,\n\t` +
+		`<https://mail\.acme\.com/acme/unsubscribe\?token=(\w+)>\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\n`).
+		FindStringSubmatch(e.DeliveryHeader)
+	if m == nil || m[2] != m[3] {
+		t.Fatal("expected the unsubscribe headers, got", e.DeliveryHeader)
+	}
+
+	// the mail of clients that are not authenticated is not changed
+	e = newBrokerTestEnvelope()
+	e.RcptTo = e.RcptTo[:1]
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") ||
+		strings.Contains(e.DeliveryHeader, "List-Unsubscribe") {
+		t.Fatal("expected no unsubscribe headers, got", e.DeliveryHeader)
+	}
+
+	// the recipient sends mail to the mailto address
+	e = newBrokerTestEnvelope()
+	e.RcptTo = []mail.Address{{User: strings.ToUpper(m[1]), Host: "mail.acme.com"}}
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be accepted, got", result)
+	}
+	if len(requests) != 1 || requests[0].Method != "mailto" || requests[0].List != "news.acme.com" ||
+		e.Values["unsubscribe"] != requests[0] {
+		t.Fatal("expected the unsubscribe to be handled", requests)
+	}
+	if _, ok := Suppressions.Suppressed("acme", requests[0].Recipient); !ok {
+		t.Error("expected the recipient to be suppressed")
+	}
+}
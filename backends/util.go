@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"compress/zlib"
 	"crypto/md5"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/textproto"
 	"regexp"
 	"strings"
@@ -59,3 +61,26 @@ func Compress(stringArguments ...string) string {
 	_ = w.Close()
 	return b.String()
 }
+
+// TenantPlaceholder is replaced with the envelope's tenant name in storage names,
+// such as table names and key prefixes
+const TenantPlaceholder = "{tenant}"
+
+// ForTenant replaces the TenantPlaceholder in name with the tenant
+func ForTenant(name, tenant string) string {
+	return strings.Replace(name, TenantPlaceholder, tenant, -1)
+}
+
+// readCAFile returns the certificates of the PEM file, to verify servers with. option is the
+// name of the config option, for the errors
+func readCAFile(option, path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", option, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s %s", option, path)
+	}
+	return pool, nil
+}
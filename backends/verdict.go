@@ -0,0 +1,115 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// Methods of the verdicts that are not authentication results
+const (
+	VerdictSpam  = "spam"
+	VerdictVirus = "virus"
+)
+
+// Verdict is the result of a check by a scanner processor. Scanners record their verdicts with
+// AddVerdict, then the "verdicts" processor turns them into standard headers
+type Verdict struct {
+	// Method is the name of the check. For authentication results it's the RFC 8601 method,
+	// eg. "spf", "dkim", "dmarc", "iprev". Use VerdictSpam or VerdictVirus for scanners
+	Method string
+	// Result is the outcome. For authentication results it's the RFC 8601 result, eg. "pass",
+	// "fail", "temperror". For spam it's "yes" or "no", for viruses it's "clean" or "infected"
+	Result string
+	// Reason is an optional explanation, eg. the name of a virus, or the spam rules that matched
+	Reason string
+	// Properties are RFC 8601 properties, eg. "smtp.mailfrom=example.com" or "header.d=example.com"
+	Properties []string
+	// Score and Required are the spam score and the score needed for the message to be spam
+	Score    float64
+	Required float64
+	// Scanner is the name of the software that did the check, eg. "ClamAV"
+	Scanner string
+}
+
+const verdictsKey = "verdicts"
+
+// AddVerdict records a verdict in the envelope, and also tags the envelope with method:result
+func AddVerdict(e *mail.Envelope, v Verdict) {
+	v.Method = strings.ToLower(v.Method)
+	v.Result = strings.ToLower(v.Result)
+	verdicts, _ := e.Values[verdictsKey].([]Verdict)
+	e.Values[verdictsKey] = append(verdicts, v)
+	e.Tags.Add(v.Method, v.Result)
+}
+
+// GetVerdicts returns the verdicts recorded in the envelope, in the order they were added
+func GetVerdicts(e *mail.Envelope) []Verdict {
+	verdicts, _ := e.Values[verdictsKey].([]Verdict)
+	return verdicts
+}
+
+// SpamScore returns the score of the last spam verdict, 0 if the email wasn't scanned
+func SpamScore(e *mail.Envelope) float64 {
+	verdicts := GetVerdicts(e)
+	for i := len(verdicts) - 1; i >= 0; i-- {
+		if verdicts[i].Method == VerdictSpam {
+			return verdicts[i].Score
+		}
+	}
+	return 0
+}
+
+// spamStatusHeader returns the X-Spam-Status header for a spam verdict
+func spamStatusHeader(v Verdict) string {
+	status := "No"
+	if v.Result == "yes" {
+		status = "Yes"
+	}
+	header := fmt.Sprintf("X-Spam-Status: %s, score=%.1f required=%.1f", status, v.Score, v.Required)
+	if v.Reason != "" {
+		header += "\n\ttests=" + v.Reason
+	}
+	return header + "\n"
+}
+
+// VerdictHeaders returns the Authentication-Results, X-Spam-Status and X-Virus-Scanned
+// headers for the verdicts. authservID identifies this server in Authentication-Results
+func VerdictHeaders(authservID string, verdicts []Verdict) string {
+	var sb strings.Builder
+	var auth []string
+	for _, v := range verdicts {
+		switch v.Method {
+		case VerdictSpam:
+			sb.WriteString(spamStatusHeader(v))
+		case VerdictVirus:
+			scanner := v.Scanner
+			if scanner == "" {
+				scanner = "unknown"
+			}
+			_, _ = fmt.Fprintf(&sb, "X-Virus-Scanned: %s on %s\n", scanner, authservID)
+			status := "Clean"
+			if v.Result == "infected" {
+				status = "Infected"
+			}
+			if v.Reason != "" {
+				status += " (" + v.Reason + ")"
+			}
+			sb.WriteString("X-Virus-Status: " + status + "\n")
+		default:
+			result := v.Method + "=" + v.Result
+			if v.Reason != "" {
+				result += " reason=\"" + strings.Replace(v.Reason, "\"", "'", -1) + "\""
+			}
+			for _, p := range v.Properties {
+				result += " " + p
+			}
+			auth = append(auth, result)
+		}
+	}
+	if len(auth) == 0 {
+		auth = append(auth, "none")
+	}
+	return "Authentication-Results: " + authservID + ";\n\t" + strings.Join(auth, ";\n\t") + "\n" + sb.String()
+}
@@ -0,0 +1,21 @@
+package backends
+
+import (
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// verifyValue is the key of e.Values that marks an envelope as an address probe, see VerifyOnly
+const verifyValue = "verify"
+
+// VerifyOnly marks e as an address probe, eg. for VRFY, that's only checked by the validate_process
+// and never saved. The validators must not change any state for it, eg. the greylist doesn't record
+// a triplet, so that probes can't be used to warm it up
+func VerifyOnly(e *mail.Envelope) {
+	e.Values[verifyValue] = true
+}
+
+// IsVerifyOnly returns true if e is an address probe, see VerifyOnly
+func IsVerifyOnly(e *mail.Envelope) bool {
+	verify, _ := e.Values[verifyValue].(bool)
+	return verify
+}
@@ -0,0 +1,209 @@
+package backends
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// writeBehindItem is a write that's waiting for the storage to be back
+type writeBehindItem struct {
+	// id identifies the email in the logs, its queued id
+	id string
+	// size is roughly how much memory the write takes
+	size  int
+	value interface{}
+}
+
+// writeBehind buffers the writes of a processor while its storage can't be reached, so that a
+// short stall doesn't fail the emails, and writes them in batches once the storage is back. It's
+// bounded by the size of the writes and by how long the storage may stall, after that the emails
+// fail with a temporary error as they would without it. The emails are accepted once their
+// writes are buffered, so they're lost if the daemon crashes before the storage is back
+type writeBehind struct {
+	name     string
+	maxBytes int
+	maxStall time.Duration
+	batch    int
+	interval time.Duration
+	// write writes a batch in order and returns how many of its writes were done before an
+	// error. retry tells if the error is worth trying again later, and close is called once the
+	// last writes were tried at shutdown
+	write func(items []writeBehindItem) (int, error)
+	retry func(err error) bool
+	close func() error
+
+	items []writeBehindItem
+	bytes int
+	// since is when the first of the buffered writes was buffered
+	since time.Time
+	sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+	// how many processors use it
+	users int
+}
+
+const defaultWriteBehindStall = time.Second * 30
+
+// writeBehindInterval is how often the storage is tried while there are buffered writes
+var writeBehindInterval = time.Second
+
+// errWriteBehindPending is returned for a write that is not tried, to keep the order of the
+// writes while earlier ones are buffered
+var errWriteBehindPending = errors.New("the earlier writes are waiting for the storage")
+
+var (
+	writeBehindsGuard sync.Mutex
+	// the buffers of the processors, by their config, so that the workers share them
+	writeBehinds = make(map[string]*writeBehind)
+)
+
+// useWriteBehind returns the buffer for the key, making and starting it with newFunc if it's
+// not used already
+func useWriteBehind(key string, newFunc func() (*writeBehind, error)) (*writeBehind, error) {
+	writeBehindsGuard.Lock()
+	defer writeBehindsGuard.Unlock()
+	if w, ok := writeBehinds[key]; ok {
+		w.users++
+		return w, nil
+	}
+	w, err := newFunc()
+	if err != nil {
+		return nil, err
+	}
+	if w.interval == 0 {
+		w.interval = writeBehindInterval
+	}
+	w.users = 1
+	w.stop, w.done = make(chan struct{}), make(chan struct{})
+	writeBehinds[key] = w
+	go w.run()
+	return w, nil
+}
+
+// release stops the buffer when the last processor that used it is shut down. The buffered
+// writes are tried a last time, the ones that still fail are logged as lost
+func (w *writeBehind) release() error {
+	writeBehindsGuard.Lock()
+	w.users--
+	last := w.users == 0
+	if last {
+		for key, v := range writeBehinds {
+			if v == w {
+				delete(writeBehinds, key)
+			}
+		}
+	}
+	writeBehindsGuard.Unlock()
+	if !last {
+		return nil
+	}
+	close(w.stop)
+	<-w.done
+	if w.close != nil {
+		return w.close()
+	}
+	return nil
+}
+
+// add buffers a write. It returns false if there's no room for it, or the storage has stalled
+// for longer than maxStall
+func (w *writeBehind) add(item writeBehindItem) bool {
+	w.Lock()
+	defer w.Unlock()
+	now := Now()
+	if len(w.items) > 0 && now.Sub(w.since) > w.maxStall {
+		return false
+	}
+	if w.bytes+item.size > w.maxBytes {
+		return false
+	}
+	if len(w.items) == 0 {
+		w.since = now
+		Log().Warnf("%s: the storage can't be reached, the writes are buffered", w.name)
+	}
+	w.items = append(w.items, item)
+	w.bytes += item.size
+	return true
+}
+
+// pending returns true while there are buffered writes
+func (w *writeBehind) pending() bool {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.items) > 0
+}
+
+func (w *writeBehind) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			w.Lock()
+			for _, item := range w.items {
+				Log().Errorf("%s: the storage is still away at shutdown, the write of %s is lost", w.name, item.id)
+			}
+			w.items, w.bytes = nil, 0
+			w.Unlock()
+			return
+		}
+	}
+}
+
+// flush writes the buffered writes a batch at a time, until the storage fails again. A write
+// that's refused for another reason is logged as lost, so that it doesn't hold up the others
+func (w *writeBehind) flush() {
+	for {
+		w.Lock()
+		n := len(w.items)
+		if n > w.batch {
+			n = w.batch
+		}
+		batch := append([]writeBehindItem(nil), w.items[:n]...)
+		w.Unlock()
+		if n == 0 {
+			return
+		}
+		done, err := w.write(batch)
+		stalled := err != nil && w.retry(err)
+		if err != nil && !stalled {
+			Log().WithError(err).Errorf("%s: the buffered write of %s failed, it's lost", w.name, batch[done].id)
+			done++
+		}
+		w.Lock()
+		for _, item := range w.items[:done] {
+			w.bytes -= item.size
+		}
+		w.items = append(w.items[:0], w.items[done:]...)
+		if len(w.items) == 0 {
+			Log().Infof("%s: the storage is back, the buffered writes were written", w.name)
+		}
+		w.Unlock()
+		if stalled {
+			return
+		}
+	}
+}
+
+// writeBehindSize returns roughly how much memory the values take
+func writeBehindSize(values ...interface{}) int {
+	size := 0
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		default:
+			size += 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,257 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorage is the storage of a write-behind buffer, that can be taken down
+type fakeStorage struct {
+	sync.Mutex
+	down    bool
+	refuse  string
+	written []string
+	batches int
+}
+
+var errFakeStorageDown = errors.New("storage down")
+
+func (f *fakeStorage) write(items []writeBehindItem) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return 0, errFakeStorageDown
+	}
+	f.batches++
+	for i, item := range items {
+		if item.id == f.refuse {
+			return i, errors.New("refused")
+		}
+		f.written = append(f.written, item.id)
+	}
+	return len(items), nil
+}
+
+func (f *fakeStorage) setDown(down bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.down = down
+}
+
+func (f *fakeStorage) writes() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.written...)
+}
+
+// waitFlushed waits until the buffer is written
+func waitFlushed(t *testing.T, w *writeBehind) {
+	for i := 0; w.pending(); i++ {
+		if i == 200 {
+			t.Fatal("expected the buffer to be flushed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	c := NewManualClock(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	restore := SetClock(c)
+	defer SetClock(restore)
+	storage := &fakeStorage{down: true, refuse: "bad"}
+	newFunc := func() (*writeBehind, error) {
+		return &writeBehind{
+			name:     "test",
+			maxBytes: 10,
+			maxStall: time.Second * 30,
+			batch:    2,
+			interval: time.Millisecond * 10,
+			write:    storage.write,
+			retry:    func(err error) bool { return err == errFakeStorageDown },
+		}, nil
+	}
+	w, err := useWriteBehind("test", newFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := useWriteBehind("test", newFunc); other != w {
+		t.Error("expected the workers to share the buffer")
+	}
+	defer func() {
+		_ = w.release()
+	}()
+
+	for _, id := range []string{"a", "bad", "c"} {
+		if !w.add(writeBehindItem{id: id, size: 3}) {
+			t.Fatal("expected", id, "to be buffered")
+		}
+	}
+	if w.add(writeBehindItem{id: "d", size: 3}) {
+		t.Error("expected the buffer to be full")
+	}
+	c.Advance(time.Second * 31)
+	if w.add(writeBehindItem{id: "e", size: 1}) {
+		t.Error("expected the stall to be too long")
+	}
+
+	// the bad write is dropped, the others are written in order and in batches
+	storage.setDown(false)
+	waitFlushed(t, w)
+	if got := strings.Join(storage.writes(), ","); got != "a,c" {
+		t.Error("expected a and c to be written, got", got)
+	}
+	if storage.batches != 2 {
+		t.Error("expected 2 batches, got", storage.batches)
+	}
+	if !w.add(writeBehindItem{id: "f", size: 10}) {
+		t.Error("expected the buffer to have room again")
+	}
+}
+
+func TestWriteBehindRelease(t *testing.T) {
+	storage := &fakeStorage{down: true}
+	closed := false
+	w, err := useWriteBehind("release", func() (*writeBehind, error) {
+		return &writeBehind{
+			name:     "test",
+			maxBytes: 10,
+			maxStall: time.Second * 30,
+			batch:    2,
+			interval: time.Hour,
+			write:    storage.write,
+			retry:    func(err error) bool { return err == errFakeStorageDown },
+			close: func() error {
+				closed = true
+				return nil
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.add(writeBehindItem{id: "a", size: 1})
+	storage.setDown(false)
+	// the buffer is written at shutdown, rather than in an hour
+	if err := w.release(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storage.writes(); len(got) != 1 || !closed {
+		t.Error("expected the buffer to be written and closed, got", got, closed)
+	}
+}
+
+// fakeStalledRedis is a redis that can be taken down
+type fakeStalledRedis struct {
+	sync.Mutex
+	down bool
+	keys map[string]string
+}
+
+func (f *fakeStalledRedis) Close() error {
+	return nil
+}
+
+func (f *fakeStalledRedis) Do(commandName string, args ...interface{}) (interface{}, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return nil, errors.New("connection reset by peer")
+	}
+	if commandName == "SET" {
+		f.keys[args[0].(string)] = args[1].(string)
+	}
+	return "OK", nil
+}
+
+func TestRedisWriteBehind(t *testing.T) {
+	redis := &fakeStalledRedis{keys: make(map[string]string)}
+	saved, interval := RedisDialer, writeBehindInterval
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		return redis, nil
+	}
+	writeBehindInterval = time.Millisecond * 10
+	defer func() {
+		RedisDialer, writeBehindInterval = saved, interval
+	}()
+
+	backend := newBrokerTestBackend(t, BackendConfig{
+		"save_process":            "HeadersParser|Hasher|Redis|Debugger",
+		"redis_interface":         "127.0.0.1:6379",
+		"redis_write_behind_size": 1024,
+	})
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	redis.Lock()
+	redis.down = true
+	redis.Unlock()
+	e := newBrokerTestEnvelope()
+	if result := backend.Process(e); !strings.HasPrefix(result.String(), "250") {
+		t.Fatal("expected the mail to be buffered, got", result)
+	}
+	big := newBrokerTestEnvelope()
+	big.Data.WriteString(strings.Repeat("x", 1024))
+	if result := backend.Process(big); !strings.HasPrefix(result.String(), "554") {
+		t.Error("expected the buffer to be full, got", result)
+	}
+
+	redis.Lock()
+	redis.down = false
+	redis.Unlock()
+	for i := 0; ; i++ {
+		redis.Lock()
+		data, ok := redis.keys[e.QueuedId]
+		redis.Unlock()
+		if ok {
+			if !strings.Contains(data, "Subject: hello") {
+				t.Error("unexpected data", data)
+			}
+			break
+		}
+		if i == 200 {
+			t.Fatal("expected the buffered key to be set")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSQLWriteBehind(t *testing.T) {
+	file, cleanup := sqlBatchTestDB(t)
+	defer cleanup()
+	interval := writeBehindInterval
+	writeBehindInterval = time.Millisecond * 10
+	defer func() {
+		writeBehindInterval = interval
+	}()
+	w, err := useSQLWriteBehind(&SQLProcessorConfig{
+		Table:           "mail",
+		Driver:          "sqlite3",
+		DSN:             file,
+		SQLValues:       sqlBatchTestValues,
+		WriteBehindSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.release()
+	}()
+	row := func(hash string) []interface{} {
+		return []interface{}{"to", "from", "subject", "", "mail", hash, "text/plain", "rcpt",
+			[]byte{127, 0, 0, 1}, "from", false, "mid", "", ""}
+	}
+	e := newBrokerTestEnvelope()
+	e.Tenant = ""
+	for i := 0; i < 30; i++ {
+		if !w.add(sqlWriteBehindItem(e, [][]interface{}{row("a"), row("b")})) {
+			t.Fatal("expected the rows to be buffered")
+		}
+	}
+	waitFlushed(t, w)
+	if n := countSQLBatchTestRows(t, file); n != 60 {
+		t.Error("expected 60 rows, got", n)
+	}
+}
@@ -0,0 +1,305 @@
+package guerrilla
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+// CertMonitorConfig configures the checks of the expiry of the servers' TLS certificates.
+// Certificates that expire within WarnDays are logged, and sent to the webhook and alert_to
+type CertMonitorConfig struct {
+	// Interval is how often the certificates are checked, eg. "1h". Defaults to 12h.
+	// Changes take effect after a restart
+	Interval string `json:"interval,omitempty"`
+	// WarnDays is how many days before the expiry to warn. Defaults to 14
+	WarnDays int `json:"warn_days,omitempty"`
+	// WebhookURL is sent a JSON POST with the certificates that expire soon
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// AlertTo are the addresses that are emailed about the certificates that expire soon
+	AlertTo []string `json:"alert_to,omitempty"`
+	// AlertFrom is the sender of the email, defaults to postmaster at the first allowed host
+	AlertFrom string `json:"alert_from,omitempty"`
+	// Smarthost is the host:port that the email is sent through
+	Smarthost string `json:"smarthost,omitempty"`
+}
+
+const (
+	defaultCertCheckInterval = time.Hour * 12
+	defaultCertWarnDays      = 14
+	// certRealertInterval is how long to wait before alerting again about a certificate
+	certRealertInterval = time.Hour * 24
+)
+
+// interval returns the check interval
+func (c *CertMonitorConfig) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return defaultCertCheckInterval, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid cert_monitor interval %q", c.Interval)
+	}
+	return d, nil
+}
+
+func (c *CertMonitorConfig) warnDays() int {
+	if c.WarnDays <= 0 {
+		return defaultCertWarnDays
+	}
+	return c.WarnDays
+}
+
+// CertStatus is the expiry of a server's certificate
+type CertStatus struct {
+	// Server is the listen interface of the server
+	Server   string    `json:"server"`
+	File     string    `json:"file"`
+	Subject  string    `json:"subject,omitempty"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	NotAfter time.Time `json:"not_after,omitempty"`
+	// DaysLeft is the number of whole days until the expiry, negative once expired
+	DaysLeft int `json:"days_left"`
+	// Error is set when the certificate could not be read
+	Error string `json:"error,omitempty"`
+
+	fingerprint [32]byte
+}
+
+// readCertStatus returns the expiry of the first certificate of the PEM file
+func readCertStatus(server, file string, now time.Time) CertStatus {
+	s := CertStatus{Server: server, File: file}
+	cert, err := readLeafCertificate(file)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Subject = cert.Subject.CommonName
+	s.DNSNames = cert.DNSNames
+	s.NotAfter = cert.NotAfter
+	left := cert.NotAfter.Sub(now)
+	s.DaysLeft = int(left / (time.Hour * 24))
+	if left < 0 && left%(time.Hour*24) != 0 {
+		s.DaysLeft--
+	}
+	s.fingerprint = sha256.Sum256(cert.Raw)
+	return s
+}
+
+func readLeafCertificate(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// certMonitor checks the certificates of the servers in the background
+type certMonitor struct {
+	g    *guerrilla
+	stop chan struct{}
+	// statuses are the results of the last check
+	statuses []CertStatus
+	// alerted is when each certificate was last alerted about
+	alerted map[[32]byte]time.Time
+	sync.Mutex
+}
+
+// certAlertClient sends the alerts to the webhook
+var certAlertClient = &http.Client{Timeout: time.Second * 10}
+
+// startCertMonitor checks the certificates now, and then every interval until stopCertMonitor.
+// It's called with g.guard locked, the checks lock it too
+func (g *guerrilla) startCertMonitor() error {
+	if g.certs != nil {
+		return nil
+	}
+	interval, err := g.Config.CertMonitor.interval()
+	if err != nil {
+		return err
+	}
+	m := &certMonitor{
+		g:       g,
+		stop:    make(chan struct{}),
+		alerted: make(map[[32]byte]time.Time),
+	}
+	g.certs = m
+	go func() {
+		m.check(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				m.check(now)
+			}
+		}
+	}()
+	return nil
+}
+
+// stopCertMonitor stops the checks
+func (g *guerrilla) stopCertMonitor() {
+	if g.certs != nil {
+		close(g.certs.stop)
+		g.certs = nil
+	}
+}
+
+// certificates returns the results of the last check
+func (g *guerrilla) certificates() []CertStatus {
+	g.guard.Lock()
+	m := g.certs
+	g.guard.Unlock()
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	return append([]CertStatus(nil), m.statuses...)
+}
+
+// adminCertificates returns the expiry of the certificates of the servers, GET /certificates.
+// Only the admin token may use it
+func (g *guerrilla) adminCertificates(w http.ResponseWriter, r *http.Request, tenant string) {
+	if tenant != "" {
+		writeAdminError(w, http.StatusForbidden, "requires the admin token")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	statuses := g.certificates()
+	if statuses == nil {
+		statuses = make([]CertStatus, 0)
+	}
+	writeAdminJSON(w, http.StatusOK, statuses)
+}
+
+// check reads the certificates of the enabled TLS servers, and alerts about the ones that
+// expire soon
+func (m *certMonitor) check(now time.Time) {
+	m.g.guard.Lock()
+	config := m.g.Config.CertMonitor
+	var statuses []CertStatus
+	// the config of each server is a snapshot, the app config's servers may be changed by a reload
+	for _, server := range m.g.servers {
+		sc, ok := server.configStore.Load().(ServerConfig)
+		if !ok || !sc.IsEnabled || (!sc.TLS.StartTLSOn && !sc.TLS.AlwaysOn) || sc.TLS.PublicKeyFile == "" {
+			continue
+		}
+		statuses = append(statuses, readCertStatus(sc.ListenInterface, sc.TLS.PublicKeyFile, now))
+	}
+	from := config.AlertFrom
+	if from == "" && len(m.g.Config.AllowedHosts) > 0 {
+		from = "postmaster@" + m.g.Config.AllowedHosts[0]
+	}
+	m.g.guard.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Server < statuses[j].Server })
+
+	var expiring []CertStatus
+	m.Lock()
+	m.statuses = statuses
+	for _, s := range statuses {
+		if s.Error != "" {
+			m.g.mainlog().Errorf("could not check the certificate %s of %s: %s", s.File, s.Server, s.Error)
+			continue
+		}
+		if s.DaysLeft >= config.warnDays() {
+			continue
+		}
+		m.g.mainlog().Warnf("the certificate %s of %s expires in %d days, on %s", s.File, s.Server,
+			s.DaysLeft, s.NotAfter.Format(time.RFC1123Z))
+		if last, ok := m.alerted[s.fingerprint]; ok && now.Sub(last) < certRealertInterval {
+			continue
+		}
+		m.alerted[s.fingerprint] = now
+		expiring = append(expiring, s)
+	}
+	m.Unlock()
+	if len(expiring) == 0 {
+		return
+	}
+	if config.WebhookURL != "" {
+		if err := postCertAlert(config.WebhookURL, expiring); err != nil {
+			m.g.mainlog().WithError(err).Error("could not send the certificate alert to the webhook")
+		}
+	}
+	if len(config.AlertTo) > 0 && config.Smarthost != "" {
+		if err := mailCertAlert(config.Smarthost, from, config.AlertTo, expiring); err != nil {
+			m.g.mainlog().WithError(err).Error("could not email the certificate alert")
+		}
+	}
+}
+
+// postCertAlert sends the certificates that expire soon as {"certificates": [...]}
+func postCertAlert(url string, expiring []CertStatus) error {
+	body, err := json.Marshal(map[string][]CertStatus{"certificates": expiring})
+	if err != nil {
+		return err
+	}
+	resp, err := certAlertClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+var certAlertTemplate = backends.MessageTemplate{
+	Headers: map[string]string{
+		"From":           "{{.From}}",
+		"To":             "{{.To}}",
+		"Subject":        "TLS certificates expire soon",
+		"Auto-Submitted": "auto-generated",
+	},
+	Text: "These certificates expire soon, renew them and reload the config:\n" +
+		"{{range .Certificates}}\n{{.File}} of {{.Server}}, for {{.Subject}}, " +
+		"expires on {{.NotAfter.Format \"2006-01-02 15:04 MST\"}}, in {{.DaysLeft}} days\n{{end}}",
+}
+
+// sendCertAlertMail sends the alert email, it's replaced by the tests
+var sendCertAlertMail = smtp.SendMail
+
+// mailCertAlert emails the certificates that expire soon through the smarthost
+func mailCertAlert(smarthost, from string, to []string, expiring []CertStatus) error {
+	composer, err := backends.NewComposer(certAlertTemplate)
+	if err != nil {
+		return err
+	}
+	msg, err := composer.Compose(struct {
+		From, To     string
+		Certificates []CertStatus
+	}{from, strings.Join(to, ", "), expiring})
+	if err != nil {
+		return err
+	}
+	return sendCertAlertMail(smarthost, nil, from, to, msg)
+}
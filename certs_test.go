@@ -0,0 +1,157 @@
+package guerrilla
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// writeTestCert writes a self-signed certificate that expires at notAfter
+func writeTestCert(t *testing.T, path string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(notAfter.Unix()),
+		Subject:      pkix.Name{CommonName: "mail.example.com"},
+		DNSNames:     []string{"mail.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	now := time.Now()
+	file := filepath.Join(dir, "cert.pem")
+	writeTestCert(t, file, now.Add(time.Hour*24*10+time.Hour))
+	if s := readCertStatus("127.0.0.1:25", file, now); s.DaysLeft != 10 || s.Subject != "mail.example.com" || s.Error != "" {
+		t.Errorf("unexpected status %+v", s)
+	}
+	writeTestCert(t, file, now.Add(-time.Hour))
+	if s := readCertStatus("127.0.0.1:25", file, now); s.DaysLeft != -1 {
+		t.Error("expected an expired certificate, got", s.DaysLeft)
+	}
+	if s := readCertStatus("127.0.0.1:25", filepath.Join(dir, "missing.pem"), now); s.Error == "" {
+		t.Error("expected an error for a missing file")
+	}
+	if _, err := (&CertMonitorConfig{Interval: "soon"}).interval(); err == nil {
+		t.Error("expected an invalid interval to be refused")
+	}
+}
+
+func TestCertMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	expiring := filepath.Join(dir, "expiring.pem")
+	writeTestCert(t, expiring, time.Now().Add(time.Hour*24*3))
+	valid := filepath.Join(dir, "valid.pem")
+	writeTestCert(t, valid, time.Now().Add(time.Hour*24*90))
+
+	var hooks []map[string][]CertStatus
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string][]CertStatus
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		hooks = append(hooks, body)
+	}))
+	defer webhook.Close()
+	var mails []string
+	defer func(send func(string, smtp.Auth, string, []string, []byte) error) { sendCertAlertMail = send }(sendCertAlertMail)
+	sendCertAlertMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		mails = append(mails, from+" "+strings.Join(to, ",")+" "+string(msg))
+		return nil
+	}
+
+	g := &guerrilla{Config: AppConfig{
+		AllowedHosts: []string{"example.com"},
+		Servers: []ServerConfig{
+			{ListenInterface: "127.0.0.1:25", IsEnabled: true, TLS: ServerTLSConfig{StartTLSOn: true, PublicKeyFile: expiring}},
+			{ListenInterface: "127.0.0.1:465", IsEnabled: true, TLS: ServerTLSConfig{AlwaysOn: true, PublicKeyFile: valid}},
+			{ListenInterface: "127.0.0.1:2525", IsEnabled: true, TLS: ServerTLSConfig{PublicKeyFile: expiring}},
+		},
+		CertMonitor: CertMonitorConfig{
+			WarnDays:   7,
+			WebhookURL: webhook.URL,
+			AlertTo:    []string{"ops@example.com"},
+			Smarthost:  "relay.example.com:25",
+		},
+	}}
+	// the servers' config is checked
+	g.servers = make(map[string]*server)
+	for _, sc := range g.Config.Servers {
+		s := &server{}
+		s.configStore.Store(sc)
+		g.servers[sc.ListenInterface] = s
+	}
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.InfoLevel.String())
+	g.setMainlog(logger)
+	m := &certMonitor{g: g, stop: make(chan struct{}), alerted: make(map[[32]byte]time.Time)}
+	g.certs = m
+	now := time.Now()
+	m.check(now)
+	statuses := g.certificates()
+	if len(statuses) != 2 || statuses[0].Server != "127.0.0.1:25" || statuses[0].DaysLeft != 2 ||
+		statuses[1].DaysLeft != 89 {
+		t.Fatalf("expected the certificates of the TLS servers, got %+v", statuses)
+	}
+	if len(hooks) != 1 || len(hooks[0]["certificates"]) != 1 || hooks[0]["certificates"][0].File != expiring {
+		t.Error("expected the webhook to be sent the expiring certificate, got", hooks)
+	}
+	if len(mails) != 1 || !strings.HasPrefix(mails[0], "postmaster@example.com ops@example.com ") ||
+		!strings.Contains(mails[0], expiring) {
+		t.Error("expected an alert email, got", mails)
+	}
+
+	// alerted again only the next day
+	m.check(now.Add(time.Hour))
+	m.check(now.Add(time.Hour * 25))
+	if len(hooks) != 2 || len(mails) != 2 {
+		t.Error("expected to be alerted once a day, got", len(hooks), len(mails))
+	}
+
+	w := httptest.NewRecorder()
+	g.adminCertificates(w, httptest.NewRequest(http.MethodGet, "/certificates", nil), "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"days_left":`) {
+		t.Error("unexpected admin response", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	g.adminCertificates(w, httptest.NewRequest(http.MethodGet, "/certificates", nil), "acme")
+	if w.Code != http.StatusForbidden {
+		t.Error("expected a tenant to be refused, got", w.Code)
+	}
+}
@@ -43,6 +43,7 @@ type AuthType int
 const (
 	AuthLOGIN = iota
 	AuthCRAMMD5
+	AuthPLAIN
 )
 
 type client struct {
@@ -54,6 +55,8 @@ type client struct {
 	errors       int
 	state        ClientState
 	messagesSent int
+	// messagesReceived counts the messages received in the session, accepted or not
+	messagesReceived int
 	// Response to be written to the client (for debugging)
 	response   bytes.Buffer
 	bufErr     error
@@ -71,6 +74,10 @@ type client struct {
 	login     string
 	password  string
 	parser    rfc5321.Parser
+	// deferredRcpts is how many of the last recipients were answered before they were validated
+	deferredRcpts int
+	// rateSlot is the slot of the tenant's rate limit that the transaction holds
+	rateSlot rateSlot
 }
 
 // NewClient allocates a new client.
@@ -86,6 +93,7 @@ func NewClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail
 		ID:          clientID,
 		log:         logger,
 	}
+	c.RemotePort = getRemotePort(conn)
 
 	// used for reading the DATA state
 	c.smtpReader = textproto.NewReader(c.bufin.Reader)
@@ -136,6 +144,14 @@ func (c *client) sendResponse(r ...interface{}) {
 // TLS handshake
 func (c *client) resetTransaction() {
 	c.Envelope.ResetTransaction()
+	c.deferredRcpts = 0
+	c.releaseRateSlot()
+}
+
+// releaseRateSlot gives back the slot of the tenant's rate limit, when no message used it
+func (c *client) releaseRateSlot() {
+	c.rateSlot.release()
+	c.rateSlot = rateSlot{}
 }
 
 // isInTransaction returns true if the connection is inside a transaction.
@@ -188,8 +204,11 @@ func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
 	c.ConnectedAt = time.Now()
 	c.ID = clientID
 	c.errors = 0
+	c.messagesSent = 0
+	c.messagesReceived = 0
 	// borrow an envelope from the envelope pool
 	c.Envelope = ep.Borrow(getRemoteAddr(conn), clientID)
+	c.RemotePort = getRemotePort(conn)
 }
 
 // getID returns the client's unique ID
@@ -211,6 +230,9 @@ func (c *client) upgradeToTLS(tlsConfig *tls.Config) error {
 	c.bufout.Reset(c.conn)
 	c.bufin.Reset(c.conn)
 	c.TLS = true
+	if state := tlsConn.ConnectionState(); len(state.VerifiedChains) > 0 {
+		c.ClientCert = mail.NewClientCert(state.VerifiedChains[0][0])
+	}
 	return err
 }
 
@@ -223,6 +245,14 @@ func getRemoteAddr(conn net.Conn) string {
 	}
 }
 
+// getRemotePort returns the client's TCP port, 0 if it's not a TCP connection
+func getRemotePort(conn net.Conn) int {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
 type pathParser func([]byte) error
 
 func (c *client) parsePath(in []byte, p pathParser) (mail.Address, error) {
@@ -249,6 +279,7 @@ func (c *client) parsePath(in []byte, p pathParser) (mail.Address, error) {
 			NullPath:   c.parser.NullPath,
 			Quoted:     c.parser.LocalPartQuotes,
 			IP:         c.parser.IP,
+			Literal:    c.parser.Literal,
 		}
 	}
 	return address, err
@@ -0,0 +1,46 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// useClientCerts configures the verification of the client certificates: the CAs they're verified
+// with, and the patterns of the certificates that may connect
+func useClientCerts(tlsConfig *tls.Config, sConfig *ServerTLSConfig) error {
+	if sConfig.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(sConfig.ClientCAs)
+		if err != nil {
+			return fmt.Errorf("error while loading the client CAs: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in client_cas_file %s", sConfig.ClientCAs)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	if len(sConfig.ClientCertAllowed) == 0 {
+		return nil
+	}
+	allowed := sConfig.ClientCertAllowed
+	// called after the chains were verified, which are empty when the client didn't present one.
+	// Unlike VerifyPeerCertificate it's also called when a session is resumed, so a certificate
+	// that was allowed before a config reload can't be used to come back with a ticket
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		cert := mail.NewClientCert(cs.VerifiedChains[0][0])
+		for _, pattern := range allowed {
+			if cert.Matches(pattern) {
+				return nil
+			}
+		}
+		return fmt.Errorf("client certificate %s is not allowed", cert.Subject)
+	}
+	return nil
+}
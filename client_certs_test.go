@@ -0,0 +1,217 @@
+package guerrilla
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// testCertCA issues the certificates of the servers and the clients
+type testCertCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCertCA(t *testing.T, name string) *testCertCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCertCA{key: key}
+	ca.cert, _ = x509.ParseCertificate(der)
+	return ca
+}
+
+// issue returns a certificate of the CA for the template, which is completed with the key and validity
+func (ca *testCertCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCerts(t *testing.T) {
+	ca := newTestCertCA(t, "client CA")
+	dir, err := ioutil.TempDir("", "client_certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	serverCert := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mail.example.com"},
+		DNSNames:    []string{"mail.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	spiffe, _ := url.Parse("spiffe://example.com/mail/outbound")
+	relay := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "eu.relay.example.com", Organization: []string{"Example"}},
+		DNSNames:    []string{"eu.relay.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	workload := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "workload"},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	other := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "laptop.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	stranger := newTestCertCA(t, "other CA").issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "eu.relay.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	// the clients keep their session tickets when set, to resume their sessions
+	var sessions tls.ClientSessionCache
+	// handshake returns the identity of the client's certificate that the server took
+	handshake := func(tlsConfig *tls.Config, certs ...tls.Certificate) (*mail.ClientCert, error) {
+		// a pipe would deadlock when both sides write, eg. the server's alert and the client's Finished
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = ln.Close()
+		}()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+				_, _ = io.Copy(ioutil.Discard, tls.Client(conn, &tls.Config{
+					InsecureSkipVerify: true,
+					ServerName:         "mail.example.com",
+					Certificates:       certs,
+					ClientSessionCache: sessions,
+				}))
+				_ = conn.Close()
+			}
+		}()
+		// the next handshake may resume the session once the client has read its ticket
+		defer func() {
+			<-done
+		}()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		c := NewClient(conn, 1, mainlog, mail.NewPool(5))
+		if err := c.upgradeToTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+		return c.ClientCert, nil
+	}
+
+	sConfig := &ServerTLSConfig{
+		ClientCAs:         caFile,
+		ClientCertAllowed: []string{"*.relay.example.com", "spiffe://example.com/mail/*"},
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAndVerifyClientCert}
+	if err := useClientCerts(tlsConfig, sConfig); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := handshake(tlsConfig, relay); err != nil || cert == nil {
+		t.Fatal("expected the relay's certificate to be taken, got", err)
+	} else if cert.CommonName != "eu.relay.example.com" || cert.Subject != "CN=eu.relay.example.com,O=Example" ||
+		cert.Issuer != "CN=client CA" || len(cert.Fingerprint) != 64 {
+		t.Error("unexpected identity", cert)
+	}
+	if cert, err := handshake(tlsConfig, workload); err != nil || cert == nil || cert.URIs[0] != spiffe.String() {
+		t.Error("expected the workload's certificate to be taken by its URI, got", cert, err)
+	}
+	if _, err := handshake(tlsConfig, other); err == nil {
+		t.Error("expected a certificate that isn't allowed to be refused")
+	}
+	if _, err := handshake(tlsConfig, stranger); err == nil {
+		t.Error("expected a certificate of another CA to be refused")
+	}
+	if _, err := handshake(tlsConfig); err == nil {
+		t.Error("expected a client without a certificate to be refused")
+	}
+
+	// a session of the relay can't be resumed once it's no longer allowed, eg. after a reload
+	var ticketKey [32]byte
+	if _, err := rand.Read(ticketKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.SetSessionTicketKeys([][32]byte{ticketKey})
+	sessions = tls.NewLRUClientSessionCache(1)
+	if _, err := handshake(tlsConfig, relay); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAndVerifyClientCert}
+	reloaded.SetSessionTicketKeys([][32]byte{ticketKey})
+	if err := useClientCerts(reloaded, &ServerTLSConfig{
+		ClientCAs:         caFile,
+		ClientCertAllowed: []string{"spiffe://example.com/mail/*"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(reloaded, relay); err == nil {
+		t.Error("expected the resumed session of a certificate that isn't allowed to be refused")
+	}
+	sessions = nil
+
+	// the certificate is optional when it's only verified if given
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if cert, err := handshake(tlsConfig); err != nil || cert != nil {
+		t.Error("expected a client without a certificate to be let in, got", cert, err)
+	}
+
+	if err := useClientCerts(&tls.Config{}, &ServerTLSConfig{ClientCAs: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected a missing client_cas_file to be an error")
+	}
+	sc := ServerConfig{ListenInterface: "127.0.0.1:2525"}
+	sc.TLS.ClientCertAllowed = []string{"*.example.com"}
+	sc.TLS.ClientAuthType = "RequireAnyClientCert"
+	if err := sc.Validate(); err == nil {
+		t.Error("expected client_cert_allowed to need a client_auth_type that verifies")
+	}
+}
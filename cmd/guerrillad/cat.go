@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/artpar/go-guerrilla"
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/spf13/cobra"
+)
+
+var (
+	catConfigPath string
+	catStores     []string
+	catDirs       []string
+	catTenants    []string
+
+	catCmd = &cobra.Command{
+		Use:   "cat <hash>",
+		Short: "print a stored message",
+		Long: `Finds the message with the hash in the stores of the backend_config, and prints it as it was
+delivered: uncompressed, with the delivery headers added by the Header processor on top of the body.
+The stores are the sql and redis processors of the save_process, and the retention_dirs`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runCat(args[0], os.Stdout); err != nil {
+				mainlog.WithError(err).Fatal("cat failed")
+			}
+		},
+	}
+)
+
+func init() {
+	catCmd.Flags().StringVarP(&catConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file")
+	catCmd.Flags().StringSliceVar(&catStores, "store", nil,
+		"Where to look for the message: sql, redis or files. Defaults to the configured stores")
+	catCmd.Flags().StringSliceVar(&catDirs, "dir", nil,
+		"Directories read by the files store, {tenant} matches any tenant. Defaults to retention_dirs")
+	catCmd.Flags().StringSliceVar(&catTenants, "tenant", nil,
+		"Tenants whose tables to read, when mail_table has a {tenant} placeholder")
+	rootCmd.AddCommand(catCmd)
+}
+
+func runCat(hash string, w io.Writer) error {
+	ac, err := loadConfigFile(catConfigPath)
+	if err != nil {
+		return err
+	}
+	dirs := catDirs
+	if len(dirs) == 0 {
+		dirs = configuredDirs(ac)
+	}
+	stores := catStores
+	if len(stores) == 0 {
+		if stores = configuredStores(ac, dirs); len(stores) == 0 {
+			return errors.New("no stores are configured, see --store")
+		}
+	}
+	return catMail(ac.BackendConfig, stores, dirs, backends.StoredMailFilter{Hash: hash, Tenants: catTenants}, w)
+}
+
+// configuredStores returns the stores that the mail is saved to: the sql and redis processors
+// of the save_process, and files when there are dirs
+func configuredStores(ac *guerrilla.AppConfig, dirs []string) []string {
+	var stores []string
+	process, _ := ac.BackendConfig["save_process"].(string)
+	for _, name := range strings.Split(process, "|") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "sql" || name == "redis" {
+			stores = append(stores, name)
+		}
+	}
+	if len(dirs) > 0 {
+		stores = append(stores, "files")
+	}
+	return stores
+}
+
+// errCatFound stops reading the stores once the message was printed
+var errCatFound = errors.New("found")
+
+// catMail writes the first message that matches the filter to w. It's an error if there's none
+func catMail(backendConfig map[string]interface{}, stores, dirs []string,
+	f backends.StoredMailFilter, w io.Writer) error {
+	err := backends.ReadStoredMail(backendConfig, stores, dirs, f, func(m *backends.StoredMail) error {
+		data, err := m.Data()
+		if err != nil {
+			return fmt.Errorf("could not read %s %s: %s", m.Store, m.Id, err)
+		}
+		if len(data) == 0 {
+			mainlog.Warnf("skipped %s %s, it has no data", m.Store, m.Id)
+			return nil
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return errCatFound
+	})
+	if err == errCatFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("no message with the hash %s in %s", f.Hash, strings.Join(stores, ", "))
+}
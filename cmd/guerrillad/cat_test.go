@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	"github.com/artpar/go-guerrilla"
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+func TestCat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	mailDir := filepath.Join(dir, "acme")
+	if err := os.MkdirAll(mailDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	message := "Delivered-To: a@acme.com\r\nReceived: from mx.example.com\r\n\r\nhello\r\n"
+	compressed, err := zstd.Compress(nil, []byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mailDir, "h1.eml"), compressed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dirs := []string{filepath.Join(dir, "{tenant}")}
+
+	var out bytes.Buffer
+	if err := catMail(nil, []string{"files"}, dirs, backends.StoredMailFilter{Hash: "h1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != message {
+		t.Error("expected the uncompressed message, got", out.String())
+	}
+	if err := catMail(nil, []string{"files"}, dirs, backends.StoredMailFilter{Hash: "h2"}, &out); err == nil {
+		t.Error("expected an error for a hash that isn't stored")
+	}
+
+	ac := &guerrilla.AppConfig{BackendConfig: map[string]interface{}{"save_process": "HeadersParser|Hasher|Compressor|SQL"}}
+	if stores := configuredStores(ac, dirs); !reflect.DeepEqual(stores, []string{"sql", "files"}) {
+		t.Error("expected the sql and files stores, got", stores)
+	}
+}
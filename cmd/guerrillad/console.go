@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/artpar/go-guerrilla"
+	"github.com/spf13/cobra"
+)
+
+var (
+	consoleConfigPath string
+	consoleAdminURL   string
+	consoleToken      string
+
+	consoleCmd = &cobra.Command{
+		Use:   "console",
+		Short: "open the debug console of a running daemon",
+		Long: `Opens the debug console of a running daemon with its admin API, to list the connected
+clients, dump the envelope a client is sending, and step a quarantined email through the
+processors. Type help for the commands. It needs the admin token, which is read from the
+config with the admin API's address, unless --admin and --token are given`,
+		Run: func(cmd *cobra.Command, args []string) {
+			adminURL, token, err := adminTarget(consoleConfigPath, consoleAdminURL, consoleToken)
+			if err != nil {
+				mainlog.WithError(err).Fatal("cannot open the console")
+			}
+			conn, r, err := openConsole(adminURL, token)
+			if err != nil {
+				mainlog.WithError(err).Fatal("cannot open the console")
+			}
+			go func() {
+				_, _ = io.Copy(conn, os.Stdin)
+				_ = conn.Close()
+			}()
+			_, _ = io.Copy(os.Stdout, r)
+		},
+	}
+)
+
+func init() {
+	consoleCmd.Flags().StringVarP(&consoleConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file, to find the admin API")
+	consoleCmd.Flags().StringVar(&consoleAdminURL, "admin", "",
+		"URL of the admin API, eg. http://127.0.0.1:8025")
+	consoleCmd.Flags().StringVar(&consoleToken, "token", "",
+		"Admin token, defaults to the admin token in the config")
+	rootCmd.AddCommand(consoleCmd)
+}
+
+// openConsole upgrades a connection to the admin API to the console. The console's output
+// is read from the returned reader, and the commands are written to the connection
+func openConsole(adminURL, token string) (net.Conn, *bufio.Reader, error) {
+	u, err := url.Parse(adminURL)
+	if err != nil || u.Host == "" {
+		return nil, nil, fmt.Errorf("invalid admin API URL %q", adminURL)
+	}
+	if u.Scheme != "http" {
+		return nil, nil, fmt.Errorf("the console needs an http:// admin API URL, got %q", adminURL)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second*30)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, _ := http.NewRequest(http.MethodGet, u.Scheme+"://"+u.Host+"/console", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", guerrilla.ConsoleProtocol)
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		_ = resp.Body.Close()
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	return conn, r, nil
+}
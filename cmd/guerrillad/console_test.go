@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla"
+)
+
+func TestOpenConsole(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"a valid token is required"}`))
+			return
+		}
+		if r.URL.Path != "/console" || r.Header.Get("Upgrade") != guerrilla.ConsoleProtocol {
+			t.Error("unexpected request", r.URL, r.Header)
+		}
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer func() {
+			_ = conn.Close()
+		}()
+		_, _ = fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n> ",
+			guerrilla.ConsoleProtocol)
+		_ = buf.Flush()
+		// echoes a command
+		line, _ := buf.ReadString('\n')
+		_, _ = fmt.Fprintf(buf, "got %s", line)
+		_ = buf.Flush()
+	}))
+	defer admin.Close()
+
+	conn, r, err := openConsole(admin.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, _ = fmt.Fprint(conn, "conns\n")
+	if out, _ := r.ReadString('\n'); out != "> got conns\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	if _, _, err := openConsole(admin.URL, "wrong"); err == nil || !strings.Contains(err.Error(), "a valid token is required") {
+		t.Error("expected the error of the API, got", err)
+	}
+}
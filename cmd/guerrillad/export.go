@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportConfigPath string
+	exportStores     []string
+	exportDirs       []string
+	exportSince      string
+	exportUntil      string
+	exportFilter     backends.StoredMailFilter
+	exportFormat     string
+	exportOut        string
+
+	exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "export stored mail to mbox, EML files or JSON lines",
+		Long: `Reads the mail saved by the sql and redis processors, or saved as files, and writes the
+messages that match the filters to an mbox file, a directory of EML files or JSON lines.
+The stores are found with the backend_config of the config file`,
+		Run: func(cmd *cobra.Command, args []string) {
+			n, err := runExport()
+			if err != nil {
+				mainlog.WithError(err).Fatal("export failed")
+			}
+			mainlog.Infof("exported %d messages", n)
+		},
+	}
+)
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file")
+	exportCmd.Flags().StringSliceVar(&exportStores, "store", []string{"sql"},
+		"Where to read the mail from: sql, redis or files")
+	exportCmd.Flags().StringSliceVar(&exportDirs, "dir", nil,
+		"Directories read by the files store, {tenant} matches any tenant. Defaults to retention_dirs")
+	exportCmd.Flags().StringVar(&exportSince, "since", "",
+		"Only mail saved at or after this date, eg. 2020-01-31 or 2020-01-31T15:04:05Z")
+	exportCmd.Flags().StringVar(&exportUntil, "until", "", "Only mail saved before this date")
+	exportCmd.Flags().StringVar(&exportFilter.Recipient, "recipient", "", "Only mail for this recipient")
+	exportCmd.Flags().StringVar(&exportFilter.Hash, "hash", "", "Only the message with this hash")
+	exportCmd.Flags().StringSliceVar(&exportFilter.Tenants, "tenant", nil,
+		"Tenants whose tables to read, when mail_table has a {tenant} placeholder")
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "mbox", "mbox, eml or jsonl")
+	exportCmd.Flags().StringVarP(&exportOut, "out", "o", "-",
+		"File to write to, - for stdout. For the eml format, the directory to write the files to")
+	rootCmd.AddCommand(exportCmd)
+}
+
+func runExport() (int, error) {
+	ac, err := loadConfigFile(exportConfigPath)
+	if err != nil {
+		return 0, err
+	}
+	if exportFilter.Since, err = parseExportDate(exportSince); err != nil {
+		return 0, err
+	}
+	if exportFilter.Until, err = parseExportDate(exportUntil); err != nil {
+		return 0, err
+	}
+	dirs := exportDirs
+	if len(dirs) == 0 {
+		dirs = configuredDirs(ac)
+	}
+	x, err := newMailExporter(exportFormat, exportOut)
+	if err != nil {
+		return 0, err
+	}
+	n, err := exportMail(ac.BackendConfig, exportStores, dirs, exportFilter, x)
+	if closeErr := x.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// parseExportDate parses a date, or a date and time. An empty string is the zero time
+func parseExportDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// mailExporter writes the exported messages
+type mailExporter interface {
+	Write(m *backends.StoredMail, data []byte) error
+	Close() error
+}
+
+// exportMail writes the matching messages to x, and returns how many were written
+func exportMail(backendConfig map[string]interface{}, stores, dirs []string,
+	f backends.StoredMailFilter, x mailExporter) (int, error) {
+	n := 0
+	err := backends.ReadStoredMail(backendConfig, stores, dirs, f, func(m *backends.StoredMail) error {
+		data, err := m.Data()
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			mainlog.Warnf("skipped %s %s, it has no data", m.Store, m.Id)
+			return nil
+		}
+		n++
+		return x.Write(m, data)
+	})
+	return n, err
+}
+
+func newMailExporter(format, out string) (mailExporter, error) {
+	switch format {
+	case "mbox", "jsonl":
+		var w io.WriteCloser = nopWriteCloser{os.Stdout}
+		if out != "-" {
+			f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return nil, err
+			}
+			w = f
+		}
+		if format == "mbox" {
+			return &mboxExporter{w: bufio.NewWriter(w), c: w}, nil
+		}
+		return &jsonlExporter{enc: json.NewEncoder(w), c: w}, nil
+	case "eml":
+		if out == "-" {
+			return nil, errors.New("the eml format needs a directory, see --out")
+		}
+		if err := os.MkdirAll(out, 0700); err != nil {
+			return nil, err
+		}
+		return &emlExporter{dir: out}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected mbox, eml or jsonl", format)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// mboxExporter writes an mboxrd file, where lines starting with "From " are quoted with a '>'
+type mboxExporter struct {
+	w *bufio.Writer
+	c io.Closer
+}
+
+func (x *mboxExporter) Write(m *backends.StoredMail, data []byte) error {
+	return backends.WriteMbox(x.w, m.From, m.Date, data)
+}
+
+func (x *mboxExporter) Close() error {
+	err := x.w.Flush()
+	if closeErr := x.c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// emlExporter writes each message to a file, named with a sequence number and the hash
+type emlExporter struct {
+	dir string
+	n   int
+}
+
+var emlUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (x *emlExporter) Write(m *backends.StoredMail, data []byte) error {
+	x.n++
+	name := fmt.Sprintf("%06d-%s.eml", x.n, emlUnsafe.ReplaceAllString(m.Hash, "_"))
+	return writeNewFile(filepath.Join(x.dir, name), data)
+}
+
+func (x *emlExporter) Close() error {
+	return nil
+}
+
+// writeNewFile writes the data to a file that must not exist
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// jsonlExporter writes a JSON object for each message, on its own line
+type jsonlExporter struct {
+	enc *json.Encoder
+	c   io.Closer
+}
+
+type exportedMail struct {
+	Store     string    `json:"store"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Id        string    `json:"id"`
+	Hash      string    `json:"hash,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Date      time.Time `json:"date"`
+	Data      string    `json:"data"`
+}
+
+func (x *jsonlExporter) Write(m *backends.StoredMail, data []byte) error {
+	return x.enc.Encode(exportedMail{
+		Store:     m.Store,
+		Tenant:    m.Tenant,
+		Id:        m.Id,
+		Hash:      m.Hash,
+		From:      m.From,
+		Recipient: m.Recipient,
+		Date:      m.Date,
+		Data:      string(data),
+	})
+}
+
+func (x *jsonlExporter) Close() error {
+	return x.c.Close()
+}
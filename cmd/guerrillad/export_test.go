@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	mailDir := filepath.Join(dir, "mail", "acme")
+	if err := os.MkdirAll(mailDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]string{
+		"h1": "Delivered-To: a@acme.com\nReturn-Path: <s@example.com>\n\nFrom here\n",
+		"h2": "Delivered-To: b@acme.com\r\n\r\nhello\r\n",
+	}
+	for hash, data := range messages {
+		if err := ioutil.WriteFile(filepath.Join(mailDir, hash+".eml"), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stores := []string{"files"}
+	dirs := []string{filepath.Join(dir, "mail", "{tenant}")}
+
+	// mbox
+	mbox := filepath.Join(dir, "out.mbox")
+	x, err := newMailExporter("mbox", mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := exportMail(nil, stores, dirs, exportFilter, x); err != nil || n != 2 {
+		t.Fatal("expected 2 messages exported, got", n, err)
+	}
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(mbox)
+	out := string(b)
+	if !strings.HasPrefix(out, "From s@example.com ") || !strings.Contains(out, "\n>From here\n") ||
+		!strings.Contains(out, "\nFrom MAILER-DAEMON ") || strings.Contains(out, "\r") {
+		t.Error("unexpected mbox", out)
+	}
+	if _, err := newMailExporter("mbox", mbox); err == nil {
+		t.Error("expected an error, as the file exists")
+	}
+
+	// eml, with a filter
+	emlDir := filepath.Join(dir, "eml")
+	x, err = newMailExporter("eml", emlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := exportFilter
+	filter.Recipient = "b@acme.com"
+	if n, err := exportMail(nil, stores, dirs, filter, x); err != nil || n != 1 {
+		t.Fatal("expected 1 message exported, got", n, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(emlDir, "000001-h2.eml")); err != nil || string(b) != messages["h2"] {
+		t.Error("unexpected eml file", string(b), err)
+	}
+
+	// jsonl
+	jsonl := filepath.Join(dir, "out.jsonl")
+	x, _ = newMailExporter("jsonl", jsonl)
+	filter = exportFilter
+	filter.Until = time.Now().Add(time.Hour)
+	filter.Hash = "h1"
+	if n, err := exportMail(nil, stores, dirs, filter, x); err != nil || n != 1 {
+		t.Fatal("expected 1 message exported, got", n, err)
+	}
+	_ = x.Close()
+	f, _ := os.Open(jsonl)
+	defer func() {
+		_ = f.Close()
+	}()
+	var m exportedMail
+	s := bufio.NewScanner(f)
+	if !s.Scan() || json.Unmarshal(s.Bytes(), &m) != nil || m.Hash != "h1" || m.Tenant != "acme" || m.Data != messages["h1"] {
+		t.Error("unexpected json", s.Text())
+	}
+
+	if _, err := newMailExporter("pdf", "-"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if d, err := parseExportDate("2020-01-31"); err != nil || d.Day() != 31 {
+		t.Error("expected the date to be parsed", d, err)
+	}
+}
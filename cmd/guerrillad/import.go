@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla"
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importConfigPath string
+	importAdminURL   string
+	importToken      string
+	importChain      string
+	importFrom       string
+	importTo         []string
+	importStores     []string
+	importDirs       []string
+	importSince      string
+	importUntil      string
+	importFilter     backends.StoredMailFilter
+
+	importCmd = &cobra.Command{
+		Use:   "import [file.eml...]",
+		Short: "send EML files or stored mail through a processor chain of a running daemon",
+		Long: `Re-injects messages with the admin API, eg. to reprocess mail after fixing a broken backend.
+The messages are EML files, or the stored mail selected with --store and the filters of the export command.
+The sender and recipients default to the Return-Path and Delivered-To headers. --chain names a chain
+of the process_chains option, otherwise the save_process chain is used`,
+		Run: func(cmd *cobra.Command, args []string) {
+			n, failed, err := runImport(args)
+			if err != nil {
+				mainlog.WithError(err).Fatal("import failed")
+			}
+			mainlog.Infof("imported %d messages, %d failed", n, failed)
+			if failed > 0 {
+				mainlog.Fatal("some messages were not imported")
+			}
+		},
+	}
+)
+
+func init() {
+	importCmd.Flags().StringVarP(&importConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file, to find the admin API and the stores")
+	importCmd.Flags().StringVar(&importAdminURL, "admin", "",
+		"URL of the admin API, eg. http://127.0.0.1:8025")
+	importCmd.Flags().StringVar(&importToken, "token", "",
+		"Admin or tenant token, defaults to the admin token in the config")
+	importCmd.Flags().StringVar(&importChain, "chain", "", "Name of the processor chain")
+	importCmd.Flags().StringVar(&importFrom, "from", "", "Sender of the messages")
+	importCmd.Flags().StringSliceVar(&importTo, "to", nil, "Recipients of the messages")
+	importCmd.Flags().StringSliceVar(&importStores, "store", nil,
+		"Import the stored mail instead of files: sql, redis or files")
+	importCmd.Flags().StringSliceVar(&importDirs, "dir", nil,
+		"Directories read by the files store, {tenant} matches any tenant. Defaults to retention_dirs")
+	importCmd.Flags().StringVar(&importSince, "since", "", "Only mail saved at or after this date")
+	importCmd.Flags().StringVar(&importUntil, "until", "", "Only mail saved before this date")
+	importCmd.Flags().StringVar(&importFilter.Recipient, "recipient", "", "Only stored mail for this recipient")
+	importCmd.Flags().StringVar(&importFilter.Hash, "hash", "", "Only the stored message with this hash")
+	importCmd.Flags().StringSliceVar(&importFilter.Tenants, "tenant", nil,
+		"Tenants whose tables to read, when mail_table has a {tenant} placeholder")
+	rootCmd.AddCommand(importCmd)
+}
+
+// runImport imports the files, or the stored mail, and returns how many messages were imported and failed
+func runImport(files []string) (int, int, error) {
+	if len(files) == 0 && len(importStores) == 0 {
+		return 0, 0, errors.New("give the files to import, or the --store to import from")
+	}
+	adminURL, token, err := adminTarget(importConfigPath, importAdminURL, importToken)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, failed := 0, 0
+	send := func(source, from string, to []string, data []byte) error {
+		if importFrom != "" {
+			from = importFrom
+		}
+		if len(importTo) > 0 {
+			to = importTo
+		}
+		res, err := importMail(adminURL, token, importChain, from, to, data)
+		if err != nil {
+			return err
+		}
+		if res.Code >= 300 {
+			failed++
+			mainlog.Warnf("%s was not imported: %s", source, res.Result)
+			return nil
+		}
+		n++
+		mainlog.Infof("%s imported as %s", source, res.QueuedId)
+		return nil
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return n, failed, err
+		}
+		if err := send(file, "", nil, data); err != nil {
+			return n, failed, err
+		}
+	}
+	if len(importStores) == 0 {
+		return n, failed, nil
+	}
+	ac, err := loadConfigFile(importConfigPath)
+	if err != nil {
+		return n, failed, err
+	}
+	if importFilter.Since, err = parseExportDate(importSince); err != nil {
+		return n, failed, err
+	}
+	if importFilter.Until, err = parseExportDate(importUntil); err != nil {
+		return n, failed, err
+	}
+	dirs := importDirs
+	if len(dirs) == 0 {
+		dirs = configuredDirs(ac)
+	}
+	err = backends.ReadStoredMail(ac.BackendConfig, importStores, dirs, importFilter, func(m *backends.StoredMail) error {
+		data, err := m.Data()
+		if err != nil {
+			return err
+		}
+		var to []string
+		if m.Recipient != "" {
+			to = []string{m.Recipient}
+		}
+		return send(m.Store+" "+m.Id, m.From, to, data)
+	})
+	return n, failed, err
+}
+
+// configuredDirs returns the retention_dirs of the backend config
+func configuredDirs(ac *guerrilla.AppConfig) []string {
+	var dirs []string
+	if configured, ok := ac.BackendConfig["retention_dirs"].([]interface{}); ok {
+		for _, dir := range configured {
+			dirs = append(dirs, fmt.Sprint(dir))
+		}
+	}
+	return dirs
+}
+
+// importMail sends a message to the /import admin API. An empty sender or recipients are taken from the
+// message's headers by the daemon
+func importMail(adminURL, token, chain, from string, to []string, data []byte) (*guerrilla.ImportResult, error) {
+	params := url.Values{}
+	if chain != "" {
+		params.Set("chain", chain)
+	}
+	if from != "" {
+		params.Set("from", from)
+	}
+	if len(to) > 0 {
+		params.Set("to", strings.Join(to, ","))
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(adminURL, "/")+"/import?"+params.Encode(),
+		bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "message/rfc822")
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnprocessableEntity {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	var res guerrilla.ImportResult
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return &res, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/artpar/go-guerrilla"
+)
+
+func TestImportMail(t *testing.T) {
+	var received []string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/import" || r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Error("unexpected request", r.Method, r.URL)
+		}
+		if q.Get("chain") != "reprocess" || q.Get("to") != "a@acme.com,b@acme.com" {
+			t.Error("unexpected parameters", r.URL)
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(data))
+		res := guerrilla.ImportResult{QueuedId: "abc", Code: 250, Result: "250 2.0.0 OK: queued as abc"}
+		if q.Get("from") == "bad@example.com" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			res = guerrilla.ImportResult{QueuedId: "def", Code: 554, Result: "554 5.0.0 Error: no such processor chain"}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer admin.Close()
+
+	to := []string{"a@acme.com", "b@acme.com"}
+	res, err := importMail(admin.URL, "secret", "reprocess", "test@example.com", to, []byte("Subject: one\n\nHello\n"))
+	if err != nil || res.Code != 250 || res.QueuedId != "abc" {
+		t.Error("expected the message to be imported, got", res, err)
+	}
+	res, err = importMail(admin.URL, "secret", "reprocess", "bad@example.com", to, []byte("Subject: two\n\nHello\n"))
+	if err != nil || res.Code != 554 {
+		t.Error("expected the result of a failed import, got", res, err)
+	}
+	if len(received) != 2 || received[0] != "Subject: one\n\nHello\n" {
+		t.Error("unexpected messages", received)
+	}
+
+	// runImport reads the files, and counts the failures
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "1.eml")
+	if err := ioutil.WriteFile(file, []byte("Subject: three\n\nHello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	importAdminURL, importToken, importChain, importTo = admin.URL, "secret", "reprocess", to
+	defer func() {
+		importAdminURL, importToken, importChain, importFrom, importTo = "", "", "", "", nil
+	}()
+	for from, failed := range map[string]int{"test@example.com": 0, "bad@example.com": 1} {
+		importFrom = from
+		n, f, err := runImport([]string{file})
+		if err != nil || n+f != 1 || f != failed {
+			t.Error("unexpected import from", from, n, f, err)
+		}
+	}
+	if _, _, err := runImport([]string{filepath.Join(dir, "missing.eml")}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	processorPackage string
+	processorDir     string
+
+	newProcessorCmd = &cobra.Command{
+		Use:   "new-processor <Name>",
+		Short: "generate the skeleton of a new processor, with tests",
+		Long: `Generates a processor that reads its config, has init and shutdown hooks,
+and a table-driven test using backends.ProcessorHarness. Use --package backends to
+add it to the backends package, otherwise register it with Daemon.AddProcessor`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			files, err := newProcessor(args[0], processorPackage, processorDir)
+			if err != nil {
+				mainlog.WithError(err).Fatal("could not generate the processor")
+			}
+			for _, f := range files {
+				mainlog.Infof("wrote %s", f)
+			}
+		},
+	}
+)
+
+func init() {
+	newProcessorCmd.Flags().StringVarP(&processorPackage, "package", "p",
+		"main", "Go package of the generated files")
+	newProcessorCmd.Flags().StringVarP(&processorDir, "dir", "d",
+		".", "Directory to write the files to")
+	rootCmd.AddCommand(newProcessorCmd)
+}
+
+var processorNameRegex = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+
+type processorTemplateData struct {
+	Name    string
+	Lower   string
+	Package string
+	// Pkg is the qualifier for identifiers of the backends package
+	Pkg string
+}
+
+// newProcessor writes the processor and its test, returning the paths of the files written.
+// Existing files are never overwritten
+func newProcessor(name, pkg, dir string) ([]string, error) {
+	if !processorNameRegex.MatchString(name) {
+		return nil, errors.New("the name must be an exported Go identifier, eg. SpamCheck")
+	}
+	data := processorTemplateData{
+		Name:    name,
+		Lower:   strings.ToLower(name),
+		Package: pkg,
+		Pkg:     "backends.",
+	}
+	prefix := ""
+	if pkg == "backends" {
+		data.Pkg = ""
+		prefix = "p_"
+	}
+	files := map[string]*template.Template{
+		filepath.Join(dir, prefix+data.Lower+".go"):      processorTemplate,
+		filepath.Join(dir, prefix+data.Lower+"_test.go"): processorTestTemplate,
+	}
+	for path := range files {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists", path)
+		}
+	}
+	var written []string
+	for _, path := range []string{
+		filepath.Join(dir, prefix+data.Lower+".go"),
+		filepath.Join(dir, prefix+data.Lower+"_test.go")} {
+		var buf bytes.Buffer
+		if err := files[path].Execute(&buf, data); err != nil {
+			return written, err
+		}
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			return written, err
+		}
+		if err = ioutil.WriteFile(path, src, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+var processorTemplate = template.Must(template.New("processor").Parse(`package {{.Package}}
+
+import (
+{{- if .Pkg}}
+	"github.com/artpar/go-guerrilla/backends"
+{{- end}}
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: {{.Lower}}
+// ----------------------------------------------------------------------------------
+// Description   : TODO: describe what the processor does
+// ----------------------------------------------------------------------------------
+// Config Options: {{.Lower}}_tag string - value of the {{.Lower}} tag added to the envelope
+// --------------:-------------------------------------------------------------------
+// Input         : e
+// ----------------------------------------------------------------------------------
+// Output        : e.Tags
+// ----------------------------------------------------------------------------------
+{{- if not .Pkg}}
+func init() {
+	processors["{{.Lower}}"] = func() Decorator {
+		return {{.Name}}()
+	}
+}
+{{- end}}
+
+// {{.Name}}Config is read from the backend_config
+type {{.Name}}Config struct {
+	Tag string ` + "`" + `json:"{{.Lower}}_tag,omitempty"` + "`" + `
+}
+
+// {{.Name}} is the processor's constructor.
+{{- if .Pkg}}
+// Register it with d.AddProcessor("{{.Name}}", {{.Name}}), then add {{.Name}} to the save_process config
+{{- end}}
+func {{.Name}}() {{.Pkg}}Decorator {
+	config := &{{.Name}}Config{}
+	{{.Pkg}}Svc.AddInitializer({{.Pkg}}LoadConfig(config, func() error {
+		// check the config, open connections...
+		if config.Tag == "" {
+			config.Tag = "seen"
+		}
+		return nil
+	}))
+	{{.Pkg}}Svc.AddShutdowner({{.Pkg}}ShutdownWith(func() error {
+		// close connections...
+		return nil
+	}))
+	return func(p {{.Pkg}}Processor) {{.Pkg}}Processor {
+		return {{.Pkg}}ProcessWith(func(e *mail.Envelope, task {{.Pkg}}SelectTask) ({{.Pkg}}Result, error) {
+			if task == {{.Pkg}}TaskSaveMail {
+				// process the email. To reject it, return a result with an error, eg.
+				// return {{.Pkg}}NewResult("554 5.0.0 Error: rejected"), errors.New("rejected")
+				e.Tags.Add("{{.Lower}}", config.Tag)
+			} else if task == {{.Pkg}}TaskValidateRcpt {
+				// validate the last recipient, e.RcptTo[len(e.RcptTo)-1]
+			}
+			// continue to the next processor
+			return p.Process(e, task)
+		})
+	}
+}
+`))
+
+var processorTestTemplate = template.Must(template.New("processor_test").Parse(`package {{.Package}}
+
+import (
+	"testing"
+{{- if .Pkg}}
+
+	"github.com/artpar/go-guerrilla/backends"
+{{- end}}
+)
+
+func Test{{.Name}}(t *testing.T) {
+	tests := []struct {
+		name   string
+		config {{.Pkg}}BackendConfig
+		data   string
+		code   int
+		tag    string
+	}{
+		{"default tag", {{.Pkg}}BackendConfig{}, "Subject: test\n\nhello\n", 200, "seen"},
+		{"configured tag", {{.Pkg}}BackendConfig{"{{.Lower}}_tag": "yes"}, "Subject: test\n\nhello\n", 200, "yes"},
+	}
+	for _, tt := range tests {
+		h, err := {{.Pkg}}NewProcessorHarness(tt.config, {{.Name}})
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		e, err := h.Envelope("sender@example.com", tt.data, "rcpt@example.com")
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		result, err := h.Save(e)
+		if result.Code() != tt.code {
+			t.Error(tt.name, "expected", tt.code, "but got", result, err)
+		}
+		if v := e.Tags.Values("{{.Lower}}"); len(v) != 1 || v[0] != tt.tag {
+			t.Error(tt.name, "expected the tag", tt.tag, "but got", v)
+		}
+		if err := h.Shutdown(); err != nil {
+			t.Error(tt.name, err)
+		}
+	}
+}
+`))
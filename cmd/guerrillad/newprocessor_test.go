@@ -0,0 +1,39 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNewProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "new-processor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if _, err := newProcessor("spamCheck", "main", dir); err == nil {
+		t.Error("expected an error for a name that's not exported")
+	}
+	for _, pkg := range []string{"main", "backends"} {
+		files, err := newProcessor("SpamCheck", pkg, dir)
+		if err != nil {
+			t.Fatal(pkg, err)
+		}
+		if len(files) != 2 {
+			t.Fatal(pkg, "expected 2 files, got", files)
+		}
+		for _, f := range files {
+			if _, err := parser.ParseFile(token.NewFileSet(), f, nil, parser.AllErrors); err != nil {
+				t.Error(pkg, "generated file does not parse:", err)
+			}
+		}
+		if _, err := newProcessor("SpamCheck", pkg, dir); err == nil {
+			t.Error(pkg, "expected an error, as the files exist")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/artpar/go-guerrilla"
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/spf13/cobra"
+)
+
+var (
+	preflightConfigPath string
+
+	preflightCmd = &cobra.Command{
+		Use:   "preflight",
+		Short: "check that the config can serve mail, before starting the daemon",
+		Long: `Binds the listeners of the servers and the admin API and closes them, initializes each processor
+of the backend on its own, then sends a test message through the validate_process and save_process.
+The test message has an X-Guerrilla-Preflight header and is sent to postmaster at the primary_mail_host.
+Each check is reported as pass or fail, and the exit status is 1 when any of them failed`,
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := readConfig(preflightConfigPath)
+			if err != nil {
+				mainlog.WithError(err).Fatal("Error while reading config")
+			}
+			pd := guerrilla.Daemon{Config: c}
+			if !printPreflight(os.Stdout, pd.Preflight()) {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	preflightCmd.Flags().StringVarP(&preflightConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file")
+	rootCmd.AddCommand(preflightCmd)
+}
+
+// printPreflight prints a line for each check, and returns true if all of them passed
+func printPreflight(w io.Writer, checks []backends.PreflightCheck) bool {
+	passed := true
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, check := range checks {
+		if check.Err != nil {
+			passed = false
+			// the errors of several initializers are on separate lines
+			msg := strings.Replace(strings.TrimSpace(check.Err.Error()), "\n", "; ", -1)
+			_, _ = fmt.Fprintf(tw, "%s\tFAIL\t%s\n", check.Component, msg)
+		} else {
+			_, _ = fmt.Fprintf(tw, "%s\tpass\t\n", check.Component)
+		}
+	}
+	_ = tw.Flush()
+	return passed
+}
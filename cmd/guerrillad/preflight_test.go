@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+func TestPrintPreflight(t *testing.T) {
+	var out bytes.Buffer
+	if !printPreflight(&out, []backends.PreflightCheck{{Component: "server 127.0.0.1:25"}}) {
+		t.Error("expected the checks to pass")
+	}
+	out.Reset()
+	if printPreflight(&out, []backends.PreflightCheck{
+		{Component: "server 127.0.0.1:25"},
+		{Component: "processor sql", Err: errors.New("\nno database\nno table")},
+	}) {
+		t.Error("expected a failure")
+	}
+	expect := "server 127.0.0.1:25  pass  \nprocessor sql        FAIL  no database; no table\n"
+	if out.String() != expect {
+		t.Errorf("expected %q, got %q", expect, out.String())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/artpar/go-guerrilla"
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/spf13/cobra"
+)
+
+var (
+	searchConfigPath string
+	searchAdminURL   string
+	searchToken      string
+	searchQuery      backends.MailQuery
+
+	searchCmd = &cobra.Command{
+		Use:   "search [query]",
+		Short: "search the mail indexed by the searchindex processor",
+		Long: `Searches the index of a running daemon with its admin API. The query uses the
+query string syntax, eg. "invoice +from:alice", and the flags narrow it down.
+The admin API's address and token are read from the config, unless --admin and --token are given`,
+		Run: func(cmd *cobra.Command, args []string) {
+			searchQuery.Text = strings.Join(args, " ")
+			adminURL, token, err := adminTarget(searchConfigPath, searchAdminURL, searchToken)
+			if err != nil {
+				mainlog.WithError(err).Fatal("cannot search")
+			}
+			hits, err := searchMail(adminURL, token, searchQuery)
+			if err != nil {
+				mainlog.WithError(err).Fatal("search failed")
+			}
+			printMailHits(os.Stdout, hits)
+		},
+	}
+)
+
+func init() {
+	searchCmd.Flags().StringVarP(&searchConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file, to find the admin API")
+	searchCmd.Flags().StringVar(&searchAdminURL, "admin", "",
+		"URL of the admin API, eg. http://127.0.0.1:8025")
+	searchCmd.Flags().StringVar(&searchToken, "token", "",
+		"Admin or tenant token, defaults to the admin token in the config")
+	searchCmd.Flags().StringVar(&searchQuery.From, "from", "", "Sender address or domain")
+	searchCmd.Flags().StringVar(&searchQuery.To, "to", "", "Recipient address or domain")
+	searchCmd.Flags().StringVar(&searchQuery.Subject, "subject", "", "Words in the subject")
+	searchCmd.Flags().StringVar(&searchQuery.Body, "body", "", "Words in the body")
+	searchCmd.Flags().StringVar(&searchQuery.Tenant, "tenant", "", "Only the tenant's mail")
+	searchCmd.Flags().IntVarP(&searchQuery.Limit, "limit", "n", 20, "Most messages to show")
+	rootCmd.AddCommand(searchCmd)
+}
+
+// adminTarget returns the admin API URL and token, from the flags or the config
+func adminTarget(configPath, adminURL, token string) (string, string, error) {
+	if adminURL != "" && token != "" {
+		return adminURL, token, nil
+	}
+	ac, err := loadConfigFile(configPath)
+	if err != nil {
+		return "", "", err
+	}
+	if adminURL == "" {
+		if ac.Admin.ListenInterface == "" {
+			return "", "", errors.New("the admin API is not configured, see the admin section of the config")
+		}
+		adminURL = "http://" + ac.Admin.ListenInterface
+	}
+	if token == "" {
+		token = ac.Admin.Token
+	}
+	return adminURL, token, nil
+}
+
+// loadConfigFile reads the config, for the commands that don't start the daemon
+func loadConfigFile(path string) (*guerrilla.AppConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %s", err)
+	}
+	var ac guerrilla.AppConfig
+	if err = json.Unmarshal(data, &ac); err != nil {
+		return nil, fmt.Errorf("could not parse config file: %s", err)
+	}
+	return &ac, nil
+}
+
+// searchMail sends the query to the admin API
+func searchMail(adminURL, token string, q backends.MailQuery) ([]backends.MailHit, error) {
+	params := url.Values{}
+	for k, v := range map[string]string{
+		"q": q.Text, "from": q.From, "to": q.To, "subject": q.Subject, "body": q.Body, "tenant": q.Tenant,
+	} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(adminURL, "/")+"/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	var hits []backends.MailHit
+	err = json.NewDecoder(resp.Body).Decode(&hits)
+	return hits, err
+}
+
+// printMailHits prints a line for each message
+func printMailHits(w io.Writer, hits []backends.MailHit) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, hit := range hits {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", hit.Date.Format(time.RFC3339), hit.QueuedId,
+			hit.From, strings.Join(hit.To, ","), hit.Subject)
+	}
+	_ = tw.Flush()
+}
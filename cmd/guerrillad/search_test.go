@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+func TestSearchMail(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"a valid token is required"}`))
+			return
+		}
+		q := r.URL.Query()
+		if r.URL.Path != "/search" || q.Get("q") != "invoice" || q.Get("from") != "alice" || q.Get("limit") != "5" {
+			t.Error("unexpected request", r.URL)
+		}
+		_ = json.NewEncoder(w).Encode([]backends.MailHit{{
+			QueuedId: "abc",
+			From:     "alice@example.com",
+			To:       []string{"bob@example.com"},
+			Subject:  "Invoice 42",
+			Date:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		}})
+	}))
+	defer admin.Close()
+
+	config, err := ioutil.TempFile("", "search-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(config.Name())
+	}()
+	_, _ = config.WriteString(`{"admin": {"listen_interface": "` + strings.TrimPrefix(admin.URL, "http://") + `", "token": "secret"}}`)
+	_ = config.Close()
+
+	adminURL, token, err := adminTarget(config.Name(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := backends.MailQuery{Text: "invoice", From: "alice", Limit: 5}
+	hits, err := searchMail(adminURL, token, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printMailHits(&out, hits)
+	if line := out.String(); !strings.HasPrefix(line, "2020-01-02T03:04:05Z  abc  alice@example.com  bob@example.com  Invoice 42") {
+		t.Error("unexpected output", line)
+	}
+	if _, err := searchMail(adminURL, "wrong", q); err == nil || !strings.Contains(err.Error(), "a valid token is required") {
+		t.Error("expected the API's error, got", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
 	"os/signal"
@@ -29,6 +30,12 @@ const (
 var (
 	configPath string
 	pidFile    string
+	// loading the config from a central store
+	configURL      string
+	configSQLDSN   string
+	configSQLQuery string
+	configWatch    time.Duration
+	configSource   guerrilla.ConfigSource
 
 	serveCmd = &cobra.Command{
 		Use:   "serve",
@@ -58,6 +65,15 @@ func init() {
 	// intentionally didn't specify default pidFile; value from config is used if flag is empty
 	serveCmd.PersistentFlags().StringVarP(&pidFile, "pidFile", "p",
 		"", "Path to the pid file")
+	serveCmd.PersistentFlags().StringVar(&configURL, "config-url",
+		"", "Load the configuration from a URL instead of the file, eg. a Consul key with ?raw")
+	serveCmd.PersistentFlags().StringVar(&configSQLDSN, "config-sql-dsn",
+		"", "Load the configuration from a MySQL database with this DSN, instead of the file")
+	serveCmd.PersistentFlags().StringVar(&configSQLQuery, "config-sql-query",
+		"SELECT `config`, `version` FROM `guerrilla_config` ORDER BY `version` DESC LIMIT 1",
+		"Query returning the configuration and its version, used with --config-sql-dsn")
+	serveCmd.PersistentFlags().DurationVar(&configWatch, "config-watch",
+		0, "How often to check the configuration URL or database for changes, eg. 30s. 0 to disable")
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -73,7 +89,7 @@ func sigHandler() {
 	)
 	for sig := range signalChannel {
 		if sig == syscall.SIGHUP {
-			if ac, err := readConfig(configPath, pidFile); err == nil {
+			if ac, err := readConfig(configPath); err == nil {
 				_ = d.ReloadConfig(*ac)
 			} else {
 				mainlog.WithError(err).Error("Could not reload config")
@@ -105,7 +121,16 @@ func sigHandler() {
 func serve(cmd *cobra.Command, args []string) {
 	logVersion()
 	d = guerrilla.Daemon{Logger: mainlog}
-	c, err := readConfig(configPath, pidFile)
+	if configURL != "" {
+		configSource = &guerrilla.HTTPConfigSource{URL: configURL}
+	} else if configSQLDSN != "" {
+		db, err := sql.Open("mysql", configSQLDSN)
+		if err != nil {
+			mainlog.WithError(err).Fatal("Error while opening the config database")
+		}
+		configSource = &guerrilla.SQLConfigSource{DB: db, Query: configSQLQuery}
+	}
+	c, err := readConfig(configPath)
 	if err != nil {
 		mainlog.WithError(err).Fatal("Error while reading config")
 	}
@@ -122,20 +147,36 @@ func serve(cmd *cobra.Command, args []string) {
 		mainlog.WithError(err).Error("Error(s) when creating new server(s)")
 		os.Exit(1)
 	}
+	if configSource != nil && configWatch > 0 {
+		if err = d.WatchConfig(configSource, configWatch, overrideConfig); err != nil {
+			mainlog.WithError(err).Error("Could not watch the config")
+		}
+	}
 	sigHandler()
 
 }
 
 // ReadConfig is called at startup, or when a SIG_HUP is caught
-func readConfig(path string, pidFile string) (*guerrilla.AppConfig, error) {
+func readConfig(path string) (*guerrilla.AppConfig, error) {
 	// Load in the config.
 	// Note here is the only place we can make an exception to the
 	// "treat config values as immutable". For example, here the
 	// command line flags can override config values
-	appConfig, err := d.LoadConfig(path)
-	if err != nil {
+	var appConfig guerrilla.AppConfig
+	var err error
+	if configSource != nil {
+		if appConfig, err = d.LoadConfigFrom(configSource); err != nil {
+			return &appConfig, fmt.Errorf("could not load config: %s", err.Error())
+		}
+	} else if appConfig, err = d.LoadConfig(path); err != nil {
 		return &appConfig, fmt.Errorf("could not read config file: %s", err.Error())
 	}
+	overrideConfig(&appConfig)
+	return &appConfig, nil
+}
+
+// overrideConfig applies the command line flags to a config that was loaded
+func overrideConfig(appConfig *guerrilla.AppConfig) {
 	// override config pidFile with with flag from the command line
 	if len(pidFile) > 0 {
 		appConfig.PidFile = pidFile
@@ -145,5 +186,4 @@ func readConfig(path string, pidFile string) (*guerrilla.AppConfig, error) {
 	if verbose {
 		appConfig.LogLevel = "debug"
 	}
-	return &appConfig, nil
 }
@@ -507,7 +507,7 @@ func TestCmdConfigChangeEvents(t *testing.T) {
 
 	bcfg := backends.BackendConfig{"log_received_mails": true}
 	backend, err := backends.New(bcfg, mainlog)
-	app, err := guerrilla.New(oldconf, backend, mainlog)
+	app, err := guerrilla.New(oldconf, backend, nil, mainlog)
 	if err != nil {
 		t.Error("Failed to create new app", err)
 	}
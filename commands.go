@@ -0,0 +1,114 @@
+package guerrilla
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// CommandHandler answers a custom SMTP command. args is the rest of the line after the verb, and e is the
+// client's envelope, eg. with RemoteIP, Helo and AuthorizedLogin, which the handler must not keep.
+// The reply is sent as is, eg. "250 2.0.0 OK", with the lines of a multi-line reply joined by "\r\n".
+// An empty reply sends the reply of NOOP
+type CommandHandler func(e *mail.Envelope, args string) string
+
+// Command is a custom SMTP command, eg. a private extension between cooperating systems
+type Command struct {
+	Handler CommandHandler
+	// Keyword is advertised in the EHLO reply when set, eg. "XSTATUS" or "XSTATUS V2"
+	Keyword string
+}
+
+// commands are the custom SMTP commands of a daemon, shared by its servers
+type commands struct {
+	sync.RWMutex
+	m map[string]Command
+}
+
+var commandVerb = regexp.MustCompile(`^[A-Z][A-Z0-9-]*$`)
+
+// builtinCommands are the commands of the server that can't be replaced. HELP and NOOP aren't here,
+// so that eg. the help text can be customized
+var builtinCommands = map[string]bool{
+	"HELO": true, "EHLO": true, "AUTH": true, "XCLIENT": true, "MAIL": true, "RCPT": true, "RSET": true,
+	"VRFY": true, "EXPN": true, "QUIT": true, "DATA": true, "STARTTLS": true,
+}
+
+func newCommands() *commands {
+	return &commands{m: make(map[string]Command)}
+}
+
+// AddCommand adds a custom SMTP command with the verb, eg. "XSTATUS", or replaces HELP or NOOP.
+// Verbs are case-insensitive, a command with the same verb is replaced, and a nil Handler removes it.
+// The commands are the daemon's, they can be added before or after it's started
+func (d *Daemon) AddCommand(verb string, c Command) error {
+	if d.commands == nil {
+		d.commands = newCommands()
+	}
+	return d.commands.add(verb, c)
+}
+
+// add adds the command with the verb, or removes it if it has no Handler
+func (cs *commands) add(verb string, c Command) error {
+	verb = strings.ToUpper(verb)
+	if !commandVerb.MatchString(verb) {
+		return fmt.Errorf("invalid command verb %q", verb)
+	}
+	if builtinCommands[verb] {
+		return fmt.Errorf("the %s command can't be replaced", verb)
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	if c.Handler == nil {
+		delete(cs.m, verb)
+		return nil
+	}
+	cs.m[verb] = c
+	return nil
+}
+
+// get returns the command of the verb, which must be in upper case
+func (cs *commands) get(verb string) (Command, bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	c, ok := cs.m[verb]
+	return c, ok
+}
+
+// advertise returns the EHLO lines of the commands' keywords, sorted
+func (cs *commands) advertise() string {
+	cs.RLock()
+	defer cs.RUnlock()
+	var keywords []string
+	for _, c := range cs.m {
+		if c.Keyword != "" {
+			keywords = append(keywords, "250-"+c.Keyword+"\r\n")
+		}
+	}
+	sort.Strings(keywords)
+	return strings.Join(keywords, "")
+}
+
+// customCommand runs the custom command of the input, and returns false when there is none
+func (s *server) customCommand(client *client, input []byte) bool {
+	verb, args := input, []byte{}
+	if i := bytes.IndexByte(input, ' '); i > -1 {
+		verb, args = input[:i], input[i+1:]
+	}
+	c, ok := s.commands.get(string(bytes.ToUpper(verb)))
+	if !ok {
+		return false
+	}
+	if reply := c.Handler(client.Envelope, string(args)); reply != "" {
+		client.sendResponse(reply)
+	} else {
+		client.sendResponse(response.Canned.SuccessNoopCmd)
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package guerrilla
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestCustomCommands(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface: "127.0.0.1:2526",
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+	})
+	d := Daemon{Config: cfg}
+	if err := d.AddCommand("MAIL", Command{Handler: func(e *mail.Envelope, args string) string { return "" }}); err == nil {
+		t.Error("expected an error when replacing MAIL")
+	}
+	if err := d.AddCommand("X STATUS", Command{}); err == nil {
+		t.Error("expected an error for an invalid verb")
+	}
+	status := func(e *mail.Envelope, args string) string {
+		return "250-" + e.Helo + "\r\n250 " + args
+	}
+	if err := d.AddCommand("xstatus", Command{Handler: status, Keyword: "XSTATUS V1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddCommand("XPING", Command{Handler: func(e *mail.Envelope, args string) string { return "" }}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddCommand("HELP", Command{Handler: func(e *mail.Envelope, args string) string {
+		return "214 2.0.0 see https://example.com/smtp"
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	// the commands are the daemon's
+	other := Daemon{}
+	if err := other.AddCommand("XOTHER", Command{Handler: status}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2526")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	cmd := func(line string, expect ...string) {
+		if line != "" {
+			if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+				t.Error(err)
+			}
+		}
+		for _, e := range expect {
+			str, err := in.ReadString('\n')
+			if err != nil {
+				t.Error(err)
+			} else if !strings.HasPrefix(str, e) {
+				t.Error("sent", line, "expected", e, "but got", str)
+			}
+		}
+	}
+	cmd("", "220")
+	cmd("EHLO host", "250-", "250-SIZE", "250-PIPELINING", "250-ENHANCEDSTATUSCODES",
+		"250-XSTATUS V1", "250 HELP")
+	cmd("xstatus queue", "250-host", "250 queue")
+	cmd("XPING", "200 2.0.0 OK")
+	cmd("HELP", "214 2.0.0 see")
+	cmd("XUNKNOWN", "554 5.5.1")
+	cmd("XOTHER", "554 5.5.1")
+	// added after the start
+	if err := d.AddCommand("XLATE", Command{Handler: func(e *mail.Envelope, args string) string {
+		return "250 2.0.0 late"
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	cmd("XLATE", "250 2.0.0 late")
+	cmd("QUIT", "221")
+}
@@ -31,6 +31,14 @@ type AppConfig struct {
 	LogLevel string `json:"log_level,omitempty"`
 	// BackendConfig configures the email envelope processing backend
 	BackendConfig backends.BackendConfig `json:"backend_config"`
+	// Tenants lists the hosted customers, see TenantConfig
+	Tenants []TenantConfig `json:"tenants,omitempty"`
+	// Admin configures the admin HTTP API, see AdminConfig
+	Admin AdminConfig `json:"admin,omitempty"`
+	// CertMonitor configures the checks of the expiry of the TLS certificates, see CertMonitorConfig
+	CertMonitor CertMonitorConfig `json:"cert_monitor,omitempty"`
+	// Stats keeps the statistics across restarts, see StatsConfig
+	Stats StatsConfig `json:"stats,omitempty"`
 }
 
 // ServerConfig specifies config options for a single server
@@ -55,6 +63,13 @@ type ServerConfig struct {
 	// MaxClients controls how many maximum clients we can handle at once.
 	// Defaults to defaultMaxClients
 	MaxClients int `json:"max_clients"`
+	// FairnessOn shares the max_clients between the IP addresses of the clients, so that a single
+	// source can't occupy all of them. Waiting clients are admitted from the least busy source first
+	FairnessOn bool `json:"fairness_on,omitempty"`
+	// FairReservedClients are slots that only sources without a connection can take
+	FairReservedClients int `json:"fair_reserved_clients,omitempty"`
+	// FairWeights give some sources a bigger share, eg. ["10.0.0.0/8=4"]. Other sources have a weight of 1
+	FairWeights []string `json:"fair_weights,omitempty"`
 	// IsEnabled set to true to start the server, false will ignore it
 	IsEnabled bool `json:"is_enabled"`
 	// XClientOn when using a proxy such as Nginx, XCLIENT command is used to pass the
@@ -63,6 +78,46 @@ type ServerConfig struct {
 	XClientOn    bool     `json:"xclient_on,omitempty"`
 	AuthRequired bool     `json:"auth_required,omitempty"`
 	AuthTypes    []string `json:"auth_types,omitempty"`
+	// AuthAllowInsecure lets clients use AUTH PLAIN and LOGIN, which send the password in the clear,
+	// before STARTTLS. They are only advertised and accepted over TLS by default
+	AuthAllowInsecure bool `json:"auth_allow_insecure,omitempty"`
+	// RejectAddressLiterals rejects MAIL/RCPT paths with an address-literal domain,
+	// eg. <user@[192.0.2.1]>. They are accepted by default
+	RejectAddressLiterals bool `json:"reject_address_literals,omitempty"`
+	// RejectSourceRoutes rejects MAIL/RCPT paths that have a source route,
+	// eg. <@relay.example.com:user@example.com>. They are accepted by default,
+	// and the route is ignored as RFC 5321 recommends
+	RejectSourceRoutes bool `json:"reject_source_routes,omitempty"`
+	// SMTPUTF8On advertises the SMTPUTF8 extension (RFC 6531). Addresses with
+	// non-ASCII characters are only accepted when the client gave the
+	// SMTPUTF8 parameter to MAIL FROM
+	SMTPUTF8On bool `json:"smtputf8_on,omitempty"`
+	// BounceMaxSize is the maximum size of a bounce (MAIL FROM:<>) message.
+	// Defaults to 0, which means MaxSize applies
+	BounceMaxSize int64 `json:"bounce_max_size,omitempty"`
+	// BounceSingleRcpt only allows one recipient for bounce messages, since
+	// a legitimate bounce is only ever returned to a single sender
+	BounceSingleRcpt bool `json:"bounce_single_rcpt,omitempty"`
+	// DeferRcptAfter answers the recipients after the first DeferRcptAfter of a transaction at once, and
+	// validates them together when DATA is given, to save a round trip to the backend for each of them.
+	// Refused ones are dropped from the transaction. 0 validates every recipient when it's given
+	DeferRcptAfter int `json:"defer_rcpt_after,omitempty"`
+	// MaxMessagesPerSession closes the connection with a 421 at the next MAIL FROM once a client has sent
+	// this many messages, accepted or not. 0 doesn't limit them
+	MaxMessagesPerSession int `json:"max_messages_per_session,omitempty"`
+	// Tenant is the name of the tenant that all mail received by this server belongs to.
+	// When empty, the tenant is found by the recipient's domain
+	Tenant string `json:"tenant,omitempty"`
+	// Policy decides whether to accept, delay or refuse clients at each stage of the session
+	Policy PolicyConfig `json:"policy,omitempty"`
+	// TCP tunes the sockets, see TCPConfig
+	TCP TCPConfig `json:"tcp,omitempty"`
+	// RateLimit limits the connections of each IP address and the messages of each sender, see RateLimitConfig
+	RateLimit RateLimitConfig `json:"rate_limit,omitempty"`
+	// ProxyProtocol takes the clients' addresses from the PROXY header of a load balancer, see ProxyProtocolConfig
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+	// VRFY answers VRFY and EXPN for the allowed networks, see VRFYConfig
+	VRFY VRFYConfig `json:"vrfy,omitempty"`
 }
 
 type ServerTLSConfig struct {
@@ -85,6 +140,13 @@ type ServerTLSConfig struct {
 	// declares the policy the server will follow for TLS Client Authentication.
 	// Use Go's default if empty
 	ClientAuthType string `json:"client_auth_type,omitempty"`
+	// ClientCAs is a PEM file of the CAs that the client certificates are verified with,
+	// the system's if empty
+	ClientCAs string `json:"client_cas_file,omitempty"`
+	// ClientCertAllowed are the patterns of the verified client certificates that may connect,
+	// matched with the common name and the subject alternative names, eg. "*.example.com".
+	// Any verified certificate may connect if empty
+	ClientCertAllowed []string `json:"client_cert_allowed,omitempty"`
 	// The following used to watch certificate changes so that the TLS can be reloaded
 	_privateKeyFileMtime int64
 	_publicKeyFileMtime  int64
@@ -96,6 +158,41 @@ type ServerTLSConfig struct {
 	StartTLSOn bool `json:"start_tls_on,omitempty"`
 	// AlwaysOn run this server as a pure TLS server, i.e. SMTPS
 	AlwaysOn bool `json:"tls_always_on,omitempty"`
+	// StartTLSRequired refuses MAIL FROM and AUTH until the client issued STARTTLS, eg. for
+	// submission on port 587. Needs StartTLSOn
+	StartTLSRequired bool `json:"start_tls_required,omitempty"`
+	// SessionTicketsOff disables resuming TLS sessions with session tickets
+	SessionTicketsOff bool `json:"session_tickets_off,omitempty"`
+	// SessionTicketRotation is how often the key that encrypts session tickets changes, eg. "1h".
+	// Tickets can be used for twice as long. When empty, Go's own keys are used
+	SessionTicketRotation string `json:"session_ticket_rotation,omitempty"`
+	// SessionTicketKeyFile is a file with a secret that the ticket keys are derived from, so that
+	// all the servers with the file can resume each other's sessions. Their clocks should be in sync
+	SessionTicketKeyFile string `json:"session_ticket_key_file,omitempty"`
+	// OCSPStaplingOn staples the certificate's OCSP response to the handshakes. The issuer's
+	// certificate must follow the certificate in public_key_file
+	OCSPStaplingOn bool `json:"ocsp_stapling_on,omitempty"`
+	// OCSPResponder is the URL of the OCSP responder, the certificate's OCSP server if empty
+	OCSPResponder string `json:"ocsp_responder,omitempty"`
+	// OCSPCacheDir is where the responses are kept, to staple them straight after a restart
+	OCSPCacheDir string `json:"ocsp_cache_dir,omitempty"`
+	// SNICertificates are more certificates, chosen by the name the client asks for with SNI.
+	// Each is "<public_key_file> <private_key_file>", the files are read again when they change
+	SNICertificates []string `json:"sni_certificates,omitempty"`
+	// ACMEHosts are the names that the certificates are requested for from an ACME CA, eg.
+	// Let's Encrypt. The key files aren't needed then
+	ACMEHosts []string `json:"acme_hosts,omitempty"`
+	// ACMEEmail is the contact of the ACME account
+	ACMEEmail string `json:"acme_email,omitempty"`
+	// ACMEDirectory is the URL of the CA's directory, Let's Encrypt's if empty
+	ACMEDirectory string `json:"acme_directory,omitempty"`
+	// ACMECacheDir is where the account key and the certificates are kept. Required
+	ACMECacheDir string `json:"acme_cache_dir,omitempty"`
+	// ACMEHTTPListen is the interface, eg. ":80", that answers the HTTP-01 challenges
+	ACMEHTTPListen string `json:"acme_http_listen,omitempty"`
+	// ACMEDNSHook is a command that answers the DNS-01 challenges, instead of HTTP-01. It's run
+	// with "present <name> <value>" to add the TXT record, and "cleanup <name> <value>"
+	ACMEDNSHook string `json:"acme_dns_hook,omitempty"`
 }
 
 // https://golang.org/pkg/crypto/tls/#pkg-constants
@@ -179,6 +276,20 @@ func (c *AppConfig) Load(jsonBytes []byte) error {
 			return errs
 		}
 	}
+	if _, err := c.CertMonitor.interval(); err != nil {
+		return err
+	}
+	// tenant names must be unique
+	names := make(map[string]bool, len(c.Tenants))
+	for _, t := range c.Tenants {
+		if t.Name == "" {
+			return errors.New("tenant name cannot be empty")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenant [%s] is listed more than once", t.Name)
+		}
+		names[t.Name] = true
+	}
 
 	// read the timestamps for the TLS keys, to determine if they need to be reloaded
 	for i := 0; i < len(c.Servers); i++ {
@@ -203,6 +314,10 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	if !reflect.DeepEqual(oldConfig.AllowedHosts, c.AllowedHosts) {
 		app.Publish(EventConfigAllowedHosts, c)
 	}
+	// have the tenants changed?
+	if !reflect.DeepEqual(oldConfig.Tenants, c.Tenants) {
+		app.Publish(EventConfigTenants, c)
+	}
 	// has pid file changed?
 	if strings.Compare(oldConfig.PidFile, c.PidFile) != 0 {
 		app.Publish(EventConfigPidFile, c)
@@ -374,7 +489,8 @@ func (sc *ServerConfig) emitChangeEvents(oldServer *ServerConfig, app Guerrilla)
 		(*sc).TLS,
 	)
 
-	if len(changes) > 0 || len(tlsChanges) > 0 {
+	if len(changes) > 0 || len(tlsChanges) > 0 || !reflect.DeepEqual(oldServer.Policy, sc.Policy) ||
+		!reflect.DeepEqual(oldServer.TCP, sc.TCP) {
 		// something changed in the server config
 		app.Publish(EventConfigServerConfig, sc)
 	}
@@ -443,7 +559,7 @@ func (sc *ServerConfig) loadTlsKeyTimestamps() error {
 func (sc *ServerConfig) Validate() error {
 	var errs Errors
 
-	if sc.TLS.StartTLSOn || sc.TLS.AlwaysOn {
+	if (sc.TLS.StartTLSOn || sc.TLS.AlwaysOn) && (len(sc.TLS.ACMEHosts) == 0 || sc.TLS.PublicKeyFile != "") {
 		if sc.TLS.PublicKeyFile == "" {
 			errs = append(errs, errors.New("PublicKeyFile is empty"))
 		}
@@ -454,6 +570,29 @@ func (sc *ServerConfig) Validate() error {
 			errs = append(errs, fmt.Errorf("cannot use TLS config for [%s], %v", sc.ListenInterface, err))
 		}
 	}
+	if sc.TLS.StartTLSOn || sc.TLS.AlwaysOn {
+		for _, entry := range sc.TLS.SNICertificates {
+			if _, err := loadSNICert(entry); err != nil {
+				errs = append(errs, fmt.Errorf("sni_certificates of [%s]: %v", sc.ListenInterface, err))
+			}
+		}
+		if err := sc.TLS.validateACME(); err != nil {
+			errs = append(errs, fmt.Errorf("cannot use ACME for [%s], %v", sc.ListenInterface, err))
+		}
+		if sc.TLS.OCSPStaplingOn && sc.TLS.PublicKeyFile == "" {
+			errs = append(errs, fmt.Errorf("ocsp_stapling_on needs public_key_file for [%s]", sc.ListenInterface))
+		}
+	}
+	if len(sc.TLS.ClientCertAllowed) > 0 && sc.TLS.ClientAuthType != "" &&
+		sc.TLS.ClientAuthType != "VerifyClientCertIfGiven" && sc.TLS.ClientAuthType != "RequireAndVerifyClientCert" {
+		errs = append(errs, fmt.Errorf("client_cert_allowed needs a client_auth_type that verifies the certificates for [%s]", sc.ListenInterface))
+	}
+	if sc.TLS.StartTLSRequired && !sc.TLS.StartTLSOn && !sc.TLS.AlwaysOn {
+		errs = append(errs, fmt.Errorf("start_tls_required needs start_tls_on for [%s]", sc.ListenInterface))
+	}
+	if err := sc.VRFY.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("%v for [%s]", err, sc.ListenInterface))
+	}
 	if len(errs) > 0 {
 		return errs
 	}
@@ -0,0 +1,154 @@
+package guerrilla
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ConfigSource provides the config from a central place, such as a database or a key-value store,
+// so that a fleet of daemons can be reconfigured without distributing files.
+// Implement it to add other stores, eg. etcd
+type ConfigSource interface {
+	// Fetch returns the config as JSON, and a version that changes whenever the config changes.
+	// If the store has no notion of a version, return a digest of the data
+	Fetch() (data []byte, version string, err error)
+}
+
+// SQLConfigSource loads the config from a database.
+// Query must return a single row, with the JSON config in the first column and its version,
+// eg. a revision number or a timestamp, in the second column
+type SQLConfigSource struct {
+	DB    *sql.DB
+	Query string
+	Args  []interface{}
+}
+
+// Fetch runs the query and returns the config and its version
+func (s *SQLConfigSource) Fetch() (data []byte, version string, err error) {
+	row := s.DB.QueryRow(s.Query, s.Args...)
+	var v interface{}
+	if err = row.Scan(&data, &v); err != nil {
+		return nil, "", fmt.Errorf("could not fetch config from database: %s", err)
+	}
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	return data, fmt.Sprint(v), nil
+}
+
+// HTTPConfigSource loads the config from a URL, eg. a Consul key using the raw parameter:
+// http://127.0.0.1:8500/v1/kv/guerrilla/config?raw
+// The version is taken from the X-Consul-Index or ETag header, or else the data's digest
+type HTTPConfigSource struct {
+	URL    string
+	Client *http.Client
+}
+
+// Fetch gets the config from the URL
+func (s *HTTPConfigSource) Fetch() (data []byte, version string, err error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Second * 30}
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not fetch config from %s: %s", s.URL, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("could not fetch config from %s: %s", s.URL, resp.Status)
+	}
+	if data, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, "", err
+	}
+	if version = resp.Header.Get("X-Consul-Index"); version == "" {
+		if version = resp.Header.Get("ETag"); version == "" {
+			version = fmt.Sprintf("%x", sha1.Sum(data))
+		}
+	}
+	return data, version, nil
+}
+
+// LoadConfigFrom is the same as LoadConfig, except that it reads in the config from a ConfigSource
+func (d *Daemon) LoadConfigFrom(src ConfigSource) (AppConfig, error) {
+	var ac AppConfig
+	data, _, err := src.Fetch()
+	if err != nil {
+		return ac, err
+	}
+	if err = ac.Load(data); err != nil {
+		return ac, err
+	}
+	if d.Config == nil {
+		d.Config = &ac
+	}
+	return ac, nil
+}
+
+// WatchConfig polls the source every interval and reloads the config whenever its version
+// changes, emitting the config change events, the same as ReloadConfig.
+// The modify function, if not nil, can change the config before it's applied, eg. to keep values
+// from command line flags. The watch stops when the daemon is shut down
+func (d *Daemon) WatchConfig(src ConfigSource, interval time.Duration, modify func(*AppConfig)) error {
+	if d.g == nil {
+		return errors.New("daemon not started")
+	}
+	if interval <= 0 {
+		return errors.New("the watch interval must be greater than 0")
+	}
+	_, version, err := src.Fetch()
+	if err != nil {
+		return err
+	}
+	d.reloadMu.Lock()
+	if d.stopWatch == nil {
+		d.stopWatch = make(chan struct{})
+	}
+	stop := d.stopWatch
+	d.reloadMu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			data, v, err := src.Fetch()
+			if err != nil {
+				d.Log().WithError(err).Error("Error while watching config")
+				continue
+			}
+			if v == version {
+				continue
+			}
+			var ac AppConfig
+			if err = ac.Load(data); err != nil {
+				d.Log().WithError(err).Error("Error while watching config")
+				continue
+			}
+			if modify != nil {
+				modify(&ac)
+			}
+			// only retry when there is a new version, if the reload fails
+			version = v
+			d.reloadMu.Lock()
+			select {
+			case <-stop:
+				// shut down while fetching
+			default:
+				_ = d.reloadConfig(ac)
+			}
+			d.reloadMu.Unlock()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,97 @@
+package guerrilla
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestWatchConfig(t *testing.T) {
+	var config atomic.Value
+	config.Store(`{"log_file" : "off", "allowed_hosts" : ["grr.la"]}`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(config.Load().(string)))
+	}))
+	defer ts.Close()
+
+	src := &HTTPConfigSource{URL: ts.URL}
+	d := Daemon{}
+	ac, err := d.LoadConfigFrom(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Config == nil || len(ac.AllowedHosts) != 1 {
+		t.Fatal("config was not loaded from the source")
+	}
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	changed := make(chan []string, 1)
+	if err = d.Subscribe(EventConfigAllowedHosts, func(c *AppConfig) {
+		changed <- c.AllowedHosts
+	}); err != nil {
+		t.Error(err)
+	}
+	if err = d.WatchConfig(src, time.Millisecond*10, func(c *AppConfig) {
+		c.LogLevel = log.DebugLevel.String()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	config.Store(`{"log_file" : "off", "allowed_hosts" : ["grr.la", "example.com"]}`)
+	select {
+	case hosts := <-changed:
+		if len(hosts) != 2 {
+			t.Error("expected 2 allowed hosts, got", hosts)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the config change was not applied")
+	}
+	if d.Config.LogLevel != log.DebugLevel.String() {
+		t.Error("expected the modify function to set the log level, got", d.Config.LogLevel)
+	}
+}
+
+func TestWatchConfigWithReloads(t *testing.T) {
+	var version int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a new version for each fetch
+		if atomic.AddInt32(&version, 1)%2 == 0 {
+			_, _ = w.Write([]byte(`{"log_file" : "off", "allowed_hosts" : ["grr.la"]}`))
+		} else {
+			_, _ = w.Write([]byte(`{"log_file" : "off", "allowed_hosts" : ["grr.la", "example.com"]}`))
+		}
+	}))
+	defer ts.Close()
+
+	src := &HTTPConfigSource{URL: ts.URL}
+	d := Daemon{}
+	if _, err := d.LoadConfigFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WatchConfig(src, time.Millisecond, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the reloads are applied one at a time, with the ones of the watch
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_ = d.ReloadConfig(AppConfig{LogFile: "off", AllowedHosts: []string{"grr.la"}})
+			}
+		}()
+	}
+	wg.Wait()
+	d.Shutdown()
+}
@@ -235,7 +235,7 @@ func TestConfigChangeEvents(t *testing.T) {
 	if err != nil {
 		t.Error("cannot create backend", err)
 	}
-	app, err := New(oldconf, backend, logger)
+	app, err := New(oldconf, backend, nil, logger)
 	if err != nil {
 		t.Error("cannot create daemon", err)
 	}
@@ -0,0 +1,471 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// ConsoleProtocol is the Upgrade header's value that opens the debug console, see adminConsole
+const ConsoleProtocol = "guerrilla-console"
+
+const (
+	// consoleIdleTimeout closes a console that hasn't sent a command for a while
+	consoleIdleTimeout = time.Minute * 10
+	// consoleMaxHeader is the most of an in flight message's header that is shown
+	consoleMaxHeader = 4 << 10
+)
+
+var clientStateNames = map[ClientState]string{
+	ClientGreeting: "greeting",
+	ClientCmd:      "command",
+	ClientData:     "data",
+	ClientStartTLS: "starttls",
+	ClientShutdown: "shutdown",
+	ClientLogin:    "login",
+	ClientPassword: "password",
+}
+
+// clientSnapshot is what a console shows of a client, as of its last command
+type clientSnapshot struct {
+	ID          uint64
+	Server      string
+	RemoteIP    string
+	Helo        string
+	State       string
+	ConnectedAt time.Time
+	ESMTP       bool
+	TLS         bool
+	Tenant      string
+	MailFrom    string
+	RcptTo      []string
+	QueuedId    string
+	Messages    int
+	// Size and Header are set while the message is being processed
+	Size   int
+	Header string
+}
+
+type consoleKey struct {
+	server string
+	id     uint64
+}
+
+// consoleState keeps the snapshots of the connected clients for the debug consoles. It's
+// shared by all servers
+type consoleState struct {
+	// sessions is the number of open consoles, the clients are only published while there's one
+	sessions int32
+	clients  sync.Map
+	// conns are the connections of the open consoles, closed when the admin API stops
+	conns map[net.Conn]struct{}
+	sync.Mutex
+}
+
+func newConsoleState() *consoleState {
+	return &consoleState{conns: make(map[net.Conn]struct{})}
+}
+
+// publish saves the client's snapshot if a console is open. inFlight adds the message
+// that's being processed
+func (c *consoleState) publish(client *client, server string, inFlight bool) {
+	if atomic.LoadInt32(&c.sessions) == 0 {
+		return
+	}
+	snap := &clientSnapshot{
+		ID:          client.ID,
+		Server:      server,
+		RemoteIP:    client.RemoteIP,
+		Helo:        client.Helo,
+		State:       clientStateNames[client.state],
+		ConnectedAt: client.ConnectedAt,
+		ESMTP:       client.ESMTP,
+		TLS:         client.TLS,
+		Tenant:      client.Tenant,
+		MailFrom:    client.MailFrom.String(),
+		QueuedId:    client.QueuedId,
+		Messages:    client.messagesSent,
+	}
+	for i := range client.RcptTo {
+		snap.RcptTo = append(snap.RcptTo, client.RcptTo[i].String())
+	}
+	if inFlight {
+		data := client.Data.Bytes()
+		snap.Size = len(data)
+		if i := bytes.Index(data, []byte("\n\r\n")); i >= 0 {
+			data = data[:i+1]
+		} else if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+			data = data[:i+1]
+		}
+		if len(data) > consoleMaxHeader {
+			data = data[:consoleMaxHeader]
+		}
+		snap.Header = string(data)
+	}
+	c.clients.Store(consoleKey{server: server, id: client.ID}, snap)
+}
+
+// forget removes the snapshot of a client that disconnected
+func (c *consoleState) forget(client *client, server string) {
+	c.clients.Delete(consoleKey{server: server, id: client.ID})
+}
+
+// snapshots returns the snapshots sorted by server and ID
+func (c *consoleState) snapshots() []*clientSnapshot {
+	var list []*clientSnapshot
+	c.clients.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*clientSnapshot))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Server != list[j].Server {
+			return list[i].Server < list[j].Server
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// open registers a console's connection
+func (c *consoleState) open(conn net.Conn) {
+	c.Lock()
+	defer c.Unlock()
+	c.conns[conn] = struct{}{}
+	atomic.AddInt32(&c.sessions, 1)
+}
+
+// close unregisters a console's connection
+func (c *consoleState) close(conn net.Conn) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.conns[conn]; !ok {
+		return
+	}
+	delete(c.conns, conn)
+	_ = conn.Close()
+	if atomic.AddInt32(&c.sessions, -1) == 0 {
+		// they'd be out of date by the next console
+		c.clients.Range(func(k, _ interface{}) bool {
+			c.clients.Delete(k)
+			return true
+		})
+	}
+}
+
+// closeAll closes the open consoles
+func (c *consoleState) closeAll() {
+	c.Lock()
+	conns := make([]net.Conn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.Unlock()
+	for _, conn := range conns {
+		c.close(conn)
+	}
+}
+
+// adminConsole opens the debug console, GET /console with the headers "Connection: Upgrade" and
+// "Upgrade: guerrilla-console". After the 101 reply, the connection takes a command per line,
+// see consoleHelp. Only the admin token may use it
+func (g *guerrilla) adminConsole(w http.ResponseWriter, r *http.Request, tenant string) {
+	if tenant != "" {
+		writeAdminError(w, http.StatusForbidden, "requires the admin token")
+		return
+	}
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), ConsoleProtocol) {
+		w.Header().Set("Upgrade", ConsoleProtocol)
+		writeAdminError(w, http.StatusUpgradeRequired, "upgrade to "+ConsoleProtocol+", eg. with guerrillad console")
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeAdminError(w, http.StatusInternalServerError, "the connection can't be upgraded")
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		g.mainlog().WithError(err).Error("could not open the console")
+		return
+	}
+	// the admin API's timeouts are for requests
+	_ = conn.SetDeadline(time.Time{})
+	g.console.open(conn)
+	defer g.console.close(conn)
+	_, _ = fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n",
+		ConsoleProtocol)
+	g.mainlog().Infof("console opened from %s", conn.RemoteAddr())
+	s := &consoleSession{g: g, conn: conn, rw: buf}
+	s.run()
+	g.mainlog().Infof("console closed from %s", conn.RemoteAddr())
+}
+
+const consoleHelp = `commands:
+  conns                          list the connected clients, as of their last command
+  dump <id> [server]             show the client and the message it's sending
+  step <queued id> [chain]       process a quarantined email, one processor at a time,
+                                 <tenant>/<queued id> for a tenant's quarantine
+  help                           show this
+  quit                           close the console
+`
+
+// consoleSession runs the commands of a console
+type consoleSession struct {
+	g    *guerrilla
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// readLine reads a line, and returns an error once the console is closed or idle
+func (s *consoleSession) readLine() (string, error) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(consoleIdleTimeout))
+	line, err := s.rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// printf writes to the console
+func (s *consoleSession) printf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(s.rw, format, args...)
+}
+
+func (s *consoleSession) run() {
+	s.printf("guerrilla console, %s. Type help for the commands\n", Version)
+	for {
+		s.printf("> ")
+		if err := s.rw.Flush(); err != nil {
+			return
+		}
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "conns":
+			s.conns()
+		case "dump":
+			s.dump(args[1:])
+		case "step":
+			s.step(args[1:])
+		case "help":
+			s.printf("%s", consoleHelp)
+		case "quit", "exit":
+			_ = s.rw.Flush()
+			return
+		default:
+			s.printf("unknown command %s, type help for the commands\n", args[0])
+		}
+	}
+}
+
+// conns lists the connected clients
+func (s *consoleSession) conns() {
+	list := s.g.console.snapshots()
+	if len(list) == 0 {
+		s.printf("no clients, or none has sent a command since the console was opened\n")
+		return
+	}
+	tw := tabwriter.NewWriter(s.rw, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tSERVER\tREMOTE\tSTATE\tAGE\tFROM\tRCPTS")
+	for _, c := range list {
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\n", c.ID, c.Server, c.RemoteIP, c.State,
+			time.Since(c.ConnectedAt).Round(time.Second), c.MailFrom, len(c.RcptTo))
+	}
+	_ = tw.Flush()
+}
+
+// dump shows a client and the envelope it's sending
+func (s *consoleSession) dump(args []string) {
+	if len(args) == 0 {
+		s.printf("usage: dump <id> [server]\n")
+		return
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		s.printf("invalid id %s\n", args[0])
+		return
+	}
+	var found []*clientSnapshot
+	for _, c := range s.g.console.snapshots() {
+		if c.ID == id && (len(args) < 2 || c.Server == args[1]) {
+			found = append(found, c)
+		}
+	}
+	if len(found) == 0 {
+		s.printf("no client %d\n", id)
+		return
+	} else if len(found) > 1 {
+		s.printf("several servers have a client %d, give the server too\n", id)
+		return
+	}
+	c := found[0]
+	tw := tabwriter.NewWriter(s.rw, 0, 4, 1, ' ', 0)
+	for _, field := range [][2]string{
+		{"id", strconv.FormatUint(c.ID, 10)},
+		{"server", c.Server},
+		{"remote", c.RemoteIP},
+		{"helo", c.Helo},
+		{"state", c.State},
+		{"connected", c.ConnectedAt.Format(time.RFC3339)},
+		{"esmtp", strconv.FormatBool(c.ESMTP)},
+		{"tls", strconv.FormatBool(c.TLS)},
+		{"tenant", c.Tenant},
+		{"messages", strconv.Itoa(c.Messages)},
+		{"queued id", c.QueuedId},
+		{"mail from", c.MailFrom},
+		{"rcpt to", strings.Join(c.RcptTo, ", ")},
+	} {
+		_, _ = fmt.Fprintf(tw, "%s:\t%s\n", field[0], field[1])
+	}
+	_ = tw.Flush()
+	if c.Header != "" {
+		s.printf("size: %d\n%s", c.Size, c.Header)
+	}
+}
+
+// step processes a quarantined email with a chain, asking before each processor
+func (s *consoleSession) step(args []string) {
+	if len(args) == 0 {
+		s.printf("usage: step <queued id> [chain]\n")
+		return
+	}
+	stepper, ok := s.g.backend().(backends.ChainStepper)
+	if !ok {
+		s.printf("the backend can't step through its processors\n")
+		return
+	}
+	e, err := s.g.quarantined(args[0])
+	if err != nil {
+		s.printf("%s\n", err)
+		return
+	}
+	chain := ""
+	if len(args) > 1 {
+		chain = args[1]
+	}
+	s.printf("stepping %s, from <%s> to %d recipients\n", e.QueuedId, e.MailFrom.String(), len(e.RcptTo))
+	run := false
+	res := stepper.StepChain(e, chain, func(name string, e *mail.Envelope) bool {
+		s.printf("next: %s, tags: [%s]\n", name, strings.Join(e.Tags.Strings(), " "))
+		if run {
+			return true
+		}
+		for {
+			s.printf("(n)ext, (c)ontinue or (a)bort? ")
+			if s.rw.Flush() != nil {
+				return false
+			}
+			line, err := s.readLine()
+			if err != nil {
+				return false
+			}
+			switch strings.ToLower(line) {
+			case "", "n", "next":
+				return true
+			case "c", "continue":
+				run = true
+				return true
+			case "a", "abort":
+				return false
+			}
+		}
+	})
+	s.printf("result: %s\n", res)
+	keys := make([]string, 0, len(e.Values))
+	for k := range e.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s.printf("tags: [%s], values: [%s]\n", strings.Join(e.Tags.Strings(), " "), strings.Join(keys, " "))
+}
+
+// quarantined reads an email that the contentfilter processor quarantined, by its queued id,
+// or <tenant>/<queued id>
+func (g *guerrilla) quarantined(name string) (*mail.Envelope, error) {
+	g.guard.Lock()
+	dir, _ := g.Config.BackendConfig.Section("contentfilter")["content_filter_quarantine_dir"].(string)
+	g.guard.Unlock()
+	if dir == "" {
+		return nil, errors.New("there's no quarantine, see content_filter_quarantine_dir")
+	}
+	tenant, id := "", name
+	if i := strings.Index(name, "/"); i >= 0 {
+		tenant, id = name[:i], name[i+1:]
+	}
+	for _, part := range []string{tenant, id} {
+		if strings.ContainsAny(part, `/\`) || strings.HasPrefix(part, ".") {
+			return nil, fmt.Errorf("invalid queued id %s", name)
+		}
+	}
+	if id == "" {
+		return nil, fmt.Errorf("invalid queued id %s", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(backends.ForTenant(dir, tenant), id+".eml"))
+	if err != nil {
+		return nil, err
+	}
+	// the envelope isn't saved with the email, so it's taken from the headers. They're parsed
+	// separately, for the HeadersParser processor of the chain
+	parsed := &mail.Envelope{}
+	parsed.Data.Write(data)
+	if err := parsed.ParseHeaders(); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not parse %s: %s", name, err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 0)
+	e.QueuedId = id
+	e.Tenant = tenant
+	e.Data.Write(data)
+	for _, key := range []string{"Return-Path", "From"} {
+		if from := consoleAddresses(parsed.HeaderIndex.GetAll(key)); len(from) > 0 {
+			e.MailFrom = from[0]
+			break
+		}
+	}
+	for _, key := range []string{"Delivered-To", "To"} {
+		if e.RcptTo = consoleAddresses(parsed.HeaderIndex.GetAll(key)); len(e.RcptTo) > 0 {
+			break
+		}
+	}
+	if len(e.RcptTo) == 0 {
+		return nil, fmt.Errorf("%s has no recipients", name)
+	}
+	if tenant != "" {
+		e.Tags.Add("tenant", tenant)
+	}
+	return e, nil
+}
+
+// consoleAddresses parses the addresses of header values, eg. "a@example.com, B <b@example.com>"
+func consoleAddresses(values []string) []mail.Address {
+	var list []mail.Address
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if a, err := mail.NewAddress(strings.TrimSpace(s)); err == nil && a.Host != "" {
+				list = append(list, *a)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,161 @@
+package guerrilla
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// testConsole is the client side of a debug console
+type testConsole struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// read returns the output up to the next prompt, for a command or a step
+func (c *testConsole) read() string {
+	var out strings.Builder
+	for !strings.HasSuffix("\n"+out.String(), "\n> ") && !strings.HasSuffix(out.String(), "(a)bort? ") {
+		s, err := c.in.ReadString(' ')
+		if err != nil {
+			c.t.Fatal("console closed after", out.String(), err)
+		}
+		out.WriteString(s)
+	}
+	return out.String()
+}
+
+// send sends a line and returns the output up to the next prompt
+func (c *testConsole) send(line string) string {
+	if _, err := fmt.Fprint(c.conn, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func TestConsole(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	dir, err := ioutil.TempDir("", "console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	held := "Delivered-To: bob@example.com\nReturn-Path: <alice@example.com>\nSubject: held\n\nhello\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "abc.eml"), []byte(held), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"example.com"},
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2525", IsEnabled: true, MaxClients: 10}},
+		Admin:        AdminConfig{ListenInterface: "127.0.0.1:2580", Token: "secret"},
+		BackendConfig: backends.BackendConfig{
+			"save_process":                  "HeadersParser|Debugger",
+			"log_received_mails":            true,
+			"content_filter_quarantine_dir": dir,
+		},
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	// a plain request is asked to upgrade
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:2580/console", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != ConsoleProtocol {
+		t.Error("expected 426, got", resp.Status)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2580")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, _ = fmt.Fprintf(conn, "GET /console HTTP/1.1\r\nHost: 127.0.0.1\r\nAuthorization: Bearer secret\r\n"+
+		"Connection: Upgrade\r\nUpgrade: %s\r\n\r\n", ConsoleProtocol)
+	c := &testConsole{t: t, conn: conn, in: bufio.NewReader(conn)}
+	if resp, err := http.ReadResponse(c.in, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("expected the console to open, got", resp, err)
+	}
+	c.read()
+
+	// a client that's in the middle of a transaction
+	smtp, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = smtp.Close()
+	}()
+	in := bufio.NewReader(smtp)
+	for _, line := range []string{"", "HELO host", "MAIL FROM:<test@example.com>", "RCPT TO:<a@example.com>"} {
+		if line != "" {
+			_, _ = fmt.Fprint(smtp, line+"\r\n")
+		}
+		if _, err := in.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the snapshot is published after the reply
+	var out string
+	for i := 0; !strings.Contains(out, "a@example.com"); i++ {
+		if i == 50 {
+			t.Fatal("expected the client to be dumped, got", out)
+		}
+		time.Sleep(time.Millisecond * 10)
+		out = c.send("dump 1")
+	}
+	if !strings.Contains(out, "test@example.com") || !strings.Contains(out, "host") {
+		t.Error("unexpected dump", out)
+	}
+	if out = c.send("conns"); !strings.Contains(out, "127.0.0.1:2525") || !strings.Contains(out, "command") {
+		t.Error("expected the client to be listed, got", out)
+	}
+
+	// the quarantined email is processed a processor at a time
+	if out = c.send("step abc"); !strings.Contains(out, "from <alice@example.com> to 1 recipients") ||
+		!strings.Contains(out, "next: headersparser") {
+		t.Fatal("unexpected step", out)
+	}
+	if out = c.send("n"); !strings.Contains(out, "next: debugger") {
+		t.Fatal("unexpected step", out)
+	}
+	if out = c.send("c"); !strings.Contains(out, "result: 250") {
+		t.Error("expected the email to be saved, got", out)
+	}
+	if out = c.send("step ../abc"); !strings.Contains(out, "invalid queued id") {
+		t.Error("expected the path to be refused, got", out)
+	}
+	if out = c.send("step abc"); !strings.Contains(out, "next: headersparser") {
+		t.Fatal("unexpected step", out)
+	}
+	if out = c.send("a"); !strings.Contains(out, "result: 554") {
+		t.Error("expected the processing to stop, got", out)
+	}
+	_, _ = fmt.Fprint(conn, "quit\n")
+	if _, err := c.in.ReadString('\n'); err == nil {
+		t.Error("expected the console to be closed")
+	}
+}
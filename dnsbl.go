@@ -0,0 +1,179 @@
+package guerrilla
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+const (
+	// defaultDNSBLTimeout is used when dnsbl_timeout is not set, the lists are queried together
+	defaultDNSBLTimeout = time.Second * 2
+	// defaultDNSBLCacheTTL is used when dnsbl_cache_ttl is not set
+	defaultDNSBLCacheTTL = time.Minute * 10
+	// dnsblCacheSize is how many answers are cached before the expired ones are removed
+	dnsblCacheSize = 10000
+)
+
+// DNSBLConfig is a DNS block list that the policy queries for the client's address at the connect stage
+type DNSBLConfig struct {
+	// Zone is the zone of the list, eg. "zen.spamhaus.org"
+	Zone string `json:"zone"`
+	// Weight is added to the connect score when the address is listed, default 1
+	Weight float64 `json:"weight,omitempty"`
+	// Action decides straight away when the address is listed: tempfail or reject
+	Action string `json:"action,omitempty"`
+	// Message replaces the text of the tempfail or reject response
+	Message string `json:"message,omitempty"`
+	// Answers only count these return codes, eg. ["127.0.0.2", "127.0.0.3"], by default any of 127.0.0.0/8
+	Answers []string `json:"answers,omitempty"`
+}
+
+// dnsblList is a compiled DNSBLConfig
+type dnsblList struct {
+	zone    string
+	weight  float64
+	action  string
+	message string
+	answers map[string]bool
+}
+
+func newDNSBLList(config DNSBLConfig) (*dnsblList, error) {
+	l := &dnsblList{
+		zone:    strings.ToLower(strings.Trim(config.Zone, ". ")),
+		weight:  config.Weight,
+		action:  strings.ToLower(config.Action),
+		message: config.Message,
+	}
+	if l.zone == "" {
+		return nil, fmt.Errorf("expected a zone")
+	}
+	switch l.action {
+	case "", PolicyTempfail, PolicyReject:
+	default:
+		return nil, fmt.Errorf("unknown action %q of %s", config.Action, l.zone)
+	}
+	if l.weight == 0 {
+		l.weight = 1
+	}
+	for _, answer := range config.Answers {
+		ip := net.ParseIP(strings.TrimSpace(answer))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid answer %q of %s", answer, l.zone)
+		}
+		if l.answers == nil {
+			l.answers = make(map[string]bool)
+		}
+		l.answers[ip.String()] = true
+	}
+	return l, nil
+}
+
+// listed returns true when an answer of the list counts
+func (l *dnsblList) listed(addrs []net.IP) bool {
+	for _, ip := range addrs {
+		if l.answers == nil || l.answers[ip.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsblAnswer is a cached answer of a list, the addresses that the client's name resolved to
+type dnsblAnswer struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// dnsblCache keeps the answers of the lists for all the servers, so that a client that reconnects
+// isn't looked up again
+var dnsblCache = struct {
+	sync.Mutex
+	m map[string]dnsblAnswer
+}{m: make(map[string]dnsblAnswer)}
+
+// dnsblErrorCodes are the answers of the lists that report an error, eg. a query through a public
+// resolver, rather than a listing
+var dnsblErrorCodes = &net.IPNet{IP: net.IPv4(127, 255, 255, 0), Mask: net.CIDRMask(24, 32)}
+
+// lookupDNSBL returns the answers of the zone for the address, from the cache when they haven't expired.
+// Failed lookups are not cached
+func lookupDNSBL(ctx context.Context, ip net.IP, zone string, ttl time.Duration) ([]net.IP, error) {
+	name := dnsblName(ip, zone)
+	now := time.Now()
+	dnsblCache.Lock()
+	answer, ok := dnsblCache.m[name]
+	dnsblCache.Unlock()
+	if ok && now.Before(answer.expires) {
+		return answer.addrs, nil
+	}
+	addrs, err := backends.Resolver().LookupIPAddr(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	answer = dnsblAnswer{expires: now.Add(ttl)}
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil && ip4[0] == 127 && !dnsblErrorCodes.Contains(ip4) {
+			answer.addrs = append(answer.addrs, ip4)
+		}
+	}
+	dnsblCache.Lock()
+	defer dnsblCache.Unlock()
+	if len(dnsblCache.m) >= dnsblCacheSize {
+		for k, v := range dnsblCache.m {
+			if !now.Before(v.expires) {
+				delete(dnsblCache.m, k)
+			}
+		}
+		if len(dnsblCache.m) >= dnsblCacheSize {
+			dnsblCache.m = make(map[string]dnsblAnswer)
+		}
+	}
+	dnsblCache.m[name] = answer
+	return answer.addrs, nil
+}
+
+// checkDNSBL queries all the lists at once, and waits for them until the timeout. A list that doesn't
+// answer in time doesn't count. It returns the score of the lists, or the decision of a list with
+// an action
+func (p *policy) checkDNSBL(c *PolicyContext) (float64, *policyDecision) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.dnsblTimeout)
+	defer cancel()
+	answers := make([][]net.IP, len(p.dnsbl))
+	errs := make([]error, len(p.dnsbl))
+	var wg sync.WaitGroup
+	for i := range p.dnsbl {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			answers[i], errs[i] = lookupDNSBL(ctx, c.IP, p.dnsbl[i].zone, p.dnsblCacheTTL)
+		}(i)
+	}
+	wg.Wait()
+	if c.dnsbl == nil {
+		c.dnsbl = make(map[string]bool)
+	}
+	score := 0.0
+	for i, l := range p.dnsbl {
+		if errs[i] != nil {
+			continue
+		}
+		// the dnsbl: condition sees the same answers
+		c.dnsbl[l.zone] = len(answers[i]) > 0
+		if !l.listed(answers[i]) {
+			continue
+		}
+		if l.action != "" {
+			return score, &policyDecision{action: l.action, rule: "dnsbl:" + l.zone, message: l.message}
+		}
+		score += l.weight
+	}
+	return score, nil
+}
@@ -41,6 +41,8 @@ const (
 	EventConfigServerMaxClients
 	// when a server's TLS config changed
 	EventConfigServerTLSConfig
+	// when tenants changed
+	EventConfigTenants
 )
 
 var eventList = [...]string{
@@ -61,6 +63,7 @@ var eventList = [...]string{
 	"server_change:timeout",
 	"server_change:max_clients",
 	"server_change:tls_config",
+	"config_change:tenants",
 }
 
 func (e Event) String() string {
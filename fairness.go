@@ -0,0 +1,199 @@
+package guerrilla
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/artpar/go-guerrilla/ipaddr"
+)
+
+// fairAdmission shares the client slots of a server between the sources of the connections, so that
+// a single aggressive source cannot occupy all of them. A source that already has clients can't take
+// the slots reserved for new sources, and when clients are waiting, a free slot goes to the source
+// with the fewest clients for its weight
+type fairAdmission struct {
+	mu       sync.Mutex
+	size     int
+	reserved int
+	weights  []fairWeight
+	// busy is the number of admitted clients
+	busy   int
+	active map[string]int
+	// lent maps the admitted client ids to their source
+	lent    map[uint64]string
+	waiting []*fairWaiter
+	closed  bool
+}
+
+type fairWeight struct {
+	network *net.IPNet
+	weight  int
+}
+
+type fairWaiter struct {
+	clientID uint64
+	source   string
+	// ready receives true when the client is admitted, false when it's turned away
+	ready chan bool
+}
+
+// newFairAdmission shares size slots, reserving some for sources without a client.
+// The weights are "<ip or cidr>=<weight>" entries, other sources have a weight of 1
+func newFairAdmission(size, reserved int, weights []string) (*fairAdmission, error) {
+	if reserved < 0 || reserved >= size {
+		return nil, fmt.Errorf("fair_reserved_clients must be between 0 and max_clients-1, got %d", reserved)
+	}
+	f := &fairAdmission{
+		size:     size,
+		reserved: reserved,
+		active:   make(map[string]int),
+		lent:     make(map[uint64]string),
+	}
+	for _, entry := range weights {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("fair weight %q should be <ip or cidr>=<weight>", entry)
+		}
+		ipNet, err := ipaddr.Network(kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("fair weight %q: %s", entry, err)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("fair weight %q should be a positive number", entry)
+		}
+		f.weights = append(f.weights, fairWeight{network: ipNet, weight: weight})
+	}
+	return f, nil
+}
+
+// connSource returns the IP address of the connection's peer
+func connSource(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (f *fairAdmission) weight(source string) int {
+	if ip := ipaddr.Parse(source); ip != nil {
+		for _, w := range f.weights {
+			if w.network.Contains(ip) {
+				return w.weight
+			}
+		}
+	}
+	return 1
+}
+
+// load is the number of clients of the source for its weight, counting n more
+func (f *fairAdmission) load(source string, n int) float64 {
+	return float64(f.active[source]+n) / float64(f.weight(source))
+}
+
+// admits reports whether a client from the source may take a free slot
+func (f *fairAdmission) admits(source string) bool {
+	if f.busy >= f.size {
+		return false
+	}
+	return f.active[source] == 0 || f.busy < f.size-f.reserved
+}
+
+func (f *fairAdmission) admit(clientID uint64, source string) {
+	f.busy++
+	f.active[source]++
+	f.lent[clientID] = source
+}
+
+// acquire blocks until the client gets a slot. It returns false if the client was turned away,
+// because the queue is full of clients from less busy sources, or the pool is shutting down
+func (f *fairAdmission) acquire(clientID uint64, source string) bool {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return false
+	}
+	if len(f.waiting) >= f.size && !f.admits(source) {
+		// the queue is full, make room by turning away the newest waiter of the busiest source
+		queued := make(map[string]int)
+		for _, w := range f.waiting {
+			queued[w.source]++
+		}
+		pending := func(source string) float64 {
+			return f.load(source, queued[source])
+		}
+		victim := 0
+		for i, w := range f.waiting {
+			if pending(w.source) >= pending(f.waiting[victim].source) {
+				victim = i
+			}
+		}
+		if pending(f.waiting[victim].source) <= f.load(source, queued[source]+1) {
+			f.mu.Unlock()
+			return false
+		}
+		f.waiting[victim].ready <- false
+		f.waiting = append(f.waiting[:victim], f.waiting[victim+1:]...)
+	}
+	w := &fairWaiter{clientID: clientID, source: source, ready: make(chan bool, 1)}
+	f.waiting = append(f.waiting, w)
+	f.dispatch()
+	f.mu.Unlock()
+	return <-w.ready
+}
+
+// release frees the client's slot and gives it to a waiting client
+func (f *fairAdmission) release(clientID uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	source, ok := f.lent[clientID]
+	if !ok {
+		return
+	}
+	delete(f.lent, clientID)
+	f.busy--
+	if f.active[source]--; f.active[source] <= 0 {
+		delete(f.active, source)
+	}
+	f.dispatch()
+}
+
+// dispatch admits waiting clients while there are free slots, the least busy sources first
+func (f *fairAdmission) dispatch() {
+	for !f.closed {
+		next := -1
+		for i, w := range f.waiting {
+			if f.admits(w.source) && (next == -1 || f.load(w.source, 0) < f.load(f.waiting[next].source, 0)) {
+				next = i
+			}
+		}
+		if next == -1 {
+			return
+		}
+		w := f.waiting[next]
+		f.waiting = append(f.waiting[:next], f.waiting[next+1:]...)
+		f.admit(w.clientID, w.source)
+		w.ready <- true
+	}
+}
+
+// shutdown turns away the waiting clients, and any that arrive until reopen is called
+func (f *fairAdmission) shutdown() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for _, w := range f.waiting {
+		w.ready <- false
+	}
+	f.waiting = nil
+}
+
+func (f *fairAdmission) reopen() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = false
+}
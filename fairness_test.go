@@ -0,0 +1,200 @@
+package guerrilla
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// waitFor starts acquiring a slot, and returns when the client is admitted or queued
+func waitFor(t *testing.T, f *fairAdmission, clientID uint64, source string) chan bool {
+	result := make(chan bool, 1)
+	go func() {
+		result <- f.acquire(clientID, source)
+	}()
+	for i := 0; i < 100; i++ {
+		f.mu.Lock()
+		_, lent := f.lent[clientID]
+		queued := false
+		for _, w := range f.waiting {
+			queued = queued || w.clientID == clientID
+		}
+		f.mu.Unlock()
+		if lent || queued {
+			return result
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("client", clientID, "was neither admitted nor queued")
+	return nil
+}
+
+func expectAdmission(t *testing.T, result chan bool, admitted bool, what string) {
+	select {
+	case ok := <-result:
+		if ok != admitted {
+			t.Error(what, "expected admitted to be", admitted)
+		}
+	case <-time.After(time.Second):
+		t.Error(what, "is still waiting")
+	}
+}
+
+func expectWaiting(t *testing.T, result chan bool, what string) {
+	select {
+	case ok := <-result:
+		t.Error(what, "expected to wait, got", ok)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestFairAdmission(t *testing.T) {
+	f, err := newFairAdmission(3, 1, []string{"192.0.2.0/24=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a busy source can't take the reserved slot
+	expectAdmission(t, waitFor(t, f, 1, "198.51.100.1"), true, "first client")
+	expectAdmission(t, waitFor(t, f, 2, "198.51.100.1"), true, "second client")
+	third := waitFor(t, f, 3, "198.51.100.1")
+	expectWaiting(t, third, "third client of a busy source")
+	expectAdmission(t, waitFor(t, f, 4, "203.0.113.1"), true, "client of a new source")
+
+	// a free slot goes to the source with the fewest clients for its weight
+	other := waitFor(t, f, 5, "192.0.2.1")
+	f.release(4)
+	expectAdmission(t, other, true, "new source, waiting after the busy one")
+	f.release(5)
+	expectWaiting(t, third, "third client, while the reserved slot is free")
+	f.release(1)
+	expectAdmission(t, third, true, "third client, once there's an unreserved slot")
+
+	f.release(2)
+	f.release(3)
+	if f.busy != 0 || len(f.active) != 0 || len(f.lent) != 0 {
+		t.Error("expected all the slots to be free, got", f.busy, f.active, f.lent)
+	}
+	f.release(3)
+	if f.busy != 0 {
+		t.Error("releasing twice should be ignored, got", f.busy)
+	}
+}
+
+func TestFairAdmissionQueue(t *testing.T) {
+	f, err := newFairAdmission(2, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAdmission(t, waitFor(t, f, 1, "198.51.100.1"), true, "first client")
+	expectAdmission(t, waitFor(t, f, 2, "198.51.100.1"), true, "second client")
+	waiting := []chan bool{waitFor(t, f, 3, "198.51.100.1"), waitFor(t, f, 4, "198.51.100.1")}
+	// the queue is full, the newest waiter of the busy source makes room
+	other := waitFor(t, f, 5, "203.0.113.1")
+	expectAdmission(t, waiting[1], false, "newest waiter of the busy source")
+	expectWaiting(t, waiting[0], "oldest waiter of the busy source")
+	// the busy source can't push out the other source
+	if f.acquire(6, "198.51.100.1") {
+		t.Error("expected another client of the busy source to be turned away")
+	}
+
+	f.release(1)
+	expectAdmission(t, other, true, "waiter of the other source")
+	f.shutdown()
+	expectAdmission(t, waiting[0], false, "waiter during the shutdown")
+	if f.acquire(7, "203.0.113.2") {
+		t.Error("expected no admission during the shutdown")
+	}
+	f.reopen()
+	f.release(2)
+	expectAdmission(t, waitFor(t, f, 8, "203.0.113.2"), true, "client after reopening")
+}
+
+func TestFairAdmissionConfig(t *testing.T) {
+	for _, weights := range [][]string{{"10.0.0.0/8"}, {"10.0.0.0/33=2"}, {"10.0.0.1=0"}, {"host=2"}} {
+		if _, err := newFairAdmission(10, 0, weights); err == nil {
+			t.Error("expected an error for the weights", weights)
+		}
+	}
+	if _, err := newFairAdmission(10, 10, nil); err == nil {
+		t.Error("expected an error when all the slots are reserved")
+	}
+	f, err := newFairAdmission(10, 2, []string{"10.0.0.1=3", "2001:db8::/32=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for source, weight := range map[string]int{"10.0.0.1": 3, "10.0.0.2": 1, "2001:db8::1": 5, "::1": 1} {
+		if w := f.weight(source); w != weight {
+			t.Error("expected the weight of", source, "to be", weight, "got", w)
+		}
+	}
+}
+
+func TestFairnessServer(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface:     "127.0.0.1:2526",
+		IsEnabled:           true,
+		MaxClients:          2,
+		FairnessOn:          true,
+		FairReservedClients: 1,
+	})
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	type session struct {
+		conn  net.Conn
+		greet chan string
+	}
+	connect := func(localIP string) *session {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+		conn, err := dialer.Dial("tcp", "127.0.0.1:2526")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &session{conn: conn, greet: make(chan string, 1)}
+		go func() {
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			s.greet <- line
+		}()
+		return s
+	}
+	greeted := func(s *session, wait time.Duration) bool {
+		select {
+		case line := <-s.greet:
+			if !strings.HasPrefix(line, "220") {
+				t.Error("expected a greeting, got", line)
+			}
+			return true
+		case <-time.After(wait):
+			return false
+		}
+	}
+
+	first := connect("127.0.0.1")
+	if !greeted(first, time.Second) {
+		t.Fatal("expected the first client to be served")
+	}
+	// the second slot is reserved for other sources
+	second := connect("127.0.0.1")
+	if greeted(second, time.Millisecond*200) {
+		t.Error("expected the second client of the source to wait")
+	}
+	other := connect("127.0.0.2")
+	if !greeted(other, time.Second) {
+		t.Error("expected the client of another source to be served")
+	}
+	_ = first.conn.Close()
+	_ = other.conn.Close()
+	if !greeted(second, time.Second*2) {
+		t.Error("expected the waiting client to be served once the others left")
+	}
+	_ = second.conn.Close()
+}
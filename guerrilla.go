@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/artpar/go-guerrilla/authenticators"
+	"net/http"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -49,6 +50,25 @@ type guerrilla struct {
 	Config        AppConfig
 	servers       map[string]*server
 	authenticator authenticators.AuthenticatorCreator
+	// tenants are shared by all servers
+	tenants *tenants
+	// histograms of the traffic of all servers
+	histograms *histograms
+	// daily counts the messages of all servers by day and recipient domain
+	daily *dailyStats
+	// console has the snapshots of the clients of all servers for the debug consoles
+	console *consoleState
+	// commands are the custom SMTP commands of all servers
+	commands *commands
+	// adminHandlers are the endpoints of the admin API
+	adminHandlers *adminHandlers
+	// statsStop stops saving the statistics, statsDone is closed once it stopped
+	statsStop chan struct{}
+	statsDone chan struct{}
+	// admin is the admin API server, nil when not running
+	admin *http.Server
+	// certs checks the expiry of the TLS certificates, nil when not running
+	certs *certMonitor
 	// guard controls access to g.servers
 	guard sync.Mutex
 	state int8
@@ -83,12 +103,24 @@ func (ls *logStore) setMainlog(log log.Logger) {
 }
 
 // Returns a new instance of Guerrilla with the given config, not yet running. Backend started.
+// If a is nil, authenticators.NewAuthenticator is used, which checks the credentials of the auth_* options
+// of the backend config, or turns AUTH off when there are none.
 func New(ac *AppConfig, b backends.Backend, a authenticators.AuthenticatorCreator, l log.Logger) (Guerrilla, error) {
+	if a == nil {
+		a = authenticators.NewAuthenticator
+	}
 	g := &guerrilla{
 		Config:        *ac, // take a local copy
 		servers:       make(map[string]*server, len(ac.Servers)),
 		authenticator: a,
+		tenants:       newTenants(),
+		histograms:    newHistograms(),
+		daily:         newDailyStats(),
+		console:       newConsoleState(),
+		commands:      newCommands(),
 	}
+	g.adminHandlers = g.newAdminHandlers()
+	g.tenants.configure(ac.Tenants)
 	g.backendStore.Store(b)
 	g.setMainlog(l)
 
@@ -99,6 +131,9 @@ func New(ac *AppConfig, b backends.Backend, a authenticators.AuthenticatorCreato
 			}
 		}
 	}
+	if err := g.loadStats(); err != nil {
+		g.mainlog().WithError(err).Error("could not restore the statistics")
+	}
 	// Write the process id (pid) to a file
 	// we should still be able to continue even if we can't write the pid, error will be logged by writePid()
 	_ = g.writePid()
@@ -144,6 +179,11 @@ func (g *guerrilla) makeServers() error {
 			if server != nil {
 				g.servers[sc.ListenInterface] = server
 				server.setAllowedHosts(g.Config.AllowedHosts)
+				server.tenants = g.tenants
+				server.histograms = g.histograms
+				server.daily = g.daily
+				server.console = g.console
+				server.commands = g.commands
 			}
 		}
 	}
@@ -189,6 +229,16 @@ func (g *guerrilla) setServerConfig(sc *ServerConfig) {
 	}
 }
 
+// setCommands replaces the custom SMTP commands of the servers, before they're started
+func (g *guerrilla) setCommands(c *commands) {
+	g.guard.Lock()
+	defer g.guard.Unlock()
+	g.commands = c
+	for _, server := range g.servers {
+		server.commands = c
+	}
+}
+
 // mapServers calls a callback on each server in g.servers map
 // It locks the g.servers map before mapping
 func (g *guerrilla) mapServers(callback func(*server)) map[string]*server {
@@ -216,6 +266,12 @@ func (g *guerrilla) subscribeEvents() {
 		g.mainlog().Infof("allowed_hosts config changed, a new list was set")
 	})
 
+	// tenants changed, they are shared by all servers
+	events[EventConfigTenants] = daemonEvent(func(c *AppConfig) {
+		g.tenants.configure(c.Tenants)
+		g.mainlog().Infof("tenants config changed, %d tenants set", len(c.Tenants))
+	})
+
 	// the main log file changed
 	events[EventConfigLogFile] = daemonEvent(func(c *AppConfig) {
 		var err error
@@ -291,7 +347,7 @@ func (g *guerrilla) subscribeEvents() {
 	// start a server that already exists in the config and has been enabled
 	events[EventConfigServerStart] = serverEvent(func(sc *ServerConfig) {
 		if server, err := g.findServer(sc.ListenInterface); err == nil {
-			if server.state == ServerStateStopped || server.state == ServerStateNew {
+			if server.getState() == ServerStateStopped || server.getState() == ServerStateNew {
 				g.mainlog().Infof("Starting server [%s]", server.listenInterface)
 				err := g.Start()
 				if err != nil {
@@ -304,7 +360,7 @@ func (g *guerrilla) subscribeEvents() {
 	// stop running a server
 	events[EventConfigServerStop] = serverEvent(func(sc *ServerConfig) {
 		if server, err := g.findServer(sc.ListenInterface); err == nil {
-			if server.state == ServerStateRunning {
+			if server.getState() == ServerStateRunning {
 				server.Shutdown()
 				g.mainlog().Infof("Server [%s] stopped.", sc.ListenInterface)
 			}
@@ -468,8 +524,8 @@ func (g *guerrilla) Start() error {
 			// not enabled
 			continue
 		}
-		if g.servers[ListenInterface].state != ServerStateNew &&
-			g.servers[ListenInterface].state != ServerStateStopped {
+		if g.servers[ListenInterface].getState() != ServerStateNew &&
+			g.servers[ListenInterface].getState() != ServerStateStopped {
 			continue
 		}
 		startWG.Add(1)
@@ -490,17 +546,48 @@ func (g *guerrilla) Start() error {
 			startErrors = append(startErrors, err)
 		}
 	}
+	if err := g.startAdmin(); err != nil {
+		startErrors = append(startErrors, err)
+	}
+	if err := g.startCertMonitor(); err != nil {
+		startErrors = append(startErrors, err)
+	}
+	if err := g.startStatsSaver(); err != nil {
+		startErrors = append(startErrors, err)
+	}
 	if len(startErrors) > 0 {
 		return startErrors
 	}
 	return nil
 }
 
+// startServer starts a single server that was stopped, eg. by draining it, while the others
+// keep running
+func (g *guerrilla) startServer(s *server) error {
+	if s.getState() != ServerStateNew && s.getState() != ServerStateStopped {
+		return fmt.Errorf("server [%s] is not stopped", s.listenInterface)
+	}
+	errs := make(chan error, 1)
+	var startWG sync.WaitGroup
+	startWG.Add(1)
+	go func() {
+		g.mainlog().Infof("Starting: %s", s.listenInterface)
+		if err := s.Start(&startWG); err != nil {
+			errs <- err
+		}
+	}()
+	startWG.Wait()
+	if s.getState() == ServerStateStartError {
+		return <-errs
+	}
+	return nil
+}
+
 func (g *guerrilla) Shutdown() {
 
 	// shut down the servers first
 	g.mapServers(func(s *server) {
-		if s.state == ServerStateRunning {
+		if s.getState() == ServerStateRunning {
 			s.Shutdown()
 			g.mainlog().Infof("shutdown completed for [%s]", s.listenInterface)
 		}
@@ -511,6 +598,9 @@ func (g *guerrilla) Shutdown() {
 		g.state = daemonStateStopped
 		defer g.guard.Unlock()
 	}()
+	g.stopAdmin()
+	g.stopCertMonitor()
+	g.stopStatsSaver()
 	if err := g.backend().Shutdown(); err != nil {
 		g.mainlog().WithError(err).Warn("Backend failed to shutdown")
 	} else {
@@ -0,0 +1,145 @@
+package guerrilla
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// defaultImportMaxSize limits an imported message when no server has a max_size
+const defaultImportMaxSize = 10485760
+
+// importClientID numbers the imported messages, for their queued ids
+var importClientID uint64
+
+// ImportResult is the reply of the /import admin API
+type ImportResult struct {
+	QueuedId string `json:"queued_id"`
+	Code     int    `json:"code"`
+	Result   string `json:"result"`
+}
+
+// adminImport sends a message through a processor chain again, eg. to reprocess stored mail after
+// fixing a broken backend. POST /import?chain=<name>&from=<sender>&to=<rcpt>,<rcpt> with the message
+// as the body. The sender and recipients default to the Return-Path and Delivered-To headers,
+// and the chain defaults to the save_process chain
+func (g *guerrilla) adminImport(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	cp, ok := g.backend().(backends.ChainProcessor)
+	if !ok {
+		writeAdminError(w, http.StatusNotImplemented, "the backend cannot process with a chain")
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, g.importMaxSize()))
+	if err != nil {
+		writeAdminError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	// stored like the DATA command does, with LF line endings
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	params := r.URL.Query()
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	e := mail.NewEnvelope(host, atomic.AddUint64(&importClientID, 1))
+	e.Helo = "import"
+	from := params.Get("from")
+	if from == "" {
+		from = backends.HeaderAddress(data, "Return-Path")
+	}
+	if from == "" {
+		e.MailFrom = mail.Address{NullPath: true}
+	} else if addr, err := mail.NewAddress(from); err == nil {
+		e.MailFrom = *addr
+	} else {
+		writeAdminError(w, http.StatusBadRequest, "bad sender: "+err.Error())
+		return
+	}
+	to := params.Get("to")
+	if to == "" {
+		to = backends.HeaderAddress(data, "Delivered-To")
+	}
+	for _, rcpt := range strings.Split(to, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt == "" {
+			continue
+		}
+		addr, err := mail.NewAddress(rcpt)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "bad recipient: "+err.Error())
+			return
+		}
+		e.PushRcpt(*addr)
+	}
+	if len(e.RcptTo) == 0 {
+		writeAdminError(w, http.StatusBadRequest, "the to parameter is required, the message has no Delivered-To header")
+		return
+	}
+
+	// the recipients' domains decide the tenant, like for the RCPT command.
+	// Only the admin token may name one for other domains
+	if tenant == "" {
+		e.Tenant = params.Get("tenant")
+	}
+	for i := range e.RcptTo {
+		if t := g.tenants.forDomain(e.RcptTo[i].Host); t != nil {
+			if i > 0 && t.Name != e.Tenant {
+				writeAdminError(w, http.StatusBadRequest, "the recipients belong to different tenants")
+				return
+			}
+			e.Tenant = t.Name
+		}
+	}
+	if tenant != "" && e.Tenant != tenant {
+		writeAdminError(w, http.StatusForbidden, "the recipients do not belong to the tenant")
+		return
+	}
+	if e.Tenant != "" {
+		e.Tags.Add("tenant", e.Tenant)
+	}
+	e.Data.Write(data)
+	e.Values["listen_interface"] = "import"
+
+	received := time.Now()
+	res := cp.ProcessChain(e, params.Get("chain"))
+	backends.TrackDeliveryAt(e, backends.DeliveryReceived, "import", received)
+	code := http.StatusOK
+	if res.Code() < 300 {
+		backends.TrackDelivery(e, backends.DeliveryQueued, res.String())
+		if n, ok := cp.(backends.DeliveryNotifier); ok {
+			n.Notify(e)
+		}
+	} else {
+		backends.TrackDelivery(e, backends.DeliveryRejected, res.String())
+		code = http.StatusUnprocessableEntity
+	}
+	g.mainlog().Infof("imported %s through the %q chain: %s", e.QueuedId, params.Get("chain"), res)
+	writeAdminJSON(w, code, ImportResult{QueuedId: e.QueuedId, Code: res.Code(), Result: res.String()})
+}
+
+// importMaxSize is the largest max_size of the servers
+func (g *guerrilla) importMaxSize() int64 {
+	g.guard.Lock()
+	defer g.guard.Unlock()
+	var size int64
+	for i := range g.Config.Servers {
+		if g.Config.Servers[i].MaxSize > size {
+			size = g.Config.Servers[i].MaxSize
+		}
+	}
+	if size == 0 {
+		return defaultImportMaxSize
+	}
+	return size
+}
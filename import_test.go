@@ -0,0 +1,87 @@
+package guerrilla
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestAdminImport(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"acme.com", "globex.com"},
+		Tenants: []TenantConfig{
+			{Name: "acme", Domains: []string{"acme.com"}, AdminToken: "acme-secret"},
+			{Name: "globex", Domains: []string{"globex.com"}, AdminToken: "globex-secret"},
+		},
+		Admin: AdminConfig{ListenInterface: "127.0.0.1:2580", Token: "secret"},
+	}
+	cfg.BackendConfig = backends.BackendConfig{
+		"save_process":           "HeadersParser|Debugger",
+		"process_chains":         []string{"reprocess=HeadersParser|Header|Debugger"},
+		"delivery_tracking_size": 100,
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+	// the kept-alive connections to the admin servers of the other tests are closed
+	http.DefaultClient.CloseIdleConnections()
+
+	message := "Return-Path: <test@example.com>\r\nDelivered-To: a@acme.com\r\n" +
+		"Message-ID: <import@example.com>\r\nSubject: Test\r\n\r\nHello\r\n"
+	post := func(query, token string) (int, ImportResult) {
+		req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:2580/import?"+query, strings.NewReader(message))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var res ImportResult
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusUnprocessableEntity {
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Error(err)
+			}
+		}
+		return resp.StatusCode, res
+	}
+
+	for _, query := range []string{"", "chain=reprocess", "chain=reprocess&from=other@example.com&to=b@acme.com"} {
+		if code, res := post(query, "acme-secret"); code != http.StatusOK || res.Code != 250 || res.QueuedId == "" {
+			t.Error("expected", query, "to be imported, got", code, res)
+		}
+	}
+	if code, res := post("chain=unknown", "secret"); code != http.StatusUnprocessableEntity || res.Code < 500 {
+		t.Error("expected an unknown chain to fail, got", code, res)
+	}
+	// the recipients belong to acme
+	if code, _ := post("", "globex-secret"); code != http.StatusForbidden {
+		t.Error("expected 403 for another tenant, got", code)
+	}
+	if code, _ := post("to=a@globex.com", "acme-secret"); code != http.StatusForbidden {
+		t.Error("expected 403 for another tenant's recipient, got", code)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:2580/import", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Error(err)
+	} else {
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Error("expected 405 for GET, got", resp.StatusCode)
+		}
+	}
+
+	if records := backends.Deliveries.Lookup("import@example.com"); len(records) < 3 {
+		t.Error("expected the imported messages to be tracked, got", records)
+	}
+}
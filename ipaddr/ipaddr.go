@@ -0,0 +1,88 @@
+// Package ipaddr parses the addresses of clients, and stores them in the ip_addr columns
+package ipaddr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Parse parses an address as it's written in the session: "192.0.2.1", "2001:db8::1", an address
+// literal such as "[IPv6:2001:db8::1]", XCLIENT's "IPV6:2001:db8::1", or a link-local address
+// with its zone, eg. "fe80::1%eth0", whose zone is dropped. It returns nil when s isn't an address
+func Parse(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if len(s) > 5 && strings.EqualFold(s[:5], "ipv6:") {
+		s = s[5:]
+	}
+	if i := strings.LastIndex(s, "%"); i > 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// Bytes returns the 16 bytes that store the address, where an IPv4 address is IPv4-mapped
+// (::ffff:192.0.2.1), so that all addresses have the same length and sort by their value.
+// It's empty, not nil, when s isn't an address, eg. a client of a unix socket, so that the
+// NOT NULL columns take it
+func Bytes(s string) []byte {
+	ip := Parse(s)
+	if ip == nil {
+		return []byte{}
+	}
+	return []byte(ip.To16())
+}
+
+// FromBytes decodes an address stored by Bytes. It also reads the addresses stored as big
+// integers by older versions, where IPv4 addresses took 4 bytes and the leading zero bytes
+// were dropped: up to 4 bytes are an IPv4 address, and up to 16 bytes are an IPv6 address
+func FromBytes(b []byte) (net.IP, error) {
+	switch {
+	case len(b) == net.IPv6len:
+		return net.IP(append([]byte(nil), b...)), nil
+	case len(b) == 0:
+		return nil, errors.New("no address")
+	case len(b) <= net.IPv4len:
+		ip := make(net.IP, net.IPv4len)
+		copy(ip[net.IPv4len-len(b):], b)
+		return ip.To16(), nil
+	case len(b) < net.IPv6len:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip[net.IPv6len-len(b):], b)
+		return ip, nil
+	}
+	return nil, fmt.Errorf("%d bytes are too many for an address", len(b))
+}
+
+// String decodes an address stored by Bytes to its text form, "" when b isn't an address
+func String(b []byte) string {
+	ip, err := FromBytes(b)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Network parses a network in the CIDR notation, or an address, which is a network of its own
+func Network(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := Parse(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
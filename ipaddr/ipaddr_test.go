@@ -0,0 +1,95 @@
+package ipaddr
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]string{
+		"192.0.2.1":                 "192.0.2.1",
+		" 192.0.2.1 ":               "192.0.2.1",
+		"::1":                       "::1",
+		"2001:db8:0:0:1:0:0:1":      "2001:db8::1:0:0:1",
+		"[IPv6:2001:db8::1]":        "2001:db8::1",
+		"IPV6:2001:db8::1":          "2001:db8::1",
+		"[192.0.2.1]":               "192.0.2.1",
+		"fe80::1%eth0":              "fe80::1",
+		"::ffff:192.0.2.1":          "192.0.2.1",
+		"2001:db8::192.0.2.1":       "2001:db8::c000:201",
+		"example.com":               "<nil>",
+		"":                          "<nil>",
+		"IPv6:":                     "<nil>",
+		"2001:db8::1::1":            "<nil>",
+		"[IPv6:2001:db8::1%eth0]":   "2001:db8::1",
+		"2001:0DB8:0000::0000:0001": "2001:db8::1",
+	} {
+		if got := Parse(s).String(); got != want {
+			t.Errorf("Parse(%q) = %s, expected %s", s, got, want)
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+	for _, s := range []string{"192.0.2.1", "0.0.0.1", "::1", "::", "2001:db8::1", "fe80::1%eth0", "::ffff:10.0.0.1"} {
+		b := Bytes(s)
+		if len(b) != net.IPv6len {
+			t.Errorf("expected 16 bytes for %s, got %d", s, len(b))
+			continue
+		}
+		if got := String(b); got != Parse(s).String() {
+			t.Errorf("expected %s to decode to %s, got %s", s, Parse(s), got)
+		}
+	}
+	if b := Bytes("192.0.2.1"); !bytes.Equal(b, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1}) {
+		t.Error("expected an IPv4-mapped address, got", b)
+	}
+	if b := Bytes("unix"); b == nil || len(b) != 0 {
+		t.Error("expected no bytes for a non-address, got", b)
+	}
+
+	// the big integers of the older versions
+	for b, want := range map[string]string{
+		string([]byte{192, 0, 2, 1}):                  "192.0.2.1",
+		string([]byte{1}):                             "0.0.0.1",
+		string(net.ParseIP("2001:db8::1").To16()):     "2001:db8::1",
+		string(net.ParseIP("::1:0:0:0:1").To16()[6:]): "::1:0:0:0:1",
+	} {
+		if got := String([]byte(b)); got != want {
+			t.Errorf("expected %v to decode to %s, got %s", []byte(b), want, got)
+		}
+	}
+	if _, err := FromBytes(nil); err == nil {
+		t.Error("expected no bytes to be refused")
+	}
+	if got := String(make([]byte, 17)); got != "" {
+		t.Error("expected 17 bytes to be refused, got", got)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	for s, want := range map[string]string{
+		"192.0.2.1":          "192.0.2.1/32",
+		"192.0.2.0/24":       "192.0.2.0/24",
+		"192.0.2.7/24":       "192.0.2.0/24",
+		"2001:db8::1":        "2001:db8::1/128",
+		"[IPv6:2001:db8::1]": "2001:db8::1/128",
+		"2001:db8::/32":      "2001:db8::/32",
+		" ::ffff:10.0.0.1 ":  "10.0.0.1/32",
+	} {
+		n, err := Network(s)
+		if err != nil || n.String() != want {
+			t.Errorf("Network(%q) = %v, %v, expected %s", s, n, err, want)
+		}
+	}
+	n, _ := Network("192.0.2.1")
+	if !n.Contains(Parse("::ffff:192.0.2.1")) || n.Contains(Parse("192.0.2.2")) {
+		t.Error("expected the network of an address to contain only the address")
+	}
+	for _, s := range []string{"", "example.com", "192.0.2.0/33", "2001:db8::/129"} {
+		if _, err := Network(s); err == nil {
+			t.Errorf("expected %q to be refused", s)
+		}
+	}
+}
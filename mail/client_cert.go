@@ -0,0 +1,66 @@
+package mail
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"path"
+	"strings"
+)
+
+// ClientCert is the identity of the certificate that the client presented in the TLS handshake,
+// once the server verified it. Processors can use it to authorize relaying, like AuthorizedLogin
+type ClientCert struct {
+	// Subject is the distinguished name of the subject, eg. "CN=relay.example.com,O=Example"
+	Subject    string
+	CommonName string
+	// DNSNames, EmailAddresses and URIs are the subject alternative names
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	Issuer         string
+	// SerialNumber is in decimal
+	SerialNumber string
+	// Fingerprint is the hex of the SHA-256 digest of the certificate
+	Fingerprint string
+}
+
+// NewClientCert returns the identity of the certificate
+func NewClientCert(cert *x509.Certificate) *ClientCert {
+	sum := sha256.Sum256(cert.Raw)
+	c := &ClientCert{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Issuer:         cert.Issuer.String(),
+		SerialNumber:   cert.SerialNumber.String(),
+		Fingerprint:    hex.EncodeToString(sum[:]),
+	}
+	for _, u := range cert.URIs {
+		c.URIs = append(c.URIs, u.String())
+	}
+	return c
+}
+
+// Matches returns true if the pattern matches the common name or a subject alternative name.
+// The pattern is a glob, where * matches any characters but /, eg. "*.example.com",
+// "*@example.com" or "spiffe://example.com/mail/*". Case is ignored
+func (c *ClientCert) Matches(pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	match := func(name string) bool {
+		ok, _ := path.Match(pattern, strings.ToLower(name))
+		return ok
+	}
+	if c.CommonName != "" && match(c.CommonName) {
+		return true
+	}
+	for _, names := range [][]string{c.DNSNames, c.EmailAddresses, c.URIs} {
+		for _, name := range names {
+			if match(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
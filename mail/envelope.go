@@ -1,7 +1,6 @@
 package mail
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/md5"
 	"errors"
@@ -10,6 +9,7 @@ import (
 	"mime"
 	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -47,6 +47,8 @@ type Address struct {
 	Quoted bool
 	// IP stores the IP Address, if the Host is an IP
 	IP net.IP
+	// Literal is true if the Host is an address-literal, eg. [192.0.2.1] or [tag:value]
+	Literal bool
 	// DisplayName is a label before the address (RFC5322)
 	DisplayName string
 	// DisplayNameQuoted is true when DisplayName was quoted
@@ -77,7 +79,7 @@ func (a *Address) String() string {
 		local = a.User
 	}
 	if a.Host != "" {
-		if a.IP != nil {
+		if a.IP != nil || a.Literal {
 			return fmt.Sprintf("%s@[%s]", local, a.Host)
 		}
 		return fmt.Sprintf("%s@%s", local, a.Host)
@@ -113,6 +115,7 @@ func NewAddress(str string) (*Address, error) {
 	a.Quoted = addr.LocalPartQuoted
 	a.Host = addr.Domain
 	a.IP = addr.IP
+	a.Literal = addr.Literal
 	a.DisplayName = addr.DisplayName
 	a.DisplayNameQuoted = addr.DisplayNameQuoted
 	a.NullPath = addr.NullPath
@@ -123,6 +126,8 @@ func NewAddress(str string) (*Address, error) {
 type Envelope struct {
 	// Remote IP address
 	RemoteIP string
+	// RemotePort is the client's TCP port, 0 if unknown
+	RemotePort int
 	// Message sent in EHLO command
 	Helo string
 	// Sender
@@ -135,12 +140,21 @@ type Envelope struct {
 	Subject string
 	// TLS is true if the email was received using a TLS connection
 	TLS bool
-	// Header stores the results from ParseHeaders()
+	// Header stores the results from ParseHeaders(), by canonical name
 	Header textproto.MIMEHeader
+	// HeaderIndex has the same fields as Header in the order they're in the email, set by
+	// ParseHeaders(). Nil until then
+	HeaderIndex *Header
 	// Values hold the values generated when processing the envelope by the backend
 	Values map[string]interface{}
+	// Session holds the values of the connection, kept for all its transactions
+	Session *Session
 	// Hashes of each email on the rcpt
 	Hashes []string
+	// HashAlgorithm is the name of the algorithm used for BodyHash and Hashes, eg. "sha256"
+	HashAlgorithm string
+	// BodyHash is the digest of Data, computed while it was received. Nil if not computed
+	BodyHash []byte
 	// additional delivery header that may be added
 	DeliveryHeader string
 	// Email(s) will be queued with this id
@@ -151,18 +165,33 @@ type Envelope struct {
 	sync.Mutex
 	// to determine user
 	AuthorizedLogin string
+	// ClientCert is the identity of the client's verified TLS certificate, nil if it presented none
+	ClientCert *ClientCert
+	// Size is the message size declared with the SIZE parameter of MAIL FROM (RFC 1870), 0 if not given
+	Size int64
+	// Tenant is the name of the tenant that the recipients belong to, empty if none
+	Tenant string
+	// Deadline, when not zero, is when processing of the email must finish.
+	// Set by the backend when it has a processing time budget
+	Deadline time.Time
+	// Tags are labels added by processors, eg. "dkim:pass". Storage processors save them with the email
+	Tags Tags
+	// MaxSize, when not 0, limits the size of the message for this transaction.
+	// Recipient validation processors may lower it with LimitSize, eg. to apply a quota
+	MaxSize int64
 }
 
 func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
 	return &Envelope{
 		RemoteIP: remoteAddr,
 		Values:   make(map[string]interface{}),
+		Session:  NewSession(),
 		QueuedId: queuedID(clientID),
 	}
 }
 
 func queuedID(clientID uint64) string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(string(time.Now().Unix())+string(clientID))))
+	return fmt.Sprintf("%x", md5.Sum([]byte(strconv.FormatInt(time.Now().Unix(), 10)+strconv.FormatUint(clientID, 10))))
 }
 
 // ParseHeaders parses the headers into Header field of the Envelope struct.
@@ -171,7 +200,7 @@ func queuedID(clientID uint64) string {
 // Decoding of encoding to UTF is only done on the Subject, where the result is assigned to the Subject field
 func (e *Envelope) ParseHeaders() error {
 	var err error
-	if e.Header != nil {
+	if e.Header != nil || e.HeaderIndex != nil {
 		return errors.New("headers already parsed")
 	}
 	buf := e.Data.Bytes()
@@ -182,14 +211,11 @@ func (e *Envelope) ParseHeaders() error {
 
 	headerEnd := bytes.Index(buf, []byte{'\n', '\n'}) // the first two new-lines chars are the End Of Header
 	if headerEnd > -1 {
-		header := buf[0 : headerEnd+2]
-		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewBuffer(header)))
-		e.Header, err = headerReader.ReadMIMEHeader()
-		if err == nil || err == io.EOF {
-			// decode the subject
-			if subject, ok := e.Header["Subject"]; ok {
-				e.Subject = MimeHeaderDecode(subject[0])
-			}
+		e.HeaderIndex, err = ParseHeader(buf[0 : headerEnd+2])
+		e.Header = e.HeaderIndex.MIMEHeader()
+		// decode the subject
+		if subject := e.HeaderIndex.Get("Subject"); subject != "" {
+			e.Subject = MimeHeaderDecode(subject)
 		}
 	} else {
 		err = errors.New("header not found")
@@ -232,18 +258,87 @@ func (e *Envelope) ResetTransaction() {
 	// todo: these are probably good candidates for buffers / use sync.Pool (after profiling)
 	e.Subject = ""
 	e.Header = nil
+	e.HeaderIndex = nil
 	e.Hashes = make([]string, 0)
 	e.DeliveryHeader = ""
 	e.Values = make(map[string]interface{})
+	e.Size = 0
+	e.MaxSize = 0
+	e.HashAlgorithm = ""
+	e.BodyHash = nil
+	e.Tenant = ""
+	e.Tags = nil
+	e.Deadline = time.Time{}
+}
+
+// LimitSize lowers MaxSize to n, unless there already is a lower limit
+func (e *Envelope) LimitSize(n int64) {
+	if e.MaxSize == 0 || n < e.MaxSize {
+		e.MaxSize = n
+	}
 }
 
 // Reseed is called when used with a new connection, once it's accepted
 func (e *Envelope) Reseed(remoteIP string, clientID uint64) {
 	e.RemoteIP = remoteIP
+	e.RemotePort = 0
 	e.QueuedId = queuedID(clientID)
 	e.Helo = ""
 	e.TLS = false
 	e.ESMTP = false
+	e.AuthorizedLogin = ""
+	e.ClientCert = nil
+	// a new session, the clones of the previous connection's envelope may still use the old one
+	e.Session = NewSession()
+	// the previous connection may have left in the middle of a transaction
+	e.ResetTransaction()
+}
+
+// Clone returns a copy of the envelope that can be processed after the envelope is reset, eg.
+// in the background. The values of e.Values are shared, the map and the rest are copied, and the Session
+// is shared
+func (e *Envelope) Clone() *Envelope {
+	c := &Envelope{
+		RemoteIP:        e.RemoteIP,
+		RemotePort:      e.RemotePort,
+		Helo:            e.Helo,
+		MailFrom:        e.MailFrom,
+		RcptTo:          append([]Address(nil), e.RcptTo...),
+		Subject:         e.Subject,
+		TLS:             e.TLS,
+		Values:          make(map[string]interface{}, len(e.Values)),
+		Session:         e.Session,
+		Hashes:          append([]string(nil), e.Hashes...),
+		HashAlgorithm:   e.HashAlgorithm,
+		BodyHash:        append([]byte(nil), e.BodyHash...),
+		DeliveryHeader:  e.DeliveryHeader,
+		QueuedId:        e.QueuedId,
+		ESMTP:           e.ESMTP,
+		AuthorizedLogin: e.AuthorizedLogin,
+		ClientCert:      e.ClientCert,
+		Size:            e.Size,
+		Tenant:          e.Tenant,
+		Deadline:        e.Deadline,
+		Tags:            append(Tags(nil), e.Tags...),
+		MaxSize:         e.MaxSize,
+	}
+	c.Data.Write(e.Data.Bytes())
+	for k, v := range e.Values {
+		c.Values[k] = v
+	}
+	if e.Header != nil {
+		c.Header = make(textproto.MIMEHeader, len(e.Header))
+		for k, v := range e.Header {
+			c.Header[k] = append([]string(nil), v...)
+		}
+	}
+	if e.HeaderIndex != nil {
+		c.HeaderIndex = NewHeader()
+		for _, f := range e.HeaderIndex.Fields() {
+			c.HeaderIndex.Add(f.Name, f.Value)
+		}
+	}
+	return c
 }
 
 // PushRcpt adds a recipient email address to the envelope
@@ -94,6 +94,17 @@ func TestAddressWithIP(t *testing.T) {
 	}
 }
 
+func TestAddressWithGeneralLiteral(t *testing.T) {
+	addr, err := NewAddress("<test@[x-tag:some.host]>")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	} else if !addr.Literal || addr.IP != nil {
+		t.Error("expecting the address host to be a literal, and not an IP")
+	} else if addr.String() != "test@[x-tag:some.host]" {
+		t.Error("expecting test@[x-tag:some.host], got", addr.String())
+	}
+}
+
 func TestEnvelope(t *testing.T) {
 	e := NewEnvelope("127.0.0.1", 22)
 
@@ -126,6 +137,10 @@ func TestEnvelope(t *testing.T) {
 	if e.Subject != "Test" {
 		t.Error("Subject expecting: Test, got:", e.Subject)
 	}
+	// the map and the index have the same fields
+	if e.Header.Get("subject") != "Test" || e.HeaderIndex.Len() != 1 || e.HeaderIndex.Fields()[0].Name != "Subject" {
+		t.Error("expected the header to be parsed into Header and HeaderIndex, got", e.Header, e.HeaderIndex)
+	}
 
 }
 
@@ -146,3 +161,51 @@ func TestEncodedWordAhead(t *testing.T) {
 	}
 
 }
+
+func TestEnvelopeLimitSize(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.LimitSize(1000)
+	e.LimitSize(2000)
+	if e.MaxSize != 1000 {
+		t.Error("expected MaxSize to be 1000, got", e.MaxSize)
+	}
+	e.LimitSize(500)
+	if e.MaxSize != 500 {
+		t.Error("expected MaxSize to be 500, got", e.MaxSize)
+	}
+	e.ResetTransaction()
+	if e.MaxSize != 0 {
+		t.Error("expected MaxSize to be reset, got", e.MaxSize)
+	}
+}
+
+func TestEnvelopeClone(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	to, _ := NewAddress("test@example.com")
+	e.PushRcpt(*to)
+	e.Data.WriteString("Subject: hello\n\nbody\n")
+	if err := e.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	e.Values["key"] = "value"
+	e.Tags.Add("dkim", "pass")
+	c := e.Clone()
+	e.ResetTransaction()
+	if c.Data.String() != "Subject: hello\n\nbody\n" || c.Subject != "hello" || c.Header.Get("Subject") != "hello" {
+		t.Error("expected the message to be copied, got", c.Data.String())
+	}
+	if len(c.RcptTo) != 1 || c.RcptTo[0].String() != "test@example.com" {
+		t.Error("expected the recipient to be copied, got", c.RcptTo)
+	}
+	if c.Values["key"] != "value" || !c.Tags.Has("dkim") || c.QueuedId != e.QueuedId {
+		t.Error("expected the values, tags and queued id to be copied")
+	}
+	c.Header.Add("X-Copy", "1")
+	c.HeaderIndex.Add("X-Copy", "1")
+	c.Values["copy"] = true
+	e.Data.WriteString("Subject: other\n\n")
+	_ = e.ParseHeaders()
+	if e.Header.Get("X-Copy") != "" || e.HeaderIndex.Has("X-Copy") || e.Values["copy"] != nil {
+		t.Error("expected the copy not to change the envelope")
+	}
+}
@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"lukechampine.com/blake3"
+)
+
+// hashes is a registry of hash algorithms that can be selected by name
+var hashes = struct {
+	m map[string]func() hash.Hash
+	sync.RWMutex
+}{m: map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash {
+		return blake3.New(32, nil)
+	},
+}}
+
+// RegisterHash makes a hash algorithm available to NewHash, under the given name.
+// Names are case-insensitive. An existing algorithm with the same name is replaced.
+func RegisterHash(name string, f func() hash.Hash) {
+	hashes.Lock()
+	defer hashes.Unlock()
+	hashes.m[strings.ToLower(name)] = f
+}
+
+// NewHash returns a new hash.Hash for the named algorithm, eg. "sha256" or "blake3"
+func NewHash(name string) (hash.Hash, error) {
+	hashes.RLock()
+	defer hashes.RUnlock()
+	if f, ok := hashes.m[strings.ToLower(name)]; ok {
+		return f(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm: %s", name)
+}
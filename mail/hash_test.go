@@ -0,0 +1,28 @@
+package mail
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func TestNewHash(t *testing.T) {
+	h, err := NewHash("SHA256")
+	if err != nil {
+		t.Fatal("error not expected", err)
+	}
+	_, _ = h.Write([]byte("hello"))
+	if fmt.Sprintf("%x", h.Sum(nil)) != fmt.Sprintf("%x", sha256.Sum256([]byte("hello"))) {
+		t.Error("sha256 digest mismatch")
+	}
+	if _, err := NewHash("blake3"); err != nil {
+		t.Error("error not expected", err)
+	}
+	if _, err := NewHash("crc0"); err == nil {
+		t.Error("error expected for unknown algorithm")
+	}
+	RegisterHash("crc0", sha256.New)
+	if _, err := NewHash("crc0"); err != nil {
+		t.Error("error not expected after RegisterHash", err)
+	}
+}
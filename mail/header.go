@@ -0,0 +1,168 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"net/textproto"
+	"strings"
+)
+
+var errMalformedHeader = errors.New("malformed header line")
+
+// HeaderField is a field of a header, with its value unfolded and trimmed
+type HeaderField struct {
+	// Name is the name as it's in the email
+	Name  string
+	Value string
+}
+
+// Header is the header of an email, parsed once and indexed by name. The fields keep the order
+// they're in the email, duplicates included, and names are looked up case-insensitively.
+// A nil *Header is an empty header that can be read, eg. before the headers are parsed
+type Header struct {
+	fields []HeaderField
+	// index has the positions of the fields, by their canonical name
+	index map[string][]int
+}
+
+// NewHeader returns an empty header, ready for Add
+func NewHeader() *Header {
+	return &Header{index: make(map[string][]int)}
+}
+
+// ParseHeader parses the header at the start of data, up to the first empty line. Lines end
+// with LF or CRLF, and the folded lines of a field are joined with a space, as in net/textproto.
+// Lines that aren't a field are skipped, and the error is returned with the rest of the header
+func ParseHeader(data []byte) (*Header, error) {
+	h := NewHeader()
+	var err error
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(h.fields) == 0 {
+				err = errMalformedHeader
+				continue
+			}
+			f := &h.fields[len(h.fields)-1]
+			if cont := string(bytes.TrimSpace(line)); f.Value == "" {
+				f.Value = cont
+			} else if cont != "" {
+				f.Value += " " + cont
+			}
+			continue
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			err = errMalformedHeader
+			continue
+		}
+		h.Add(string(bytes.TrimRight(line[:i], " \t")), string(bytes.TrimSpace(line[i+1:])))
+	}
+	return h, err
+}
+
+// Get returns the first value of the named field, or "" if the header doesn't have it
+func (h *Header) Get(name string) string {
+	if h == nil {
+		return ""
+	}
+	if pos := h.index[textproto.CanonicalMIMEHeaderKey(name)]; len(pos) > 0 {
+		return h.fields[pos[0]].Value
+	}
+	return ""
+}
+
+// GetAll returns the values of the named field, in the order they're in the email
+func (h *Header) GetAll(name string) []string {
+	if h == nil {
+		return nil
+	}
+	pos := h.index[textproto.CanonicalMIMEHeaderKey(name)]
+	if len(pos) == 0 {
+		return nil
+	}
+	values := make([]string, len(pos))
+	for i, p := range pos {
+		values[i] = h.fields[p].Value
+	}
+	return values
+}
+
+// Has returns true if the header has the named field, even empty
+func (h *Header) Has(name string) bool {
+	return h != nil && len(h.index[textproto.CanonicalMIMEHeaderKey(name)]) > 0
+}
+
+// Add appends a field at the end of the header
+func (h *Header) Add(name, value string) {
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	h.index[key] = append(h.index[key], len(h.fields))
+	h.fields = append(h.fields, HeaderField{Name: name, Value: value})
+}
+
+// Del removes all the fields of that name
+func (h *Header) Del(name string) {
+	if h == nil {
+		return
+	}
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	if len(h.index[key]) == 0 {
+		return
+	}
+	fields := h.fields[:0]
+	h.index = make(map[string][]int, len(h.index))
+	for _, f := range h.fields {
+		if k := textproto.CanonicalMIMEHeaderKey(f.Name); k != key {
+			h.index[k] = append(h.index[k], len(fields))
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// Len returns the number of fields
+func (h *Header) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+// Fields returns the fields in the order they're in the email. They must not be modified
+func (h *Header) Fields() []HeaderField {
+	if h == nil {
+		return nil
+	}
+	return h.fields
+}
+
+// MIMEHeader returns the fields as a textproto.MIMEHeader, by canonical name
+func (h *Header) MIMEHeader() textproto.MIMEHeader {
+	m := make(textproto.MIMEHeader, h.Len())
+	for _, f := range h.Fields() {
+		key := textproto.CanonicalMIMEHeaderKey(f.Name)
+		m[key] = append(m[key], f.Value)
+	}
+	return m
+}
+
+// String returns the fields, one per line
+func (h *Header) String() string {
+	var b strings.Builder
+	for _, f := range h.Fields() {
+		b.WriteString(f.Name)
+		b.WriteString(": ")
+		b.WriteString(f.Value)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package mail
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	h, err := ParseHeader([]byte("Received: from a\r\nSubject: hello\r\n\tthere \r\n" +
+		"received: from b\r\nX-Empty:\r\nbad line\r\n\r\nBody: not a header\r\n"))
+	if err != errMalformedHeader {
+		t.Error("expected the bad line to be reported, got", err)
+	}
+	if h.Len() != 4 {
+		t.Fatal("expected 4 fields, got", h.Fields())
+	}
+	if h.Get("SUBJECT") != "hello there" {
+		t.Errorf("expected the subject to be unfolded, got %q", h.Get("Subject"))
+	}
+	if got := h.GetAll("Received"); !reflect.DeepEqual(got, []string{"from a", "from b"}) {
+		t.Error("expected the duplicates in order, got", got)
+	}
+	if !h.Has("x-empty") || h.Get("X-Empty") != "" || h.Has("Body") {
+		t.Error("unexpected fields", h.Fields())
+	}
+	if h.Fields()[2].Name != "received" {
+		t.Error("expected the name as it is in the email, got", h.Fields()[2].Name)
+	}
+
+	h.Add("X-Spam", "yes")
+	h.Del("Received")
+	if h.Has("Received") || h.Get("x-spam") != "yes" || h.Get("Subject") != "hello there" || h.Len() != 3 {
+		t.Error("unexpected fields after Del", h.Fields())
+	}
+	if h.String() != "Subject: hello there\nX-Empty: \nX-Spam: yes\n" {
+		t.Errorf("unexpected header %q", h.String())
+	}
+	if m := h.MIMEHeader(); m.Get("X-Spam") != "yes" || len(m) != 3 {
+		t.Error("unexpected MIMEHeader", m)
+	}
+}
+
+func TestNilHeader(t *testing.T) {
+	var h *Header
+	if h.Get("Subject") != "" || h.GetAll("Received") != nil || h.Has("From") || h.Len() != 0 ||
+		h.String() != "" || len(h.MIMEHeader()) != 0 {
+		t.Error("expected a nil header to be empty")
+	}
+	h.Del("From")
+}
@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"strings"
+	"unicode"
+)
+
+// subjectPrefixes are the prefixes of replies and forwards, lower case, in the languages that
+// mail clients use, eg. "AW" for German replies or "转发" for Chinese forwards
+var subjectPrefixes = map[string]bool{
+	// English, and the Latin abbreviations most clients use
+	"re": true, "fw": true, "fwd": true,
+	// German
+	"aw": true, "wg": true,
+	// Dutch
+	"antw": true, "doorst": true,
+	// Scandinavian
+	"sv": true, "vs": true, "vb": true, "vl": true, "fs": true,
+	// French, Italian, Spanish and Portuguese
+	"tr": true, "rif": true, "rv": true, "res": true, "enc": true,
+	// Polish, Czech, Turkish and Indonesian
+	"odp": true, "pd": true, "přeposlat": true, "ynt": true, "ilt": true, "bls": true, "trs": true,
+	// Greek, Russian, Hebrew and Arabic
+	"σχετ": true, "πρθ": true, "ответ": true, "пересл": true, "השב": true, "הועבר": true, "رد": true, "توجيه": true,
+	// Chinese, Japanese and Korean
+	"回复": true, "回覆": true, "答复": true, "转发": true, "轉寄": true, "转寄": true, "返信": true, "転送": true,
+	"답장": true, "회신": true, "전달": true,
+}
+
+// subjectPrefix returns the length of the reply or forward prefix at the start of s, including
+// its colon, or 0. Prefixes may have a counter, eg. "Re[2]:", "Re(2):" or "Re^2:"
+func subjectPrefix(s string) int {
+	i := strings.IndexAny(s, ":：")
+	if i <= 0 || i > 32 {
+		return 0
+	}
+	word := strings.TrimSpace(s[:i])
+	if j := strings.IndexAny(word, "[(^"); j > 0 {
+		counter := strings.Trim(word[j:], "[]()^ ")
+		if strings.TrimFunc(counter, unicode.IsDigit) != "" {
+			return 0
+		}
+		word = strings.TrimSpace(word[:j])
+	}
+	if !subjectPrefixes[strings.ToLower(word)] {
+		return 0
+	}
+	if strings.HasPrefix(s[i:], "：") {
+		return i + len("：")
+	}
+	return i + 1
+}
+
+// collapseSpace replaces each run of whitespace with a single space, and trims the ends
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// NormalizeSubject returns the subject as it was before it was replied to or forwarded, so
+// that the subjects of a thread compare equal: the encoded-words are decoded, the prefixes
+// such as "Re:", "Fwd:", "AW:" or "回复:" are removed, and runs of whitespace become a space
+func NormalizeSubject(subject string) string {
+	s := collapseSpace(MimeHeaderDecode(subject))
+	for {
+		n := subjectPrefix(s)
+		if n == 0 {
+			return s
+		}
+		s = strings.TrimSpace(s[n:])
+	}
+}
+
+// NormalizeDisplayName returns the display name of an address the way it's shown: the
+// encoded-words are decoded, the quotes and escapes removed, and runs of whitespace become a
+// space, so that `"Bob  Smith"` and `=?utf-8?q?Bob_Smith?=` are the same name
+func NormalizeDisplayName(name string) string {
+	s := strings.TrimSpace(MimeHeaderDecode(name))
+	for len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	if strings.IndexByte(s, '\\') >= 0 {
+		var b strings.Builder
+		escaped := false
+		for _, r := range s {
+			if r == '\\' && !escaped {
+				escaped = true
+				continue
+			}
+			escaped = false
+			b.WriteRune(r)
+		}
+		s = b.String()
+	}
+	return collapseSpace(s)
+}
@@ -0,0 +1,37 @@
+package mail
+
+import "testing"
+
+func TestNormalizeSubject(t *testing.T) {
+	for in, want := range map[string]string{
+		"Re: hello":                     "hello",
+		"RE: Fwd: re:  hello   world ":  "hello world",
+		"AW: WG: Termin":                "Termin",
+		"Re[2]: Re(3): Re^4: status":    "status",
+		"回复：转发: 会议":                     "会议",
+		"=?UTF-8?Q?Re:_caf=C3=A9?=":     "café",
+		"Re: Fwd:":                      "",
+		"Reminder: hello":               "Reminder: hello",
+		"Re[x]: hello":                  "Re[x]: hello",
+		"Note: Re: the meeting":         "Note: Re: the meeting",
+		"\tSV:\tVS: Svar\r\n  på mötet": "Svar på mötet",
+	} {
+		if got := NormalizeSubject(in); got != want {
+			t.Errorf("NormalizeSubject(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}
+
+func TestNormalizeDisplayName(t *testing.T) {
+	for in, want := range map[string]string{
+		`"Bob  Smith"`:                    "Bob Smith",
+		"=?utf-8?q?Bob_Smith?=":           "Bob Smith",
+		`"Smith, Bob \"The Builder\""`:    `Smith, Bob "The Builder"`,
+		` 'Alice' `:                       "Alice",
+		"=?ISO-8859-1?Q?Andr=E9?= Pirard": "André Pirard",
+	} {
+		if got := NormalizeDisplayName(in); got != want {
+			t.Errorf("NormalizeDisplayName(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}
@@ -24,6 +24,7 @@ type SingleAddress struct {
 	LocalPartQuoted   bool
 	Domain            string
 	IP                net.IP
+	Literal           bool
 	NullPath          bool
 }
 
@@ -110,6 +111,7 @@ func (s *RFC5322) addAddress() {
 	s.addr.LocalPartQuoted = s.LocalPartQuotes
 	s.addr.Domain = s.Domain
 	s.addr.IP = s.IP
+	s.addr.Literal = s.Literal
 	s.List = append(s.List, s.addr)
 	s.addr = SingleAddress{}
 }
@@ -8,6 +8,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -34,6 +35,8 @@ type Parser struct {
 	LocalPartQuotes bool   // does the local part need quotes?
 	Domain          string // can be an ip-address, enclosed in square brackets if it is
 	IP              net.IP
+	Literal         bool // is Domain an address-literal, eg. [192.0.2.1] or [tag:value]?
+	UTF8            bool // were non-ASCII characters found? (RFC 6531)
 	pos             int
 	NullPath        bool
 	ch              byte
@@ -58,6 +61,8 @@ func (s *Parser) Reset() {
 		s.accept.Reset()
 		s.LocalPartQuotes = false
 		s.IP = nil
+		s.Literal = false
+		s.UTF8 = false
 	}
 }
 
@@ -301,15 +306,16 @@ func (s *Parser) domain() error {
 }
 
 // Let-dig [Ldh-str]
+// sub-domain =/ U-label (RFC 6531)
 func (s *Parser) subdomain() error {
 	state := 0
 	for c := s.next(); ; c = s.next() {
 		switch state {
 		case 0:
 			p := s.peek()
-			if isLetDig(c) {
+			if s.isLetDigU(c) {
 				s.accept.WriteByte(c)
-				if !isLetDig(p) && p != '-' {
+				if !s.isLetDigU(p) && p != '-' {
 					return nil
 				}
 				state = 1
@@ -318,10 +324,10 @@ func (s *Parser) subdomain() error {
 			return errors.New("subdomain parse err")
 		case 1:
 			p := s.peek()
-			if isLetDig(c) || c == '-' {
+			if s.isLetDigU(c) || c == '-' {
 				s.accept.WriteByte(c)
 			}
-			if !isLetDig(p) && p != '-' {
+			if !s.isLetDigU(p) && p != '-' {
 				if c == '-' {
 					return errors.New("subdomain parse err")
 				}
@@ -347,10 +353,17 @@ func (s *Parser) mailbox() error {
 		return atExpected
 	}
 	if p := s.peek(); p == '[' {
-		return s.addressLiteral()
+		err = s.addressLiteral()
 	} else {
-		return s.domain()
+		err = s.domain()
+	}
+	if err == nil && s.UTF8 {
+		// the domain is still in the accept buffer
+		if !utf8.ValidString(s.LocalPart) || !utf8.Valid(s.accept.Bytes()) {
+			return errors.New("invalid utf-8 in mailbox")
+		}
 	}
+	return err
 }
 
 // "[" ( IPv4-address-literal /
@@ -361,13 +374,24 @@ func (s *Parser) addressLiteral() error {
 	if ch == '[' {
 		p := s.peek()
 		var err error
-		if p == 'I' || p == 'i' {
-			for i := 0; i < 5; i++ {
-				s.next() // IPv6:
-			}
-			err = s.ipv6AddressLiteral()
-		} else if p >= 48 && p <= 57 {
+		if p >= 48 && p <= 57 {
 			err = s.ipv4AddressLiteral()
+		} else if isLetDig(p) {
+			// Standardized-tag ":"
+			var tag bytes.Buffer
+			for c := s.next(); c != ':'; c = s.next() {
+				if !isLetDig(c) && c != '-' {
+					return errors.New("address literal tag parse error")
+				}
+				tag.WriteByte(c)
+			}
+			if strings.EqualFold(tag.String(), "IPv6") {
+				err = s.ipv6AddressLiteral()
+			} else {
+				err = s.generalAddressLiteral(tag.String())
+			}
+		} else {
+			err = errors.New("address literal parse error")
 		}
 		if err != nil {
 			return err
@@ -375,11 +399,32 @@ func (s *Parser) addressLiteral() error {
 		if s.ch != ']' {
 			return errors.New("] expected for address literal")
 		}
+		s.Literal = true
 		return nil
 	}
 	return nil
 }
 
+// Standardized-tag ":" 1*dcontent
+// dcontent = %d33-90 / %d94-126
+// The tag and the ':' have already been consumed
+func (s *Parser) generalAddressLiteral(tag string) error {
+	s.accept.WriteString(tag)
+	s.accept.WriteByte(':')
+	n := 0
+	for c := s.next(); ; c = s.next() {
+		if (c >= 33 && c <= 90) || (c >= 94 && c <= 126) {
+			s.accept.WriteByte(c)
+			n++
+			continue
+		}
+		if n == 0 {
+			return errors.New("general address literal parse error")
+		}
+		return nil
+	}
+}
+
 // Snum 3("."  Snum)
 func (s *Parser) ipv4AddressLiteral() error {
 	for i := 0; i < 4; i++ {
@@ -504,7 +549,10 @@ func (s *Parser) QcontentSMTP() error {
 				continue
 			} else if ch == 32 || ch == 33 ||
 				(ch >= 35 && ch <= 91) ||
-				(ch >= 93 && ch <= 126) {
+				(ch >= 93 && ch <= 126) || ch >= 0x80 {
+				if ch >= 0x80 {
+					s.UTF8 = true
+				}
 				if s.LocalPartQuotes == false && !s.isAtext(ch) {
 					s.LocalPartQuotes = true
 				}
@@ -550,7 +598,7 @@ func (s *Parser) atom() error {
 			if !s.isAtext(s.next()) {
 				return errors.New("atom parse error")
 			} else {
-				s.accept.WriteByte(s.ch)
+				s.acceptAtext(s.ch)
 				state = 1
 				continue
 			}
@@ -559,12 +607,20 @@ func (s *Parser) atom() error {
 			if !s.isAtext(s.next()) {
 				return nil
 			} else {
-				s.accept.WriteByte(s.ch)
+				s.acceptAtext(s.ch)
 			}
 		}
 	}
 }
 
+// acceptAtext accepts c, noting if it is part of a UTF-8 sequence
+func (s *Parser) acceptAtext(c byte) {
+	if c >= 0x80 {
+		s.UTF8 = true
+	}
+	s.accept.WriteByte(c)
+}
+
 /*
 
 Dot-string     = Atom *("."  Atom)
@@ -581,7 +637,8 @@ atext           =       ALPHA / DIGIT / ; Any character except controls,
                         "^" / "_" /
                         "`" / "{" /
                         "|" / "}" /
-                        "~"
+                        "~" /
+                        UTF8-non-ascii  ; RFC 6531
 
 */
 
@@ -598,12 +655,21 @@ func (s *Parser) isAtext(c byte) bool {
 		c == '^' || c == '_' ||
 		c == '`' || c == '{' ||
 		c == '|' || c == '}' ||
-		c == '~' {
+		c == '~' || c >= 0x80 {
 		return true
 	}
 	return false
 }
 
+// isLetDigU is like isLetDig, but also accepts the bytes of a UTF-8 U-label
+func (s *Parser) isLetDigU(c byte) bool {
+	if c >= 0x80 {
+		s.UTF8 = true
+		return true
+	}
+	return isLetDig(c)
+}
+
 func isLetDig(c byte) bool {
 	if ('0' <= c && c <= '9') ||
 		('A' <= c && c <= 'Z') ||
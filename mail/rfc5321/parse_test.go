@@ -294,6 +294,77 @@ func TestParseMailBoxBad(t *testing.T) {
 	}
 }
 
+func TestParseAddressLiteral(t *testing.T) {
+	tests := []struct {
+		in     string
+		domain string
+		ip     bool
+		err    bool
+	}{
+		{"[192.0.2.1]", "192.0.2.1", true, false},
+		{"[IPv6:2001:db8::1]", "2001:db8::1", true, false},
+		{"[ipv6:2001:db8::1]", "2001:db8::1", true, false},
+		{"[x-tag:some.host]", "x-tag:some.host", false, false},
+		{"[Ipvx:2001:db8::1]", "Ipvx:2001:db8::1", false, false},
+		{"[x-tag:]", "", false, true},
+		{"[x-tag:a[b]", "", false, true},
+		{"[x_tag:a]", "", false, true},
+		{"[IPv6:not-ip]", "", false, true},
+	}
+	for _, tt := range tests {
+		s := NewParser([]byte("user@" + tt.in))
+		err := s.mailbox()
+		if tt.err {
+			if err == nil {
+				t.Error(tt.in, "error expected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(tt.in, "error not expected", err)
+			continue
+		}
+		if s.Domain != tt.domain {
+			t.Error(tt.in, "expected domain:", tt.domain, "got:", s.Domain)
+		}
+		if !s.Literal {
+			t.Error(tt.in, "expected Literal to be true")
+		}
+		if (s.IP != nil) != tt.ip {
+			t.Error(tt.in, "unexpected IP:", s.IP)
+		}
+	}
+}
+
+func TestParseMailboxUTF8(t *testing.T) {
+	s := NewParser([]byte("jöe@exämple.com"))
+	if err := s.mailbox(); err != nil {
+		t.Error("error not expected", err)
+	}
+	if !s.UTF8 || s.LocalPart != "jöe" || s.Domain != "exämple.com" {
+		t.Error("expected UTF8 jöe@exämple.com, got", s.UTF8, s.LocalPart, s.Domain)
+	}
+
+	s = NewParser([]byte("\"jö e\"@example.com"))
+	if err := s.mailbox(); err != nil {
+		t.Error("error not expected", err)
+	}
+	if !s.UTF8 || !s.LocalPartQuotes {
+		t.Error("expected a quoted UTF8 local part")
+	}
+
+	s = NewParser([]byte("joe@example.com"))
+	if err := s.mailbox(); err != nil || s.UTF8 {
+		t.Error("expected ASCII address", err)
+	}
+
+	// not valid utf-8
+	s = NewParser([]byte("j\xf6e@example.com"))
+	if err := s.mailbox(); err == nil {
+		t.Error("error expected")
+	}
+}
+
 func TestParseMailbox(t *testing.T) {
 
 	s := NewParser([]byte("jsmith@[IPv6:2001:db8::1]"))
@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"sync"
+)
+
+// The keys of the values that the server puts in the session
+const (
+	// SessionRDNS is the []string of the names of the client's address, once the policy looked them up
+	SessionRDNS = "rdns"
+	// SessionDNSBL is the map[string]bool of the DNSBL zones that the policy queried, true if listed
+	SessionDNSBL = "dnsbl"
+)
+
+// Session holds the values of a connection, unlike Envelope.Values which are reset with each
+// transaction. Processors use it to do the work about the client once, eg. a lookup of its address,
+// for all the messages that it sends. It's safe for concurrent use
+type Session struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func NewSession() *Session {
+	return &Session{values: make(map[string]interface{})}
+}
+
+// Get returns the value of the key, and false if there is none
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set sets the value of the key
+func (s *Session) Set(key string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = v
+}
+
+// Delete removes the value of the key
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// Once returns the value of the key, which f computes if there is none yet. The session is locked
+// while f runs, so f must not use the session
+func (s *Session) Once(key string, f func() interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	v := f()
+	s.values[key] = v
+	return v
+}
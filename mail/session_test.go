@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 1)
+	calls := 0
+	lookup := func() interface{} {
+		calls++
+		return "listed"
+	}
+	if v := e.Session.Once("rbl", lookup); v != "listed" {
+		t.Error("expected the value of f, got", v)
+	}
+	// kept for the next transaction
+	e.ResetTransaction()
+	if v := e.Session.Once("rbl", lookup); v != "listed" || calls != 1 {
+		t.Error("expected the value to be computed once, got", v, calls)
+	}
+	e.Session.Set("rdns", []string{"mail.example.com"})
+	c := e.Clone()
+	if _, ok := c.Session.Get("rdns"); !ok {
+		t.Error("expected the clone to share the session")
+	}
+	c.Session.Delete("rdns")
+	if _, ok := e.Session.Get("rdns"); ok {
+		t.Error("expected the value to be deleted")
+	}
+
+	// a new connection has a new session, the clone keeps the old one
+	e.Reseed("127.0.0.2", 2)
+	if _, ok := e.Session.Get("rbl"); ok {
+		t.Error("expected a new session")
+	}
+	if v, ok := c.Session.Get("rbl"); !ok || v != "listed" {
+		t.Error("expected the clone to keep its session, got", v)
+	}
+}
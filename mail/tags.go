@@ -0,0 +1,88 @@
+package mail
+
+import (
+	"strings"
+)
+
+// Tag is a label that processors attach to an envelope to record a finding,
+// eg. "dkim:pass", "rbl:listed" or "tenant:acme". The Value may be empty
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// ParseTag parses a tag in the key:value form. The value is empty if there is no colon
+func ParseTag(s string) Tag {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, ':'); i > -1 {
+		return Tag{Key: s[:i], Value: s[i+1:]}
+	}
+	return Tag{Key: s}
+}
+
+func (t Tag) String() string {
+	if t.Value == "" {
+		return t.Key
+	}
+	return t.Key + ":" + t.Value
+}
+
+// Tags is the set of tags attached to an envelope, in the order they were added
+type Tags []Tag
+
+// ParseTags parses a comma separated list of tags, as returned by Tags.String
+func ParseTags(s string) Tags {
+	var tags Tags
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tag := ParseTag(t)
+			tags.Add(tag.Key, tag.Value)
+		}
+	}
+	return tags
+}
+
+// Add appends a tag, unless the same tag is already in the set
+func (t *Tags) Add(key, value string) {
+	for _, tag := range *t {
+		if tag.Key == key && tag.Value == value {
+			return
+		}
+	}
+	*t = append(*t, Tag{Key: key, Value: value})
+}
+
+// Has returns true if there is a tag with the given key
+func (t Tags) Has(key string) bool {
+	for _, tag := range t {
+		if tag.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns the values of all the tags with the given key
+func (t Tags) Values(key string) []string {
+	var values []string
+	for _, tag := range t {
+		if tag.Key == key {
+			values = append(values, tag.Value)
+		}
+	}
+	return values
+}
+
+// Strings returns each tag in the key:value form
+func (t Tags) Strings() []string {
+	s := make([]string, len(t))
+	for i := range t {
+		s[i] = t[i].String()
+	}
+	return s
+}
+
+// String returns the tags as a comma separated list, eg. "dkim:pass,tenant:acme"
+func (t Tags) String() string {
+	return strings.Join(t.Strings(), ",")
+}
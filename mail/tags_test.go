@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	var tags Tags
+	tags.Add("dkim", "pass")
+	tags.Add("rbl", "listed")
+	tags.Add("rbl", "listed")
+	tags.Add("spam", "")
+	if len(tags) != 3 {
+		t.Error("expected 3 tags, got", len(tags))
+	}
+	if s := tags.String(); s != "dkim:pass,rbl:listed,spam" {
+		t.Error("unexpected string", s)
+	}
+	if !tags.Has("spam") || tags.Has("tenant") {
+		t.Error("Has returned the wrong result")
+	}
+	parsed := ParseTags(" dkim:pass, rbl:listed,,spam ")
+	if parsed.String() != tags.String() {
+		t.Error("expected", tags.String(), "but got", parsed.String())
+	}
+	if v := ParseTag("url:http://example.com").Value; v != "http://example.com" {
+		t.Error("expected the value to be split at the first colon, got", v)
+	}
+}
+
+func TestEnvelopeTagsReset(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 1)
+	e.Tags.Add("tenant", "acme")
+	if v := e.Tags.Values("tenant"); len(v) != 1 || v[0] != "acme" {
+		t.Error("expected the tenant tag, got", v)
+	}
+	e.ResetTransaction()
+	if len(e.Tags) != 0 {
+		t.Error("expected the tags to be reset")
+	}
+}
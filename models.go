@@ -62,3 +62,27 @@ func newSMTPBufferedReader(rd io.Reader) *smtpBufferedReader {
 	s := &smtpBufferedReader{bufio.NewReader(alr), alr}
 	return s
 }
+
+// dataLimitReader reads the DATA of a message, and returns MessageSizeExceeded as soon as the message
+// is longer than n bytes, so that the rest of it is neither buffered nor streamed
+type dataLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (dlr *dataLimitReader) Read(p []byte) (n int, err error) {
+	if dlr.n <= 0 {
+		// at the limit, any more data is too much
+		var probe [1]byte
+		if n, err = dlr.r.Read(probe[:]); n > 0 {
+			return 0, MessageSizeExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > dlr.n {
+		p = p[:dlr.n]
+	}
+	n, err = dlr.r.Read(p)
+	dlr.n -= int64(n)
+	return
+}
@@ -0,0 +1,258 @@
+package guerrilla
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspDefaultRefresh is how often a response without a nextUpdate is fetched again
+	ocspDefaultRefresh = time.Hour
+	// ocspRetry is how long to wait after a failed fetch
+	ocspRetry = time.Minute * 5
+	// ocspMaxResponseSize limits the responder's reply
+	ocspMaxResponseSize = 1 << 20
+)
+
+var (
+	// ocspHTTPClient fetches the OCSP responses
+	ocspHTTPClient = &http.Client{Timeout: time.Second * 10}
+
+	// ocspResponses caches the good responses by the certificate's fingerprint,
+	// so that they survive a reload of the TLS config
+	ocspResponses = struct {
+		sync.Mutex
+		m map[[32]byte]*ocspResponse
+	}{m: make(map[[32]byte]*ocspResponse)}
+)
+
+// ocspResponse is a verified response for a certificate
+type ocspResponse struct {
+	der        []byte
+	revoked    bool
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// refreshAt is halfway through the validity of the response
+func (r *ocspResponse) refreshAt() time.Time {
+	if r.nextUpdate.IsZero() {
+		return r.thisUpdate.Add(ocspDefaultRefresh)
+	}
+	return r.thisUpdate.Add(r.nextUpdate.Sub(r.thisUpdate) / 2)
+}
+
+// expired returns true once the nextUpdate set by the responder has passed, by more than
+// the clock skew
+func (r *ocspResponse) expired() bool {
+	return !r.nextUpdate.IsZero() && backends.Expired(r.nextUpdate)
+}
+
+// parseOCSPResponse checks that the response is signed by the issuer, or a responder
+// delegated by the issuer, and returns the certificate's status
+func parseOCSPResponse(der []byte, cert, issuer *x509.Certificate) (*ocspResponse, error) {
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	// ParseResponseForCert checks that the issuer signed the responder's certificate, not its usage
+	if resp.Certificate != nil && !bytes.Equal(resp.Certificate.Raw, issuer.Raw) {
+		delegated := false
+		for _, usage := range resp.Certificate.ExtKeyUsage {
+			delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+		}
+		if !delegated {
+			return nil, errors.New("the OCSP responder's certificate is not for OCSP signing")
+		}
+	}
+	if resp.Status != ocsp.Good && resp.Status != ocsp.Revoked {
+		return nil, errors.New("the OCSP responder doesn't know the certificate")
+	}
+	return &ocspResponse{
+		der:        der,
+		revoked:    resp.Status == ocsp.Revoked,
+		thisUpdate: resp.ThisUpdate,
+		nextUpdate: resp.NextUpdate,
+	}, nil
+}
+
+// ocspStapler staples the certificate's OCSP response to the handshakes, so that clients that check
+// revocation don't have to ask the CA. The response is fetched in the background, halfway through
+// the validity of the previous one
+type ocspStapler struct {
+	cert        tls.Certificate
+	leaf        *x509.Certificate
+	issuer      *x509.Certificate
+	responder   string
+	fingerprint [32]byte
+	cacheFile   string
+	log         log.Logger
+
+	sync.Mutex
+	stapled   *tls.Certificate
+	response  *ocspResponse
+	refreshAt time.Time
+	fetching  bool
+}
+
+// newOCSPStapler needs the issuer's certificate after the certificate in the chain.
+// The responder defaults to the OCSP server of the certificate
+func newOCSPStapler(cert tls.Certificate, responder, cacheDir string, l log.Logger) (*ocspStapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("OCSP stapling needs the issuer's certificate after the certificate in public_key_file")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	if responder == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return nil, errors.New("the certificate has no OCSP server, see ocsp_responder")
+		}
+		responder = leaf.OCSPServer[0]
+	}
+	o := &ocspStapler{
+		cert:        cert,
+		leaf:        leaf,
+		issuer:      issuer,
+		responder:   responder,
+		fingerprint: sha256.Sum256(cert.Certificate[0]),
+		log:         l,
+		stapled:     &cert,
+	}
+	if cacheDir != "" {
+		o.cacheFile = filepath.Join(cacheDir, hex.EncodeToString(o.fingerprint[:])+".ocsp")
+	}
+	// start with a cached response, to staple before the first fetch
+	ocspResponses.Lock()
+	r := ocspResponses.m[o.fingerprint]
+	ocspResponses.Unlock()
+	if r == nil && o.cacheFile != "" {
+		if der, err := ioutil.ReadFile(o.cacheFile); err == nil {
+			r, _ = parseOCSPResponse(der, leaf, issuer)
+		}
+	}
+	if r != nil && !r.expired() {
+		o.use(r)
+	}
+	return o, nil
+}
+
+// use staples the response. Called with the lock held, or before the stapler is shared
+func (o *ocspStapler) use(r *ocspResponse) {
+	cert := o.cert
+	cert.OCSPStaple = r.der
+	o.stapled = &cert
+	o.response = r
+	o.refreshAt = r.refreshAt()
+}
+
+// getCertificate is the tls.Config's GetCertificate. It returns the certificate with the current
+// response, and starts fetching a new one when it's due
+func (o *ocspStapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	o.Lock()
+	defer o.Unlock()
+	now := backends.Now()
+	if !o.fetching && !now.Before(o.refreshAt) {
+		o.fetching = true
+		go o.refresh()
+	}
+	if o.response != nil && o.response.expired() {
+		o.stapled, o.response = &o.cert, nil
+	}
+	return o.stapled, nil
+}
+
+// refresh fetches the response, and keeps the previous one if the fetch fails
+func (o *ocspStapler) refresh() {
+	r, err := o.fetch()
+	o.Lock()
+	defer o.Unlock()
+	o.fetching = false
+	if err != nil {
+		o.log.WithError(err).Warnf("could not fetch the OCSP response from %s", o.responder)
+		o.refreshAt = backends.Now().Add(ocspRetry)
+		return
+	}
+	if r.revoked {
+		o.log.Errorf("the OCSP responder says that the certificate %s is revoked", o.leaf.Subject)
+	}
+	o.use(r)
+	ocspResponses.Lock()
+	ocspResponses.m[o.fingerprint] = r
+	ocspResponses.Unlock()
+	if o.cacheFile != "" {
+		if err := ioutil.WriteFile(o.cacheFile, r.der, 0644); err != nil {
+			o.log.WithError(err).Warn("could not cache the OCSP response")
+		}
+	}
+}
+
+func (o *ocspStapler) fetch() (*ocspResponse, error) {
+	req, err := ocsp.CreateRequest(o.leaf, o.issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, o.responder, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpReq.Header.Set("Accept", "application/ocsp-response")
+	resp, err := ocspHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the OCSP responder replied %s", resp.Status)
+	}
+	der, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseOCSPResponse(der, o.leaf, o.issuer)
+}
+
+// useOCSPStapling makes the TLS config staple the certificate's OCSP response
+func useOCSPStapling(tlsConfig *tls.Config, sConfig *ServerTLSConfig, l log.Logger) error {
+	if !sConfig.OCSPStaplingOn {
+		return nil
+	}
+	if sConfig.OCSPCacheDir != "" {
+		if err := os.MkdirAll(sConfig.OCSPCacheDir, 0755); err != nil {
+			return err
+		}
+	}
+	o, err := newOCSPStapler(tlsConfig.Certificates[0], sConfig.OCSPResponder, sConfig.OCSPCacheDir, l)
+	if err != nil {
+		return fmt.Errorf("cannot staple OCSP responses: %s", err)
+	}
+	// GetCertificate is only used when there are no Certificates
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = o.getCertificate
+	// fetch now, rather than with the first handshake
+	_, _ = o.getCertificate(nil)
+	return nil
+}
@@ -0,0 +1,250 @@
+package guerrilla
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testOCSPCA struct {
+	key    *ecdsa.PrivateKey
+	cert   *x509.Certificate
+	server *httptest.Server
+	// hits counts the requests to the responder
+	hits int32
+}
+
+func newTestOCSPCA(t *testing.T) *testOCSPCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testOCSPCA{key: key}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ca.hits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil || r.Header.Get("Content-Type") != "application/ocsp-request" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(ca.respond(t, req.SerialNumber, ocsp.Good, nil, ca.key))
+	}))
+	return ca
+}
+
+// issue returns a certificate issued by the CA, with the CA's certificate in the chain
+func (ca *testOCSPCA) issue(t *testing.T, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "mail.example.com"},
+		DNSNames:     []string{"mail.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{ca.server.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+}
+
+// respond returns a response about the serial number, with the status of ocsp.
+// It's signed with the key of the responder, which is the CA when responder is nil
+func (ca *testOCSPCA) respond(t *testing.T, serial *big.Int, status int, responder *x509.Certificate, key crypto.Signer) []byte {
+	now := time.Now().UTC().Truncate(time.Second)
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Hour),
+		RevokedAt:    now.Add(-time.Minute),
+		Certificate:  responder,
+	}
+	if responder == nil {
+		responder = ca.cert
+	}
+	der, err := ocsp.CreateResponse(ca.cert, responder, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// responder returns the certificate of a responder delegated by the CA, and its key
+func (ca *testOCSPCA) responder(t *testing.T, usage ...x509.ExtKeyUsage) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test OCSP responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  usage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestOCSPResponse(t *testing.T) {
+	ca := newTestOCSPCA(t)
+	defer ca.server.Close()
+	leaf, _ := x509.ParseCertificate(ca.issue(t, 2).Certificate[0])
+	serial := leaf.SerialNumber
+
+	r, err := parseOCSPResponse(ca.respond(t, serial, ocsp.Good, nil, ca.key), leaf, ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.revoked || r.nextUpdate.Sub(r.thisUpdate) != time.Hour || r.refreshAt() != r.thisUpdate.Add(time.Minute*30) {
+		t.Error("unexpected response", r)
+	}
+	// the response expires once its nextUpdate passed, by more than the clock skew
+	prev := backends.SetClock(backends.NewManualClock(r.nextUpdate.Add(time.Minute)))
+	defer backends.SetClock(prev)
+	if !r.expired() {
+		t.Error("expected the response to expire after its nextUpdate")
+	}
+	backends.SetClockSkew(time.Minute * 5)
+	defer backends.SetClockSkew(0)
+	if r.expired() {
+		t.Error("expected the response to be valid within the clock skew")
+	}
+	if r, err := parseOCSPResponse(ca.respond(t, serial, ocsp.Revoked, nil, ca.key), leaf, ca.cert); err != nil || !r.revoked {
+		t.Error("expected the certificate to be revoked", err)
+	}
+	if _, err := parseOCSPResponse(ca.respond(t, serial, ocsp.Unknown, nil, ca.key), leaf, ca.cert); err == nil {
+		t.Error("expected an error for an unknown certificate")
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := parseOCSPResponse(ca.respond(t, serial, ocsp.Good, nil, other), leaf, ca.cert); err == nil {
+		t.Error("expected an error for a response that the issuer didn't sign")
+	}
+	responder, key := ca.responder(t, x509.ExtKeyUsageOCSPSigning)
+	if r, err := parseOCSPResponse(ca.respond(t, serial, ocsp.Good, responder, key), leaf, ca.cert); err != nil || r.revoked {
+		t.Error("expected the response of a delegated responder to be taken", err)
+	}
+	responder, key = ca.responder(t, x509.ExtKeyUsageServerAuth)
+	if _, err := parseOCSPResponse(ca.respond(t, serial, ocsp.Good, responder, key), leaf, ca.cert); err == nil {
+		t.Error("expected an error for a responder that isn't for OCSP signing")
+	}
+	if _, err := parseOCSPResponse(ca.respond(t, big.NewInt(3), ocsp.Good, nil, ca.key), leaf, ca.cert); err == nil {
+		t.Error("expected an error for a response about another certificate")
+	}
+	if _, err := parseOCSPResponse([]byte{0x30, 0x03, 0x0a, 0x01, 0x01}, leaf, ca.cert); err == nil {
+		t.Error("expected an error for a malformed response")
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	ca := newTestOCSPCA(t)
+	defer ca.server.Close()
+	dir, err := ioutil.TempDir("", "ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	logger, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	sConfig := &ServerTLSConfig{OCSPStaplingOn: true, OCSPCacheDir: dir}
+	cert := ca.issue(t, 4)
+
+	staple := func(tlsConfig *tls.Config) []byte {
+		client, server := net.Pipe()
+		defer func() {
+			_ = client.Close()
+		}()
+		go func() {
+			_ = tls.Server(server, tlsConfig).Handshake()
+			_ = server.Close()
+		}()
+		conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return conn.ConnectionState().OCSPResponse
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := useOCSPStapling(tlsConfig, sConfig, logger); err != nil {
+		t.Fatal(err)
+	}
+	var stapled []byte
+	for i := 0; i < 100 && stapled == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+		stapled = staple(tlsConfig)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if r, err := parseOCSPResponse(stapled, leaf, ca.cert); err != nil || r.revoked {
+		t.Fatal("expected a good response to be stapled", err)
+	}
+	if hits := atomic.LoadInt32(&ca.hits); hits != 1 {
+		t.Error("expected the response to be fetched once, got", hits)
+	}
+
+	// a restart staples the cached response straight away
+	ocspResponses.Lock()
+	ocspResponses.m = make(map[[32]byte]*ocspResponse)
+	ocspResponses.Unlock()
+	tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := useOCSPStapling(tlsConfig, sConfig, logger); err != nil {
+		t.Fatal(err)
+	}
+	if staple(tlsConfig) == nil {
+		t.Error("expected the cached response to be stapled")
+	}
+	if hits := atomic.LoadInt32(&ca.hits); hits != 1 {
+		t.Error("expected the cached response to be used, got", hits, "fetches")
+	}
+
+	// without the issuer, the response can't be requested
+	alone := cert
+	alone.Certificate = alone.Certificate[:1]
+	if err := useOCSPStapling(&tls.Config{Certificates: []tls.Certificate{alone}}, sConfig, logger); err == nil {
+		t.Error("expected an error without the issuer's certificate")
+	}
+}
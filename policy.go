@@ -0,0 +1,736 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/ipaddr"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// The stages of a session where the policy is evaluated
+const (
+	PolicyConnect = "connect"
+	PolicyHelo    = "helo"
+	PolicyMail    = "mail"
+	PolicyRcpt    = "rcpt"
+	PolicyData    = "data"
+)
+
+// The decisions of a policy rule
+const (
+	// PolicyAccept trusts the client, the configured rules are not checked again in the session
+	PolicyAccept = "accept"
+	// PolicyTempfail refuses the command with a temporary error, or closes the connection
+	PolicyTempfail = "tempfail"
+	// PolicyReject refuses the command with a permanent error, or closes the connection
+	PolicyReject = "reject"
+	// PolicyTarpit delays the response, and the rules are still checked
+	PolicyTarpit = "tarpit"
+)
+
+const (
+	// policyLookupTimeout limits the DNS lookups of a stage
+	policyLookupTimeout = time.Second * 5
+	// defaultTarpitDelay is used when tarpit_delay is not set
+	defaultTarpitDelay = time.Second * 5
+)
+
+// PolicyConfig is the connection policy of a server. Rules add to a score, or decide straight away,
+// and the score of the session is compared with the thresholds after each stage
+type PolicyConfig struct {
+	// Rules are checked in order
+	Rules []PolicyRuleConfig `json:"rules,omitempty"`
+	// Lists are named lists of IP addresses and networks, for the list:<name> condition
+	Lists map[string][]string `json:"lists,omitempty"`
+	// GeoIPFile is a CSV file of network,country lines, eg. "192.0.2.0/24,NL", for the country: condition
+	GeoIPFile string `json:"geoip_file,omitempty"`
+	// TempfailScore, RejectScore and TarpitScore are the thresholds of the score, 0 disables them
+	TempfailScore float64 `json:"tempfail_score,omitempty"`
+	RejectScore   float64 `json:"reject_score,omitempty"`
+	TarpitScore   float64 `json:"tarpit_score,omitempty"`
+	// TarpitDelay is how long to delay the responses to tarpitted clients, eg. "10s", default 5s
+	TarpitDelay string `json:"tarpit_delay,omitempty"`
+	// DNSBL are the block lists queried at the connect stage, after the rules
+	DNSBL []DNSBLConfig `json:"dnsbl,omitempty"`
+	// DNSBLTimeout is how long to wait for all the lists, eg. "1s", default 2s
+	DNSBLTimeout string `json:"dnsbl_timeout,omitempty"`
+	// DNSBLCacheTTL is how long to keep the answers of the lists, eg. "1h", default 10m
+	DNSBLCacheTTL string `json:"dnsbl_cache_ttl,omitempty"`
+}
+
+// PolicyRuleConfig is a rule of the policy
+type PolicyRuleConfig struct {
+	// Name is logged when the rule decides, defaults to the conditions
+	Name string `json:"name,omitempty"`
+	// Stage is when the rule is checked: connect, helo, mail, rcpt or data, or a comma separated list
+	Stage string `json:"stage"`
+	// If lists the conditions, all of them must be true, eg. ["rdns:none", "!list:trusted"]
+	If []string `json:"if,omitempty"`
+	// Score is added to the session's score when the conditions are true
+	Score float64 `json:"score,omitempty"`
+	// Action decides straight away: accept, tempfail, reject or tarpit
+	Action string `json:"action,omitempty"`
+	// Message replaces the text of the tempfail or reject response
+	Message string `json:"message,omitempty"`
+}
+
+// PolicyContext is what the conditions know about the client. It's kept for the session
+type PolicyContext struct {
+	Stage         string
+	IP            net.IP
+	Helo          string
+	MailFrom      mail.Address
+	Rcpt          mail.Address
+	TLS           bool
+	Authenticated bool
+
+	// the score of each stage, rcpt and data scores only count for the command
+	connectScore, heloScore, mailScore float64
+	accepted                           bool
+
+	// answers of lookups
+	ptr       []string
+	ptrDone   bool
+	confirmed *bool
+	dnsbl     map[string]bool
+}
+
+// PTR returns the names of the client's IP address, looked up once in a session
+func (c *PolicyContext) PTR() []string {
+	if !c.ptrDone {
+		c.ptrDone = true
+		ctx, cancel := context.WithTimeout(context.Background(), policyLookupTimeout)
+		defer cancel()
+		names, _ := backends.Resolver().LookupAddr(ctx, c.IP.String())
+		for _, name := range names {
+			c.ptr = append(c.ptr, strings.ToLower(strings.TrimSuffix(name, ".")))
+		}
+	}
+	return c.ptr
+}
+
+// forwardConfirmed returns true if a name of the client's IP address resolves back to it
+func (c *PolicyContext) forwardConfirmed() bool {
+	if c.confirmed == nil {
+		confirmed := false
+		ctx, cancel := context.WithTimeout(context.Background(), policyLookupTimeout)
+		defer cancel()
+		for _, name := range c.PTR() {
+			addrs, _ := backends.Resolver().LookupIPAddr(ctx, name)
+			for _, addr := range addrs {
+				confirmed = confirmed || addr.IP.Equal(c.IP)
+			}
+		}
+		c.confirmed = &confirmed
+	}
+	return *c.confirmed
+}
+
+// share puts the answers of the lookups in the session, so that the processors don't look them up again
+func (c *PolicyContext) share(session *mail.Session) {
+	if c.ptrDone {
+		session.Set(mail.SessionRDNS, append([]string(nil), c.ptr...))
+	}
+	if len(c.dnsbl) > 0 {
+		dnsbl := make(map[string]bool, len(c.dnsbl))
+		for zone, listed := range c.dnsbl {
+			dnsbl[zone] = listed
+		}
+		session.Set(mail.SessionDNSBL, dnsbl)
+	}
+}
+
+// PolicySignal is a condition of the policy rules
+type PolicySignal interface {
+	Match(c *PolicyContext) bool
+}
+
+// PolicySignalFunc is a function that is a PolicySignal
+type PolicySignalFunc func(c *PolicyContext) bool
+
+func (f PolicySignalFunc) Match(c *PolicyContext) bool {
+	return f(c)
+}
+
+var policySignals = struct {
+	sync.Mutex
+	m map[string]func(arg string) (PolicySignal, error)
+}{m: make(map[string]func(arg string) (PolicySignal, error))}
+
+// RegisterPolicySignal adds a condition for the rules, written as name:argument. The function
+// is called with the argument when a policy is configured
+func RegisterPolicySignal(name string, f func(arg string) (PolicySignal, error)) {
+	policySignals.Lock()
+	defer policySignals.Unlock()
+	policySignals.m[strings.ToLower(name)] = f
+}
+
+// GeoIPCountry returns the country code of an IP address for the country: condition, when there is
+// no geoip_file. Set it to use a GeoIP database
+var GeoIPCountry func(ip net.IP) string
+
+type policyRule struct {
+	name    string
+	stages  map[string]bool
+	signals []PolicySignal
+	score   float64
+	action  string
+	message string
+}
+
+func (r *policyRule) matches(c *PolicyContext) bool {
+	if !r.stages[c.Stage] {
+		return false
+	}
+	for _, s := range r.signals {
+		if !s.Match(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// policy is a server's compiled PolicyConfig
+type policy struct {
+	config       PolicyConfig
+	authRequired bool
+	// required rules come from the server config, and are checked even for accepted clients
+	required    []*policyRule
+	rules       []*policyRule
+	tarpitDelay time.Duration
+	// dnsbl are the block lists, queried together at the connect stage
+	dnsbl         []*dnsblList
+	dnsblTimeout  time.Duration
+	dnsblCacheTTL time.Duration
+}
+
+// policyDecision is the outcome of a stage, an empty action lets the command through
+type policyDecision struct {
+	action  string
+	rule    string
+	message string
+	score   float64
+}
+
+func newPolicy(sc *ServerConfig) (*policy, error) {
+	p := &policy{
+		config:        sc.Policy,
+		authRequired:  sc.AuthRequired,
+		tarpitDelay:   defaultTarpitDelay,
+		dnsblTimeout:  defaultDNSBLTimeout,
+		dnsblCacheTTL: defaultDNSBLCacheTTL,
+	}
+	if sc.Policy.TarpitDelay != "" {
+		d, err := time.ParseDuration(sc.Policy.TarpitDelay)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid tarpit_delay %q", sc.Policy.TarpitDelay)
+		}
+		p.tarpitDelay = d
+	}
+	if sc.Policy.DNSBLTimeout != "" {
+		d, err := time.ParseDuration(sc.Policy.DNSBLTimeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid dnsbl_timeout %q", sc.Policy.DNSBLTimeout)
+		}
+		p.dnsblTimeout = d
+	}
+	if sc.Policy.DNSBLCacheTTL != "" {
+		d, err := time.ParseDuration(sc.Policy.DNSBLCacheTTL)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid dnsbl_cache_ttl %q", sc.Policy.DNSBLCacheTTL)
+		}
+		p.dnsblCacheTTL = d
+	}
+	for _, lc := range sc.Policy.DNSBL {
+		l, err := newDNSBLList(lc)
+		if err != nil {
+			return nil, fmt.Errorf("policy dnsbl: %s", err)
+		}
+		p.dnsbl = append(p.dnsbl, l)
+	}
+	if sc.AuthRequired {
+		p.required = append(p.required, &policyRule{
+			name:    "auth_required",
+			stages:  map[string]bool{PolicyRcpt: true, PolicyData: true},
+			signals: []PolicySignal{PolicySignalFunc(func(c *PolicyContext) bool { return !c.Authenticated })},
+			action:  PolicyReject,
+			message: "Client host rejected: Access denied",
+		})
+	}
+	b := &policyBuilder{config: &sc.Policy}
+	for i, rc := range sc.Policy.Rules {
+		r, err := b.rule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %d: %s", i+1, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// evaluate checks the rules of the context's stage, and updates the score of the session
+func (p *policy) evaluate(c *PolicyContext) policyDecision {
+	for _, r := range p.required {
+		if r.matches(c) {
+			return policyDecision{action: r.action, rule: r.name, message: r.message}
+		}
+	}
+	if c.accepted {
+		return policyDecision{}
+	}
+	score := 0.0
+	tarpit := ""
+	for _, r := range p.rules {
+		if !r.matches(c) {
+			continue
+		}
+		switch r.action {
+		case "":
+			score += r.score
+		case PolicyTarpit:
+			score += r.score
+			tarpit = r.name
+		default:
+			if r.action == PolicyAccept {
+				c.accepted = true
+			}
+			return policyDecision{action: r.action, rule: r.name, message: r.message}
+		}
+	}
+	if c.Stage == PolicyConnect && len(p.dnsbl) > 0 {
+		listed, d := p.checkDNSBL(c)
+		if d != nil {
+			return *d
+		}
+		score += listed
+	}
+	switch c.Stage {
+	case PolicyConnect:
+		c.connectScore = score
+	case PolicyHelo:
+		c.heloScore = score
+	case PolicyMail:
+		c.mailScore = score
+	}
+	total := c.connectScore + c.heloScore
+	if c.Stage != PolicyConnect && c.Stage != PolicyHelo {
+		total += c.mailScore
+		if c.Stage != PolicyMail {
+			total += score
+		}
+	}
+	d := policyDecision{rule: "score", score: total}
+	switch {
+	case p.config.RejectScore > 0 && total >= p.config.RejectScore:
+		d.action = PolicyReject
+	case p.config.TempfailScore > 0 && total >= p.config.TempfailScore:
+		d.action = PolicyTempfail
+	case p.config.TarpitScore > 0 && total >= p.config.TarpitScore:
+		d.action = PolicyTarpit
+	case tarpit != "":
+		d.action, d.rule = PolicyTarpit, tarpit
+	}
+	return d
+}
+
+// response returns the response for a tempfail or reject at the stage
+func (d policyDecision) response(stage string) *response.Response {
+	r := &response.Response{EnhancedCode: ".7.1", BasicCode: 554, Class: response.ClassPermanentFailure}
+	if d.action == PolicyTempfail {
+		r.BasicCode, r.Class = 451, response.ClassTransientFailure
+		if stage == PolicyConnect {
+			r.BasicCode = 421
+		}
+	}
+	r.Comment = d.message
+	if r.Comment == "" && d.action == PolicyTempfail {
+		r.Comment = "Try again later"
+	} else if r.Comment == "" {
+		r.Comment = "Rejected by policy"
+	}
+	return r
+}
+
+// policyBuilder compiles the rules of a policy config
+type policyBuilder struct {
+	config *PolicyConfig
+	lists  map[string]*ipList
+	geoIP  geoIPTable
+}
+
+func (b *policyBuilder) rule(rc PolicyRuleConfig) (*policyRule, error) {
+	r := &policyRule{name: rc.Name, stages: make(map[string]bool), score: rc.Score, message: rc.Message}
+	if r.name == "" {
+		r.name = strings.Join(rc.If, " & ")
+	}
+	for _, stage := range strings.Split(rc.Stage, ",") {
+		switch stage = strings.ToLower(strings.TrimSpace(stage)); stage {
+		case PolicyConnect, PolicyHelo, PolicyMail, PolicyRcpt, PolicyData:
+			r.stages[stage] = true
+		default:
+			return nil, fmt.Errorf("unknown stage %q", stage)
+		}
+	}
+	switch r.action = strings.ToLower(rc.Action); r.action {
+	case "", PolicyAccept, PolicyTempfail, PolicyReject, PolicyTarpit:
+	default:
+		return nil, fmt.Errorf("unknown action %q", rc.Action)
+	}
+	for _, cond := range rc.If {
+		s, err := b.signal(cond)
+		if err != nil {
+			return nil, err
+		}
+		r.signals = append(r.signals, s)
+	}
+	return r, nil
+}
+
+// signal compiles a condition, name:argument with an optional ! in front
+func (b *policyBuilder) signal(cond string) (PolicySignal, error) {
+	cond = strings.TrimSpace(cond)
+	if strings.HasPrefix(cond, "!") {
+		s, err := b.signal(cond[1:])
+		if err != nil {
+			return nil, err
+		}
+		return PolicySignalFunc(func(c *PolicyContext) bool { return !s.Match(c) }), nil
+	}
+	name, arg := cond, ""
+	if i := strings.Index(cond, ":"); i > -1 {
+		name, arg = cond[:i], cond[i+1:]
+	}
+	switch name = strings.ToLower(name); name {
+	case "list":
+		l, err := b.list(arg)
+		if err != nil {
+			return nil, err
+		}
+		return PolicySignalFunc(func(c *PolicyContext) bool { return l.contains(c.IP) }), nil
+	case "country":
+		country, err := b.countries()
+		if err != nil {
+			return nil, err
+		}
+		codes := make(map[string]bool)
+		for _, code := range strings.Split(arg, ",") {
+			codes[strings.ToUpper(strings.TrimSpace(code))] = true
+		}
+		return PolicySignalFunc(func(c *PolicyContext) bool { return codes[country(c.IP)] }), nil
+	}
+	policySignals.Lock()
+	f, ok := policySignals.m[name]
+	policySignals.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown condition %q", cond)
+	}
+	s, err := f(arg)
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %s", cond, err)
+	}
+	return s, nil
+}
+
+func (b *policyBuilder) list(name string) (*ipList, error) {
+	if l, ok := b.lists[name]; ok {
+		return l, nil
+	}
+	entries, ok := b.config.Lists[name]
+	if !ok {
+		return nil, fmt.Errorf("no list named %q", name)
+	}
+	l, err := newIPList(entries)
+	if err != nil {
+		return nil, fmt.Errorf("list %q: %s", name, err)
+	}
+	if b.lists == nil {
+		b.lists = make(map[string]*ipList)
+	}
+	b.lists[name] = l
+	return l, nil
+}
+
+// countries returns the lookup of the country: condition
+func (b *policyBuilder) countries() (func(ip net.IP) string, error) {
+	if b.config.GeoIPFile == "" {
+		if GeoIPCountry == nil {
+			return nil, fmt.Errorf("the country: condition needs a geoip_file")
+		}
+		return GeoIPCountry, nil
+	}
+	if b.geoIP == nil {
+		t, err := loadGeoIP(b.config.GeoIPFile)
+		if err != nil {
+			return nil, err
+		}
+		b.geoIP = t
+	}
+	return b.geoIP.country, nil
+}
+
+// ipList is a list of networks
+type ipList struct {
+	nets []*net.IPNet
+}
+
+// newIPList parses addresses and networks in the CIDR notation
+func newIPList(entries []string) (*ipList, error) {
+	l := &ipList{}
+	for _, entry := range entries {
+		for _, s := range strings.Split(entry, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			n, err := ipaddr.Network(s)
+			if err != nil {
+				return nil, err
+			}
+			l.nets = append(l.nets, n)
+		}
+	}
+	return l, nil
+}
+
+func (l *ipList) contains(ip net.IP) bool {
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoIPRange is a range of addresses of a country, the addresses are 16 bytes
+type geoIPRange struct {
+	first, last net.IP
+	country     string
+}
+
+// geoIPTable is sorted by the first address of the ranges
+type geoIPTable []geoIPRange
+
+// loadGeoIP reads a CSV file of network,country lines. Blank lines and lines starting with # are skipped
+func loadGeoIP(path string) (geoIPTable, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var t geoIPTable
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected network,country", path, line)
+		}
+		l, err := newIPList(fields[:1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		n := l.nets[0]
+		first := n.IP.To16()
+		last := make(net.IP, len(first))
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		t = append(t, geoIPRange{first: first, last: last, country: strings.ToUpper(strings.TrimSpace(fields[1]))})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(t, func(i, j int) bool { return bytes.Compare(t[i].first, t[j].first) < 0 })
+	return t, nil
+}
+
+// country returns the country of the range with the address, or an empty string
+func (t geoIPTable) country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	// the last range that starts at or before the address
+	i := sort.Search(len(t), func(i int) bool { return bytes.Compare(t[i].first, ip) > 0 }) - 1
+	if i >= 0 && bytes.Compare(ip, t[i].last) <= 0 {
+		return t[i].country
+	}
+	return ""
+}
+
+// policyRate counts the events of each IP address in fixed windows
+type policyRate struct {
+	limit  int
+	window time.Duration
+	sync.Mutex
+	counts map[string]*policyRateCount
+}
+
+type policyRateCount struct {
+	start time.Time
+	n     int
+}
+
+// policyRatePrune is how many addresses are counted before the expired counts are removed
+const policyRatePrune = 1024
+
+// Match counts the event, and is true when there were more than limit events in the window
+func (r *policyRate) Match(c *PolicyContext) bool {
+	now := time.Now()
+	key := c.IP.String()
+	r.Lock()
+	defer r.Unlock()
+	count, ok := r.counts[key]
+	if !ok || now.Sub(count.start) >= r.window {
+		if !ok && len(r.counts) >= policyRatePrune {
+			for k, v := range r.counts {
+				if now.Sub(v.start) >= r.window {
+					delete(r.counts, k)
+				}
+			}
+		}
+		count = &policyRateCount{start: now}
+		r.counts[key] = count
+	}
+	count.n++
+	return count.n > r.limit
+}
+
+// dnsblName returns the name to look up for the address in a DNS block list zone
+func dnsblName(ip net.IP, zone string) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip4[i])))
+		}
+	} else {
+		const hex = "0123456789abcdef"
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, string(hex[ip[i]&0xf]), string(hex[ip[i]>>4]))
+		}
+	}
+	return strings.Join(labels, ".") + "." + strings.Trim(zone, ".")
+}
+
+// globSignal matches a glob, case insensitive, against a value of the context
+func globSignal(pattern string, value func(c *PolicyContext) []string) (PolicySignal, error) {
+	pattern = strings.ToLower(pattern)
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return PolicySignalFunc(func(c *PolicyContext) bool {
+		for _, v := range value(c) {
+			if ok, _ := filepath.Match(pattern, strings.ToLower(v)); ok {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func init() {
+	// cidr:<networks> - the client's address is in the comma separated networks
+	RegisterPolicySignal("cidr", func(arg string) (PolicySignal, error) {
+		l, err := newIPList([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		return PolicySignalFunc(func(c *PolicyContext) bool { return l.contains(c.IP) }), nil
+	})
+	// rdns:none - the address has no name, rdns:mismatch - no name resolves back to the address,
+	// rdns:<glob> - a name matches, eg. "rdns:*.dynamic.example.net"
+	RegisterPolicySignal("rdns", func(arg string) (PolicySignal, error) {
+		switch arg {
+		case "none":
+			return PolicySignalFunc(func(c *PolicyContext) bool { return len(c.PTR()) == 0 }), nil
+		case "mismatch":
+			return PolicySignalFunc(func(c *PolicyContext) bool { return !c.forwardConfirmed() }), nil
+		}
+		return globSignal(arg, func(c *PolicyContext) []string { return c.PTR() })
+	})
+	// dnsbl:<zone> - the address is listed by a DNS block list, eg. "dnsbl:zen.spamhaus.org"
+	RegisterPolicySignal("dnsbl", func(arg string) (PolicySignal, error) {
+		zone := strings.ToLower(strings.Trim(arg, ". "))
+		if zone == "" {
+			return nil, fmt.Errorf("expected a zone")
+		}
+		return PolicySignalFunc(func(c *PolicyContext) bool {
+			if listed, ok := c.dnsbl[zone]; ok {
+				return listed
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), policyLookupTimeout)
+			defer cancel()
+			addrs, _ := lookupDNSBL(ctx, c.IP, zone, defaultDNSBLCacheTTL)
+			if c.dnsbl == nil {
+				c.dnsbl = make(map[string]bool)
+			}
+			c.dnsbl[zone] = len(addrs) > 0
+			return c.dnsbl[zone]
+		}), nil
+	})
+	// helo:<glob> - the HELO or EHLO name matches
+	RegisterPolicySignal("helo", func(arg string) (PolicySignal, error) {
+		return globSignal(arg, func(c *PolicyContext) []string { return []string{c.Helo} })
+	})
+	// sender:<glob> - the MAIL FROM address matches, <> for the null sender
+	RegisterPolicySignal("sender", func(arg string) (PolicySignal, error) {
+		return globSignal(arg, func(c *PolicyContext) []string {
+			if c.MailFrom.NullPath {
+				return []string{"<>"}
+			}
+			return []string{c.MailFrom.String()}
+		})
+	})
+	// rcpt:<glob> - the RCPT TO address matches
+	RegisterPolicySignal("rcpt", func(arg string) (PolicySignal, error) {
+		return globSignal(arg, func(c *PolicyContext) []string { return []string{c.Rcpt.String()} })
+	})
+	// tls - the connection is encrypted
+	RegisterPolicySignal("tls", func(arg string) (PolicySignal, error) {
+		return PolicySignalFunc(func(c *PolicyContext) bool { return c.TLS }), nil
+	})
+	// auth - the client has logged in
+	RegisterPolicySignal("auth", func(arg string) (PolicySignal, error) {
+		return PolicySignalFunc(func(c *PolicyContext) bool { return c.Authenticated }), nil
+	})
+	// rate:<count>/<duration> - the address was seen more than count times in the period at the
+	// rule's stage, eg. "rate:20/1m". Only counted when the conditions before it are true
+	RegisterPolicySignal("rate", func(arg string) (PolicySignal, error) {
+		parts := strings.SplitN(arg, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected count/duration")
+		}
+		limit, err := strconv.Atoi(parts[0])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid count %q", parts[0])
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", parts[1])
+		}
+		return &policyRate{limit: limit, window: window, counts: make(map[string]*policyRateCount)}, nil
+	})
+}
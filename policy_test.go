@@ -0,0 +1,389 @@
+package guerrilla
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// policyResolver answers the lookups of the policy tests
+type policyResolver struct {
+	ptr map[string][]string
+	a   map[string][]net.IPAddr
+	// slow is a zone whose lookups time out
+	slow    string
+	lookups int32
+}
+
+func (r *policyResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, nil
+}
+
+func (r *policyResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	if r.slow != "" && strings.HasSuffix(host, "."+r.slow) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return r.a[host], nil
+}
+
+func (r *policyResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, nil
+}
+
+func (r *policyResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.ptr[addr], nil
+}
+
+func evaluatePolicy(p *policy, c *PolicyContext, stage string) policyDecision {
+	c.Stage = stage
+	return p.evaluate(c)
+}
+
+func TestPolicyRules(t *testing.T) {
+	resolver := backends.Resolver()
+	backends.SetResolver(&policyResolver{
+		ptr: map[string][]string{
+			"192.0.2.1":   {"mail.example.com."},
+			"192.0.2.2":   {"host-2.dynamic.example.net."},
+			"203.0.113.9": {"mail.example.org."},
+		},
+		a: map[string][]net.IPAddr{
+			"mail.example.com":           {{IP: net.ParseIP("192.0.2.1")}},
+			"host-2.dynamic.example.net": {{IP: net.ParseIP("192.0.2.2")}},
+			"9.113.0.203.bl.example.com": {{IP: net.ParseIP("127.0.0.2")}},
+		},
+	})
+	defer func() {
+		backends.SetResolver(resolver)
+	}()
+	p, err := newPolicy(&ServerConfig{AuthRequired: true, Policy: PolicyConfig{
+		Lists: map[string][]string{"trusted": {"10.0.0.0/8", "2001:db8::1"}},
+		Rules: []PolicyRuleConfig{
+			{Stage: "connect", If: []string{"list:trusted"}, Action: "accept"},
+			{Stage: "connect", If: []string{"dnsbl:bl.example.com"}, Action: "reject", Message: "Listed"},
+			{Stage: "connect", If: []string{"rdns:none"}, Score: 3},
+			{Stage: "connect", If: []string{"rdns:mismatch"}, Score: 2},
+			{Stage: "connect", If: []string{"rdns:*.dynamic.*"}, Score: 2},
+			{Stage: "helo", If: []string{`helo:\[*`}, Score: 1},
+			{Stage: "mail", If: []string{"sender:*@spam.example"}, Score: 5},
+			{Stage: "rcpt", If: []string{"rcpt:abuse@*"}, Action: "accept"},
+			{Stage: "rcpt,data", If: []string{"!tls"}, Score: 1},
+		},
+		TarpitScore:   2,
+		TempfailScore: 5,
+		RejectScore:   8,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authed := func(ip string) *PolicyContext {
+		return &PolicyContext{IP: net.ParseIP(ip), Authenticated: true}
+	}
+
+	// the required rule from auth_required applies even to trusted clients
+	trusted := &PolicyContext{IP: net.ParseIP("10.1.2.3")}
+	if d := evaluatePolicy(p, trusted, PolicyConnect); d.action != PolicyAccept || !trusted.accepted {
+		t.Error("expected the trusted client to be accepted, got", d)
+	}
+	if d := evaluatePolicy(p, trusted, PolicyRcpt); d.action != PolicyReject || d.rule != "auth_required" {
+		t.Error("expected auth_required to reject the trusted client, got", d)
+	}
+	if d := evaluatePolicy(p, authed("2001:db8::1"), PolicyConnect); d.action != PolicyAccept {
+		t.Error("expected the trusted IPv6 client to be accepted, got", d)
+	}
+
+	if d := evaluatePolicy(p, authed("203.0.113.9"), PolicyConnect); d.action != PolicyReject || d.message != "Listed" {
+		t.Error("expected the listed client to be rejected, got", d)
+	}
+	if r := (policyDecision{action: PolicyReject, message: "Listed"}).response(PolicyConnect); r.String() != "554 5.7.1 Listed" {
+		t.Error("unexpected response", r)
+	}
+	if r := (policyDecision{action: PolicyTempfail}).response(PolicyConnect); !strings.HasPrefix(r.String(), "421 4.7.1") {
+		t.Error("unexpected response", r)
+	}
+
+	good := authed("192.0.2.1")
+	if d := evaluatePolicy(p, good, PolicyConnect); d.action != "" {
+		t.Error("expected the forward confirmed client through, got", d)
+	}
+	// the score of the mail stage counts for the transaction, the rcpt score for the command
+	good.MailFrom = mail.Address{User: "bob", Host: "spam.example"}
+	if d := evaluatePolicy(p, good, PolicyMail); d.action != PolicyTempfail || d.score != 5 {
+		t.Error("expected the sender to be tempfailed, got", d)
+	}
+	good.Rcpt = mail.Address{User: "user", Host: "example.com"}
+	if d := evaluatePolicy(p, good, PolicyRcpt); d.score != 6 {
+		t.Error("expected the rcpt score to be added, got", d)
+	}
+	if d := evaluatePolicy(p, good, PolicyRcpt); d.score != 6 {
+		t.Error("expected the rcpt score to count once, got", d)
+	}
+	good.Rcpt = mail.Address{User: "abuse", Host: "example.com"}
+	if d := evaluatePolicy(p, good, PolicyRcpt); d.action != PolicyAccept {
+		t.Error("expected the abuse address to be accepted, got", d)
+	}
+
+	dynamic := authed("192.0.2.2")
+	dynamic.Helo = "[192.0.2.2]"
+	if d := evaluatePolicy(p, dynamic, PolicyConnect); d.action != PolicyTarpit || d.score != 2 {
+		t.Error("expected the dynamic client to be tarpitted, got", d)
+	}
+	if d := evaluatePolicy(p, dynamic, PolicyHelo); d.action != PolicyTarpit || d.score != 3 {
+		t.Error("expected the helo score to be added, got", d)
+	}
+	unknown := authed("198.51.100.7")
+	if d := evaluatePolicy(p, unknown, PolicyConnect); d.score != 5 || d.action != PolicyTempfail {
+		t.Error("expected the client without rDNS to be tempfailed, got", d)
+	}
+
+	for _, bad := range []PolicyRuleConfig{
+		{Stage: "quit"},
+		{Stage: "connect", Action: "drop"},
+		{Stage: "connect", If: []string{"nosuch:thing"}},
+		{Stage: "connect", If: []string{"list:missing"}},
+		{Stage: "connect", If: []string{"cidr:10.0.0.0/33"}},
+		{Stage: "connect", If: []string{"rate:ten/1m"}},
+		{Stage: "connect", If: []string{"country:NL"}},
+		{Stage: "connect", If: []string{"helo:["}},
+	} {
+		if _, err := newPolicy(&ServerConfig{Policy: PolicyConfig{Rules: []PolicyRuleConfig{bad}}}); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
+
+func TestPolicyDNSBL(t *testing.T) {
+	resolver := backends.Resolver()
+	r := &policyResolver{
+		a: map[string][]net.IPAddr{
+			"1.2.0.192.zen.example.org":   {{IP: net.ParseIP("127.0.0.4")}},
+			"1.2.0.192.score.example.org": {{IP: net.ParseIP("127.0.0.2")}},
+			"2.2.0.192.zen.example.org":   {{IP: net.ParseIP("127.0.0.10")}},
+			"2.2.0.192.score.example.org": {{IP: net.ParseIP("127.0.0.2")}},
+			// refused, not a listing
+			"3.2.0.192.zen.example.org": {{IP: net.ParseIP("127.255.255.254")}},
+		},
+		slow: "slow.example.org",
+	}
+	backends.SetResolver(r)
+	defer func() {
+		backends.SetResolver(resolver)
+	}()
+	p, err := newPolicy(&ServerConfig{Policy: PolicyConfig{
+		Rules: []PolicyRuleConfig{
+			{Stage: "connect", If: []string{"cidr:10.0.0.0/8"}, Action: "accept"},
+			{Stage: "helo", If: []string{"dnsbl:Zen.Example.org."}, Score: 1},
+		},
+		DNSBL: []DNSBLConfig{
+			{Zone: "zen.example.org", Action: "reject", Message: "Listed by zen", Answers: []string{"127.0.0.2", "127.0.0.4"}},
+			{Zone: "score.example.org", Weight: 3},
+			{Zone: "slow.example.org", Weight: 10},
+		},
+		DNSBLTimeout:  "50ms",
+		TempfailScore: 3,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("192.0.2.1")}, PolicyConnect); d.action != PolicyReject ||
+		d.rule != "dnsbl:zen.example.org" || d.message != "Listed by zen" {
+		t.Error("expected the listed client to be rejected, got", d)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("expected the slow list to be given up on, waited", elapsed)
+	}
+	// 127.0.0.10 isn't one of the answers that reject, the other list scores it
+	c := &PolicyContext{IP: net.ParseIP("192.0.2.2")}
+	if d := evaluatePolicy(p, c, PolicyConnect); d.action != PolicyTempfail || d.score != 3 {
+		t.Error("expected the client to be tempfailed by its score, got", d)
+	}
+	// the condition uses the answers of the connect stage
+	lookups := atomic.LoadInt32(&r.lookups)
+	if d := evaluatePolicy(p, c, PolicyHelo); d.score != 4 || atomic.LoadInt32(&r.lookups) != lookups {
+		t.Error("expected the helo rule to reuse the answer, got", d, atomic.LoadInt32(&r.lookups)-lookups)
+	}
+	// the processors get the answers from the session
+	session := mail.NewSession()
+	c.share(session)
+	if v, _ := session.Get(mail.SessionDNSBL); fmt.Sprint(v) != "map[score.example.org:true zen.example.org:true]" {
+		t.Error("expected the answers in the session, got", v)
+	}
+	if _, ok := session.Get(mail.SessionRDNS); ok {
+		t.Error("expected no rdns in the session, it wasn't looked up")
+	}
+	// the answers are cached for the next connections
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("192.0.2.2")}, PolicyConnect); d.score != 3 ||
+		atomic.LoadInt32(&r.lookups) != lookups+1 {
+		t.Error("expected only the slow list to be queried again, got", d, atomic.LoadInt32(&r.lookups)-lookups)
+	}
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("192.0.2.3")}, PolicyConnect); d.action != "" {
+		t.Error("expected the error code to be ignored, got", d)
+	}
+	before := atomic.LoadInt32(&r.lookups)
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("10.0.0.1")}, PolicyConnect); d.action != PolicyAccept ||
+		atomic.LoadInt32(&r.lookups) != before {
+		t.Error("expected the trusted client to be accepted without lookups, got", d)
+	}
+
+	for _, bad := range []DNSBLConfig{
+		{Weight: 1},
+		{Zone: "zen.example.org", Action: "tarpit"},
+		{Zone: "zen.example.org", Answers: []string{"127.0.0"}},
+	} {
+		if _, err := newPolicy(&ServerConfig{Policy: PolicyConfig{DNSBL: []DNSBLConfig{bad}}}); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+	if _, err := newPolicy(&ServerConfig{Policy: PolicyConfig{DNSBLTimeout: "soon"}}); err == nil {
+		t.Error("expected an error for the timeout")
+	}
+}
+
+func TestPolicyRate(t *testing.T) {
+	p, err := newPolicy(&ServerConfig{Policy: PolicyConfig{
+		Rules: []PolicyRuleConfig{{Stage: "connect", If: []string{"!cidr:10.0.0.0/8", "rate:2/1h"}, Action: "tempfail"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("192.0.2.1")}, PolicyConnect)
+		if (i <= 2) != (d.action == "") {
+			t.Error("unexpected decision for connection", i, d)
+		}
+	}
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("192.0.2.2")}, PolicyConnect); d.action != "" {
+		t.Error("expected another address to be counted apart, got", d)
+	}
+	for i := 0; i < 5; i++ {
+		if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("10.0.0.1")}, PolicyConnect); d.action != "" {
+			t.Error("expected the excluded network not to be limited, got", d)
+		}
+	}
+}
+
+func TestPolicyGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "geoip.csv")
+	data := "# network,country\n198.51.100.0/24,nl\n192.0.2.0/25,DE\n2001:db8::/32,FR\n203.0.113.7,US\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := loadGeoIP(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, country := range map[string]string{
+		"198.51.100.200": "NL",
+		"192.0.2.1":      "DE",
+		"192.0.2.200":    "",
+		"2001:db8::5":    "FR",
+		"203.0.113.7":    "US",
+		"203.0.113.8":    "",
+		"10.0.0.1":       "",
+	} {
+		if c := table.country(net.ParseIP(ip)); c != country {
+			t.Error("expected", ip, "to be in", country, "got", c)
+		}
+	}
+	p, err := newPolicy(&ServerConfig{Policy: PolicyConfig{
+		GeoIPFile: file,
+		Rules:     []PolicyRuleConfig{{Stage: "connect", If: []string{"country:nl,fr"}, Action: "reject"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("2001:db8::1")}, PolicyConnect); d.action != PolicyReject {
+		t.Error("expected the client from FR to be rejected, got", d)
+	}
+	if d := evaluatePolicy(p, &PolicyContext{IP: net.ParseIP("192.0.2.1")}, PolicyConnect); d.action != "" {
+		t.Error("expected the client from DE through, got", d)
+	}
+	if dnsblName(net.ParseIP("2001:db8::1"), "bl.example.com.") !=
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example.com" {
+		t.Error("unexpected IPv6 DNSBL name", dnsblName(net.ParseIP("2001:db8::1"), "bl.example.com."))
+	}
+}
+
+func TestPolicyServer(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface: "127.0.0.1:2526",
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+		Policy: PolicyConfig{
+			Rules: []PolicyRuleConfig{
+				{Stage: "connect", If: []string{"cidr:127.0.0.2"}, Action: "reject", Message: "Go away"},
+				{Stage: "helo", If: []string{"helo:*.invalid"}, Action: "tempfail"},
+				{Stage: "rcpt", If: []string{"rcpt:blocked@*"}, Action: "reject"},
+			},
+		},
+	})
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	dial := func(localIP string) (net.Conn, *bufio.Reader, string) {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+		conn, err := dialer.Dial("tcp", "127.0.0.1:2526")
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := bufio.NewReader(conn)
+		line, _ := in.ReadString('\n')
+		return conn, in, line
+	}
+	conn, _, line := dial("127.0.0.2")
+	if !strings.HasPrefix(line, "554 5.7.1 Go away") {
+		t.Error("expected the client to be rejected at the connect stage, got", line)
+	}
+	_ = conn.Close()
+
+	conn, in, line := dial("127.0.0.1")
+	defer func() {
+		_ = conn.Close()
+	}()
+	if !strings.HasPrefix(line, "220") {
+		t.Fatal("expected a greeting, got", line)
+	}
+	for _, step := range [][2]string{
+		{"HELO host.invalid", "451 4.7.1"},
+		{"HELO mail.example.org", "250"},
+		{"MAIL FROM:<bob@example.org>", "250"},
+		{"RCPT TO:<blocked@example.com>", "554 5.7.1"},
+		{"RCPT TO:<user@example.com>", "250"},
+	} {
+		if _, err := conn.Write([]byte(step[0] + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, _ := in.ReadString('\n')
+		if !strings.HasPrefix(line, step[1]) {
+			t.Error("expected", step[1], "for", step[0], "got", line)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 var (
 	ErrPoolShuttingDown = errors.New("server pool: shutting down")
+	ErrPoolBusy         = errors.New("server pool: too many connections")
 )
 
 // a struct can be pooled if it has the following interface
@@ -36,6 +37,8 @@ type Pool struct {
 	isShuttingDownFlg atomic.Value
 	poolGuard         sync.Mutex
 	ShutdownChan      chan int
+	// fair shares the clients between the sources of the connections, nil when it's not enabled
+	fair *fairAdmission
 }
 
 type lentClients struct {
@@ -82,6 +85,9 @@ func (p *Pool) ShutdownState() {
 	defer p.poolGuard.Unlock()
 	p.isShuttingDownFlg.Store(true) // no more borrowing
 	p.ShutdownChan <- 1             // release any waiting p.sem
+	if p.fair != nil {
+		p.fair.shutdown()
+	}
 
 	// set a low timeout (let the clients finish whatever the're doing)
 	p.activeClients.mapAll(func(p Poolable) {
@@ -92,6 +98,29 @@ func (p *Pool) ShutdownState() {
 
 }
 
+// Drain stops the borrowing, so that the active clients quit after their current transaction,
+// and waits up to grace for them. Returns false if some clients are still active
+func (p *Pool) Drain(grace time.Duration) bool {
+	p.poolGuard.Lock()
+	p.isShuttingDownFlg.Store(true)
+	if p.fair != nil {
+		// the clients waiting for a slot haven't started a session
+		p.fair.shutdown()
+	}
+	p.poolGuard.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.activeClients.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
 func (p *Pool) ShutdownWait() {
 	p.poolGuard.Lock() // ensure no other thread is in the borrowing now
 	defer p.poolGuard.Unlock()
@@ -100,6 +129,9 @@ func (p *Pool) ShutdownWait() {
 		// drain
 		<-p.ShutdownChan
 	}
+	if p.fair != nil {
+		p.fair.reopen()
+	}
 	p.isShuttingDownFlg.Store(false)
 }
 
@@ -128,6 +160,9 @@ func (p *Pool) GetActiveClientsCount() int {
 
 // Borrow a Client from the pool. Will block if len(activeClients) > maxClients
 func (p *Pool) Borrow(conn net.Conn, clientID uint64, logger log.Logger, ep *mail.Pool) (Poolable, error) {
+	if p.fair != nil {
+		return p.borrowFair(conn, clientID, logger, ep)
+	}
 	p.poolGuard.Lock()
 	defer p.poolGuard.Unlock()
 
@@ -153,8 +188,39 @@ func (p *Pool) Borrow(conn net.Conn, clientID uint64, logger log.Logger, ep *mai
 	return c, nil
 }
 
+// borrowFair is like Borrow, but waits for the fair admission to give the client a slot.
+// Returns ErrPoolBusy if the client was turned away
+func (p *Pool) borrowFair(conn net.Conn, clientID uint64, logger log.Logger, ep *mail.Pool) (Poolable, error) {
+	var c Poolable
+	if p.IsShuttingDown() {
+		return c, ErrPoolShuttingDown
+	}
+	if !p.fair.acquire(clientID, connSource(conn)) {
+		if p.IsShuttingDown() {
+			return c, ErrPoolShuttingDown
+		}
+		return c, ErrPoolBusy
+	}
+	p.poolGuard.Lock()
+	defer p.poolGuard.Unlock()
+	if p.IsShuttingDown() {
+		p.fair.release(clientID)
+		return c, ErrPoolShuttingDown
+	}
+	p.sem <- true // doesn't block, the admission keeps the clients within the pool size
+	select {
+	case c = <-p.pool:
+		c.init(conn, clientID, ep)
+	default:
+		c = NewClient(conn, clientID, logger, ep)
+	}
+	p.activeClientsAdd(c)
+	return c, nil
+}
+
 // Return returns a Client back to the pool.
 func (p *Pool) Return(c Poolable) {
+	clientID := c.getID()
 	p.activeClientsRemove(c)
 	select {
 	case p.pool <- c:
@@ -163,6 +229,9 @@ func (p *Pool) Return(c Poolable) {
 	}
 
 	<-p.sem // make room for the next serving client
+	if p.fair != nil {
+		p.fair.release(clientID)
+	}
 }
 
 func (p *Pool) activeClientsAdd(c Poolable) {
@@ -0,0 +1,99 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// Preflight checks that the daemon's config can serve mail before it starts: each enabled server
+// and the admin API can listen, and load their certificates, each processor initializes, and a test
+// message goes through the validate_process and save_process. The test message has the
+// backends.PreflightHeader, and is sent to postmaster at the primary_mail_host.
+// The listeners are closed right away. It must not be called once the daemon started
+func (d *Daemon) Preflight() []backends.PreflightCheck {
+	if d.Config == nil {
+		d.Config = &AppConfig{}
+	}
+	var checks []backends.PreflightCheck
+	if err := d.configureDefaults(); err != nil {
+		// eg. a certificate that can't be read, the other components are still checked
+		checks = append(checks, backends.PreflightCheck{Component: "config", Err: err})
+		if d.Backend == nil {
+			_ = d.Config.setBackendDefaults()
+		}
+	}
+	if d.Logger == nil {
+		d.Logger, _ = log.GetLogger(log.OutputOff.String(), d.Config.LogLevel)
+	}
+	for i := range d.Config.Servers {
+		sc := &d.Config.Servers[i]
+		if !sc.IsEnabled {
+			continue
+		}
+		checks = append(checks, backends.PreflightCheck{
+			Component: "server " + sc.ListenInterface,
+			Err:       preflightListen(sc.ListenInterface),
+		})
+		if (sc.TLS.StartTLSOn || sc.TLS.AlwaysOn) && (len(sc.TLS.ACMEHosts) == 0 || sc.TLS.PublicKeyFile != "") {
+			_, err := tls.LoadX509KeyPair(sc.TLS.PublicKeyFile, sc.TLS.PrivateKeyFile)
+			if err != nil {
+				err = fmt.Errorf("error while loading the certificate: %s", err)
+			}
+			checks = append(checks, backends.PreflightCheck{Component: "tls " + sc.ListenInterface, Err: err})
+		}
+	}
+	if d.Config.Admin.ListenInterface != "" {
+		checks = append(checks, backends.PreflightCheck{
+			Component: "admin " + d.Config.Admin.ListenInterface,
+			Err:       preflightListen(d.Config.Admin.ListenInterface),
+		})
+	}
+	if d.Backend != nil {
+		// a backend given by the package user is not checked
+		return checks
+	}
+	backends.Svc.SetMainlog(d.Logger)
+	checks = append(checks, backends.PreflightProcessors(d.Config.BackendConfig)...)
+	return append(checks, d.preflightMessage()...)
+}
+
+// preflightListen binds the address, then closes the listener
+func preflightListen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// preflightMessage starts the backend and sends a test message through it
+func (d *Daemon) preflightMessage() []backends.PreflightCheck {
+	validate := backends.PreflightCheck{Component: "validate_process"}
+	save := backends.PreflightCheck{Component: "save_process"}
+	b, err := backends.New(d.Config.BackendConfig, d.Logger)
+	if err == nil {
+		err = b.Start()
+	}
+	if err != nil {
+		save.Err = fmt.Errorf("the backend did not start: %s", err)
+		return []backends.PreflightCheck{save}
+	}
+	defer func() {
+		_ = b.Shutdown()
+	}()
+	host, _ := d.Config.BackendConfig["primary_mail_host"].(string)
+	to := mail.Address{User: "postmaster", Host: host}
+	e := backends.NewPreflightEnvelope(mail.Address{User: "preflight", Host: host}, to)
+	if err := b.ValidateRcpt(e); err != nil {
+		validate.Err = fmt.Errorf("%s was refused: %s", to.String(), err)
+	}
+	if result := b.Process(e); result.Code() < 200 || result.Code() > 299 {
+		save.Err = fmt.Errorf("the test message was not saved: %s", result)
+	}
+	return []backends.PreflightCheck{validate, save}
+}
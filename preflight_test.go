@@ -0,0 +1,88 @@
+package guerrilla
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestPreflight(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	// the second server's port is taken
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = taken.Close()
+	}()
+	var saved *mail.Envelope
+	d := Daemon{Config: &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"example.com"},
+		Servers: []ServerConfig{
+			{ListenInterface: "127.0.0.1:2527", IsEnabled: true},
+			{ListenInterface: taken.Addr().String(), IsEnabled: true},
+			{ListenInterface: "127.0.0.1:2528", IsEnabled: true,
+				TLS: ServerTLSConfig{StartTLSOn: true, PublicKeyFile: "tests/none.pem", PrivateKeyFile: "tests/none.pem"}},
+		},
+		BackendConfig: backends.BackendConfig{
+			"save_process":       "HeadersParser|Header|Keep",
+			"validate_process":   "Keep",
+			"process_chains":     []interface{}{"lmtp=LMTP"},
+			"primary_mail_host":  "mx.example.com",
+			"log_received_mails": true,
+		},
+	}}
+	d.AddProcessor("Keep", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					saved = e
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	results := make(map[string]string)
+	for _, check := range d.Preflight() {
+		results[check.Component] = "pass"
+		if check.Err != nil {
+			results[check.Component] = check.Err.Error()
+		}
+	}
+	for component, expect := range map[string]string{
+		"config":                          "cannot use TLS config for [127.0.0.1:2528]",
+		"server 127.0.0.1:2527":           "pass",
+		"server " + taken.Addr().String(): "address already in use",
+		"server 127.0.0.1:2528":           "pass",
+		"tls 127.0.0.1:2528":              "error while loading the certificate",
+		"processor headersparser":         "pass",
+		"processor keep":                  "pass",
+		"processor lmtp":                  "lmtp_address",
+		"validate_process":                "the backend did not start",
+		"save_process":                    "the backend did not start",
+	} {
+		if got, ok := results[component]; !ok && expect != "the backend did not start" {
+			t.Error("expected a check of", component, "got", results)
+		} else if ok && !strings.Contains(got, expect) {
+			t.Errorf("expected %s to be %q, got %q", component, expect, got)
+		}
+	}
+
+	// without the chain that fails, the test message goes through
+	d.Config.BackendConfig["process_chains"] = []interface{}{}
+	for _, check := range d.Preflight() {
+		if check.Err != nil && strings.HasPrefix(check.Component, "processor") ||
+			check.Err != nil && strings.HasSuffix(check.Component, "_process") {
+			t.Error(check.Component, "failed:", check.Err)
+		}
+	}
+	if saved == nil || saved.Header.Get(backends.PreflightHeader) != "yes" || saved.RcptTo[0].String() != "postmaster@mx.example.com" {
+		t.Error("expected the test message to be saved, got", saved)
+	}
+}
@@ -0,0 +1,199 @@
+package guerrilla
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artpar/go-guerrilla/ipaddr"
+)
+
+// ProxyProtocolConfig is for servers behind a load balancer, such as HAProxy or an AWS NLB, that
+// passes the address of the client with the PROXY protocol, version 1 or 2
+type ProxyProtocolConfig struct {
+	// On expects each connection to start with a PROXY header, the client's address is taken from it
+	On bool `json:"on,omitempty"`
+	// Allowed are the addresses or networks of the proxies, eg. "10.0.0.0/8". Connections from
+	// other sources are closed. Required, as the header could claim any address
+	Allowed []string `json:"allowed,omitempty"`
+	// Timeout is how long the proxy has to send the header, eg. "5s", which is the default
+	Timeout string `json:"timeout,omitempty"`
+}
+
+const defaultProxyProtocolTimeout = time.Second * 5
+
+// proxyV1MaxLength is the longest version 1 header, with the CRLF
+const proxyV1MaxLength = 107
+
+// proxyV2Signature starts a version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocol reads the PROXY headers of a server's connections
+type proxyProtocol struct {
+	config  ProxyProtocolConfig
+	allowed []*net.IPNet
+	timeout time.Duration
+}
+
+// newProxyProtocol returns nil when the PROXY protocol isn't on
+func newProxyProtocol(config ProxyProtocolConfig) (*proxyProtocol, error) {
+	if !config.On {
+		return nil, nil
+	}
+	if len(config.Allowed) == 0 {
+		return nil, errors.New("proxy_protocol: allowed needs the addresses of the proxies")
+	}
+	p := &proxyProtocol{config: config, timeout: defaultProxyProtocolTimeout}
+	for _, entry := range config.Allowed {
+		ipNet, err := ipaddr.Network(entry)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_protocol: %s", err)
+		}
+		p.allowed = append(p.allowed, ipNet)
+	}
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("proxy_protocol: invalid timeout %q", config.Timeout)
+		}
+		p.timeout = d
+	}
+	return p, nil
+}
+
+// accept reads the header of a connection from an allowed proxy. The returned connection has the
+// client's address as its remote address, or the proxy's when the header has none, eg. for the
+// proxy's health checks
+func (p *proxyProtocol) accept(conn net.Conn) (net.Conn, error) {
+	ip := ipaddr.Parse(getRemoteAddr(conn))
+	allowed := false
+	for _, ipNet := range p.allowed {
+		if ip != nil && ipNet.Contains(ip) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%s is not an allowed proxy", conn.RemoteAddr())
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(p.timeout)); err != nil {
+		return nil, err
+	}
+	addr, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY header from %s: %s", conn.RemoteAddr(), err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: addr}, nil
+}
+
+// readProxyHeader reads a version 1 or 2 header, and nothing after it. The address is nil
+// when the header has none
+func readProxyHeader(r io.Reader) (*net.TCPAddr, error) {
+	// the shortest header, "PROXY UNKNOWN\r\n", is longer than the signature of version 2
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(start, []byte("PROXY ")) {
+		return nil, errors.New("no PROXY header")
+	}
+	// read a byte at a time, so that the SMTP commands after the line are left
+	line := append(make([]byte, 0, proxyV1MaxLength), start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errors.New("the header is too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	return parseProxyV1(string(line[:len(line)-2]))
+}
+
+// parseProxyV1 parses a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25"
+func parseProxyV1(line string) (*net.TCPAddr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("unexpected source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a version 2 header, after the signature
+func readProxyV2(r io.Reader) (*net.TCPAddr, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, fmt.Errorf("unexpected version %d", head[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch head[0] & 0x0f {
+	case 0:
+		// LOCAL, the proxy's own connection
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unexpected command %d", head[0]&0x0f)
+	}
+	// the address family and the transport, the addresses of other families are ignored, and so
+	// are the TLVs after the addresses
+	switch head[1] {
+	case 0x11:
+		// TCP over IPv4: the source and destination addresses, then their ports
+		if len(body) < 12 {
+			return nil, errors.New("the IPv4 addresses are cut short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("the IPv6 addresses are cut short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
+
+// proxyConn is a connection from a proxy, whose remote address is the client's
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,144 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a version 2 header with the TCP source and destination, and a TLV after them
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	var addrs []byte
+	if ip := src.IP.To4(); ip != nil {
+		b.Write([]byte{0x21, 0x11})
+		addrs = append(append(addrs, ip...), dst.IP.To4()...)
+	} else {
+		b.Write([]byte{0x21, 0x21})
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	// PP2_TYPE_NOOP
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0x00)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	b.Write(length)
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 25}
+	tests := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", addr: "192.0.2.1:56324"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", addr: "[2001:db8::1]:56324"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"},
+		{header: string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, dst)), addr: "192.0.2.1:56324"},
+		{header: string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 25})), addr: "[2001:db8::1]:56324"},
+		// LOCAL, eg. a health check
+		{header: string(proxyV2Signature) + "\x20\x00\x00\x00"},
+		{header: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 99999 25\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 " + strings.Repeat("1", 80) + "\r\n", err: true},
+		{header: "EHLO mail.example.com\r\n", err: true},
+		{header: string(proxyV2Signature) + "\x11\x11\x00\x00", err: true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "EHLO mail.example.com\r\n"))
+		addr, err := readProxyHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %v", test.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.header, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr {
+			t.Errorf("expected %q for %q, got %q", test.addr, test.header, got)
+		}
+		// the commands after the header are left
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "EHLO mail.example.com\r\n" {
+			t.Errorf("expected the command after %q to be left, got %q", test.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocolAccept(t *testing.T) {
+	if _, err := newProxyProtocol(ProxyProtocolConfig{On: true}); err == nil {
+		t.Error("expected an error when no proxies are allowed")
+	}
+	if p, err := newProxyProtocol(ProxyProtocolConfig{Allowed: []string{"10.0.0.0/8"}}); p != nil || err != nil {
+		t.Error("expected nothing when it's off, got", p, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	// connect sends the header, and returns the server's side of the connection
+	connect := func(header string) net.Conn {
+		go func() {
+			if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+				_, _ = conn.Write([]byte(header))
+				_, _ = ioutil.ReadAll(conn)
+				_ = conn.Close()
+			}
+		}()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	p, err := newProxyProtocol(ProxyProtocolConfig{On: true, Allowed: []string{"127.0.0.0/8"}, Timeout: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := connect("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	proxied, err := p.accept(conn)
+	if err != nil {
+		t.Fatal(err)
+	} else if getRemoteAddr(proxied) != "192.0.2.1" || getRemotePort(proxied) != 56324 {
+		t.Error("expected the client's address, got", proxied.RemoteAddr())
+	}
+	_ = conn.Close()
+
+	// a proxy that doesn't send the header in time
+	p.timeout /= 10
+	conn = connect("")
+	if _, err := p.accept(conn); err == nil {
+		t.Error("expected an error when the header isn't sent")
+	}
+	_ = conn.Close()
+
+	p, err = newProxyProtocol(ProxyProtocolConfig{On: true, Allowed: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = connect("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	if _, err := p.accept(conn); err == nil || !strings.Contains(err.Error(), "not an allowed proxy") {
+		t.Error("expected the connection of a proxy that isn't allowed to be refused, got", err)
+	}
+	_ = conn.Close()
+}
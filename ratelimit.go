@@ -0,0 +1,234 @@
+package guerrilla
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+)
+
+// RateLimitConfig limits how often the clients of a server may connect and send mail. Each IP address and
+// sender has a token bucket that refills evenly over the period, so a burst can use up the bucket at once
+// and the next ones get what has refilled since
+type RateLimitConfig struct {
+	// ConnectionsPerMinute is how many connections an IP address may open in a minute. The connections over
+	// the limit get a 421 and are closed. 0 means no limit
+	ConnectionsPerMinute int `json:"connections_per_minute,omitempty"`
+	// ConnectionBurst is the size of the bucket of the connections, defaults to ConnectionsPerMinute
+	ConnectionBurst int `json:"connection_burst,omitempty"`
+	// MessagesPerHour is how many messages a sender may send in an hour. The sender is the user that logged
+	// in with AUTH, otherwise the MAIL FROM address. The MAIL FROM commands over the limit get a 450. Bounces
+	// are not limited. 0 means no limit
+	MessagesPerHour int `json:"messages_per_hour,omitempty"`
+	// MessageBurst is the size of the bucket of the messages, defaults to MessagesPerHour
+	MessageBurst int `json:"message_burst,omitempty"`
+	// RedisInterface is the <host>:<port> of a redis that keeps the buckets, so that the nodes of a cluster
+	// share them. When it can't be reached, each node counts on its own until it's back
+	RedisInterface string `json:"redis_interface,omitempty"`
+	// RedisKeyPrefix is prepended to the keys of the buckets, default "ratelimit:"
+	RedisKeyPrefix string `json:"redis_key_prefix,omitempty"`
+}
+
+const (
+	defaultRateLimitKeyPrefix = "ratelimit:"
+	// rateLimitRedisTimeout limits how long connecting to redis may take
+	rateLimitRedisTimeout = time.Second * 2
+	// rateLimitSweepInterval is how often the full buckets are dropped from memory
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateBucket is a token bucket. It holds up to burst tokens, and gets rate tokens more each second
+type rateBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+// refill adds the tokens since the last time the bucket was used
+func (b *rateBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// memoryRateStore keeps the buckets of a node
+type memoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{buckets: make(map[string]*rateBucket)}
+}
+
+// take takes a token from the bucket of the key, returning false when it's empty
+func (m *memoryRateStore) take(key string, rate float64, burst int, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.swept) >= rateLimitSweepInterval {
+		m.sweep(now)
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	b.rate, b.burst = rate, float64(burst)
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets that have filled up, they're the same as new ones
+func (m *memoryRateStore) sweep(now time.Time) {
+	m.swept = now
+	for key, b := range m.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateBucketScript is the token bucket of memoryRateStore, in a hash of redis. The hash expires once the
+// bucket would be full again
+const rateBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * rate)
+	last = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(last))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return allowed
+`
+
+// redisRateStore keeps the buckets in redis, for all the nodes
+type redisRateStore struct {
+	address string
+	prefix  string
+	mu      sync.Mutex
+	conn    backends.RedisConn
+}
+
+// take takes a token from the bucket of the key in redis, returning false when it's empty
+func (r *redisRateStore) take(key string, rate float64, burst int, now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		conn, err := backends.RedisDialer("tcp", r.address, backends.RedisDialTimeout(rateLimitRedisTimeout))
+		if err != nil {
+			return false, err
+		}
+		r.conn = conn
+	}
+	reply, err := r.conn.Do("EVAL", rateBucketScript, 1, r.prefix+key,
+		strconv.FormatFloat(rate, 'g', -1, 64), burst,
+		strconv.FormatFloat(float64(now.UnixNano())/1e9, 'f', 3, 64))
+	if err != nil {
+		// dial again for the next one
+		_ = r.conn.Close()
+		r.conn = nil
+		return false, err
+	}
+	allowed, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	return allowed == 1, nil
+}
+
+func (r *redisRateStore) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		_ = r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// rateLimiter applies the RateLimitConfig of a server
+type rateLimiter struct {
+	config RateLimitConfig
+	local  *memoryRateStore
+	// redis is nil when the buckets are kept in memory
+	redis *redisRateStore
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	if config.ConnectionsPerMinute < 0 || config.ConnectionBurst < 0 {
+		return nil, fmt.Errorf("rate_limit: connections_per_minute and connection_burst can't be negative")
+	}
+	if config.MessagesPerHour < 0 || config.MessageBurst < 0 {
+		return nil, fmt.Errorf("rate_limit: messages_per_hour and message_burst can't be negative")
+	}
+	rl := &rateLimiter{config: config, local: newMemoryRateStore()}
+	if config.RedisInterface != "" {
+		prefix := config.RedisKeyPrefix
+		if prefix == "" {
+			prefix = defaultRateLimitKeyPrefix
+		}
+		rl.redis = &redisRateStore{address: config.RedisInterface, prefix: prefix}
+	}
+	return rl, nil
+}
+
+// take takes a token from the bucket of the key, which gets limit tokens per period. When redis can't be
+// reached, the bucket in memory is used, and the error is returned with its answer
+func (rl *rateLimiter) take(key string, limit, burst int, period time.Duration, now time.Time) (bool, error) {
+	if burst == 0 {
+		burst = limit
+	}
+	rate := float64(limit) / period.Seconds()
+	if rl.redis != nil {
+		allowed, err := rl.redis.take(key, rate, burst, now)
+		if err == nil {
+			return allowed, nil
+		}
+		return rl.local.take(key, rate, burst, now), err
+	}
+	return rl.local.take(key, rate, burst, now), nil
+}
+
+// allowConnection returns false when the IP address has used up its connections
+func (rl *rateLimiter) allowConnection(ip string, now time.Time) (bool, error) {
+	if rl.config.ConnectionsPerMinute == 0 {
+		return true, nil
+	}
+	return rl.take("conn:"+ip, rl.config.ConnectionsPerMinute, rl.config.ConnectionBurst, time.Minute, now)
+}
+
+// allowMessage returns false when the sender has used up its messages. The sender is "user:<login>"
+// for the clients that logged in, otherwise "from:<address>"
+func (rl *rateLimiter) allowMessage(sender string, now time.Time) (bool, error) {
+	if rl.config.MessagesPerHour == 0 {
+		return true, nil
+	}
+	return rl.take(strings.ToLower(sender), rl.config.MessagesPerHour, rl.config.MessageBurst, time.Hour, now)
+}
+
+func (rl *rateLimiter) close() {
+	if rl.redis != nil {
+		rl.redis.close()
+	}
+}
@@ -0,0 +1,165 @@
+package guerrilla
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{ConnectionsPerMinute: 2, MessagesPerHour: 60, MessageBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	for i := 1; i <= 3; i++ {
+		if ok, _ := rl.allowConnection("192.0.2.1", now); ok != (i <= 2) {
+			t.Error("unexpected decision for connection", i, ok)
+		}
+	}
+	if ok, _ := rl.allowConnection("192.0.2.2", now); !ok {
+		t.Error("expected another address to have its own bucket")
+	}
+	// a token every 30 seconds
+	if ok, _ := rl.allowConnection("192.0.2.1", now.Add(time.Second*29)); ok {
+		t.Error("expected the bucket to be empty still")
+	}
+	if ok, _ := rl.allowConnection("192.0.2.1", now.Add(time.Second*30)); !ok {
+		t.Error("expected a token to have refilled")
+	}
+
+	// a burst of 1, and a message a minute
+	if ok, _ := rl.allowMessage("user:Alice", now); !ok {
+		t.Error("expected the first message to be allowed")
+	}
+	if ok, _ := rl.allowMessage("user:alice", now.Add(time.Second)); ok {
+		t.Error("expected the sender to be limited, ignoring the case")
+	}
+	if ok, _ := rl.allowMessage("user:alice", now.Add(time.Minute)); !ok {
+		t.Error("expected a message to have refilled")
+	}
+
+	// the full buckets are dropped
+	rl.local.sweep(now.Add(time.Hour))
+	if len(rl.local.buckets) != 0 {
+		t.Error("expected the buckets to be swept, got", len(rl.local.buckets))
+	}
+
+	if _, err := newRateLimiter(RateLimitConfig{MessagesPerHour: -1}); err == nil {
+		t.Error("expected a negative limit to be refused")
+	}
+}
+
+// rateLimitTestConn answers EVAL with the reply, or fails
+type rateLimitTestConn struct {
+	reply interface{}
+	err   error
+	keys  []string
+}
+
+func (c *rateLimitTestConn) Close() error {
+	return nil
+}
+
+func (c *rateLimitTestConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName != "EVAL" || len(args) != 6 {
+		return nil, errors.New("unexpected command")
+	}
+	c.keys = append(c.keys, args[2].(string))
+	return c.reply, c.err
+}
+
+func TestRateLimiterRedis(t *testing.T) {
+	conn := &rateLimitTestConn{reply: int64(0)}
+	saved := backends.RedisDialer
+	backends.RedisDialer = func(network, address string, options ...backends.RedisDialOption) (backends.RedisConn, error) {
+		return conn, nil
+	}
+	defer func() {
+		backends.RedisDialer = saved
+	}()
+	rl, err := newRateLimiter(RateLimitConfig{MessagesPerHour: 10, RedisInterface: "127.0.0.1:6379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if ok, err := rl.allowMessage("from:Bob@example.com", now); ok || err != nil {
+		t.Error("expected the shared bucket to be empty, got", ok, err)
+	}
+	if len(conn.keys) != 1 || conn.keys[0] != "ratelimit:from:bob@example.com" {
+		t.Error("unexpected keys", conn.keys)
+	}
+	// the bucket in memory is used while redis fails
+	conn.err = errors.New("connection refused")
+	if ok, err := rl.allowMessage("from:bob@example.com", now); !ok || err == nil {
+		t.Error("expected the local bucket to be used, got", ok, err)
+	}
+}
+
+func TestRateLimitServer(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface: "127.0.0.1:2526",
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+		RateLimit:       RateLimitConfig{ConnectionsPerMinute: 2, MessagesPerHour: 1},
+	})
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	dial := func() (net.Conn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", "127.0.0.1:2526")
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := bufio.NewReader(conn)
+		line, _ := in.ReadString('\n')
+		return conn, in, line
+	}
+	conn, in, line := dial()
+	defer func() {
+		_ = conn.Close()
+	}()
+	if !strings.HasPrefix(line, "220") {
+		t.Fatal("expected a greeting, got", line)
+	}
+	for _, step := range [][2]string{
+		{"HELO mail.example.org", "250"},
+		{"MAIL FROM:<bob@example.org>", "250"},
+		{"RSET", "250"},
+		{"MAIL FROM:<Bob@example.org>", "450 4.7.1"},
+		{"MAIL FROM:<>", "250"},
+		{"RSET", "250"},
+		{"MAIL FROM:<alice@example.org>", "250"},
+	} {
+		if _, err := conn.Write([]byte(step[0] + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, _ := in.ReadString('\n')
+		if !strings.HasPrefix(line, step[1]) {
+			t.Error("expected", step[1], "for", step[0], "got", line)
+		}
+	}
+
+	second, _, line := dial()
+	_ = second.Close()
+	if !strings.HasPrefix(line, "220") {
+		t.Error("expected the second connection to be greeted, got", line)
+	}
+	third, _, line := dial()
+	_ = third.Close()
+	if !strings.HasPrefix(line, "421 4.7.0") {
+		t.Error("expected the third connection to be refused, got", line)
+	}
+}
@@ -0,0 +1,50 @@
+package guerrilla
+
+import (
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// validateDeferredRcpts validates the recipients that were answered before they were validated,
+// see ServerConfig.DeferRcptAfter. The refused ones were answered with a 250, so they are dropped from
+// the transaction and bounced to the sender once the message is accepted. It returns the reply to DATA
+// when the transaction can't go on
+func (s *server) validateDeferredRcpts(client *client) *response.Response {
+	n := client.deferredRcpts
+	all := client.RcptTo
+	var errs []backends.RcptError
+	if v, ok := s.backend().(backends.RcptBatchValidator); ok {
+		errs = v.ValidateRcpts(client.Envelope, n)
+	} else {
+		for i := len(all) - n; i < len(all); i++ {
+			client.RcptTo = all[:i+1]
+			errs = append(errs, s.backend().ValidateRcpt(client.Envelope))
+		}
+		client.RcptTo = all
+	}
+	for _, err := range errs {
+		if err == backends.StorageNotAvailable || err == backends.StorageTooBusy || err == backends.StorageTimeout ||
+			err == backends.Greylisted {
+			// they stay deferred, for the next DATA
+			return response.Canned.ErrorRcptValidation
+		}
+	}
+	first := len(all) - n
+	kept := append(make([]mail.Address, 0, len(all)), all[:first]...)
+	for i, err := range errs {
+		rcpt := all[first+i]
+		if err == nil {
+			kept = append(kept, rcpt)
+			continue
+		}
+		s.log().Infof("dropped the deferred recipient %s: %s", rcpt.String(), err)
+		backends.BounceRcpt(client.Envelope, rcpt, response.Canned.FailRcptCmd.String()+" "+err.Error())
+	}
+	client.RcptTo = kept
+	client.deferredRcpts = 0
+	if len(kept) == 0 {
+		return response.Canned.FailNoValidRecipients
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package guerrilla
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+)
+
+// pickyValidator refuses nobody@, and can't tell for busy@. It records the recipients of the saved email,
+// and passes on the bounces
+var pickyDelivered []string
+var pickyBounces = make(chan string, 1)
+
+var pickyValidator = func() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+			if task == backends.TaskValidateRcpt {
+				switch e.RcptTo[len(e.RcptTo)-1].User {
+				case "nobody":
+					return backends.NewResult(response.Canned.FailRcptCmd), backends.NoSuchUser
+				case "busy":
+					return backends.NewResult(response.Canned.ErrorRcptValidation), backends.StorageTooBusy
+				}
+			} else if task == backends.TaskSaveMail && e.MailFrom.NullPath {
+				pickyBounces <- e.Data.String()
+			} else if task == backends.TaskSaveMail {
+				pickyDelivered = nil
+				for _, rcpt := range e.RcptTo {
+					pickyDelivered = append(pickyDelivered, rcpt.String())
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func TestDeferRcpt(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface: "127.0.0.1:2526",
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+		DeferRcptAfter:  1,
+	})
+	cfg.BackendConfig = backends.BackendConfig{
+		"save_process":       "HeadersParser|Picky",
+		"validate_process":   "Picky",
+		"log_received_mails": true,
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("Picky", pickyValidator)
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2526")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	cmd := func(line, expect string) {
+		if line != "" {
+			if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+				t.Error(err)
+			}
+		}
+		str, err := in.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		} else if !strings.HasPrefix(str, expect) {
+			t.Error("sent", line, "expected", expect, "but got", str)
+		}
+	}
+	cmd("", "220")
+	cmd("HELO host", "250")
+	// the first recipient is validated right away
+	cmd("MAIL FROM:<test@example.com>", "250")
+	cmd("RCPT TO:<nobody@example.com>", "550")
+	cmd("RCPT TO:<a@example.com>", "250")
+	// then they are accepted, and validated with DATA
+	cmd("RCPT TO:<nobody@example.com>", "250")
+	cmd("RCPT TO:<b@example.com>", "250")
+	cmd("DATA", "354")
+	cmd("Subject: Test\r\n\r\nHello\r\n.", "250")
+	if fmt.Sprint(pickyDelivered) != "[a@example.com b@example.com]" {
+		t.Error("expected nobody to be dropped, got", pickyDelivered)
+	}
+	// and bounced, as it was answered with a 250
+	select {
+	case dsn := <-pickyBounces:
+		for _, line := range []string{"To: <test@example.com>", "Final-Recipient: rfc822; nobody@example.com",
+			"Status: 5.1.1", "Subject: Test"} {
+			if !strings.Contains(dsn, line) {
+				t.Error("expected", line, "in the DSN", dsn)
+			}
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("expected nobody to be bounced")
+	}
+
+	// the validation can't tell, the client may try again later
+	cmd("MAIL FROM:<test@example.com>", "250")
+	cmd("RCPT TO:<a@example.com>", "250")
+	cmd("RCPT TO:<busy@example.com>", "250")
+	cmd("DATA", "451 4.")
+	cmd("QUIT", "221")
+}
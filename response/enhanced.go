@@ -130,6 +130,8 @@ type Responses struct {
 	FailSyntaxError              *Response
 	FailReadLimitExceededDataCmd *Response
 	FailMessageSizeExceeded      *Response
+	FailMessageSizeDeclared      *Response
+	FailMailboxFull              *Response
 	FailReadErrorDataCmd         *Response
 	FailPathTooLong              *Response
 	FailInvalidAddress           *Response
@@ -139,17 +141,51 @@ type Responses struct {
 	FailBackendTransaction       *Response
 	FailBackendTimeout           *Response
 	FailRcptCmd                  *Response
+	FailAddressLiteral           *Response
+	FailSourceRoute              *Response
+	FailNonASCIIAddress          *Response
+	// FailNoValidRecipients is the reply to DATA when all the recipients that were validated late were refused
+	FailNoValidRecipients *Response
+	// FailStartTLSRequired refuses MAIL FROM and AUTH before STARTTLS, when the server requires it
+	FailStartTLSRequired *Response
+	// FailExpnNotAllowed is the reply to EXPN when it's off or the client isn't allowed to use it
+	FailExpnNotAllowed *Response
 
 	// The 400's
 	ErrorTooManyRecipients *Response
 	ErrorRelayDenied       *Response
+	ErrorTenantMismatch    *Response
+	ErrorRateLimited       *Response
+	// ErrorConnectionRateLimited closes the connections of an address that connects too often
+	ErrorConnectionRateLimited *Response
+	// ErrorSenderRateLimited refuses MAIL FROM for a sender that has sent too many messages
+	ErrorSenderRateLimited *Response
+	// ErrorGreylisted defers a recipient that was greylisted, the client is let through when it tries again
+	ErrorGreylisted *Response
+	ErrorBudgetExceeded    *Response
 	ErrorShutdown          *Response
+	// ErrorMailboxOverQuota is a tempfail, so that the mail is delivered once the recipient makes room
+	ErrorMailboxOverQuota *Response
+	// ErrorStorageUnavailable is a tempfail for when the storage could not be reached, so the mail is not lost
+	ErrorStorageUnavailable *Response
+	// ErrorTooManyConnections is sent before closing a connection that could not get a slot
+	ErrorTooManyConnections *Response
+	// ErrorTooManyMessages is sent before closing a connection that has sent max_messages_per_session
+	ErrorTooManyMessages *Response
+	// ErrorAuthUnavailable is the reply to AUTH when the credentials could not be checked
+	ErrorAuthUnavailable *Response
+	// ErrorTooManyAuthFailures is sent before closing a connection that failed AUTH too many times
+	ErrorTooManyAuthFailures *Response
+	// ErrorRcptValidation is the reply to DATA when the recipients that were validated late could not be
+	ErrorRcptValidation *Response
 
 	// The 200's
 	SuccessMailCmd       *Response
 	SuccessRcptCmd       *Response
 	SuccessResetCmd      *Response
 	SuccessVerifyCmd     *Response
+	// SuccessVerifiedCmd is the reply to VRFY and EXPN for a valid address, followed by the address
+	SuccessVerifiedCmd   *Response
 	SuccessNoopCmd       *Response
 	SuccessQuitCmd       *Response
 	SuccessDataCmd       *Response
@@ -200,6 +236,12 @@ func init() {
 		Comment:      "Cannot verify user",
 	}
 
+	Canned.SuccessVerifiedCmd = &Response{
+		EnhancedCode: DestinationMailboxAddressValid,
+		BasicCode:    250,
+		Class:        ClassSuccess,
+	}
+
 	Canned.ErrorTooManyRecipients = &Response{
 		EnhancedCode: TooManyRecipients,
 		BasicCode:    452,
@@ -214,6 +256,104 @@ func init() {
 		Comment:      "Error: Relay access denied:",
 	}
 
+	Canned.ErrorTenantMismatch = &Response{
+		EnhancedCode: TooManyRecipients,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Recipient belongs to another tenant, send it in a separate transaction",
+	}
+
+	Canned.ErrorRateLimited = &Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Rate limit exceeded, try again later",
+	}
+
+	Canned.FailStartTLSRequired = &Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    530,
+		Class:        ClassPermanentFailure,
+		Comment:      "Must issue a STARTTLS command first",
+	}
+
+	Canned.FailExpnNotAllowed = &Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: EXPN not allowed",
+	}
+
+	Canned.ErrorConnectionRateLimited = &Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many connections, try again later",
+	}
+
+	Canned.ErrorTooManyMessages = &Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many messages in this session, reconnect to send more",
+	}
+
+	Canned.ErrorAuthUnavailable = &Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    454,
+		Class:        ClassTransientFailure,
+		Comment:      "Temporary authentication failure",
+	}
+
+	Canned.ErrorTooManyAuthFailures = &Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many failed authentication attempts",
+	}
+
+	Canned.ErrorSenderRateLimited = &Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    450,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many messages from this sender, try again later",
+	}
+
+	Canned.ErrorGreylisted = &Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Greylisted, please try again later",
+	}
+
+	Canned.ErrorBudgetExceeded = &Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: processing took too long, try again later",
+	}
+
+	Canned.ErrorMailboxOverQuota = &Response{
+		EnhancedCode: MailboxFull,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Mailbox is over quota, try again later",
+	}
+
+	Canned.ErrorRcptValidation = &Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: could not validate the recipients, try again later",
+	}
+
+	Canned.ErrorStorageUnavailable = &Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: could not save the email, try again later",
+	}
+
 	Canned.SuccessQuitCmd = &Response{
 		EnhancedCode: OtherStatus,
 		BasicCode:    221,
@@ -268,6 +408,13 @@ func init() {
 		Comment:      "Server is shutting down. Please try again later. Sayonara!",
 	}
 
+	Canned.ErrorTooManyConnections = &Response{
+		EnhancedCode: NetworkCongestion,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many connections, try again later",
+	}
+
 	Canned.FailSyntaxError = &Response{
 		EnhancedCode: SyntaxError,
 		BasicCode:    550,
@@ -283,12 +430,26 @@ func init() {
 	}
 
 	Canned.FailMessageSizeExceeded = &Response{
-		EnhancedCode: OtherOrUndefinedNetworkOrRoutingStatus,
+		EnhancedCode: MessageTooBigForSystem,
 		BasicCode:    552,
 		Class:        ClassPermanentFailure,
 		Comment:      "Error:",
 	}
 
+	Canned.FailMessageSizeDeclared = &Response{
+		EnhancedCode: MessageTooBigForSystem,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Message size exceeds fixed maximum message size",
+	}
+
+	Canned.FailMailboxFull = &Response{
+		EnhancedCode: MailboxFull,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Message size exceeds the recipient's limit",
+	}
+
 	Canned.FailReadErrorDataCmd = &Response{
 		EnhancedCode: OtherOrUndefinedMailSystemStatus,
 		BasicCode:    451,
@@ -324,6 +485,34 @@ func init() {
 		Comment:      "Domain cannot exceed 255 characters",
 	}
 
+	Canned.FailAddressLiteral = &Response{
+		EnhancedCode: BadDestinationMailboxAddressSyntax,
+		BasicCode:    553,
+		Class:        ClassPermanentFailure,
+		Comment:      "Address literals are not accepted",
+	}
+
+	Canned.FailSourceRoute = &Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    553,
+		Class:        ClassPermanentFailure,
+		Comment:      "Source routes are not accepted",
+	}
+
+	Canned.FailNonASCIIAddress = &Response{
+		EnhancedCode: NonASCIIAddressesNotPermitted,
+		BasicCode:    553,
+		Class:        ClassPermanentFailure,
+		Comment:      "Non-ASCII addresses require SMTPUTF8",
+	}
+
+	Canned.FailNoValidRecipients = &Response{
+		EnhancedCode: BadDestinationMailboxAddress,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: none of the recipients are valid",
+	}
+
 	Canned.FailBackendNotRunning = &Response{
 		EnhancedCode: OtherOrUndefinedProtocolStatus,
 		BasicCode:    554,
@@ -403,6 +592,7 @@ const (
 	ConversionRequiredButNotSupported       = ".6.3"
 	ConversionWithLossPerformed             = ".6.4"
 	ConversionFailed                        = ".6.5"
+	NonASCIIAddressesNotPermitted           = ".6.7"
 )
 
 var defaultTexts = struct {
@@ -2,15 +2,19 @@ package guerrilla
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,6 +22,7 @@ import (
 
 	"github.com/artpar/go-guerrilla/authenticators"
 	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/ipaddr"
 	"github.com/artpar/go-guerrilla/log"
 	"github.com/artpar/go-guerrilla/mail"
 	"github.com/artpar/go-guerrilla/mail/rfc5321"
@@ -40,6 +45,8 @@ const (
 	ServerStateRunning
 	// Server could not start due to an error
 	ServerStateStartError
+	// Server has stopped accepting clients, and waits for the connected ones to finish
+	ServerStateDraining
 )
 
 // Server listens for SMTP clients on the port specified in its config
@@ -53,13 +60,25 @@ type server struct {
 	listener        net.Listener
 	closedListener  chan bool
 	hosts           allowedHosts // stores map[string]bool for faster lookup
-	state           int
+	state           int32        // read and written with getState and setState
+	// drainGrace is how long the clients get to finish when the listener is closed by Drain
+	drainGrace atomic.Value // stores time.Duration
+	// drained is false if Drain had to shut down clients that didn't finish in time
+	drained bool
 	// If log changed after a config reload, newLogStore stores the value here until it's safe to change it
 	logStore      atomic.Value
 	mainlogStore  atomic.Value
 	backendStore  atomic.Value
 	envelopePool  *mail.Pool
 	authenticator authenticators.Authenticator
+	tenants       *tenants
+	histograms    *histograms
+	daily         *dailyStats
+	console       *consoleState
+	commands      *commands
+	policyStore   atomic.Value // stores *policy
+	rateStore     atomic.Value // stores *rateLimiter
+	proxyStore    atomic.Value // stores *proxyProtocol, nil when it's off
 }
 
 type allowedHosts struct {
@@ -79,6 +98,7 @@ var (
 	cmdRCPT     command = []byte("RCPT TO:")
 	cmdRSET     command = []byte("RSET")
 	cmdVRFY     command = []byte("VRFY")
+	cmdEXPN     command = []byte("EXPN")
 	cmdNOOP     command = []byte("NOOP")
 	cmdQUIT     command = []byte("QUIT")
 	cmdDATA     command = []byte("DATA")
@@ -98,6 +118,11 @@ func newServer(sc *ServerConfig, b backends.Backend, a authenticators.Authentica
 		state:           ServerStateNew,
 		envelopePool:    mail.NewPool(sc.MaxClients),
 		authenticator:   a,
+		tenants:         newTenants(),
+		histograms:      newHistograms(),
+		daily:           newDailyStats(),
+		console:         newConsoleState(),
+		commands:        newCommands(),
 	}
 	server.mainlogStore.Store(mainlog)
 	server.backendStore.Store(b)
@@ -114,6 +139,31 @@ func newServer(sc *ServerConfig, b backends.Backend, a authenticators.Authentica
 			server.logStore.Store(l)
 		}
 	}
+	if sc.FairnessOn {
+		fair, err := newFairAdmission(sc.MaxClients, sc.FairReservedClients, sc.FairWeights)
+		if err != nil {
+			return server, fmt.Errorf("server [%s]: %s", sc.ListenInterface, err)
+		}
+		server.clientPool.fair = fair
+	}
+	if err := sc.TCP.validate(); err != nil {
+		return server, fmt.Errorf("server [%s]: %s", sc.ListenInterface, err)
+	}
+	p, err := newPolicy(sc)
+	if err != nil {
+		return server, fmt.Errorf("server [%s]: %s", sc.ListenInterface, err)
+	}
+	server.policyStore.Store(p)
+	rl, err := newRateLimiter(sc.RateLimit)
+	if err != nil {
+		return server, fmt.Errorf("server [%s]: %s", sc.ListenInterface, err)
+	}
+	server.rateStore.Store(rl)
+	pp, err := newProxyProtocol(sc.ProxyProtocol)
+	if err != nil {
+		return server, fmt.Errorf("server [%s]: %s", sc.ListenInterface, err)
+	}
+	server.proxyStore.Store(pp)
 	server.setConfig(sc)
 	server.setTimeout(sc.Timeout)
 	if err := server.configureTLS(); err != nil {
@@ -125,14 +175,17 @@ func newServer(sc *ServerConfig, b backends.Backend, a authenticators.Authentica
 func (s *server) configureTLS() error {
 	sConfig := s.configStore.Load().(ServerConfig)
 	if sConfig.TLS.AlwaysOn || sConfig.TLS.StartTLSOn {
-		cert, err := tls.LoadX509KeyPair(sConfig.TLS.PublicKeyFile, sConfig.TLS.PrivateKeyFile)
-		if err != nil {
-			return fmt.Errorf("error while loading the certificate: %s", err)
-		}
 		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-			ServerName:   sConfig.Hostname,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ServerName: sConfig.Hostname,
+		}
+		// with ACME, the key files are optional
+		if len(sConfig.TLS.ACMEHosts) == 0 || sConfig.TLS.PublicKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(sConfig.TLS.PublicKeyFile, sConfig.TLS.PrivateKeyFile)
+			if err != nil {
+				return fmt.Errorf("error while loading the certificate: %s", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
 		}
 		if len(sConfig.TLS.Protocols) > 0 {
 			if min, ok := TLSProtocols[sConfig.TLS.Protocols[0]]; ok {
@@ -176,6 +229,18 @@ func (s *server) configureTLS() error {
 		}
 		tlsConfig.PreferServerCipherSuites = sConfig.TLS.PreferServerCipherSuites
 		tlsConfig.Rand = rand.Reader
+		if err := useSessionTickets(tlsConfig, &sConfig.TLS); err != nil {
+			return err
+		}
+		if err := useClientCerts(tlsConfig, &sConfig.TLS); err != nil {
+			return err
+		}
+		if err := useOCSPStapling(tlsConfig, &sConfig.TLS, s.log()); err != nil {
+			return err
+		}
+		if err := useSNICertificates(tlsConfig, &sConfig.TLS, s.log()); err != nil {
+			return err
+		}
 		s.tlsConfigStore.Store(tlsConfig)
 	}
 	return nil
@@ -204,9 +269,120 @@ func (s *server) setTimeout(seconds int) {
 // goroutine safe config store
 func (s *server) setConfig(sc *ServerConfig) {
 	s.configStore.Store(*sc)
+	s.setRateLimit(sc)
+	s.setProxyProtocol(sc)
+	if p, ok := s.policyStore.Load().(*policy); ok && reflect.DeepEqual(p.config, sc.Policy) && p.authRequired == sc.AuthRequired {
+		return
+	}
+	if p, err := newPolicy(sc); err != nil {
+		s.log().WithError(err).Errorf("invalid policy for server [%s], the previous policy is kept", sc.ListenInterface)
+	} else {
+		s.policyStore.Store(p)
+	}
+}
+
+// setRateLimit replaces the rate limiter when its config changed. The buckets in memory start again full
+func (s *server) setRateLimit(sc *ServerConfig) {
+	old, ok := s.rateStore.Load().(*rateLimiter)
+	if ok && reflect.DeepEqual(old.config, sc.RateLimit) {
+		return
+	}
+	rl, err := newRateLimiter(sc.RateLimit)
+	if err != nil {
+		s.log().WithError(err).Errorf("invalid rate_limit for server [%s], the previous limits are kept", sc.ListenInterface)
+		return
+	}
+	s.rateStore.Store(rl)
+	if ok {
+		old.close()
+	}
+}
+
+// setProxyProtocol replaces the reader of the PROXY headers when its config changed
+func (s *server) setProxyProtocol(sc *ServerConfig) {
+	if old, ok := s.proxyStore.Load().(*proxyProtocol); ok && (old == nil && !sc.ProxyProtocol.On ||
+		old != nil && reflect.DeepEqual(old.config, sc.ProxyProtocol)) {
+		return
+	}
+	pp, err := newProxyProtocol(sc.ProxyProtocol)
+	if err != nil {
+		s.log().WithError(err).Errorf("invalid proxy_protocol for server [%s], the previous one is kept", sc.ListenInterface)
+		return
+	}
+	s.proxyStore.Store(pp)
+}
+
+// allowRate checks the rate limit of the client's address at the connect stage, or of its sender at the
+// mail stage. It returns false when the limit was reached, after sending the response
+func (s *server) allowRate(client *client, stage string) bool {
+	rl, ok := s.rateStore.Load().(*rateLimiter)
+	if !ok {
+		return true
+	}
+	var allowed bool
+	var err error
+	resp := response.Canned.ErrorConnectionRateLimited
+	key := client.RemoteIP
+	if stage == PolicyConnect {
+		allowed, err = rl.allowConnection(key, time.Now())
+	} else {
+		key = "from:" + client.MailFrom.String()
+		if client.authStore.IsAuthenticated && client.AuthorizedLogin != "" {
+			key = "user:" + client.AuthorizedLogin
+		}
+		allowed, err = rl.allowMessage(key, time.Now())
+		resp = response.Canned.ErrorSenderRateLimited
+	}
+	if err != nil {
+		s.log().WithError(err).Warn("rate_limit: redis can't be reached, counting on this node")
+	}
+	if allowed {
+		return true
+	}
+	s.log().WithFields(logrus.Fields{"client": client.ID, "ip": client.RemoteIP, "key": key}).Infof("rate_limit: %s refused", stage)
+	client.sendResponse(resp)
+	return false
+}
+
+// checkPolicy evaluates the policy at the stage. It returns false when the command, or the connection
+// at the connect stage, is refused, after sending the response. A tarpitted client is delayed
+func (s *server) checkPolicy(client *client, pc *PolicyContext, stage string) bool {
+	p, ok := s.policyStore.Load().(*policy)
+	if !ok {
+		return true
+	}
+	pc.Stage = stage
+	pc.IP = ipaddr.Parse(client.RemoteIP)
+	pc.Helo = client.Helo
+	pc.MailFrom = client.MailFrom
+	pc.TLS = client.TLS
+	pc.Authenticated = client.authStore.IsAuthenticated
+	d := p.evaluate(pc)
+	pc.share(client.Session)
+	if d.action == "" || d.action == PolicyAccept {
+		return true
+	}
+	s.log().WithFields(logrus.Fields{
+		"client": client.ID, "ip": client.RemoteIP, "stage": stage, "rule": d.rule, "score": d.score,
+	}).Infof("policy: %s", d.action)
+	if d.action == PolicyTarpit {
+		time.Sleep(p.tarpitDelay)
+		return true
+	}
+	client.sendResponse(d.response(stage))
+	return false
 }
 
 // goroutine safe
+// getState returns the state of the server, which is changed by the goroutine that runs Start
+func (s *server) getState() int {
+	return int(atomic.LoadInt32(&s.state))
+}
+
+func (s *server) setState(state int) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
 func (s *server) isEnabled() bool {
 	sc := s.configStore.Load().(ServerConfig)
 	return sc.IsEnabled
@@ -237,16 +413,26 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 	var clientID uint64
 	clientID = 0
 
-	listener, err := net.Listen("tcp", s.listenInterface)
+	sConfig := s.configStore.Load().(ServerConfig)
+	listener, err := inheritedListener(s.listenInterface)
+	if err != nil {
+		s.log().WithError(err).Warn("could not use the sockets passed by systemd")
+	}
+	if listener != nil {
+		s.log().Infof("Using the socket passed by systemd for %s", s.listenInterface)
+	} else {
+		lc := sConfig.TCP.listenConfig(s.log())
+		listener, err = lc.Listen(context.Background(), "tcp", s.listenInterface)
+	}
 	s.listener = listener
 	if err != nil {
 		startWG.Done() // don't wait for me
-		s.state = ServerStateStartError
+		s.setState(ServerStateStartError)
 		return fmt.Errorf("[%s] Cannot listen on port: %s ", s.listenInterface, err.Error())
 	}
 
 	s.log().Infof("Listening on TCP %s", s.listenInterface)
-	s.state = ServerStateRunning
+	s.setState(ServerStateRunning)
 	startWG.Done() // start successful, don't wait for me
 
 	for {
@@ -258,30 +444,68 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 				s.log().Infof("Server [%s] has stopped accepting new clients", s.listenInterface)
 				// the listener has been closed, wait for clients to exit
 				s.log().Infof("shutting down pool [%s]", s.listenInterface)
+				if grace, ok := s.drainGrace.Load().(time.Duration); ok && grace > 0 {
+					s.drained = s.clientPool.Drain(grace)
+				}
 				s.clientPool.ShutdownState()
 				s.clientPool.ShutdownWait()
-				s.state = ServerStateStopped
+				s.setState(ServerStateStopped)
 				s.closedListener <- true
 				return nil
 			}
 			s.mainlog().WithError(err).Info("Temporary error accepting client")
 			continue
 		}
-		go func(p Poolable, borrowErr error) {
-			c := p.(*client)
+		if sConfig, ok := s.configStore.Load().(ServerConfig); ok {
+			if err := sConfig.TCP.tune(conn); err != nil {
+				s.log().WithError(err).Warnf("[%s] could not set the tcp options", s.listenInterface)
+			}
+			if conn, err = sConfig.TCP.wrap(conn); err != nil {
+				s.log().WithError(err).Warnf("[%s] the connection is read as buffered", s.listenInterface)
+			}
+		}
+		serve := func(p Poolable, borrowErr error) {
 			if borrowErr == nil {
+				c := p.(*client)
 				s.handleClient(c)
+				// the client may have gone in the middle of a transaction
+				c.releaseRateSlot()
 				s.envelopePool.Return(c.Envelope)
 				s.clientPool.Return(c)
 			} else {
 				s.log().WithError(borrowErr).Info("couldn't borrow a new client")
+				if borrowErr == ErrPoolBusy {
+					_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+					_, _ = fmt.Fprintf(conn, "%s\r\n", response.Canned.ErrorTooManyConnections)
+				}
 				// we could not get a client, so close the connection.
 				_ = conn.Close()
 
 			}
+		}
+		if pp, ok := s.proxyStore.Load().(*proxyProtocol); ok && pp != nil {
+			// the header is read in the client's own goroutine, so that a slow proxy
+			// doesn't hold up the other connections
+			go func(conn net.Conn, clientID uint64) {
+				proxied, err := pp.accept(conn)
+				if err != nil {
+					s.log().WithError(err).Warnf("[%s] closed the connection", s.listenInterface)
+					_ = conn.Close()
+					return
+				}
+				serve(s.clientPool.Borrow(proxied, clientID, s.log(), s.envelopePool))
+			}(conn, clientID)
+		} else if s.clientPool.fair != nil {
+			// the client waits for its turn in its own goroutine, so that
+			// other sources can still connect
+			go func(clientID uint64) {
+				serve(s.clientPool.Borrow(conn, clientID, s.log(), s.envelopePool))
+			}(clientID)
+		} else {
 			// intentionally placed Borrow in args so that it's called in the
 			// same main goroutine.
-		}(s.clientPool.Borrow(conn, clientID, s.log(), s.envelopePool))
+			go serve(s.clientPool.Borrow(conn, clientID, s.log(), s.envelopePool))
+		}
 
 	}
 }
@@ -297,14 +521,115 @@ func (s *server) Shutdown() {
 		s.clientPool.ShutdownState()
 		// listener already closed, wait for clients to exit
 		s.clientPool.ShutdownWait()
-		s.state = ServerStateStopped
+		s.setState(ServerStateStopped)
+	}
+	if rl, ok := s.rateStore.Load().(*rateLimiter); ok {
+		rl.close()
+	}
+}
+
+// Drain stops accepting clients, and gives the connected clients up to grace to finish their
+// transactions before the ones still connected are shut down. The server is draining until the
+// returned channel gets false if there were any, or true
+func (s *server) Drain(grace time.Duration) <-chan bool {
+	done := make(chan bool, 1)
+	if !atomic.CompareAndSwapInt32(&s.state, ServerStateRunning, ServerStateDraining) {
+		done <- true
+		return done
 	}
+	s.drainGrace.Store(grace)
+	s.drained = true
+	go func() {
+		s.Shutdown()
+		s.drainGrace.Store(time.Duration(0))
+		done <- s.drained
+	}()
+	return done
 }
 
 func (s *server) GetActiveClientsCount() int {
 	return s.clientPool.GetActiveClientsCount()
 }
 
+// checkPath applies the address literal, source route and SMTPUTF8 settings to the
+// path that was just parsed by the client's parser. smtputf8 is true if the client
+// gave the SMTPUTF8 parameter to MAIL FROM. Returns nil if the path is acceptable
+func (s *server) checkPath(sc *ServerConfig, client *client, smtputf8 bool) *response.Response {
+	if sc.RejectAddressLiterals && client.parser.Literal {
+		return response.Canned.FailAddressLiteral
+	}
+	if sc.RejectSourceRoutes && len(client.parser.ADL) > 0 {
+		return response.Canned.FailSourceRoute
+	}
+	if client.parser.UTF8 && !(sc.SMTPUTF8On && smtputf8) {
+		return response.Canned.FailNonASCIIAddress
+	}
+	return nil
+}
+
+// rcptTenant finds the tenant of a recipient, which is the server's tenant if set,
+// otherwise the tenant of the recipient's domain. Returns a response if the recipient
+// cannot be added because it belongs to a different tenant than the recipients before it,
+// or if the tenant's rate limit was reached
+func (s *server) rcptTenant(sc *ServerConfig, client *client, to *mail.Address) (*tenant, *response.Response) {
+	var t *tenant
+	name := sc.Tenant
+	if name != "" {
+		if t = s.tenants.get(name); t == nil {
+			// not in the tenants list, so there are no limits
+			t = &tenant{TenantConfig: TenantConfig{Name: name}}
+		}
+	} else if t = s.tenants.forDomain(to.Host); t != nil {
+		name = t.Name
+	}
+	if len(client.RcptTo) > 0 {
+		if name != client.Tenant {
+			return nil, response.Canned.ErrorTenantMismatch
+		}
+		return t, nil
+	}
+	if t != nil {
+		slot, ok := t.reserve(time.Now())
+		if !ok {
+			t.rejected()
+			return nil, response.Canned.ErrorRateLimited
+		}
+		// held until the message is accepted, so that concurrent transactions can't go over the limit
+		client.rateSlot = slot
+	}
+	return t, nil
+}
+
+// maxSize returns the largest message that the client may send in the current transaction.
+// The limit for the authorized login applies first, then the bounce limit for null senders,
+// then any lower limit that was set on the envelope by the recipient validation processors
+func (s *server) maxSize(sc *ServerConfig, client *client) int64 {
+	size := s.authenticator.GetMailSize(client.AuthorizedLogin, sc.MaxSize)
+	if client.MailFrom.NullPath && sc.BounceMaxSize > 0 && sc.BounceMaxSize < size {
+		size = sc.BounceMaxSize
+	}
+	if client.MaxSize > 0 && client.MaxSize < size {
+		size = client.MaxSize
+	}
+	return size
+}
+
+// pathParam returns the value of the ESMTP parameter key, and true if key is in params
+func pathParam(params [][]string, key string) (string, bool) {
+	for i := range params {
+		if len(params[i]) > 1 && strings.EqualFold(params[i][0], key) {
+			return params[i][1], true
+		}
+	}
+	return "", false
+}
+
+// hasPathParam returns true if the ESMTP parameter key is in params
+func hasPathParam(params [][]string, key string) bool {
+	_, ok := pathParam(params, key)
+	return ok
+}
+
 // Verifies that the host is a valid recipient.
 // host checking turned off if there is a single entry and it's a dot.
 func (s *server) allowsHost(host string) bool {
@@ -364,9 +689,19 @@ func (s *server) isShuttingDown() bool {
 	return s.clientPool.IsShuttingDown()
 }
 
+// isDraining returns true while Drain lets the clients finish their transactions
+func (s *server) isDraining() bool {
+	grace, ok := s.drainGrace.Load().(time.Duration)
+	return ok && grace > 0
+}
+
 // Handles an entire client SMTP exchange
 func (s *server) handleClient(client *client) {
 	defer client.closeConn()
+	defer func() {
+		s.histograms.session(time.Since(client.ConnectedAt), client.messagesReceived)
+		s.console.forget(client, s.listenInterface)
+	}()
 	sc := s.configStore.Load().(ServerConfig)
 	client.authStore = authenticators.AuthStore{}
 	s.log().Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
@@ -381,14 +716,17 @@ func (s *server) handleClient(client *client) {
 	ehlo := fmt.Sprintf("250-%s Hello\r\n", sc.Hostname)
 
 	// Extended feature advertisements
-	messageSize := fmt.Sprintf("250-SIZE %d\r\n", sc.MaxSize)
 	pipelining := "250-PIPELINING\r\n"
 	advertiseTLS := "250-STARTTLS\r\n"
 	advertiseEnhancedStatusCodes := "250-ENHANCEDSTATUSCODES\r\n"
+	advertiseSMTPUTF8 := ""
+	if sc.SMTPUTF8On {
+		// SMTPUTF8 also requires 8BITMIME (RFC 6531, section 3.1)
+		advertiseSMTPUTF8 = "250-8BITMIME\r\n250-SMTPUTF8\r\n"
+	}
 	// The last line doesn't need \r\n since string will be printed as a new line.
 	// Also, Last line has no dash -
 	help := "250 HELP"
-	advertiseAuthType := s.authenticator.GetAdvertiseAuthentication(sc.AuthTypes)
 
 	if sc.TLS.AlwaysOn {
 		tlsConfig, ok := s.tlsConfigStore.Load().(*tls.Config)
@@ -407,9 +745,14 @@ func (s *server) handleClient(client *client) {
 		advertiseTLS = ""
 	}
 	r := response.Canned
+	pc := &PolicyContext{}
 	for client.isAlive() {
 		switch client.state {
 		case ClientGreeting:
+			if !s.allowRate(client, PolicyConnect) || !s.checkPolicy(client, pc, PolicyConnect) {
+				client.kill()
+				break
+			}
 			client.sendResponse(greeting)
 			client.state = ClientCmd
 		case ClientCmd:
@@ -431,7 +774,7 @@ func (s *server) handleClient(client *client) {
 				client.kill()
 				break
 			}
-			if s.isShuttingDown() {
+			if s.isShuttingDown() && !(s.isDraining() && client.isInTransaction()) {
 				client.state = ClientShutdown
 				continue
 			}
@@ -451,6 +794,10 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.FailSyntaxError)
 					break
 				}
+				if !s.checkPolicy(client, pc, PolicyHelo) {
+					client.Helo = ""
+					break
+				}
 				client.resetTransaction()
 				client.sendResponse(helo)
 
@@ -463,32 +810,55 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.FailSyntaxError)
 					break
 				}
+				if !s.checkPolicy(client, pc, PolicyHelo) {
+					client.Helo = ""
+					break
+				}
 				client.ESMTP = true
 				client.resetTransaction()
+				messageSize := fmt.Sprintf("250-SIZE %d\r\n", s.maxSize(&sc, client))
+				advertiseAuthType := s.authenticator.GetAdvertiseAuthentication(s.authTypes(&sc, client))
 				client.sendResponse(ehlo,
 					messageSize,
 					pipelining,
 					advertiseTLS,
 					advertiseAuthType,
 					advertiseEnhancedStatusCodes,
+					advertiseSMTPUTF8,
+					s.commands.advertise(),
 					help)
 				// .NET library fix - note the trailing space
 			case strings.Index(cmdString, "AUTH LOGIN ") == 0:
-				client.login = cmdString[len("AUTH LOGIN "):]
-				client.state = ClientPassword
-				client.sendResponse("334 UGFzc3dvcmQ6")
+				if reply := s.refuseAuth(&sc, client, "LOGIN"); reply != "" {
+					client.sendResponse(reply)
+				} else {
+					client.login = string(input[len("AUTH LOGIN "):])
+					client.state = ClientPassword
+					client.sendResponse("334 UGFzc3dvcmQ6")
+				}
 			case strings.Index(cmdString, "AUTH LOGIN") == 0:
-				if !sc.IsAuthTypeAllowed("LOGIN") {
-					client.sendResponse("500 5.5.1 Invalid command")
+				if reply := s.refuseAuth(&sc, client, "LOGIN"); reply != "" {
+					client.sendResponse(reply)
 				} else {
 					client.state = ClientLogin
 					client.authType = AuthLOGIN
 					client.sendResponse("334 VXNlcm5hbWU6")
 				}
 
+			case strings.Index(cmdString, "AUTH PLAIN") == 0:
+				if reply := s.refuseAuth(&sc, client, "PLAIN"); reply != "" {
+					client.sendResponse(reply)
+				} else if initial := strings.TrimSpace(string(input[len("AUTH PLAIN"):])); initial != "" {
+					s.authPlain(client, initial)
+				} else {
+					client.authType = AuthPLAIN
+					client.state = ClientLogin
+					client.sendResponse("334 ")
+				}
+
 			case strings.Index(cmdString, "AUTH CRAM-MD5") == 0:
-				if !sc.IsAuthTypeAllowed("CRAM-MD5") {
-					client.sendResponse("500 5.5.1 Invalid command")
+				if reply := s.refuseAuth(&sc, client, "CRAM-MD5"); reply != "" {
+					client.sendResponse(reply)
 				} else {
 					client.authType = AuthCRAMMD5
 					client.state = ClientLogin
@@ -501,8 +871,10 @@ func (s *server) handleClient(client *client) {
 				}
 
 			case cmdHELP.match(cmd):
-				quote := response.GetQuote()
-				client.sendResponse("214-OK\r\n", quote)
+				if !s.customCommand(client, input) {
+					quote := response.GetQuote()
+					client.sendResponse("214-OK\r\n", quote)
+				}
 
 			case sc.XClientOn && cmdXCLIENT.match(cmd):
 				if toks := bytes.Split(input[8:], []byte{' '}); len(toks) > 0 {
@@ -523,10 +895,22 @@ func (s *server) handleClient(client *client) {
 				}
 				client.sendResponse(r.SuccessMailCmd)
 			case cmdMAIL.match(cmd):
+				if sc.TLS.StartTLSRequired && !client.TLS {
+					client.sendResponse(r.FailStartTLSRequired)
+					break
+				}
 				if client.isInTransaction() {
 					client.sendResponse(r.FailNestedMailCmd)
 					break
 				}
+				if sc.MaxMessagesPerSession > 0 && client.messagesReceived >= sc.MaxMessagesPerSession {
+					s.log().WithFields(logrus.Fields{
+						"client": client.ID, "ip": client.RemoteIP, "messages": client.messagesReceived,
+					}).Info("max_messages_per_session reached, closing the connection")
+					client.sendResponse(r.ErrorTooManyMessages)
+					client.kill()
+					break
+				}
 				client.MailFrom, err = client.parsePath(input[10:], client.parser.MailFrom)
 				if err != nil {
 					s.log().WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
@@ -534,16 +918,44 @@ func (s *server) handleClient(client *client) {
 					break
 				} else if client.parser.NullPath {
 					// bounce has empty from address
+					client.MailFrom = mail.Address{NullPath: true}
+				} else if resp := s.checkPath(&sc, client, hasPathParam(client.MailFrom.PathParams, "SMTPUTF8")); resp != nil {
 					client.MailFrom = mail.Address{}
+					client.sendResponse(resp)
+					break
+				}
+				if size, ok := pathParam(client.MailFrom.PathParams, "SIZE"); ok {
+					if client.Size, err = strconv.ParseInt(size, 10, 64); err != nil || client.Size < 0 {
+						client.MailFrom = mail.Address{}
+						client.Size = 0
+						client.sendResponse(r.FailSyntaxError)
+						break
+					}
+					if client.Size > s.maxSize(&sc, client) {
+						client.MailFrom = mail.Address{}
+						client.Size = 0
+						client.sendResponse(r.FailMessageSizeDeclared)
+						break
+					}
+				}
+				if !s.checkPolicy(client, pc, PolicyMail) {
+					client.MailFrom = mail.Address{}
+					client.Size = 0
+					break
+				}
+				if !client.MailFrom.NullPath && !s.allowRate(client, PolicyMail) {
+					client.MailFrom = mail.Address{}
+					client.Size = 0
+					break
 				}
 				client.sendResponse(r.SuccessMailCmd)
 
 			case cmdRCPT.match(cmd):
-				if sc.AuthRequired && !client.authStore.IsAuthenticated {
-					client.sendResponse("554 5.7.1 Client host rejected: Access denied")
+				if len(client.RcptTo) > rfc5321.LimitRecipients {
+					client.sendResponse(r.ErrorTooManyRecipients)
 					break
 				}
-				if len(client.RcptTo) > rfc5321.LimitRecipients {
+				if sc.BounceSingleRcpt && client.MailFrom.NullPath && len(client.RcptTo) > 0 {
 					client.sendResponse(r.ErrorTooManyRecipients)
 					break
 				}
@@ -553,18 +965,62 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(err.Error())
 					break
 				}
+				if resp := s.checkPath(&sc, client, hasPathParam(client.MailFrom.PathParams, "SMTPUTF8")); resp != nil {
+					client.sendResponse(resp)
+					break
+				}
 				s.defaultHost(&to)
+				pc.Rcpt = to
+				if !s.checkPolicy(client, pc, PolicyRcpt) {
+					break
+				}
 				if (to.IP != nil && !s.allowsIp(to.IP)) || (to.IP == nil && !s.allowsHost(to.Host)) {
 					client.sendResponse(r.ErrorRelayDenied, " ", to.Host)
+				} else if t, resp := s.rcptTenant(&sc, client, &to); resp != nil {
+					client.sendResponse(resp)
 				} else {
+					// keep these, in case the recipient gets refused
+					maxSize, tenantName := client.MaxSize, client.Tenant
+					if t != nil {
+						client.Tenant = t.Name
+						if size := t.maxSize(); size > 0 {
+							client.LimitSize(size)
+						}
+					}
 					client.PushRcpt(to)
+					if sc.DeferRcptAfter > 0 && len(client.RcptTo) > sc.DeferRcptAfter {
+						// validated with the other deferred recipients at DATA
+						client.deferredRcpts++
+						client.sendResponse(r.SuccessRcptCmd)
+						break
+					}
 					rcptError := s.backend().ValidateRcpt(client.Envelope)
-					if rcptError != nil {
+					if rcptError == backends.Greylisted {
+						client.PopRcpt()
+						client.MaxSize, client.Tenant = maxSize, tenantName
+						client.sendResponse(r.ErrorGreylisted)
+					} else if rcptError == backends.StorageNotAvailable || rcptError == backends.StorageTooBusy ||
+						rcptError == backends.StorageTimeout {
+						// the recipient couldn't be looked up, the client tries again later
 						client.PopRcpt()
+						client.MaxSize, client.Tenant = maxSize, tenantName
+						client.sendResponse(r.ErrorRcptValidation)
+					} else if rcptError != nil {
+						client.PopRcpt()
+						client.MaxSize, client.Tenant = maxSize, tenantName
 						client.sendResponse(r.FailRcptCmd, " ", rcptError.Error())
+					} else if client.MaxSize > 0 && client.Size > client.MaxSize {
+						// a processor lowered the limit for this recipient, below the declared size
+						client.PopRcpt()
+						client.MaxSize, client.Tenant = maxSize, tenantName
+						client.sendResponse(r.FailMailboxFull)
 					} else {
 						client.sendResponse(r.SuccessRcptCmd)
 					}
+					if len(client.RcptTo) == 0 {
+						// the first recipient was refused
+						client.releaseRateSlot()
+					}
 				}
 
 			case cmdRSET.match(cmd):
@@ -572,21 +1028,25 @@ func (s *server) handleClient(client *client) {
 				client.sendResponse(r.SuccessResetCmd)
 
 			case cmdVRFY.match(cmd):
-				client.sendResponse(r.SuccessVerifyCmd)
+				s.verify(&sc, client, input[len(cmdVRFY):], false)
+
+			case cmdEXPN.match(cmd):
+				s.verify(&sc, client, input[len(cmdEXPN):], true)
 
 			case cmdNOOP.match(cmd):
-				client.sendResponse(r.SuccessNoopCmd)
+				if !s.customCommand(client, input) {
+					client.sendResponse(r.SuccessNoopCmd)
+				}
 
 			case cmdQUIT.match(cmd):
 				client.sendResponse(r.SuccessQuitCmd)
 				client.kill()
 
 			case cmdDATA.match(cmd):
-				if sc.AuthRequired && !client.authStore.IsAuthenticated {
-					client.sendResponse("554 5.7.1 Client host rejected: Access denied")
+				if !s.checkPolicy(client, pc, PolicyData) {
 					break
 				}
-				if client.MailFrom.IsEmpty() {
+				if client.MailFrom.IsEmpty() && !client.MailFrom.NullPath {
 					client.sendResponse(response.Canned.FailNoSenderDataCmd)
 					break
 				}
@@ -594,6 +1054,17 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.FailNoRecipientsDataCmd)
 					break
 				}
+				if client.deferredRcpts > 0 {
+					if resp := s.validateDeferredRcpts(client); resp != nil {
+						client.sendResponse(resp)
+						break
+					}
+				}
+				if client.Size > s.maxSize(&sc, client) {
+					// a recipient's limit is lower than the size declared with MAIL FROM
+					client.sendResponse(r.FailMessageSizeDeclared)
+					break
+				}
 				client.sendResponse(r.SuccessDataCmd)
 				client.state = ClientData
 
@@ -602,6 +1073,9 @@ func (s *server) handleClient(client *client) {
 				client.sendResponse(r.SuccessStartTLSCmd)
 				client.state = ClientStartTLS
 			default:
+				if s.customCommand(client, input) {
+					break
+				}
 				client.errors++
 				if client.errors >= MaxUnrecognizedCommands {
 					client.sendResponse(r.FailMaxUnrecognizedCmd)
@@ -632,8 +1106,16 @@ func (s *server) handleClient(client *client) {
 					client.AuthorizedLogin = s.authenticator.ExtractLoginFromAuthString(string(authString))
 					client.sendResponse("235 Authentication succeeded")
 				} else {
-					client.sendResponse("535 5.7.8 Error: authentication failed:")
+					s.authFailed(client, "535 5.7.8 Error: authentication failed:")
+				}
+				client.state = ClientCmd
+			case AuthPLAIN:
+				authString, err := s.readCommand(client, sc.MaxSize)
+				if err != nil {
+					s.log().WithError(err).Warnf("error reading the AUTH PLAIN response: %s", client.RemoteIP)
+					return
 				}
+				s.authPlain(client, string(authString))
 				client.state = ClientCmd
 			}
 
@@ -643,38 +1125,80 @@ func (s *server) handleClient(client *client) {
 				err = fmt.Errorf("Error reading password: %v", err)
 			}
 			client.password = string(password)
-			if s.authenticator.VerifyLOGIN(client.login, client.password) {
+			if ok, err := s.authenticator.VerifyLOGIN(client.login, client.password); err != nil {
+				client.sendResponse(r.ErrorAuthUnavailable)
+			} else if ok {
 				client.AuthorizedLogin, err = s.authenticator.DecodeLogin(client.login)
 				if err != nil {
 					fmt.Print(err)
-					client.sendResponse("535 5.7.0 Invalid login or password")
+					s.authFailed(client, "535 5.7.0 Invalid login or password")
 				} else {
 					client.authStore.IsAuthenticated = true
 					client.sendResponse("235 Authentication succeeded")
 				}
 			} else {
-				client.sendResponse("535 5.7.0 Invalid login or password")
+				s.authFailed(client, "535 5.7.0 Invalid login or password")
 			}
 			client.state = ClientCmd
 
 		case ClientData:
 
-			// intentionally placed the limit 1MB above so that reading does not return with an error
-			// if the client goes a little over. Anything above will err
-			maxMailSize := int64(s.authenticator.GetMailSize(client.AuthorizedLogin, sc.MaxSize))
-			client.bufin.setLimit(maxMailSize + 1024000) // This a hard limit.
-
-			n, err := client.Data.ReadFrom(client.smtpReader.DotReader())
-			if n > sc.MaxSize {
-				err = fmt.Errorf("maximum DATA size exceeded (%d)", sc.MaxSize)
+			// a message over the limit is drained up to the hard limit, so that the client can go on with
+			// the next one. Anything above will err
+			maxMailSize := s.maxSize(&sc, client)
+			client.bufin.setLimit(2*maxMailSize + 1024000) // This a hard limit.
+
+			var bodyHash hash.Hash
+			dotReader := client.smtpReader.DotReader()
+			var dataReader io.Reader = &dataLimitReader{r: dotReader, n: maxMailSize}
+			if alg := backends.Svc.StreamHash(); alg != "" {
+				if h, err := mail.NewHash(alg); err == nil {
+					bodyHash = h
+					client.HashAlgorithm = alg
+					dataReader = io.TeeReader(dataReader, bodyHash)
+				} else {
+					s.log().WithError(err).Error("cannot hash the message body")
+				}
+			}
+			// with stream processors, only the header section of the message is buffered
+			var stream backends.StreamProcessor
+			var streamErr error
+			if ds, ok := s.backend().(backends.DataStreamer); ok {
+				stream, streamErr = ds.StreamData(client.Envelope)
+			}
+			var n int64
+			var err error
+			if stream != nil {
+				n, err = io.Copy(stream, dataReader)
+			} else if streamErr != nil {
+				// the client is still sending the message
+				n, err = io.Copy(ioutil.Discard, dataReader)
+			} else {
+				n, err = client.Data.ReadFrom(dataReader)
+			}
+			if bodyHash != nil {
+				client.BodyHash = bodyHash.Sum(nil)
+			}
+			if stream != nil {
+				// an incomplete message is discarded by the stream processors
+				if closeErr := stream.Close(err); err == nil {
+					streamErr = closeErr
+				}
 			}
 			if err != nil {
 				if err == LineLimitExceeded {
 					client.sendResponse(r.FailReadLimitExceededDataCmd, " ", LineLimitExceeded.Error())
 					client.kill()
 				} else if err == MessageSizeExceeded {
+					// the rest of the message is discarded up to the final dot, so the client can go on,
+					// unless it goes over the hard limit
+					_, drainErr := io.Copy(ioutil.Discard, dotReader)
 					client.sendResponse(r.FailMessageSizeExceeded, " ", MessageSizeExceeded.Error())
-					client.kill()
+					if drainErr == nil {
+						client.state = ClientCmd
+					} else {
+						client.kill()
+					}
 				} else {
 					client.sendResponse(r.FailReadErrorDataCmd, " ", err.Error())
 					client.kill()
@@ -683,14 +1207,52 @@ func (s *server) handleClient(client *client) {
 				client.resetTransaction()
 				break
 			}
+			if streamErr != nil {
+				s.log().WithError(streamErr).Error("could not stream the message to the backend")
+				client.sendResponse(r.ErrorStorageUnavailable)
+				client.state = ClientCmd
+				client.resetTransaction()
+				break
+			}
 
 			client.Envelope.Values["listen_interface"] = s.listenInterface
+			if client.Tenant != "" {
+				client.Tags.Add("tenant", client.Tenant)
+			}
 
+			client.messagesReceived++
+			s.console.publish(client, s.listenInterface, true)
+			received := time.Now()
 			res := s.backend().Process(client.Envelope)
+			// recorded after processing, as the processors may have changed the QueuedId
+			backends.TrackDeliveryAt(client.Envelope, backends.DeliveryReceived, s.listenInterface, received)
 			if res.Code() < 300 {
 				client.messagesSent++
+				s.histograms.accepted(n, len(client.RcptTo))
+				backends.TrackDelivery(client.Envelope, backends.DeliveryQueued, res.String())
+			} else {
+				backends.TrackDelivery(client.Envelope, backends.DeliveryRejected, res.String())
+			}
+			s.log().WithFields(logrus.Fields{
+				"queued_id": client.QueuedId,
+				"code":      res.Code(),
+				"tags":      client.Tags.Strings(),
+			}).Debug("message processed")
+			s.daily.add(time.Now(), client.Tenant, client.RcptTo, n, res.Code() < 300)
+			if t := s.tenants.get(client.Tenant); t != nil {
+				if res.Code() < 300 {
+					t.accepted(n)
+					// the slot is used by the message
+					client.rateSlot = rateSlot{}
+				} else {
+					t.rejected()
+				}
 			}
 			client.sendResponse(res)
+			if n, ok := s.backend().(backends.DeliveryNotifier); ok && res.Code() < 300 {
+				// bounces the recipients that the processors couldn't deliver to
+				n.Notify(client.Envelope)
+			}
 			client.state = ClientCmd
 			if s.isShuttingDown() {
 				client.state = ClientShutdown
@@ -733,7 +1295,7 @@ func (s *server) handleClient(client *client) {
 				return
 			}
 		}
-
+		s.console.publish(client, s.listenInterface, false)
 	}
 }
 
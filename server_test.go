@@ -11,9 +11,11 @@ import (
 
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 
+	"github.com/artpar/go-guerrilla/authenticators"
 	"github.com/artpar/go-guerrilla/backends"
 	"github.com/artpar/go-guerrilla/log"
 	"github.com/artpar/go-guerrilla/mail"
@@ -56,7 +58,7 @@ func getMockServerConn(sc *ServerConfig, t *testing.T) (*mocks.Conn, *server) {
 	if err != nil {
 		t.Error("new dummy backend failed because:", err)
 	}
-	server, err := newServer(sc, backend, mainlog)
+	server, err := newServer(sc, backend, authenticators.NoopAuthenticator{}, mainlog)
 	if err != nil {
 		//t.Error("new server failed because:", err)
 	} else {
@@ -492,7 +494,7 @@ func TestGithubIssue198(t *testing.T) {
 }
 
 func sendMessage(greet string, TLS bool, w *textproto.Writer, t *testing.T, line string, r *textproto.Reader, err error, client *client) string {
-	if err := w.PrintfLine(greet + " test.test.com"); err != nil {
+	if err := w.PrintfLine("%s test.test.com", greet); err != nil {
 		t.Error(err)
 	}
 	for {
@@ -1148,3 +1150,75 @@ func TestAllowsHosts(t *testing.T) {
 	s.setAllowedHosts([]string{"grr.la", "example.com"})
 
 }
+
+func TestDataLimitReader(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		err  error
+	}{
+		{"12345", nil},
+		{"123456", MessageSizeExceeded},
+		{"1234567890", MessageSizeExceeded},
+	} {
+		var buf strings.Builder
+		r := &dataLimitReader{r: strings.NewReader(test.data), n: 5}
+		_, err := io.Copy(&buf, r)
+		if err != test.err {
+			t.Errorf("expected %v for %q, got %v", test.err, test.data, err)
+		}
+		if buf.Len() > 5 {
+			t.Errorf("expected at most 5 bytes of %q, got %q", test.data, buf.String())
+		}
+	}
+}
+
+func TestMaxMessagesPerSession(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface:       "127.0.0.1:2526",
+		IsEnabled:             true,
+		MaxClients:            2,
+		Timeout:               5,
+		MaxMessagesPerSession: 2,
+	})
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2526")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	cmd := func(line, expect string) {
+		if line != "" {
+			if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+				t.Error(err)
+			}
+		}
+		str, err := in.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		} else if !strings.HasPrefix(str, expect) {
+			t.Error("sent", line, "expected", expect, "but got", str)
+		}
+	}
+	cmd("", "220")
+	cmd("HELO host", "250")
+	for i := 0; i < 2; i++ {
+		cmd("MAIL FROM:<test@example.com>", "250")
+		cmd("RCPT TO:<a@example.com>", "250")
+		cmd("DATA", "354")
+		cmd("Subject: Test\r\n\r\nHello\r\n.", "250")
+	}
+	cmd("MAIL FROM:<test@example.com>", "421 4.7.0")
+	if _, err := in.ReadString('\n'); err != io.EOF {
+		t.Error("expected the connection to be closed, got", err)
+	}
+}
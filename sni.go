@@ -0,0 +1,198 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// sniCheckInterval is how often the files of the SNI certificates are checked for changes
+var sniCheckInterval = time.Minute
+
+// sniCert is a certificate of sni_certificates
+type sniCert struct {
+	publicKeyFile, privateKeyFile string
+	cert                          *tls.Certificate
+	// names are the DNS names of the certificate, lower case, or its common name when it has none
+	names []string
+	// modified is when the files last changed
+	modified time.Time
+}
+
+// loadSNICert reads the certificate of an entry, "<public_key_file> <private_key_file>"
+func loadSNICert(entry string) (*sniCert, error) {
+	files := strings.Fields(entry)
+	if len(files) != 2 {
+		return nil, fmt.Errorf("%q should be <public_key_file> <private_key_file>", entry)
+	}
+	c := &sniCert{publicKeyFile: files[0], privateKeyFile: files[1]}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lastModified returns when the files last changed
+func (c *sniCert) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{c.publicKeyFile, c.privateKeyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (c *sniCert) load() error {
+	modified, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.publicKeyFile, c.privateKeyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("the certificate %s has no names", c.publicKeyFile)
+	}
+	c.names = make([]string, len(names))
+	for i, name := range names {
+		c.names[i] = strings.ToLower(name)
+	}
+	c.cert, c.modified = &cert, modified
+	return nil
+}
+
+// sniCertificates picks the certificate of the name that the client asks for
+type sniCertificates struct {
+	sync.Mutex
+	certs   []*sniCert
+	checked time.Time
+	acme    *acmeManager
+	// fallback returns the certificate of public_key_file, nil when there's none
+	fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	log      log.Logger
+}
+
+// useSNICertificates makes the TLS config choose the certificate by the name the client asks
+// for, from the sni_certificates and the ACME hosts. The certificate of public_key_file is
+// used for the other names
+func useSNICertificates(tlsConfig *tls.Config, sConfig *ServerTLSConfig, l log.Logger) error {
+	if len(sConfig.SNICertificates) == 0 && len(sConfig.ACMEHosts) == 0 {
+		return nil
+	}
+	s := &sniCertificates{log: l, checked: time.Now()}
+	for _, entry := range sConfig.SNICertificates {
+		c, err := loadSNICert(entry)
+		if err != nil {
+			return fmt.Errorf("sni_certificates: %s", err)
+		}
+		s.certs = append(s.certs, c)
+	}
+	if len(sConfig.ACMEHosts) > 0 {
+		m, err := useACME(sConfig, l)
+		if err != nil {
+			return err
+		}
+		s.acme = m
+	}
+	if tlsConfig.GetCertificate != nil {
+		s.fallback = tlsConfig.GetCertificate
+	} else if len(tlsConfig.Certificates) > 0 {
+		cert := tlsConfig.Certificates[0]
+		s.fallback = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+	// GetCertificate is only used when there are no Certificates
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = s.getCertificate
+	return nil
+}
+
+// getCertificate is the tls.Config's GetCertificate
+func (s *sniCertificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if s.acme != nil && name != "" && s.acme.covers(name) {
+		return s.acme.getCertificate(hello)
+	}
+	if cert := s.match(name); cert != nil {
+		return cert, nil
+	}
+	if s.fallback != nil {
+		return s.fallback(hello)
+	}
+	if s.acme != nil {
+		// clients that don't ask for a name get the first ACME host's
+		return s.acme.getCertificate(hello)
+	}
+	if len(s.certs) > 0 {
+		return s.match(s.certs[0].names[0]), nil
+	}
+	return nil, errors.New("no certificate")
+}
+
+// match returns the certificate with the name, or a wildcard name of its parent domain. Nil when
+// there's none
+func (s *sniCertificates) match(name string) *tls.Certificate {
+	s.Lock()
+	defer s.Unlock()
+	s.reload()
+	wildcard := ""
+	if i := strings.Index(name, "."); i > 0 {
+		wildcard = "*" + name[i:]
+	}
+	for _, want := range []string{name, wildcard} {
+		if want == "" {
+			continue
+		}
+		for _, c := range s.certs {
+			for _, n := range c.names {
+				if n == want {
+					return c.cert
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reload reads the certificates whose files changed, at most every sniCheckInterval. A certificate
+// that can't be read keeps the previous one. Called with the lock held
+func (s *sniCertificates) reload() {
+	now := time.Now()
+	if now.Sub(s.checked) < sniCheckInterval {
+		return
+	}
+	s.checked = now
+	for _, c := range s.certs {
+		if modified, err := c.lastModified(); err == nil && modified.Equal(c.modified) {
+			continue
+		}
+		if err := c.load(); err != nil {
+			s.log.WithError(err).Errorf("failed to reload the certificate %s", c.publicKeyFile)
+			continue
+		}
+		s.log.Infof("reloaded the certificate %s", c.publicKeyFile)
+	}
+}
@@ -0,0 +1,117 @@
+package guerrilla
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// writeTestKeyPair writes the certificate and its key to name.pem and name.key in the dir, and
+// returns the sni_certificates entry
+func writeTestKeyPair(t *testing.T, dir, name string, cert tls.Certificate) string {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(pub, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(priv, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pub + " " + priv
+}
+
+func TestSNICertificates(t *testing.T) {
+	defer func(interval time.Duration) {
+		sniCheckInterval = interval
+	}(sniCheckInterval)
+	dir, err := ioutil.TempDir("", "sni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	ca := newTestCertCA(t, "test CA")
+	issue := func(names ...string) tls.Certificate {
+		return ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: names[0]}, DNSNames: names})
+	}
+	def := issue("mail.example.com")
+	org := writeTestKeyPair(t, dir, "org", issue("mx.example.org", "example.org"))
+	wildcard := writeTestKeyPair(t, dir, "net", issue("*.example.net"))
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{def}}
+	sConfig := &ServerTLSConfig{SNICertificates: []string{org, wildcard}}
+	if err := useSNICertificates(tlsConfig, sConfig, mainlog); err != nil {
+		t.Fatal(err)
+	}
+	name := func(serverName string) string {
+		cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	for serverName, want := range map[string]string{
+		"mx.example.org":    "mx.example.org",
+		"MX.Example.org.":   "mx.example.org",
+		"example.org":       "mx.example.org",
+		"a.example.net":     "*.example.net",
+		"a.b.example.net":   "mail.example.com",
+		"example.net":       "mail.example.com",
+		"":                  "mail.example.com",
+		"mail.example.com":  "mail.example.com",
+		"other.example.com": "mail.example.com",
+	} {
+		if got := name(serverName); got != want {
+			t.Errorf("expected the certificate of %s for %q, got %s", want, serverName, got)
+		}
+	}
+
+	// a renewed certificate is used once its files change
+	writeTestKeyPair(t, dir, "org", issue("mx2.example.org", "mx.example.org"))
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(filepath.Join(dir, "org.pem"), later, later)
+	if got := name("mx.example.org"); got != "mx.example.org" {
+		t.Error("expected the certificate to be checked at most every interval, got", got)
+	}
+	sniCheckInterval = 0
+	if got := name("mx.example.org"); got != "mx2.example.org" {
+		t.Error("expected the renewed certificate, got", got)
+	}
+	// a broken file keeps the previous certificate
+	if err := ioutil.WriteFile(filepath.Join(dir, "org.pem"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := name("mx.example.org"); got != "mx2.example.org" {
+		t.Error("expected the previous certificate to be kept, got", got)
+	}
+
+	// without public_key_file, the first certificate is the default
+	tlsConfig = &tls.Config{}
+	if err := useSNICertificates(tlsConfig, &ServerTLSConfig{SNICertificates: []string{wildcard}}, mainlog); err != nil {
+		t.Fatal(err)
+	}
+	if got := name("mail.example.com"); got != "*.example.net" {
+		t.Error("expected the first certificate, got", got)
+	}
+
+	for _, entry := range []string{wildcard + " extra", filepath.Join(dir, "missing.pem") + " " + filepath.Join(dir, "net.key")} {
+		if err := useSNICertificates(&tls.Config{}, &ServerTLSConfig{SNICertificates: []string{entry}}, mainlog); err == nil {
+			t.Errorf("expected %q to be refused", entry)
+		}
+	}
+}
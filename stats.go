@@ -0,0 +1,200 @@
+package guerrilla
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram counts observations in buckets, like an OpenMetrics histogram. It's safe for
+// concurrent use
+type Histogram struct {
+	// bounds are the upper bounds of the buckets, in increasing order. The last bucket, +Inf,
+	// is implied
+	bounds []float64
+	counts []int64
+	sum    float64
+	sync.Mutex
+}
+
+// NewHistogram returns a histogram with the upper bounds of its buckets
+func NewHistogram(bounds ...float64) *Histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	return &Histogram{bounds: b, counts: make([]int64, len(b)+1)}
+}
+
+// Observe adds a value to its bucket
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.Unlock()
+}
+
+// Snapshot returns the cumulative counts of the buckets
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.Lock()
+	defer h.Unlock()
+	s := HistogramSnapshot{Bounds: h.bounds, Counts: make([]int64, len(h.counts)), Sum: h.sum}
+	for i, c := range h.counts {
+		s.Count += c
+		s.Counts[i] = s.Count
+	}
+	return s
+}
+
+// HistogramSnapshot is the state of a histogram at a point in time
+type HistogramSnapshot struct {
+	// Bounds are the upper bounds of the buckets, without the last one, +Inf
+	Bounds []float64 `json:"bounds"`
+	// Counts are the number of observations less than or equal to each bound, the last one
+	// is for +Inf, so it's Count
+	Counts []int64 `json:"counts"`
+	// Sum is the sum of all the observations
+	Sum float64 `json:"sum"`
+	// Count is the number of observations
+	Count int64 `json:"count"`
+}
+
+// The names of the histograms, see Daemon.Histograms
+const (
+	HistogramMessageSize     = "message_size_bytes"
+	HistogramRecipients      = "recipients_per_message"
+	HistogramSessionDuration = "session_duration_seconds"
+	HistogramSessionMessages = "messages_per_session"
+)
+
+// histograms track the shape of the traffic of all the servers, for capacity planning
+type histograms struct {
+	// messageSize and recipients are observed for each accepted message
+	messageSize *Histogram
+	recipients  *Histogram
+	// sessionDuration and sessionMessages are observed when a client disconnects
+	sessionDuration *Histogram
+	sessionMessages *Histogram
+}
+
+func newHistograms() *histograms {
+	return &histograms{
+		messageSize:     NewHistogram(1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20),
+		recipients:      NewHistogram(1, 2, 5, 10, 20, 50, 100),
+		sessionDuration: NewHistogram(0.1, 0.5, 1, 5, 10, 30, 60, 300),
+		sessionMessages: NewHistogram(0, 1, 2, 5, 10, 50, 100, 1000),
+	}
+}
+
+// accepted records a message of size bytes for rcpts recipients
+func (h *histograms) accepted(size int64, rcpts int) {
+	h.messageSize.Observe(float64(size))
+	h.recipients.Observe(float64(rcpts))
+}
+
+// session records a client that was connected for d, and sent the messages
+func (h *histograms) session(d time.Duration, messages int) {
+	h.sessionDuration.Observe(d.Seconds())
+	h.sessionMessages.Observe(float64(messages))
+}
+
+// snapshots returns the histograms by their names
+func (h *histograms) snapshots() map[string]HistogramSnapshot {
+	return map[string]HistogramSnapshot{
+		HistogramMessageSize:     h.messageSize.Snapshot(),
+		HistogramRecipients:      h.recipients.Snapshot(),
+		HistogramSessionDuration: h.sessionDuration.Snapshot(),
+		HistogramSessionMessages: h.sessionMessages.Snapshot(),
+	}
+}
+
+// openMetricsPrefix is prepended to the names of the metrics
+const openMetricsPrefix = "guerrilla_"
+
+// WriteOpenMetrics writes the histograms in the OpenMetrics text format, sorted by name
+func WriteOpenMetrics(w io.Writer, snapshots map[string]HistogramSnapshot) error {
+	if err := writeHistograms(w, snapshots); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+// writeHistograms writes the histograms in the OpenMetrics text format, without the # EOF
+func writeHistograms(w io.Writer, snapshots map[string]HistogramSnapshot) error {
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := snapshots[name]
+		metric := openMetricsPrefix + name
+		if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", metric); err != nil {
+			return err
+		}
+		for _, unit := range []string{"bytes", "seconds"} {
+			if strings.HasSuffix(name, "_"+unit) {
+				if _, err := fmt.Fprintf(w, "# UNIT %s %s\n", metric, unit); err != nil {
+					return err
+				}
+			}
+		}
+		for i, c := range s.Counts {
+			le := "+Inf"
+			if i < len(s.Bounds) {
+				le = strconv.FormatFloat(s.Bounds[i], 'f', -1, 64)
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", metric, le, c); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", metric,
+			strconv.FormatFloat(s.Sum, 'f', -1, 64), metric, s.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openMetricsLabel escapes a label value
+var openMetricsLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeTenantMetrics writes the counters of each tenant in the OpenMetrics text format, labelled with the
+// tenant's name
+func writeTenantMetrics(w io.Writer, stats map[string]TenantStats) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counters := []struct {
+		name  string
+		value func(TenantStats) int64
+	}{
+		{"tenant_messages", func(s TenantStats) int64 { return s.Messages }},
+		{"tenant_bytes", func(s TenantStats) int64 { return s.Bytes }},
+		{"tenant_rejected", func(s TenantStats) int64 { return s.Rejected }},
+	}
+	for _, c := range counters {
+		metric := openMetricsPrefix + c.name
+		if _, err := fmt.Fprintf(w, "# TYPE %s counter\n", metric); err != nil {
+			return err
+		}
+		if c.name == "tenant_bytes" {
+			if _, err := fmt.Fprintf(w, "# UNIT %s bytes\n", metric); err != nil {
+				return err
+			}
+		}
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "%s_total{tenant=\"%s\"} %d\n", metric,
+				openMetricsLabel.Replace(name), c.value(stats[name])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
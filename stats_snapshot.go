@@ -0,0 +1,295 @@
+package guerrilla
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// StatsConfig keeps the statistics across restarts
+type StatsConfig struct {
+	// File is where the counters are saved, and loaded from when the daemon starts.
+	// They're only kept in memory when empty. Changes take effect after a restart
+	File string `json:"file,omitempty"`
+	// Interval is how often the counters are saved, eg. "5m". Defaults to 1m
+	Interval string `json:"interval,omitempty"`
+	// Days is how many days of daily counters are kept. Defaults to 30
+	Days int `json:"days,omitempty"`
+}
+
+const (
+	defaultStatsInterval = time.Minute
+	defaultStatsDays     = 30
+)
+
+// interval returns how often the counters are saved
+func (c *StatsConfig) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return defaultStatsInterval, nil
+	}
+	return time.ParseDuration(c.Interval)
+}
+
+// DailyStats are the counters of a recipient domain of a tenant for a day
+type DailyStats struct {
+	// Day is the local date, eg. "2020-03-01"
+	Day    string `json:"day"`
+	Tenant string `json:"tenant,omitempty"`
+	Domain string `json:"domain"`
+	// Messages is the number of accepted messages with recipients in the domain
+	Messages int64 `json:"messages"`
+	// Recipients is the number of recipients in the domain of the accepted messages
+	Recipients int64 `json:"recipients"`
+	// Bytes is the size of the accepted messages
+	Bytes int64 `json:"bytes"`
+	// Rejected is the number of messages with recipients in the domain that were refused after DATA
+	Rejected int64 `json:"rejected"`
+}
+
+type dailyKey struct {
+	day, tenant, domain string
+}
+
+// dailyStats counts the messages of each day, by recipient domain. It's shared by all servers
+type dailyStats struct {
+	counts map[dailyKey]*DailyStats
+	sync.Mutex
+}
+
+func newDailyStats() *dailyStats {
+	return &dailyStats{counts: make(map[dailyKey]*DailyStats)}
+}
+
+// add counts a message of size bytes for each domain of its recipients
+func (d *dailyStats) add(now time.Time, tenant string, rcpts []mail.Address, size int64, accepted bool) {
+	day := now.Format("2006-01-02")
+	d.Lock()
+	defer d.Unlock()
+	seen := make(map[string]bool, len(rcpts))
+	for i := range rcpts {
+		key := dailyKey{day: day, tenant: tenant, domain: strings.ToLower(rcpts[i].Host)}
+		s, ok := d.counts[key]
+		if !ok {
+			s = &DailyStats{Day: key.day, Tenant: key.tenant, Domain: key.domain}
+			d.counts[key] = s
+		}
+		if !accepted {
+			if !seen[key.domain] {
+				s.Rejected++
+			}
+		} else {
+			s.Recipients++
+			if !seen[key.domain] {
+				s.Messages++
+				s.Bytes += size
+			}
+		}
+		seen[key.domain] = true
+	}
+}
+
+// list returns the counters of the tenant, or of all tenants when all is true, sorted by
+// day, tenant and domain
+func (d *dailyStats) list(tenant string, all bool) []DailyStats {
+	d.Lock()
+	defer d.Unlock()
+	list := make([]DailyStats, 0, len(d.counts))
+	for _, s := range d.counts {
+		if all || s.Tenant == tenant {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.Domain < b.Domain
+	})
+	return list
+}
+
+// prune removes the days before the first day that is kept
+func (d *dailyStats) prune(now time.Time, days int) {
+	first := now.AddDate(0, 0, 1-days).Format("2006-01-02")
+	d.Lock()
+	defer d.Unlock()
+	for key := range d.counts {
+		if key.day < first {
+			delete(d.counts, key)
+		}
+	}
+}
+
+// restore adds the saved counters
+func (d *dailyStats) restore(list []DailyStats) {
+	d.Lock()
+	defer d.Unlock()
+	for i := range list {
+		s := list[i]
+		d.counts[dailyKey{day: s.Day, tenant: s.Tenant, domain: s.Domain}] = &s
+	}
+}
+
+// restore sets the counters of the tenants that are still configured
+func (ts *tenants) restore(stats map[string]TenantStats) {
+	ts.RLock()
+	defer ts.RUnlock()
+	for name, s := range stats {
+		if t, ok := ts.byName[name]; ok {
+			atomic.StoreInt64(&t.stats.Messages, s.Messages)
+			atomic.StoreInt64(&t.stats.Bytes, s.Bytes)
+			atomic.StoreInt64(&t.stats.Rejected, s.Rejected)
+		}
+	}
+}
+
+// restore sets the counts of the histogram, if it has the same buckets
+func (h *Histogram) restore(s HistogramSnapshot) {
+	if len(s.Bounds) != len(h.bounds) || len(s.Counts) != len(h.counts) {
+		return
+	}
+	for i := range s.Bounds {
+		if s.Bounds[i] != h.bounds[i] {
+			return
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+	var prev int64
+	for i, c := range s.Counts {
+		h.counts[i] = c - prev
+		prev = c
+	}
+	h.sum = s.Sum
+}
+
+// statsSnapshot is the content of the stats file
+type statsSnapshot struct {
+	Saved      time.Time                    `json:"saved"`
+	Tenants    map[string]TenantStats       `json:"tenants"`
+	Daily      []DailyStats                 `json:"daily"`
+	Histograms map[string]HistogramSnapshot `json:"histograms"`
+}
+
+// loadStats restores the counters from the stats file, if it's set and exists
+func (g *guerrilla) loadStats() error {
+	if g.Config.Stats.File == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(g.Config.Stats.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var s statsSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	g.tenants.restore(s.Tenants)
+	g.daily.restore(s.Daily)
+	g.histograms.messageSize.restore(s.Histograms[HistogramMessageSize])
+	g.histograms.recipients.restore(s.Histograms[HistogramRecipients])
+	g.histograms.sessionDuration.restore(s.Histograms[HistogramSessionDuration])
+	g.histograms.sessionMessages.restore(s.Histograms[HistogramSessionMessages])
+	g.mainlog().Infof("restored the statistics saved at %s", s.Saved.Format(time.RFC3339))
+	return nil
+}
+
+// saveStats writes the counters to the stats file, replacing it
+func (g *guerrilla) saveStats(now time.Time) error {
+	days := g.Config.Stats.Days
+	if days <= 0 {
+		days = defaultStatsDays
+	}
+	g.daily.prune(now, days)
+	if g.Config.Stats.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(statsSnapshot{
+		Saved:      now,
+		Tenants:    g.tenants.stats(),
+		Daily:      g.daily.list("", true),
+		Histograms: g.histograms.snapshots(),
+	})
+	if err != nil {
+		return err
+	}
+	path := g.Config.Stats.File
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// startStatsSaver saves the counters every interval until stopStatsSaver
+func (g *guerrilla) startStatsSaver() error {
+	if g.statsStop != nil {
+		return nil
+	}
+	interval, err := g.Config.Stats.interval()
+	if err != nil {
+		return err
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	g.statsStop, g.statsDone = stop, done
+	// so that the counters can also be saved, and the old daily ones dropped, at set times
+	backends.RegisterMaintenanceJob("stats_rollup", func() error {
+		return g.saveStats(time.Now())
+	})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				if err := g.saveStats(now); err != nil {
+					g.mainlog().WithError(err).Error("could not save the statistics")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// stopStatsSaver stops saving the counters, and saves them a last time
+func (g *guerrilla) stopStatsSaver() {
+	if g.statsStop == nil {
+		return
+	}
+	backends.RegisterMaintenanceJob("stats_rollup", nil)
+	close(g.statsStop)
+	<-g.statsDone
+	g.statsStop, g.statsDone = nil, nil
+	if err := g.saveStats(time.Now()); err != nil {
+		g.mainlog().WithError(err).Error("could not save the statistics")
+	}
+}
@@ -0,0 +1,112 @@
+package guerrilla
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+func TestDailyStats(t *testing.T) {
+	d := newDailyStats()
+	day1 := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	rcpts := []mail.Address{{User: "a", Host: "Acme.com"}, {User: "b", Host: "acme.com"}, {User: "c", Host: "other.com"}}
+	d.add(day1, "acme", rcpts, 100, true)
+	d.add(day1, "acme", rcpts[:1], 50, false)
+	d.add(day1.AddDate(0, 0, 1), "", rcpts[2:], 10, true)
+	list := d.list("acme", false)
+	if len(list) != 2 || list[0].Domain != "acme.com" || list[1].Domain != "other.com" {
+		t.Fatal("unexpected list", list)
+	}
+	if s := list[0]; s.Messages != 1 || s.Recipients != 2 || s.Bytes != 100 || s.Rejected != 1 {
+		t.Error("unexpected counters", s)
+	}
+	if all := d.list("", true); len(all) != 3 || all[2].Day != "2020-03-02" {
+		t.Error("expected the days of all tenants, got", all)
+	}
+	// only the last day is kept
+	d.prune(day1.AddDate(0, 0, 1), 1)
+	if all := d.list("", true); len(all) != 1 || all[0].Day != "2020-03-02" {
+		t.Error("expected the first day to be pruned, got", all)
+	}
+}
+
+func TestStatsRestored(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"acme.com", "example.com"},
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2525", IsEnabled: true, MaxClients: 10}},
+		Tenants:      []TenantConfig{{Name: "acme", Domains: []string{"acme.com"}, AdminToken: "acme-secret"}},
+		Admin:        AdminConfig{ListenInterface: "127.0.0.1:2580", Token: "secret"},
+		Stats:        StatsConfig{File: filepath.Join(dir, "stats.json"), Interval: "1h"},
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := bufio.NewReader(conn)
+	for _, line := range []string{"", "HELO host", "MAIL FROM:<test@example.com>", "RCPT TO:<a@acme.com>",
+		"DATA", "Subject: Test\r\n\r\nHello\r\n.", "MAIL FROM:<test@example.com>", "RCPT TO:<b@example.com>",
+		"DATA", "Subject: Test\r\n\r\nHello\r\n.", "QUIT"} {
+		if line != "" {
+			_, _ = fmt.Fprint(conn, line+"\r\n")
+		}
+		if _, err := in.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+	// saved when the daemon is shut down
+	d.Shutdown()
+
+	d = Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+	if s := d.TenantStats()["acme"]; s.Messages != 1 {
+		t.Error("expected the tenant's counters to be restored, got", s)
+	}
+	if daily := d.DailyStats(); len(daily) != 2 || daily[0].Domain != "example.com" || daily[0].Messages != 1 {
+		t.Error("expected the daily counters to be restored, got", daily)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:2580/stats", nil)
+	req.Header.Set("Authorization", "Bearer acme-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var stats AdminStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Tenants) != 1 || stats.Tenants["acme"].Messages != 1 || len(stats.Daily) != 1 ||
+		stats.Daily[0].Domain != "acme.com" {
+		t.Error("expected only the tenant's counters, got", stats)
+	}
+}
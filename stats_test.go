@@ -0,0 +1,120 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(10, 1, 5)
+	for _, v := range []float64{0.5, 1, 3, 7, 100} {
+		h.Observe(v)
+	}
+	s := h.Snapshot()
+	if fmt.Sprint(s.Bounds) != "[1 5 10]" || fmt.Sprint(s.Counts) != "[2 3 4 5]" || s.Count != 5 || s.Sum != 111.5 {
+		t.Error("unexpected snapshot", s)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteOpenMetrics(&buf, map[string]HistogramSnapshot{"size_bytes": s}); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# TYPE guerrilla_size_bytes histogram
+# UNIT guerrilla_size_bytes bytes
+guerrilla_size_bytes_bucket{le="1"} 2
+guerrilla_size_bytes_bucket{le="5"} 3
+guerrilla_size_bytes_bucket{le="10"} 4
+guerrilla_size_bytes_bucket{le="+Inf"} 5
+guerrilla_size_bytes_sum 111.5
+guerrilla_size_bytes_count 5
+# EOF
+`
+	if buf.String() != expect {
+		t.Errorf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"example.com"},
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2525", IsEnabled: true, MaxClients: 10}},
+		Admin:        AdminConfig{ListenInterface: "127.0.0.1:2580", Token: "secret"},
+		Tenants:      []TenantConfig{{Name: "example", Domains: []string{"example.com"}}},
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := bufio.NewReader(conn)
+	for _, line := range []string{"", "HELO host", "MAIL FROM:<test@example.com>", "RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>", "DATA", "Subject: Test\r\n\r\nHello\r\n.", "QUIT"} {
+		if line != "" {
+			_, _ = fmt.Fprint(conn, line+"\r\n")
+		}
+		if _, err := in.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+
+	get := func(token string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:2580/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// the session is recorded once the server closed the connection
+	var body string
+	for i := 0; !strings.Contains(body, "guerrilla_session_duration_seconds_count 1"); i++ {
+		if i == 50 {
+			t.Fatal("expected the session to be recorded, got", body)
+		}
+		time.Sleep(time.Millisecond * 20)
+		_, body = get("secret")
+	}
+	for _, line := range []string{
+		`guerrilla_recipients_per_message_bucket{le="1"} 0`,
+		`guerrilla_recipients_per_message_bucket{le="2"} 1`,
+		`guerrilla_message_size_bytes_bucket{le="1024"} 1`,
+		"guerrilla_message_size_bytes_count 1",
+		`guerrilla_messages_per_session_bucket{le="0"} 0`,
+		`guerrilla_messages_per_session_bucket{le="1"} 1`,
+		"# TYPE guerrilla_tenant_messages counter",
+		`guerrilla_tenant_messages_total{tenant="example"} 1`,
+		`guerrilla_tenant_rejected_total{tenant="example"} 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Error("expected", line, "in", body)
+		}
+	}
+	if h := d.Histograms()[HistogramRecipients]; h.Count != 1 || h.Sum != 2 {
+		t.Error("unexpected histogram", h)
+	}
+	if code, _ := get("other"); code != http.StatusUnauthorized {
+		t.Error("expected 401 without the admin token, got", code)
+	}
+}
@@ -0,0 +1,131 @@
+package guerrilla
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The states reported to systemd with sd_notify
+const (
+	sdReady     = "READY=1"
+	sdReloading = "RELOADING=1"
+	sdStopping  = "STOPPING=1"
+)
+
+// sdListenFdsStart is the first descriptor that systemd passes, after stdin, stdout and stderr
+const sdListenFdsStart = 3
+
+// systemdListeners are the sockets passed by systemd's socket activation, until the servers take them
+var systemdListeners = struct {
+	sync.Mutex
+	once sync.Once
+	l    []net.Listener
+	err  error
+}{}
+
+// listenersFromEnv returns the listeners of the descriptors that systemd passed, as given by the
+// LISTEN_PID and LISTEN_FDS variables. The descriptors start at start
+func listenersFromEnv(pid, fds string, start int) ([]net.Listener, error) {
+	if fds == "" {
+		return nil, nil
+	}
+	// the sockets are for this process, not a parent that didn't take them
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	listeners := make([]net.Listener, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// the listener has its own copy of the descriptor
+		_ = f.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("socket %d from systemd is not a listener: %s", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// inheritedListener returns the socket passed by systemd for the address, or nil if there is none.
+// A socket is given once, so a server that is restarted on a config reload listens by itself.
+// If the sockets couldn't be taken, the error is returned to the first caller
+func inheritedListener(addr string) (net.Listener, error) {
+	systemdListeners.Lock()
+	defer systemdListeners.Unlock()
+	systemdListeners.once.Do(func() {
+		systemdListeners.l, systemdListeners.err = listenersFromEnv(
+			os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), sdListenFdsStart)
+		// not for the processes that we start
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemdListeners.err != nil {
+		err := systemdListeners.err
+		systemdListeners.err = nil
+		return nil, err
+	}
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, nil
+	}
+	for i, l := range systemdListeners.l {
+		if got, ok := l.Addr().(*net.TCPAddr); ok && sameListenAddr(want, got) {
+			systemdListeners.l = append(systemdListeners.l[:i], systemdListeners.l[i+1:]...)
+			return l, nil
+		}
+	}
+	return nil, nil
+}
+
+// sameListenAddr returns true if a socket bound to got listens on want. A socket on all the
+// addresses, eg. ListenStream=25, is taken for "0.0.0.0:25" and "[::]:25"
+func sameListenAddr(want, got *net.TCPAddr) bool {
+	if want.Port != got.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP == nil || got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
+
+// sdNotify reports the state to systemd, when it started the process with Type=notify.
+// It does nothing when NOTIFY_SOCKET isn't set
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// in the abstract namespace
+		socket = "\x00" + socket[1:]
+	} else if !strings.HasPrefix(socket, "/") {
+		return errors.New("NOTIFY_SOCKET is not a unix socket")
+	}
+	if state == sdReloading {
+		// Type=notify-reload needs to know when the reload started
+		if usec := monotonicUsec(); usec > 0 {
+			state += "\nMONOTONIC_USEC=" + strconv.FormatUint(usec, 10)
+		}
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err = conn.Write([]byte(state))
+	return err
+}
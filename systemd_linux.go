@@ -0,0 +1,14 @@
+package guerrilla
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// monotonicUsec returns CLOCK_MONOTONIC in microseconds, the clock of systemd's timestamps
+func monotonicUsec() uint64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return uint64(ts.Sec)*1e6 + uint64(ts.Nsec)/1e3
+}
@@ -0,0 +1,143 @@
+package guerrilla
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestListenersFromEnv(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	// listenersFromEnv closes the descriptors it's given
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if l, err := listenersFromEnv(strconv.Itoa(os.Getpid()+1), "1", fd); l != nil || err != nil {
+		t.Error("expected the sockets of another process to be left, got", l, err)
+	}
+	if _, err := listenersFromEnv(pid, "x", fd); err == nil {
+		t.Error("expected an error for LISTEN_FDS")
+	}
+	listeners, err := listenersFromEnv(pid, "1", fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].Addr().String() != ln.Addr().String() {
+		t.Fatal("expected the listener, got", listeners)
+	}
+	_ = listeners[0].Close()
+
+	for _, test := range []struct {
+		want, got string
+		same      bool
+	}{
+		{"127.0.0.1:25", "127.0.0.1:25", true},
+		{"127.0.0.1:25", "127.0.0.1:26", false},
+		{"0.0.0.0:25", "[::]:25", true},
+		{":25", "0.0.0.0:25", true},
+		{"127.0.0.1:25", "[::]:25", false},
+	} {
+		want, _ := net.ResolveTCPAddr("tcp", test.want)
+		got, _ := net.ResolveTCPAddr("tcp", test.got)
+		if sameListenAddr(want, got) != test.same {
+			t.Errorf("expected %s on %s to be %v", test.want, test.got, test.same)
+		}
+	}
+}
+
+func TestSystemdSocketActivation(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if systemd passed it
+	systemdListeners.once.Do(func() {})
+	systemdListeners.Lock()
+	systemdListeners.l = append(systemdListeners.l, ln)
+	systemdListeners.Unlock()
+
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = notifications.Close()
+	}()
+	_ = os.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "notify"))
+	defer func() {
+		_ = os.Unsetenv("NOTIFY_SOCKET")
+	}()
+	notified := func(expect string) {
+		buf := make([]byte, 256)
+		n, err := notifications.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if !strings.HasPrefix(string(buf[:n]), expect) {
+			t.Errorf("expected %q to be notified, got %q", expect, buf[:n])
+		}
+	}
+
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface: ln.Addr().String(),
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+	})
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	notified(sdReady)
+	if l, _ := inheritedListener(ln.Addr().String()); l != nil {
+		t.Error("expected the server to have taken the socket")
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	_ = conn.Close()
+	if !strings.HasPrefix(line, "220") {
+		t.Error("expected a greeting on the passed socket, got", line)
+	}
+
+	if err := d.ReloadConfig(*cfg); err != nil {
+		t.Fatal(err)
+	}
+	notified(sdReloading + "\nMONOTONIC_USEC=")
+	notified(sdReady)
+	d.Shutdown()
+	notified(sdStopping)
+}
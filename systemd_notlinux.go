@@ -0,0 +1,8 @@
+// +build !linux
+
+package guerrilla
+
+// monotonicUsec returns 0, systemd only runs on Linux
+func monotonicUsec() uint64 {
+	return 0
+}
@@ -0,0 +1,135 @@
+package guerrilla
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+// TCPConfig tunes the sockets of a server. Go's defaults suit clients close by, senders far
+// away with a high latency may do better with bigger buffers and keep-alives that notice a
+// dead peer sooner or later
+type TCPConfig struct {
+	// KeepAlive is the interval of the keep-alive probes, eg. "30s", or "off". Defaults to Go's 15s
+	KeepAlive string `json:"keep_alive,omitempty"`
+	// NoDelay sets TCP_NODELAY, so that the replies are sent straight away. It's on by default,
+	// false turns Nagle's algorithm on
+	NoDelay *bool `json:"no_delay,omitempty"`
+	// ReadBuffer and WriteBuffer set the sizes of the socket's buffers in bytes, SO_RCVBUF and
+	// SO_SNDBUF. 0 keeps the system's defaults
+	ReadBuffer  int `json:"read_buffer,omitempty"`
+	WriteBuffer int `json:"write_buffer,omitempty"`
+	// DeferAccept only accepts a connection once the client has sent something, or the time has
+	// passed, eg. "5s". SMTP clients wait for the greeting, so it's only useful behind a proxy
+	// that speaks first. Only on Linux, it's ignored with a warning elsewhere
+	DeferAccept string `json:"defer_accept,omitempty"`
+	// Reader is how the connections are read, "buffered" (default) or "vectored". Vectored reads
+	// fill the client's buffer and a shared overflow buffer in one readv, so that a message comes
+	// in with fewer syscalls, while an idle connection holds no more than its own buffer. Only on
+	// Linux, elsewhere the connections are read as buffered with a warning. Experimental
+	Reader string `json:"reader,omitempty"`
+}
+
+// The ways to read the connections, see TCPConfig.Reader
+const (
+	TCPReaderBuffered = "buffered"
+	TCPReaderVectored = "vectored"
+)
+
+// validate checks the durations
+func (c *TCPConfig) validate() error {
+	if c.KeepAlive != "" && c.KeepAlive != "off" {
+		if d, err := time.ParseDuration(c.KeepAlive); err != nil || d <= 0 {
+			return fmt.Errorf("invalid tcp keep_alive %q", c.KeepAlive)
+		}
+	}
+	if c.DeferAccept != "" {
+		if d, err := time.ParseDuration(c.DeferAccept); err != nil || d < time.Second {
+			return fmt.Errorf("invalid tcp defer_accept %q, it needs at least a second", c.DeferAccept)
+		}
+	}
+	switch c.Reader {
+	case "", TCPReaderBuffered, TCPReaderVectored:
+	default:
+		return fmt.Errorf("invalid tcp reader %q, expecting buffered or vectored", c.Reader)
+	}
+	if c.ReadBuffer < 0 || c.WriteBuffer < 0 {
+		return fmt.Errorf("invalid tcp buffer sizes %d and %d", c.ReadBuffer, c.WriteBuffer)
+	}
+	return nil
+}
+
+// listenConfig returns how to open the listener, with the options of the listening socket
+func (c *TCPConfig) listenConfig(l log.Logger) net.ListenConfig {
+	var lc net.ListenConfig
+	if c.DeferAccept == "" {
+		return lc
+	}
+	d, _ := time.ParseDuration(c.DeferAccept)
+	lc.Control = func(network, address string, raw syscall.RawConn) error {
+		var err error
+		if ctrlErr := raw.Control(func(fd uintptr) {
+			err = setDeferAccept(fd, int(d/time.Second))
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		if err != nil {
+			l.WithError(err).Warnf("[%s] tcp defer_accept is not used", address)
+		}
+		return nil
+	}
+	return lc
+}
+
+// tune sets the options of an accepted connection. They're set for each connection, so that
+// a new config applies to the next clients
+func (c *TCPConfig) tune(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if c.KeepAlive == "off" {
+		if err := tc.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if c.KeepAlive != "" {
+		d, err := time.ParseDuration(c.KeepAlive)
+		if err != nil {
+			return err
+		}
+		if err := tc.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tc.SetKeepAlivePeriod(d); err != nil {
+			return err
+		}
+	}
+	if c.NoDelay != nil {
+		if err := tc.SetNoDelay(*c.NoDelay); err != nil {
+			return err
+		}
+	}
+	if c.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(c.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if c.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(c.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrap returns the connection to read the client from, with the reader of the config
+func (c *TCPConfig) wrap(conn net.Conn) (net.Conn, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || c.Reader != TCPReaderVectored {
+		return conn, nil
+	}
+	return newVectoredConn(tc)
+}
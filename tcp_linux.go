@@ -0,0 +1,98 @@
+package guerrilla
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDeferAccept sets TCP_DEFER_ACCEPT on the listening socket
+func setDeferAccept(fd uintptr, seconds int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, seconds)
+}
+
+// vectoredReadSize is the size of the overflow buffers of the vectored reads
+const vectoredReadSize = 64 << 10
+
+// vectoredBuffers are the overflow buffers, shared by all the connections
+var vectoredBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, vectoredReadSize)
+		return &b
+	},
+}
+
+// vectoredConn reads a connection with readv, into the caller's buffer and an overflow buffer
+// from vectoredBuffers. The overflow buffer is only taken once the socket has data, and is
+// given back as soon as its data has been read, so waiting for a client costs nothing more
+type vectoredConn struct {
+	*net.TCPConn
+	raw syscall.RawConn
+	// buf is the overflow buffer that still has data, the rest is pending
+	buf     *[]byte
+	pending []byte
+}
+
+func newVectoredConn(conn *net.TCPConn) (net.Conn, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return conn, err
+	}
+	return &vectoredConn{TCPConn: conn, raw: raw}, nil
+}
+
+// Read returns what's left of the last read first, the connection's deadlines still apply
+func (c *vectoredConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		if len(c.pending) == 0 {
+			vectoredBuffers.Put(c.buf)
+			c.buf, c.pending = nil, nil
+		}
+		return n, nil
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var n int
+	var buf *[]byte
+	var readErr error
+	err := c.raw.Read(func(fd uintptr) bool {
+		buf = vectoredBuffers.Get().(*[]byte)
+		for {
+			n, readErr = unix.Readv(int(fd), [][]byte{p, *buf})
+			if readErr != unix.EINTR {
+				break
+			}
+		}
+		if readErr == unix.EAGAIN {
+			// wait for the data without holding the buffer
+			vectoredBuffers.Put(buf)
+			buf = nil
+			return false
+		}
+		return true
+	})
+	if err == nil && readErr != nil {
+		err = &net.OpError{Op: "read", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(),
+			Err: os.NewSyscallError("readv", readErr)}
+	}
+	if err != nil || n <= len(p) {
+		if buf != nil {
+			vectoredBuffers.Put(buf)
+		}
+		if err != nil {
+			return 0, err
+		} else if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+	c.buf, c.pending = buf, (*buf)[:n-len(p)]
+	return len(p), nil
+}
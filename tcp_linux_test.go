@@ -0,0 +1,71 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVectoredConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := TCPConfig{Reader: TCPReaderVectored}
+	conn, err := c.wrap(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, ok := conn.(*vectoredConn); !ok {
+		t.Fatalf("expected a vectored connection, got %T", conn)
+	}
+
+	// the deadlines still apply while waiting
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := conn.Read(make([]byte, 10)); err == nil {
+		t.Fatal("expected the read to time out")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("expected a timeout, got", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	// more than fits the reader's buffer comes in with the overflow
+	data := "EHLO example.com\r\n" + strings.Repeat("0123456789abcdef", 10000)
+	go func() {
+		_, _ = client.Write([]byte(data))
+		_ = client.Close()
+	}()
+	r := bufio.NewReaderSize(conn, 4096)
+	line, err := r.ReadString('\n')
+	if err != nil || line != "EHLO example.com\r\n" {
+		t.Fatalf("unexpected line %q, %v", line, err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, []byte(data[len(line):])) {
+		t.Fatalf("expected %d bytes, got %d", len(data)-len(line), len(rest))
+	}
+	if vc := conn.(*vectoredConn); vc.buf != nil {
+		t.Error("expected the overflow buffer to be given back")
+	}
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+package guerrilla
+
+import (
+	"errors"
+	"net"
+)
+
+// setDeferAccept isn't supported on this platform
+func setDeferAccept(fd uintptr, seconds int) error {
+	return errors.New("TCP_DEFER_ACCEPT is only supported on Linux")
+}
+
+// newVectoredConn isn't supported on this platform, the connection is read as it is
+func newVectoredConn(conn *net.TCPConn) (net.Conn, error) {
+	return conn, errors.New("vectored reads are only supported on Linux")
+}
@@ -0,0 +1,73 @@
+package guerrilla
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestTCPConfigValidate(t *testing.T) {
+	for _, c := range []TCPConfig{
+		{KeepAlive: "soon"},
+		{KeepAlive: "-1s"},
+		{DeferAccept: "500ms"},
+		{ReadBuffer: -1},
+		{Reader: "uring"},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+	noDelay := false
+	c := TCPConfig{KeepAlive: "off", NoDelay: &noDelay, ReadBuffer: 1 << 16, DeferAccept: "5s", Reader: TCPReaderVectored}
+	if err := c.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPConfigListen(t *testing.T) {
+	noDelay := false
+	c := TCPConfig{KeepAlive: "45s", NoDelay: &noDelay, ReadBuffer: 1 << 16, WriteBuffer: 1 << 16, DeferAccept: "1s"}
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.InfoLevel.String())
+	lc := c.listenConfig(logger)
+	if lc.Control == nil {
+		t.Fatal("expected defer_accept to set the listening socket")
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	// with defer_accept on Linux, the connection is accepted once the client has sent something
+	if runtime.GOOS == "linux" {
+		_, _ = client.Write([]byte("EHLO\r\n"))
+	}
+	_ = listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * 5))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := c.tune(conn); err != nil {
+		t.Error("expected the options to be set, got", err)
+	}
+	c.KeepAlive = "off"
+	if err := c.tune(conn); err != nil {
+		t.Error("expected the keep-alives to be turned off, got", err)
+	}
+}
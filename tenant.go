@@ -0,0 +1,202 @@
+package guerrilla
+
+import (
+	"crypto/subtle"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantConfig specifies a tenant, ie. a hosted customer. Mail for one tenant is never
+// mixed with mail for another tenant in the same transaction, and each tenant has its
+// own limits and statistics.
+type TenantConfig struct {
+	// Name identifies the tenant. It's stored in the envelope's Tenant field,
+	// and storage processors use it in place of {tenant} in table names and key prefixes
+	Name string `json:"name"`
+	// Domains lists the recipient domains that belong to the tenant, * can be used as a wildcard.
+	// A server's tenant setting takes priority over the recipient's domain
+	Domains []string `json:"domains,omitempty"`
+	// RateLimit is the maximum number of messages accepted per minute. 0 means no limit
+	RateLimit int `json:"rate_limit,omitempty"`
+	// MaxSize is the maximum size of a message. 0 means the server's max_size applies
+	MaxSize int64 `json:"max_size,omitempty"`
+	// AdminToken gives access to the admin API, but only to the tenant's data
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+// TenantStats are the counters kept for each tenant
+type TenantStats struct {
+	// Messages is the number of messages accepted
+	Messages int64
+	// Bytes is the total size of the messages accepted
+	Bytes int64
+	// Rejected is the number of transactions that were refused, eg. by the rate limit or the backend
+	Rejected int64
+}
+
+type tenant struct {
+	TenantConfig
+	stats TenantStats
+	// rate limiting, a count of messages within a one-minute window
+	windowStart time.Time
+	windowCount int
+	sync.Mutex
+}
+
+// rateSlot is a message of the tenant's rate limit, taken by a transaction until its message is
+// accepted, or given back if it isn't
+type rateSlot struct {
+	t *tenant
+	// window is the start of the window that the slot was taken in
+	window time.Time
+}
+
+// reserve takes a slot of the tenant's rate limit, and returns false if it was reached.
+// The slot has no tenant when there is no limit
+func (t *tenant) reserve(now time.Time) (rateSlot, bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.RateLimit <= 0 {
+		return rateSlot{}, true
+	}
+	if now.Sub(t.windowStart) >= time.Minute {
+		t.windowStart = now
+		t.windowCount = 0
+	}
+	if t.windowCount >= t.RateLimit {
+		return rateSlot{}, false
+	}
+	t.windowCount++
+	return rateSlot{t: t, window: t.windowStart}, true
+}
+
+// release gives the slot back, unless its window has passed
+func (s rateSlot) release() {
+	if s.t == nil {
+		return
+	}
+	s.t.Lock()
+	defer s.t.Unlock()
+	if s.t.windowStart.Equal(s.window) && s.t.windowCount > 0 {
+		s.t.windowCount--
+	}
+}
+
+// maxSize returns the tenant's message size limit, 0 if none
+func (t *tenant) maxSize() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.MaxSize
+}
+
+// accepted counts a message of size bytes against the tenant. Its rate limit was counted
+// when the transaction took a slot
+func (t *tenant) accepted(size int64) {
+	atomic.AddInt64(&t.stats.Messages, 1)
+	atomic.AddInt64(&t.stats.Bytes, size)
+}
+
+// rejected counts a refused transaction against the tenant
+func (t *tenant) rejected() {
+	atomic.AddInt64(&t.stats.Rejected, 1)
+}
+
+// tenants maps names and recipient domains to tenants.
+// It is shared by all servers, so that limits apply across all listeners
+type tenants struct {
+	byName    map[string]*tenant
+	domains   map[string]*tenant
+	wildcards []string
+	sync.RWMutex
+}
+
+func newTenants() *tenants {
+	return &tenants{
+		byName:  make(map[string]*tenant),
+		domains: make(map[string]*tenant),
+	}
+}
+
+// configure sets the list of tenants. Tenants that remain in the list keep their counters
+func (ts *tenants) configure(list []TenantConfig) {
+	ts.Lock()
+	defer ts.Unlock()
+	byName := make(map[string]*tenant, len(list))
+	ts.domains = make(map[string]*tenant)
+	ts.wildcards = nil
+	for i := range list {
+		t, ok := ts.byName[list[i].Name]
+		if !ok {
+			t = &tenant{}
+		}
+		t.Lock()
+		t.TenantConfig = list[i]
+		t.Unlock()
+		byName[t.Name] = t
+		for _, d := range t.Domains {
+			d = strings.ToLower(d)
+			if strings.Contains(d, "*") {
+				ts.wildcards = append(ts.wildcards, d)
+			}
+			ts.domains[d] = t
+		}
+	}
+	ts.byName = byName
+}
+
+// get returns the named tenant, or nil if not found
+func (ts *tenants) get(name string) *tenant {
+	ts.RLock()
+	defer ts.RUnlock()
+	return ts.byName[name]
+}
+
+// forDomain returns the tenant that the domain belongs to, or nil if none
+func (ts *tenants) forDomain(domain string) *tenant {
+	ts.RLock()
+	defer ts.RUnlock()
+	domain = strings.ToLower(domain)
+	if t, ok := ts.domains[domain]; ok {
+		return t
+	}
+	for _, w := range ts.wildcards {
+		if matched, err := filepath.Match(w, domain); matched && err == nil {
+			return ts.domains[w]
+		}
+	}
+	return nil
+}
+
+// forAdminToken returns the name of the tenant that the admin API token belongs to,
+// and false if none
+func (ts *tenants) forAdminToken(token []byte) (string, bool) {
+	ts.RLock()
+	defer ts.RUnlock()
+	for name, t := range ts.byName {
+		t.Lock()
+		adminToken := t.AdminToken
+		t.Unlock()
+		if adminToken != "" && subtle.ConstantTimeCompare(token, []byte(adminToken)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// stats returns a snapshot of the counters for each tenant, keyed by name
+func (ts *tenants) stats() map[string]TenantStats {
+	ts.RLock()
+	defer ts.RUnlock()
+	s := make(map[string]TenantStats, len(ts.byName))
+	for name, t := range ts.byName {
+		s[name] = TenantStats{
+			Messages: atomic.LoadInt64(&t.stats.Messages),
+			Bytes:    atomic.LoadInt64(&t.stats.Bytes),
+			Rejected: atomic.LoadInt64(&t.stats.Rejected),
+		}
+	}
+	return s
+}
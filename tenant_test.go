@@ -0,0 +1,156 @@
+package guerrilla
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestTenantsForDomain(t *testing.T) {
+	ts := newTenants()
+	ts.configure([]TenantConfig{
+		{Name: "acme", Domains: []string{"acme.com", "*.acme.com"}},
+		{Name: "globex", Domains: []string{"Globex.com"}},
+	})
+	testTable := map[string]string{
+		"acme.com":      "acme",
+		"mail.acme.com": "acme",
+		"GLOBEX.COM":    "globex",
+		"initech.com":   "",
+	}
+	for domain, name := range testTable {
+		found := ""
+		if tenant := ts.forDomain(domain); tenant != nil {
+			found = tenant.Name
+		}
+		if found != name {
+			t.Error("expected tenant", name, "for", domain, "but got", found)
+		}
+	}
+
+	// counters must survive a reconfigure
+	ts.get("acme").accepted(100)
+	ts.configure([]TenantConfig{{Name: "acme", RateLimit: 1}})
+	if s := ts.stats()["acme"]; s.Messages != 1 || s.Bytes != 100 {
+		t.Error("expected the acme counters to be kept, got", s)
+	}
+	if _, ok := ts.get("acme").reserve(time.Now()); !ok {
+		t.Error("expected acme to have a slot")
+	}
+	if _, ok := ts.get("acme").reserve(time.Now()); ok {
+		t.Error("expected acme to be rate limited")
+	}
+	if ts.get("globex") != nil {
+		t.Error("expected globex to be removed")
+	}
+}
+
+func TestTenantRateSlot(t *testing.T) {
+	ts := newTenants()
+	ts.configure([]TenantConfig{{Name: "acme", RateLimit: 2}})
+	acme := ts.get("acme")
+	now := time.Now()
+	first, ok := acme.reserve(now)
+	if !ok {
+		t.Fatal("expected a slot")
+	}
+	if _, ok := acme.reserve(now); !ok {
+		t.Fatal("expected a second slot")
+	}
+	// unfinished transactions hold their slots
+	if _, ok := acme.reserve(now); ok {
+		t.Error("expected acme to be rate limited")
+	}
+	first.release()
+	if _, ok := acme.reserve(now); !ok {
+		t.Error("expected the released slot to be taken again")
+	}
+	// a slot of a passed window doesn't count against the new one
+	slot, _ := ts.get("acme").reserve(now.Add(time.Minute))
+	first.release()
+	slot.release()
+	if _, ok := acme.reserve(now.Add(time.Minute)); !ok {
+		t.Error("expected a slot in the new window")
+	}
+	if _, ok := acme.reserve(now.Add(time.Minute)); !ok {
+		t.Error("expected a second slot in the new window")
+	}
+	if _, ok := acme.reserve(now.Add(time.Minute)); ok {
+		t.Error("expected acme to be rate limited in the new window")
+	}
+	// without a limit the slot is empty
+	ts.configure([]TenantConfig{{Name: "acme"}})
+	if slot, ok := ts.get("acme").reserve(now); !ok || slot.t != nil {
+		t.Error("expected an empty slot without a limit")
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"acme.com", "globex.com"},
+		Tenants: []TenantConfig{
+			{Name: "acme", Domains: []string{"acme.com"}, RateLimit: 1},
+			{Name: "globex", Domains: []string{"globex.com"}},
+		},
+	}
+	cfg.BackendConfig = backends.BackendConfig{
+		"save_process":       "HeadersParser|Debugger",
+		"log_received_mails": true,
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	cmd := func(line, expect string) {
+		if line != "" {
+			if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+				t.Error(err)
+			}
+		}
+		str, err := in.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		} else if !strings.HasPrefix(str, expect) {
+			t.Error("sent", line, "expected", expect, "but got", str)
+		}
+	}
+	cmd("", "220")
+	cmd("HELO host", "250")
+	// a transaction that was reset gives its slot back
+	cmd("MAIL FROM:<test@example.com>", "250")
+	cmd("RCPT TO:<a@acme.com>", "250")
+	cmd("RSET", "250")
+	cmd("MAIL FROM:<test@example.com>", "250")
+	cmd("RCPT TO:<a@acme.com>", "250")
+	cmd("RCPT TO:<b@globex.com>", "452 4.5.3")
+	cmd("DATA", "354")
+	cmd("Subject: Test\r\n\r\nHello\r\n.", "250")
+	// acme is only allowed 1 message a minute
+	cmd("MAIL FROM:<test@example.com>", "250")
+	cmd("RCPT TO:<a@acme.com>", "451 4.7.1")
+	cmd("RCPT TO:<b@globex.com>", "250")
+	cmd("QUIT", "221")
+
+	stats := d.TenantStats()
+	if stats["acme"].Messages != 1 || stats["acme"].Rejected != 1 {
+		t.Error("unexpected acme stats", stats["acme"])
+	}
+}
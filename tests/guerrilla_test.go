@@ -68,7 +68,7 @@ func init() {
 			return
 		}
 		backend, _ := getBackend(config.BackendConfig, logger)
-		app, initErr = guerrilla.New(&config.AppConfig, backend, logger)
+		app, initErr = guerrilla.New(&config.AppConfig, backend, nil, logger)
 	}
 
 }
@@ -1028,7 +1028,7 @@ func TestDataMaxLength(t *testing.T) {
 				t.Error("Hello command failed", err.Error())
 			}
 
-			response, err := Command(conn, bufin, "MAIL FROM:test@grr.la")
+			response, err := Command(conn, bufin, "MAIL FROM:<test@grr.la>")
 			if err != nil {
 				t.Error("command failed", err.Error())
 			}
@@ -1046,14 +1046,18 @@ func TestDataMaxLength(t *testing.T) {
 			response, err = Command(
 				conn,
 				bufin,
-				fmt.Sprintf("Subject:test\r\n\r\nHello %s\r\n.\r\n",
+				fmt.Sprintf("Subject:test\r\n\r\nHello %s\r\n.",
 					strings.Repeat("n", int(config.Servers[0].MaxSize-20))))
 
-			//expected := "500 Line too long"
-			expected := "451 4.3.0 Error: maximum DATA size exceeded"
+			expected := "552 5.3.4 Error: maximum message size exceeded"
 			if strings.Index(response, expected) != 0 {
 				t.Error("Server did not respond with", expected, ", it said:"+response)
 			}
+			// the rest of the message was discarded, the client can go on
+			response, err = Command(conn, bufin, "RSET")
+			if err != nil || strings.Index(response, "250") != 0 {
+				t.Error("expected the connection to be kept, got", response, err)
+			}
 
 		}
 		_ = conn.Close()
@@ -1162,6 +1166,57 @@ func TestDataCommand(t *testing.T) {
 	}
 }
 
+// It should reject a message at MAIL time if the declared SIZE is too large
+func TestMailFromSizeExceeded(t *testing.T) {
+	if initErr != nil {
+		t.Error(initErr)
+		t.FailNow()
+	}
+	defer cleanTestArtifacts(t)
+	if startErrors := app.Start(); startErrors == nil {
+		conn, bufin, err := Connect(config.Servers[0], 20)
+		if err != nil {
+			// handle error
+			t.Error(err.Error(), config.Servers[0].ListenInterface)
+			t.FailNow()
+		} else {
+			if _, err := Command(conn, bufin, "HELO localtester"); err != nil {
+				t.Error("Hello command failed", err.Error())
+			}
+			response, err := Command(
+				conn,
+				bufin,
+				fmt.Sprintf("MAIL FROM:<test@grr.la> SIZE=%d", config.Servers[0].MaxSize+1))
+			if err != nil {
+				t.Error("command failed", err.Error())
+			}
+			expected := "552 5.3.4 Message size exceeds fixed maximum message size"
+			if strings.Index(response, expected) != 0 {
+				t.Error("Server did not respond with", expected, ", it said:"+response)
+			}
+			response, err = Command(
+				conn,
+				bufin,
+				fmt.Sprintf("MAIL FROM:<test@grr.la> SIZE=%d", config.Servers[0].MaxSize))
+			if err != nil {
+				t.Error("command failed", err.Error())
+			}
+			expected = "250 2.1.0 OK"
+			if strings.Index(response, expected) != 0 {
+				t.Error("Server did not respond with", expected, ", it said:"+response)
+			}
+		}
+		_ = conn.Close()
+		app.Shutdown()
+	} else {
+		if startErrors := app.Start(); startErrors != nil {
+			t.Error(startErrors)
+			app.Shutdown()
+			t.FailNow()
+		}
+	}
+}
+
 // Fuzzer crashed the server by submitting "DATA\r\n" as the first command
 func TestFuzz86f25b86b09897aed8f6c2aa5b5ee1557358a6de(t *testing.T) {
 	if initErr != nil {
@@ -1181,7 +1236,7 @@ func TestFuzz86f25b86b09897aed8f6c2aa5b5ee1557358a6de(t *testing.T) {
 				conn,
 				bufin,
 				"DATA\r\n")
-			expected := "503 5.5.1 Error: No recipients"
+			expected := "503 5.5.1 Error: No sender"
 			if strings.Index(response, expected) != 0 {
 				t.Error("Server did not respond with", expected, ", it said:"+response, err)
 			}
@@ -0,0 +1,5 @@
+// +build !race
+
+package test
+
+const raceEnabled = false
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+	"github.com/artpar/go-guerrilla/mail"
+)
+
+// TestProcessorPlugin builds the plugin in backends/testdata/plugin and uses its processor
+func TestProcessorPlugin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building a plugin is slow")
+	}
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	so := filepath.Join(dir, "plugin.so")
+	args := []string{"build", "-buildmode=plugin", "-o", so}
+	if raceEnabled {
+		// a plugin is refused when it's not built with the same flags
+		args = append(args, "-race")
+	}
+	out, err := exec.Command("go", append(args, "../backends/testdata/plugin")...).CombinedOutput()
+	if err != nil {
+		t.Skip("cannot build plugins here:", err, string(out))
+	}
+	logger, _ := log.GetLogger(log.OutputOff.String(), log.DebugLevel.String())
+	backend, err := backends.New(backends.BackendConfig{
+		"processor_plugins": []interface{}{so},
+		"save_process":      "PluginTagger",
+	}, logger)
+	if err != nil {
+		t.Fatal("could not load the plugin:", err)
+	}
+	if err = backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "test", Host: "example.com"}}
+	backend.Process(e)
+	if e.Tags.String() != "plugin:loaded" {
+		t.Error("expected the plugin's processor to tag the envelope, got", e.Tags.String())
+	}
+
+	_, err = backends.New(backends.BackendConfig{
+		"processor_plugins": []interface{}{filepath.Join(dir, "missing.so")},
+	}, logger)
+	if err == nil {
+		t.Error("expected an error for a missing plugin")
+	}
+}
@@ -0,0 +1,6 @@
+// +build race
+
+package test
+
+// raceEnabled is true when the tests are built with -race, plugins must be built the same way
+const raceEnabled = true
@@ -0,0 +1,127 @@
+package guerrilla
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// defaultTicketRotation is how often the session ticket key changes when only a key file is configured
+const defaultTicketRotation = time.Hour
+
+// ticketKeysKept is how many keys can decrypt a ticket, the current one and the previous ones
+const ticketKeysKept = 2
+
+// sessionTicketKeys rotates the keys that encrypt TLS session tickets. The keys are random,
+// or derived from a secret and the rotation period, so that the servers sharing the secret
+// can resume each other's sessions
+type sessionTicketKeys struct {
+	interval time.Duration
+	secret   []byte
+	sync.Mutex
+	// epoch is the rotation period of the keys in use
+	epoch  int64
+	random map[int64][32]byte
+}
+
+// newSessionTicketKeys returns nil when the Go defaults should be used
+func newSessionTicketKeys(tlsConfig *ServerTLSConfig) (*sessionTicketKeys, error) {
+	if tlsConfig.SessionTicketRotation == "" && tlsConfig.SessionTicketKeyFile == "" {
+		return nil, nil
+	}
+	k := &sessionTicketKeys{interval: defaultTicketRotation, epoch: -1}
+	if tlsConfig.SessionTicketRotation != "" {
+		d, err := time.ParseDuration(tlsConfig.SessionTicketRotation)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid session_ticket_rotation %q", tlsConfig.SessionTicketRotation)
+		}
+		k.interval = d
+	}
+	if tlsConfig.SessionTicketKeyFile != "" {
+		secret, err := ioutil.ReadFile(tlsConfig.SessionTicketKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read session_ticket_key_file: %s", err)
+		}
+		if k.secret = bytes.TrimSpace(secret); len(k.secret) < 16 {
+			return nil, fmt.Errorf("session_ticket_key_file [%s] should have a secret of 16 bytes or more",
+				tlsConfig.SessionTicketKeyFile)
+		}
+	} else {
+		k.random = make(map[int64][32]byte)
+	}
+	return k, nil
+}
+
+// keys returns the keys for the period of t, the first one encrypts new tickets
+func (k *sessionTicketKeys) keys(t time.Time) [][32]byte {
+	epoch := t.UnixNano() / int64(k.interval)
+	keys := make([][32]byte, 0, ticketKeysKept)
+	for i := int64(0); i < ticketKeysKept; i++ {
+		keys = append(keys, k.key(epoch-i))
+	}
+	if k.random != nil {
+		for e := range k.random {
+			if e <= epoch-ticketKeysKept {
+				delete(k.random, e)
+			}
+		}
+	}
+	return keys
+}
+
+func (k *sessionTicketKeys) key(epoch int64) [32]byte {
+	var key [32]byte
+	if k.secret != nil {
+		mac := hmac.New(sha256.New, k.secret)
+		_, _ = mac.Write([]byte("go-guerrilla session ticket key"))
+		_ = binary.Write(mac, binary.BigEndian, epoch)
+		copy(key[:], mac.Sum(nil))
+		return key
+	}
+	if key, ok := k.random[epoch]; ok {
+		return key
+	}
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err)
+	}
+	k.random[epoch] = key
+	return key
+}
+
+// rotate sets the keys of the current period on the config, when they changed
+func (k *sessionTicketKeys) rotate(tlsConfig *tls.Config, now time.Time) {
+	k.Lock()
+	defer k.Unlock()
+	epoch := now.UnixNano() / int64(k.interval)
+	if epoch == k.epoch {
+		return
+	}
+	k.epoch = epoch
+	tlsConfig.SetSessionTicketKeys(k.keys(now))
+}
+
+// useSessionTickets configures the session tickets of the server's TLS config
+func useSessionTickets(tlsConfig *tls.Config, sConfig *ServerTLSConfig) error {
+	if sConfig.SessionTicketsOff {
+		tlsConfig.SessionTicketsDisabled = true
+		return nil
+	}
+	k, err := newSessionTicketKeys(sConfig)
+	if err != nil || k == nil {
+		return err
+	}
+	k.rotate(tlsConfig, time.Now())
+	// the keys are rotated when a handshake starts, returning nil keeps using tlsConfig
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		k.rotate(tlsConfig, time.Now())
+		return nil, nil
+	}
+	return nil
+}
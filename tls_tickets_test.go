@@ -0,0 +1,134 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	keyFile := filepath.Join(dir, "ticket.key")
+	if err := ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ServerTLSConfig{SessionTicketRotation: "1h", SessionTicketKeyFile: keyFile}
+	a, err := newSessionTicketKeys(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newSessionTicketKeys(cfg)
+	now := time.Now()
+	keys := a.keys(now)
+	if len(keys) != ticketKeysKept || keys[0] != b.keys(now)[0] {
+		t.Error("expected the servers sharing the secret to have the same keys")
+	}
+	later := a.keys(now.Add(time.Hour))
+	if later[0] == keys[0] || later[1] != keys[0] {
+		t.Error("expected a new key, and the previous one to be kept")
+	}
+
+	random, err := newSessionTicketKeys(&ServerTLSConfig{SessionTicketRotation: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := random.keys(now); k[0] == keys[0] || k[0] != random.keys(now)[0] {
+		t.Error("expected random keys that last for the period")
+	}
+	random.keys(now.Add(time.Hour * 5))
+	if len(random.random) != ticketKeysKept {
+		t.Error("expected the old random keys to be forgotten, got", len(random.random))
+	}
+
+	if k, err := newSessionTicketKeys(&ServerTLSConfig{}); k != nil || err != nil {
+		t.Error("expected the Go defaults", k, err)
+	}
+	short := filepath.Join(dir, "short.key")
+	_ = ioutil.WriteFile(short, []byte("secret"), 0600)
+	for _, bad := range []ServerTLSConfig{
+		{SessionTicketRotation: "soon"},
+		{SessionTicketRotation: "1ms"},
+		{SessionTicketKeyFile: filepath.Join(dir, "missing.key")},
+		{SessionTicketKeyFile: short},
+	} {
+		if _, err := newSessionTicketKeys(&bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
+
+func TestSessionTicketResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	shared := filepath.Join(dir, "shared.key")
+	other := filepath.Join(dir, "other.key")
+	_ = ioutil.WriteFile(shared, []byte("a secret shared by the cluster"), 0600)
+	_ = ioutil.WriteFile(other, []byte("a secret of another cluster"), 0600)
+	keyFile, certFile := filepath.Join(dir, "client.key"), filepath.Join(dir, "client.pem")
+	_ = ioutil.WriteFile(keyFile, []byte(clientPrvKey), 0600)
+	_ = ioutil.WriteFile(certFile, []byte(clientPubKey), 0600)
+
+	newTLSConfig := func(secretFile string, off bool) *tls.Config {
+		s := server{}
+		s.setConfig(&ServerConfig{TLS: ServerTLSConfig{
+			StartTLSOn:           true,
+			PrivateKeyFile:       keyFile,
+			PublicKeyFile:        certFile,
+			SessionTicketKeyFile: secretFile,
+			SessionTicketsOff:    off,
+		}})
+		if err := s.configureTLS(); err != nil {
+			t.Fatal(err)
+		}
+		return s.tlsConfigStore.Load().(*tls.Config)
+	}
+	cache := tls.NewLRUClientSessionCache(4)
+	handshake := func(serverConfig *tls.Config) bool {
+		clientConn, serverConn := net.Pipe()
+		defer func() {
+			_ = clientConn.Close()
+			_ = serverConn.Close()
+		}()
+		go func() {
+			_ = tls.Server(serverConn, serverConfig).Handshake()
+		}()
+		client := tls.Client(clientConn, &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+			MaxVersion:         tls.VersionTLS12,
+		})
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return client.ConnectionState().DidResume
+	}
+
+	if handshake(newTLSConfig(shared, false)) {
+		t.Error("the first handshake can't resume")
+	}
+	if !handshake(newTLSConfig(shared, false)) {
+		t.Error("expected another server with the shared secret to resume the session")
+	}
+	if handshake(newTLSConfig(other, false)) {
+		t.Error("expected a server with another secret not to resume the session")
+	}
+	off := newTLSConfig(shared, true)
+	if handshake(off) || !off.SessionTicketsDisabled {
+		t.Error("expected session tickets to be disabled")
+	}
+}
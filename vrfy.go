@@ -0,0 +1,127 @@
+package guerrilla
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/ipaddr"
+	"github.com/artpar/go-guerrilla/mail"
+	"github.com/artpar/go-guerrilla/response"
+	"github.com/sirupsen/logrus"
+)
+
+// VRFYConfig answers VRFY and EXPN for internal tooling, by checking the address with the recipient
+// validation of the validate_process. Other clients get the usual 252 to VRFY, so that they can't
+// find out the addresses
+type VRFYConfig struct {
+	// On answers VRFY for the clients of Allowed
+	On bool `json:"on,omitempty"`
+	// ExpnOn answers EXPN too. Lists aren't expanded, a valid address is answered with itself
+	ExpnOn bool `json:"expn_on,omitempty"`
+	// Allowed are the addresses or networks of the clients that get answers, eg. "10.0.0.0/8". Required
+	Allowed []string `json:"allowed,omitempty"`
+	// PerMinute is how many VRFY and EXPN commands a client's address may give in a minute, default 10
+	PerMinute int `json:"per_minute,omitempty"`
+}
+
+const defaultVRFYPerMinute = 10
+
+// validate checks the networks
+func (c *VRFYConfig) validate() error {
+	if !c.On && !c.ExpnOn {
+		return nil
+	}
+	if len(c.Allowed) == 0 {
+		return fmt.Errorf("vrfy: allowed needs the networks of the clients")
+	}
+	for _, entry := range c.Allowed {
+		if _, err := ipaddr.Network(entry); err != nil {
+			return fmt.Errorf("vrfy: %s", err)
+		}
+	}
+	if c.PerMinute < 0 {
+		return fmt.Errorf("vrfy: per_minute can't be negative")
+	}
+	return nil
+}
+
+// allows returns true if the client's address is in an allowed network
+func (c *VRFYConfig) allows(remoteIP string) bool {
+	ip := ipaddr.Parse(remoteIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range c.Allowed {
+		if ipNet, err := ipaddr.Network(entry); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify answers VRFY, or EXPN when expn is set, with the address in arg. The address is checked in a
+// separate envelope, so that the client's transaction isn't changed
+func (s *server) verify(sc *ServerConfig, client *client, arg []byte, expn bool) {
+	r := response.Canned
+	if (expn && !sc.VRFY.ExpnOn) || (!expn && !sc.VRFY.On) || !sc.VRFY.allows(client.RemoteIP) {
+		if expn {
+			client.sendResponse(r.FailExpnNotAllowed)
+		} else {
+			client.sendResponse(r.SuccessVerifyCmd)
+		}
+		return
+	}
+	if rl, ok := s.rateStore.Load().(*rateLimiter); ok {
+		perMinute := sc.VRFY.PerMinute
+		if perMinute == 0 {
+			perMinute = defaultVRFYPerMinute
+		}
+		allowed, err := rl.take("vrfy:"+client.RemoteIP, perMinute, 0, time.Minute, time.Now())
+		if err != nil {
+			s.log().WithError(err).Warn("rate_limit: redis can't be reached, counting on this node")
+		}
+		if !allowed {
+			s.log().WithFields(logrus.Fields{"client": client.ID, "ip": client.RemoteIP}).Info("vrfy: rate limit reached")
+			client.sendResponse(r.ErrorRateLimited)
+			return
+		}
+	}
+	arg = bytes.TrimSpace(arg)
+	if len(arg) == 0 {
+		client.sendResponse(r.FailSyntaxError)
+		return
+	}
+	if arg[0] != '<' {
+		arg = append(append([]byte{'<'}, arg...), '>')
+	}
+	to, err := client.parsePath(arg, client.parser.RcptTo)
+	if err != nil {
+		client.sendResponse(err)
+		return
+	}
+	s.defaultHost(&to)
+	if (to.IP != nil && !s.allowsIp(to.IP)) || (to.IP == nil && !s.allowsHost(to.Host)) {
+		client.sendResponse(r.ErrorRelayDenied, " ", to.Host)
+		return
+	}
+	e := mail.NewEnvelope(client.RemoteIP, client.ID)
+	e.Helo, e.ESMTP, e.TLS = client.Helo, client.ESMTP, client.TLS
+	e.Tenant = sc.Tenant
+	if t := s.tenants.forDomain(to.Host); e.Tenant == "" && t != nil {
+		e.Tenant = t.Name
+	}
+	e.PushRcpt(to)
+	// the validators don't keep any state for a probe, eg. greylist triplets
+	backends.VerifyOnly(e)
+	switch err := s.backend().ValidateRcpt(e); err {
+	case nil:
+		client.sendResponse(r.SuccessVerifiedCmd, "<", to.String(), ">")
+	case backends.Greylisted, backends.StorageNotAvailable, backends.StorageTooBusy, backends.StorageTimeout:
+		// the address couldn't be checked
+		client.sendResponse(r.SuccessVerifyCmd)
+	default:
+		client.sendResponse(r.FailRcptCmd, " ", err.Error())
+	}
+}
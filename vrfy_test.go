@@ -0,0 +1,110 @@
+package guerrilla
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/artpar/go-guerrilla/backends"
+	"github.com/artpar/go-guerrilla/log"
+)
+
+func TestVRFYConfig(t *testing.T) {
+	if err := (&VRFYConfig{}).validate(); err != nil {
+		t.Error("expected no error when it's off, got", err)
+	}
+	if err := (&VRFYConfig{On: true}).validate(); err == nil {
+		t.Error("expected an error without the allowed networks")
+	}
+	if err := (&VRFYConfig{ExpnOn: true, Allowed: []string{"10.0.0.0/33"}}).validate(); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+	c := &VRFYConfig{On: true, Allowed: []string{"10.0.0.0/8", "2001:db8::1"}}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{"10.1.2.3": true, "2001:db8::1": true, "192.0.2.1": false, "": false} {
+		if c.allows(ip) != allowed {
+			t.Errorf("expected allows(%q) to be %v", ip, allowed)
+		}
+	}
+}
+
+func TestVRFY(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cfg := &AppConfig{LogFile: log.OutputOff.String(), AllowedHosts: []string{"example.com"}}
+	cfg.Servers = append(cfg.Servers, ServerConfig{
+		ListenInterface: "127.0.0.1:2526",
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+		VRFY:            VRFYConfig{On: true, ExpnOn: true, Allowed: []string{"127.0.0.0/8"}, PerMinute: 6},
+	}, ServerConfig{
+		ListenInterface: "127.0.0.1:2527",
+		IsEnabled:       true,
+		MaxClients:      2,
+		Timeout:         5,
+		VRFY:            VRFYConfig{On: true, Allowed: []string{"10.0.0.0/8"}},
+	})
+	cfg.BackendConfig = backends.BackendConfig{
+		"save_process":       "HeadersParser|Picky",
+		"validate_process":   "Picky",
+		"log_received_mails": true,
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("Picky", pickyValidator)
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	dial := func(addr string) (net.Conn, func(line, expect string)) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := bufio.NewReader(conn)
+		return conn, func(line, expect string) {
+			if line != "" {
+				if _, err := fmt.Fprint(conn, line+"\r\n"); err != nil {
+					t.Error(err)
+				}
+			}
+			str, err := in.ReadString('\n')
+			if err != nil {
+				t.Error(err)
+			} else if !strings.HasPrefix(str, expect) {
+				t.Error("sent", line, "expected", expect, "but got", str)
+			}
+		}
+	}
+	conn, cmd := dial("127.0.0.1:2526")
+	defer func() {
+		_ = conn.Close()
+	}()
+	cmd("", "220")
+	cmd("HELO host", "250")
+	cmd("VRFY <a@example.com>", "250 2.1.5 <a@example.com>")
+	cmd("VRFY b@example.com", "250 2.1.5 <b@example.com>")
+	cmd("VRFY <nobody@example.com>", "550 5.1.1")
+	// the validation can't tell
+	cmd("VRFY <busy@example.com>", "252")
+	cmd("EXPN <a@example.com>", "250 2.1.5 <a@example.com>")
+	cmd("VRFY <a@example.org>", "454 4.1.1")
+	// over the limit of 6 a minute
+	cmd("VRFY <a@example.com>", "451 4.7.1")
+	cmd("QUIT", "221")
+
+	// this server doesn't answer the loopback, and has no EXPN
+	other, cmd := dial("127.0.0.1:2527")
+	defer func() {
+		_ = other.Close()
+	}()
+	cmd("", "220")
+	cmd("HELO host", "250")
+	cmd("VRFY <nobody@example.com>", "252")
+	cmd("EXPN <a@example.com>", "550 5.7.1")
+	cmd("QUIT", "221")
+}